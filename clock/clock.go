@@ -0,0 +1,190 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package clock notices when the wall clock jumps relative to the monotonic
+// clock, which happens when NTP steps the time and when the system resumes
+// from suspend, since Linux's monotonic clock stops while suspended.
+//
+// Durations and timeouts in subtrace use the monotonic clock and the wall
+// clock is only used for timestamps that are displayed. A jump still changes
+// what the traced processes and their peers see, so timeout-based
+// interventions are held off for Grace after one and the events that span it
+// are annotated.
+package clock
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Clock reads the monotonic and wall clocks.
+type Clock interface {
+	// Mono returns the monotonic time elapsed since an arbitrary origin. It
+	// never goes backwards and doesn't advance while the system is suspended.
+	Mono() time.Duration
+
+	// Wall returns the wall clock time without a monotonic reading.
+	Wall() time.Time
+}
+
+type system struct {
+	origin time.Time
+}
+
+// System returns the system's clocks.
+func System() Clock {
+	return &system{origin: time.Now()}
+}
+
+func (c *system) Mono() time.Duration { return time.Since(c.origin) }
+func (c *system) Wall() time.Time     { return time.Now().Round(0) }
+
+// Fake is a Clock for tests that only moves when told to.
+type Fake struct {
+	mu   sync.Mutex
+	mono time.Duration
+	wall time.Time
+}
+
+// NewFake returns a fake clock whose wall clock reads wall.
+func NewFake(wall time.Time) *Fake {
+	return &Fake{wall: wall.Round(0)}
+}
+
+func (f *Fake) Mono() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mono
+}
+
+func (f *Fake) Wall() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.wall
+}
+
+// Advance moves both clocks forward by d.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mono += d
+	f.wall = f.wall.Add(d)
+}
+
+// Step moves only the wall clock by d, like an NTP step does. A positive d
+// also looks like the system was suspended for that long.
+func (f *Fake) Step(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.wall = f.wall.Add(d)
+}
+
+// JumpThreshold is how much more or less the wall clock may move than the
+// monotonic clock between two checks before it counts as a jump. Ordinary NTP
+// slewing is orders of magnitude slower.
+var JumpThreshold = 2 * time.Second
+
+// Grace is how long timeout-based interventions are held off after a jump.
+var Grace = 10 * time.Second
+
+// checkInterval is how often Loop checks for jumps.
+var checkInterval = time.Second
+
+// Jump is a discontinuity of the wall clock.
+type Jump struct {
+	Mono   time.Duration // monotonic time at which it was noticed
+	Offset time.Duration // how much further the wall clock moved than the monotonic clock
+}
+
+// Kind returns "forward" for a jump ahead, which is what a resume from
+// suspend looks like, and "backward" otherwise.
+func (j Jump) Kind() string {
+	if j.Offset > 0 {
+		return "forward"
+	}
+	return "backward"
+}
+
+// Detector notices jumps of a clock.
+type Detector struct {
+	Clock
+
+	mu    sync.Mutex
+	mono  time.Duration // at the last check
+	wall  time.Time
+	count int // jumps noticed so far
+	last  Jump
+}
+
+// NewDetector returns a detector for jumps of c.
+func NewDetector(c Clock) *Detector {
+	return &Detector{Clock: c, mono: c.Mono(), wall: c.Wall()}
+}
+
+// Default is the detector for the system's clocks.
+var Default = NewDetector(System())
+
+// Check compares how far both clocks moved since the last check and logs and
+// returns the jump if they differ by more than JumpThreshold.
+func (d *Detector) Check() (Jump, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	mono, wall := d.Mono(), d.Wall()
+	offset := wall.Sub(d.wall) - (mono - d.mono)
+	d.mono, d.wall = mono, wall
+	if offset < JumpThreshold && offset > -JumpThreshold {
+		return Jump{}, false
+	}
+
+	d.count++
+	d.last = Jump{Mono: mono, Offset: offset}
+	slog.Info("wall clock jumped, holding off timeouts", "kind", d.last.Kind(), "offset", offset.Round(time.Millisecond), "grace", Grace)
+	return d.last, true
+}
+
+// Count returns the number of jumps noticed so far.
+func (d *Detector) Count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count
+}
+
+// Since checks for a jump and returns the last one if more than count jumps
+// have been noticed. Something that recorded Count when it began uses it to
+// find out whether it spans a jump.
+func (d *Detector) Since(count int) (Jump, bool) {
+	d.Check()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.count <= count {
+		return Jump{}, false
+	}
+	return d.last, true
+}
+
+// InGrace checks for a jump and reports whether the last one was noticed less
+// than Grace ago.
+func (d *Detector) InGrace() bool {
+	d.Check()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count > 0 && d.Mono()-d.last.Mono < Grace
+}
+
+// Loop checks the default detector for jumps every second until ctx is done,
+// so that a jump is noticed even when nothing else asks.
+func Loop(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			Default.Check()
+		}
+	}
+}
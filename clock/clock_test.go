@@ -0,0 +1,56 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetector(t *testing.T) {
+	prevGrace := Grace
+	Grace = 10 * time.Second
+	t.Cleanup(func() { Grace = prevGrace })
+
+	f := NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := NewDetector(f)
+
+	// Ordinary ticking and slewing by less than the threshold isn't a jump.
+	f.Advance(time.Minute)
+	f.Step(JumpThreshold / 2)
+	if j, ok := d.Check(); ok {
+		t.Fatalf("got jump %+v after the clocks moved together", j)
+	}
+	if d.InGrace() {
+		t.Fatalf("in grace without a jump")
+	}
+	before := d.Count()
+
+	// A resume from an hour of suspend.
+	f.Step(time.Hour)
+	f.Advance(time.Second)
+	j, ok := d.Since(before)
+	if !ok || j.Offset != time.Hour || j.Kind() != "forward" {
+		t.Fatalf("got jump %+v, %v after suspend, want a forward jump by an hour", j, ok)
+	}
+	if !d.InGrace() {
+		t.Fatalf("not in grace right after a jump")
+	}
+	f.Advance(Grace)
+	if d.InGrace() {
+		t.Fatalf("still in grace %s after a jump", Grace)
+	}
+
+	// An NTP step back is noticed separately.
+	f.Step(-time.Minute)
+	if j, ok := d.Check(); !ok || j.Offset != -time.Minute || j.Kind() != "backward" {
+		t.Fatalf("got jump %+v, %v after a step back, want a backward jump by a minute", j, ok)
+	}
+	if got := d.Count(); got != before+2 {
+		t.Fatalf("got %d jumps, want %d", got, before+2)
+	}
+	if _, ok := d.Since(d.Count()); ok {
+		t.Fatalf("got a jump since the last one")
+	}
+}
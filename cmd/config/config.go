@@ -0,0 +1,247 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"gopkg.in/yaml.v3"
+	"subtrace.dev/config"
+)
+
+func NewCommand() *ffcli.Command {
+	c := new(ffcli.Command)
+	c.Name = "config"
+	c.ShortUsage = "subtrace config <subcommand>"
+	c.ShortHelp = "work with subtrace configuration files"
+	c.FlagSet = flag.NewFlagSet("config", flag.ContinueOnError)
+	c.Subcommands = []*ffcli.Command{newCheckCommand(), newValidateCommand()}
+	c.Exec = func(ctx context.Context, args []string) error {
+		fmt.Fprintf(os.Stdout, "%s\n", c.UsageFunc(c))
+		if len(args) > 0 {
+			return fmt.Errorf("unknown subcommand %q", args[0])
+		}
+		return nil
+	}
+	return c
+}
+
+type Check struct {
+	ffcli.Command
+	flags struct {
+		explain      string
+		payloadLimit int64
+		profile      string
+	}
+}
+
+func newCheckCommand() *ffcli.Command {
+	c := new(Check)
+
+	c.Name = "check"
+	c.ShortUsage = "subtrace config check [flags] <config.yaml>"
+	c.ShortHelp = "validate a config file and report rules that can never take effect"
+
+	c.FlagSet = flag.NewFlagSet("check", flag.ContinueOnError)
+	c.FlagSet.StringVar(&c.flags.explain, "explain", "", "run the sample event in this JSON file through the config and print how each rule treats it")
+	c.FlagSet.Int64Var(&c.flags.payloadLimit, "payload-limit", 4096, "the -payload-limit that subtrace run will use")
+	c.FlagSet.StringVar(&c.flags.profile, "profile", "", "the -profile that subtrace run will use")
+
+	c.Exec = c.entrypoint
+	return &c.Command
+}
+
+func (c *Check) entrypoint(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s", c.ShortUsage)
+	}
+	path := args[0]
+
+	cfg, err := newConfig(c.flags.profile)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Load(path); err != nil {
+		return fmt.Errorf("load %s: %w", path, err)
+	}
+
+	problems := cfg.Check(c.flags.payloadLimit)
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", path, p)
+	}
+
+	if c.flags.explain != "" {
+		if len(problems) > 0 {
+			fmt.Println()
+		}
+		if err := explain(os.Stdout, cfg, c.flags.explain); err != nil {
+			return fmt.Errorf("explain: %w", err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s) in %s", len(problems), path)
+	}
+	return nil
+}
+
+// newConfig returns an empty config with the comma-separated profiles added.
+func newConfig(profiles string) (*config.Config, error) {
+	cfg := config.New()
+	for _, name := range strings.Split(profiles, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if err := cfg.AddProfile(name); err != nil {
+				return nil, fmt.Errorf("-profile: %w", err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+type Validate struct {
+	ffcli.Command
+	flags struct {
+		payloadLimit int64
+		profile      string
+	}
+}
+
+func newValidateCommand() *ffcli.Command {
+	c := new(Validate)
+
+	c.Name = "validate"
+	c.ShortUsage = "subtrace config validate [flags] <config.yaml>"
+	c.ShortHelp = "report every error and rule that can never take effect in a config file, for CI"
+
+	c.FlagSet = flag.NewFlagSet("validate", flag.ContinueOnError)
+	c.FlagSet.Int64Var(&c.flags.payloadLimit, "payload-limit", 4096, "the -payload-limit that subtrace run will use")
+	c.FlagSet.StringVar(&c.flags.profile, "profile", "", "the -profile that subtrace run will use")
+
+	c.Exec = c.entrypoint
+	return &c.Command
+}
+
+// entrypoint prints every problem in the config on its own line and fails if
+// there's any. Unlike check, it doesn't stop at the first error that keeps
+// the config from loading.
+func (c *Validate) entrypoint(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s", c.ShortUsage)
+	}
+	path := args[0]
+
+	cfg, err := newConfig(c.flags.profile)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	if err := cfg.Load(path); err != nil {
+		problems = loadErrors(err)
+	} else {
+		for _, p := range cfg.Check(c.flags.payloadLimit) {
+			problems = append(problems, p.String())
+		}
+	}
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", path, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s) in %s", len(problems), path)
+	}
+	fmt.Printf("%s: ok\n", path)
+	return nil
+}
+
+// loadErrors splits an error returned by Config.Load into one message per
+// problem.
+func loadErrors(err error) []string {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var ret []string
+		for _, err := range joined.Unwrap() {
+			ret = append(ret, loadErrors(err)...)
+		}
+		return ret
+	}
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		ret := make([]string, len(te.Errors))
+		for i, msg := range te.Errors {
+			ret[i] = "decode: " + msg
+		}
+		return ret
+	}
+	return []string{err.Error()}
+}
+
+func explain(w io.Writer, cfg *config.Config, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read sample: %w", err)
+	}
+	var sample config.Sample
+	if err := json.Unmarshal(b, &sample); err != nil {
+		return fmt.Errorf("decode sample: %w", err)
+	}
+
+	ex, err := cfg.Explain(sample)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ex.Rules {
+		cond := strings.TrimSpace(r.If)
+		switch {
+		case r.Match != "" && cond != "":
+			cond = fmt.Sprintf("match %s and %s", r.Match, cond)
+		case r.Match != "":
+			cond = "match " + r.Match
+		case cond == "":
+			cond = "true"
+		}
+		var result string
+		switch {
+		case !r.Applies:
+			result = "skipped, for other processes"
+		case r.Err != nil:
+			result = fmt.Sprintf("error (not matched): %v", r.Err)
+		case r.Index == ex.Decision:
+			result = "matched, decides"
+		case r.Matched:
+			result = "matched, but an earlier rule decides"
+		default:
+			result = "not matched"
+		}
+		fmt.Fprintf(w, "rule %d (line %d): if %s then %s: %s\n", r.Index, r.Line, cond, r.Then, result)
+	}
+	if ex.Decision < 0 {
+		fmt.Fprintf(w, "event: %s (no rule matched)\n", ex.Action)
+	} else {
+		fmt.Fprintf(w, "event: %s (rule %d, line %d)\n", ex.Action, ex.Decision, ex.Rules[ex.Decision].Line)
+	}
+
+	if ex.Host == "" {
+		fmt.Fprintf(w, "payloads: unknown, the sample request has no host\n")
+		return nil
+	}
+	decision := "captured"
+	if !ex.PayloadsAllowed {
+		decision = "redacted"
+	}
+	fmt.Fprintf(w, "payloads for %s: %s (%s)\n", ex.Host, decision, ex.PayloadsReason)
+	if len(ex.Rewrites) == 0 {
+		fmt.Fprintf(w, "rewrites: none\n")
+	}
+	for _, r := range ex.Rewrites {
+		fmt.Fprintf(w, "rewrites: rewrite %d (line %d) applies\n", r.Index, r.Line)
+	}
+	return nil
+}
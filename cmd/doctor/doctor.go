@@ -0,0 +1,123 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package doctor
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"subtrace.dev/cmd/run/localproxy"
+	"subtrace.dev/procfs"
+	"subtrace.dev/stats"
+)
+
+func NewCommand() *ffcli.Command {
+	c := new(ffcli.Command)
+	c.Name = "doctor"
+	c.ShortUsage = "subtrace doctor"
+	c.ShortHelp = "check the environment for what affects the events subtrace run captures"
+	c.FlagSet = flag.NewFlagSet("doctor", flag.ContinueOnError)
+	c.Exec = func(ctx context.Context, args []string) error {
+		return run(os.Stdout)
+	}
+	return c
+}
+
+// check inspects one aspect of the environment. It writes what it found to w
+// and returns the number of findings that need attention. Detection reads
+// iptables, so it's done once and every check gets the report.
+type check struct {
+	name string
+	run  func(w io.Writer, r localproxy.Report) int
+}
+
+var checks = []check{
+	{"local proxies", checkLocalProxies},
+	{"istio sidecar", checkIstio},
+	{"procfs", checkProcfs},
+	{"ephemeral ports", checkEphemeralPorts},
+}
+
+func run(w io.Writer) error {
+	report := localproxy.Detect(os.Environ())
+
+	var problems int
+	for _, c := range checks {
+		fmt.Fprintf(w, "%s:\n", c.name)
+		problems += c.run(w, report)
+	}
+	if problems > 0 {
+		return fmt.Errorf("found %d thing(s) that affect the events", problems)
+	}
+	return nil
+}
+
+func checkLocalProxies(w io.Writer, report localproxy.Report) int {
+	if len(report.Proxies) == 0 {
+		fmt.Fprintf(w, "  ok: no proxy on this host in the environment or iptables\n")
+		return 0
+	}
+	for _, p := range report.Proxies {
+		fmt.Fprintf(w, "  warning: %s\n", p.Warning())
+	}
+	return len(report.Proxies)
+}
+
+func checkIstio(w io.Writer, report localproxy.Report) int {
+	if !report.Istio.Detected() {
+		fmt.Fprintf(w, "  ok: not detected\n")
+		return 0
+	}
+	for _, e := range report.Istio.Evidence {
+		fmt.Fprintf(w, "  detected: %s\n", e)
+	}
+	for _, line := range report.Istio.Guidance(os.Getuid()) {
+		fmt.Fprintf(w, "  - %s\n", line)
+	}
+	return 1
+}
+
+// checkProcfs probes /proc like subtrace run does at startup and reports the
+// features it would run without.
+func checkProcfs(w io.Writer, _ localproxy.Report) int {
+	degraded := procfs.Init()
+	if len(degraded) == 0 {
+		fmt.Fprintf(w, "  ok: %s is readable\n", procfs.Root)
+		return 0
+	}
+	for _, f := range degraded {
+		if f == procfs.FeatureThreads {
+			fmt.Fprintf(w, "  error: %s: subtrace run can't start without %s\n", f, procfs.Path("self/status"))
+		} else {
+			fmt.Fprintf(w, "  degraded: %s\n", f)
+		}
+	}
+	return len(degraded)
+}
+
+// checkEphemeralPorts warns when more than half of the ephemeral port range is
+// in use. subtrace run takes about as many local ports again for its loopback
+// connections, so such a range runs out under it.
+func checkEphemeralPorts(w io.Writer, _ localproxy.Report) int {
+	lo, hi, ok := stats.EphemeralPortRange()
+	if !ok {
+		fmt.Fprintf(w, "  unknown: cannot read %s\n", procfs.Path("sys/net/ipv4/ip_local_port_range"))
+		return 0
+	}
+	inUse, size, ok := stats.EphemeralPortsInUse()
+	if !ok {
+		fmt.Fprintf(w, "  ok: range %d-%d, cannot count the ports in use\n", lo, hi)
+		return 0
+	}
+	if inUse*2 > size {
+		fmt.Fprintf(w, "  warning: %d of the %d ports in range %d-%d are in use; widen net.ipv4.ip_local_port_range or enable net.ipv4.tcp_tw_reuse\n", inUse, size, lo, hi)
+		return 1
+	}
+	fmt.Fprintf(w, "  ok: %d of the %d ports in range %d-%d are in use\n", inUse, size, lo, hi)
+	return 0
+}
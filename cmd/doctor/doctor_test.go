@@ -0,0 +1,91 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package doctor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"subtrace.dev/cmd/run/localproxy"
+	"subtrace.dev/procfs"
+)
+
+// fakeProc points procfs at a directory with the given files for the rest of
+// the test and probes it.
+func fakeProc(t *testing.T, files map[string]string) {
+	t.Helper()
+	orig := procfs.Root
+	procfs.Root = t.TempDir()
+	t.Cleanup(func() {
+		procfs.Root = orig
+		procfs.Init()
+	})
+	for name, content := range files {
+		path := filepath.Join(procfs.Root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	procfs.Init()
+}
+
+func TestCheckProcfs(t *testing.T) {
+	fakeProc(t, nil)
+
+	var out strings.Builder
+	if n := checkProcfs(&out, localproxy.Report{}); n != 5 {
+		t.Errorf("got %d findings, want 5:\n%s", n, out.String())
+	}
+	if !strings.Contains(out.String(), "error: "+string(procfs.FeatureThreads)) {
+		t.Errorf("missing thread tracking, which subtrace run can't do without:\n%s", out.String())
+	}
+}
+
+func TestCheckEphemeralPorts(t *testing.T) {
+	// tcpLine is a socket of /proc/net/tcp bound to the given local port.
+	tcpLine := func(port int) string {
+		return fmt.Sprintf("   0: 0100007F:%04X 0100007F:1F90 01 00000000:00000000 00:00000000 00000000     0        0 1 1 0 20 4 30 10 -1\n", port)
+	}
+	const header = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+	for _, tt := range []struct {
+		name  string
+		used  int
+		want  int
+		state string
+	}{
+		{"plenty", 2, 0, "ok: 2 of the 10 ports"},
+		{"pressure", 6, 1, "warning: 6 of the 10 ports"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := header
+			for i := range tt.used {
+				tcp += tcpLine(40000 + i)
+			}
+			tcp += tcpLine(80) // not ephemeral
+			fakeProc(t, map[string]string{
+				"sys/net/ipv4/ip_local_port_range":   "40000\t40009\n",
+				"sys/net/ipv4/tcp_abort_on_overflow": "0\n",
+				"net/tcp":                            tcp,
+			})
+
+			var out strings.Builder
+			if n := checkEphemeralPorts(&out, localproxy.Report{}); n != tt.want || !strings.Contains(out.String(), tt.state) {
+				t.Errorf("got %d findings, want %d with %q:\n%s", n, tt.want, tt.state, out.String())
+			}
+		})
+	}
+
+	fakeProc(t, nil)
+	var out strings.Builder
+	if n := checkEphemeralPorts(&out, localproxy.Report{}); n != 0 || !strings.Contains(out.String(), "unknown") {
+		t.Errorf("got %d findings without a port range, want 0 and unknown:\n%s", n, out.String())
+	}
+}
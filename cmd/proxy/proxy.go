@@ -27,6 +27,7 @@ import (
 	"subtrace.dev/devtools"
 	"subtrace.dev/global"
 	"subtrace.dev/logging"
+	"subtrace.dev/rpc"
 	"subtrace.dev/tracer"
 )
 
@@ -111,12 +112,12 @@ func (c *Command) entrypoint(ctx context.Context, args []string) error {
 
 	if c.flags.log == nil {
 		c.flags.log = new(bool)
-		if os.Getenv("SUBTRACE_TOKEN") == "" {
+		if rpc.Token() == "" {
 			*c.flags.log = true
 		} else {
 			*c.flags.log = false
 		}
-	} else if *c.flags.log == false && os.Getenv("SUBTRACE_TOKEN") == "" {
+	} else if *c.flags.log == false && rpc.Token() == "" {
 		exists := false
 		for _, arg := range os.Args {
 			if strings.Contains(arg, "-log") {
@@ -135,11 +136,11 @@ func (c *Command) entrypoint(ctx context.Context, args []string) error {
 
 	tracer.DefaultManager.SetLog(*c.flags.log)
 
-	if os.Getenv("SUBTRACE_TOKEN") != "" && os.Getenv("SUBTRACE_LINK_ID_OVERRIDE") != "" {
+	if rpc.Token() != "" && os.Getenv("SUBTRACE_LINK_ID_OVERRIDE") != "" {
 		slog.Debug("SUBTRACE_LINK_ID_OVERRIDE is ignored when SUBTRACE_TOKEN is set")
 	}
 
-	if os.Getenv("SUBTRACE_TOKEN") != "" || c.flags.devtools == "" {
+	if rpc.Token() != "" || c.flags.devtools == "" {
 		go tracer.DefaultPublisher.Loop(ctx)
 	}
 
@@ -157,6 +158,9 @@ func (c *Command) entrypoint(ctx context.Context, args []string) error {
 		if err := c.global.Config.Load(c.flags.config); err != nil {
 			return fmt.Errorf("load config: %w", err)
 		}
+		for _, p := range c.global.Config.Check(tracer.PayloadLimitBytes) {
+			fmt.Fprintf(os.Stderr, "subtrace: warning: %s: %s\n", c.flags.config, p)
+		}
 	}
 
 	if c.flags.devtools != "" && !strings.HasPrefix(c.flags.devtools, "/") {
@@ -0,0 +1,461 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package run
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/google/martian/v3/log"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/engine"
+	"subtrace.dev/cmd/run/engine/inject"
+	"subtrace.dev/cmd/run/engine/process"
+	"subtrace.dev/cmd/run/engine/seccomp"
+	"subtrace.dev/cmd/run/fd"
+	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/devtools"
+	"subtrace.dev/procfs"
+)
+
+// NewAttachCommand returns the attach command, which traces a process that's
+// already running, along with its descendants, until it's interrupted.
+func NewAttachCommand() *ffcli.Command {
+	c := newCommand()
+
+	c.Name = "attach"
+	c.ShortUsage = "subtrace attach [flags] -pid <pid>"
+	c.ShortHelp = "trace a process that's already running"
+
+	c.FlagSet.IntVar(&c.flags.attachPID, "pid", 0, "process to trace along with its descendants")
+	c.FlagSet.BoolVar(&c.flags.noNewPrivs, "no-new-privs", false, "set no_new_privs on the process before attaching, which it needs unless it has CAP_SYS_ADMIN (setuid binaries it executes afterwards no longer gain privileges)")
+	c.UsageFunc = func(fc *ffcli.Command) string {
+		return ffcli.DefaultUsageFunc(fc) + attachHelp
+	}
+	return &c.Command
+}
+
+const attachHelp = `
+Attaching installs a seccomp filter in every process of the tree, which needs
+CAP_SYS_PTRACE (or the same user and a permissive Yama ptrace_scope). Connections
+the processes create after attaching are proxied and traced like under
+subtrace run. Sockets that were open before aren't, including connections
+accepted later on listeners that were open before, and are listed at startup.
+
+Ctrl+C detaches and leaves the processes running, but:
+  - connections traced while attached are closed when subtrace exits
+  - listeners created while attached stop accepting connections
+  - the filter can't be removed, so every filtered syscall still makes a round
+    trip through a small subtrace process that stays behind until they exit
+
+EXAMPLES
+  $ subtrace attach -pid $(pgrep -o nginx)
+  $ subtrace attach -pid 1234 -no-new-privs -har out.har
+`
+
+func (c *Command) attaching() bool {
+	return c.flags.attachPID != 0
+}
+
+// attached is a process that a seccomp filter was injected into.
+type attached struct {
+	pid int
+	sec *seccomp.Listener
+	eng *engine.Engine
+}
+
+// runAttach injects a seccomp filter into the process tree of -pid and traces
+// it until every process exits or subtrace is interrupted, in which case it
+// detaches.
+func (c *Command) runAttach() (int, error) {
+	pids, err := processTree(c.flags.attachPID)
+	if err != nil {
+		return 1, err
+	}
+
+	if c.flags.devtools != "" && !strings.HasPrefix(c.flags.devtools, "/") {
+		c.flags.devtools = "/" + c.flags.devtools
+	}
+	c.global.Devtools = devtools.NewServer(c.flags.devtools)
+
+	itab := socket.NewInodeTable()
+	syscalls := filteredSyscalls()
+	opts := inject.Options{NoNewPrivs: c.flags.noNewPrivs}
+
+	// A child forked after its parent was attached to inherits the parent's
+	// filter and is traced by the parent's engine like under subtrace run.
+	var procs []*attached
+	for _, pid := range pids {
+		a, err := inject.Attach(pid, syscalls, opts)
+		switch {
+		case err == nil:
+		case errors.Is(err, inject.ErrPermission) && len(procs) == 0:
+			printMissingSysPtrace()
+			return 1, nil
+		case errors.Is(err, inject.ErrNoNewPrivs) && len(procs) == 0:
+			return 1, fmt.Errorf("attach to %d: %w (see -no-new-privs)", pid, err)
+		case len(procs) == 0:
+			return 1, fmt.Errorf("attach to %d: %w", pid, err)
+		default:
+			fmt.Fprintf(os.Stderr, "subtrace: warning: failed to attach to descendant %d, not tracing it: %v\n", pid, err)
+			continue
+		}
+
+		p, err := process.New(c.global, itab, pid)
+		if err != nil {
+			// The filter is installed, so its notifications still need answers.
+			slog.Debug("failed to track attached process, leaving it untraced", "pid", pid, "err", err)
+		}
+		proc := &attached{pid: pid, sec: a.Listener}
+		if p != nil {
+			proc.eng = engine.New(c.global, a.Listener, itab, p)
+			c.introspect(proc.eng, itab)
+			go proc.eng.Start()
+		} else {
+			go respond(a.Listener)
+		}
+		if err := a.Release(); err != nil {
+			slog.Warn("failed to clean up after attaching", "pid", pid, "err", err)
+		}
+		procs = append(procs, proc)
+		slog.Debug("attached", "pid", pid, "listener", a.Listener.FD())
+	}
+	printUntraceable(pids)
+	fmt.Fprintf(os.Stderr, "subtrace: attached to %s, press Ctrl+C to detach\n", plural(len(procs), "process", "processes"))
+
+	var engines []*engine.Engine
+	for _, proc := range procs {
+		if proc.eng != nil {
+			engines = append(engines, proc.eng)
+		}
+	}
+
+	log.SetLevel(log.Silent)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM)
+	defer signal.Stop(sigs)
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for _, eng := range engines {
+			eng.Wait()
+		}
+	}()
+
+	progress := newShutdownProgress(c.flags.quiet, engines...)
+	select {
+	case <-exited:
+		slog.Debug("every attached process exited")
+		c.shutdown.Store(progress)
+		progress.begin()
+		defer progress.end()
+
+	case sig := <-sigs:
+		slog.Debug("detaching", "signal", sig)
+		for _, eng := range engines {
+			eng.Detach()
+		}
+		if err := handOff(procs); err != nil {
+			fmt.Fprintf(os.Stderr, "subtrace: error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "subtrace: the attached processes' filtered syscalls fail with ENOSYS once subtrace exits\n")
+		}
+		fmt.Fprintf(os.Stderr, "subtrace: detached\n")
+
+		c.shutdown.Store(progress)
+		progress.begin()
+		defer progress.end()
+	}
+
+	// See the equivalent shutdown sequence in entrypointParent.
+	for _, eng := range engines {
+		if err := eng.Close(); err != nil {
+			slog.Debug("failed to close engine cleanly", "err", err) // not fatal
+		}
+	}
+
+	progress.setPhase("connections", shutdownGracePeriod)
+	if abandoned := socket.Drain(shutdownGracePeriod, progress.abandon); abandoned > 0 {
+		slog.Debug("closed proxies still running after shutdown grace period", "count", abandoned)
+	}
+	c.writeHostsFile()
+	c.writeTLSReport()
+	c.printBandwidthSummary()
+	c.printCacheSummary()
+	return 0, nil
+}
+
+// processTree returns pid followed by its descendants, each after its parent,
+// except for subtrace itself (e.g. when attaching to the shell that started
+// it). Processes forked while the tree is being attached to may be missed.
+func processTree(pid int) ([]int, error) {
+	if _, err := os.Stat(procfs.Path("%d", pid)); err != nil {
+		return nil, fmt.Errorf("process %d: %w", pid, err)
+	}
+	if pid == os.Getpid() {
+		return nil, fmt.Errorf("cannot attach to subtrace itself")
+	}
+
+	ents, err := os.ReadDir(procfs.Path(""))
+	if err != nil {
+		return nil, fmt.Errorf("list processes: %w", err)
+	}
+	children := make(map[int][]int)
+	for _, ent := range ents {
+		child, err := strconv.Atoi(ent.Name())
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(procfs.Path("%d/stat", child))
+		if err != nil {
+			continue // exited
+		}
+		// The command name in parentheses may contain spaces and parentheses.
+		_, rest, ok := strings.Cut(string(b[strings.LastIndexByte(string(b), ')')+1:]), " ")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 2 {
+			continue
+		}
+		if ppid, err := strconv.Atoi(fields[1]); err == nil && child != os.Getpid() {
+			children[ppid] = append(children[ppid], child)
+		}
+	}
+
+	tree := []int{pid}
+	for i := 0; i < len(tree); i++ {
+		kids := children[tree[i]]
+		slices.Sort(kids)
+		tree = append(tree, kids...)
+	}
+	return tree, nil
+}
+
+// printUntraceable lists the sockets that were open in the processes before
+// attaching, which aren't traced.
+func printUntraceable(pids []int) {
+	var lines []string
+	for _, pid := range pids {
+		for _, s := range openSockets(pid) {
+			lines = append(lines, fmt.Sprintf("  pid %d fd %d: %s", pid, s.fd, s.desc))
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "subtrace: %s opened before attaching won't be traced:\n", plural(len(lines), "socket", "sockets"))
+	fmt.Fprintf(os.Stderr, "%s\n", strings.Join(lines, "\n"))
+}
+
+type openSocket struct {
+	fd   int
+	desc string
+}
+
+// openSockets returns the sockets open in process pid, described from its
+// network namespace's /proc/net tables.
+func openSockets(pid int) []openSocket {
+	ents, err := os.ReadDir(procfs.Path("%d/fd", pid))
+	if err != nil {
+		return nil
+	}
+
+	var ret []openSocket
+	var tables map[uint64]string
+	for _, ent := range ents {
+		n, err := strconv.Atoi(ent.Name())
+		if err != nil {
+			continue
+		}
+		link, err := os.Readlink(procfs.Path("%d/fd/%d", pid, n))
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		ino, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if tables == nil {
+			tables = readSocketTables(pid)
+		}
+		desc, ok := tables[ino]
+		if !ok {
+			desc = link
+		}
+		ret = append(ret, openSocket{fd: n, desc: desc})
+	}
+	slices.SortFunc(ret, func(a, b openSocket) int { return a.fd - b.fd })
+	return ret
+}
+
+// readSocketTables describes every socket in the network namespace of
+// process pid by inode.
+func readSocketTables(pid int) map[uint64]string {
+	ret := make(map[uint64]string)
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		readInetTable(ret, pid, proto)
+	}
+
+	f, err := os.Open(procfs.Path("%d/net/unix", pid))
+	if err != nil {
+		return ret
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		// Num RefCount Protocol Flags Type St Inode [Path]
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		ino, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			continue
+		}
+		desc := "unix (unnamed)"
+		if len(fields) > 7 {
+			desc = "unix " + fields[7]
+		}
+		ret[ino] = desc
+	}
+	return ret
+}
+
+// tcpStates names the states of /proc/net/tcp worth telling apart.
+var tcpStates = map[string]string{
+	"01": "established",
+	"0A": "listening",
+}
+
+func readInetTable(ret map[uint64]string, pid int, proto string) {
+	f, err := os.Open(procfs.Path("%d/net/%s", pid, proto))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		ino, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || ino == 0 {
+			continue
+		}
+		local, err1 := procfs.ParseNetAddr(fields[1])
+		remote, err2 := procfs.ParseNetAddr(fields[2])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		name := strings.TrimSuffix(proto, "6")
+		desc := fmt.Sprintf("%s %s", name, local)
+		if remote.Port() != 0 {
+			desc += fmt.Sprintf(" -> %s", remote)
+		}
+		if state, ok := tcpStates[fields[3]]; ok && name == "tcp" {
+			desc += " (" + state + ")"
+		}
+		ret[ino] = desc
+	}
+}
+
+// handOff starts a process that stays behind to answer the notifications of
+// every listener once subtrace exits. A filter can't be removed, and if its
+// listener were closed, the syscalls it notifies would fail with ENOSYS.
+func handOff(procs []*attached) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("hand off: executable: %w", err)
+	}
+	devnull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("hand off: %w", err)
+	}
+	defer devnull.Close()
+
+	files := []*os.File{devnull, devnull, devnull}
+	for _, proc := range procs {
+		dup, err := unix.Dup(proc.sec.FD())
+		if err != nil {
+			return fmt.Errorf("hand off: dup: %w", err)
+		}
+		f := os.NewFile(uintptr(dup), "seccomp")
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	p, err := os.StartProcess(self, os.Args, &os.ProcAttr{
+		Env:   append(os.Environ(), fmt.Sprintf("_SUBTRACE_RESPONDER=%d", len(procs))),
+		Files: files,
+		Sys:   &syscall.SysProcAttr{Setsid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("hand off: start responder: %w", err)
+	}
+	slog.Debug("handed off listeners", "responder", p.Pid, "count", len(procs))
+	return p.Release()
+}
+
+// entrypointResponder is the process handOff starts. It answers every
+// notification of the listeners it inherited, starting at file descriptor 3,
+// by letting the kernel run the syscall, until the processes they filter have
+// all exited.
+func entrypointResponder(count string) error {
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return fmt.Errorf("responder: invalid listener count %q", count)
+	}
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			respond(seccomp.NewFromFD(fd.NewFD(3 + i)))
+		}()
+	}
+	wg.Wait()
+	os.Exit(0)
+	panic("unreachable")
+}
+
+// respond lets the kernel run every syscall the listener is notified of until
+// no process uses its filter anymore.
+func respond(sec *seccomp.Listener) {
+	defer sec.Close()
+	fds := []unix.PollFd{{Fd: int32(sec.FD()), Events: unix.POLLIN}}
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return
+		}
+		if fds[0].Revents&unix.POLLIN != 0 {
+			if n, errno := sec.Receive(); errno == 0 {
+				n.Skip()
+			}
+			continue
+		}
+		if fds[0].Revents&(unix.POLLHUP|unix.POLLERR|unix.POLLNVAL) != 0 {
+			return
+		}
+	}
+}
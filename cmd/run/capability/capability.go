@@ -0,0 +1,150 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package capability assembles a machine-readable report of what the tracer
+// can do in the current run. Each subsystem registers the features, sinks and
+// limits it owns at init, and the registered functions are evaluated when the
+// report is built so that they reflect flags and environment variables.
+package capability
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// SchemaVersion is the version of the Report document. It's bumped whenever a
+// field is removed or changes meaning; adding fields or entries doesn't bump
+// it.
+const SchemaVersion = 1
+
+// Feature describes an optional part of the tracer.
+type Feature struct {
+	// Available is whether the feature is compiled in and supported by the
+	// running kernel.
+	Available bool `json:"available"`
+	// Enabled is whether the feature is turned on for this run. It's always
+	// false if the feature isn't available.
+	Enabled bool `json:"enabled"`
+	// Detail is a short human-readable note, e.g. why a feature is
+	// unavailable.
+	Detail string `json:"detail,omitempty"`
+	// Intervenes is whether the feature changes traffic or the traced
+	// processes' behavior when enabled, instead of only observing them.
+	Intervenes bool `json:"intervenes,omitempty"`
+}
+
+// Kernel describes the running kernel.
+type Kernel struct {
+	Release   string `json:"release"`
+	Supported bool   `json:"supported"`
+}
+
+// Report is the capability document.
+type Report struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	Version       string             `json:"version"`
+	Engine        string             `json:"engine"`
+	Kernel        Kernel             `json:"kernel"`
+	Features      map[string]Feature `json:"features"`
+	Sinks         []string           `json:"sinks"`
+	Limits        map[string]int64   `json:"limits"`
+}
+
+var registry = struct {
+	mu       sync.Mutex
+	features map[string]func() Feature
+	sinks    map[string]func() bool
+	limits   map[string]func() int64
+}{
+	features: make(map[string]func() Feature),
+	sinks:    make(map[string]func() bool),
+	limits:   make(map[string]func() int64),
+}
+
+// RegisterFeature registers an optional feature. Names are snake_case.
+// Registering the same name again replaces the earlier registration.
+func RegisterFeature(name string, fn func() Feature) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.features[name] = fn
+}
+
+// RegisterSink registers an event sink. It's listed in the report if active
+// returns true.
+func RegisterSink(name string, active func() bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.sinks[name] = active
+}
+
+// RegisterLimit registers a limit in force. By convention, the name ends with
+// its unit (e.g. payload_limit_bytes) and zero means unlimited.
+func RegisterLimit(name string, value func() int64) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.limits[name] = value
+}
+
+// Collect evaluates every registered feature, sink and limit. The caller
+// fills in the version, engine and kernel.
+func Collect() Report {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	ret := Report{
+		SchemaVersion: SchemaVersion,
+		Features:      make(map[string]Feature, len(registry.features)),
+		Sinks:         []string{},
+		Limits:        make(map[string]int64, len(registry.limits)),
+	}
+	for name, fn := range registry.features {
+		f := fn()
+		f.Enabled = f.Enabled && f.Available
+		ret.Features[name] = f
+	}
+	for name, active := range registry.sinks {
+		if active() {
+			ret.Sinks = append(ret.Sinks, name)
+		}
+	}
+	slices.Sort(ret.Sinks)
+	for name, fn := range registry.limits {
+		ret.Limits[name] = fn()
+	}
+	return ret
+}
+
+// Interventions returns the sorted names of the enabled features that
+// intervene.
+func (r Report) Interventions() []string {
+	var ret []string
+	for name, f := range r.Features {
+		if f.Enabled && f.Intervenes {
+			ret = append(ret, name)
+		}
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+// Write writes the report to w as indented JSON. Map keys are sorted, so the
+// output is stable.
+func (r Report) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Handler returns an HTTP handler that serves the report built by fn.
+func Handler(fn func() Report) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		if err := fn().Write(w); err != nil {
+			slog.Debug("failed to write capabilities response", "err", err) // not fatal
+		}
+	}
+}
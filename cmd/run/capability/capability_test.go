@@ -0,0 +1,86 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capability
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// withRegistry replaces the registry for the duration of the test.
+func withRegistry(t *testing.T) {
+	registry.mu.Lock()
+	features, sinks, limits := registry.features, registry.sinks, registry.limits
+	registry.features = make(map[string]func() Feature)
+	registry.sinks = make(map[string]func() bool)
+	registry.limits = make(map[string]func() int64)
+	registry.mu.Unlock()
+
+	t.Cleanup(func() {
+		registry.mu.Lock()
+		registry.features, registry.sinks, registry.limits = features, sinks, limits
+		registry.mu.Unlock()
+	})
+}
+
+// TestReportSchema pins the JSON document. Changing the golden file means
+// tools that parse it may break, so removing or renaming a field must come
+// with a SchemaVersion bump.
+func TestReportSchema(t *testing.T) {
+	withRegistry(t)
+
+	RegisterFeature("tls_interception", func() Feature { return Feature{Available: true, Enabled: true} })
+	RegisterFeature("udp", func() Feature { return Feature{Detail: "UDP sockets are not traced"} })
+	RegisterSink("zipkin", func() bool { return true })
+	RegisterSink("log", func() bool { return true })
+	RegisterSink("devtools", func() bool { return false })
+	RegisterLimit("payload_limit_bytes", func() int64 { return 4096 })
+
+	r := Collect()
+	r.Version = "b000-test"
+	r.Engine = "seccomp_unotify"
+	r.Kernel = Kernel{Release: "6.1.0", Supported: true}
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	path := filepath.Join("testdata", "report.json")
+	if *update {
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			t.Fatalf("update golden file: %v", err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden file: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("report doesn't match %s (run with -update if intended):\ngot:\n%s\nwant:\n%s", path, buf.Bytes(), want)
+	}
+}
+
+func TestUnavailableFeatureIsNotEnabled(t *testing.T) {
+	withRegistry(t)
+
+	RegisterFeature("wait_killable_recv", func() Feature { return Feature{Available: false, Enabled: true} })
+	if f := Collect().Features["wait_killable_recv"]; f.Enabled {
+		t.Errorf("got %+v, want an unavailable feature to be reported as disabled", f)
+	}
+}
+
+func TestEmptyReport(t *testing.T) {
+	withRegistry(t)
+
+	r := Collect()
+	if r.SchemaVersion != SchemaVersion || r.Features == nil || r.Sinks == nil || r.Limits == nil {
+		t.Errorf("got %+v, want the schema version and empty (not null) collections", r)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capability_test
+
+import (
+	"testing"
+
+	"subtrace.dev/cmd/run/capability"
+	"subtrace.dev/cmd/run/engine/process"
+	"subtrace.dev/cmd/run/journal"
+	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/cmd/run/tls"
+)
+
+// TestFeatureToggles checks that the features registered by each subsystem
+// follow the variables their flags set.
+func TestFeatureToggles(t *testing.T) {
+	tests := []struct {
+		feature string
+		toggle  *bool
+		invert  bool
+	}{
+		{feature: "tls_interception", toggle: &tls.Enabled},
+		{feature: "tracelogs", toggle: &journal.Enabled},
+		{feature: "loopback_collapse", toggle: &socket.CollapseLoopback},
+		{feature: "vsock", toggle: &process.StrictSockets, invert: true},
+		{feature: "unix_seqpacket", toggle: &process.StrictSockets, invert: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.feature, func(t *testing.T) {
+			prev := *tt.toggle
+			t.Cleanup(func() { *tt.toggle = prev })
+
+			for _, val := range []bool{false, true} {
+				*tt.toggle = val
+				f, ok := capability.Collect().Features[tt.feature]
+				if !ok {
+					t.Fatalf("feature %q is not registered", tt.feature)
+				}
+				if want := val != tt.invert; !f.Available || f.Enabled != want {
+					t.Errorf("with toggle=%v: got %+v, want available and enabled=%v", val, f, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteAccountingToggle(t *testing.T) {
+	if capability.Collect().Features["write_accounting"].Enabled {
+		t.Fatalf("write accounting enabled before EnableWriteAccounting")
+	}
+	process.EnableWriteAccounting()
+	if f := capability.Collect().Features["write_accounting"]; !f.Enabled {
+		t.Errorf("got %+v after EnableWriteAccounting, want enabled", f)
+	}
+}
+
+func TestUDPFeature(t *testing.T) {
+	if f := capability.Collect().Features["udp"]; !f.Available || !f.Enabled || f.Detail == "" {
+		t.Errorf("got udp %+v, want available and enabled with a detail", f)
+	}
+}
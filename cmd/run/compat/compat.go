@@ -0,0 +1,101 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package compat is the registry of the ways a traced process can tell that
+// it's traced. Every subsystem that deliberately diverges from untraced
+// behavior, usually for performance or robustness, registers the divergence at
+// init along with the most faithful implementation available, so that strict
+// mode can switch all of them at once and report what's left.
+package compat
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Behavior is a deliberate divergence from untraced behavior.
+type Behavior struct {
+	// Name is a snake_case identifier.
+	Name string
+	// Divergence describes what the traced process observes differently by
+	// default.
+	Divergence string
+	// Strict switches to the most faithful implementation. It's nil if there
+	// is none.
+	Strict func()
+	// Residual describes what the process still observes differently in
+	// strict mode, if anything.
+	Residual string
+}
+
+var registry struct {
+	mu        sync.Mutex
+	behaviors map[string]Behavior
+	strict    bool
+}
+
+// Register registers a behavior. Registering the same name again replaces
+// the earlier registration.
+func Register(b Behavior) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.behaviors == nil {
+		registry.behaviors = make(map[string]Behavior)
+	}
+	registry.behaviors[b.Name] = b
+}
+
+// List returns every registered behavior sorted by name.
+func List() []Behavior {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	var ret []Behavior
+	for _, b := range registry.behaviors {
+		ret = append(ret, b)
+	}
+	slices.SortFunc(ret, func(a, b Behavior) int { return strings.Compare(a.Name, b.Name) })
+	return ret
+}
+
+// EnableStrict switches every registered behavior to its strict
+// implementation. It overrides flags that enable the fast ones, so it must be
+// called after flags are parsed and before tracing starts. It returns the
+// behaviors that still diverge.
+func EnableStrict() []Behavior {
+	var residual []Behavior
+	for _, b := range List() {
+		if b.Strict != nil {
+			b.Strict()
+		}
+		if b.Residual != "" {
+			residual = append(residual, b)
+		}
+	}
+
+	registry.mu.Lock()
+	registry.strict = true
+	registry.mu.Unlock()
+	return residual
+}
+
+// Strict reports whether EnableStrict has been called.
+func Strict() bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return registry.strict
+}
+
+// WriteReport writes the divergences that remain in strict mode to w.
+func WriteReport(w io.Writer, residual []Behavior) {
+	if len(residual) == 0 {
+		fmt.Fprintf(w, "subtrace: strict mode: no known divergence from untraced behavior remains\n")
+		return
+	}
+	fmt.Fprintf(w, "subtrace: strict mode: %d known divergence(s) from untraced behavior remain:\n", len(residual))
+	for _, b := range residual {
+		fmt.Fprintf(w, "  %s: %s\n", b.Name, b.Residual)
+	}
+}
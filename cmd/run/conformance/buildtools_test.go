@@ -0,0 +1,269 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build conformance
+
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildTool is a real package manager. setup skips the test if the tool
+// isn't installed, writes a project that depends on every package of the
+// registry to dir and returns the command that downloads them, its
+// environment and the files, relative to dir, that pin the downloaded
+// content and must come out the same with and without subtrace.
+type buildTool struct {
+	name string
+
+	// prefix is the path prefix of the tool's artifacts on the registry.
+	prefix string
+
+	setup func(t *testing.T, reg *registry, dir string) (argv []string, env []string, outputs []string)
+}
+
+var buildTools = []buildTool{
+	{"go", "/go/", func(t *testing.T, reg *registry, dir string) ([]string, []string, []string) {
+		requireCommand(t, "go", "version")
+		var gomod, main strings.Builder
+		gomod.WriteString("module example.test/app\n\ngo 1.21\n\nrequire (\n")
+		main.WriteString("package main\n\nimport (\n\t\"fmt\"\n\n")
+		for i := 1; i <= registryPackages; i++ {
+			fmt.Fprintf(&gomod, "\tmirror.test/dep%d v1.0.0\n", i)
+			fmt.Fprintf(&main, "\t\"mirror.test/dep%d\"\n", i)
+		}
+		gomod.WriteString(")\n")
+		main.WriteString(")\n\nfunc main() {\n\tfmt.Println(")
+		for i := 1; i <= registryPackages; i++ {
+			fmt.Fprintf(&main, "dep%d.N, ", i)
+		}
+		main.WriteString(")\n}\n")
+		writeFiles(t, dir, map[string]string{"go.mod": gomod.String(), "main.go": main.String()})
+
+		cache := t.TempDir()
+		env := []string{
+			"GOPROXY=" + reg.URL + "/go",
+			"GOSUMDB=off",
+			"GOFLAGS=-mod=mod -modcacherw",
+			"GOTOOLCHAIN=local",
+			"GOPATH=" + filepath.Join(cache, "gopath"),
+			"GOMODCACHE=" + filepath.Join(cache, "modcache"),
+			"GOCACHE=" + filepath.Join(cache, "gocache"),
+		}
+		return []string{"go", "build", "./..."}, env, []string{"go.sum"}
+	}},
+	{"npm", "/npm/", func(t *testing.T, reg *registry, dir string) ([]string, []string, []string) {
+		requireCommand(t, "npm", "--version")
+		deps := make(map[string]string)
+		for i := 1; i <= registryPackages; i++ {
+			deps[fmt.Sprintf("mirror-dep%d", i)] = "1.0.0"
+		}
+		pkg, _ := json.Marshal(map[string]any{"name": "app", "version": "1.0.0", "private": true, "dependencies": deps})
+		writeFiles(t, dir, map[string]string{"package.json": string(pkg)})
+
+		env := []string{"npm_config_cache=" + t.TempDir(), "npm_config_update_notifier=false"}
+		return []string{"npm", "install", "--registry", reg.URL + "/npm/", "--no-audit", "--no-fund"}, env, []string{"package-lock.json"}
+	}},
+	{"pip", "/pypi/", func(t *testing.T, reg *registry, dir string) ([]string, []string, []string) {
+		requireCommand(t, "python3", "-m", "pip", "--version")
+		var reqs strings.Builder
+		var outputs []string
+		for i := 1; i <= registryPackages; i++ {
+			wheel := fmt.Sprintf("mirror_dep%d-1.0.0-py3-none-any.whl", i)
+			sum := sha256.Sum256(reg.artifacts["/pypi/files/"+wheel])
+			fmt.Fprintf(&reqs, "mirror-dep%d==1.0.0 --hash=sha256:%s\n", i, hex.EncodeToString(sum[:]))
+			outputs = append(outputs, filepath.Join("wheels", wheel))
+		}
+		writeFiles(t, dir, map[string]string{"requirements.txt": reqs.String()})
+
+		u, _ := url.Parse(reg.URL)
+		env := []string{"PIP_CONFIG_FILE=" + os.DevNull, "PIP_DISABLE_PIP_VERSION_CHECK=1"}
+		argv := []string{
+			"python3", "-m", "pip", "download", "--no-deps", "--no-cache-dir",
+			"--dest", "wheels", "--index-url", reg.URL + "/pypi/simple/", "--trusted-host", u.Hostname(),
+			"--require-hashes", "-r", "requirements.txt",
+		}
+		return argv, env, outputs
+	}},
+	{"cargo", "/cargo/crates/", func(t *testing.T, reg *registry, dir string) ([]string, []string, []string) {
+		requireCommand(t, "cargo", "--version")
+		var manifest strings.Builder
+		manifest.WriteString("[package]\nname = \"app\"\nversion = \"1.0.0\"\nedition = \"2021\"\n\n[dependencies]\n")
+		for i := 1; i <= registryPackages; i++ {
+			fmt.Fprintf(&manifest, "mirror_dep%d = \"1.0.0\"\n", i)
+		}
+		home := t.TempDir()
+		writeFiles(t, dir, map[string]string{"Cargo.toml": manifest.String(), "src/main.rs": "fn main() {}\n"})
+		writeFiles(t, home, map[string]string{"config.toml": fmt.Sprintf("[source.crates-io]\nreplace-with = \"mirror\"\n\n[source.mirror]\nregistry = \"sparse+%s/cargo/index/\"\n", reg.URL)})
+
+		env := []string{"CARGO_HOME=" + home, "CARGO_TERM_COLOR=never"}
+		return []string{"cargo", "fetch"}, env, []string{"Cargo.lock"}
+	}},
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("create %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+}
+
+// buildEvent is the part of an -event-log line the build tool test looks at.
+type buildEvent struct {
+	Tags  map[string]string `json:"tags"`
+	Entry struct {
+		Request struct {
+			URL string `json:"url"`
+		} `json:"request"`
+		Response *struct {
+			Status  int `json:"status"`
+			Headers []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			} `json:"headers"`
+			Content struct {
+				Text []byte `json:"text"`
+			} `json:"content"`
+		} `json:"response"`
+	} `json:"entry"`
+}
+
+func (ev *buildEvent) header(name string) string {
+	for _, h := range ev.Entry.Response.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// runBuildTool runs the tool in a new project against reg, under subtrace
+// with the build-tools profile if traced is true. It returns the content of
+// the tool's outputs and the events subtrace logged.
+func runBuildTool(t *testing.T, tool buildTool, reg *registry, traced bool) (map[string][]byte, []buildEvent) {
+	dir := t.TempDir()
+	argv, env, outputs := tool.setup(t, reg, dir)
+
+	eventLog := filepath.Join(t.TempDir(), "events.jsonl")
+	if traced {
+		logfile := filepath.Join(t.TempDir(), "subtrace.log")
+		t.Cleanup(func() {
+			if t.Failed() {
+				b, _ := os.ReadFile(logfile)
+				t.Logf("subtrace log:\n%s", b)
+			}
+		})
+		argv = append([]string{subtraceBinary, "run", "-quiet", "-log=false", "-logfile", logfile, "-profile", "build-tools", "-event-log", eventLog, "--"}, argv...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("run %q (traced=%v): %v\n%s", argv, traced, err, out)
+	}
+
+	ret := make(map[string][]byte)
+	for _, name := range outputs {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("read output (traced=%v): %v", traced, err)
+		}
+		ret[name] = b
+	}
+	if !traced {
+		return ret, nil
+	}
+
+	f, err := os.Open(eventLog)
+	if err != nil {
+		t.Fatalf("open event log: %v", err)
+	}
+	defer f.Close()
+
+	var events []buildEvent
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 64<<20)
+	for s.Scan() {
+		var ev buildEvent
+		if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+			t.Fatalf("decode event log line: %v", err)
+		}
+		events = append(events, ev)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("read event log: %v", err)
+	}
+	return ret, events
+}
+
+// TestBuildTools downloads dependencies with real package managers from a
+// local registry mirror. The tools verify the hash of every artifact, so any
+// byte subtrace alters in transit fails the download. Under subtrace with the
+// build-tools profile, every artifact must get an event with its size and
+// cache status and without its body.
+func TestBuildTools(t *testing.T) {
+	for _, tool := range buildTools {
+		t.Run(tool.name, func(t *testing.T) {
+			reg := newRegistry(t)
+
+			untraced, _ := runBuildTool(t, tool, reg, false)
+			traced, events := runBuildTool(t, tool, reg, true)
+			for name, want := range untraced {
+				if !bytes.Equal(traced[name], want) {
+					t.Errorf("%s differs under subtrace\nwithout:\n%s\nwith:\n%s", name, want, traced[name])
+				}
+			}
+
+			for _, path := range reg.artifactPaths(tool.prefix) {
+				var found bool
+				for _, ev := range events {
+					u, err := url.Parse(ev.Entry.Request.URL)
+					if err != nil || u.Path != path || ev.Entry.Response == nil || ev.Entry.Response.Status != 200 {
+						continue
+					}
+					found = true
+
+					if got, want := ev.header("content-length"), strconv.Itoa(len(reg.artifacts[path])); got != want {
+						t.Errorf("%s: got content-length %q, want %s", path, got, want)
+					}
+					if ev.Tags["http_cache_status"] == "" {
+						t.Errorf("%s: no http_cache_status tag (tags: %v)", path, ev.Tags)
+					}
+					if got := ev.Tags["subtrace_profile"]; got != "build-tools" {
+						t.Errorf("%s: got tag subtrace_profile=%q, want build-tools", path, got)
+					}
+					if text := ev.Entry.Response.Content.Text; len(text) > 0 && !bytes.HasPrefix(text, []byte("<redacted")) {
+						t.Errorf("%s: response body kept despite the profile's payload policy (%d bytes)", path, len(text))
+					}
+				}
+				if !found {
+					t.Errorf("no 200 event for artifact %s (%d events)", path, len(events))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build conformance
+
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subtraceBinary is the subtrace binary under test. It's built once by
+// TestMain unless SUBTRACE_BINARY points to an existing one.
+var subtraceBinary string
+
+func TestMain(m *testing.M) {
+	os.Exit(func() int {
+		subtraceBinary = os.Getenv("SUBTRACE_BINARY")
+		if subtraceBinary == "" {
+			dir, err := os.MkdirTemp("", "subtrace-conformance-")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "create temp dir: %v\n", err)
+				return 1
+			}
+			defer os.RemoveAll(dir)
+
+			subtraceBinary = filepath.Join(dir, "subtrace")
+			build := func(args ...string) ([]byte, error) {
+				cmd := exec.Command("go", append(append([]string{"build", "-o", subtraceBinary}, args...), "subtrace.dev")...)
+				cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+				return cmd.CombinedOutput()
+			}
+			if out, err := build(); err != nil {
+				// Newer toolchains refuse the runtime.futex linkname unless
+				// asked not to.
+				if _, err2 := build("-ldflags=-checklinkname=0"); err2 != nil {
+					fmt.Fprintf(os.Stderr, "build subtrace: %v\n%s", err, out)
+					return 1
+				}
+			}
+		}
+		return m.Run()
+	}())
+}
+
+// client is a real HTTP client stack. setup skips the test if the client
+// isn't installed and returns the command that runs the conformance steps.
+//
+// Every client performs the same steps in order and prints one line per
+// response: the step name, the status code, the X-Conn-Requests header (the
+// number of requests served on the connection, "-" if missing) and the body
+// size. A request that fails prints the step name followed by "error".
+type client struct {
+	name  string
+	setup func(t *testing.T) []string
+}
+
+var clients = []client{
+	{"go", func(t *testing.T) []string {
+		bin := filepath.Join(t.TempDir(), "goclient")
+		cmd := exec.Command("go", "build", "-o", bin, "./testdata/goclient")
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("build go client: %v\n%s", err, out)
+		}
+		return []string{bin}
+	}},
+	{"python-requests", func(t *testing.T) []string {
+		requireCommand(t, "python3", "-c", "import requests")
+		return []string{"python3", testdata(t, "client.py")}
+	}},
+	{"node", func(t *testing.T) []string {
+		requireCommand(t, "node", "--version")
+		return []string{"node", testdata(t, "client.js")}
+	}},
+	{"java-httpclient", func(t *testing.T) []string {
+		requireCommand(t, "java", "--version")
+		return []string{"java", "-Djdk.internal.httpclient.disableHostnameVerification=true", testdata(t, "Client.java")}
+	}},
+	{"curl-http2", func(t *testing.T) []string {
+		out := requireCommand(t, "curl", "--version")
+		if !strings.Contains(out, "HTTP2") {
+			t.Skip("curl was built without HTTP/2 support")
+		}
+		return []string{"bash", testdata(t, "client.sh")}
+	}},
+}
+
+// requireCommand runs a command and skips the test if it fails.
+func requireCommand(t *testing.T, name string, args ...string) string {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Skipf("%s unavailable: %v", name, err)
+	}
+	return string(out)
+}
+
+func testdata(t *testing.T, name string) string {
+	path, err := filepath.Abs(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("resolve testdata path: %v", err)
+	}
+	return path
+}
+
+// wantSteps is the outcome of each step, as printed by every client without
+// subtrace.
+var wantSteps = []string{
+	"keepalive 200",
+	"keepalive 200",
+	"keepalive 200",
+	"tls 200",
+	"redirect 200",
+	"timeout error",
+	"close error",
+}
+
+// wantSpans is the number of spans for each name and status code that every
+// client must produce. Requests to /slow and /close don't get a response, so
+// their spans are only checked for not claiming one.
+var wantSpans = map[string]int{
+	"GET /ok 200":       5,
+	"GET /redirect 302": 1,
+}
+
+type result struct {
+	transcript string
+	hits       map[string]int
+	spans      map[string]int
+
+	unattributed int
+}
+
+// run runs argv against a new server, under subtrace if traced is true.
+func run(t *testing.T, argv []string, traced bool) result {
+	srv := newServer(t)
+
+	var col *collector
+	if traced {
+		col = newCollector(t)
+		// subtrace logs to stdout by default, which is where the client's
+		// output goes.
+		logfile := filepath.Join(t.TempDir(), "subtrace.log")
+		t.Cleanup(func() {
+			if t.Failed() {
+				b, _ := os.ReadFile(logfile)
+				t.Logf("subtrace log:\n%s", b)
+			}
+		})
+		flags := []string{subtraceBinary, "run", "-quiet", "-log=false", "-logfile", logfile, "-zipkin-endpoint", col.URL + "/api/v2/spans"}
+		if os.Getenv("SUBTRACE_CONFORMANCE_STRICT") != "" {
+			flags = append(flags, "-strict")
+		}
+		argv = append(append(flags, "--"), argv...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(), srv.env()...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run %q (traced=%v): %v\nstdout:\n%s\nstderr:\n%s", argv, traced, err, stdout.String(), stderr.String())
+	}
+
+	ret := result{
+		transcript: stdout.String(),
+		hits:       srv.hitCounts(),
+	}
+	if col != nil {
+		ret.spans = col.counts()
+		ret.unattributed = col.unattributed()
+	}
+	return ret
+}
+
+func TestClients(t *testing.T) {
+	for _, c := range clients {
+		t.Run(c.name, func(t *testing.T) {
+			argv := c.setup(t)
+
+			untraced := run(t, argv, false)
+			checkSteps(t, untraced.transcript)
+
+			traced := run(t, argv, true)
+			if traced.transcript != untraced.transcript {
+				t.Errorf("client output differs under subtrace\nwithout:\n%s\nwith:\n%s", untraced.transcript, traced.transcript)
+			}
+			if !maps.Equal(traced.hits, untraced.hits) {
+				t.Errorf("server saw different requests under subtrace: got %v, want %v", traced.hits, untraced.hits)
+			}
+
+			for name, want := range wantSpans {
+				if got := traced.spans[name]; got != want {
+					t.Errorf("got %d %q spans, want %d (all spans: %v)", got, name, want, traced.spans)
+				}
+			}
+			if traced.unattributed > 0 {
+				t.Errorf("got %d spans without process tags", traced.unattributed)
+			}
+			for name, n := range traced.spans {
+				if (strings.HasPrefix(name, "GET /slow ") || strings.HasPrefix(name, "GET /close ")) && !strings.HasSuffix(name, " 0") {
+					t.Errorf("got %d %q spans for a request that never got a response", n, name)
+				}
+			}
+		})
+	}
+}
+
+// checkSteps checks that the client itself behaved as expected so that a
+// broken client script doesn't pass by failing the same way twice.
+func checkSteps(t *testing.T, transcript string) {
+	t.Helper()
+
+	lines := strings.Split(strings.TrimSpace(transcript), "\n")
+	if len(lines) != len(wantSteps) {
+		t.Fatalf("got %d steps, want %d:\n%s", len(lines), len(wantSteps), transcript)
+	}
+	for i, want := range wantSteps {
+		if lines[i] != want && !strings.HasPrefix(lines[i], want+" ") {
+			t.Fatalf("step %d: got %q, want %q:\n%s", i, lines[i], want, transcript)
+		}
+	}
+}
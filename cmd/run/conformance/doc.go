@@ -0,0 +1,29 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package conformance traces real HTTP clients (Go, Python requests, Node,
+// Java and curl) performing a scripted set of requests against a local server
+// and checks that they behave the same with and without subtrace, and that
+// the expected events are produced. A preforking Python server checks that
+// workers forked after listen(2) accept from the listener they inherit, and a
+// Python server that the signals `docker stop` and reloads use must get them
+// through subtrace, a Ctrl-C must reach a program exactly once whether subtrace
+// is in the foreground of its terminal or not, and a program run with
+// -tracelogs in a terminal must see the terminal's window size and its changes. A Python server that
+// authenticates its clients by SO_PEERCRED must get their pids. The time subtrace adds to
+// starting a command is held to a budget. Package managers (go, npm, pip and
+// cargo) download dependencies from a local registry mirror under the
+// build-tools profile; they verify the hash of every artifact, and every
+// artifact must get an event with its size and cache status. A request still
+// in flight when the traced command exits must get its event too.
+//
+// The tests need the client toolchains, root privileges and seccomp user
+// notifications, so they're behind the conformance build tag:
+//
+//	go test -tags conformance -v ./cmd/run/conformance
+//
+// Set SUBTRACE_CONFORMANCE_STRICT=1 to trace the clients with -strict.
+//
+// conformance.Dockerfile at the root of the repository builds a container
+// with every client installed. Clients that aren't installed are skipped.
+package conformance
@@ -0,0 +1,72 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build conformance
+
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestExitDrain exits the traced command while a client it started in the
+// background is in the middle of a request, killing the client on its way out
+// like a torn down process group. Every traced process is gone by the time the
+// server responds, and subtrace must still wait for the response and log the
+// request's event with it before it exits.
+func TestExitDrain(t *testing.T) {
+	requireCommand(t, "curl", "--version")
+
+	// The server holds the response back until well after the command has
+	// exited, which it does as soon as the request arrives.
+	started := filepath.Join(t.TempDir(), "started")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		os.WriteFile(started, nil, 0o644)
+		time.Sleep(time.Second)
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	script := `curl -s -o /dev/null "$1/drain" & while [ ! -e "$2" ]; do sleep 0.01; done; kill -9 $!`
+	argv := tracedArgv(t, []string{"sh", "-c", script, "sh", srv.URL, started}, true)
+	eventLog := filepath.Join(t.TempDir(), "events.jsonl")
+	argv = append(argv[:2], append([]string{"-event-log", eventLog}, argv[2:]...)...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).CombinedOutput(); err != nil {
+		t.Fatalf("run %q: %v\n%s", argv, err, out)
+	}
+
+	b, err := os.ReadFile(eventLog)
+	if err != nil {
+		t.Fatalf("read event log: %v", err)
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(nil, 64<<20)
+	for s.Scan() {
+		var ev buildEvent
+		if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+			t.Fatalf("decode event log line: %v", err)
+		}
+		if u, err := url.Parse(ev.Entry.Request.URL); err == nil && u.Path == "/drain" {
+			if ev.Entry.Response == nil || ev.Entry.Response.Status != http.StatusOK {
+				t.Errorf("got an event without the response: %s", s.Bytes())
+			}
+			return
+		}
+	}
+	t.Errorf("no event for the request in flight when the command exited:\n%s", b)
+}
@@ -0,0 +1,64 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build conformance
+
+package conformance
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestPeerCred runs a server that authenticates its clients by SO_PEERCRED
+// and checks that it gets their pids. Under subtrace, the server must read
+// the client's pid on every connection with -peer-auth, and on every
+// connection after the first without it, once subtrace has learned that the
+// server authenticates its peers.
+func TestPeerCred(t *testing.T) {
+	requireCommand(t, "python3", "--version")
+
+	for _, tt := range []struct {
+		name     string
+		traced   bool
+		peerAuth bool
+		first    bool // whether the first connection gets the client's pid
+	}{
+		{name: "traced=false", first: true},
+		{name: "traced=true", traced: true},
+		{name: "traced=true/peer-auth", traced: true, peerAuth: true, first: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "peerauth.sock")
+			argv := tracedArgv(t, []string{"python3", testdata(t, "peerauth.py"), path, "3"}, tt.traced)
+			if tt.peerAuth {
+				argv = slices.Insert(argv, 2, "-peer-auth="+path) // after "run"
+			}
+
+			out, err := exec.Command(argv[0], argv[1:]...).Output()
+			if err != nil {
+				t.Fatalf("run %q: %v", argv, err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+			if len(lines) != 3 {
+				t.Fatalf("got %d connections, want 3:\n%s", len(lines), out)
+			}
+			for i, line := range lines {
+				var sent, cred int
+				if _, err := fmt.Sscan(line, &sent, &cred); err != nil {
+					t.Fatalf("parse %q: %v", line, err)
+				}
+				if i == 0 && !tt.first {
+					continue
+				}
+				if cred != sent {
+					t.Errorf("connection %d: got SO_PEERCRED pid %d, want the client's pid %d", i+1, cred, sent)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build conformance
+
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// preforkWorkers is the number of workers testdata/prefork.py forks.
+const preforkWorkers = 4
+
+// TestPrefork runs a server that forks its workers after listen(2) and
+// closes the listener in the parent. Every worker must accept from the
+// listener it inherited, with and without subtrace.
+func TestPrefork(t *testing.T) {
+	requireCommand(t, "python3", "--version")
+
+	for _, traced := range []bool{false, true} {
+		t.Run(fmt.Sprintf("traced=%v", traced), func(t *testing.T) {
+			argv := []string{"python3", testdata(t, "prefork.py")}
+			if traced {
+				logfile := filepath.Join(t.TempDir(), "subtrace.log")
+				t.Cleanup(func() {
+					if t.Failed() {
+						b, _ := os.ReadFile(logfile)
+						t.Logf("subtrace log:\n%s", b)
+					}
+				})
+				argv = append([]string{subtraceBinary, "run", "-quiet", "-log=false", "-logfile", logfile, "--"}, argv...)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+
+			var stderr bytes.Buffer
+			cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+			cmd.Stderr = &stderr
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatalf("stdin: %v", err)
+			}
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatalf("stdout: %v", err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("start %q: %v", argv, err)
+			}
+			defer func() {
+				stdin.Close()
+				if err := cmd.Wait(); err != nil {
+					t.Errorf("run %q: %v\nstderr:\n%s", argv, err, stderr.String())
+				}
+			}()
+
+			port, err := bufio.NewReader(stdout).ReadString('\n')
+			if err != nil {
+				t.Fatalf("read port: %v\nstderr:\n%s", err, stderr.String())
+			}
+			addr := net.JoinHostPort("127.0.0.1", strings.TrimSpace(port))
+
+			// A worker serves one connection at a time, so as many concurrent
+			// connections as there are workers must each get a different one.
+			for round := range 3 {
+				var conns []net.Conn
+				var pids []string
+				for range preforkWorkers {
+					conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+					if err != nil {
+						t.Fatalf("round %d: dial: %v", round, err)
+					}
+					defer conn.Close()
+					conns = append(conns, conn)
+				}
+				for _, conn := range conns {
+					conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+					pid, err := bufio.NewReader(conn).ReadString('\n')
+					if err != nil {
+						t.Fatalf("round %d: read worker pid: %v", round, err)
+					}
+					pids = append(pids, strings.TrimSpace(pid))
+				}
+				for _, conn := range conns {
+					conn.Close()
+				}
+
+				slices.Sort(pids)
+				if len(slices.Compact(slices.Clone(pids))) != preforkWorkers {
+					t.Fatalf("round %d: got connections accepted by workers %v, want %d different workers", round, pids, preforkWorkers)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build conformance
+
+package conformance
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// registryPackages is the number of packages the registry serves for every
+// tool. The first one carries a large blob so that downloads span many reads.
+const registryPackages = 4
+
+const registryBlobSize = 8 << 20
+
+// registry is a local mirror of the Go module proxy, npm, PyPI and crates.io
+// protocols serving registryPackages made-up packages each, mirror-dep1 to
+// mirror-dep4 with the naming rules of every ecosystem. Artifacts, the
+// downloads whose hashes the tools verify, are served with an ETag and an
+// immutable Cache-Control like real registries so that events get a cache
+// status.
+//
+//	/go/mirror.test/depN/@v/...              GOPROXY
+//	/npm/mirror-depN                         npm packument
+//	/npm/mirror-depN/-/mirror-depN-1.0.0.tgz npm tarball
+//	/pypi/simple/mirror-depN/                PEP 503 simple index
+//	/pypi/files/mirror_depN-1.0.0-...whl     wheel
+//	/cargo/index/...                         sparse crates index
+//	/cargo/crates/mirror_depN/1.0.0/download crate
+type registry struct {
+	*httptest.Server
+
+	// artifacts has the body of every artifact by path.
+	artifacts map[string][]byte
+
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func newRegistry(t *testing.T) *registry {
+	r := &registry{artifacts: make(map[string][]byte), hits: make(map[string]int)}
+	mux := http.NewServeMux()
+	r.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		r.hits[req.URL.Path]++
+		r.mu.Unlock()
+		mux.ServeHTTP(w, req)
+	}))
+	r.Start()
+	t.Cleanup(r.Close)
+
+	r.serve(mux, "/cargo/index/config.json", "application/json", []byte(fmt.Sprintf(`{"dl": "%s/cargo/crates"}`, r.URL)))
+	for i := 1; i <= registryPackages; i++ {
+		r.addGo(t, mux, i)
+		r.addNPM(t, mux, i)
+		r.addPyPI(t, mux, i)
+		r.addCargo(t, mux, i)
+	}
+	return r
+}
+
+// blob returns the made-up payload of package i, large for the first one.
+func blob(eco string, i int) []byte {
+	size := 64 << 10
+	if i == 1 {
+		size = registryBlobSize
+	}
+	b := make([]byte, size)
+	rand.New(rand.NewSource(int64(len(eco)*100 + i))).Read(b)
+	return b
+}
+
+func (r *registry) serve(mux *http.ServeMux, path, contentType string, body []byte) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", contentType)
+		w.Write(body)
+	})
+}
+
+func (r *registry) serveArtifact(mux *http.ServeMux, path, contentType string, body []byte) {
+	r.artifacts[path] = body
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("etag", etag)
+		w.Header().Set("cache-control", "public, max-age=31536000, immutable")
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(body))
+	})
+}
+
+func (r *registry) addGo(t *testing.T, mux *http.ServeMux, i int) {
+	mod := fmt.Sprintf("mirror.test/dep%d", i)
+	prefix := "/go/" + mod + "/@v/"
+	gomod := fmt.Sprintf("module %s\n\ngo 1.21\n", mod)
+
+	b := new(bytes.Buffer)
+	zw := zip.NewWriter(b)
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{
+		{"go.mod", []byte(gomod)},
+		{"dep.go", []byte(fmt.Sprintf("package dep%d\n\nconst N = %d\n", i, i))},
+		{"blob.bin", blob("go", i)},
+	} {
+		w, err := zw.Create(mod + "@v1.0.0/" + f.name)
+		if err != nil {
+			t.Fatalf("create zip entry: %v", err)
+		}
+		w.Write(f.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close zip: %v", err)
+	}
+
+	r.serve(mux, prefix+"list", "text/plain", []byte("v1.0.0\n"))
+	r.serve(mux, prefix+"v1.0.0.info", "application/json", []byte(`{"Version":"v1.0.0","Time":"2024-01-01T00:00:00Z"}`))
+	r.serve(mux, prefix+"v1.0.0.mod", "text/plain", []byte(gomod))
+	r.serveArtifact(mux, prefix+"v1.0.0.zip", "application/zip", b.Bytes())
+}
+
+// targz returns a gzipped tarball of the files, in order of name.
+func targz(t *testing.T, files map[string][]byte) []byte {
+	b := new(bytes.Buffer)
+	gw := gzip.NewWriter(b)
+	tw := tar.NewWriter(gw)
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		content := files[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), ModTime: time.Unix(1704067200, 0)}); err != nil {
+			t.Fatalf("write tar header: %v", err)
+		}
+		tw.Write(content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("close gzip: %v", err)
+	}
+	return b.Bytes()
+}
+
+func (r *registry) addNPM(t *testing.T, mux *http.ServeMux, i int) {
+	name := fmt.Sprintf("mirror-dep%d", i)
+	tgz := targz(t, map[string][]byte{
+		"package/package.json": []byte(fmt.Sprintf(`{"name": %q, "version": "1.0.0", "main": "index.js"}`, name)),
+		"package/index.js":     []byte(fmt.Sprintf("module.exports = %d;\n", i)),
+		"package/blob.bin":     blob("npm", i),
+	})
+	tarball := fmt.Sprintf("/npm/%s/-/%s-1.0.0.tgz", name, name)
+	sha512sum, sha1sum := sha512.Sum512(tgz), sha1.Sum(tgz)
+
+	packument, _ := json.Marshal(map[string]any{
+		"name":      name,
+		"dist-tags": map[string]string{"latest": "1.0.0"},
+		"versions": map[string]any{
+			"1.0.0": map[string]any{
+				"name":    name,
+				"version": "1.0.0",
+				"dist": map[string]string{
+					"tarball":   r.URL + tarball,
+					"integrity": "sha512-" + base64.StdEncoding.EncodeToString(sha512sum[:]),
+					"shasum":    hex.EncodeToString(sha1sum[:]),
+				},
+			},
+		},
+	})
+	r.serve(mux, "/npm/"+name, "application/json", packument)
+	r.serveArtifact(mux, tarball, "application/octet-stream", tgz)
+}
+
+func (r *registry) addPyPI(t *testing.T, mux *http.ServeMux, i int) {
+	name, module := fmt.Sprintf("mirror-dep%d", i), fmt.Sprintf("mirror_dep%d", i)
+	distInfo := module + "-1.0.0.dist-info/"
+
+	b := new(bytes.Buffer)
+	zw := zip.NewWriter(b)
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{
+		{module + "/__init__.py", []byte(fmt.Sprintf("N = %d\n", i))},
+		{module + "/blob.bin", blob("pypi", i)},
+		{distInfo + "METADATA", []byte(fmt.Sprintf("Metadata-Version: 2.1\nName: %s\nVersion: 1.0.0\n", name))},
+		{distInfo + "WHEEL", []byte("Wheel-Version: 1.0\nGenerator: conformance\nRoot-Is-Purelib: true\nTag: py3-none-any\n")},
+		{distInfo + "RECORD", []byte("")},
+	} {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatalf("create zip entry: %v", err)
+		}
+		w.Write(f.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close zip: %v", err)
+	}
+
+	wheel := fmt.Sprintf("/pypi/files/%s-1.0.0-py3-none-any.whl", module)
+	sum := sha256.Sum256(b.Bytes())
+	index := fmt.Sprintf("<!DOCTYPE html>\n<html><body>\n<a href=\"%s#sha256=%s\">%s-1.0.0-py3-none-any.whl</a>\n</body></html>\n", wheel, hex.EncodeToString(sum[:]), module)
+	r.serve(mux, "/pypi/simple/"+name+"/", "text/html", []byte(index))
+	r.serveArtifact(mux, wheel, "application/octet-stream", b.Bytes())
+}
+
+func (r *registry) addCargo(t *testing.T, mux *http.ServeMux, i int) {
+	name := fmt.Sprintf("mirror_dep%d", i)
+	crate := targz(t, map[string][]byte{
+		name + "-1.0.0/Cargo.toml": []byte(fmt.Sprintf("[package]\nname = %q\nversion = \"1.0.0\"\nedition = \"2021\"\n", name)),
+		name + "-1.0.0/src/lib.rs": []byte(fmt.Sprintf("pub const N: u32 = %d;\n", i)),
+		name + "-1.0.0/blob.bin":   blob("cargo", i),
+	})
+	sum := sha256.Sum256(crate)
+	entry, _ := json.Marshal(map[string]any{
+		"name":     name,
+		"vers":     "1.0.0",
+		"deps":     []any{},
+		"cksum":    hex.EncodeToString(sum[:]),
+		"features": map[string]any{},
+		"yanked":   false,
+	})
+
+	r.serve(mux, fmt.Sprintf("/cargo/index/%s/%s/%s", name[:2], name[2:4], name), "text/plain", append(entry, '\n'))
+	r.serveArtifact(mux, fmt.Sprintf("/cargo/crates/%s/1.0.0/download", name), "application/octet-stream", crate)
+}
+
+// artifactPaths returns the paths of the artifacts of one ecosystem.
+func (r *registry) artifactPaths(prefix string) []string {
+	var ret []string
+	for path := range r.artifacts {
+		if strings.HasPrefix(path, prefix) {
+			ret = append(ret, path)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,212 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build conformance
+
+package conformance
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type connRequestsKey struct{}
+
+// server is the local server that clients send their scripted requests to.
+// Every scenario has its own path:
+//
+//	/ok        200 with a short body and the number of requests served on
+//	           the connection so far in X-Conn-Requests (keep-alive reuse)
+//	/redirect  302 to /ok
+//	/slow      200 after slowDelay, longer than every client's timeout
+//	/close     closes the connection without responding
+type server struct {
+	http  *httptest.Server
+	https *httptest.Server
+
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+const slowDelay = 3 * time.Second
+
+func newServer(t *testing.T) *server {
+	s := &server{hits: make(map[string]int)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		n := r.Context().Value(connRequestsKey{}).(*atomic.Int64).Add(1)
+		w.Header().Set("x-conn-requests", fmt.Sprintf("%d", n))
+		fmt.Fprint(w, "ok")
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		r.Context().Value(connRequestsKey{}).(*atomic.Int64).Add(1)
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(slowDelay):
+			fmt.Fprint(w, "slow")
+		case <-r.Context().Done():
+			// Don't let the server send an empty 200 after the client gave up.
+			panic(http.ErrAbortHandler)
+		}
+	})
+	mux.HandleFunc("/close", func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0) // RST instead of FIN
+		}
+		conn.Close()
+	})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.hits[r.URL.Path]++
+		s.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	})
+	connContext := func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, connRequestsKey{}, new(atomic.Int64))
+	}
+
+	s.http = httptest.NewUnstartedServer(handler)
+	s.http.Config.ConnContext = connContext
+	s.http.Start()
+	t.Cleanup(s.http.Close)
+
+	s.https = httptest.NewUnstartedServer(handler)
+	s.https.Config.ConnContext = connContext
+	s.https.EnableHTTP2 = true
+	s.https.TLS = &tls.Config{Certificates: []tls.Certificate{localhostCertificate(t)}}
+	s.https.StartTLS()
+	t.Cleanup(s.https.Close)
+	return s
+}
+
+// localhostCertificate returns a self-signed certificate for localhost. The
+// certificate httptest uses by default is only valid for example.com, which
+// clients that skip verification accept but subtrace can't present a
+// duplicate of to a client that asked for localhost.
+func localhostCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// env returns the environment variables that tell clients where to send
+// requests. URLs use localhost rather than 127.0.0.1 so that clients resolve
+// it to both ::1 and 127.0.0.1 and exercise their dual-stack dialers; the
+// server only listens on 127.0.0.1.
+func (s *server) env() []string {
+	localhost := func(u string) string { return strings.Replace(u, "127.0.0.1", "localhost", 1) }
+	return []string{
+		"CONFORMANCE_HTTP_URL=" + localhost(s.http.URL),
+		"CONFORMANCE_HTTPS_URL=" + localhost(s.https.URL),
+	}
+}
+
+func (s *server) hitCounts() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make(map[string]int, len(s.hits))
+	for k, v := range s.hits {
+		ret[k] = v
+	}
+	return ret
+}
+
+// collector is a Zipkin v2 collector that records the spans subtrace sends.
+type collector struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	spans []collectedSpan
+}
+
+type collectedSpan struct {
+	Name string            `json:"name"`
+	Tags map[string]string `json:"tags"`
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var spans []collectedSpan
+		if err := json.NewDecoder(r.Body).Decode(&spans); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		c.spans = append(c.spans, spans...)
+		c.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// counts returns the number of spans for each name and status code, e.g.
+// "GET /ok 200". Spans without a status code end with 0.
+func (c *collector) counts() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make(map[string]int)
+	for _, s := range c.spans {
+		status := s.Tags["http.status_code"]
+		if status == "" {
+			status = "0"
+		}
+		ret[s.Name+" "+status]++
+	}
+	return ret
+}
+
+// unattributed returns the number of spans that aren't attributed to the
+// process that made the request.
+func (c *collector) unattributed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, s := range c.spans {
+		if s.Tags["process_id"] == "" {
+			n++
+		}
+	}
+	return n
+}
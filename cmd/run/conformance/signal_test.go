@@ -0,0 +1,192 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build conformance
+
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tracedArgv returns argv run under subtrace if traced is true.
+func tracedArgv(t *testing.T, argv []string, traced bool) []string {
+	if !traced {
+		return argv
+	}
+	logfile := filepath.Join(t.TempDir(), "subtrace.log")
+	t.Cleanup(func() {
+		if t.Failed() {
+			b, _ := os.ReadFile(logfile)
+			t.Logf("subtrace log:\n%s", b)
+		}
+	})
+	return append([]string{subtraceBinary, "run", "-quiet", "-log=false", "-logfile", logfile, "--"}, argv...)
+}
+
+// TestSignalForwarding sends the signals `docker stop` and reloads use to
+// subtrace, which must pass them on to the traced server and wait for it to
+// shut down cleanly.
+func TestSignalForwarding(t *testing.T) {
+	requireCommand(t, "python3", "--version")
+
+	for _, traced := range []bool{false, true} {
+		t.Run(fmt.Sprintf("traced=%v", traced), func(t *testing.T) {
+			argv := tracedArgv(t, []string{"python3", testdata(t, "signals.py")}, traced)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+
+			var stderr bytes.Buffer
+			cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+			cmd.Stderr = &stderr
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatalf("stdout: %v", err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("start %q: %v", argv, err)
+			}
+			lines := bufio.NewReader(stdout)
+			expect := func(want string) {
+				t.Helper()
+				line, err := lines.ReadString('\n')
+				if got := strings.TrimSpace(line); got != want {
+					cmd.Process.Kill()
+					t.Fatalf("got line %q (err=%v), want %q\nstderr:\n%s", got, err, want, stderr.String())
+				}
+			}
+
+			expect("ready")
+			for _, sig := range []struct {
+				sig  syscall.Signal
+				name string
+			}{
+				{syscall.SIGHUP, "SIGHUP"},
+				{syscall.SIGUSR1, "SIGUSR1"},
+				{syscall.SIGUSR2, "SIGUSR2"},
+				{syscall.SIGTERM, "SIGTERM"},
+			} {
+				if err := cmd.Process.Signal(sig.sig); err != nil {
+					t.Fatalf("send %s: %v", sig.name, err)
+				}
+				expect(sig.name)
+			}
+			expect("shutdown")
+
+			if err := cmd.Wait(); err != nil {
+				t.Errorf("run %q: %v, want a clean exit\nstderr:\n%s", argv, err, stderr.String())
+			}
+		})
+	}
+}
+
+// TestInterrupt checks that a Ctrl-C reaches the traced command exactly once,
+// from the terminal, when subtrace is in the foreground of a terminal, which
+// signals the command itself, and that a SIGINT sent to subtrace alone, as
+// when it runs in the background, is passed on.
+func TestInterrupt(t *testing.T) {
+	requireCommand(t, "python3", "--version")
+
+	for _, foreground := range []bool{true, false} {
+		for _, traced := range []bool{false, true} {
+			t.Run(fmt.Sprintf("foreground=%v/traced=%v", foreground, traced), func(t *testing.T) {
+				argv := tracedArgv(t, []string{"python3", testdata(t, "interrupt.py")}, traced)
+
+				// The terminal would echo the Ctrl-C in the middle of the
+				// output otherwise.
+				master, slave := openPTY(t)
+				termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+				if err != nil {
+					t.Fatalf("get termios: %v", err)
+				}
+				termios.Lflag &^= unix.ECHO
+				if err := unix.IoctlSetTermios(int(slave.Fd()), unix.TCSETS, termios); err != nil {
+					t.Fatalf("set termios: %v", err)
+				}
+
+				cmd := exec.Command(argv[0], argv[1:]...)
+				cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+				cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: foreground}
+				if err := cmd.Start(); err != nil {
+					t.Fatalf("start %q: %v", argv, err)
+				}
+				defer cmd.Wait()
+				defer cmd.Process.Kill()
+				slave.Close()
+
+				lines := bufio.NewReader(master)
+				expect := func(want string) {
+					t.Helper()
+					for {
+						line, err := lines.ReadString('\n')
+						got := strings.TrimSpace(line)
+						if got == want {
+							return
+						}
+						if err != nil || got == "ready" || got == "shutdown" || strings.HasPrefix(got, "SIG") {
+							t.Fatalf("got line %q (err=%v), want %q", got, err, want)
+						}
+						t.Logf("output: %s", got) // subtrace's own, e.g. warnings
+					}
+				}
+
+				expect("ready")
+				if foreground {
+					if _, err := master.Write([]byte{termios.Cc[unix.VINTR]}); err != nil {
+						t.Fatalf("send Ctrl-C: %v", err)
+					}
+					expect("SIGINT terminal")
+				} else {
+					if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
+						t.Fatalf("send SIGINT: %v", err)
+					}
+					expect("SIGINT kill")
+				}
+
+				// Give a second SIGINT time to arrive before the SIGTERM.
+				time.Sleep(500 * time.Millisecond)
+				if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+					t.Fatalf("send SIGTERM: %v", err)
+				}
+				expect("shutdown")
+			})
+		}
+	}
+}
+
+// TestDeathBySignal checks that subtrace exits with 128+n, like a shell, when
+// the traced command is killed by signal n.
+func TestDeathBySignal(t *testing.T) {
+	for _, traced := range []bool{false, true} {
+		t.Run(fmt.Sprintf("traced=%v", traced), func(t *testing.T) {
+			argv := []string{"sh", "-c", "kill -SEGV $$"}
+			if traced {
+				argv = tracedArgv(t, argv, traced)
+			} else {
+				// Without subtrace there's no parent to turn the signal into an
+				// exit code, so let a shell do it.
+				argv = []string{"sh", "-c", "sh -c 'kill -SEGV $$'; exit $?"}
+			}
+
+			var exitErr *exec.ExitError
+			out, err := exec.Command(argv[0], argv[1:]...).CombinedOutput()
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != 128+int(syscall.SIGSEGV) {
+				t.Errorf("run %q: got %v, want exit status %d\n%s", argv, err, 128+int(syscall.SIGSEGV), out)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build conformance
+
+package conformance
+
+import (
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startupBudget is how much longer `subtrace run -- true` may take than
+// `true` on its own.
+const startupBudget = 50 * time.Millisecond
+
+// runTrue runs true, through subtrace if traced, and returns how long it took.
+func runTrue(tb testing.TB, traced bool) time.Duration {
+	argv := []string{"true"}
+	if traced {
+		argv = append([]string{subtraceBinary, "run", "-quiet", "-log=false", "--"}, argv...)
+	}
+	begin := time.Now()
+	if out, err := exec.Command(argv[0], argv[1:]...).CombinedOutput(); err != nil {
+		tb.Fatalf("%v: %v\n%s", argv, err, out)
+	}
+	return time.Since(begin)
+}
+
+func median(ds []time.Duration) time.Duration {
+	slices.Sort(ds)
+	return ds[len(ds)/2]
+}
+
+// TestStartupLatency checks that subtrace adds at most startupBudget to the
+// time it takes a command to run. The first run is left out since it pays
+// for loading the binary from disk.
+func TestStartupLatency(t *testing.T) {
+	runTrue(t, true)
+
+	const runs = 11
+	var plain, traced []time.Duration
+	for range runs {
+		plain = append(plain, runTrue(t, false))
+		traced = append(traced, runTrue(t, true))
+	}
+	added := median(traced) - median(plain)
+	t.Logf("true took %v, %v traced (%v added)", median(plain), median(traced), added)
+	if added > startupBudget {
+		t.Errorf("subtrace added %v to startup, want at most %v (subtrace run -v logs the phases)", added, startupBudget)
+	}
+}
+
+func BenchmarkStartup(b *testing.B) {
+	runTrue(b, true)
+	for b.Loop() {
+		runTrue(b, true)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build conformance
+
+package conformance
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY returns the master and slave of a new PTY.
+func openPTY(t *testing.T) (master, slave *os.File) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open /dev/ptmx: %v", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Fatalf("get pts name: %v", err)
+	}
+	var unlock int32
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, master.Fd(), unix.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Fatalf("unlock pts: %v", errno)
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatalf("open /dev/pts/%d: %v", n, err)
+	}
+	t.Cleanup(func() { slave.Close() })
+	return master, slave
+}
+
+// TestTerminalSize runs a program in a terminal and resizes the terminal.
+// Under subtrace -tracelogs, which puts PTYs between the program's stdout and
+// the terminal, the program must see the terminal's size and its change.
+func TestTerminalSize(t *testing.T) {
+	requireCommand(t, "python3", "--version")
+
+	for _, traced := range []bool{false, true} {
+		t.Run(fmt.Sprintf("traced=%v", traced), func(t *testing.T) {
+			argv := tracedArgv(t, []string{"python3", testdata(t, "winsize.py")}, traced)
+			if traced {
+				argv = slices.Insert(argv, 2, "-tracelogs") // after "run"
+			}
+
+			master, slave := openPTY(t)
+			if err := unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: 40, Col: 100}); err != nil {
+				t.Fatalf("set window size: %v", err)
+			}
+
+			cmd := exec.Command(argv[0], argv[1:]...)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("start %q: %v", argv, err)
+			}
+			defer cmd.Wait()
+			defer cmd.Process.Kill()
+			slave.Close()
+
+			lines := bufio.NewReader(master)
+			expect := func(want string) {
+				t.Helper()
+				for {
+					line, err := lines.ReadString('\n')
+					got := strings.TrimSpace(line)
+					if got == want {
+						return
+					}
+					if err != nil || got == "timeout" || got == "ready" {
+						t.Fatalf("got line %q (err=%v), want %q", got, err, want)
+					}
+					t.Logf("output: %s", got) // subtrace's own, e.g. warnings
+				}
+			}
+
+			expect("40 100")
+			expect("ready")
+			if err := unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: 50, Col: 132}); err != nil {
+				t.Fatalf("resize: %v", err)
+			}
+			expect("50 132")
+		})
+	}
+}
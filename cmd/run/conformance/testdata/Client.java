@@ -0,0 +1,62 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Runs the conformance steps with java.net.http.HttpClient, which prefers
+// HTTP/2 (and so asks to upgrade plaintext connections to h2c) and reaps idle
+// pooled connections on its own schedule. Run it with
+// -Djdk.internal.httpclient.disableHostnameVerification=true.
+
+import java.net.URI;
+import java.net.http.HttpClient;
+import java.net.http.HttpRequest;
+import java.net.http.HttpResponse;
+import java.security.SecureRandom;
+import java.security.cert.X509Certificate;
+import java.time.Duration;
+import javax.net.ssl.SSLContext;
+import javax.net.ssl.TrustManager;
+import javax.net.ssl.X509TrustManager;
+
+public class Client {
+    public static void main(String[] args) throws Exception {
+        String httpURL = System.getenv("CONFORMANCE_HTTP_URL");
+        String httpsURL = System.getenv("CONFORMANCE_HTTPS_URL");
+
+        TrustManager[] trustAll = new TrustManager[] {
+            new X509TrustManager() {
+                public void checkClientTrusted(X509Certificate[] chain, String authType) {}
+                public void checkServerTrusted(X509Certificate[] chain, String authType) {}
+                public X509Certificate[] getAcceptedIssuers() { return new X509Certificate[0]; }
+            },
+        };
+        SSLContext ssl = SSLContext.getInstance("TLS");
+        ssl.init(null, trustAll, new SecureRandom());
+
+        HttpClient client = HttpClient.newBuilder()
+            .sslContext(ssl)
+            .followRedirects(HttpClient.Redirect.NORMAL)
+            .build();
+
+        for (int i = 0; i < 3; i++) {
+            get(client, "keepalive", httpURL + "/ok", null);
+        }
+        get(client, "tls", httpsURL + "/ok", null);
+        get(client, "redirect", httpURL + "/redirect", null);
+        get(client, "timeout", httpURL + "/slow", Duration.ofMillis(500));
+        get(client, "close", httpURL + "/close", null);
+    }
+
+    static void get(HttpClient client, String step, String url, Duration timeout) {
+        HttpRequest.Builder req = HttpRequest.newBuilder(URI.create(url));
+        if (timeout != null) {
+            req.timeout(timeout);
+        }
+        try {
+            HttpResponse<byte[]> resp = client.send(req.build(), HttpResponse.BodyHandlers.ofByteArray());
+            String reqs = resp.headers().firstValue("x-conn-requests").orElse("-");
+            System.out.println(step + " " + resp.statusCode() + " " + reqs + " " + resp.body().length);
+        } catch (Exception e) {
+            System.out.println(step + " error");
+        }
+    }
+}
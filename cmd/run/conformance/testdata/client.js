@@ -0,0 +1,60 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Runs the conformance steps with Node's http and https modules, keep-alive
+// agents and the happy-eyeballs dialer (autoSelectFamily).
+
+const http = require("http");
+const https = require("https");
+
+const httpURL = process.env.CONFORMANCE_HTTP_URL;
+const httpsURL = process.env.CONFORMANCE_HTTPS_URL;
+
+const agents = {
+  "http:": new http.Agent({ keepAlive: true, maxSockets: 1 }),
+  "https:": new https.Agent({ keepAlive: true, rejectUnauthorized: false }),
+};
+
+function get(url, { timeout, follow } = {}) {
+  return new Promise((resolve, reject) => {
+    const u = new URL(url);
+    const mod = u.protocol === "https:" ? https : http;
+    const req = mod.get(u, { agent: agents[u.protocol], autoSelectFamily: true, timeout }, (res) => {
+      if (follow && res.statusCode >= 300 && res.statusCode < 400 && res.headers.location) {
+        res.resume();
+        resolve(get(new URL(res.headers.location, u).href, { timeout, follow }));
+        return;
+      }
+      let length = 0;
+      res.on("data", (chunk) => (length += chunk.length));
+      res.on("end", () => resolve({ status: res.statusCode, headers: res.headers, length }));
+      res.on("error", reject);
+    });
+    req.on("timeout", () => req.destroy(new Error("timeout")));
+    req.on("error", reject);
+  });
+}
+
+async function step(name, url, opts) {
+  try {
+    const res = await get(url, opts);
+    console.log(name, res.status, res.headers["x-conn-requests"] ?? "-", res.length);
+  } catch (err) {
+    console.log(name, "error");
+  }
+}
+
+async function main() {
+  for (let i = 0; i < 3; i++) {
+    await step("keepalive", httpURL + "/ok");
+  }
+  await step("tls", httpsURL + "/ok");
+  await step("redirect", httpURL + "/redirect", { follow: true });
+  await step("timeout", httpURL + "/slow", { timeout: 500 });
+  await step("close", httpURL + "/close");
+  for (const agent of Object.values(agents)) {
+    agent.destroy();
+  }
+}
+
+main();
@@ -0,0 +1,38 @@
+# Copyright (c) Subtrace, Inc.
+# SPDX-License-Identifier: BSD-3-Clause
+
+# Runs the conformance steps with a requests session that retries failed
+# requests through urllib3.
+
+import os
+
+import requests
+import urllib3
+from requests.adapters import HTTPAdapter
+from urllib3.util.retry import Retry
+
+urllib3.disable_warnings()
+
+HTTP_URL = os.environ["CONFORMANCE_HTTP_URL"]
+HTTPS_URL = os.environ["CONFORMANCE_HTTPS_URL"]
+
+session = requests.Session()
+for prefix in ("http://", "https://"):
+    session.mount(prefix, HTTPAdapter(max_retries=Retry(total=2, backoff_factor=0)))
+
+
+def get(step, url, **kwargs):
+    try:
+        resp = session.get(url, verify=False, **kwargs)
+    except requests.RequestException:
+        print(step, "error", flush=True)
+        return
+    print(step, resp.status_code, resp.headers.get("x-conn-requests", "-"), len(resp.content), flush=True)
+
+
+for _ in range(3):
+    get("keepalive", HTTP_URL + "/ok")
+get("tls", HTTPS_URL + "/ok")
+get("redirect", HTTP_URL + "/redirect")
+get("timeout", HTTP_URL + "/slow", timeout=0.5)
+get("close", HTTP_URL + "/close")
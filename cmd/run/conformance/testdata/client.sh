@@ -0,0 +1,27 @@
+#!/usr/bin/env bash
+# Copyright (c) Subtrace, Inc.
+# SPDX-License-Identifier: BSD-3-Clause
+
+# Runs the conformance steps with curl --http2, which negotiates h2 over TLS
+# and asks to upgrade plaintext connections to h2c.
+
+set -uo pipefail
+
+get() {
+  local step=$1
+  shift
+  local out
+  if out=$(curl -sS -k --http2 -w "${step} %{http_code} %header{x-conn-requests} %{size_download}\n" "$@" 2>/dev/null); then
+    printf '%s\n' "${out}"
+  else
+    echo "${step} error"
+  fi
+}
+
+# A single invocation with several URLs reuses the connection.
+get keepalive -o /dev/null -o /dev/null -o /dev/null \
+  "${CONFORMANCE_HTTP_URL}/ok" "${CONFORMANCE_HTTP_URL}/ok" "${CONFORMANCE_HTTP_URL}/ok"
+get tls -o /dev/null "${CONFORMANCE_HTTPS_URL}/ok"
+get redirect -o /dev/null -L "${CONFORMANCE_HTTP_URL}/redirect"
+get timeout -o /dev/null --max-time 0.5 "${CONFORMANCE_HTTP_URL}/slow"
+get close -o /dev/null "${CONFORMANCE_HTTP_URL}/close"
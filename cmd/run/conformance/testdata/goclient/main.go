@@ -0,0 +1,57 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Command goclient runs the conformance steps with net/http's default
+// connection pooling.
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+func main() {
+	httpURL, httpsURL := os.Getenv("CONFORMANCE_HTTP_URL"), os.Getenv("CONFORMANCE_HTTPS_URL")
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	for range 3 {
+		get(client, "keepalive", httpURL+"/ok")
+	}
+	get(client, "tls", httpsURL+"/ok")
+	get(client, "redirect", httpURL+"/redirect")
+
+	slow := *client
+	slow.Timeout = 500 * time.Millisecond
+	get(&slow, "timeout", httpURL+"/slow")
+
+	get(client, "close", httpURL+"/close")
+}
+
+func get(client *http.Client, step string, url string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Println(step, "error")
+		return
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Println(step, "error")
+		return
+	}
+	reqs := resp.Header.Get("x-conn-requests")
+	if reqs == "" {
+		reqs = "-"
+	}
+	fmt.Println(step, resp.StatusCode, reqs, len(b))
+}
@@ -0,0 +1,31 @@
+# Copyright (c) Subtrace, Inc.
+# SPDX-License-Identifier: BSD-3-Clause
+
+# Prints "ready" once it waits for SIGINT and SIGTERM, then for every SIGINT,
+# "SIGINT" and where it came from: "terminal" for a Ctrl-C and "kill" for one
+# sent by a process. SIGINTs are taken one at a time with sigwaitinfo(2) rather
+# than by a handler, which would run once for two that arrive together, and
+# with a real-time priority where allowed so that one is taken before another
+# can arrive and merge with it while it's pending. On SIGTERM, it prints
+# "shutdown" and exits with status 0.
+
+import os
+import signal
+
+SI_KERNEL = 0x80
+
+try:
+    os.sched_setscheduler(0, os.SCHED_FIFO, os.sched_param(50))
+except PermissionError:
+    pass
+
+sigs = {signal.SIGINT, signal.SIGTERM}
+signal.pthread_sigmask(signal.SIG_BLOCK, sigs)
+
+print("ready", flush=True)
+while True:
+    info = signal.sigwaitinfo(sigs)
+    if info.si_signo == signal.SIGTERM:
+        print("shutdown", flush=True)
+        break
+    print("SIGINT", "terminal" if info.si_code == SI_KERNEL else "kill", flush=True)
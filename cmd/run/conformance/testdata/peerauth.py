@@ -0,0 +1,38 @@
+# Copyright (c) Subtrace, Inc.
+# SPDX-License-Identifier: BSD-3-Clause
+
+# A server on the unix socket at argv[1] that authenticates its peers by
+# SO_PEERCRED, like the Docker daemon or PostgreSQL with peer authentication.
+# It runs a client argv[2] times, one after the other, and prints a line with
+# the pid the client sends and the pid SO_PEERCRED reports for it.
+
+import os
+import socket
+import struct
+import subprocess
+import sys
+
+if sys.argv[1] == "client":
+    with socket.socket(socket.AF_UNIX, socket.SOCK_STREAM) as s:
+        s.connect(sys.argv[2])
+        s.sendall(str(os.getpid()).encode())
+        s.shutdown(socket.SHUT_WR)
+        s.recv(16)
+    sys.exit(0)
+
+path, count = sys.argv[1], int(sys.argv[2])
+with socket.socket(socket.AF_UNIX, socket.SOCK_STREAM) as lis:
+    lis.bind(path)
+    lis.listen(8)
+    for _ in range(count):
+        client = subprocess.Popen([sys.executable, __file__, "client", path])
+        conn, _ = lis.accept()
+        with conn:
+            cred = conn.getsockopt(socket.SOL_SOCKET, socket.SO_PEERCRED, struct.calcsize("3i"))
+            pid, _, _ = struct.unpack("3i", cred)
+            sent = b""
+            while chunk := conn.recv(16):
+                sent += chunk
+            print(sent.decode(), pid, flush=True)
+            conn.sendall(b"ok")
+        client.wait()
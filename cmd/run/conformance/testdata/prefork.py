@@ -0,0 +1,53 @@
+# Copyright (c) Subtrace, Inc.
+# SPDX-License-Identifier: BSD-3-Clause
+
+# A preforking server: the parent listens, forks four workers that accept on
+# the inherited listener and closes its own copy of it. Like gunicorn's sync
+# workers, each worker waits for the listener to be readable before accepting
+# on it without blocking, so that an accept lost to another worker isn't
+# fatal. Every connection gets the pid of the worker that accepted it, which
+# then serves nothing else until the client closes it.
+#
+# The parent prints the port once the workers are up, and stops them when its
+# stdin is closed.
+
+import os
+import select
+import signal
+import socket
+import sys
+
+WORKERS = 4
+
+lis = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+lis.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+lis.bind(("127.0.0.1", 0))
+lis.listen(128)
+lis.setblocking(False)
+port = lis.getsockname()[1]
+
+pids = []
+for _ in range(WORKERS):
+    pid = os.fork()
+    if pid == 0:
+        signal.signal(signal.SIGTERM, lambda *_: os._exit(0))
+        while True:
+            select.select([lis], [], [])
+            try:
+                conn, _ = lis.accept()
+            except BlockingIOError:
+                continue
+            conn.setblocking(True)
+            conn.sendall(b"%d\n" % os.getpid())
+            conn.recv(1)
+            conn.close()
+    pids.append(pid)
+
+lis.close()
+print(port, flush=True)
+
+sys.stdin.read()
+for pid in pids:
+    os.kill(pid, signal.SIGTERM)
+for pid in pids:
+    os.waitpid(pid, 0)
@@ -0,0 +1,25 @@
+# Copyright (c) Subtrace, Inc.
+# SPDX-License-Identifier: BSD-3-Clause
+
+# A server that reloads on SIGHUP, SIGUSR1 and SIGUSR2 and shuts down cleanly
+# on SIGTERM. It prints "ready" once its handlers are installed, the name of
+# every signal it gets and "shutdown" before it exits with status 0.
+
+import signal
+import sys
+import time
+
+def handle(signum, frame):
+    name = signal.Signals(signum).name
+    print(name, flush=True)
+    if signum == signal.SIGTERM:
+        time.sleep(0.2)  # shutdown hooks
+        print("shutdown", flush=True)
+        sys.exit(0)
+
+for sig in (signal.SIGHUP, signal.SIGUSR1, signal.SIGUSR2, signal.SIGTERM):
+    signal.signal(sig, handle)
+
+print("ready", flush=True)
+while True:
+    signal.pause()
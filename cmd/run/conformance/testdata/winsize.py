@@ -0,0 +1,28 @@
+# Copyright (c) Subtrace, Inc.
+# SPDX-License-Identifier: BSD-3-Clause
+
+# Prints the window size of its stdout as "rows cols" and "ready", then waits
+# for a SIGWINCH that changes it and prints the new size, or "timeout" if none
+# does within 10 seconds.
+
+import os
+import signal
+import sys
+import time
+
+def size():
+    s = os.get_terminal_size(sys.stdout.fileno())
+    return f"{s.lines} {s.columns}"
+
+signal.pthread_sigmask(signal.SIG_BLOCK, {signal.SIGWINCH})
+before = size()
+print(before, flush=True)
+print("ready", flush=True)
+
+deadline = time.monotonic() + 10
+while time.monotonic() < deadline:
+    signal.sigtimedwait({signal.SIGWINCH}, max(0, deadline - time.monotonic()))
+    if size() != before:
+        print(size(), flush=True)
+        sys.exit(0)
+print("timeout", flush=True)
@@ -0,0 +1,359 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package crash writes a report when the tracer panics. The report has what's
+// needed to find the bug without the traced process's data: the panic, the
+// stack, the version, the kernel, the enabled features and the number of live
+// sockets and processes. Subsystems register the counts and the flushes of
+// finished events they own, and everything they register is run with a
+// deadline so that a crash in the middle of shutdown, or with a lock held,
+// can't hang the tracer.
+package crash
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"subtrace.dev/cmd/run/capability"
+	"subtrace.dev/cmd/run/kernel"
+	"subtrace.dev/cmd/version"
+)
+
+// IssueURL is where users are asked to file crash reports.
+const IssueURL = "https://github.com/subtrace/subtrace/issues/new"
+
+var (
+	// Dir is the directory reports are written to. Empty means the default
+	// temporary directory.
+	Dir string
+
+	// FlushTimeout bounds the emergency flush of finished events.
+	FlushTimeout = 500 * time.Millisecond
+
+	// CollectTimeout bounds each of the counts and the feature list.
+	CollectTimeout = 100 * time.Millisecond
+
+	// WaitTimeout bounds how long a panic waits for the report of an earlier
+	// one to be written.
+	WaitTimeout = 2 * time.Second
+)
+
+// maxPanicBytes bounds the panic value in a report.
+const maxPanicBytes = 256
+
+// Report is the crash report document.
+type Report struct {
+	Time      time.Time       `json:"time"`
+	Version   string          `json:"version"`
+	Kernel    string          `json:"kernel"`
+	Subsystem string          `json:"subsystem"`
+	Panic     string          `json:"panic"`
+	Stack     string          `json:"stack"`
+	Features  []string        `json:"features"`
+	Counts    map[string]int  `json:"counts"`
+	Flushed   map[string]bool `json:"flushed,omitempty"`
+}
+
+var registry = struct {
+	mu      sync.Mutex
+	counts  map[string]func() int
+	flushes map[string]func(timeout time.Duration) bool
+}{
+	counts:  make(map[string]func() int),
+	flushes: make(map[string]func(timeout time.Duration) bool),
+}
+
+// RegisterCount registers a count of live objects, e.g. sockets, for reports.
+// Registering the same name again replaces the earlier registration.
+func RegisterCount(name string, fn func() int) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.counts[name] = fn
+}
+
+// RegisterFlush registers a flush of events that are already finished, which
+// reports run before the tracer exits. fn must return by timeout and report
+// whether everything was flushed.
+func RegisterFlush(name string, fn func(timeout time.Duration) bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.flushes[name] = fn
+}
+
+// guard makes sure that only the first of any number of concurrent or nested
+// panics writes a report. The others wait for it.
+type guard struct {
+	started atomic.Bool
+	done    chan struct{}
+	path    string // set before done is closed
+}
+
+var current atomic.Pointer[guard]
+
+func init() {
+	current.Store(&guard{done: make(chan struct{})})
+}
+
+// exit is os.Exit, replaced by tests.
+var exit = os.Exit
+
+// Recover writes a report if the goroutine is panicking and then exits. It
+// must be deferred directly:
+//
+//	defer crash.Recover("proxy")
+func Recover(subsystem string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	Write(subsystem, v, debug.Stack())
+	exit(2)
+}
+
+// Write writes a report of a panic with value v and the stack of the
+// panicking goroutine, flushes finished events and tells the user where the
+// report is. It returns the report's path, which is empty if the report could
+// only be written to stderr. Only the first call writes a report: the others
+// wait up to WaitTimeout for it and return its path.
+func Write(subsystem string, v any, stack []byte) string {
+	g := current.Load()
+	if !g.started.CompareAndSwap(false, true) {
+		timer := time.NewTimer(WaitTimeout)
+		defer timer.Stop()
+		select {
+		case <-g.done:
+			return g.path
+		case <-timer.C:
+			return ""
+		}
+	}
+	defer close(g.done)
+
+	r := collect(subsystem, v, stack)
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		b = []byte(fmt.Sprintf("encode crash report: %v", err))
+	}
+	g.path, err = save(b)
+
+	msg := new(strings.Builder)
+	fmt.Fprintf(msg, "subtrace: %s panic: %s\n", subsystem, r.Panic)
+	if err != nil {
+		// The report is all there is, so it goes to stderr instead.
+		fmt.Fprintf(msg, "subtrace: failed to write crash report: %v\n", err)
+		fmt.Fprintf(msg, "-----BEGIN SUBTRACE CRASH REPORT-----\n%s\n-----END SUBTRACE CRASH REPORT-----\n", b)
+	} else {
+		fmt.Fprintf(msg, "subtrace: crash report written to %s\n", g.path)
+	}
+	fmt.Fprintf(msg, "[CRITICAL] Subtrace crashed and we're sorry about that. Please file a bug report with the crash report at %s\n", IssueURL)
+
+	// Write all the bytes at once so that there's as little interference
+	// between different processes writing to stderr at the same time. The
+	// tracer never writes to stderr otherwise unless asked to.
+	os.Stderr.WriteString(msg.String())
+	return g.path
+}
+
+// collect builds the report. Everything registered runs with a deadline,
+// and concurrently, so a count that blocks doesn't hold up the flush.
+func collect(subsystem string, v any, stack []byte) *Report {
+	r := &Report{
+		Time:      time.Now().UTC(),
+		Version:   version.Full(false),
+		Subsystem: subsystem,
+		Panic:     describe(v),
+		Stack:     strings.TrimSpace(string(stack)),
+		Features:  []string{},
+		Counts:    map[string]int{"goroutines": runtime.NumGoroutine()},
+	}
+	if release, err := kernel.Release(); err == nil {
+		r.Kernel = release
+	}
+
+	registry.mu.Lock()
+	counts := make(map[string]func() int, len(registry.counts))
+	for name, fn := range registry.counts {
+		counts[name] = fn
+	}
+	flushes := make(map[string]func(time.Duration) bool, len(registry.flushes))
+	for name, fn := range registry.flushes {
+		flushes[name] = fn
+	}
+	registry.mu.Unlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	run := func(timeout time.Duration, fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bounded(timeout, fn)
+		}()
+	}
+	run(CollectTimeout, func() {
+		var features []string
+		for name, f := range capability.Collect().Features {
+			if f.Enabled {
+				features = append(features, name)
+			}
+		}
+		slices.Sort(features)
+		mu.Lock()
+		r.Features = append(r.Features, features...)
+		mu.Unlock()
+	})
+	for name, fn := range counts {
+		run(CollectTimeout, func() {
+			n := fn()
+			mu.Lock()
+			r.Counts[name] = n
+			mu.Unlock()
+		})
+	}
+	if len(flushes) > 0 {
+		r.Flushed = make(map[string]bool, len(flushes))
+	}
+	for name, fn := range flushes {
+		mu.Lock()
+		r.Flushed[name] = false // unless it returns in time
+		mu.Unlock()
+		run(FlushTimeout+CollectTimeout, func() {
+			ok := fn(FlushTimeout)
+			mu.Lock()
+			r.Flushed[name] = ok
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	// Functions that missed their deadline may still write to r, so the
+	// report is a copy of what made it in time.
+	mu.Lock()
+	defer mu.Unlock()
+	ret := *r
+	ret.Features = slices.Clone(r.Features)
+	ret.Counts = maps.Clone(r.Counts)
+	ret.Flushed = maps.Clone(r.Flushed)
+	return &ret
+}
+
+// bounded runs fn and waits for it up to timeout. A panic in fn is dropped
+// since it's most likely a symptom of the one being reported.
+func bounded(timeout time.Duration, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() { recover() }()
+		fn()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// describe returns the panic value as it goes in a report. Panics raised by
+// the runtime never carry data, but a value passed to panic may be derived
+// from the traffic, so only the first line of strings and errors is kept with
+// the quoted parts, which is where the tracer's own panics put any data,
+// redacted. Other values are reported by their type only.
+func describe(v any) string {
+	var s string
+	switch v := v.(type) {
+	case runtime.Error:
+		return v.Error()
+	case error:
+		s = fmt.Sprintf("%T: %s", v, v.Error())
+	case string:
+		s = v
+	default:
+		return fmt.Sprintf("%T value", v)
+	}
+	if i := strings.IndexAny(s, "\r\n"); i >= 0 {
+		s = s[:i]
+	}
+	s = redactQuoted(s)
+	if len(s) > maxPanicBytes {
+		n := maxPanicBytes
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n] + "..."
+	}
+	return s
+}
+
+// redactQuoted replaces the contents of every part of s in double or back
+// quotes, as %q writes them. An unterminated quote redacts the rest of s.
+func redactQuoted(s string) string {
+	b := new(strings.Builder)
+	for {
+		i := strings.IndexAny(s, "\"`")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		q := s[i]
+		b.WriteString(s[:i+1])
+		b.WriteString("<redacted>")
+		s = s[i+1:]
+
+		// Skip escaped quotes.
+		end := -1
+		for j := 0; j < len(s); j++ {
+			if s[j] == '\\' && q == '"' {
+				j++
+				continue
+			}
+			if s[j] == q {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			return b.String()
+		}
+		b.WriteByte(q)
+		s = s[end+1:]
+	}
+}
+
+// save writes a report to a new file in Dir and returns its path.
+func save(b []byte) (string, error) {
+	dir := Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := fmt.Sprintf("subtrace-crash-%s-%d-*.json", time.Now().UTC().Format("20060102T150405Z"), os.Getpid())
+	f, err := os.CreateTemp(dir, name)
+	if err != nil {
+		return "", fmt.Errorf("create: %w", err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return "", fmt.Errorf("write: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("close: %w", err)
+	}
+	if abs, err := filepath.Abs(f.Name()); err == nil {
+		return abs, nil
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,229 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package crash
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const secret = "Authorization: Bearer sk_live_hunter2"
+
+// setup resets the guard and sends reports to a temporary directory and
+// stderr to a file, whose contents the returned function reads.
+func setup(t *testing.T) (dir string, stderr func() string) {
+	t.Helper()
+	current.Store(&guard{done: make(chan struct{})})
+
+	prevDir, prevExit, prevStderr := Dir, exit, os.Stderr
+	Dir = t.TempDir()
+	f, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatalf("create stderr: %v", err)
+	}
+	os.Stderr = f
+	t.Cleanup(func() {
+		Dir, exit, os.Stderr = prevDir, prevExit, prevStderr
+		f.Close()
+	})
+	return Dir, func() string {
+		b, _ := os.ReadFile(f.Name())
+		return string(b)
+	}
+}
+
+// crashIn runs fn on a new goroutine guarded by Recover as subsystem would
+// and returns the exit code Recover asked for.
+func crashIn(subsystem string, fn func()) int {
+	code := make(chan int, 1)
+	exit = func(c int) {
+		code <- c
+		// Recover doesn't expect exit to return.
+		select {}
+	}
+	go func() {
+		defer Recover(subsystem)
+		fn()
+		code <- 0
+	}()
+	return <-code
+}
+
+func readReport(t *testing.T, dir string) (Report, string) {
+	t.Helper()
+	paths, _ := filepath.Glob(filepath.Join(dir, "subtrace-crash-*.json"))
+	if len(paths) != 1 {
+		t.Fatalf("got reports %v, want one", paths)
+	}
+	b, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatalf("read report: %v", err)
+	}
+	var r Report
+	if err := json.Unmarshal(b, &r); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	return r, string(b)
+}
+
+func TestRecover(t *testing.T) {
+	payload := []byte("POST /login HTTP/1.1\r\n" + secret + "\r\n\r\npassword=hunter2")
+	for _, tt := range []struct {
+		subsystem string
+		fn        func()
+		want      string // in the panic field
+	}{
+		{"proxy", func() { panic(fmt.Errorf("unexpected header %q", secret)) }, `*errors.errorString: unexpected header "<redacted>"`},
+		{"parser", func() { panic("bad request line: \"" + string(payload)) }, `bad request line: "<redacted>`},
+		{"publisher", func() { panic(payload) }, "[]uint8 value"},
+		{"dispatch", func() {
+			var b []byte
+			_ = b[len(payload)]
+		}, "runtime error: index out of range"},
+		{"journal", func() { panic(fmt.Sprintf("line %d of `%s`", 3, secret)) }, "line 3 of `<redacted>`"},
+	} {
+		t.Run(tt.subsystem, func(t *testing.T) {
+			dir, stderr := setup(t)
+			RegisterCount("sockets", func() int { return 7 })
+			flushed := false
+			RegisterFlush("publisher", func(time.Duration) bool {
+				flushed = true
+				return true
+			})
+
+			if code := crashIn(tt.subsystem, tt.fn); code != 2 {
+				t.Fatalf("got exit code %d, want 2", code)
+			}
+			r, raw := readReport(t, dir)
+			if r.Subsystem != tt.subsystem || !strings.HasPrefix(r.Panic, tt.want) {
+				t.Errorf("got %s panic %q, want %s panic %q", r.Subsystem, r.Panic, tt.subsystem, tt.want)
+			}
+			if r.Version == "" || r.Kernel == "" || !strings.Contains(r.Stack, "crash.crashIn") {
+				t.Errorf("got version %q, kernel %q and stack %q", r.Version, r.Kernel, r.Stack)
+			}
+			if r.Counts["sockets"] != 7 || r.Counts["goroutines"] == 0 {
+				t.Errorf("got counts %v", r.Counts)
+			}
+			if !flushed || !r.Flushed["publisher"] {
+				t.Errorf("got flushed %v", r.Flushed)
+			}
+			for _, s := range []string{"hunter2", "sk_live", "Bearer", "password"} {
+				if strings.Contains(raw, s) {
+					t.Errorf("report has %q:\n%s", s, raw)
+				}
+			}
+
+			out := stderr()
+			if !strings.Contains(out, "crash report written to "+filepath.Join(dir, "subtrace-crash-")) || !strings.Contains(out, IssueURL) {
+				t.Errorf("got stderr %q", out)
+			}
+			if strings.Contains(out, "hunter2") {
+				t.Errorf("stderr has the payload: %q", out)
+			}
+		})
+	}
+}
+
+// TestConcurrentPanics checks that panics on many goroutines at once write a
+// single report.
+func TestConcurrentPanics(t *testing.T) {
+	dir, _ := setup(t)
+
+	var wg sync.WaitGroup
+	paths := make([]string, 16)
+	for i := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			paths[i] = Write("engine", fmt.Sprintf("worker %d", i), nil)
+		}()
+	}
+	wg.Wait()
+
+	readReport(t, dir)
+	for _, path := range paths {
+		if path == "" || path != paths[0] {
+			t.Fatalf("got paths %v, want the same report for every panic", paths)
+		}
+	}
+}
+
+// TestNestedPanic checks that a panic while a report is being written, here
+// in a registered count, doesn't write another one or hang.
+func TestNestedPanic(t *testing.T) {
+	dir, _ := setup(t)
+	RegisterCount("sockets", func() int { panic(secret) })
+	RegisterFlush("publisher", func(time.Duration) bool {
+		Write("publisher", "again", nil)
+		return true
+	})
+
+	start := time.Now()
+	if path := Write("proxy", "first", nil); path == "" {
+		t.Fatalf("got no report")
+	}
+	if took := time.Since(start); took > WaitTimeout {
+		t.Errorf("took %v", took)
+	}
+	r, raw := readReport(t, dir)
+	if _, ok := r.Counts["sockets"]; ok || strings.Contains(raw, "hunter2") {
+		t.Errorf("got counts %v", r.Counts)
+	}
+}
+
+// TestBounded checks that counts and flushes that never return don't hold up
+// the report past their deadlines.
+func TestBounded(t *testing.T) {
+	dir, _ := setup(t)
+	block := make(chan struct{})
+	defer close(block)
+	RegisterCount("sockets", func() int { <-block; return 1 })
+	RegisterCount("processes", func() int { return 2 })
+	RegisterFlush("publisher", func(time.Duration) bool { <-block; return true })
+
+	start := time.Now()
+	Write("engine", "stuck", nil)
+	if took := time.Since(start); took > FlushTimeout+2*CollectTimeout+time.Second {
+		t.Errorf("took %v", took)
+	}
+	r, _ := readReport(t, dir)
+	if _, ok := r.Counts["sockets"]; ok || r.Counts["processes"] != 2 || r.Flushed["publisher"] {
+		t.Errorf("got counts %v and flushed %v", r.Counts, r.Flushed)
+	}
+}
+
+// TestStderrFallback checks that a report that can't be written to a file
+// goes to stderr.
+func TestStderrFallback(t *testing.T) {
+	_, stderr := setup(t)
+	Dir = filepath.Join(Dir, "missing")
+
+	if path := Write("engine", fmt.Errorf("decode %q", secret), nil); path != "" {
+		t.Fatalf("got report at %s", path)
+	}
+	out := stderr()
+	if !strings.Contains(out, "-----BEGIN SUBTRACE CRASH REPORT-----") || strings.Contains(out, "hunter2") {
+		t.Errorf("got stderr %q", out)
+	}
+}
+
+func TestRedactQuoted(t *testing.T) {
+	for in, want := range map[string]string{
+		`no quotes`:                     `no quotes`,
+		`can't parse "a\"b" or "c"`:     `can't parse "<redacted>" or "<redacted>"`,
+		"raw `x\\` tail":                "raw `<redacted>` tail",
+		`unterminated "secret and more`: `unterminated "<redacted>`,
+		`empty "" quotes`:               `empty "<redacted>" quotes`,
+	} {
+		if got := redactQuoted(in); got != want {
+			t.Errorf("%s: got %s, want %s", in, got, want)
+		}
+	}
+}
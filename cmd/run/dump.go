@@ -0,0 +1,295 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package run
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/pprof"
+	"time"
+
+	"subtrace.dev/cmd/run/crash"
+	"subtrace.dev/cmd/run/engine"
+	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/cmd/version"
+	"subtrace.dev/logging"
+	"subtrace.dev/tracer"
+)
+
+// dumpTimeout bounds how long a state dump takes. Sections that aren't
+// collected in time, e.g. because a lock they need is held by a stuck
+// goroutine, are left out and marked as timed out in the manifest.
+const dumpTimeout = 10 * time.Second
+
+// dumpManifest is manifest.json, the first file of a state dump.
+type dumpManifest struct {
+	Version  string              `json:"version"`
+	Time     time.Time           `json:"time"`
+	PID      int                 `json:"pid"`
+	Trigger  string              `json:"trigger"`
+	Sections []dumpManifestEntry `json:"sections"`
+}
+
+type dumpManifestEntry struct {
+	File  string `json:"file"`
+	Bytes int    `json:"bytes"`
+	Took  string `json:"took"`
+	Error string `json:"error,omitempty"`
+}
+
+type dumpSection struct {
+	file    string
+	collect func() ([]byte, error)
+}
+
+// introspect records an engine and its inode table for state dumps.
+func (c *Command) introspect(eng *engine.Engine, itab *socket.InodeTable) {
+	c.inspect.mu.Lock()
+	defer c.inspect.mu.Unlock()
+	c.inspect.engines = append(c.inspect.engines, eng)
+	for _, t := range c.inspect.itabs {
+		if t == itab {
+			return
+		}
+	}
+	c.inspect.itabs = append(c.inspect.itabs, itab)
+}
+
+// registerCrashCounts makes crash reports count what state dumps list.
+func (c *Command) registerCrashCounts() {
+	crash.RegisterCount("processes", func() int {
+		c.inspect.mu.Lock()
+		engines := c.inspect.engines
+		c.inspect.mu.Unlock()
+		n := 0
+		for _, eng := range engines {
+			n += eng.Processes()
+		}
+		return n
+	})
+	crash.RegisterCount("sockets", func() int {
+		c.inspect.mu.Lock()
+		itabs := c.inspect.itabs
+		c.inspect.mu.Unlock()
+		n := 0
+		for _, itab := range itabs {
+			n += itab.Len()
+		}
+		return n
+	})
+	crash.RegisterCount("proxies", socket.Running)
+}
+
+func (c *Command) dumpSections() []dumpSection {
+	c.inspect.mu.Lock()
+	engines, itabs := c.inspect.engines, c.inspect.itabs
+	c.inspect.mu.Unlock()
+
+	return []dumpSection{
+		{"goroutines.txt", func() ([]byte, error) {
+			var b bytes.Buffer
+			err := pprof.Lookup("goroutine").WriteTo(&b, 2)
+			return b.Bytes(), err
+		}},
+		{"processes.json", func() ([]byte, error) {
+			var procs []engine.ProcessStatus
+			for _, eng := range engines {
+				procs = append(procs, eng.Status().Processes...)
+			}
+			return dumpJSON(procs)
+		}},
+		{"inodes.json", func() ([]byte, error) {
+			var inodes []socket.InodeInfo
+			for _, itab := range itabs {
+				inodes = append(inodes, itab.Snapshot()...)
+			}
+			return dumpJSON(inodes)
+		}},
+		{"proxies.json", func() ([]byte, error) { return dumpJSON(socket.Proxies()) }},
+		{"bandwidth.json", func() ([]byte, error) { return dumpJSON(socket.Bandwidth(0)) }},
+		{"dispatch.json", func() ([]byte, error) { return dumpJSON(socket.Dispatch()) }},
+		{"parser.json", func() ([]byte, error) { return dumpJSON(socket.Parser()) }},
+		{"startup.json", func() ([]byte, error) { return dumpJSON(c.startup.timings()) }},
+		{"publisher.json", func() ([]byte, error) { return dumpJSON(tracer.DefaultPublisher.Metrics()) }},
+		{"sinks.json", func() ([]byte, error) { return dumpJSON(tracer.SinkMetrics()) }},
+		{"cache.json", func() ([]byte, error) { return dumpJSON(tracer.CacheEffectiveness(0)) }},
+		{"capabilities.json", func() ([]byte, error) { return dumpJSON(c.capabilities()) }},
+		{"config.yaml", func() ([]byte, error) {
+			if c.global == nil || c.global.Config == nil {
+				return nil, nil
+			}
+			return c.global.Config.Dump()
+		}},
+		{"connections.json", func() ([]byte, error) {
+			var events []map[string]string
+			for _, tags := range tracer.RecentConnections() {
+				scrubbed := make(map[string]string, len(tags))
+				for k, v := range tags {
+					scrubbed[k] = scrubSecrets(k, v)
+				}
+				events = append(events, scrubbed)
+			}
+			return dumpJSON(events)
+		}},
+		{"log.txt", func() ([]byte, error) {
+			var b bytes.Buffer
+			for _, line := range logging.Recent() {
+				b.WriteString(scrubSecrets("", line))
+				b.WriteByte('\n')
+			}
+			return b.Bytes(), nil
+		}},
+	}
+}
+
+func dumpJSON(v any) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+var (
+	secretName  = regexp.MustCompile(`(?i)token|secret|passw(or)?d|authorization|cookie|api[_-]?key|credential`)
+	secretValue = regexp.MustCompile(`(?i)([\w.-]*(?:token|secret|passw(?:or)?d|authorization|cookie|api[_-]?key|credential)[\w.-]*)(=|: ?)("(?:[^"\\]|\\.)*"|(?:(?:bearer|basic) )?\S+)`)
+)
+
+// scrubSecrets redacts the value of a tag whose name looks like it holds a
+// credential, and key=value pairs that look like credentials within it, such
+// as -token=... on a command line or authorization="..." in a log line.
+func scrubSecrets(name string, value string) string {
+	if name != "" && secretName.MatchString(name) {
+		return "<redacted>"
+	}
+	return secretValue.ReplaceAllString(value, "${1}${2}<redacted>")
+}
+
+// writeStateDump writes a tar.gz of everything the tracer knows about its
+// state: goroutine stacks, traced processes, socket inodes, running proxies,
+// metrics, the config in force, recent connection events and recent log lines.
+// Each section is a read-only snapshot and none contains payload bytes.
+func (c *Command) writeStateDump(w io.Writer, trigger string) error {
+	manifest := dumpManifest{
+		Version: version.GetCanonicalString(),
+		Time:    time.Now().UTC(),
+		PID:     os.Getpid(),
+		Trigger: trigger,
+	}
+
+	type result struct {
+		b   []byte
+		err error
+	}
+	deadline := time.After(dumpTimeout)
+	var files [][]byte
+	for _, s := range c.dumpSections() {
+		begin := time.Now()
+		ch := make(chan result, 1)
+		go func() {
+			b, err := s.collect()
+			ch <- result{b, err}
+		}()
+
+		entry := dumpManifestEntry{File: s.file}
+		var r result
+		select {
+		case r = <-ch:
+		case <-deadline:
+			r.err = fmt.Errorf("timed out")
+		}
+		if r.err != nil {
+			entry.Error = r.err.Error()
+			r.b = nil
+		}
+		entry.Bytes, entry.Took = len(r.b), time.Since(begin).Round(time.Microsecond).String()
+		manifest.Sections = append(manifest.Sections, entry)
+		files = append(files, r.b)
+	}
+
+	b, err := dumpJSON(manifest)
+	if err != nil {
+		return fmt.Errorf("encode manifest: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	add := func(name string, b []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(b)), ModTime: manifest.Time}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("%s: write header: %w", name, err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			return fmt.Errorf("%s: write: %w", name, err)
+		}
+		return nil
+	}
+	if err := add("manifest.json", b); err != nil {
+		return err
+	}
+	for i, entry := range manifest.Sections {
+		if entry.Error == "" {
+			if err := add(entry.File, files[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("close tar: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("close gzip: %w", err)
+	}
+	return nil
+}
+
+// dumpStateFile writes a state dump to -dump-dir, e.g. on SIGQUIT. Dumps
+// requested while one is being written are skipped.
+func (c *Command) dumpStateFile(trigger string) {
+	if !c.inspect.dumping.CompareAndSwap(false, true) {
+		slog.Debug("skipped state dump while another is in progress", "trigger", trigger)
+		return
+	}
+	defer c.inspect.dumping.Store(false)
+
+	dir := c.flags.dumpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	path := filepath.Join(dir, fmt.Sprintf("subtrace-dump-%d-%s.tar.gz", os.Getpid(), time.Now().UTC().Format("20060102T150405Z")))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		slog.Error("failed to create state dump", "path", path, "err", err)
+		return
+	}
+	err = c.writeStateDump(f, trigger)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		slog.Error("failed to write state dump", "path", path, "err", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "subtrace: wrote state dump to %s\n", path)
+}
+
+// serveDebugDump serves a state dump as a tar.gz download.
+func (c *Command) serveDebugDump(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	if err := c.writeStateDump(&b, "http"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := fmt.Sprintf("subtrace-dump-%d.tar.gz", os.Getpid())
+	w.Header().Set("content-type", "application/gzip")
+	w.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if _, err := w.Write(b.Bytes()); err != nil {
+		slog.Debug("failed to write debug dump response", "err", err) // not fatal
+	}
+}
@@ -4,13 +4,13 @@
 package engine
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"runtime"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,12 +19,13 @@ import (
 	"unsafe"
 
 	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/crash"
 	"subtrace.dev/cmd/run/engine/process"
 	"subtrace.dev/cmd/run/engine/seccomp"
 	"subtrace.dev/cmd/run/socket"
 	"subtrace.dev/cmd/run/syscalls"
-	"subtrace.dev/cmd/version"
 	"subtrace.dev/global"
+	"subtrace.dev/procfs"
 )
 
 type Engine struct {
@@ -37,6 +38,8 @@ type Engine struct {
 	threads   map[int]*process.Process
 	running   chan struct{}
 	inPanic   atomic.Bool
+	detached  atomic.Bool
+	inflight  inflight
 }
 
 func New(global *global.Global, seccomp *seccomp.Listener, itab *socket.InodeTable, root *process.Process) *Engine {
@@ -49,45 +52,95 @@ func New(global *global.Global, seccomp *seccomp.Listener, itab *socket.InodeTab
 		threads:   map[int]*process.Process{},
 		running:   make(chan struct{}),
 	}
+	root.Adopt = e.adopt
 	go e.waitProcess(root)
 	return e
 }
 
 func (e *Engine) ensureProcessLocked(pid int) *process.Process {
+	p, err := e.tryEnsureProcessLocked(pid)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (e *Engine) tryEnsureProcessLocked(pid int) (*process.Process, error) {
 	if _, ok := e.processes[pid]; !ok {
 		tgid, err := getThreadGroupID(pid)
 		if err != nil {
-			panic(fmt.Errorf("read process: %w", err))
+			return nil, fmt.Errorf("read process: %w", err)
 		}
 		if tgid != pid {
-			leader := e.ensureProcessLocked(tgid)
+			leader, err := e.tryEnsureProcessLocked(tgid)
+			if err != nil {
+				return nil, err
+			}
 			e.threads[pid] = leader
-			return leader
+			return leader, nil
 		}
 
 		p, err := process.New(e.global, e.itab, pid)
 		if err != nil {
-			panic(fmt.Errorf("new process: %w", err))
+			return nil, fmt.Errorf("new process: %w", err)
 		}
+		p.Adopt = e.adopt
 
 		slog.Debug("observed new process", "proc", p)
 
-		// Import the new process' known inodes as sockets. We do this with the
-		// engine locked because this needs to happen exactly once for each process
-		// and must happen before handling the process' first syscall.
-		if err := e.importInodes(p); err != nil {
-			panic(fmt.Errorf("new process %d: import inodes: %w", p.PID, err))
+		parent := e.parentLocked(pid)
+		untraced := parent != nil && p.InheritExclusion(parent)
+		if parent != nil && p.SharesFiles(parent) {
+			// Created with clone(CLONE_FILES), so the parent's sockets are its
+			// sockets, and the ones either of them creates later too.
+			p.ShareFiles(parent)
+			slog.Debug("process shares fd table with parent", "proc", p, "parent", parent)
+		} else if untraced {
+			// Forked by an excluded process, which has no sockets to inherit.
+			slog.Debug("process excluded like its parent", "proc", p, "parent", parent)
+		} else if err := e.importInodes(p); err != nil {
+			// Import the new process' known inodes as sockets. We do this with the
+			// engine locked because this needs to happen exactly once for each
+			// process and must happen before handling the process' first syscall.
+			return nil, fmt.Errorf("new process %d: import inodes: %w", p.PID, err)
 		}
 
 		e.processes[pid] = p
 		go e.waitProcess(p)
 	}
 
-	return e.processes[pid]
+	return e.processes[pid], nil
+}
+
+// parentLocked returns the parent of process pid if it's traced.
+func (e *Engine) parentLocked(pid int) *process.Process {
+	ppid, err := getParentID(pid)
+	if err != nil {
+		return nil
+	}
+	return e.processes[ppid]
+}
+
+// adopt registers a process that a traced process forked before the child
+// makes its first syscall (see process.handleClone). The child may already be
+// gone.
+func (e *Engine) adopt(pid int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.tryEnsureProcessLocked(pid); err != nil {
+		slog.Debug("failed to adopt forked process", "pid", pid, "err", err)
+	}
 }
 
 func (e *Engine) importInodes(p *process.Process) error {
-	dirfd, err := unix.Open(fmt.Sprintf("/proc/%d/fd/", p.PID), unix.O_RDONLY, 0o700)
+	if !procfs.Has(procfs.FeatureFDs) {
+		return nil
+	}
+
+	dirfd, err := unix.Open(procfs.Path("%d/fd", p.PID), unix.O_RDONLY, 0o700)
+	if procfs.Degrade(procfs.FeatureFDs, err) {
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("open dir: %w", err)
 	}
@@ -144,7 +197,7 @@ func (e *Engine) importInodes(p *process.Process) error {
 			}
 
 			if err := p.ImportInode(targetFD, inode); err != nil {
-				return fmt.Errorf("import %d: %w", inode.Number, err)
+				return fmt.Errorf("import %d: %w", inode.Number(), err)
 			}
 
 			count += 1
@@ -201,6 +254,11 @@ func (e *Engine) countRunning() int {
 	return len(e.processes)
 }
 
+// Processes returns the number of live traced processes.
+func (e *Engine) Processes() int {
+	return e.countRunning()
+}
+
 func (e *Engine) closeLocked() error {
 	select {
 	case <-e.running:
@@ -220,10 +278,87 @@ func (e *Engine) Close() error {
 	return e.closeLocked()
 }
 
+// Detach stops tracing without closing the listener so that another process
+// can take it over: from then on, every syscall is left to the kernel, and the
+// ones whose handlers may block for as long as the tracee would (e.g. a
+// blocking accept(2) on a traced listener) are failed with EINTR so that the
+// tracee retries them untraced. It returns once the other notifications
+// received so far are answered. Connections that were already proxied keep
+// going through their proxies for as long as this process runs.
+func (e *Engine) Detach() {
+	if e.detached.Swap(true) {
+		return
+	}
+	e.inflight.mu.Lock()
+	blocking := make([]*seccomp.Notif, 0, len(e.inflight.blocking))
+	for n := range e.inflight.blocking {
+		blocking = append(blocking, n)
+	}
+	clear(e.inflight.blocking)
+	e.inflight.mu.Unlock()
+
+	for _, n := range blocking {
+		if err := abortNotif(n); err != nil {
+			slog.Debug("failed to abort blocking notification on detach", "pid", n.PID, "syscall", syscalls.GetName(n.Syscall), "err", err)
+		}
+	}
+
+	// The other handlers don't block, so the notifications they're handling
+	// are answered shortly. Whoever takes over the listener can't answer them.
+	for deadline := time.Now().Add(detachWait); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		e.inflight.mu.Lock()
+		left := len(e.inflight.notifs)
+		e.inflight.mu.Unlock()
+		if left == 0 {
+			return
+		}
+	}
+	slog.Warn("detached with seccomp notifications still being handled")
+}
+
+// detachWait is how long Detach waits for the notifications being handled.
+const detachWait = time.Second
+
 func (e *Engine) Wait() {
 	<-e.running
 }
 
+// Status is a snapshot of what the engine is still tracing.
+type Status struct {
+	Processes []ProcessStatus // sorted by PID
+}
+
+type ProcessStatus struct {
+	PID  int
+	Name string // empty if unknown
+}
+
+// Status returns a snapshot of the traced processes that haven't exited yet.
+func (e *Engine) Status() Status {
+	e.mu.RLock()
+	pids := make([]int, 0, len(e.processes))
+	for pid := range e.processes {
+		pids = append(pids, pid)
+	}
+	e.mu.RUnlock()
+
+	slices.Sort(pids)
+
+	var s Status
+	for _, pid := range pids {
+		ps := ProcessStatus{PID: pid}
+		if procfs.Has(procfs.FeatureMetadata) {
+			if b, err := os.ReadFile(procfs.Path("%d/comm", pid)); err == nil {
+				ps.Name = strings.TrimSpace(string(b))
+			} else {
+				procfs.Degrade(procfs.FeatureMetadata, err)
+			}
+		}
+		s.Processes = append(s.Processes, ps)
+	}
+	return s
+}
+
 func (e *Engine) panicGuard(main, failed chan *seccomp.Notif) {
 	err := recover()
 	if err == nil {
@@ -233,27 +368,9 @@ func (e *Engine) panicGuard(main, failed chan *seccomp.Notif) {
 	stack := debug.Stack()
 	e.inPanic.Store(true)
 
-	b := new(bytes.Buffer)
-	fmt.Fprintf(b, "subtrace: engine panic: %v\n", err)
-	fmt.Fprintf(b, "\n")
-	fmt.Fprintf(b, "-----BEGIN SUBTRACE CRASH REPORT-----\n")
-	fmt.Fprintf(b, "time: %s\n", time.Now().Format(time.RFC3339Nano))
-	fmt.Fprintf(b, "version: %s\n", version.Full(false))
-	fmt.Fprintf(b, "panic: %+v\n", err)
-	fmt.Fprintf(b, "stack trace: %s\n", strings.TrimSpace(string(stack)))
-	fmt.Fprintf(b, "-----END SUBTRACE CRASH REPORT-----\n")
-	fmt.Fprintf(b, "\n")
-	fmt.Fprintf(b, "[CRITICAL] !!! Subtrace encountered a critical error. The tracing engine will\n")
-	fmt.Fprintf(b, "[CRITICAL] !!! now enter safe mode. New requests will no longer be traced.\n")
-	fmt.Fprintf(b, "[CRITICAL] !!! We're sorry about this. Please consider filing a bug report at\n")
-	fmt.Fprintf(b, "[CRITICAL] !!! https://github.com/subtrace/subtrace with the above crash report.\n")
-	fmt.Fprintf(b, "\n")
-
-	// Write all the bytes at once so that there's as little interference between
-	// different processes writing to stderr at the same time. The tracer NEVER
-	// writes to stdout or stderr for this exact reason (unless it is started
-	// with -v or -log=true), but this is the exception to the rule.
-	os.Stderr.Write(b.Bytes())
+	// The report goes first in case draining the channels blocks.
+	crash.Write("engine", err, stack)
+	os.Stderr.WriteString("[CRITICAL] The tracing engine is now in safe mode: new requests will no longer be traced.\n")
 
 	go e.drainSafeMode(failed)
 	e.drainSafeMode(main)
@@ -268,6 +385,11 @@ func (e *Engine) drainSafeMode(ch chan *seccomp.Notif) {
 }
 
 func (e *Engine) handle(n *seccomp.Notif) {
+	if e.detached.Load() {
+		n.Skip()
+		return
+	}
+
 	handler := process.Handlers[n.Syscall]
 	if handler == nil {
 		slog.Error(fmt.Sprintf("no handler found for %s", syscalls.GetName(n.Syscall)))
@@ -275,6 +397,10 @@ func (e *Engine) handle(n *seccomp.Notif) {
 	}
 
 	p := e.getProcess(n.PID)
+	if p.Excluded(n.Syscall) {
+		n.Skip()
+		return
+	}
 
 	switch err := handler(p, n); {
 	case err == nil:
@@ -283,6 +409,7 @@ func (e *Engine) handle(n *seccomp.Notif) {
 		// don't need to do anything more here.
 	default:
 		slog.Error(fmt.Sprintf("critical error in handling %s", syscalls.GetName(n.Syscall)), "notif", n, "proc", p, "err", err)
+		p.FailInternal(n, err)
 	}
 }
 
@@ -326,16 +453,28 @@ func (e *Engine) Start() {
 					return
 				}
 				e.handle(n)
+				e.untrackNotif(n)
 				pending = nil
 			}
 		}()
 	}
 
+	stop := make(chan struct{})
+	defer close(stop)
+	go e.watchdog(stop)
+
 dispatch:
 	for e.countRunning() > 0 {
 		n, errno := e.seccomp.Receive()
 		switch errno {
 		case 0:
+			// Processes that rules exclude entirely are answered right away
+			// rather than by a worker.
+			if p := e.getProcessFast(n.PID); p != nil && p.Passthrough(n.Syscall) {
+				n.Skip()
+				continue
+			}
+			e.trackNotif(n)
 			ch <- n
 		case unix.ENOENT:
 			// The target was killed by a signal or its syscall was interrupted by a
@@ -359,7 +498,16 @@ dispatch:
 }
 
 func getThreadGroupID(pid int) (int, error) {
-	path := fmt.Sprintf("/proc/%d/status", pid)
+	return getStatusField(pid, "Tgid")
+}
+
+func getParentID(pid int) (int, error) {
+	return getStatusField(pid, "PPid")
+}
+
+// getStatusField returns the numeric field key of /proc/<pid>/status.
+func getStatusField(pid int, key string) (int, error) {
+	path := procfs.Path("%d/status", pid)
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return 0, fmt.Errorf("read %s: %w", path, err)
@@ -370,13 +518,13 @@ func getThreadGroupID(pid int) (int, error) {
 		if !ok {
 			continue
 		}
-		if strings.TrimSpace(k) == "Tgid" {
-			tgid, err := strconv.Atoi(strings.TrimSpace(v))
+		if strings.TrimSpace(k) == key {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
 			if err != nil {
-				return 0, fmt.Errorf("parse tgid: %w", err)
+				return 0, fmt.Errorf("parse %s: %w", strings.ToLower(key), err)
 			}
-			return tgid, nil
+			return n, nil
 		}
 	}
-	return 0, fmt.Errorf("parse tgid: row not found")
+	return 0, fmt.Errorf("parse %s: row not found", strings.ToLower(key))
 }
@@ -0,0 +1,409 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package inject installs the tracer's seccomp filter in a process that's
+// already running. A filter can only be installed by a thread of the process
+// it applies to, so one of its threads is stopped with ptrace(2) and made to
+// call seccomp(2) itself from the syscall instruction in its vDSO, after
+// which SECCOMP_FILTER_FLAG_TSYNC extends the filter to the other threads.
+// The thread is then put back exactly where it was stopped.
+package inject
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"subtrace.dev/cmd/run/engine/seccomp"
+	"subtrace.dev/cmd/run/fd"
+	"subtrace.dev/procfs"
+)
+
+// ErrPermission is returned if this process isn't allowed to ptrace(2) the
+// target, e.g. without CAP_SYS_PTRACE or because of the Yama LSM.
+var ErrPermission = errors.New("not permitted to ptrace the process")
+
+// ErrNoNewPrivs is returned if the target has neither CAP_SYS_ADMIN nor the
+// no_new_privs bit, one of which seccomp(2) requires (see Options.NoNewPrivs).
+var ErrNoNewPrivs = errors.New("the process has neither CAP_SYS_ADMIN nor no_new_privs set")
+
+var errExited = errors.New("the thread exited")
+
+type Options struct {
+	// NoNewPrivs sets the no_new_privs bit of the target before installing the
+	// filter. From then on, execve(2) no longer grants the privileges of setuid
+	// binaries and file capabilities to the target and its children, which is
+	// why it's opt-in.
+	NoNewPrivs bool
+}
+
+// Attachment is a seccomp filter installed in a running process whose
+// injecting thread hasn't been let go yet.
+type Attachment struct {
+	Listener *seccomp.Listener
+
+	t       *thread
+	fd      int     // the listener's file descriptor in the target
+	scratch uintptr // the page mapped in the target for the filter
+	size    uintptr
+	release chan chan error
+}
+
+// Attach installs a filter that notifies the returned listener of syscalls in
+// every thread of process pid. Release must be called once the caller answers
+// the listener's notifications: the thread that installed the filter stays
+// stopped until then because cleaning up after it makes syscalls the filter
+// may notify, like close(2).
+func Attach(pid int, syscalls []int, opts Options) (*Attachment, error) {
+	instrs, err := seccomp.BuildFilter(syscalls)
+	if err != nil {
+		return nil, fmt.Errorf("build filter: %w", err)
+	}
+
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return nil, fmt.Errorf("pidfd_open: %w", err)
+	}
+	defer unix.Close(pidfd)
+
+	a := &Attachment{release: make(chan chan error)}
+	attached := make(chan error, 1)
+	go func() {
+		// Every ptrace(2) request must come from the thread that seized the
+		// tracee.
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		t, err := seize(pid)
+		if err != nil {
+			attached <- err
+			return
+		}
+		a.t = t
+		defer t.mem.Close()
+
+		if err := a.install(pidfd, instrs, opts); err != nil {
+			if a.scratch != 0 {
+				t.syscall(unix.SYS_MUNMAP, a.scratch, a.size)
+			}
+			t.detach()
+			attached <- err
+			return
+		}
+		attached <- nil
+
+		done := <-a.release
+		done <- a.finish()
+	}()
+	if err := <-attached; err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Release closes the target's copy of the listener, unmaps the filter and
+// lets the injecting thread resume whatever it was doing.
+func (a *Attachment) Release() error {
+	done := make(chan error)
+	a.release <- done
+	return <-done
+}
+
+func (a *Attachment) install(pidfd int, instrs []linux.BPFInstruction, opts Options) error {
+	if opts.NoNewPrivs {
+		if _, errno, err := a.t.syscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1); err != nil {
+			return fmt.Errorf("prctl: %w", err)
+		} else if errno != 0 {
+			return fmt.Errorf("prctl: PR_SET_NO_NEW_PRIVS: %w", errno)
+		}
+	}
+
+	// The struct sock_fprog and the instructions it points to go into a page
+	// of their own rather than on the thread's stack, which might not have
+	// room for them (e.g. a goroutine's).
+	b := make([]byte, 16+8*len(instrs))
+	size := uintptr((len(b) + os.Getpagesize() - 1) &^ (os.Getpagesize() - 1))
+	addr, errno, err := a.t.syscall(unix.SYS_MMAP, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS, ^uintptr(0), 0)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	} else if errno != 0 {
+		return fmt.Errorf("mmap: %w", errno)
+	}
+	a.scratch, a.size = addr, size
+
+	binary.NativeEndian.PutUint16(b[0:], uint16(len(instrs)))
+	binary.NativeEndian.PutUint64(b[8:], uint64(addr+16))
+	for i, ins := range instrs {
+		off := 16 + 8*i
+		binary.NativeEndian.PutUint16(b[off:], ins.OpCode)
+		b[off+2], b[off+3] = ins.JumpIfTrue, ins.JumpIfFalse
+		binary.NativeEndian.PutUint32(b[off+4:], ins.K)
+	}
+	if _, err := a.t.mem.WriteAt(b, int64(addr)); err != nil {
+		return fmt.Errorf("write filter: %w", err)
+	}
+
+	ret, errno, err := a.t.syscall(unix.SYS_SECCOMP, seccomp.SECCOMP_SET_MODE_FILTER, seccomp.FilterFlags(), addr)
+	switch {
+	case err != nil:
+		return fmt.Errorf("seccomp: %w", err)
+	case errno == unix.EACCES && !opts.NoNewPrivs:
+		return fmt.Errorf("seccomp: %w: %w", errno, ErrNoNewPrivs)
+	case errno == unix.ESRCH:
+		return fmt.Errorf("seccomp: %w (a thread has a different seccomp filter)", errno)
+	case errno != 0:
+		return fmt.Errorf("seccomp: %w", errno)
+	}
+	a.fd = int(ret)
+
+	// The filter can't be removed anymore. If this fails, the target's filtered
+	// syscalls wait for a listener nobody answers, but pidfd_getfd(2) needs the
+	// same permission as ptrace(2), which was just used.
+	local, err := unix.PidfdGetfd(pidfd, a.fd, 0)
+	if err != nil {
+		return fmt.Errorf("pidfd_getfd: %w", err)
+	}
+	lfd := fd.NewFD(local)
+	defer lfd.DecRef()
+	a.Listener = seccomp.NewFromFD(lfd)
+	return nil
+}
+
+func (a *Attachment) finish() error {
+	var errs []error
+	if _, errno, err := a.t.syscall(unix.SYS_CLOSE, uintptr(a.fd)); err != nil || errno != 0 {
+		errs = append(errs, fmt.Errorf("close listener: %w", cmpErr(err, errno)))
+	}
+	if _, errno, err := a.t.syscall(unix.SYS_MUNMAP, a.scratch, a.size); err != nil || errno != 0 {
+		errs = append(errs, fmt.Errorf("munmap filter: %w", cmpErr(err, errno)))
+	}
+	if err := a.t.detach(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func cmpErr(err error, errno syscall.Errno) error {
+	if err != nil {
+		return err
+	}
+	return errno
+}
+
+// thread is a thread of the target stopped with ptrace(2).
+type thread struct {
+	pid, tid int
+	mem      *os.File // /proc/<pid>/mem
+	insn     uintptr  // a syscall instruction
+	saved    regs     // registers when the thread was stopped
+
+	// signals are the signals that arrived while the thread was made to run
+	// syscalls for us. They're sent again once it's let go.
+	signals []unix.Signal
+}
+
+// seize stops a thread of process pid.
+func seize(pid int) (*thread, error) {
+	mem, err := os.OpenFile(procfs.Path("%d/mem", pid), os.O_RDWR, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, fmt.Errorf("open %s: %w", procfs.Path("%d/mem", pid), ErrPermission)
+		}
+		return nil, fmt.Errorf("open %s: %w", procfs.Path("%d/mem", pid), err)
+	}
+	insn, err := findSyscallInsn(pid, mem)
+	if err != nil {
+		mem.Close()
+		return nil, err
+	}
+
+	ents, err := os.ReadDir(procfs.Path("%d/task", pid))
+	if err != nil {
+		mem.Close()
+		return nil, fmt.Errorf("list threads: %w", err)
+	}
+	errs := []error{fmt.Errorf("no thread of %d could be stopped", pid)}
+	for _, ent := range ents {
+		tid, err := strconv.Atoi(ent.Name())
+		if err != nil {
+			continue
+		}
+		_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SEIZE, uintptr(tid), 0, unix.PTRACE_O_TRACESYSGOOD, 0, 0)
+		switch errno {
+		case 0:
+		case unix.EPERM:
+			mem.Close()
+			return nil, fmt.Errorf("ptrace %d: %w: %w", tid, errno, ErrPermission)
+		default:
+			errs = append(errs, fmt.Errorf("ptrace %d: %w", tid, errno)) // e.g. exited
+			continue
+		}
+
+		t := &thread{pid: pid, tid: tid, mem: mem, insn: insn}
+		if err := t.interrupt(); err != nil {
+			unix.PtraceDetach(tid)
+			errs = append(errs, fmt.Errorf("interrupt %d: %w", tid, err))
+			continue
+		}
+		return t, nil
+	}
+	mem.Close()
+	return nil, errors.Join(errs...)
+}
+
+// findSyscallInsn returns the address of a syscall instruction in the vDSO of
+// process pid, which every process has one of at an address that doesn't
+// change for as long as it runs.
+func findSyscallInsn(pid int, mem *os.File) (uintptr, error) {
+	f, err := os.Open(procfs.Path("%d/maps", pid))
+	if err != nil {
+		return 0, fmt.Errorf("read memory map: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 6 || fields[5] != "[vdso]" {
+			continue
+		}
+		lo, hi, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			break
+		}
+		start, err1 := strconv.ParseUint(lo, 16, 64)
+		end, err2 := strconv.ParseUint(hi, 16, 64)
+		if err1 != nil || err2 != nil || end <= start {
+			break
+		}
+		b := make([]byte, end-start)
+		if _, err := mem.ReadAt(b, int64(start)); err != nil {
+			return 0, fmt.Errorf("read vdso: %w", err)
+		}
+		for i := 0; i+len(syscallInsn) <= len(b); i += syscallInsnAlign {
+			if bytes.Equal(b[i:i+len(syscallInsn)], syscallInsn) {
+				return uintptr(start) + uintptr(i), nil
+			}
+		}
+		return 0, fmt.Errorf("no syscall instruction in the vdso")
+	}
+	return 0, fmt.Errorf("no vdso mapping")
+}
+
+// wait waits for the thread's next stop.
+func (t *thread) wait() (unix.WaitStatus, error) {
+	var ws unix.WaitStatus
+	for {
+		_, err := unix.Wait4(t.tid, &ws, unix.WALL, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return ws, fmt.Errorf("wait4: %w", err)
+		}
+		if ws.Exited() || ws.Signaled() {
+			return ws, errExited
+		}
+		return ws, nil
+	}
+}
+
+// isEventStop reports whether ws is a PTRACE_EVENT_STOP, which PTRACE_INTERRUPT
+// and group-stops cause.
+func isEventStop(ws unix.WaitStatus) bool {
+	return ws.Stopped() && int(ws>>16) == unix.PTRACE_EVENT_STOP
+}
+
+// isSignalStop reports whether ws is a signal-delivery-stop. The signal is
+// suppressed when the thread is resumed and sent again once it's let go.
+func isSignalStop(ws unix.WaitStatus) bool {
+	return ws.Stopped() && ws>>16 == 0 && ws.StopSignal() != unix.SIGTRAP|0x80
+}
+
+// interrupt stops the thread and saves its registers.
+func (t *thread) interrupt() error {
+	if err := unix.PtraceInterrupt(t.tid); err != nil {
+		return err
+	}
+	for {
+		ws, err := t.wait()
+		if err != nil {
+			return err
+		}
+		if isEventStop(ws) {
+			break
+		}
+		if isSignalStop(ws) {
+			t.signals = append(t.signals, ws.StopSignal())
+		}
+		if err := unix.PtraceCont(t.tid, 0); err != nil {
+			return fmt.Errorf("continue: %w", err)
+		}
+	}
+	if err := getRegs(t.tid, &t.saved); err != nil {
+		return fmt.Errorf("get registers: %w", err)
+	}
+	return nil
+}
+
+// syscall makes the thread run system call nr with args and returns its
+// return value, or the errno it failed with.
+func (t *thread) syscall(nr int, args ...uintptr) (uintptr, syscall.Errno, error) {
+	var a [6]uintptr
+	copy(a[:], args)
+	r := t.saved
+	setSyscall(&r, t.insn, nr, a)
+	if err := setRegs(t.tid, &r); err != nil {
+		return 0, 0, fmt.Errorf("set registers: %w", err)
+	}
+
+	for stops := 0; stops < 2; { // syscall-enter-stop and syscall-exit-stop
+		if err := unix.PtraceSyscall(t.tid, 0); err != nil {
+			return 0, 0, fmt.Errorf("resume: %w", err)
+		}
+		ws, err := t.wait()
+		if err != nil {
+			return 0, 0, err
+		}
+		switch {
+		case ws.Stopped() && ws.StopSignal() == unix.SIGTRAP|0x80:
+			stops++
+		case isSignalStop(ws):
+			t.signals = append(t.signals, ws.StopSignal())
+		}
+	}
+
+	if err := getRegs(t.tid, &r); err != nil {
+		return 0, 0, fmt.Errorf("get registers: %w", err)
+	}
+	ret := syscallResult(&r)
+	if v := int64(ret); v < 0 && v > -4096 {
+		return 0, syscall.Errno(-v), nil
+	}
+	return ret, 0, nil
+}
+
+// detach restores the thread's registers and lets it go.
+func (t *thread) detach() error {
+	r := restartRegs(t.saved)
+	var errs []error
+	if err := setRegs(t.tid, &r); err != nil {
+		errs = append(errs, fmt.Errorf("restore registers: %w", err))
+	}
+	if err := unix.PtraceDetach(t.tid); err != nil {
+		errs = append(errs, fmt.Errorf("detach: %w", err))
+	}
+	for _, sig := range t.signals {
+		unix.Tgkill(t.pid, t.tid, sig)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,73 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package inject
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/procfs"
+)
+
+// TestAttach installs a filter in a running sleep(1), which is stopped in
+// clock_nanosleep(2) the whole time, and checks that the filter notifies the
+// listener and that the process finishes sleeping once it's let go.
+func TestAttach(t *testing.T) {
+	cmd := exec.Command("sleep", "1")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("start sleep: %v", err)
+	}
+	defer cmd.Process.Kill()
+	time.Sleep(100 * time.Millisecond) // until it's sleeping
+
+	start := time.Now()
+	a, err := Attach(cmd.Process.Pid, []int{unix.SYS_CLOSE}, Options{NoNewPrivs: true})
+	if errors.Is(err, ErrPermission) {
+		t.Skipf("attach: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+
+	closes := make(chan int, 16)
+	go func() {
+		for {
+			n, errno := a.Listener.Receive()
+			if errno != 0 {
+				return
+			}
+			closes <- int(n.Args[0])
+			n.Skip()
+		}
+	}()
+	if err := a.Release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	select {
+	case fd := <-closes:
+		if fd != a.fd {
+			t.Errorf("got close(%d), want the listener's close(%d)", fd, a.fd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the listener wasn't notified of close(2)")
+	}
+
+	b, err := os.ReadFile(procfs.Path("%d/status", cmd.Process.Pid))
+	if err != nil || !strings.Contains(string(b), "Seccomp:\t2") {
+		t.Errorf("the filter isn't installed: %v", err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("sleep: %v", err)
+	}
+	if took := time.Since(start); took > 3*time.Second {
+		t.Errorf("sleep took %s after attaching", took)
+	}
+	a.Listener.Close()
+}
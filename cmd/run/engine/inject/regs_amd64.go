@@ -0,0 +1,57 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package inject
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+type regs = unix.PtraceRegs
+
+// syscallInsn is the syscall instruction.
+var syscallInsn = []byte{0x0f, 0x05}
+
+const syscallInsnAlign = 1
+
+func getRegs(tid int, r *regs) error {
+	return unix.PtraceGetRegs(tid, r)
+}
+
+func setRegs(tid int, r *regs) error {
+	return unix.PtraceSetRegs(tid, r)
+}
+
+// setSyscall makes r execute system call nr with args at the syscall
+// instruction at pc. orig_rax is cleared so that the kernel doesn't restart
+// the syscall the thread was stopped in, if any, at pc.
+func setSyscall(r *regs, pc uintptr, nr int, args [6]uintptr) {
+	r.Rip = uint64(pc)
+	r.Rax = uint64(nr)
+	r.Orig_rax = ^uint64(0)
+	r.Rdi, r.Rsi, r.Rdx, r.R10, r.R8, r.R9 = uint64(args[0]), uint64(args[1]), uint64(args[2]), uint64(args[3]), uint64(args[4]), uint64(args[5])
+}
+
+func syscallResult(r *regs) uintptr {
+	return uintptr(r.Rax)
+}
+
+// restartRegs returns the registers to restore to resume a thread stopped at r.
+// A thread stopped while in a syscall that has to be restarted has the
+// kernel's -ERESTART* return value in rax, which the kernel would have turned
+// into a restart if the thread hadn't been made to run something else, so it's
+// done here instead.
+func restartRegs(r regs) regs {
+	if int64(r.Orig_rax) >= 0 {
+		switch int64(r.Rax) {
+		case -512, -513, -514: // ERESTARTSYS, ERESTARTNOINTR, ERESTARTNOHAND
+			r.Rax = r.Orig_rax
+			r.Rip -= 2
+		case -516: // ERESTART_RESTARTBLOCK
+			r.Rax = unix.SYS_RESTART_SYSCALL
+			r.Rip -= 2
+		}
+	}
+	r.Orig_rax = ^uint64(0)
+	return r
+}
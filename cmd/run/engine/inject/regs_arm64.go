@@ -0,0 +1,46 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package inject
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+type regs = unix.PtraceRegsArm64
+
+// syscallInsn is svc #0.
+var syscallInsn = []byte{0x01, 0x00, 0x00, 0xd4}
+
+const syscallInsnAlign = 4
+
+const ntPRStatus = 1 // NT_PRSTATUS
+
+func getRegs(tid int, r *regs) error {
+	return unix.PtraceGetRegSetArm64(tid, ntPRStatus, r)
+}
+
+func setRegs(tid int, r *regs) error {
+	return unix.PtraceSetRegSetArm64(tid, ntPRStatus, r)
+}
+
+// setSyscall makes r execute system call nr with args at the syscall
+// instruction at pc.
+func setSyscall(r *regs, pc uintptr, nr int, args [6]uintptr) {
+	r.Pc = uint64(pc)
+	r.Regs[8] = uint64(nr)
+	for i, arg := range args {
+		r.Regs[i] = uint64(arg)
+	}
+}
+
+func syscallResult(r *regs) uintptr {
+	return uintptr(r.Regs[0])
+}
+
+// restartRegs returns the registers to restore to resume a thread stopped at r.
+// On arm64, the kernel has already rewound a syscall that has to be restarted
+// by the time the thread stops.
+func restartRegs(r regs) regs {
+	return r
+}
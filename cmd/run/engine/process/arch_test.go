@@ -0,0 +1,60 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"subtrace.dev/cmd/run/syscalls"
+)
+
+// TestLegacySyscalls checks that where this architecture still has an older
+// variant of a syscall we handle, we handle it too. arm64 only has the newer
+// ones, so a variant that amd64 tracees use and we don't handle is invisible
+// on arm64.
+func TestLegacySyscalls(t *testing.T) {
+	for _, tt := range []struct{ legacy, handled string }{
+		{"SYS_OPEN", "SYS_OPENAT"},
+		{"SYS_STAT", "SYS_NEWFSTATAT"},
+		{"SYS_LSTAT", "SYS_NEWFSTATAT"},
+		{"SYS_DUP2", "SYS_DUP3"},
+		{"SYS_FORK", "SYS_CLONE"},
+		{"SYS_VFORK", "SYS_CLONE"},
+		{"SYS_ACCEPT", "SYS_ACCEPT4"},
+		{"SYS_SOCKETCALL", "SYS_SOCKET"},
+	} {
+		legacy, ok := syscalls.Lookup(tt.legacy)
+		if !ok {
+			continue
+		}
+		handled, ok := syscalls.Lookup(tt.handled)
+		if !ok || Handlers[handled] == nil {
+			continue
+		}
+		if Handlers[legacy] == nil {
+			t.Errorf("%s is handled but %s isn't", tt.handled, tt.legacy)
+		}
+	}
+}
+
+// TestStatLayout checks that the stat struct handleFstatat writes to the
+// tracee is laid out like the kernel's on this architecture, which differs
+// between amd64 and arm64.
+func TestStatLayout(t *testing.T) {
+	want := linux.Stat{Ino: 1, Mode: 2, Nlink: 3, Size: 4, Blksize: 5}
+	b := make([]byte, want.SizeBytes())
+	want.MarshalBytes(b)
+
+	var got unix.Stat_t
+	if len(b) != int(unsafe.Sizeof(got)) {
+		t.Fatalf("got %d bytes, want %d", len(b), unsafe.Sizeof(got))
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&got)), len(b)), b)
+	if got.Ino != 1 || got.Mode != 2 || got.Nlink != 3 || got.Size != 4 || got.Blksize != 5 {
+		t.Errorf("got %+v", got)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/capability"
+	"subtrace.dev/cmd/run/engine/seccomp"
+	"subtrace.dev/cmd/run/socket"
+)
+
+func init() {
+	capability.RegisterFeature("dns", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: Handlers[unix.SYS_RECVFROM] != nil, Detail: "lookups over UDP sent with sendto, sendmsg or sendmmsg and received with recvfrom, recvmsg or recvmmsg, and over TCP"}
+	})
+}
+
+// maxObservedDatagram is how much of a datagram sent to port 53 is read from
+// the tracee's memory to observe it. Queries are much smaller than this.
+const maxObservedDatagram = 4096
+
+// EnableDNSTracing registers handlers that observe the DNS queries the tracee
+// sends on datagram sockets and the responses it receives without emulating
+// either: every handler leaves the syscall to the kernel. sendmsg(2) and
+// sendmmsg(2) are only registered if EnableWriteAccounting didn't already,
+// in which case the emulated send observes the query. Queries sent with
+// write(2) on a connected socket and responses received with read(2), which
+// would make every file read and write a notification, aren't observed. It
+// must be called after EnableWriteAccounting and before the seccomp filter is
+// installed.
+func EnableDNSTracing() {
+	socket.TraceDNS = true
+
+	Handlers[unix.SYS_SENDTO] = func(p *Process, n *seccomp.Notif) error {
+		return p.handleSendtoDNS(n, int(int32(n.Args[0])), uintptr(n.Args[1]), int(n.Args[2]), uintptr(n.Args[4]), int(n.Args[5]))
+	}
+	if Handlers[unix.SYS_SENDMSG] == nil {
+		Handlers[unix.SYS_SENDMSG] = func(p *Process, n *seccomp.Notif) error {
+			return p.handleSendmsgDNS(n, int(int32(n.Args[0])), uintptr(n.Args[1]), 1)
+		}
+	}
+	if Handlers[unix.SYS_SENDMMSG] == nil {
+		Handlers[unix.SYS_SENDMMSG] = func(p *Process, n *seccomp.Notif) error {
+			return p.handleSendmsgDNS(n, int(int32(n.Args[0])), uintptr(n.Args[1]), int(uint32(n.Args[2])))
+		}
+	}
+	for _, nr := range []int{unix.SYS_RECVFROM, unix.SYS_RECVMSG, unix.SYS_RECVMMSG} {
+		Handlers[nr] = func(p *Process, n *seccomp.Notif) error {
+			return p.handleRecvDNS(n, int(int32(n.Args[0])))
+		}
+	}
+}
+
+// getDatagramSocket returns the tracked datagram socket for fd, if any.
+func (p *Process) getDatagramSocket(fd int) (*socket.Socket, bool) {
+	s, ok := p.getSocket(fd)
+	if !ok || !s.Inode.IsDatagram() {
+		return nil, false
+	}
+	return s, true
+}
+
+// handleSendtoDNS observes a datagram sent with sendto(2) and leaves the send
+// to the kernel.
+func (p *Process) handleSendtoDNS(n *seccomp.Notif, fd int, bufAddr uintptr, size int, addrPtr uintptr, addrSize int) error {
+	s, ok := p.getDatagramSocket(fd)
+	if !ok || size <= 0 {
+		return n.Skip()
+	}
+	var to netip.AddrPort
+	if addrPtr != 0 {
+		addr, errno, err := p.vmReadSockaddr(n, addrPtr, addrSize)
+		if err != nil || errno != 0 {
+			return n.Skip() // let the kernel fail it the same way
+		}
+		to = addr
+	}
+	p.observeDNSSend(n, s, to, []unix.RemoteIovec{{Base: bufAddr, Len: size}})
+	return n.Skip()
+}
+
+// handleSendmsgDNS observes the datagrams sent with sendmsg(2), or the first
+// vlen sent with sendmmsg(2) (sendmsg is vlen 1 with a struct msghdr instead
+// of a struct mmsghdr, which starts with one), and leaves the send to the
+// kernel.
+func (p *Process) handleSendmsgDNS(n *seccomp.Notif, fd int, addr uintptr, vlen int) error {
+	s, ok := p.getDatagramSocket(fd)
+	if !ok {
+		return n.Skip()
+	}
+
+	const sizeofMmsghdr = sizeofMsghdr + 8 // struct mmsghdr with padding
+
+	for i := range min(vlen, 16) { // resolvers send two queries (A and AAAA) at once
+		msg, errno, err := p.vmReadMsghdr(n, addr+uintptr(i*sizeofMmsghdr))
+		if err != nil || errno != 0 {
+			break
+		}
+		var to netip.AddrPort
+		if msg.name != 0 {
+			if to, errno, err = p.vmReadSockaddr(n, msg.name, msg.namelen); err != nil || errno != 0 {
+				break
+			}
+		}
+		iovs, errno, err := p.vmReadIovecs(n, msg.iov, msg.iovlen)
+		if err != nil || errno != 0 {
+			break
+		}
+		p.observeDNSSend(n, s, to, iovs)
+	}
+	return n.Skip()
+}
+
+// observeDNSSend reads a datagram sent to port 53 from the tracee's memory and
+// observes it. Failing to read it is never propagated to the tracee: the
+// kernel fails the send the same way.
+func (p *Process) observeDNSSend(n *seccomp.Notif, s *socket.Socket, to netip.AddrPort, iovs []unix.RemoteIovec) {
+	if _, ok := s.DNSDestination(to); !ok {
+		return
+	}
+	b, errno, err := p.vmReadVectored(n, iovs, maxObservedDatagram)
+	if err != nil || errno != 0 || len(b) == 0 {
+		return
+	}
+	s.ObserveDNSSend(to, b)
+}
+
+// handleRecvDNS observes the datagram about to be received with recvfrom(2),
+// recvmsg(2) or recvmmsg(2) if it may answer a DNS query, and leaves the
+// receive to the kernel.
+func (p *Process) handleRecvDNS(n *seccomp.Notif, fd int) error {
+	if s, ok := p.getDatagramSocket(fd); ok {
+		s.ObserveDNSReceive()
+	}
+	return n.Skip()
+}
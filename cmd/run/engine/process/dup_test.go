@@ -0,0 +1,44 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLowestFreeFD(t *testing.T) {
+	p := &Process{PID: os.Getpid()}
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	used := int(f.Fd())
+
+	got, err := p.lowestFreeFD(used)
+	if err != nil {
+		t.Skipf("lowest free fd: %v", err)
+	}
+	if got <= used {
+		t.Errorf("got fd %d, want one past fd %d, which is open", got, used)
+	}
+	if _, err := unix.FcntlInt(uintptr(got), unix.F_GETFD, 0); err != unix.EBADF {
+		t.Errorf("got fd %d, which is open", got)
+	}
+
+	var rl unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rl); err != nil {
+		t.Fatalf("getrlimit: %v", err)
+	}
+	if errno := p.checkFD(got); errno != 0 {
+		t.Errorf("check fd %d: got %v, want success", got, errno)
+	}
+	if errno := p.checkFD(int(rl.Cur)); errno != unix.EBADF {
+		t.Errorf("check fd %d past the limit: got %v, want EBADF", rl.Cur, errno)
+	}
+}
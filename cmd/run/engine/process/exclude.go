@@ -0,0 +1,145 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/engine/seccomp"
+	"subtrace.dev/config"
+	"subtrace.dev/procfs"
+)
+
+// Values of Process.exclusion.
+const (
+	exclusionUnknown uint32 = iota
+	exclusionNo
+	exclusionYes
+)
+
+// Limits on how much of a pending execve(2)'s argv is read to decide whether
+// the new program is excluded.
+const (
+	maxExecArgs    = 64
+	maxExecArgSize = 4096
+)
+
+// keepsTracking reports whether syscall nr is handled even for an excluded
+// process, because it ends the process or changes what it runs or where.
+func keepsTracking(nr int) bool {
+	switch nr {
+	case unix.SYS_EXIT, unix.SYS_EXIT_GROUP, unix.SYS_EXECVE, unix.SYS_EXECVEAT, unix.SYS_SETNS, unix.SYS_UNSHARE:
+		return true
+	}
+	return false
+}
+
+// Passthrough reports whether syscall nr can be handed back to the kernel
+// without being handled because rules exclude the process entirely. It only
+// looks at a decision that was already made, so it never reads anything from
+// the process and doesn't allocate. An excluded process gets real sockets
+// that aren't proxied, and sockets it inherited from a traced parent stay
+// open until it exits.
+func (p *Process) Passthrough(nr int) bool {
+	return p.exclusion.Load() == exclusionYes && !keepsTracking(nr)
+}
+
+// Excluded is Passthrough for a process whose exclusion may not have been
+// decided yet, which it decides first.
+func (p *Process) Excluded(nr int) bool {
+	if p.exclusion.Load() == exclusionUnknown {
+		p.exclusion.CompareAndSwap(exclusionUnknown, p.decideExclusion())
+	}
+	return p.Passthrough(nr)
+}
+
+func (p *Process) decideExclusion() uint32 {
+	if !p.global.Config.HasProcessRules() || !p.global.Config.ExcludesProcess(p.processInfo()) {
+		return exclusionNo
+	}
+	slog.Debug("process is excluded by rule", "proc", p)
+	return exclusionYes
+}
+
+// InheritExclusion gives a forked process its parent's decision, since both
+// run the same program until the child calls execve(2). It reports whether
+// the parent is excluded and has no traced sockets for the child to import.
+func (p *Process) InheritExclusion(parent *Process) bool {
+	state := parent.exclusion.Load()
+	p.exclusion.Store(state)
+	if state != exclusionYes {
+		return false
+	}
+
+	files := parent.files.Load()
+	files.mu.RLock()
+	defer files.mu.RUnlock()
+	return len(files.sockets) == 0
+}
+
+// exclusionAtExec decides whether the program a pending execve(2) runs is
+// excluded before it makes its first syscall, so that a short-lived helper
+// never gets a proxied socket. The executable is taken to be the base name of
+// the path passed to execve(2), which differs from the one in the event
+// template for symlinks and scripts. If the exec fails, the decision stays
+// with the program that tried it, which usually exits right after. Processes
+// are left undecided if that's not enough to tell, e.g. with rules on the
+// environment.
+func (p *Process) exclusionAtExec(n *seccomp.Notif, pathAddr uintptr, argvAddr uintptr) uint32 {
+	c := p.global.Config
+	if !c.HasProcessRules() {
+		return exclusionNo
+	}
+	if c.NeedsProcessEnv() {
+		return exclusionUnknown
+	}
+
+	path, errno, err := p.vmReadString(n, pathAddr, unix.PathMax)
+	if errno != 0 || err != nil || path == "" {
+		return exclusionUnknown
+	}
+	info := config.ProcessInfo{Executable: filepath.Base(path)}
+	if c.NeedsProcessCommandLine() {
+		args, ok := p.readExecArgs(n, argvAddr)
+		if !ok {
+			return exclusionUnknown
+		}
+		info.CommandLine = strings.Join(args, " ")
+	}
+	if c.NeedsContainerID() {
+		info.ContainerID = procfs.ContainerID(p.PID)
+	}
+
+	if !c.ExcludesProcess(info) {
+		return exclusionNo
+	}
+	slog.Debug("exec target is excluded by rule", "proc", p, "executable", info.Executable)
+	return exclusionYes
+}
+
+// readExecArgs reads the NULL-terminated argv array of a pending execve(2).
+// It reports false if the array is longer than maxExecArgs or can't be read.
+func (p *Process) readExecArgs(n *seccomp.Notif, argvAddr uintptr) ([]string, bool) {
+	b, errno, err := p.vmReadBytes(n, argvAddr, 8*maxExecArgs)
+	if errno != 0 || err != nil {
+		return nil, false
+	}
+
+	var args []string
+	for i := 0; i+8 <= len(b); i += 8 {
+		ptr := uintptr(arch.Uint64(b[i:]))
+		if ptr == 0 {
+			return args, true
+		}
+		arg, errno, err := p.vmReadString(n, ptr, maxExecArgSize)
+		if errno != 0 || err != nil {
+			return nil, false
+		}
+		args = append(args, arg)
+	}
+	return nil, false
+}
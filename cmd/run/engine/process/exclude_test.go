@@ -0,0 +1,95 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/global"
+	"subtrace.dev/procfs"
+)
+
+// excludedHelpers returns n processes running the test binary under a config
+// that excludes it, standing in for helpers like curl spawned per request.
+func excludedHelpers(tb testing.TB, n int) []*Process {
+	procfs.Init()
+	if !procfs.Has(procfs.FeatureMetadata) {
+		tb.Skip("process metadata unavailable")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		tb.Fatalf("executable: %v", err)
+	}
+
+	path := filepath.Join(tb.TempDir(), "subtrace.yaml")
+	content := fmt.Sprintf("rules:\n  - process: {executable: %q}\n    then: exclude\n", filepath.Base(exe))
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		tb.Fatal(err)
+	}
+	c := config.New()
+	if err := c.Load(path); err != nil {
+		tb.Fatalf("load config: %v", err)
+	}
+
+	g := &global.Global{Config: c}
+	helpers := make([]*Process, n)
+	for i := range helpers {
+		helpers[i] = &Process{global: g, PID: os.Getpid()}
+		helpers[i].files.Store(newFDTable())
+	}
+	return helpers
+}
+
+func TestExcluded(t *testing.T) {
+	helpers := excludedHelpers(t, 1000)
+	for _, p := range helpers {
+		if p.Passthrough(unix.SYS_SOCKET) {
+			t.Fatalf("passthrough before the exclusion was decided")
+		}
+		if !p.Excluded(unix.SYS_SOCKET) {
+			t.Fatalf("socket(2) of an excluded process isn't passed through")
+		}
+		if p.Excluded(unix.SYS_EXECVE) {
+			t.Fatalf("execve(2) of an excluded process is passed through")
+		}
+	}
+
+	child := &Process{global: helpers[0].global, PID: os.Getpid()}
+	child.files.Store(newFDTable())
+	if !child.InheritExclusion(helpers[0]) || !child.Passthrough(unix.SYS_CONNECT) {
+		t.Errorf("child of an excluded process isn't excluded")
+	}
+
+	// The CONTINUE path for excluded processes only looks at the cached
+	// decision, so it must stay far below the cost of the notification.
+	r := testing.Benchmark(func(b *testing.B) {
+		benchmarkPassthrough(b, helpers)
+	})
+	if r.AllocsPerOp() != 0 || r.NsPerOp() > 2000 {
+		t.Errorf("got %d ns/op, %d allocs/op for excluded processes, want at most 2µs and none", r.NsPerOp(), r.AllocsPerOp())
+	}
+}
+
+func BenchmarkPassthrough(b *testing.B) {
+	helpers := excludedHelpers(b, 1000)
+	for _, p := range helpers {
+		p.Excluded(unix.SYS_SOCKET)
+	}
+	benchmarkPassthrough(b, helpers)
+}
+
+func benchmarkPassthrough(b *testing.B, helpers []*Process) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !helpers[i%len(helpers)].Passthrough(unix.SYS_CONNECT) {
+			b.Fatalf("connect(2) of an excluded process isn't passed through")
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/engine/seccomp"
+	"subtrace.dev/cmd/run/fd"
+	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/procfs"
+)
+
+// fdTable maps the file descriptors of a process to the sockets they refer
+// to. Processes created with clone(CLONE_FILES) share one, just like they
+// share the kernel's file descriptor table.
+type fdTable struct {
+	mu      sync.RWMutex
+	sockets map[int]*socket.Socket
+	users   int // processes sharing the table
+
+	// forking is held for writing while a process forks and its child is
+	// registered, and for reading while sockets are closed. Otherwise the
+	// parent could close a socket the child inherited before the child holds
+	// its own reference, which would close it for the child too.
+	forking sync.RWMutex
+}
+
+func newFDTable() *fdTable {
+	return &fdTable{sockets: make(map[int]*socket.Socket), users: 1}
+}
+
+// release drops a process's use of the table and returns the sockets to close
+// if it was the last one.
+func (t *fdTable) release() map[int]*socket.Socket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.users--; t.users > 0 {
+		return nil
+	}
+	return t.sockets
+}
+
+// ShareFiles makes the process use parent's file descriptor table, which it
+// shares because it was created with clone(CLONE_FILES). It must be called
+// before the process's first syscall is handled.
+func (p *Process) ShareFiles(parent *Process) {
+	files := parent.files.Load()
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	files.users++
+	p.files.Store(files)
+}
+
+// SharesFiles reports whether the process and q share a file descriptor table.
+func (p *Process) SharesFiles(q *Process) bool {
+	const KCMP_FILES = 2 // see /usr/include/linux/kcmp.h
+	ret, _, errno := unix.Syscall6(unix.SYS_KCMP, uintptr(p.PID), uintptr(q.PID), KCMP_FILES, 0, 0, 0)
+	return errno == 0 && ret == 0
+}
+
+// unshareFiles gives the process its own copy of a file descriptor table that
+// it shared with others, like the kernel does on execve(2) and
+// unshare(CLONE_FILES). Both happen when the syscall succeeds, which is
+// assumed.
+func (p *Process) unshareFiles() {
+	old := p.files.Load()
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	if old.users == 1 {
+		return
+	}
+
+	files := newFDTable()
+	for targetFD, s := range old.sockets {
+		if !s.FD.IncRef() {
+			continue
+		}
+		dup, err := unix.FcntlInt(uintptr(s.FD.FD()), unix.F_DUPFD_CLOEXEC, 0)
+		s.FD.DecRef()
+		if err != nil {
+			slog.Debug("failed to copy socket for unshared fd table", "proc", p, "sock", s, "err", err) // not fatal
+			continue
+		}
+		dupFD := fd.NewFD(dup)
+		files.sockets[targetFD] = socket.NewSocket(p.getGlobal(), p.getEventTemplate().Copy(), s.Inode, dupFD)
+		dupFD.DecRef()
+	}
+	old.users--
+	p.files.Store(files)
+	slog.Debug("unshared fd table", "proc", p, "sockets", len(files.sockets))
+}
+
+// handleClone handles fork(2), vfork(2), clone(2) and clone3(2). Threads are
+// tracked through their thread group, but a new process is registered as
+// soon as it exists so that it holds its own references to the sockets it
+// inherits before the parent can close them. Preforking servers, which fork
+// workers after listen(2) and sometimes close the listener in the parent,
+// depend on that.
+func (p *Process) handleClone(n *seccomp.Notif, flags uint64) error {
+	if flags&(unix.CLONE_THREAD|unix.CLONE_PARENT) != 0 || p.Adopt == nil {
+		return n.Skip()
+	}
+
+	files := p.files.Load()
+	files.forking.Lock()
+	defer files.forking.Unlock()
+
+	before, err := children(p.PID, n.PID)
+	if err != nil {
+		// The child imports the sockets it inherited on its first syscall
+		// instead (see Engine.importInodes).
+		slog.Debug("failed to read children, not waiting for fork", "proc", p, "tid", n.PID, "err", err)
+		return n.Skip()
+	}
+	if err := n.Skip(); err != nil {
+		return err
+	}
+
+	if child, ok := waitChild(p.PID, n.PID, n.Syscall, before); ok {
+		p.Adopt(child)
+	}
+	return nil
+}
+
+// handleClone3 handles clone3(2), whose flags are in the clone_args struct.
+func (p *Process) handleClone3(n *seccomp.Notif, argsAddr uintptr) error {
+	b, errno, err := p.vmReadBytes(n, argsAddr, 8)
+	if err != nil {
+		return err
+	}
+	if errno != 0 || len(b) < 8 {
+		return n.Skip() // the kernel fails it the same way
+	}
+	return p.handleClone(n, arch.Uint64(b))
+}
+
+// children returns the processes that thread tid of process pid created.
+func children(pid, tid int) ([]int, error) {
+	b, err := os.ReadFile(procfs.Path("%d/task/%d/children", pid, tid))
+	if err != nil {
+		return nil, err
+	}
+	var ret []int
+	for _, f := range strings.Fields(string(b)) {
+		if child, err := strconv.Atoi(f); err == nil {
+			ret = append(ret, child)
+		}
+	}
+	return ret, nil
+}
+
+// forkTimeout bounds how long handleClone waits for the child to appear.
+var forkTimeout = time.Second
+
+// waitChild waits for thread tid of process pid to create a child other than
+// the ones in before. It returns false if the thread left syscall nr without
+// creating one, which happens when fork fails.
+func waitChild(pid, tid int, nr int, before []int) (int, bool) {
+	deadline := time.Now().Add(forkTimeout)
+	for delay := 50 * time.Microsecond; ; delay = min(2*delay, 5*time.Millisecond) {
+		done := leftSyscall(pid, tid, nr)
+		after, err := children(pid, tid)
+		if err != nil {
+			return 0, false // the parent exited
+		}
+		for _, child := range after {
+			if !slices.Contains(before, child) {
+				return child, true
+			}
+		}
+		if done || time.Now().After(deadline) {
+			slog.Debug("no child after fork", "pid", pid, "tid", tid, "left", done)
+			return 0, false
+		}
+		time.Sleep(delay)
+	}
+}
+
+// leftSyscall reports whether thread tid of process pid is known to be past
+// syscall nr because it's blocked somewhere else. A running thread may still
+// be in it.
+func leftSyscall(pid, tid int, nr int) bool {
+	b, err := os.ReadFile(procfs.Path("%d/task/%d/syscall", pid, tid))
+	if err != nil {
+		return false // can't tell, so wait for the deadline
+	}
+	f, _, _ := strings.Cut(strings.TrimSpace(string(b)), " ")
+	return f != "running" && f != strconv.Itoa(nr)
+}
@@ -0,0 +1,67 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+)
+
+// TestShareFiles shares a socket table between two processes, as
+// clone(CLONE_FILES) does, and unshares it, as execve(2) does. The socket
+// must stay open until both copies are closed.
+func TestShareFiles(t *testing.T) {
+	g := &global.Global{Config: config.New()}
+	parent := &Process{global: g, PID: os.Getpid()}
+	parent.files.Store(newFDTable())
+	child := &Process{global: g, PID: os.Getpid()}
+
+	if !child.SharesFiles(parent) {
+		t.Skip("kcmp(KCMP_FILES) unavailable")
+	}
+
+	sock, err := socket.CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	parent.files.Load().sockets[3] = sock
+
+	child.ShareFiles(parent)
+	if s, ok := child.getSocket(3); !ok || s != sock {
+		t.Fatalf("got socket %v, %v in the shared table, want the parent's", s, ok)
+	}
+	if sockets := parent.files.Load().release(); sockets != nil {
+		t.Fatalf("parent's exit released %d sockets of a table the child still uses", len(sockets))
+	}
+	parent.files.Load().users++
+
+	child.unshareFiles()
+	copied, ok := child.getSocket(3)
+	if !ok || copied == sock || copied.Inode != sock.Inode {
+		t.Fatalf("got socket %v, %v after unsharing, want a copy on the same inode", copied, ok)
+	}
+	if users := parent.files.Load().users; users != 1 {
+		t.Fatalf("got %d users of the parent's table after unsharing, want 1", users)
+	}
+
+	for _, p := range []*Process{parent, child} {
+		for _, s := range p.files.Load().release() {
+			if errno := s.Close(); errno != 0 {
+				t.Fatalf("close: %v", errno)
+			}
+		}
+		if info := sock.Inode.Info(); p == parent && (info.State == "closed" || info.Open != 1) {
+			t.Fatalf("got inode %+v after the parent's copy was closed, want it open with the child's copy", info)
+		}
+	}
+	if info := sock.Inode.Info(); info.State != "closed" {
+		t.Fatalf("got inode %+v after both copies were closed, want it closed", info)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"subtrace.dev/cmd/run/socket"
 	"subtrace.dev/cmd/run/syscalls"
 	"subtrace.dev/cmd/run/tls"
+	"subtrace.dev/procfs"
 )
 
 // handleExit handles the exit(2) syscall.
@@ -49,18 +50,25 @@ func (p *Process) handleExecve(n *seccomp.Notif, pathAddr uintptr, argvAddr uint
 	// Invalidate the event template cache so that sockets created by the new
 	// program will require re-reading values for process event fields such as
 	// process_exec_name, process_exec_size and process_cmdline.
+	// The same goes for the config resolved for the process.
 	p.tmpl.Store(nil)
+	p.resolved.Store(nil)
+	p.exclusion.Store(p.exclusionAtExec(n, pathAddr, argvAddr))
+	p.unshareFiles()
 	return n.Skip()
 }
 
 func (p *Process) handleExecveat(n *seccomp.Notif, dirfd int, pathAddr uintptr, argvAddr uintptr, envpAddr uintptr, flags int) error {
 	p.tmpl.Store(nil)
+	p.resolved.Store(nil)
+	p.exclusion.Store(p.exclusionAtExec(n, pathAddr, argvAddr))
+	p.unshareFiles()
 	return n.Skip()
 }
 
 func (p *Process) resolveDirfd(dirfd int) (string, syscall.Errno, error) {
 	if dirfd == unix.AT_FDCWD {
-		path, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", p.PID))
+		path, err := os.Readlink(procfs.Path("%d/cwd", p.PID))
 		if err != nil {
 			return "", 0, fmt.Errorf("readlink cwd: %w", err)
 		}
@@ -80,7 +88,7 @@ func (p *Process) resolveDirfd(dirfd int) (string, syscall.Errno, error) {
 	}()
 	defer fd.DecRef()
 
-	path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd.FD()))
+	path, err := os.Readlink(procfs.Path("self/fd/%d", fd.FD()))
 	if err != nil {
 		return "", 0, fmt.Errorf("readlink dirfd: %w", err)
 	}
@@ -94,7 +102,15 @@ func (p *Process) resolvePath(n *seccomp.Notif, dirfd int, pathAddr uintptr) (st
 	}
 
 	if !filepath.IsAbs(path) {
+		if !procfs.Has(procfs.FeatureFDs) {
+			// Relative paths can't be resolved, so they never match a known CA
+			// store path and the caller lets the kernel handle the syscall.
+			return path, 0, nil
+		}
 		dirpath, errno, err := p.resolveDirfd(dirfd)
+		if procfs.Degrade(procfs.FeatureFDs, err) {
+			return path, 0, nil
+		}
 		if errno != 0 || err != nil {
 			return "", errno, err
 		}
@@ -125,7 +141,10 @@ func (p *Process) handleOpen(n *seccomp.Notif, dirfd int, pathAddr uintptr, flag
 
 	slog.Debug("handling TLS CA cert file open", "path", path)
 
-	ephemeralPEM := tls.GetEphemeralCAPEM()
+	ephemeralPEM, err := tls.GetEphemeralCAPEM()
+	if err != nil {
+		return fmt.Errorf("inject ephemeral CA: %w", err)
+	}
 
 	orig, err := os.ReadFile(path)
 	if err != nil {
@@ -159,14 +178,12 @@ func fdcwd() uintptr {
 	return uintptr(x)
 }
 
-// handleFstatat handles the fstatat(2) syscall. We intercept it to ensure that
-// the file size of the system root CA store is consistent with the ephemeral
-// CA injection we do in the open(2) handler.
+// handleFstatat handles the fstatat(2), stat(2) and lstat(2) syscalls. We
+// intercept them to ensure that the file size of the system root CA store is
+// consistent with the ephemeral CA injection we do in the open(2) handler.
 //
 // Note that we don't handle fstat(2) because it directly operates on an open
 // file descriptor.
-//
-// TODO: stat(2)
 func (p *Process) handleFstatat(n *seccomp.Notif, dirfd int, pathAddr uintptr, bufAddr uintptr, flags int) error {
 	path, errno, err := p.resolvePath(n, dirfd, pathAddr)
 	if err != nil {
@@ -179,7 +196,10 @@ func (p *Process) handleFstatat(n *seccomp.Notif, dirfd int, pathAddr uintptr, b
 		return n.Skip()
 	}
 
-	ephemeralPEM := tls.GetEphemeralCAPEM()
+	ephemeralPEM, err := tls.GetEphemeralCAPEM()
+	if err != nil {
+		return fmt.Errorf("inject ephemeral CA: %w", err)
+	}
 
 	var nr int
 	switch runtime.GOARCH {
@@ -225,7 +245,10 @@ func (p *Process) handleStatx(n *seccomp.Notif, dirfd int, pathAddr uintptr, fla
 		return n.Skip()
 	}
 
-	ephemeralPEM := tls.GetEphemeralCAPEM()
+	ephemeralPEM, err := tls.GetEphemeralCAPEM()
+	if err != nil {
+		return fmt.Errorf("inject ephemeral CA: %w", err)
+	}
 
 	pathb := []byte(path)
 
@@ -250,6 +273,10 @@ func (p *Process) handleStatx(n *seccomp.Notif, dirfd int, pathAddr uintptr, fla
 
 // handleClose handles the close(2) syscall.
 func (p *Process) handleClose(n *seccomp.Notif, fd int) error {
+	files := p.files.Load()
+	files.forking.RLock()
+	defer files.forking.RUnlock()
+
 	s, ok := p.getDeleteSocket(fd)
 	if !ok {
 		return n.Skip()
@@ -280,6 +307,80 @@ func (p *Process) handleFcntl(n *seccomp.Notif, srcFD int, cmd int, arg int) err
 		return n.Skip()
 	}
 
+	flags := 0
+	if cmd == unix.F_DUPFD_CLOEXEC {
+		flags = unix.SOCK_CLOEXEC
+	}
+	if arg == 0 {
+		return p.dupSocket(n, src, -1, flags)
+	}
+
+	if arg < 0 || p.checkFD(arg) != 0 {
+		return n.Return(0, unix.EINVAL)
+	}
+	target, err := p.lowestFreeFD(arg)
+	if err != nil {
+		// Without the file descriptor table, the duplicate gets the lowest free
+		// number like dup(2) would.
+		slog.Debug("failed to find free fd, ignoring minimum", "proc", p, "min", arg, "err", err)
+		return p.dupSocket(n, src, -1, flags)
+	}
+	if p.checkFD(target) != 0 {
+		return n.Return(0, unix.EMFILE)
+	}
+	return p.dupSocket(n, src, target, flags)
+}
+
+// handleDup handles the dup(2), dup2(2) and dup3(2) syscalls. newFD is -1 for
+// dup(2). The duplicate is a new Socket on the same Inode, so the connection
+// stays open until the process closes the last file descriptor referring to
+// it (see Inode.remove).
+func (p *Process) handleDup(n *seccomp.Notif, oldFD int, newFD int, flags int) error {
+	if oldFD == newFD || flags&^unix.O_CLOEXEC != 0 {
+		// dup2 returns newFD and dup3 fails with EINVAL, neither of which
+		// changes anything.
+		return n.Skip()
+	}
+
+	src, ok := p.getSocket(oldFD)
+	if newFD < 0 {
+		if !ok {
+			return n.Skip()
+		}
+		return p.dupSocket(n, src, -1, 0)
+	}
+
+	if errno := p.checkFD(newFD); errno != 0 {
+		return n.Return(0, errno)
+	}
+	if ok {
+		return p.dupSocket(n, src, newFD, flags)
+	}
+	if _, replaced := p.getSocket(newFD); !replaced {
+		return n.Skip()
+	}
+
+	// Some other file replaces one of our sockets, so do the dup ourselves to
+	// know when the socket's file descriptor is gone.
+	fd, errno := p.getFD(oldFD)
+	if errno != 0 {
+		return n.Return(0, unix.EBADF)
+	}
+	defer fd.DecRef()
+
+	prev, ok := p.getDeleteSocket(newFD)
+	if _, err := n.AddFDAt(fd, newFD, flags); err != nil {
+		return fmt.Errorf("addfd: %w", err)
+	}
+	if ok {
+		p.closeReplaced(prev, newFD)
+	}
+	return nil
+}
+
+// dupSocket duplicates src into the process's file descriptor table at target,
+// or at the lowest free number if target is -1.
+func (p *Process) dupSocket(n *seccomp.Notif, src *socket.Socket, target int, flags int) error {
 	if !src.FD.IncRef() {
 		return n.Return(0, unix.EBADF)
 	}
@@ -297,34 +398,53 @@ func (p *Process) handleFcntl(n *seccomp.Notif, srcFD int, cmd int, arg int) err
 	dstFD := fd.NewFD(dup)
 	defer dstFD.DecRef()
 
-	dst := socket.NewSocket(p.global, p.getEventTemplate().Copy(), src.Inode, dstFD)
-
-	switch cmd {
-	case unix.F_DUPFD:
-		return p.installSocket(n, dst, 0)
-	case unix.F_DUPFD_CLOEXEC:
-		return p.installSocket(n, dst, unix.SOCK_CLOEXEC)
-	default:
-		panic("unreachable")
+	dst := socket.NewSocket(p.getGlobal(), p.getEventTemplate().Copy(), src.Inode, dstFD)
+	if target < 0 {
+		err = p.installSocket(n, dst, flags)
+	} else {
+		err = p.installSocketAt(n, dst, target, flags)
 	}
+	if err != nil {
+		// The process never got the duplicate, so it mustn't keep the inode
+		// open.
+		dst.Close()
+		return err
+	}
+	return nil
 }
 
 // handleSocket handles the socket(2) syscall.
 func (p *Process) handleSocket(n *seccomp.Notif, domain, typ, protocol int) error {
 	// TODO(adtac): support connect(AF_UNSPEC) on tracked sockets as a way to
 	// dissolve connection state (see connect(2) manpage).
-	if domain != unix.AF_INET && domain != unix.AF_INET6 {
-		return n.Skip()
+	if isObservedOnly(domain, typ) && StrictSockets {
+		return n.Return(0, unix.EAFNOSUPPORT)
 	}
-	if typ&unix.SOCK_STREAM == 0 {
+	if domain == unix.AF_UNIX {
+		if !socket.TraceUnix || typ&sockTypeMask != unix.SOCK_STREAM || protocol != 0 {
+			return n.Skip()
+		}
+	} else if domain != unix.AF_INET && domain != unix.AF_INET6 {
 		return n.Skip()
 	}
-	if protocol == unix.IPPROTO_IP {
-		protocol = unix.IPPROTO_TCP // see /usr/include/linux/in.h
+	switch typ & sockTypeMask {
+	case unix.SOCK_STREAM:
+		if protocol == unix.IPPROTO_IP {
+			protocol = unix.IPPROTO_TCP // see /usr/include/linux/in.h
+		}
+	case unix.SOCK_DGRAM:
+		if protocol != unix.IPPROTO_IP && protocol != unix.IPPROTO_UDP {
+			return n.Skip() // e.g. IPPROTO_ICMP or IPPROTO_UDPLITE
+		}
+		protocol = unix.IPPROTO_UDP
+	default:
+		// SOCK_SEQPACKET (5) has the SOCK_STREAM (1) bit set, so compare the
+		// whole type rather than test for the bit.
+		return n.Skip()
 	}
 
 	switch protocol {
-	case unix.IPPROTO_IP, unix.IPPROTO_TCP:
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP:
 	case unix.IPPROTO_MPTCP:
 		// We currently don't support MPTCP, so behave as the kernel does in this situation [1].
 		// Most applications will fallback to regular TCP, so this is fine. If an application relies on
@@ -336,9 +456,20 @@ func (p *Process) handleSocket(n *seccomp.Notif, domain, typ, protocol int) erro
 		return n.Skip()
 	}
 
-	sock, err := socket.CreateSocket(p.global, p.getEventTemplate().Copy(), domain, typ)
+	var ns *socket.Netns
+	if p.netnsSwitched.Load() {
+		var ok bool
+		if ns, ok = p.getNetns(n.PID); !ok {
+			return n.Skip()
+		}
+	}
+
+	sock, err := socket.CreateSocketInNetns(p.getGlobal(), p.getEventTemplate().Copy(), domain, typ, ns)
 	if err != nil {
-		return fmt.Errorf("create new socket: %w", err)
+		// Let the kernel create an untraced socket rather than failing a
+		// syscall that would've succeeded without subtrace.
+		slog.Debug("failed to create socket, skipping", "proc", p, "domain", domain, "type", typ, "err", err)
+		return n.Skip()
 	}
 	if err := p.installSocket(n, sock, typ&unix.SOCK_CLOEXEC); err != nil {
 		return fmt.Errorf("install: %w", err)
@@ -346,12 +477,66 @@ func (p *Process) handleSocket(n *seccomp.Notif, domain, typ, protocol int) erro
 	return nil
 }
 
+// getNetns returns the network namespace that thread tid creates sockets in,
+// or nil if it's ours. It returns false if the thread's sockets must be left
+// to the kernel because of NetnsPolicy.
+func (p *Process) getNetns(tid int) (*socket.Netns, bool) {
+	ino, foreign, err := socket.InForeignNetns(tid)
+	if err != nil {
+		slog.Debug("failed to read network namespace, assuming ours", "proc", p, "tid", tid, "err", err) // not fatal
+		return nil, true
+	}
+	if !foreign {
+		return nil, true
+	}
+
+	p.netnsMu.Lock()
+	defer p.netnsMu.Unlock()
+	if ns, ok := p.netns[ino]; ok {
+		return ns, ns != nil
+	}
+
+	var ns *socket.Netns
+	if socket.NetnsPolicy == "follow" {
+		ns, err = socket.OpenNetns(tid)
+		if err == nil {
+			err = ns.CanEnter()
+		}
+		if err != nil {
+			ns = nil
+		}
+	}
+	policy := socket.NetnsPolicy
+	if ns == nil {
+		policy = "passthrough"
+	}
+	socket.NoteNetnsSwitch(p.getGlobal(), p.getEventTemplate(), ino, policy, err)
+
+	if p.netns == nil {
+		p.netns = make(map[uint64]*socket.Netns)
+	}
+	p.netns[ino] = ns // nil for passthrough
+	return ns, ns != nil
+}
+
+// handleNetnsSwitch handles setns(2) and unshare(2), which the process may
+// use to move to another network namespace. The kernel does the switch.
+func (p *Process) handleNetnsSwitch(n *seccomp.Notif, net bool) error {
+	if net {
+		p.netnsSwitched.Store(true)
+	}
+	return n.Skip()
+}
+
 // handleConnect handles the bind(2) syscall.
 func (p *Process) handleBind(n *seccomp.Notif, fd int, addrPtr uintptr, addrSize int) error {
-	s, ok := p.getSocket(fd)
+	s, ok := p.getStreamSocket(fd)
 	if !ok {
 		return n.Skip()
 	}
+	if s.Inode.Domain == unix.AF_UNIX {
+		return p.handleBindUnix(n, s, addrPtr, addrSize)
+	}
 
 	bind, errno, err := p.vmReadSockaddr(n, addrPtr, addrSize)
 	if err != nil {
@@ -361,6 +546,11 @@ func (p *Process) handleBind(n *seccomp.Notif, fd int, addrPtr uintptr, addrSize
 		return n.Return(0, errno)
 	}
 
+	if socket.PeerAuthListener(bind) && p.bypassSocket(fd, s) {
+		slog.Debug("bypassing bind of a peer auth listener", "proc", p, "fd", fd, "addr", bind)
+		return n.Skip()
+	}
+
 	errno, err = s.Bind(bind)
 	if err != nil {
 		return fmt.Errorf("bind socket: %w", err)
@@ -372,8 +562,20 @@ func (p *Process) handleBind(n *seccomp.Notif, fd int, addrPtr uintptr, addrSize
 func (p *Process) handleConnect(n *seccomp.Notif, fd int, addrPtr uintptr, addrSize int) error {
 	s, ok := p.getSocket(fd)
 	if !ok {
+		p.observeConnect(n, fd, addrPtr, addrSize)
 		return n.Skip()
 	}
+	if s.Inode.IsDatagram() {
+		// The kernel connects datagram sockets itself, including with AF_UNSPEC
+		// to dissolve the association, which vmReadSockaddr rejects.
+		if peer, errno, err := p.vmReadSockaddr(n, addrPtr, addrSize); err == nil && errno == 0 {
+			s.ObserveConnect(peer)
+		}
+		return n.Skip()
+	}
+	if s.Inode.Domain == unix.AF_UNIX {
+		return p.handleConnectUnix(n, fd, s, addrPtr, addrSize)
+	}
 
 	peer, errno, err := p.vmReadSockaddr(n, addrPtr, addrSize)
 	if err != nil {
@@ -383,7 +585,12 @@ func (p *Process) handleConnect(n *seccomp.Notif, fd int, addrPtr uintptr, addrS
 		return n.Return(0, errno)
 	}
 
-	errno, err = s.Connect(peer)
+	if socket.Bypassed(peer) && p.bypassSocket(fd, s) {
+		slog.Debug("bypassing connect", "proc", p, "fd", fd, "addr", peer)
+		return n.Skip()
+	}
+
+	errno, err = s.Connect(peer, p.itab)
 	if err != nil {
 		return fmt.Errorf("connect socket: %w", err)
 	}
@@ -392,7 +599,7 @@ func (p *Process) handleConnect(n *seccomp.Notif, fd int, addrPtr uintptr, addrS
 
 // handleListen handles the listen(2) syscall.
 func (p *Process) handleListen(n *seccomp.Notif, fd int, backlog int) error {
-	s, ok := p.getSocket(fd)
+	s, ok := p.getStreamSocket(fd)
 	if !ok {
 		return n.Skip()
 	}
@@ -407,9 +614,27 @@ func (p *Process) handleListen(n *seccomp.Notif, fd int, backlog int) error {
 	return n.Skip()
 }
 
+// handleShutdown handles the shutdown(2) syscall. The kernel does the shutdown
+// itself in every case; see (*socket.Socket).Shutdown for what we track.
+func (p *Process) handleShutdown(n *seccomp.Notif, fd int, how int) error {
+	s, ok := p.getStreamSocket(fd)
+	if !ok {
+		return n.Skip()
+	}
+
+	errno, err := s.Shutdown(how)
+	if err != nil {
+		return fmt.Errorf("shutdown socket: %w", err)
+	}
+	if errno != 0 {
+		return n.Return(0, errno)
+	}
+	return n.Skip()
+}
+
 // handleAccept handles the accept(2) and accept4(2) syscalls.
 func (p *Process) handleAccept(n *seccomp.Notif, fd int, addrPtr uintptr, addrSizePtr uintptr, flags int) error {
-	s, ok := p.getSocket(fd)
+	s, ok := p.getStreamSocket(fd)
 	if !ok {
 		return n.Skip()
 	}
@@ -422,7 +647,18 @@ func (p *Process) handleAccept(n *seccomp.Notif, fd int, addrPtr uintptr, addrSi
 		return n.Return(0, errno)
 	}
 
-	if addrPtr != 0 && addrSizePtr != 0 {
+	if addrPtr != 0 && addrSizePtr != 0 && s.Inode.Domain == unix.AF_UNIX {
+		name, errno := ret.UnixPeerAddr()
+		if errno == 0 {
+			errno, err = p.vmWriteSockaddrUnix(n, name, addrPtr, addrSizePtr)
+			if err != nil {
+				return fmt.Errorf("write sock addr: %w", err)
+			}
+		}
+		if errno != 0 {
+			return n.Return(0, errno)
+		}
+	} else if addrPtr != 0 && addrSizePtr != 0 {
 		peer, errno, err := ret.PeerAddr()
 		if err != nil {
 			return fmt.Errorf("get peer addr of accepted socket: %w", err)
@@ -456,13 +692,21 @@ func (p *Process) handleAccept(n *seccomp.Notif, fd int, addrPtr uintptr, addrSi
 	return nil
 }
 
-// handleGetsockopt handles the getsockopt(2) syscall to emulate SO_ERROR.
+// handleGetsockopt handles the getsockopt(2) syscall to emulate SO_ERROR, to
+// report the external connection's TCP_MAXSEG and to report the credentials
+// of the peer of an accepted AF_UNIX connection.
 func (p *Process) handleGetsockopt(n *seccomp.Notif, fd int, level int, name int, valPtr uintptr, valSizePtr uintptr) error {
-	if level != unix.SOL_SOCKET || name != unix.SO_ERROR {
+	switch {
+	case level == unix.SOL_SOCKET && name == unix.SO_ERROR:
+	case level == unix.IPPROTO_TCP && name == unix.TCP_MAXSEG:
+		return p.handleGetMaxseg(n, fd, valPtr, valSizePtr)
+	case level == unix.SOL_SOCKET && (name == unix.SO_PEERCRED || name == unix.SO_PEERSEC):
+		return p.handleGetPeerCred(n, fd, name, valPtr, valSizePtr)
+	default:
 		return n.Skip()
 	}
 
-	s, ok := p.getSocket(fd)
+	s, ok := p.getStreamSocket(fd)
 	if !ok {
 		return n.Skip()
 	}
@@ -485,28 +729,375 @@ func (p *Process) handleGetsockopt(n *seccomp.Notif, fd int, level int, name int
 	return n.Return(0, errno)
 }
 
+// handleGetMaxseg answers getsockopt(TCP_MAXSEG) with the external
+// connection's MSS if it couldn't be mirrored onto the tracee's socket.
+func (p *Process) handleGetMaxseg(n *seccomp.Notif, fd int, valPtr uintptr, valSizePtr uintptr) error {
+	s, ok := p.getStreamSocket(fd)
+	if !ok {
+		return n.Skip()
+	}
+	mss, ok := s.MaxSeg()
+	if !ok {
+		return n.Skip()
+	}
+
+	valSize, errno, err := p.vmReadUint32(n, valSizePtr)
+	if err != nil {
+		return fmt.Errorf("read value size pointer: %w", err)
+	}
+	if errno != 0 || int32(valSize) < 4 {
+		return n.Skip() // let the kernel fail it the same way
+	}
+
+	errno, err = p.vmWriteUint32(n, valPtr, uint32(mss))
+	if err != nil {
+		return fmt.Errorf("write value: %w", err)
+	}
+	if errno != 0 {
+		return n.Return(0, errno)
+	}
+	errno, err = p.vmWriteUint32(n, valSizePtr, 4)
+	if err != nil {
+		return fmt.Errorf("write value size: %w", err)
+	}
+	return n.Return(0, errno)
+}
+
+// handleGetPeerCred answers getsockopt(SO_PEERCRED) and getsockopt(SO_PEERSEC)
+// on a proxied AF_UNIX socket with the external connection's peer, which is
+// the process at the other end rather than subtrace.
+func (p *Process) handleGetPeerCred(n *seccomp.Notif, fd int, name int, valPtr uintptr, valSizePtr uintptr) error {
+	s, ok := p.getStreamSocket(fd)
+	if !ok {
+		return n.Skip()
+	}
+
+	var val []byte
+	switch name {
+	case unix.SO_PEERCRED:
+		cred, errno, ok := s.PeerCred()
+		if !ok {
+			return n.Skip()
+		}
+		if errno != 0 {
+			return n.Return(0, errno)
+		}
+		val = arch.AppendUint32(val, uint32(cred.Pid))
+		val = arch.AppendUint32(val, cred.Uid)
+		val = arch.AppendUint32(val, cred.Gid)
+	case unix.SO_PEERSEC:
+		label, errno, ok := s.PeerSec()
+		if !ok {
+			return n.Skip()
+		}
+		if errno != 0 {
+			return n.Return(0, errno)
+		}
+		val = []byte(label)
+	}
+
+	valSize, errno, err := p.vmReadUint32(n, valSizePtr)
+	if err != nil {
+		return fmt.Errorf("read value size pointer: %w", err)
+	}
+	if errno != 0 {
+		return n.Return(0, errno)
+	}
+	if int32(valSize) < 0 {
+		return n.Return(0, unix.EINVAL)
+	}
+
+	// Like the kernel, SO_PEERCRED is cut down to the buffer and SO_PEERSEC
+	// fails with ERANGE and the size it needs.
+	if int(valSize) < len(val) {
+		if name == unix.SO_PEERSEC {
+			errno, err = p.vmWriteUint32(n, valSizePtr, uint32(len(val)))
+			if err != nil {
+				return fmt.Errorf("write value size: %w", err)
+			}
+			if errno != 0 {
+				return n.Return(0, errno)
+			}
+			return n.Return(0, unix.ERANGE)
+		}
+		val = val[:valSize]
+	}
+
+	errno, err = p.vmWriteBytes(n, valPtr, val)
+	if err != nil {
+		return fmt.Errorf("write value: %w", err)
+	}
+	if errno != 0 {
+		return n.Return(0, errno)
+	}
+	errno, err = p.vmWriteUint32(n, valSizePtr, uint32(len(val)))
+	if err != nil {
+		return fmt.Errorf("write value size: %w", err)
+	}
+	return n.Return(0, errno)
+}
+
 // handleSetsockopt handles the setsockopt(2) syscall to allow ignoring
-// TCP_DEFER_ACCEPT.
+// TCP_DEFER_ACCEPT, or applying it to the external listener instead if
+// socket.MirrorDeferAccept is set. SO_SNDBUF and SO_RCVBUF are set on behalf
+// of the tracee so that the proxy's sockets can be resized to match.
 func (p *Process) handleSetsockopt(n *seccomp.Notif, fd int, level int, name int, valPtr uintptr, valSize uint32) error {
-	_, ok := p.getSocket(fd)
+	s, ok := p.getStreamSocket(fd)
 	if !ok {
 		return n.Skip()
 	}
 
 	if level == unix.SOL_TCP && name == unix.TCP_DEFER_ACCEPT {
+		if !socket.MirrorDeferAccept {
+			return n.Return(0, 0)
+		}
+		if valSize < 4 {
+			return n.Return(0, unix.EINVAL)
+		}
+		val, errno, err := p.vmReadUint32(n, valPtr)
+		if err != nil {
+			return fmt.Errorf("read value: %w", err)
+		}
+		if errno != 0 {
+			return n.Return(0, errno)
+		}
+		s.DeferAccept(int(int32(val)))
 		return n.Return(0, 0)
 	}
 
+	if level == unix.SOL_SOCKET && (name == unix.SO_SNDBUF || name == unix.SO_RCVBUF) {
+		if valSize < 4 {
+			return n.Return(0, unix.EINVAL)
+		}
+		val, errno, err := p.vmReadUint32(n, valPtr)
+		if err != nil {
+			return fmt.Errorf("read value: %w", err)
+		}
+		if errno != 0 {
+			return n.Return(0, errno)
+		}
+		return n.Return(0, s.SetBuffer(name, int(int32(val))))
+	}
+
 	return n.Skip()
 }
 
+// maxEmulatedWrite is the maximum number of bytes a single emulated write
+// gathers from the tracee's memory. Anything beyond that is reported back to
+// the tracee as a partial write, which is allowed for stream sockets and which
+// callers of writev(2) and sendmsg(2) already need to handle.
+const maxEmulatedWrite = 1 << 20
+
+// emulateSend gathers the bytes described by iovs from the tracee's memory and
+// writes them to the socket on the tracee's behalf so that only the bytes that
+// were actually written are accounted.
+func (p *Process) emulateSend(n *seccomp.Notif, s *socket.Socket, iovs []unix.RemoteIovec, flags int, to netip.AddrPort) (int, syscall.Errno, error) {
+	b, errno, err := p.vmReadVectored(n, iovs, maxEmulatedWrite)
+	if errno != 0 || err != nil {
+		return 0, errno, err
+	}
+
+	// Zero-length sends still go to the kernel so that they fail exactly like
+	// they would untraced (e.g. ENOTCONN or EPIPE) and succeed without
+	// generating any traffic otherwise.
+	if to.IsValid() {
+		written, errno := s.SendTo(b, flags, to)
+		return written, errno, nil
+	}
+	written, errno := s.Send(b, flags)
+	return written, errno, nil
+}
+
+// sendDestination returns the destination address of a message sent with
+// sendmsg(2) or sendmmsg(2). Only datagram sockets are emulated with one; ok
+// is false if the message must be left to the kernel.
+func (p *Process) sendDestination(n *seccomp.Notif, s *socket.Socket, msg msghdr) (to netip.AddrPort, ok bool) {
+	if msg.controllen != 0 {
+		return netip.AddrPort{}, false
+	}
+	if msg.name == 0 {
+		return netip.AddrPort{}, true
+	}
+	if !s.Inode.IsDatagram() {
+		return netip.AddrPort{}, false
+	}
+	to, errno, err := p.vmReadSockaddr(n, msg.name, msg.namelen)
+	if err != nil || errno != 0 {
+		return netip.AddrPort{}, false // let the kernel fail it the same way
+	}
+	return to, true
+}
+
+// returnSend answers an emulated send with the given result. Socket.Send always
+// suppresses SIGPIPE on our side, so if the kernel would have sent one to the
+// writing thread, raise it in the tracee instead. This must happen after the
+// notification is answered, otherwise the signal interrupts the blocked
+// syscall and the tracee restarts it.
+func (p *Process) returnSend(n *seccomp.Notif, val int, errno syscall.Errno, flags int) error {
+	if err := n.Return(uintptr(val), errno); err != nil {
+		return err
+	}
+	if errno == unix.EPIPE && flags&unix.MSG_NOSIGNAL == 0 {
+		if err := unix.Tgkill(p.PID, n.PID, unix.SIGPIPE); err != nil {
+			slog.Debug("failed to raise SIGPIPE in tracee", "proc", p, "tid", n.PID, "err", err) // not fatal
+		}
+	}
+	return nil
+}
+
+// handleWritev handles the writev(2) syscall on tracked sockets to account the
+// bytes written from each iovec.
+func (p *Process) handleWritev(n *seccomp.Notif, fd int, iovAddr uintptr, iovcnt int) error {
+	s, ok := p.getSocket(fd)
+	if !ok {
+		return n.Skip()
+	}
+
+	iovs, errno, err := p.vmReadIovecs(n, iovAddr, iovcnt)
+	if err != nil {
+		return fmt.Errorf("read iovecs: %w", err)
+	}
+	if errno != 0 {
+		return n.Return(0, errno)
+	}
+
+	written, errno, err := p.emulateSend(n, s, iovs, 0, netip.AddrPort{})
+	if err != nil {
+		return fmt.Errorf("emulate writev: %w", err)
+	}
+	return p.returnSend(n, written, errno, 0)
+}
+
+// handleSendmsg handles the sendmsg(2) syscall on tracked sockets. Messages
+// with ancillary data (e.g. SCM_RIGHTS, which refers to the tracee's file
+// descriptor table) are left to the kernel, and so are messages with a
+// destination address on stream sockets.
+func (p *Process) handleSendmsg(n *seccomp.Notif, fd int, msgAddr uintptr, flags int) error {
+	s, ok := p.getSocket(fd)
+	if !ok {
+		return n.Skip()
+	}
+
+	msg, errno, err := p.vmReadMsghdr(n, msgAddr)
+	if err != nil {
+		return fmt.Errorf("read msghdr: %w", err)
+	}
+	if errno != 0 {
+		return n.Return(0, errno)
+	}
+	to, ok := p.sendDestination(n, s, msg)
+	if !ok {
+		return n.Skip()
+	}
+
+	iovs, errno, err := p.vmReadIovecs(n, msg.iov, msg.iovlen)
+	if err != nil {
+		return fmt.Errorf("read iovecs: %w", err)
+	}
+	if errno != 0 {
+		return n.Return(0, errno)
+	}
+
+	written, errno, err := p.emulateSend(n, s, iovs, flags, to)
+	if err != nil {
+		return fmt.Errorf("emulate sendmsg: %w", err)
+	}
+	return p.returnSend(n, written, errno, flags)
+}
+
+// handleSendmmsg handles the sendmmsg(2) syscall on tracked sockets.
+func (p *Process) handleSendmmsg(n *seccomp.Notif, fd int, vecAddr uintptr, vlen int, flags int) error {
+	s, ok := p.getSocket(fd)
+	if !ok {
+		return n.Skip()
+	}
+
+	// Like the kernel, silently cap the number of messages to UIO_MAXIOV.
+	vlen = min(vlen, linux.UIO_MAXIOV)
+
+	const sizeofMmsghdr = sizeofMsghdr + 8 // struct mmsghdr with padding
+
+	sent := 0
+	for ; sent < vlen; sent++ {
+		addr := vecAddr + uintptr(sent*sizeofMmsghdr)
+		msg, errno, err := p.vmReadMsghdr(n, addr)
+		if err != nil {
+			return fmt.Errorf("read mmsghdr %d: %w", sent, err)
+		}
+		if errno != 0 {
+			if sent == 0 {
+				return n.Return(0, errno)
+			}
+			break
+		}
+		to, ok := p.sendDestination(n, s, msg)
+		if !ok {
+			if sent == 0 {
+				return n.Skip()
+			}
+			break // let the tracee retry the rest
+		}
+
+		iovs, errno, err := p.vmReadIovecs(n, msg.iov, msg.iovlen)
+		if err != nil {
+			return fmt.Errorf("read iovecs %d: %w", sent, err)
+		}
+		if errno != 0 {
+			if sent == 0 {
+				return n.Return(0, errno)
+			}
+			break
+		}
+
+		want := 0
+		for _, iov := range iovs {
+			want += iov.Len
+		}
+
+		written, errno, err := p.emulateSend(n, s, iovs, flags, to)
+		if err != nil {
+			return fmt.Errorf("emulate sendmmsg %d: %w", sent, err)
+		}
+		if errno != 0 {
+			if sent == 0 {
+				return p.returnSend(n, 0, errno, flags)
+			}
+			break
+		}
+
+		errno, err = p.vmWriteUint32(n, addr+sizeofMsghdr, uint32(written))
+		if err != nil {
+			return fmt.Errorf("write msg_len %d: %w", sent, err)
+		}
+		if errno != 0 {
+			// Like the kernel, don't count a message whose msg_len can't be
+			// written, even though it was sent.
+			if sent == 0 {
+				return n.Return(0, errno)
+			}
+			break
+		}
+
+		if written < want {
+			// Stop after a partial write: writing the next message before the tracee
+			// retries the rest of this one would reorder the byte stream.
+			sent++
+			break
+		}
+	}
+	return n.Return(uintptr(sent), 0)
+}
+
 // handleGetsockname handles the getsockname(2) syscall to emulate the external
 // connection's bind address.
 func (p *Process) handleGetsockname(n *seccomp.Notif, fd int, addrPtr uintptr, addrSizePtr uintptr) error {
-	s, ok := p.getSocket(fd)
+	s, ok := p.getStreamSocket(fd)
 	if !ok {
 		return n.Skip()
 	}
+	if s.Inode.Domain == unix.AF_UNIX {
+		return p.handleGetnameUnix(n, s, false, addrPtr, addrSizePtr)
+	}
 
 	bind, errno, err := s.BindAddr()
 	if err != nil {
@@ -544,10 +1135,13 @@ func (p *Process) handleGetsockname(n *seccomp.Notif, fd int, addrPtr uintptr, a
 // handleGetpeername handles the getpeername(2) syscall to emulate the external
 // connection's peer address.
 func (p *Process) handleGetpeername(n *seccomp.Notif, fd int, addrPtr uintptr, addrSizePtr uintptr) error {
-	s, ok := p.getSocket(fd)
+	s, ok := p.getStreamSocket(fd)
 	if !ok {
 		return n.Skip()
 	}
+	if s.Inode.Domain == unix.AF_UNIX {
+		return p.handleGetnameUnix(n, s, true, addrPtr, addrSizePtr)
+	}
 
 	peer, errno, err := s.PeerAddr()
 	if err != nil {
@@ -577,6 +1171,22 @@ func (p *Process) handleGetpeername(n *seccomp.Notif, fd int, addrPtr uintptr, a
 
 var Handlers [1024]func(*Process, *seccomp.Notif) error
 
+// EnableWriteAccounting registers the writev(2), sendmsg(2) and sendmmsg(2)
+// handlers. They're opt-in because every vectored write the tracee does,
+// including ones on regular files and pipes, becomes a seccomp notification.
+// It must be called before the seccomp filter is installed.
+func EnableWriteAccounting() {
+	Handlers[unix.SYS_WRITEV] = func(p *Process, n *seccomp.Notif) error {
+		return p.handleWritev(n, int(int32(n.Args[0])), uintptr(n.Args[1]), int(n.Args[2]))
+	}
+	Handlers[unix.SYS_SENDMSG] = func(p *Process, n *seccomp.Notif) error {
+		return p.handleSendmsg(n, int(int32(n.Args[0])), uintptr(n.Args[1]), int(n.Args[2]))
+	}
+	Handlers[unix.SYS_SENDMMSG] = func(p *Process, n *seccomp.Notif) error {
+		return p.handleSendmmsg(n, int(int32(n.Args[0])), uintptr(n.Args[1]), int(uint32(n.Args[2])), int(n.Args[3]))
+	}
+}
+
 func init() {
 	Handlers[unix.SYS_EXIT] = func(p *Process, n *seccomp.Notif) error {
 		return p.handleExit(n, int(n.Args[0]))
@@ -592,6 +1202,24 @@ func init() {
 		return p.handleExecveat(n, int(int32(n.Args[0])), uintptr(n.Args[1]), uintptr(n.Args[2]), uintptr(n.Args[3]), int(n.Args[4]))
 	}
 
+	Handlers[unix.SYS_SETNS] = func(p *Process, n *seccomp.Notif) error {
+		nstype := int(n.Args[1]) // 0 allows any namespace type, including a pidfd for several
+		return p.handleNetnsSwitch(n, nstype == 0 || nstype&unix.CLONE_NEWNET != 0)
+	}
+	Handlers[unix.SYS_UNSHARE] = func(p *Process, n *seccomp.Notif) error {
+		if int(n.Args[0])&unix.CLONE_FILES != 0 {
+			p.unshareFiles()
+		}
+		return p.handleNetnsSwitch(n, int(n.Args[0])&unix.CLONE_NEWNET != 0)
+	}
+
+	Handlers[unix.SYS_CLONE] = func(p *Process, n *seccomp.Notif) error {
+		return p.handleClone(n, uint64(n.Args[0]))
+	}
+	Handlers[unix.SYS_CLONE3] = func(p *Process, n *seccomp.Notif) error {
+		return p.handleClone3(n, uintptr(n.Args[0]))
+	}
+
 	Handlers[unix.SYS_OPENAT] = func(p *Process, n *seccomp.Notif) error {
 		return p.handleOpen(n, int(int32(n.Args[0])), uintptr(n.Args[1]), int(n.Args[2]), int(n.Args[3]))
 	}
@@ -601,6 +1229,17 @@ func init() {
 		Handlers[syscalls.GetNumber("SYS_NEWFSTATAT")] = func(p *Process, n *seccomp.Notif) error {
 			return p.handleFstatat(n, int(int32(n.Args[0])), uintptr(n.Args[1]), uintptr(n.Args[2]), int(n.Args[3]))
 		}
+		// arm64 only has openat(2) and fstatat(2), but musl and static
+		// binaries on amd64 still use the older syscalls.
+		Handlers[syscalls.GetNumber("SYS_OPEN")] = func(p *Process, n *seccomp.Notif) error {
+			return p.handleOpen(n, unix.AT_FDCWD, uintptr(n.Args[0]), int(n.Args[1]), int(n.Args[2]))
+		}
+		Handlers[syscalls.GetNumber("SYS_STAT")] = func(p *Process, n *seccomp.Notif) error {
+			return p.handleFstatat(n, unix.AT_FDCWD, uintptr(n.Args[0]), uintptr(n.Args[1]), 0)
+		}
+		Handlers[syscalls.GetNumber("SYS_LSTAT")] = func(p *Process, n *seccomp.Notif) error {
+			return p.handleFstatat(n, unix.AT_FDCWD, uintptr(n.Args[0]), uintptr(n.Args[1]), unix.AT_SYMLINK_NOFOLLOW)
+		}
 	case "arm64":
 		Handlers[syscalls.GetNumber("SYS_FSTATAT")] = func(p *Process, n *seccomp.Notif) error {
 			return p.handleFstatat(n, int(int32(n.Args[0])), uintptr(n.Args[1]), uintptr(n.Args[2]), int(n.Args[3]))
@@ -621,6 +1260,25 @@ func init() {
 		return p.handleFcntl(n, int(int32(n.Args[0])), int(n.Args[1]), int(n.Args[2]))
 	}
 
+	Handlers[unix.SYS_DUP] = func(p *Process, n *seccomp.Notif) error {
+		return p.handleDup(n, int(int32(n.Args[0])), -1, 0)
+	}
+	Handlers[unix.SYS_DUP3] = func(p *Process, n *seccomp.Notif) error {
+		return p.handleDup(n, int(int32(n.Args[0])), int(int32(n.Args[1])), int(n.Args[2]))
+	}
+	if runtime.GOARCH == "amd64" {
+		// arm64 only has dup3(2) and clone(2).
+		Handlers[syscalls.GetNumber("SYS_DUP2")] = func(p *Process, n *seccomp.Notif) error {
+			return p.handleDup(n, int(int32(n.Args[0])), int(int32(n.Args[1])), 0)
+		}
+		Handlers[syscalls.GetNumber("SYS_FORK")] = func(p *Process, n *seccomp.Notif) error {
+			return p.handleClone(n, 0)
+		}
+		Handlers[syscalls.GetNumber("SYS_VFORK")] = func(p *Process, n *seccomp.Notif) error {
+			return p.handleClone(n, unix.CLONE_VM|unix.CLONE_VFORK)
+		}
+	}
+
 	Handlers[unix.SYS_SOCKET] = func(p *Process, n *seccomp.Notif) error {
 		return p.handleSocket(n, int(n.Args[0]), int(n.Args[1]), int(n.Args[2]))
 	}
@@ -637,6 +1295,10 @@ func init() {
 		return p.handleListen(n, int(int32(n.Args[0])), int(n.Args[1]))
 	}
 
+	Handlers[unix.SYS_SHUTDOWN] = func(p *Process, n *seccomp.Notif) error {
+		return p.handleShutdown(n, int(int32(n.Args[0])), int(n.Args[1]))
+	}
+
 	Handlers[unix.SYS_ACCEPT] = func(p *Process, n *seccomp.Notif) error {
 		return p.handleAccept(n, int(int32(n.Args[0])), uintptr(n.Args[1]), uintptr(n.Args[2]), 0)
 	}
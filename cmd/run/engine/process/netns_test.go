@@ -0,0 +1,70 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/config"
+	"subtrace.dev/global"
+)
+
+// threadInNewNetns starts a thread that moves to a new network namespace and
+// returns its tid. The thread exits when the test ends.
+func threadInNewNetns(t *testing.T) int {
+	if os.Getuid() != 0 {
+		t.Skip("unshare(CLONE_NEWNET) needs root")
+	}
+
+	tid, done := make(chan int), make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		runtime.LockOSThread() // never unlocked: the thread exits with the goroutine
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			t.Logf("unshare: %v", err)
+			close(tid)
+			return
+		}
+		tid <- unix.Gettid()
+		<-done
+	}()
+	ret, ok := <-tid
+	if !ok {
+		t.Skip("cannot create a network namespace")
+	}
+	return ret
+}
+
+func TestNetnsPolicy(t *testing.T) {
+	tid := threadInNewNetns(t)
+	defer func(prev string) { socket.NetnsPolicy = prev }(socket.NetnsPolicy)
+
+	for _, policy := range []string{"follow", "passthrough"} {
+		socket.NetnsPolicy = policy
+		p := &Process{global: &global.Global{Config: config.New()}, PID: os.Getpid()}
+
+		if ns, ok := p.getNetns(unix.Gettid()); ns != nil || !ok {
+			t.Errorf("%s: got netns %v, ok=%v for a thread in our namespace, want nil, true", policy, ns, ok)
+		}
+
+		ns, ok := p.getNetns(tid)
+		switch policy {
+		case "follow":
+			if ns == nil || !ok {
+				t.Fatalf("follow: got netns %v, ok=%v, want the thread's namespace", ns, ok)
+			}
+			if again, _ := p.getNetns(tid); again != ns {
+				t.Errorf("follow: got a different netns the second time, want it cached")
+			}
+		case "passthrough":
+			if ns != nil || ok {
+				t.Errorf("passthrough: got netns %v, ok=%v, want nil, false", ns, ok)
+			}
+		}
+	}
+}
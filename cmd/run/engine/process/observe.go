@@ -0,0 +1,132 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/capability"
+	"subtrace.dev/cmd/run/compat"
+	"subtrace.dev/cmd/run/engine/seccomp"
+	"subtrace.dev/tracer"
+)
+
+// StrictSockets makes socket(2) fail with EAFNOSUPPORT for AF_VSOCK and
+// SOCK_SEQPACKET sockets instead of letting them bypass the proxy. By default,
+// such sockets work as usual and only their connections are recorded.
+var StrictSockets bool
+
+func init() {
+	capability.RegisterFeature("tcp", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: true, Detail: "proxied"}
+	})
+	capability.RegisterFeature("udp", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: true, Detail: "datagrams carried by the traced socket, flows recorded"}
+	})
+	observed := func() capability.Feature {
+		if StrictSockets {
+			return capability.Feature{Available: true, Detail: "socket(2) fails with EAFNOSUPPORT"}
+		}
+		return capability.Feature{Available: true, Enabled: true, Detail: "connections recorded, not proxied"}
+	}
+	capability.RegisterFeature("unix_seqpacket", observed)
+	capability.RegisterFeature("vsock", observed)
+	capability.RegisterFeature("strict_sockets", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: StrictSockets, Intervenes: true}
+	})
+	compat.Register(compat.Behavior{
+		Name:       "strict_sockets",
+		Divergence: "AF_VSOCK and SOCK_SEQPACKET sockets fail with EAFNOSUPPORT (-strict-sockets)",
+		Strict:     func() { StrictSockets = false },
+	})
+	capability.RegisterFeature("write_accounting", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: Handlers[unix.SYS_WRITEV] != nil}
+	})
+}
+
+// sockTypeMask masks out SOCK_NONBLOCK and SOCK_CLOEXEC from a socket type
+// (SOCK_TYPE_MASK in include/linux/net.h).
+const sockTypeMask = 0xf
+
+// isObservedOnly reports whether sockets of the given domain and type are
+// never proxied but have their connections recorded.
+func isObservedOnly(domain, typ int) bool {
+	return domain == unix.AF_VSOCK || typ&sockTypeMask == unix.SOCK_SEQPACKET
+}
+
+// observeConnect records an event for a connect(2) on a socket that isn't
+// proxied if it's one that isObservedOnly covers. The syscall itself is left
+// to the kernel, so whether the connection succeeded isn't known. Failures are
+// never propagated to the tracee.
+func (p *Process) observeConnect(n *seccomp.Notif, targetFD int, addrPtr uintptr, addrSize int) {
+	b, errno, err := p.vmReadBytes(n, addrPtr, addrSize)
+	if err != nil || errno != 0 || len(b) < 2 {
+		return
+	}
+
+	ev := p.getEventTemplate().Copy()
+	ev.Set("socket_observe_only", "true")
+
+	var summary string
+	switch family := arch.Uint16(b[0:2]); family {
+	case unix.AF_VSOCK:
+		// struct sockaddr_vm: family, reserved, port, cid.
+		if len(b) < 12 {
+			return
+		}
+		port, cid := arch.Uint32(b[4:8]), arch.Uint32(b[8:12])
+		ev.Set("socket_family", "vsock")
+		ev.Set("vsock_cid", fmt.Sprintf("%d", cid))
+		ev.Set("vsock_port", fmt.Sprintf("%d", port))
+		summary = fmt.Sprintf("vsock connect cid=%d port=%d", cid, port)
+
+	case unix.AF_UNIX:
+		typ, ok := p.getSocketType(targetFD)
+		if !ok || typ != unix.SOCK_SEQPACKET {
+			return
+		}
+		path := b[2:]
+		if i := bytes.IndexByte(path, 0); i > 0 {
+			path = path[:i]
+		} else if i == 0 && len(path) > 1 {
+			path = append([]byte("@"), path[1:]...) // abstract namespace
+		}
+		ev.Set("socket_family", "unix")
+		ev.Set("socket_type", "seqpacket")
+		ev.Set("unix_peer", string(path))
+		summary = fmt.Sprintf("seqpacket connect %q", path)
+
+	default:
+		return
+	}
+
+	tracer.AddDecision(ev, tracer.Decision{Layer: "socket", Verdict: "observed", Reason: tracer.ReasonNotProxied, Detail: ev.Get("socket_family")}, tracer.CaptureNone)
+
+	slog.Debug("observed connect on unproxied socket", "proc", p, "fd", targetFD, "summary", summary)
+	go tracer.PublishConnection(p.getGlobal(), ev, summary)
+}
+
+func (p *Process) getSocketType(targetFD int) (int, bool) {
+	fd, errno := p.getFD(targetFD)
+	if errno != 0 {
+		return 0, false
+	}
+	defer func() {
+		if fd.ClosingIncRef() {
+			defer fd.DecRef()
+			fd.Lock()
+			unix.Close(fd.FD())
+		}
+	}()
+	defer fd.DecRef()
+
+	typ, err := unix.GetsockoptInt(fd.FD(), unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return 0, false
+	}
+	return typ, true
+}
@@ -20,8 +20,10 @@ import (
 	"subtrace.dev/cmd/run/engine/seccomp"
 	"subtrace.dev/cmd/run/fd"
 	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/config"
 	"subtrace.dev/event"
 	"subtrace.dev/global"
+	"subtrace.dev/procfs"
 )
 
 type Process struct {
@@ -31,11 +33,26 @@ type Process struct {
 	PID    int
 	Exited chan struct{}
 
-	pidfd   *fd.FD
-	mu      sync.RWMutex
-	sockets map[int]*socket.Socket
+	pidfd *fd.FD
+	mu    sync.RWMutex
+	files atomic.Pointer[fdTable]
 
-	tmpl atomic.Pointer[event.Event]
+	// Adopt registers a process that this one forked with the engine.
+	Adopt func(pid int)
+
+	tmpl     atomic.Pointer[event.Event]
+	resolved atomic.Pointer[global.Global]
+
+	// exclusion caches whether rules exclude the process entirely (see
+	// Passthrough). Like the resolved config, it's decided again on execve(2).
+	exclusion atomic.Uint32
+
+	// netnsSwitched is set once any thread of the process may be in another
+	// network namespace than ours, after which every socket(2) checks which
+	// one it's in. netns holds the namespaces seen so far by inode.
+	netnsSwitched atomic.Bool
+	netnsMu       sync.Mutex
+	netns         map[uint64]*socket.Netns
 }
 
 // New creates a new process with the given PID.
@@ -48,16 +65,22 @@ func New(global *global.Global, itab *socket.InodeTable, pid int) (*Process, err
 	pidfd := fd.NewFD(int(ret))
 	defer pidfd.DecRef()
 
-	return &Process{
+	p := &Process{
 		global: global,
 		itab:   itab,
 
 		PID:    pid,
 		Exited: make(chan struct{}),
 
-		pidfd:   pidfd,
-		sockets: make(map[int]*socket.Socket),
-	}, nil
+		pidfd: pidfd,
+	}
+	p.files.Store(newFDTable())
+
+	// A child created with clone(CLONE_NEWNET) starts out in its own namespace.
+	if _, foreign, err := socket.InForeignNetns(pid); err != nil || foreign {
+		p.netnsSwitched.Store(true)
+	}
+	return p, nil
 }
 
 func (p *Process) getEventTemplate() *event.Event {
@@ -68,27 +91,42 @@ func (p *Process) getEventTemplate() *event.Event {
 	tmpl := p.global.Config.GetEventTemplate()
 	tmpl.Set("process_id", fmt.Sprintf("%d", p.PID))
 
-	if path, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", p.PID)); err == nil {
-		tmpl.Set("process_executable_name", filepath.Base(path))
+	var exe string
+	var err error
+	if procfs.Has(procfs.FeatureMetadata) {
+		exe, err = os.Readlink(procfs.Path("%d/exe", p.PID))
+		procfs.Degrade(procfs.FeatureMetadata, err)
+	}
+	if !procfs.Has(procfs.FeatureMetadata) {
+		tmpl.Set("process_executable_name", procfs.Unavailable)
+		tmpl.Set("process_executable_size", procfs.Unavailable)
+		tmpl.Set("process_command_line", procfs.Unavailable)
+		tmpl.Set("process_user", procfs.Unavailable)
+		p.tmpl.Store(tmpl)
+		return tmpl
+	}
+
+	if err == nil {
+		tmpl.Set("process_executable_name", event.Intern(filepath.Base(exe)))
 	}
 
-	if info, err := os.Stat(fmt.Sprintf("/proc/%d/exe", p.PID)); err == nil {
-		tmpl.Set("process_executable_size", fmt.Sprintf("%d", info.Size()))
+	if info, err := os.Stat(procfs.Path("%d/exe", p.PID)); err == nil {
+		tmpl.Set("process_executable_size", event.Intern(fmt.Sprintf("%d", info.Size())))
 	}
 
-	if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", p.PID)); err == nil {
+	if cmdline, err := os.ReadFile(procfs.Path("%d/cmdline", p.PID)); err == nil {
 		var parts []string
 		args := bytes.Split(cmdline, []byte{0})
 		for i := 0; i < len(args)-1; i++ {
 			parts = append(parts, string(args[i]))
 		}
-		tmpl.Set("process_command_line", strings.Join(parts, " "))
+		tmpl.Set("process_command_line", event.Intern(strings.Join(parts, " ")))
 	}
 
-	if info, err := os.Stat(fmt.Sprintf("/proc/%d", p.PID)); err == nil {
+	if info, err := os.Stat(procfs.Path("%d", p.PID)); err == nil {
 		if sys, ok := info.Sys().(*syscall.Stat_t); ok {
 			if name, err := findUsername(sys.Uid); err == nil && name != "" {
-				tmpl.Set("process_user", name)
+				tmpl.Set("process_user", event.Intern(name))
 			} else {
 				tmpl.Set("process_user", fmt.Sprintf("%d", sys.Uid))
 			}
@@ -99,6 +137,69 @@ func (p *Process) getEventTemplate() *event.Event {
 	return tmpl
 }
 
+// getGlobal returns the global state with the config resolved for the program
+// the process is running so that rules for specific processes are decided
+// once rather than for every event. Like the event template, it's cached until
+// the process calls execve(2).
+func (p *Process) getGlobal() *global.Global {
+	if g := p.resolved.Load(); g != nil {
+		return g
+	}
+
+	g := p.global
+	if p.global.Config.HasProcessRules() {
+		info := p.processInfo()
+		resolved := *p.global
+		resolved.Config = p.global.Config.ForProcess(info)
+		g = &resolved
+		slog.Debug("resolved config for process", "proc", p, "executable", info.Executable, "containerID", info.ContainerID)
+	}
+
+	p.resolved.Store(g)
+	return g
+}
+
+// processInfo returns what process rules match the running program against.
+func (p *Process) processInfo() config.ProcessInfo {
+	tmpl := p.getEventTemplate()
+	info := config.ProcessInfo{
+		Executable:  tmpl.Get("process_executable_name"),
+		CommandLine: tmpl.Get("process_command_line"),
+	}
+	if p.global.Config.NeedsProcessEnv() {
+		if b, err := os.ReadFile(procfs.Path("%d/environ", p.PID)); err == nil {
+			info.Env = strings.Split(strings.TrimSuffix(string(b), "\x00"), "\x00")
+		}
+	}
+	if p.global.Config.NeedsContainerID() {
+		info.ContainerID = procfs.ContainerID(p.PID)
+	}
+	return info
+}
+
+// FailInternal answers a notification whose handler failed with err before
+// answering it so that the tracee isn't left waiting. Emulated syscalls fail
+// with the errno from socket.TranslateError, along with a diagnostic event
+// naming the cause, and the rest are handed back to the kernel.
+func (p *Process) FailInternal(n *seccomp.Notif, err error) {
+	errno, ok := socket.TranslateError(n.Syscall, err)
+	if !ok {
+		if err := n.Skip(); err != nil && !errors.Is(err, unix.EALREADY) {
+			slog.Debug("failed to skip notification after handler error", "notif", n, "err", err) // not fatal
+		}
+		return
+	}
+
+	switch rerr := n.Return(0, errno); {
+	case rerr == nil:
+		socket.NoteInternalError(p.getGlobal(), p.getEventTemplate(), n.Syscall, "handler", err, errno)
+	case errors.Is(rerr, unix.EALREADY):
+		// The handler answered before failing.
+	default:
+		slog.Debug("failed to answer notification after handler error", "notif", n, "err", rerr) // not fatal
+	}
+}
+
 func (p *Process) LogValue() slog.Value {
 	select {
 	case <-p.Exited:
@@ -120,8 +221,9 @@ func (p *Process) installSocket(n *seccomp.Notif, sock *socket.Socket, flags int
 	// that this is a socket we care about. Since the tracer engine may have
 	// multiple concurrent workers, we need synchronization until the end of this
 	// function.
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	files := p.files.Load()
+	files.mu.Lock()
+	defer files.mu.Unlock()
 
 	p.itab.Add(sock.Inode)
 
@@ -129,15 +231,55 @@ func (p *Process) installSocket(n *seccomp.Notif, sock *socket.Socket, flags int
 	if err != nil {
 		return fmt.Errorf("addfd: %w", err)
 	}
-	if p.sockets[fd] != nil {
+	if files.sockets[fd] != nil {
 		return fmt.Errorf("register: socket already exists")
 	}
-	p.sockets[fd] = sock
+	files.sockets[fd] = sock
 
 	slog.Debug("registered socket", "proc", p, "sock", sock, "fd", fmt.Sprintf("targfd_%d", fd))
 	return nil
 }
 
+// installSocketAt is installSocket for syscalls that return a specific file
+// descriptor number. If target was one of the process's sockets, the kernel
+// closes the process's copy and the socket is closed too.
+func (p *Process) installSocketAt(n *seccomp.Notif, sock *socket.Socket, target int, flags int) error {
+	if !sock.FD.IncRef() {
+		return unix.EBADF
+	}
+	defer sock.FD.DecRef()
+
+	files := p.files.Load()
+	files.mu.Lock()
+	p.itab.Add(sock.Inode)
+	fd, err := n.AddFDAt(sock.FD, target, flags)
+	if err != nil {
+		files.mu.Unlock()
+		return fmt.Errorf("addfd: %w", err)
+	}
+	prev := files.sockets[fd]
+	files.sockets[fd] = sock
+	files.mu.Unlock()
+
+	slog.Debug("registered socket", "proc", p, "sock", sock, "fd", fmt.Sprintf("targfd_%d", fd))
+	if prev != nil {
+		p.closeReplaced(prev, fd)
+	}
+	return nil
+}
+
+// closeReplaced closes a socket whose file descriptor the process replaced
+// with dup2(2) or dup3(2), which close it implicitly.
+func (p *Process) closeReplaced(s *socket.Socket, fd int) {
+	slog.Debug("socket replaced", "proc", p, "sock", s, "fd", fmt.Sprintf("targfd_%d", fd))
+	files := p.files.Load()
+	files.forking.RLock()
+	defer files.forking.RUnlock()
+	if errno := s.Close(); errno != 0 {
+		slog.Debug("failed to close replaced socket cleanly", "errno", errno) // not fatal, see handleClose
+	}
+}
+
 func (p *Process) ImportInode(targetFD int, inode *socket.Inode) error {
 	fd, errno := p.getFD(targetFD)
 	if errno != 0 {
@@ -145,42 +287,78 @@ func (p *Process) ImportInode(targetFD int, inode *socket.Inode) error {
 	}
 	defer fd.DecRef()
 
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	files := p.files.Load()
+	files.mu.Lock()
+	defer files.mu.Unlock()
 
-	if old, ok := p.sockets[targetFD]; ok {
+	if old, ok := files.sockets[targetFD]; ok {
 		return fmt.Errorf("import socket: targetFD=%d already exists: %s", targetFD, old.LogValue().String())
 	}
 
-	sock := socket.NewSocket(p.global, p.getEventTemplate().Copy(), inode, fd)
-	p.sockets[targetFD] = sock
+	sock := socket.NewSocket(p.getGlobal(), p.getEventTemplate().Copy(), inode, fd)
+	files.sockets[targetFD] = sock
 
 	slog.Debug("imported inode", "proc", p, "inode", inode, "sock", sock)
 	return nil
 }
 
 func (p *Process) getSocket(fd int) (*socket.Socket, bool) {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
+	files := p.files.Load()
+	files.mu.RLock()
+	defer files.mu.RUnlock()
 
-	s, ok := p.sockets[fd]
+	s, ok := files.sockets[fd]
 	if !ok {
 		return nil, false
 	}
 	return s, ok
 }
 
+// getStreamSocket is getSocket for syscalls that are only emulated for stream
+// sockets. The kernel handles them for datagram sockets (see IsDatagram).
+func (p *Process) getStreamSocket(fd int) (*socket.Socket, bool) {
+	s, ok := p.getSocket(fd)
+	if !ok || s.Inode.IsDatagram() {
+		return nil, false
+	}
+	return s, true
+}
+
 func (p *Process) getDeleteSocket(fd int) (*socket.Socket, bool) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	files := p.files.Load()
+	files.mu.Lock()
+	defer files.mu.Unlock()
 
-	s, ok := p.sockets[fd]
+	s, ok := files.sockets[fd]
 	if ok {
-		delete(p.sockets, fd)
+		delete(files.sockets, fd)
 	}
 	return s, ok
 }
 
+// bypassSocket stops tracking the socket at fd so that the kernel connects
+// the process's own socket to a destination in socket.Bypass. It reports
+// whether it did.
+func (p *Process) bypassSocket(fd int, s *socket.Socket) bool {
+	files := p.files.Load()
+	files.forking.RLock()
+	defer files.forking.RUnlock()
+
+	files.mu.Lock()
+	if files.sockets[fd] != s || !s.Bypass() {
+		files.mu.Unlock()
+		return false
+	}
+	delete(files.sockets, fd)
+	files.mu.Unlock()
+
+	// A child forked later must not import the socket either.
+	if p.itab != nil {
+		p.itab.Remove(s.Inode)
+	}
+	return true
+}
+
 func (p *Process) getFD(targetFD int) (*fd.FD, syscall.Errno) {
 	if !p.pidfd.IncRef() {
 		return nil, unix.EBADF
@@ -194,9 +372,55 @@ func (p *Process) getFD(targetFD int) (*fd.FD, syscall.Errno) {
 	return fd.NewFD(int(ret)), 0
 }
 
+// Signal sends sig to the process through its pidfd, so that it can't reach
+// another process that reused the PID once this one is reaped. It fails with
+// ESRCH if the process has exited.
+func (p *Process) Signal(sig unix.Signal) error {
+	if !p.pidfd.IncRef() {
+		return unix.ESRCH
+	}
+	defer p.pidfd.DecRef()
+	return unix.PidfdSendSignal(p.pidfd.FD(), sig, nil, 0)
+}
+
+// checkFD returns EBADF if fd is past the process's file descriptor limit,
+// which is what dup2(2) and dup3(2) return for such a target.
+func (p *Process) checkFD(fd int) syscall.Errno {
+	var rl unix.Rlimit
+	if err := unix.Prlimit(p.PID, unix.RLIMIT_NOFILE, nil, &rl); err != nil {
+		return 0 // let the install fail instead
+	}
+	if fd < 0 || uint64(fd) >= rl.Cur {
+		return unix.EBADF
+	}
+	return 0
+}
+
+// lowestFreeFD returns the lowest file descriptor number that's at least min
+// and isn't open in the process, which is what fcntl(F_DUPFD) allocates. The
+// process may open something there before the caller installs a file, so it's
+// only used when min isn't 0 (see handleFcntl).
+func (p *Process) lowestFreeFD(min int) (int, error) {
+	entries, err := os.ReadDir(procfs.Path("%d/fd", p.PID))
+	if err != nil {
+		return 0, fmt.Errorf("read fds: %w", err)
+	}
+	used := make(map[int]bool, len(entries))
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil {
+			used[n] = true
+		}
+	}
+	for used[min] {
+		min++
+	}
+	return min, nil
+}
+
 func (p *Process) poll() (exited bool, _ error) {
 	if !p.pidfd.IncRef() {
-		return false, fmt.Errorf("pidfd: file closed")
+		// cleanup closed it, which Wait checks for.
+		return false, fmt.Errorf("pidfd: file closed: %w", unix.EBADF)
 	}
 	defer p.pidfd.DecRef()
 
@@ -267,10 +491,12 @@ func (p *Process) cleanup() {
 	// a dup+sendmsg or a pidfd_getfd?
 	<-p.Exited
 
-	p.mu.RLock()
-	defer p.mu.RUnlock()
+	// The sockets of a table that other processes still share stay open.
+	files := p.files.Load()
+	files.forking.RLock()
+	defer files.forking.RUnlock()
 	var errs []error
-	for fd, s := range p.sockets {
+	for fd, s := range files.release() {
 		if errno := s.Close(); errno != 0 {
 			errs = append(errs, fmt.Errorf("close socket fd=targfd_%d: %w", fd, errno))
 		}
@@ -0,0 +1,675 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/engine/seccomp"
+	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/tracer"
+)
+
+// sendChildEnv makes the test binary run TestSendChild as the tracee of
+// TestEmulatedSend instead of the usual tests.
+const sendChildEnv = "SUBTRACE_TEST_SEND_CHILD"
+
+// sendResult is what a step of TestSendChild reports: the syscall's return
+// value and errno, and for sendmmsg(2), the msg_len of each message.
+type sendResult struct {
+	ret   int
+	errno syscall.Errno
+	lens  []uint32
+}
+
+// TestEmulatedSend runs TestSendChild in a child process that routes its
+// writev(2), sendmsg(2) and sendmmsg(2) calls to this process with a seccomp
+// filter and checks what the emulation returns for each, that the upstream
+// gets exactly the bytes the child was told were written, and that only those
+// bytes are accounted.
+func TestEmulatedSend(t *testing.T) {
+	upstream, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer upstream.Close()
+
+	// The upstream reads everything it gets unless it's paused, which lets
+	// the child fill the socket's buffers.
+	var (
+		mu       sync.Mutex
+		cond     = sync.NewCond(&mu)
+		paused   bool
+		received []byte
+	)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 64<<10)
+		for {
+			mu.Lock()
+			for paused {
+				cond.Wait()
+			}
+			mu.Unlock()
+
+			n, err := conn.Read(b)
+			mu.Lock()
+			received = append(received, b[:n]...)
+			cond.Broadcast()
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	g := &global.Global{Config: config.New()}
+	sock, err := socket.CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if errno, err := sock.Connect(netip.MustParseAddrPort(upstream.Addr().String()), nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v, err=%v", errno, err)
+	}
+
+	next, stdin := startSendChild(t, g, sock, "stream")
+	io.WriteString(stdin, "start\n")
+
+	got := make(map[string]sendResult)
+	var done string
+	for done == "" {
+		switch line := next(); {
+		case line == "pause":
+			mu.Lock()
+			paused = true
+			mu.Unlock()
+			io.WriteString(stdin, "go\n")
+		case strings.HasPrefix(line, "done "):
+			done = line
+		default:
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				t.Fatalf("got %q from the child", line)
+			}
+			var r sendResult
+			r.ret, _ = strconv.Atoi(fields[1])
+			errno, _ := strconv.Atoi(fields[2])
+			r.errno = syscall.Errno(errno)
+			for _, s := range fields[3:] {
+				n, _ := strconv.ParseUint(s, 10, 32)
+				r.lens = append(r.lens, uint32(n))
+			}
+			got[fields[0]] = r
+		}
+	}
+
+	for name, want := range map[string]sendResult{
+		"writev":                {ret: 17},
+		"writev-empty":          {ret: 0},
+		"writev-too-many":       {ret: -1, errno: unix.EINVAL},
+		"writev-fault-second":   {ret: 100},
+		"writev-fault-first":    {ret: -1, errno: unix.EFAULT},
+		"writev-capped":         {ret: maxEmulatedWrite},
+		"sendmsg":               {ret: 11},
+		"sendmsg-name":          {ret: 4},
+		"sendmmsg":              {ret: 3, lens: []uint32{1, 2, 3}},
+		"sendmmsg-fault-second": {ret: 1, lens: []uint32{10, 0}},
+		"sendmmsg-capped":       {ret: 1, lens: []uint32{maxEmulatedWrite, 0}},
+		"sendmmsg-ro-second":    {ret: 1, lens: []uint32{1, 0}},
+		"sendmmsg-ro-first":     {ret: -1, errno: unix.EFAULT, lens: []uint32{0}},
+	} {
+		r, ok := got[name]
+		if !ok {
+			t.Errorf("%s: no result from the child", name)
+		} else if r.ret != want.ret || r.errno != want.errno || !slices.Equal(r.lens, want.lens) {
+			t.Errorf("%s: got %+v, want %+v", name, r, want)
+		}
+	}
+	// Nothing drains the socket, so these must fail with EAGAIN rather than
+	// block, after writing whatever fits.
+	for _, name := range []string{"writev-nonblock", "sendmsg-dontwait"} {
+		if r := got[name]; r.errno != unix.EAGAIN {
+			t.Errorf("%s: got %+v, want EAGAIN", name, r)
+		}
+	}
+
+	var total int
+	var sum string
+	if _, err := fmt.Sscanf(done, "done %d %s", &total, &sum); err != nil {
+		t.Fatalf("got %q from the child", done)
+	}
+	mu.Lock()
+	paused = false
+	cond.Broadcast()
+	mu.Unlock()
+	var stream []byte
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		stream = slices.Clone(received)
+		mu.Unlock()
+		if len(stream) >= total {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upstream got %d bytes, want %d", len(stream), total)
+		}
+	}
+	if len(stream) != total || fmt.Sprintf("%x", sha256.Sum256(stream)) != sum {
+		t.Errorf("upstream got %d bytes that don't match the %d bytes the child was told were written", len(stream), total)
+	}
+
+	// sendmsg(2) with a destination on a stream socket is left to the
+	// kernel, so those bytes aren't accounted.
+	if want := uint64(total - got["sendmsg-name"].ret); sock.Inode.Written() != want {
+		t.Errorf("got %d bytes accounted, want %d", sock.Inode.Written(), want)
+	}
+}
+
+// TestEmulatedSendHTTP checks that the bytes accounted for an intercepted
+// HTTP/1 connection, including those of a writev(2) that the emulation cut
+// short, end up on the request's event.
+func TestEmulatedSendHTTP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := tracer.OpenEventLog(path)
+	if err != nil {
+		t.Fatalf("open event log: %v", err)
+	}
+	prevLog := tracer.DefaultEventLog
+	tracer.DefaultEventLog = l
+	t.Cleanup(func() {
+		tracer.DefaultEventLog = prevLog
+		l.Close()
+	})
+
+	upstream, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go srv.Serve(upstream)
+	defer srv.Close()
+
+	g := &global.Global{Config: config.New()}
+	sock, err := socket.CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if errno, err := sock.Connect(netip.MustParseAddrPort(upstream.Addr().String()), nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v, err=%v", errno, err)
+	}
+
+	next, stdin := startSendChild(t, g, sock, "http")
+	io.WriteString(stdin, "start\n")
+
+	got := make(map[string]sendResult)
+	var resp string
+	for done := false; !done; {
+		switch line := next(); {
+		case line == "done":
+			done = true
+		case strings.HasPrefix(line, "response "):
+			resp = strings.TrimPrefix(line, "response ")
+		default:
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				t.Fatalf("got %q from the child", line)
+			}
+			var r sendResult
+			r.ret, _ = strconv.Atoi(fields[1])
+			errno, _ := strconv.Atoi(fields[2])
+			r.errno = syscall.Errno(errno)
+			got[fields[0]] = r
+		}
+	}
+	if want := (sendResult{ret: len(httpChildHead)}); !reflect.DeepEqual(got["writev-short"], want) {
+		t.Errorf("writev-short: got %+v, want %+v", got["writev-short"], want)
+	}
+	if want := (sendResult{ret: len(httpChildRest)}); !reflect.DeepEqual(got["writev-rest"], want) {
+		t.Errorf("writev-rest: got %+v, want %+v", got["writev-rest"], want)
+	}
+	if resp != "200 ok" {
+		t.Errorf("got response %q, want %q", resp, "200 ok")
+	}
+
+	var tags map[string]string
+	for deadline := time.Now().Add(10 * time.Second); tags == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the request's event")
+		}
+		b, _ := os.ReadFile(path)
+		for _, s := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			var line tracer.EventLogLine
+			if json.Unmarshal([]byte(s), &line) == nil {
+				tags = line.Tags
+			}
+		}
+	}
+	if want := fmt.Sprintf("%d", len(httpChildHead)+len(httpChildRest)); tags["connection_accounted_write_bytes"] != want {
+		t.Errorf("got connection_accounted_write_bytes %q, want %q", tags["connection_accounted_write_bytes"], want)
+	}
+}
+
+// startSendChild starts TestSendChild with the given scenario and a dup of
+// sock as its fd 3, and handles the writev(2), sendmsg(2) and sendmmsg(2)
+// calls the child's seccomp filter routes to this process. It returns a
+// function that reads the next line the child reports, and the child's stdin.
+func startSendChild(t *testing.T, g *global.Global, sock *socket.Socket, scenario string) (func() string, io.Writer) {
+	t.Helper()
+	dup, err := unix.Dup(sock.FD.FD())
+	if err != nil {
+		t.Fatalf("dup: %v", err)
+	}
+	f := os.NewFile(uintptr(dup), "tracee-socket")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSendChild$")
+	cmd.Env = append(os.Environ(), sendChildEnv+"="+scenario)
+	cmd.ExtraFiles = []*os.File{f} // fd 3 in the child
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("stdin pipe: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("stdout pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start child: %v", err)
+	}
+	f.Close()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	next := func() string {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("child exited early")
+			}
+			return line
+		case <-time.After(30 * time.Second):
+			t.Fatalf("timed out waiting for the child")
+		}
+		return ""
+	}
+
+	var lfd int
+	if line := next(); strings.HasPrefix(line, "skip ") {
+		t.Skipf("install seccomp filter: %s", strings.TrimPrefix(line, "skip "))
+	} else if _, err := fmt.Sscanf(line, "listener %d", &lfd); err != nil {
+		t.Fatalf("got %q from the child, want its listener", line)
+	}
+
+	p, err := New(g, socket.NewInodeTable(), cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("new process: %v", err)
+	}
+	listenerFD, errno := p.getFD(lfd)
+	if errno != 0 {
+		t.Skipf("pidfd_getfd: %v", errno)
+	}
+	l := seccomp.NewFromFD(listenerFD)
+	if err := p.ImportInode(3, sock.Inode); err != nil {
+		t.Fatalf("import inode: %v", err)
+	}
+	go func() {
+		for {
+			n, errno := l.Receive()
+			if errno != 0 {
+				return
+			}
+			var err error
+			switch n.Syscall {
+			case unix.SYS_WRITEV:
+				err = p.handleWritev(n, int(int32(n.Args[0])), uintptr(n.Args[1]), int(n.Args[2]))
+			case unix.SYS_SENDMSG:
+				err = p.handleSendmsg(n, int(int32(n.Args[0])), uintptr(n.Args[1]), int(n.Args[2]))
+			case unix.SYS_SENDMMSG:
+				err = p.handleSendmmsg(n, int(int32(n.Args[0])), uintptr(n.Args[1]), int(uint32(n.Args[2])), int(n.Args[3]))
+			default:
+				err = n.Skip()
+			}
+			if err != nil {
+				t.Errorf("handle %v: %v", n, err)
+				n.Skip()
+			}
+		}
+	}()
+	return next, stdin
+}
+
+// TestSendChild is the tracee of TestEmulatedSend and TestEmulatedSendHTTP.
+// It routes its writev(2), sendmsg(2) and sendmmsg(2) calls to the test with a
+// seccomp filter and runs the scenario named by sendChildEnv on fd 3.
+func TestSendChild(t *testing.T) {
+	scenario := os.Getenv(sendChildEnv)
+	if scenario == "" {
+		t.Skip("only run by TestEmulatedSend and TestEmulatedSendHTTP")
+	}
+
+	runtime.LockOSThread()
+	lfd, err := seccomp.InstallFilter([]int{unix.SYS_WRITEV, unix.SYS_SENDMSG, unix.SYS_SENDMMSG})
+	if err != nil {
+		fmt.Printf("skip %v\n", err)
+		os.Exit(0)
+	}
+	fmt.Printf("listener %d\n", lfd)
+
+	in := bufio.NewReader(os.Stdin)
+	if _, err := in.ReadString('\n'); err != nil { // wait for the socket to be imported
+		os.Exit(1)
+	}
+	switch scenario {
+	case "stream":
+		os.Exit(sendChild(in))
+	case "http":
+		os.Exit(sendHTTPChild())
+	}
+	os.Exit(1)
+}
+
+// mmsghdr is struct mmsghdr on 64-bit architectures.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+func reportSend(name string, r sendResult) {
+	var lens []string
+	for _, n := range r.lens {
+		lens = append(lens, strconv.FormatUint(uint64(n), 10))
+	}
+	fmt.Printf("%s %d %d %s\n", name, r.ret, int(r.errno), strings.Join(lens, " "))
+}
+
+func sendSyscallResult(r uintptr, errno syscall.Errno) sendResult {
+	if errno != 0 {
+		return sendResult{ret: -1, errno: errno}
+	}
+	return sendResult{ret: int(r)}
+}
+
+func iovecs(bufs ...[]byte) []unix.Iovec {
+	var iovs []unix.Iovec
+	for _, b := range bufs {
+		iov := unix.Iovec{Len: uint64(len(b))}
+		if len(b) > 0 {
+			iov.Base = &b[0]
+		}
+		iovs = append(iovs, iov)
+	}
+	return iovs
+}
+
+func writevChild(iovs []unix.Iovec) sendResult {
+	var ptr unsafe.Pointer
+	if len(iovs) > 0 {
+		ptr = unsafe.Pointer(&iovs[0])
+	}
+	r, _, errno := unix.Syscall(unix.SYS_WRITEV, 3, uintptr(ptr), uintptr(len(iovs)))
+	return sendSyscallResult(r, errno)
+}
+
+// unreadable returns an iovec of n bytes that can't be read.
+func unreadable(n int) (unix.Iovec, error) {
+	bad, err := unix.Mmap(-1, 0, 4096, unix.PROT_NONE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return unix.Iovec{}, err
+	}
+	return unix.Iovec{Base: &bad[0], Len: uint64(n)}, nil
+}
+
+func sendChild(in *bufio.Reader) int {
+	// badIov can't be read, for the iovecs that fault.
+	badIov, err := unreadable(100)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mmap: %v\n", err)
+		return 1
+	}
+
+	var (
+		stream hash.Hash = sha256.New()
+		total  int
+	)
+	// accept records the first n bytes of bufs as written.
+	accept := func(n int, bufs ...[]byte) {
+		for _, b := range bufs {
+			b = b[:min(n, len(b))]
+			stream.Write(b)
+			total += len(b)
+			n -= len(b)
+		}
+	}
+	sendmsg := func(msg *unix.Msghdr, flags int) sendResult {
+		r, _, errno := unix.Syscall(unix.SYS_SENDMSG, 3, uintptr(unsafe.Pointer(msg)), uintptr(flags))
+		return sendSyscallResult(r, errno)
+	}
+	sendmmsg := func(msgs []mmsghdr) sendResult {
+		r, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, 3, uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+		ret := sendSyscallResult(r, errno)
+		for _, m := range msgs {
+			ret.lens = append(ret.lens, m.len)
+		}
+		return ret
+	}
+	msghdr := func(iovs []unix.Iovec) unix.Msghdr {
+		return unix.Msghdr{Iov: &iovs[0], Iovlen: uint64(len(iovs))}
+	}
+	pattern := func(n int, seed byte) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = seed + byte(i)
+		}
+		return b
+	}
+
+	// The first bytes make the proxy treat the connection as an unknown
+	// protocol and pass everything through unchanged.
+	hello, empty, abc := []byte("SSH-2.0-test\r\n"), []byte{}, []byte("abc")
+	r := writevChild(iovecs(hello, empty, abc))
+	reportSend("writev", r)
+	accept(r.ret, hello, empty, abc)
+
+	reportSend("writev-empty", writevChild(nil))
+	reportSend("writev-too-many", writevChild(make([]unix.Iovec, 1025)))
+
+	a := pattern(100, 1)
+	r = writevChild([]unix.Iovec{iovecs(a)[0], badIov})
+	reportSend("writev-fault-second", r)
+	accept(r.ret, a)
+
+	reportSend("writev-fault-first", writevChild([]unix.Iovec{badIov}))
+
+	c := pattern(3<<19, 2)
+	r = writevChild(iovecs(c))
+	reportSend("writev-capped", r)
+	accept(r.ret, c)
+
+	hi, world := []byte("hello "), []byte("world")
+	msg := msghdr(iovecs(hi, world))
+	r = sendmsg(&msg, 0)
+	reportSend("sendmsg", r)
+	accept(r.ret, hi, world)
+
+	name := []byte("name")
+	sa := unix.RawSockaddrInet4{Family: unix.AF_INET, Addr: [4]byte{127, 0, 0, 1}}
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], 9)
+	msg = msghdr(iovecs(name))
+	msg.Name, msg.Namelen = (*byte)(unsafe.Pointer(&sa)), unix.SizeofSockaddrInet4
+	r = sendmsg(&msg, 0)
+	reportSend("sendmsg-name", r)
+	accept(r.ret, name)
+
+	one, two, three := []byte("a"), []byte("bb"), []byte("ccc")
+	msgs := []mmsghdr{{hdr: msghdr(iovecs(one))}, {hdr: msghdr(iovecs(two))}, {hdr: msghdr(iovecs(three))}}
+	r = sendmmsg(msgs)
+	reportSend("sendmmsg", r)
+	for i, b := range [][]byte{one, two, three}[:max(r.ret, 0)] {
+		accept(int(msgs[i].len), b)
+	}
+
+	d := pattern(10, 3)
+	msgs = []mmsghdr{{hdr: msghdr(iovecs(d))}, {hdr: msghdr([]unix.Iovec{badIov})}}
+	r = sendmmsg(msgs)
+	reportSend("sendmmsg-fault-second", r)
+	if r.ret > 0 {
+		accept(int(msgs[0].len), d)
+	}
+
+	e, x := pattern(3<<19, 4), []byte("x")
+	msgs = []mmsghdr{{hdr: msghdr(iovecs(e))}, {hdr: msghdr(iovecs(x))}}
+	r = sendmmsg(msgs)
+	reportSend("sendmmsg-capped", r)
+	for i, b := range [][]byte{e, x}[:max(r.ret, 0)] {
+		accept(int(msgs[i].len), b)
+	}
+
+	// An msg_len that can't be written: the message is sent, but like the
+	// kernel, it's not counted, and it's an error if it's the first one.
+	// ro has a writable page followed by a read-only one.
+	ro, err := unix.Mmap(-1, 0, 8192, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mmap: %v\n", err)
+		return 1
+	}
+	f, g, h := []byte("f"), []byte("gg"), []byte("hhh")
+	size := unsafe.Sizeof(mmsghdr{})
+	straddle := (*[2]mmsghdr)(unsafe.Pointer(&ro[4096-size]))
+	straddle[0] = mmsghdr{hdr: msghdr(iovecs(f))}
+	straddle[1] = mmsghdr{hdr: msghdr(iovecs(g))}
+	first := (*[1]mmsghdr)(unsafe.Pointer(&ro[4096+size]))
+	first[0] = mmsghdr{hdr: msghdr(iovecs(h))}
+	if err := unix.Mprotect(ro[4096:], unix.PROT_READ); err != nil {
+		fmt.Fprintf(os.Stderr, "mprotect: %v\n", err)
+		return 1
+	}
+	r = sendmmsg(straddle[:])
+	reportSend("sendmmsg-ro-second", r)
+	accept(len(f), f)
+	accept(len(g), g)
+	r = sendmmsg(first[:])
+	reportSend("sendmmsg-ro-first", r)
+	accept(len(h), h)
+	runtime.KeepAlive(f)
+	runtime.KeepAlive(g)
+	runtime.KeepAlive(h)
+
+	// Fill the socket's buffers while the upstream doesn't read, first with a
+	// non-blocking socket and then with MSG_DONTWAIT on a blocking one.
+	fmt.Println("pause")
+	if _, err := in.ReadString('\n'); err != nil {
+		return 1
+	}
+	fill := func(name string, send func(b []byte) sendResult) {
+		sent := 0
+		for i := range 1024 {
+			b := pattern(256<<10, byte(i))
+			r := send(b)
+			if r.errno != 0 {
+				reportSend(name, sendResult{ret: sent, errno: r.errno})
+				return
+			}
+			accept(r.ret, b)
+			sent += r.ret
+		}
+		reportSend(name, sendResult{ret: sent})
+	}
+	unix.SetNonblock(3, true)
+	fill("writev-nonblock", func(b []byte) sendResult {
+		return writevChild(iovecs(b))
+	})
+	unix.SetNonblock(3, false)
+	fill("sendmsg-dontwait", func(b []byte) sendResult {
+		msg := msghdr(iovecs(b))
+		return sendmsg(&msg, unix.MSG_DONTWAIT)
+	})
+
+	fmt.Printf("done %d %x\n", total, stream.Sum(nil))
+	return 0
+}
+
+// httpChildHead and httpChildRest are the request sendHTTPChild sends.
+const (
+	httpChildHead = "GET /short HTTP/1.1\r\nHost: example.com\r\n"
+	httpChildRest = "Content-Length: 0\r\n\r\n"
+)
+
+// sendHTTPChild sends an HTTP/1 request whose head is cut short by an iovec
+// that faults, then sends the rest of it and reads the response.
+func sendHTTPChild() int {
+	badIov, err := unreadable(100)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mmap: %v\n", err)
+		return 1
+	}
+	head, rest := []byte(httpChildHead), []byte(httpChildRest)
+	r := writevChild([]unix.Iovec{iovecs(head)[0], badIov, iovecs(rest)[0]})
+	reportSend("writev-short", r)
+	if r.ret != len(head) {
+		return 1
+	}
+	r = writevChild(iovecs(rest))
+	reportSend("writev-rest", r)
+	if r.ret != len(rest) {
+		return 1
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(os.NewFile(3, "socket")), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read response: %v\n", err)
+		return 1
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read body: %v\n", err)
+		return 1
+	}
+	fmt.Printf("response %d %s\n", resp.StatusCode, body)
+	fmt.Println("done")
+	return 0
+}
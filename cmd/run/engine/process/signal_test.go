@@ -0,0 +1,42 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/config"
+	"subtrace.dev/global"
+)
+
+// TestSignal checks that a signal sent through the pidfd reaches the process
+// and that once the process is reaped, Signal fails with ESRCH instead of
+// reaching whatever reuses its pid.
+func TestSignal(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	p, err := New(&global.Global{Config: config.New()}, socket.NewInodeTable(), cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("new process: %v", err)
+	}
+	if err := p.Signal(unix.SIGTERM); err != nil {
+		t.Fatalf("signal: %v", err)
+	}
+	cmd.Wait()
+	if status := cmd.ProcessState.Sys().(syscall.WaitStatus); !status.Signaled() || status.Signal() != unix.SIGTERM {
+		t.Fatalf("got %v, want killed by SIGTERM", cmd.ProcessState)
+	}
+	if err := p.Signal(unix.SIGTERM); !errors.Is(err, unix.ESRCH) {
+		t.Fatalf("got %v signaling a reaped process, want ESRCH", err)
+	}
+}
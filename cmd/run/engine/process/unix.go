@@ -0,0 +1,93 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package process
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/engine/seccomp"
+	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/procfs"
+)
+
+// unixPath returns the path subtrace uses for the address name that thread
+// tid passed to bind(2) or connect(2). Relative paths are resolved against the
+// thread's working directory through procfs, which keeps them short enough to
+// fit in a struct sockaddr_un.
+func unixPath(tid int, name string) string {
+	if name == "" || name[0] == '@' || filepath.IsAbs(name) {
+		return name
+	}
+	return procfs.Path("%d/cwd/%s", tid, name)
+}
+
+// handleBindUnix handles bind(2) on a traced AF_UNIX socket.
+func (p *Process) handleBindUnix(n *seccomp.Notif, s *socket.Socket, addrPtr uintptr, addrSize int) error {
+	name, errno, err := p.vmReadSockaddrUnix(n, addrPtr, addrSize)
+	if err != nil {
+		return fmt.Errorf("read bind addr: %w", err)
+	}
+	if errno != 0 {
+		return n.Return(0, errno)
+	}
+
+	errno, err = s.BindUnix(name, unixPath(n.PID, name))
+	if err != nil {
+		return fmt.Errorf("bind unix socket: %w", err)
+	}
+	return n.Return(0, errno)
+}
+
+// handleConnectUnix handles connect(2) on a traced AF_UNIX socket.
+func (p *Process) handleConnectUnix(n *seccomp.Notif, fd int, s *socket.Socket, addrPtr uintptr, addrSize int) error {
+	name, errno, err := p.vmReadSockaddrUnix(n, addrPtr, addrSize)
+	if err != nil {
+		return fmt.Errorf("read peer addr: %w", err)
+	}
+	if errno == 0 && name == "" {
+		errno = unix.EINVAL
+	}
+	if errno != 0 {
+		return n.Return(0, errno)
+	}
+
+	path := unixPath(n.PID, name)
+	if (socket.PeerAuthPath(name) || socket.PeerAuthPath(path)) && p.bypassSocket(fd, s) {
+		// The server authenticates its peers, so it has to see the process's
+		// own credentials.
+		slog.Debug("bypassing connect to a peer auth listener", "proc", p, "fd", fd, "path", name)
+		return n.Skip()
+	}
+
+	errno, err = s.ConnectUnix(name, path)
+	if err != nil {
+		return fmt.Errorf("connect unix socket: %w", err)
+	}
+	return n.Return(0, errno)
+}
+
+// handleGetnameUnix handles getsockname(2) and getpeername(2) on a traced
+// AF_UNIX socket.
+func (p *Process) handleGetnameUnix(n *seccomp.Notif, s *socket.Socket, peer bool, addrPtr uintptr, addrSizePtr uintptr) error {
+	get := s.UnixBindAddr
+	if peer {
+		get = s.UnixPeerAddr
+	}
+	name, errno := get()
+	if errno != 0 {
+		return n.Return(0, errno)
+	}
+
+	if addrPtr == 0 || addrSizePtr == 0 {
+		return n.Return(0, unix.EFAULT)
+	}
+	errno, err := p.vmWriteSockaddrUnix(n, name, addrPtr, addrSizePtr)
+	if err != nil {
+		return fmt.Errorf("write addr: %w", err)
+	}
+	return n.Return(0, errno)
+}
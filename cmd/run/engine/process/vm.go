@@ -113,6 +113,43 @@ func (p *Process) vmReadSockaddr(n *seccomp.Notif, ptr uintptr, size int) (netip
 	}
 }
 
+// sizeofSockaddrUn is sizeof(struct sockaddr_un).
+const sizeofSockaddrUn = 110
+
+// vmReadSockaddrUnix reads a struct sockaddr_un of size bytes from the
+// process's virtual memory starting at ptr. It returns the address as a
+// net.UnixAddr name: a path, an abstract name with a leading "@", or "" if the
+// size leaves no room for one (autobind for bind(2)).
+func (p *Process) vmReadSockaddrUnix(n *seccomp.Notif, ptr uintptr, size int) (string, syscall.Errno, error) {
+	if ptr == 0 || size < 2 || size > sizeofSockaddrUn {
+		return "", unix.EINVAL, nil
+	}
+
+	b, errno, err := p.vmReadBytes(n, ptr, size)
+	if errno != 0 || err != nil {
+		return "", errno, err
+	}
+	if len(b) < size {
+		return "", unix.EFAULT, nil
+	}
+	if arch.Uint16(b[0:2]) != unix.AF_UNIX {
+		return "", unix.EINVAL, nil
+	}
+
+	path := b[2:]
+	switch {
+	case len(path) == 0:
+		return "", 0, nil
+	case path[0] == 0:
+		// The abstract namespace: every byte up to size is part of the name.
+		return "@" + string(path[1:]), 0, nil
+	}
+	if i := bytes.IndexByte(path, 0); i != -1 {
+		path = path[:i]
+	}
+	return string(path), 0, nil
+}
+
 // vmWriteBytes writes b to the process's memory starting at ptr. It returns an
 // error if the address range isn't writable or if the notification is invalid.
 func (p *Process) vmWriteBytes(n *seccomp.Notif, ptr uintptr, b []byte) (syscall.Errno, error) {
@@ -202,3 +239,165 @@ func (p *Process) vmWriteSockaddr(n *seccomp.Notif, addr netip.AddrPort, ptr uin
 	}
 	return 0, nil
 }
+
+// vmWriteSockaddrUnix writes a struct sockaddr_un for the address name, as
+// returned by vmReadSockaddrUnix, and its length to the process' memory at
+// ptr. Like the kernel, the address is truncated to the size at sizePtr and
+// the full length is written back.
+func (p *Process) vmWriteSockaddrUnix(n *seccomp.Notif, name string, ptr uintptr, sizePtr uintptr) (syscall.Errno, error) {
+	if ptr == 0 || sizePtr == 0 {
+		panic(fmt.Sprintf("NULL: ptr=%x, sizePtr=%x", ptr, sizePtr))
+	}
+
+	avail, errno, err := p.vmReadUint32(n, sizePtr)
+	if errno != 0 || err != nil {
+		return errno, err
+	}
+	if int32(avail) < 0 {
+		return unix.EINVAL, nil
+	}
+
+	b := arch.AppendUint16(nil, unix.AF_UNIX)
+	switch {
+	case name == "":
+	case name[0] == '@':
+		b = append(append(b, 0), name[1:]...)
+	default:
+		b = append(append(b, name...), 0)
+	}
+	size := len(b)
+	if uint32(size) > avail {
+		b = b[:avail]
+	}
+
+	if errno, err := p.vmWriteBytes(n, ptr, b); errno != 0 || err != nil {
+		return errno, err
+	}
+	return p.vmWriteUint32(n, sizePtr, uint32(size))
+}
+
+// vmReadIovecs reads an array of count iovec structs from the process'
+// memory starting at ptr.
+func (p *Process) vmReadIovecs(n *seccomp.Notif, ptr uintptr, count int) ([]unix.RemoteIovec, syscall.Errno, error) {
+	if count == 0 {
+		return nil, 0, nil
+	}
+	if count < 0 || count > linux.UIO_MAXIOV {
+		return nil, unix.EINVAL, nil
+	}
+
+	const size = 16 // sizeof(struct iovec) on 64-bit
+	b, errno, err := p.vmReadBytes(n, ptr, count*size)
+	if errno != 0 || err != nil {
+		return nil, errno, err
+	}
+	if len(b) < count*size {
+		return nil, unix.EFAULT, nil
+	}
+
+	iovs := make([]unix.RemoteIovec, count)
+	for i := range iovs {
+		iovs[i].Base = uintptr(arch.Uint64(b[i*size+0:]))
+		iovs[i].Len = int(arch.Uint64(b[i*size+8:]))
+		if iovs[i].Len < 0 {
+			return nil, unix.EINVAL, nil
+		}
+	}
+	return iovs, 0, nil
+}
+
+// vmReadVectored gathers the bytes described by iovs from the process' memory
+// into a single contiguous buffer of at most maxSize bytes. All ranges are
+// read with a single batched process_vm_readv(2) call (or a few if there are
+// more than UIO_MAXIOV ranges) instead of one call per range.
+func (p *Process) vmReadVectored(n *seccomp.Notif, iovs []unix.RemoteIovec, maxSize int) ([]byte, syscall.Errno, error) {
+	total := 0
+	var remote []unix.RemoteIovec
+	for _, iov := range iovs {
+		if iov.Len == 0 {
+			continue
+		}
+		if total+iov.Len > maxSize {
+			iov.Len = maxSize - total
+		}
+		remote = append(remote, iov)
+		if total += iov.Len; total == maxSize {
+			break
+		}
+	}
+	if total == 0 {
+		return nil, 0, nil
+	}
+
+	b := make([]byte, total)
+	read := 0
+	for len(remote) > 0 {
+		batch := remote[:min(len(remote), linux.UIO_MAXIOV)]
+		remote = remote[len(batch):]
+
+		want := 0
+		for _, iov := range batch {
+			want += iov.Len
+		}
+
+		local := []unix.Iovec{{Base: &b[read], Len: uint64(want)}}
+		got, err := unix.ProcessVMReadv(int(p.PID), local, batch, 0)
+		if err != nil {
+			if !n.Valid() {
+				return nil, 0, seccomp.ErrCancelled
+			}
+			var errno syscall.Errno
+			if errors.As(err, &errno) {
+				return nil, errno, nil
+			}
+			return nil, 0, fmt.Errorf("process_vm_readv: unknown error: %w", err)
+		}
+		read += got
+		if got < want {
+			// process_vm_readv(2) stops at the first unreadable range, which is
+			// where the kernel's own writev(2) would have stopped too.
+			break
+		}
+	}
+	if !n.Valid() {
+		return nil, 0, seccomp.ErrCancelled
+	}
+	if read == 0 {
+		return nil, unix.EFAULT, nil
+	}
+	return b[:read], 0, nil
+}
+
+// msghdr is the subset of struct msghdr fields we care about.
+type msghdr struct {
+	name       uintptr
+	namelen    int
+	iov        uintptr
+	iovlen     int
+	control    uintptr
+	controllen int
+}
+
+// sizeofMsghdr is sizeof(struct msghdr) on 64-bit architectures.
+const sizeofMsghdr = 56
+
+// vmReadMsghdr reads a struct msghdr from the process' memory at ptr.
+func (p *Process) vmReadMsghdr(n *seccomp.Notif, ptr uintptr) (msghdr, syscall.Errno, error) {
+	b, errno, err := p.vmReadBytes(n, ptr, sizeofMsghdr)
+	if errno != 0 || err != nil {
+		return msghdr{}, errno, err
+	}
+	if len(b) < sizeofMsghdr {
+		return msghdr{}, unix.EFAULT, nil
+	}
+
+	// ref: <linux/socket.h>: struct user_msghdr
+	return msghdr{
+		name:       uintptr(arch.Uint64(b[0:])),
+		namelen:    int(arch.Uint32(b[8:])),
+		iov:        uintptr(arch.Uint64(b[16:])),
+		iovlen:     int(arch.Uint64(b[24:])),
+		control:    uintptr(arch.Uint64(b[32:])),
+		controllen: int(arch.Uint64(b[40:])),
+	}, 0, nil
+}
@@ -33,6 +33,9 @@ const (
 	SECCOMP_IOCTL_NOTIF_SEND     = 0xc0182101
 	SECCOMP_IOCTL_NOTIF_ADDFD    = 0x40182103
 	SECCOMP_IOCTL_NOTIF_ID_VALID = 0x40082102
+
+	// ref: <asm/unistd.h>: https://elixir.bootlin.com/linux/v6.7/source/arch/x86/include/uapi/asm/unistd.h#L6
+	X32_SYSCALL_BIT = 0x40000000
 )
 
 // ref: <linux/seccomp.h>: struct seccomp_notif: https://elixir.bootlin.com/linux/v6.7/source/include/uapi/linux/seccomp.h#L75
@@ -48,6 +51,9 @@ type notif struct {
 	}
 }
 
+// notifSize is the size of struct seccomp_notif.
+const notifSize = 80
+
 func (x *notif) SizeBytes() int {
 	var n int
 	n += x.id.SizeBytes()
@@ -101,14 +107,17 @@ func (x *resp) SizeBytes() int {
 	return n
 }
 
-func (x *resp) Bytes() []byte {
-	ret := make([]byte, x.SizeBytes())
-	b := ret
+// respSize is the size of struct seccomp_notif_resp.
+const respSize = 24
+
+// MarshalBytes encodes x into b, which is at least respSize bytes long, and
+// returns what's left of b.
+func (x *resp) MarshalBytes(b []byte) []byte {
 	b = x.id.MarshalBytes(b)
 	b = x.val.MarshalBytes(b)
 	b = x.errno.MarshalBytes(b)
 	b = x.flags.MarshalBytes(b)
-	return ret
+	return b
 }
 
 // ref: <linux/seccomp.h>: struct seccomp_notif_addfd: https://elixir.bootlin.com/linux/v6.7/source/include/uapi/linux/seccomp.h#L132
@@ -126,17 +135,20 @@ func (x *addfd) SizeBytes() int {
 	n += x.flags.SizeBytes()
 	n += x.srcFD.SizeBytes()
 	n += x.newFD.SizeBytes()
-	n += x.newFD.SizeBytes()
+	n += x.newFDFlags.SizeBytes()
 	return n
 }
 
-func (x *addfd) Bytes() []byte {
-	ret := make([]byte, x.SizeBytes())
-	b := ret
+// addfdSize is the size of struct seccomp_notif_addfd.
+const addfdSize = 24
+
+// MarshalBytes encodes x into b, which is at least addfdSize bytes long, and
+// returns what's left of b.
+func (x *addfd) MarshalBytes(b []byte) []byte {
 	b = x.id.MarshalBytes(b)
 	b = x.flags.MarshalBytes(b)
 	b = x.srcFD.MarshalBytes(b)
 	b = x.newFD.MarshalBytes(b)
 	b = x.newFDFlags.MarshalBytes(b)
-	return ret
+	return b
 }
@@ -16,6 +16,7 @@ import (
 	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/bpf"
 	"gvisor.dev/gvisor/pkg/marshal/primitive"
+	"subtrace.dev/cmd/run/capability"
 	"subtrace.dev/cmd/run/fd"
 	"subtrace.dev/cmd/run/kernel"
 	"subtrace.dev/cmd/run/syscalls"
@@ -28,12 +29,18 @@ const (
 
 var ErrCancelled = errors.New("seccomp user notification cancelled")
 
-// InstallFilter installs a seccomp BPF program to filter the system calls we
-// want to intercept. It return the file descriptor to be used with ioctl(2) to
-// receive notifications.
-//
-// User notification-based seccomp filters are Linux 5.0+ only.
-func InstallFilter(syscalls []int) (int, error) {
+func init() {
+	capability.RegisterFeature("seccomp_wait_killable_recv", func() capability.Feature {
+		if _, _, err := kernel.CheckVersion("5.19", false); err != nil {
+			return capability.Feature{Detail: "requires Linux 5.19+"}
+		}
+		return capability.Feature{Available: true, Enabled: true}
+	})
+}
+
+// BuildFilter returns the seccomp BPF program that notifies the listener of
+// the given system calls and lets the kernel handle every other one.
+func BuildFilter(syscalls []int) ([]linux.BPFInstruction, error) {
 	const (
 		// ref: https://github.com/google/gvisor/blob/3b57dd815f7fbe69b330410e8456633cfe209438/pkg/seccomp/seccomp_rules.go#LL31C1-L37C2
 		offsetNR   = 0
@@ -52,12 +59,19 @@ func InstallFilter(syscalls []int) (int, error) {
 	case "arm64":
 		builder.AddJump(bpf.Jmp|bpf.Jeq|bpf.K, linux.AUDIT_ARCH_AARCH64, 1, 0)
 	default:
-		return 0, fmt.Errorf("unsupported arch: %q", runtime.GOARCH)
+		return nil, fmt.Errorf("unsupported arch: %q", runtime.GOARCH)
 	}
 	builder.AddStmt(bpf.Ret|bpf.K, uint32(SECCOMP_RET_KILL_PROCESS))
 
 	// Check if the number matches a syscall we're interested in intercepting.
 	builder.AddStmt(bpf.Ld|bpf.W|bpf.Abs, offsetNR)
+	if runtime.GOARCH == "amd64" {
+		// x32 syscalls have the same arch as x86-64 ones but their numbers have
+		// __X32_SYSCALL_BIT set, so they'd never match below and would reach the
+		// kernel without us seeing them. Fail them like kernels without x32 do.
+		builder.AddJump(bpf.Jmp|bpf.Jge|bpf.K, X32_SYSCALL_BIT, 0, 1)
+		builder.AddStmt(bpf.Ret|bpf.K, uint32(SECCOMP_RET_ERRNO|unix.ENOSYS))
+	}
 	for _, nr := range syscalls {
 		builder.AddJump(bpf.Jmp|bpf.Jeq|bpf.K, uint32(nr), 0, 1)
 		builder.AddStmt(bpf.Ret|bpf.K, SECCOMP_RET_USER_NOTIF)
@@ -66,44 +80,31 @@ func InstallFilter(syscalls []int) (int, error) {
 	// We're not interested in this syscall. Let the kernel handle it.
 	builder.AddStmt(bpf.Ret|bpf.K, uint32(SECCOMP_RET_ALLOW))
 
-	var instrs []linux.BPFInstruction
-	if arr, err := builder.Instructions(); err != nil {
-		return 0, fmt.Errorf("build: %w", err)
-	} else {
-		for _, ins := range arr {
-			instrs = append(instrs, linux.BPFInstruction(ins))
-		}
+	arr, err := builder.Instructions()
+	if err != nil {
+		return nil, fmt.Errorf("build: %w", err)
 	}
-
-	prog := &linux.SockFprog{
-		Len:    uint16(len(instrs)),
-		Filter: &instrs[0],
-	}
-
-	// Lock the goroutine's OS thread before installing seccomp filters because
-	// without this the filter doesn't seem to apply to children. Not sure why.
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-
-	// From seccomp(2) man page:
-	//   In order to use the SECCOMP_SET_MODE_FILTER operation, either the
-	//   calling thread must have the CAP_SYS_ADMIN capability in its user
-	//   namespace, or the thread must already have the no_new_privs bit set.
-	if _, _, errno := unix.Syscall(unix.SYS_PRCTL, linux.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
-		return 0, fmt.Errorf("prctl: PR_SET_NO_NEW_PRIVS: %w", errno)
+	var instrs []linux.BPFInstruction
+	for _, ins := range arr {
+		instrs = append(instrs, linux.BPFInstruction(ins))
 	}
+	return instrs, nil
+}
 
+// FilterFlags returns the flags of the seccomp(2) call that installs the
+// filter built by BuildFilter.
+func FilterFlags() uintptr {
 	flags := uintptr(SECCOMP_FILTER_FLAG_NEW_LISTENER)
 
-	// We just did a PR_SET_NO_NEW_PRIVS and we'll later be doing a execve(2) to
-	// start the tracee process (see run.go). Let's say the PR_SET_NO_NEW_PRIVS=1
-	// is done by thread A, the execve is done by thread B, and thread B got
-	// created _before_ the prctl call. In this example, there's a race condition
-	// between these two steps where the tracee gets started with no_new_privs=0
-	// even though the prctl(PR_SET_NO_NEW_PRIVS, 1) returned success. By setting
-	// SECCOMP_FILTER_FLAG_TSYNC, we tell the kernel to synchronize all threads
-	// of the tracer to have the same seccomp settings in the seccomp(2) call
-	// below that does SECCOMP_SET_MODE_FILTER.
+	// InstallFilter does a PR_SET_NO_NEW_PRIVS and we'll later be doing a
+	// execve(2) to start the tracee process (see run.go). Let's say the
+	// PR_SET_NO_NEW_PRIVS=1 is done by thread A, the execve is done by thread
+	// B, and thread B got created _before_ the prctl call. In this example,
+	// there's a race condition between these two steps where the tracee gets
+	// started with no_new_privs=0 even though the prctl(PR_SET_NO_NEW_PRIVS, 1)
+	// returned success. By setting SECCOMP_FILTER_FLAG_TSYNC, we tell the
+	// kernel to synchronize all threads of the tracer to have the same seccomp
+	// settings in the seccomp(2) call that does SECCOMP_SET_MODE_FILTER.
 	//
 	// For historical reasons, the flags SECCOMP_FILTER_FLAG_TSYNC and
 	// SECCOMP_FILTER_FLAG_NEW_LISTENER were declared to be mutually exclusive
@@ -132,8 +133,38 @@ func InstallFilter(syscalls []int) (int, error) {
 		slog.Debug("found kernel version 5.19+, enabling SECCOMP_FILTER_FLAG_WAIT_KILLABLE_RECV")
 		flags |= SECCOMP_FILTER_FLAG_WAIT_KILLABLE_RECV
 	}
+	return flags
+}
+
+// InstallFilter installs a seccomp BPF program to filter the system calls we
+// want to intercept. It return the file descriptor to be used with ioctl(2) to
+// receive notifications.
+//
+// User notification-based seccomp filters are Linux 5.0+ only.
+func InstallFilter(syscalls []int) (int, error) {
+	instrs, err := BuildFilter(syscalls)
+	if err != nil {
+		return 0, err
+	}
+	prog := &linux.SockFprog{
+		Len:    uint16(len(instrs)),
+		Filter: &instrs[0],
+	}
+
+	// Lock the goroutine's OS thread before installing seccomp filters because
+	// without this the filter doesn't seem to apply to children. Not sure why.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
 
-	ret, _, errno := unix.Syscall(unix.SYS_SECCOMP, SECCOMP_SET_MODE_FILTER, flags, uintptr(unsafe.Pointer(prog)))
+	// From seccomp(2) man page:
+	//   In order to use the SECCOMP_SET_MODE_FILTER operation, either the
+	//   calling thread must have the CAP_SYS_ADMIN capability in its user
+	//   namespace, or the thread must already have the no_new_privs bit set.
+	if _, _, errno := unix.Syscall(unix.SYS_PRCTL, linux.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return 0, fmt.Errorf("prctl: PR_SET_NO_NEW_PRIVS: %w", errno)
+	}
+
+	ret, _, errno := unix.Syscall(unix.SYS_SECCOMP, SECCOMP_SET_MODE_FILTER, FilterFlags(), uintptr(unsafe.Pointer(prog)))
 	if errno != 0 {
 		return 0, fmt.Errorf("install: %w", errno)
 	}
@@ -142,12 +173,20 @@ func InstallFilter(syscalls []int) (int, error) {
 
 type Listener struct {
 	fd *fd.FD
+
+	// recv is the buffer Receive reads notifications into.
+	recv [notifSize]byte
 }
 
 func NewFromFD(fd *fd.FD) *Listener {
 	return &Listener{fd: fd}
 }
 
+// FD returns the listener's file descriptor.
+func (l *Listener) FD() int {
+	return l.fd.FD()
+}
+
 func (l *Listener) Close() error {
 	if !l.fd.ClosingIncRef() {
 		return fmt.Errorf("already closed")
@@ -173,14 +212,16 @@ func (l *Listener) receiveSingle(b []byte) syscall.Errno {
 		return unix.EBADF
 	}
 	defer l.fd.DecRef()
+	clear(b) // the kernel rejects a struct seccomp_notif that isn't zeroed
 	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(l.fd.FD()), SECCOMP_IOCTL_NOTIF_RECV, uintptr(unsafe.Pointer(&b[0])))
 	return errno
 }
 
-// Receive receives a single user notification.
+// Receive receives a single user notification. It reuses the listener's
+// buffer, so it must not be called concurrently.
 func (l *Listener) Receive() (*Notif, syscall.Errno) {
 	var x notif
-	b := make([]byte, x.SizeBytes())
+	b := l.recv[:]
 	for {
 		errno := l.receiveSingle(b)
 		if errno == 0 {
@@ -298,7 +339,8 @@ func (n *Notif) send(handled bool, ret uintptr, errno syscall.Errno) error {
 		r.val = primitive.Int64(ret)
 		r.errno = primitive.Int32(-errno)
 	}
-	b := r.Bytes()
+	var b [respSize]byte // on the stack: replies are sent by every worker
+	r.MarshalBytes(b[:])
 	_, _, sendErrno := unix.Syscall(unix.SYS_IOCTL, uintptr(n.listener.fd.FD()), SECCOMP_IOCTL_NOTIF_SEND, uintptr(unsafe.Pointer(&b[0])))
 	switch sendErrno {
 	case 0:
@@ -358,6 +400,17 @@ func (n *Notif) Return(ret uintptr, errno syscall.Errno) error {
 //
 // The SECCOMP_ADDFD_FLAG_SEND flag is available in Linux 5.14+ only.
 func (n *Notif) AddFD(fd *fd.FD, flags int) (int, error) {
+	return n.addFD(fd, 0, 0, flags)
+}
+
+// AddFDAt is AddFD for syscalls that return a specific file descriptor number
+// (e.g. dup2, dup3). Whatever the tracee had at target is atomically replaced
+// and closed, like dup2(2) does.
+func (n *Notif) AddFDAt(fd *fd.FD, target int, flags int) (int, error) {
+	return n.addFD(fd, SECCOMP_ADDFD_FLAG_SETFD, target, flags)
+}
+
+func (n *Notif) addFD(fd *fd.FD, addFlags uint32, newFD int, flags int) (int, error) {
 	if !n.state.CompareAndSwap(stateReceived, stateReplying) {
 		return 0, unix.EALREADY
 	}
@@ -370,10 +423,14 @@ func (n *Notif) AddFD(fd *fd.FD, flags int) (int, error) {
 
 	var r addfd
 	r.id = primitive.Uint64(n.ID)
-	r.flags = SECCOMP_ADDFD_FLAG_SEND
+	r.flags = primitive.Uint32(SECCOMP_ADDFD_FLAG_SEND | addFlags)
 	r.srcFD = primitive.Uint32(fd.FD())
+	if addFlags&SECCOMP_ADDFD_FLAG_SETFD != 0 {
+		r.newFD = primitive.Uint32(newFD)
+	}
 	r.newFDFlags = primitive.Uint32(flags)
-	b := r.Bytes()
+	var b [addfdSize]byte
+	r.MarshalBytes(b[:])
 	target, _, addErrno := unix.Syscall(unix.SYS_IOCTL, uintptr(n.listener.fd.FD()), SECCOMP_IOCTL_NOTIF_ADDFD, uintptr(unsafe.Pointer(&b[0])))
 	switch addErrno {
 	case 0:
@@ -0,0 +1,86 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package seccomp
+
+import (
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/bpf"
+)
+
+// TestBuildFilter runs the filter on the seccomp data of syscalls made with
+// each calling convention the kernel can report on this architecture.
+func TestBuildFilter(t *testing.T) {
+	instrs, err := BuildFilter([]int{unix.SYS_CONNECT})
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	var insns []bpf.Instruction
+	for _, ins := range instrs {
+		insns = append(insns, bpf.Instruction(ins))
+	}
+	prog, err := bpf.Compile(insns, false)
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	type call struct {
+		name string
+		arch uint32
+		nr   int32
+		want uint32
+	}
+	var calls []call
+	switch runtime.GOARCH {
+	case "amd64":
+		calls = []call{
+			{"connect", linux.AUDIT_ARCH_X86_64, unix.SYS_CONNECT, SECCOMP_RET_USER_NOTIF},
+			{"getpid", linux.AUDIT_ARCH_X86_64, unix.SYS_GETPID, SECCOMP_RET_ALLOW},
+			{"x32 connect", linux.AUDIT_ARCH_X86_64, X32_SYSCALL_BIT | 42, SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)},
+			{"int 0x80", unix.AUDIT_ARCH_I386, 102, SECCOMP_RET_KILL_PROCESS},
+		}
+	case "arm64":
+		calls = []call{
+			{"connect", linux.AUDIT_ARCH_AARCH64, unix.SYS_CONNECT, SECCOMP_RET_USER_NOTIF},
+			{"getpid", linux.AUDIT_ARCH_AARCH64, unix.SYS_GETPID, SECCOMP_RET_ALLOW},
+			{"aarch32", unix.AUDIT_ARCH_ARM, 283, SECCOMP_RET_KILL_PROCESS},
+		}
+	default:
+		t.Skipf("GOARCH=%s: unsupported", runtime.GOARCH)
+	}
+
+	for _, c := range calls {
+		data := linux.SeccompData{Nr: c.nr, Arch: c.arch}
+		in := make([]byte, data.SizeBytes())
+		data.MarshalBytes(in)
+		got, err := bpf.Exec[bpf.NativeEndian](prog, in)
+		if err != nil {
+			t.Fatalf("%s: exec: %v", c.name, err)
+		}
+		if got != c.want {
+			t.Errorf("%s: got %#x, want %#x", c.name, got, c.want)
+		}
+	}
+}
+
+// TestIoctlNumbers checks the ioctl numbers, which had to be written down by
+// hand, against the ones generated for this architecture.
+func TestIoctlNumbers(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		got, want uint
+	}{
+		{"SECCOMP_IOCTL_NOTIF_RECV", SECCOMP_IOCTL_NOTIF_RECV, unix.SECCOMP_IOCTL_NOTIF_RECV},
+		{"SECCOMP_IOCTL_NOTIF_SEND", SECCOMP_IOCTL_NOTIF_SEND, unix.SECCOMP_IOCTL_NOTIF_SEND},
+		{"SECCOMP_IOCTL_NOTIF_ADDFD", SECCOMP_IOCTL_NOTIF_ADDFD, unix.SECCOMP_IOCTL_NOTIF_ADDFD},
+		{"SECCOMP_IOCTL_NOTIF_ID_VALID", SECCOMP_IOCTL_NOTIF_ID_VALID, unix.SECCOMP_IOCTL_NOTIF_ID_VALID},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, tt.got, tt.want)
+		}
+	}
+}
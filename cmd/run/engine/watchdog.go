@@ -0,0 +1,198 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package engine
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/clock"
+	"subtrace.dev/cmd/run/capability"
+	"subtrace.dev/cmd/run/compat"
+	"subtrace.dev/cmd/run/engine/seccomp"
+	"subtrace.dev/cmd/run/syscalls"
+	"subtrace.dev/event"
+	"subtrace.dev/tracer"
+)
+
+var (
+	// WatchdogThreshold is how long a seccomp notification may go unanswered
+	// before the watchdog reports the engine as stalled. Zero disables the
+	// watchdog.
+	WatchdogThreshold = 10 * time.Second
+
+	// WatchdogAbort is how long a seccomp notification may go unanswered before
+	// the watchdog answers it with EINTR itself so that the tracee unblocks.
+	// The stuck handler keeps its worker, and its own reply later fails
+	// harmlessly. Zero disables aborting.
+	WatchdogAbort time.Duration
+
+	watchdogInterval = time.Second
+)
+
+func init() {
+	capability.RegisterLimit("watchdog_threshold_ms", func() int64 { return WatchdogThreshold.Milliseconds() })
+	capability.RegisterLimit("watchdog_abort_ms", func() int64 { return WatchdogAbort.Milliseconds() })
+	capability.RegisterFeature("watchdog_abort", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: WatchdogThreshold > 0 && WatchdogAbort > 0, Intervenes: true}
+	})
+	compat.Register(compat.Behavior{
+		Name:       "watchdog_abort",
+		Divergence: "syscalls that stay unanswered for too long fail with EINTR (-watchdog-abort)",
+		Strict:     func() { WatchdogAbort = 0 },
+	})
+}
+
+// abortNotif answers a notification on behalf of a stuck handler. Tests
+// replace it because they have no seccomp listener to reply to.
+var abortNotif = func(n *seccomp.Notif) error {
+	return n.Return(0, unix.EINTR)
+}
+
+// inflight tracks the notifications that have been received but not handled
+// yet, including ones still waiting for a free worker.
+type inflight struct {
+	mu      sync.Mutex
+	notifs  map[*seccomp.Notif]time.Time // with monotonic readings
+	stalled bool                         // whether the current stall has been reported
+	reports int                          // number of stalls reported, for tests
+
+	// blocking holds the notifications of mayBlock syscalls, which the
+	// watchdog doesn't track, for Detach to answer.
+	blocking map[*seccomp.Notif]struct{}
+}
+
+// mayBlock holds the syscalls whose handlers legitimately take as long as the
+// tracee's own syscall would (e.g. a blocking accept(2) waits for a client, and
+// emulated sends wait for buffer space). The watchdog doesn't track them, so a
+// handler stuck in one of them goes unnoticed.
+var mayBlock = map[int]bool{
+	unix.SYS_ACCEPT:   true,
+	unix.SYS_ACCEPT4:  true,
+	unix.SYS_CONNECT:  true,
+	unix.SYS_WRITEV:   true,
+	unix.SYS_SENDMSG:  true,
+	unix.SYS_SENDMMSG: true,
+}
+
+func (e *Engine) trackNotif(n *seccomp.Notif) {
+	e.inflight.mu.Lock()
+	defer e.inflight.mu.Unlock()
+	if mayBlock[n.Syscall] {
+		if e.inflight.blocking == nil {
+			e.inflight.blocking = make(map[*seccomp.Notif]struct{})
+		}
+		e.inflight.blocking[n] = struct{}{}
+		return
+	}
+	if e.inflight.notifs == nil {
+		e.inflight.notifs = make(map[*seccomp.Notif]time.Time)
+	}
+	e.inflight.notifs[n] = time.Now()
+}
+
+func (e *Engine) untrackNotif(n *seccomp.Notif) {
+	e.inflight.mu.Lock()
+	defer e.inflight.mu.Unlock()
+	delete(e.inflight.notifs, n)
+	delete(e.inflight.blocking, n)
+}
+
+// watchdog periodically checks that notifications are being answered until
+// stop is closed.
+func (e *Engine) watchdog(stop <-chan struct{}) {
+	if WatchdogThreshold <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			e.checkStalls(now)
+		}
+	}
+}
+
+// checkStalls reports the engine as stalled if the oldest unanswered
+// notification is older than WatchdogThreshold, and aborts the ones older than
+// WatchdogAbort. A stall is reported once, when it starts; the next one is
+// reported after every notification has been answered in time again. Ages are
+// measured on the monotonic clock, but aborting waits out the grace interval
+// after the wall clock jumped: after a resume from suspend, handlers are busy
+// catching up with everything that happened while the system was asleep.
+func (e *Engine) checkStalls(now time.Time) {
+	grace := WatchdogAbort > 0 && clock.Default.InGrace()
+
+	e.inflight.mu.Lock()
+	var oldest *seccomp.Notif
+	var oldestAge time.Duration
+	var abort []*seccomp.Notif
+	for n, begin := range e.inflight.notifs {
+		age := now.Sub(begin)
+		if age > oldestAge {
+			oldest, oldestAge = n, age
+		}
+		if WatchdogAbort > 0 && age >= WatchdogAbort && !grace {
+			abort = append(abort, n)
+			delete(e.inflight.notifs, n)
+		}
+	}
+	count := len(e.inflight.notifs) + len(abort)
+
+	report := false
+	switch {
+	case oldest == nil || oldestAge < WatchdogThreshold:
+		e.inflight.stalled = false
+	case !e.inflight.stalled:
+		e.inflight.stalled = true
+		e.inflight.reports++
+		report = true
+	}
+	e.inflight.mu.Unlock()
+
+	if report {
+		e.reportStall(oldest, oldestAge, count)
+	}
+
+	for _, n := range abort {
+		err := abortNotif(n)
+		slog.Warn("engine watchdog answered stuck seccomp notification with EINTR", "pid", n.PID, "syscall", syscalls.GetName(n.Syscall), "id", fmt.Sprintf("0x%x", n.ID), "err", err)
+	}
+}
+
+// reportStall dumps every goroutine's stack to the log and publishes a
+// diagnostic event.
+func (e *Engine) reportStall(n *seccomp.Notif, age time.Duration, count int) {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	// Don't log the notification itself: its LogValue talks to the listener,
+	// which may be what's stuck.
+	slog.Error("engine watchdog: seccomp notification unanswered, traced processes may be hanging",
+		"pid", n.PID,
+		"syscall", syscalls.GetName(n.Syscall),
+		"id", fmt.Sprintf("0x%x", n.ID),
+		"age", age.Round(time.Millisecond),
+		"inflight", count,
+		"stacks", string(buf))
+
+	if e.global == nil || e.global.Config == nil {
+		return
+	}
+	ev := event.New()
+	ev.Set("process_id", fmt.Sprintf("%d", n.PID))
+	ev.Set("engine_watchdog", "stalled")
+	ev.Set("watchdog_syscall", syscalls.GetName(n.Syscall))
+	ev.Set("watchdog_pending_ms", fmt.Sprintf("%d", age.Milliseconds()))
+	ev.Set("watchdog_inflight", fmt.Sprintf("%d", count))
+	go tracer.PublishConnection(e.global, ev, fmt.Sprintf("engine stalled: %s unanswered for %s", syscalls.GetName(n.Syscall), age.Round(time.Millisecond)))
+}
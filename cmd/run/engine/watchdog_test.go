@@ -0,0 +1,155 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package engine
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/clock"
+	"subtrace.dev/cmd/run/engine/seccomp"
+)
+
+// TestWatchdogStuckHandler simulates a handler that never answers its
+// notification. The watchdog must report the stall once and, with
+// WatchdogAbort set, answer the notification so the tracee unblocks.
+func TestWatchdogStuckHandler(t *testing.T) {
+	prevThreshold, prevAbort, prevInterval, prevAbortNotif := WatchdogThreshold, WatchdogAbort, watchdogInterval, abortNotif
+	t.Cleanup(func() {
+		WatchdogThreshold, WatchdogAbort, watchdogInterval, abortNotif = prevThreshold, prevAbort, prevInterval, prevAbortNotif
+	})
+	WatchdogThreshold = 20 * time.Millisecond
+	WatchdogAbort = 100 * time.Millisecond
+	watchdogInterval = 5 * time.Millisecond
+
+	// The tracee is blocked in its syscall until the notification is answered.
+	var once sync.Once
+	unblocked := make(chan struct{})
+	abortNotif = func(n *seccomp.Notif) error {
+		once.Do(func() { close(unblocked) })
+		return nil
+	}
+
+	e := &Engine{}
+	stop := make(chan struct{})
+	defer close(stop)
+	go e.watchdog(stop)
+
+	stuck := &seccomp.Notif{ID: 1, PID: 42}
+	e.trackNotif(stuck)
+	handlerDone := make(chan struct{})
+	defer close(handlerDone)
+	go func() {
+		<-handlerDone // the stuck handler
+		e.untrackNotif(stuck)
+	}()
+
+	select {
+	case <-unblocked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watchdog didn't answer the stuck notification")
+	}
+
+	e.inflight.mu.Lock()
+	reports, left := e.inflight.reports, len(e.inflight.notifs)
+	e.inflight.mu.Unlock()
+	if reports != 1 {
+		t.Errorf("got %d stall reports, want 1", reports)
+	}
+	if left != 0 {
+		t.Errorf("got %d notifications in flight after abort, want 0", left)
+	}
+
+	// Notifications answered in time after the stall don't trigger another
+	// report.
+	for range 5 {
+		n := &seccomp.Notif{ID: 2, PID: 42}
+		e.trackNotif(n)
+		e.untrackNotif(n)
+		time.Sleep(watchdogInterval)
+	}
+	e.inflight.mu.Lock()
+	reports, stalled := e.inflight.reports, e.inflight.stalled
+	e.inflight.mu.Unlock()
+	if reports != 1 || stalled {
+		t.Errorf("got reports=%d stalled=%v after recovering, want 1 and false", reports, stalled)
+	}
+}
+
+func TestWatchdogReportsOncePerStall(t *testing.T) {
+	prevThreshold, prevAbort := WatchdogThreshold, WatchdogAbort
+	t.Cleanup(func() { WatchdogThreshold, WatchdogAbort = prevThreshold, prevAbort })
+	WatchdogThreshold, WatchdogAbort = time.Second, 0
+
+	e := &Engine{}
+	n := &seccomp.Notif{ID: 1, PID: 42}
+	e.trackNotif(n)
+
+	now := time.Now()
+	e.checkStalls(now)
+	e.checkStalls(now.Add(2 * time.Second))
+	e.checkStalls(now.Add(3 * time.Second))
+	if e.inflight.reports != 1 {
+		t.Fatalf("got %d reports during one stall, want 1", e.inflight.reports)
+	}
+
+	e.untrackNotif(n)
+	e.checkStalls(now.Add(4 * time.Second))
+	e.trackNotif(n)
+	e.checkStalls(time.Now().Add(2 * time.Second))
+	if e.inflight.reports != 2 {
+		t.Fatalf("got %d reports after a second stall, want 2", e.inflight.reports)
+	}
+}
+
+func TestWatchdogIgnoresBlockingSyscalls(t *testing.T) {
+	prevThreshold, prevAbort := WatchdogThreshold, WatchdogAbort
+	t.Cleanup(func() { WatchdogThreshold, WatchdogAbort = prevThreshold, prevAbort })
+	WatchdogThreshold, WatchdogAbort = time.Second, 0
+
+	// A blocking accept(2) waits in its handler until a client connects.
+	e := &Engine{}
+	e.trackNotif(&seccomp.Notif{ID: 1, PID: 42, Syscall: unix.SYS_ACCEPT4})
+	e.checkStalls(time.Now().Add(time.Minute))
+	if e.inflight.reports != 0 {
+		t.Fatalf("got %d reports for a blocking accept, want 0", e.inflight.reports)
+	}
+}
+
+// TestWatchdogClockJump checks that the watchdog waits out the grace interval
+// after the wall clock jumped before it aborts a notification.
+func TestWatchdogClockJump(t *testing.T) {
+	prevThreshold, prevAbort, prevAbortNotif := WatchdogThreshold, WatchdogAbort, abortNotif
+	prevGrace, prevDefault := clock.Grace, clock.Default
+	t.Cleanup(func() {
+		WatchdogThreshold, WatchdogAbort, abortNotif = prevThreshold, prevAbort, prevAbortNotif
+		clock.Grace, clock.Default = prevGrace, prevDefault
+	})
+	WatchdogThreshold, WatchdogAbort, clock.Grace = time.Second, 2*time.Second, 10*time.Second
+	f := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	clock.Default = clock.NewDetector(f)
+
+	aborted := 0
+	abortNotif = func(n *seccomp.Notif) error {
+		aborted++
+		return nil
+	}
+
+	e := &Engine{}
+	e.trackNotif(&seccomp.Notif{ID: 1, PID: 42})
+	now := time.Now()
+
+	f.Step(time.Hour)
+	e.checkStalls(now.Add(WatchdogAbort))
+	if aborted != 0 {
+		t.Fatalf("got %d aborts within the grace interval, want 0", aborted)
+	}
+	f.Advance(clock.Grace)
+	e.checkStalls(now.Add(WatchdogAbort + clock.Grace))
+	if aborted != 1 {
+		t.Fatalf("got %d aborts after the grace interval, want 1", aborted)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package idle checks that the tracer doesn't burn CPU while the traced
+// program is idle.
+package idle
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// budget is the fraction of a core the tracer may use while idle.
+const budget = 0.005
+
+// clockTicks is USER_HZ, the unit of utime and stime in /proc/<pid>/stat. It's
+// 100 on every architecture Linux supports.
+const clockTicks = 100
+
+func getBinary(t *testing.T) string {
+	t.Helper()
+
+	if path := os.Getenv("SUBTRACE_BINARY"); path != "" {
+		return path
+	}
+
+	out := filepath.Join(t.TempDir(), "subtrace")
+	build := func(args ...string) error {
+		cmd := exec.Command("go", append(append([]string{"build", "-o", out}, args...), "subtrace.dev")...)
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+		b, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, b)
+		}
+		return nil
+	}
+	if err := build(); err != nil {
+		// Newer toolchains refuse the runtime.futex linkname unless asked not to.
+		if err2 := build("-ldflags=-checklinkname=0"); err2 != nil {
+			t.Skipf("cannot build subtrace binary (set SUBTRACE_BINARY to use a prebuilt one): %v", err)
+		}
+	}
+	return out
+}
+
+// cpuTime returns the user and system CPU time used by pid so far.
+func cpuTime(pid int) (time.Duration, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces, so start after its closing paren.
+	i := strings.LastIndexByte(string(b), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("malformed stat: %q", b)
+	}
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("malformed stat: %q", b)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse utime: %w", err)
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse stime: %w", err)
+	}
+	return time.Duration(utime+stime) * time.Second / clockTicks, nil
+}
+
+// TestIdleCPU traces a sleeping program with journal and devtools enabled and
+// checks the tracer's CPU usage against the budget. The window defaults to a
+// few seconds for CI; set SUBTRACE_IDLE_SECONDS=300 for a thorough run.
+func TestIdleCPU(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping idle CPU test in short mode")
+	}
+
+	window := 3 * time.Second
+	if val := os.Getenv("SUBTRACE_IDLE_SECONDS"); val != "" {
+		secs, err := strconv.Atoi(val)
+		if err != nil {
+			t.Fatalf("parse SUBTRACE_IDLE_SECONDS: %v", err)
+		}
+		window = time.Duration(secs) * time.Second
+	}
+	const warmup = 2 * time.Second
+
+	bin := getBinary(t)
+	sleep := fmt.Sprintf("%d", int((warmup + window + 5*time.Second).Seconds()))
+	cmd := exec.Command(bin, "run", "-tracelogs", "-devtools=/subtrace", "-quiet", "--", "sleep", sleep)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	time.Sleep(warmup)
+	before, err := cpuTime(cmd.Process.Pid)
+	if err != nil {
+		t.Skipf("cannot read tracer cpu time (tracing unsupported here?): %v", err)
+	}
+	time.Sleep(window)
+	after, err := cpuTime(cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("read tracer cpu time: %v", err)
+	}
+
+	// CPU time is only accounted in whole clock ticks, so allow a couple of
+	// ticks on short windows.
+	allowed := max(time.Duration(budget*float64(window)), 2*time.Second/clockTicks)
+	used := after - before
+	t.Logf("tracer used %v of CPU over %v idle (allowed %v)", used, window, allowed)
+	if used > allowed {
+		t.Fatalf("tracer used %v of CPU over %v while idle, want at most %v (%.1f%% of a core)", used, window, allowed, budget*100)
+	}
+}
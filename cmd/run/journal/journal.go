@@ -2,28 +2,92 @@ package journal
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"subtrace.dev/cmd/run/capability"
 )
 
 var Enabled bool = false
 
+func init() {
+	capability.RegisterFeature("tracelogs", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: Enabled}
+	})
+}
+
 const maxLogLines = 4096
 
+// MaxLineBytes bounds the length of a line. The rest of a longer line is
+// discarded as it's read rather than buffered.
+var MaxLineBytes = 1024
+
+// JSON makes the journal parse lines that are JSON objects and keep the
+// JSONFields they have in Line.Fields. Lines that start with whitespace and
+// aren't JSON, such as the frames of a stack trace, are appended to the line
+// before them on the same stream instead.
+var JSON bool
+
+// JSONFields are the fields JSON extracts from a line. A name with dots, such
+// as "span.trace_id", also matches a field nested in objects.
+var JSONFields = []string{"level", "msg", "trace_id"}
+
+// Bounds on the lines Between returns for one request.
+var (
+	CorrelateMaxLines = 64
+	CorrelateMaxBytes = 16 << 10
+)
+
+// trackTTL is how long Track keeps an ID whose untrack was never called, e.g.
+// because the request's event was never finished.
+const trackTTL = 10 * time.Minute
+
+// Line is a line the traced command wrote to stdout or stderr.
+type Line struct {
+	Time      time.Time `json:"time"` // when subtrace read it
+	Stream    string    `json:"stream"`
+	Text      string    `json:"text"`
+	RequestID string    `json:"requestId,omitempty"` // the tracked ID it contains, see Track
+
+	// Fields are the JSONFields of a JSON line, as strings. Text still has
+	// the line verbatim.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
 type Journal struct {
 	Stdout io.Writer
 	Stderr io.Writer
 
 	mu  sync.RWMutex
-	buf [maxLogLines]string
+	buf [maxLogLines]Line
 	idx uint64
 
-	ch chan string
+	ch chan Line
+
+	trackMu sync.Mutex
+	tracked map[string]*trackedID
+
+	// last is the index in buf of the last line of each stream plus one, for
+	// lines that continue it (see JSON).
+	last map[string]uint64
+}
+
+type trackedID struct {
+	refs  int
+	since time.Time
 }
 
 func New() *Journal {
 	j := new(Journal)
-	j.ch = make(chan string, 1<<16)
+	j.ch = make(chan Line, 1<<16)
+	j.tracked = make(map[string]*trackedID)
 
 	prout, pwout := io.Pipe()
 	prerr, pwerr := io.Pipe()
@@ -31,27 +95,46 @@ func New() *Journal {
 	j.Stderr = pwerr
 
 	go j.listen()
-	go j.loop(prout)
-	go j.loop(prerr)
+	go j.loop(prout, "stdout")
+	go j.loop(prerr, "stderr")
 
 	return j
 }
 
-func (j *Journal) loop(r io.ReadCloser) {
+func (j *Journal) loop(r io.ReadCloser, stream string) {
 	defer r.Close()
 
-	s := bufio.NewScanner(r)
-	for s.Scan() {
-		line := s.Text()
-		if len(line) > 1024 {
-			line = line[:1024]
+	br := bufio.NewReader(r)
+	for {
+		line, err := readLine(br, MaxLineBytes)
+		if line != "" || err == nil {
+			select {
+			case j.ch <- Line{Time: time.Now(), Stream: stream, Text: line}:
+			default:
+				// dropping data
+			}
+		}
+		if err != nil {
+			return
 		}
+	}
+}
 
-		select {
-		case j.ch <- line:
-		default:
-			// dropping data
+// readLine reads a line from r without its line ending. Only the first max
+// bytes of it are kept. At the end of r, it returns what's left with io.EOF.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var b []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if n := max - len(b); n > 0 {
+			b = append(b, chunk[:min(n, len(chunk))]...)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
 		}
+		b = bytes.TrimSuffix(b, []byte("\n"))
+		b = bytes.TrimSuffix(b, []byte("\r")) // PTYs end lines with \r\n
+		return string(b), err
 	}
 }
 
@@ -61,12 +144,196 @@ func (j *Journal) listen() {
 	}
 }
 
-func (j *Journal) addLine(line string) {
+func (j *Journal) addLine(line Line) {
+	if JSON {
+		line.Fields = parseFields(line.Text)
+		if line.Fields == nil && isContinuation(line.Text) && j.continueLine(line) {
+			return
+		}
+	}
+	line.RequestID = j.match(line.Text)
+
 	j.mu.Lock()
 	defer j.mu.Unlock()
 
 	j.buf[j.idx%maxLogLines] = line
 	j.idx++
+	if j.last == nil {
+		j.last = make(map[string]uint64)
+	}
+	j.last[line.Stream] = j.idx
+}
+
+// isContinuation reports whether text continues the line before it, like the
+// frames of a stack trace, which start with whitespace.
+func isContinuation(text string) bool {
+	return strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t")
+}
+
+// continueLine appends line to the last line of its stream, if it's still in
+// the buffer, and reports whether it did. The joined line is cut at
+// MaxLineBytes like any other.
+func (j *Journal) continueLine(line Line) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	last, ok := j.last[line.Stream]
+	if !ok || j.idx-last >= maxLogLines {
+		return false
+	}
+	prev := &j.buf[(last-1)%maxLogLines]
+	if n := MaxLineBytes - len(prev.Text); n > 0 {
+		text := "\n" + line.Text
+		prev.Text += text[:min(n, len(text))]
+	}
+	return true
+}
+
+// parseFields returns the JSONFields of text if it's a JSON object, or nil if
+// it isn't one. Values that aren't strings are kept as JSON.
+func parseFields(text string) map[string]string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "{") {
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil || dec.More() {
+		return nil
+	}
+
+	fields := make(map[string]string)
+	for _, name := range JSONFields {
+		v, ok := lookupField(obj, name)
+		if !ok || v == nil {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			fields[name] = v
+		case json.Number:
+			fields[name] = v.String()
+		case bool:
+			fields[name] = strconv.FormatBool(v)
+		default:
+			b, _ := json.Marshal(v)
+			fields[name] = string(b)
+		}
+	}
+	return fields
+}
+
+// lookupField returns the field name of obj, or the nested field it names
+// with dots if obj has no such field itself.
+func lookupField(obj map[string]any, name string) (any, bool) {
+	if v, ok := obj[name]; ok {
+		return v, true
+	}
+	first, rest, ok := strings.Cut(name, ".")
+	if !ok {
+		return nil, false
+	}
+	nested, ok := obj[first].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return lookupField(nested, rest)
+}
+
+// Track makes lines that contain id, such as the value of a request ID
+// header, carry it in their RequestID until untrack is called, so that they
+// can be told apart from the lines of concurrent requests.
+func (j *Journal) Track(id string) (untrack func()) {
+	j.trackMu.Lock()
+	defer j.trackMu.Unlock()
+
+	now := time.Now()
+	for k, t := range j.tracked {
+		if now.Sub(t.since) > trackTTL {
+			delete(j.tracked, k)
+		}
+	}
+
+	t, ok := j.tracked[id]
+	if !ok {
+		t = &trackedID{since: now}
+		j.tracked[id] = t
+	}
+	t.refs++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			j.trackMu.Lock()
+			defer j.trackMu.Unlock()
+			if t.refs--; t.refs == 0 && j.tracked[id] == t {
+				delete(j.tracked, id)
+			}
+		})
+	}
+}
+
+// match returns the longest tracked ID that line contains, or "" if none.
+func (j *Journal) match(line string) string {
+	j.trackMu.Lock()
+	defer j.trackMu.Unlock()
+
+	var ret string
+	for id := range j.tracked {
+		if len(id) < len(ret) || (len(id) == len(ret) && id > ret) {
+			continue
+		}
+		if strings.Contains(line, id) {
+			ret = id
+		}
+	}
+	return ret
+}
+
+// Between returns lines read from begin to end, oldest first, for a request
+// whose tracked ID is id (or "" if it has none). Lines that carry another
+// request's ID are left out. At most CorrelateMaxLines lines and
+// CorrelateMaxBytes bytes of text are returned: lines that carry id are kept
+// first, then the earliest of the rest.
+func (j *Journal) Between(begin, end time.Time, id string) []Line {
+	j.mu.RLock()
+	var lines []Line
+	for i := j.idx; i > 0 && j.idx-i < maxLogLines; i-- {
+		line := j.buf[(i-1)%maxLogLines]
+		if line.Time.Before(begin) {
+			break
+		}
+		if line.Time.After(end) || (line.RequestID != "" && line.RequestID != id) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	j.mu.RUnlock()
+	slices.Reverse(lines)
+
+	keep := make([]bool, len(lines))
+	n, size := 0, 0
+	for _, own := range []bool{true, false} {
+		for i, line := range lines {
+			if keep[i] || (line.RequestID != "") != own {
+				continue
+			}
+			if n == CorrelateMaxLines || size+len(line.Text) > CorrelateMaxBytes {
+				break
+			}
+			keep[i] = true
+			n, size = n+1, size+len(line.Text)
+		}
+	}
+
+	ret := make([]Line, 0, n)
+	for i, line := range lines {
+		if keep[i] {
+			ret = append(ret, line)
+		}
+	}
+	return ret
 }
 
 func (j *Journal) CopyFrom(pos uint64) (uint64, []string) {
@@ -78,14 +345,11 @@ func (j *Journal) CopyFrom(pos uint64) (uint64, []string) {
 	}
 
 	numLines := min(j.idx-pos, uint64(maxLogLines))
-	bufEnd := j.idx % maxLogLines
-	bufStart := (j.idx - numLines) % maxLogLines
-
-	if bufStart < bufEnd {
-		return j.idx - numLines, append([]string{}, j.buf[bufStart:bufEnd]...)
-	} else {
-		return j.idx - numLines, append(j.buf[bufStart:], j.buf[:bufEnd]...)
+	ret := make([]string, 0, numLines)
+	for i := j.idx - numLines; i < j.idx; i++ {
+		ret = append(ret, j.buf[i%maxLogLines].Text)
 	}
+	return j.idx - numLines, ret
 }
 
 func (j *Journal) GetIndex() uint64 {
@@ -0,0 +1,140 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package journal
+
+import (
+	"bufio"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func texts(lines []Line) []string {
+	var ret []string
+	for _, line := range lines {
+		ret = append(ret, line.Text)
+	}
+	return ret
+}
+
+func TestBetween(t *testing.T) {
+	j := &Journal{tracked: make(map[string]*trackedID)}
+	base := time.Unix(1000, 0)
+	add := func(sec int, text string) {
+		j.addLine(Line{Time: base.Add(time.Duration(sec) * time.Second), Stream: "stdout", Text: text})
+	}
+
+	untrackA := j.Track("req-aaaa")
+	untrackB := j.Track("req-bbbb")
+	add(0, "before")
+	add(1, "handling req-aaaa")
+	add(2, "unrelated")
+	add(3, "handling req-bbbb")
+	add(4, "done req-aaaa")
+	untrackB()
+	add(5, "late req-bbbb") // no longer tracked
+	untrackA()
+	add(9, "after")
+
+	begin, end := base.Add(time.Second), base.Add(5*time.Second)
+	for _, tt := range []struct {
+		id   string
+		want []string
+	}{
+		{"req-aaaa", []string{"handling req-aaaa", "unrelated", "done req-aaaa", "late req-bbbb"}},
+		{"req-bbbb", []string{"unrelated", "handling req-bbbb", "late req-bbbb"}},
+		{"", []string{"unrelated", "late req-bbbb"}},
+	} {
+		if got := texts(j.Between(begin, end, tt.id)); !slices.Equal(got, tt.want) {
+			t.Errorf("id %q: got %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestBetweenBounds(t *testing.T) {
+	prev := CorrelateMaxLines
+	CorrelateMaxLines = 3
+	t.Cleanup(func() { CorrelateMaxLines = prev })
+
+	j := &Journal{tracked: make(map[string]*trackedID)}
+	untrack := j.Track("req-aaaa")
+	defer untrack()
+	now := time.Now()
+	for i := range 10 {
+		text := strings.Repeat("x", i)
+		if i == 7 {
+			text = "got req-aaaa"
+		}
+		j.addLine(Line{Time: now, Text: text})
+	}
+
+	// The request's own line is kept first, then the earliest of the rest.
+	want := []string{"", "x", "got req-aaaa"}
+	if got := texts(j.Between(now, now, "req-aaaa")); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	prevJSON, prevFields := JSON, JSONFields
+	JSON, JSONFields = true, []string{"level", "msg", "trace_id", "span.id", "status"}
+	t.Cleanup(func() { JSON, JSONFields = prevJSON, prevFields })
+
+	j := &Journal{tracked: make(map[string]*trackedID)}
+	now := time.Now()
+	for _, l := range []struct{ stream, text string }{
+		{"stdout", `{"level":"info","msg":"listening","trace_id":"abc123","span":{"id":7},"status":200,"extra":true}`},
+		{"stderr", `Traceback (most recent call last):`},
+		{"stdout", `{"level":"error","msg":"failed"}`},
+		{"stderr", `  File "app.py", line 3, in <module>`},
+		{"stderr", "\traise ValueError()"},
+		{"stderr", `ValueError`},
+		{"stdout", `{"level": "warn", "msg": "truncated`},
+		{"stdout", `  {"level":"debug"}`},
+	} {
+		j.addLine(Line{Time: now, Stream: l.stream, Text: l.text})
+	}
+
+	lines := j.Between(now, now, "")
+	want := []string{
+		`{"level":"info","msg":"listening","trace_id":"abc123","span":{"id":7},"status":200,"extra":true}`,
+		"Traceback (most recent call last):\n  File \"app.py\", line 3, in <module>\n\traise ValueError()",
+		`{"level":"error","msg":"failed"}`,
+		`ValueError`,
+		`{"level": "warn", "msg": "truncated`,
+		`  {"level":"debug"}`,
+	}
+	if got := texts(lines); !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	wantFields := map[string]string{"level": "info", "msg": "listening", "trace_id": "abc123", "span.id": "7", "status": "200"}
+	if !maps.Equal(lines[0].Fields, wantFields) {
+		t.Errorf("got fields %v, want %v", lines[0].Fields, wantFields)
+	}
+	if lines[1].Fields != nil || lines[4].Fields != nil {
+		t.Errorf("got fields for lines that aren't JSON")
+	}
+	if lines[5].Fields["level"] != "debug" {
+		t.Errorf("got fields %v for an indented JSON line", lines[5].Fields)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 1<<20)
+	r := bufio.NewReaderSize(strings.NewReader("short\r\n"+long+"\n\nlast"), 16)
+	var got []string
+	for {
+		line, err := readLine(r, 8)
+		got = append(got, line)
+		if err != nil {
+			break
+		}
+	}
+	if want := []string{"short", "xxxxxxxx", "", "last"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -49,6 +49,15 @@ func CheckVersion(want string, log bool) (int, int, error) {
 	return gotMajor, gotMinor, ErrUnsupportedVersion
 }
 
+// Release returns the running kernel's release string (uname -r).
+func Release() (string, error) {
+	var buf unix.Utsname
+	if err := unix.Uname(&buf); err != nil {
+		return "", fmt.Errorf("uname: %w", err)
+	}
+	return string(buf.Release[:bytes.IndexByte(buf.Release[:], 0)]), nil
+}
+
 func parseMajorMinor(version string) (int, int, error) {
 	parts := strings.Split(version, ".")
 	if len(parts) < 2 {
@@ -0,0 +1,332 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package localproxy detects proxies on the same host that traced traffic
+// goes through, such as an Istio/Envoy sidecar or a local corporate HTTP
+// proxy. subtrace captures the connections a process makes, so when the
+// process talks to such a proxy, it sees connections to a loopback port
+// instead of the destinations behind it.
+package localproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"subtrace.dev/procfs"
+)
+
+// How a proxy was configured, as set in Proxy.Kind.
+const (
+	// KindHTTP is a forward proxy the process is told to use. It speaks
+	// HTTP CONNECT or takes absolute-form requests.
+	KindHTTP = "http"
+
+	// KindRedirect is a transparent proxy that iptables redirects
+	// connections to.
+	KindRedirect = "redirect"
+)
+
+// Proxy is a local proxy traced traffic may go through.
+type Proxy struct {
+	Addr   netip.AddrPort
+	Kind   string
+	Source string // the environment variable or the mechanism it was found by
+}
+
+func (p Proxy) String() string {
+	return fmt.Sprintf("%s proxy on %s (%s)", p.Kind, p.Addr, p.Source)
+}
+
+// proxyEnvVars are the environment variables HTTP clients take a forward
+// proxy from, in both cases as curl, Go and Python accept either.
+var proxyEnvVars = []string{"HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY", "http_proxy", "https_proxy", "all_proxy"}
+
+// FromEnv returns the forward proxies on a loopback address that environ
+// points HTTP clients to. Proxies on other hosts are none of its concern: the
+// process's connections to them are captured, and so are their destinations
+// with the proxy-aware parsing of CONNECT and absolute-form requests.
+func FromEnv(environ []string) []Proxy {
+	var ret []Proxy
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || value == "" || !slices.Contains(proxyEnvVars, name) {
+			continue
+		}
+		addr, ok := loopbackProxyAddr(value)
+		if !ok || slices.ContainsFunc(ret, func(p Proxy) bool { return p.Addr == addr }) {
+			continue
+		}
+		ret = append(ret, Proxy{Addr: addr, Kind: KindHTTP, Source: name})
+	}
+	return ret
+}
+
+// loopbackProxyAddr returns the address of a proxy URL if it's on a loopback
+// address. A URL without a scheme is taken as http:// like curl does.
+func loopbackProxyAddr(s string) (netip.AddrPort, bool) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h", "socks4", "socks4a":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !addr.Unmap().IsLoopback() {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(addr.Unmap(), uint16(n)), true
+}
+
+var redirectRule = regexp.MustCompile(`-j REDIRECT\b.*--to-ports (\d+)`)
+
+// ParseIptablesSave returns the ports that the nat table rules in the output
+// of iptables-save redirect connections to, in the order they first appear.
+func ParseIptablesSave(out string) []uint16 {
+	var ret []uint16
+	for _, line := range strings.Split(out, "\n") {
+		m := redirectRule.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		port, err := strconv.ParseUint(m[1], 10, 16)
+		if err == nil && !slices.Contains(ret, uint16(port)) {
+			ret = append(ret, uint16(port))
+		}
+	}
+	return ret
+}
+
+// iptablesSave returns the output of iptables-save for the nat table. It needs
+// CAP_NET_ADMIN, which application containers usually don't have, so it's
+// only attempted as root.
+func iptablesSave() (string, error) {
+	if os.Geteuid() != 0 {
+		return "", fmt.Errorf("not root")
+	}
+	path, err := exec.LookPath("iptables-save")
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-t", "nat").Output()
+	if err != nil {
+		return "", fmt.Errorf("iptables-save: %w", err)
+	}
+	return string(out), nil
+}
+
+// Listener is a TCP listener of the network namespace.
+type Listener struct {
+	Addr netip.AddrPort
+	UID  int
+}
+
+// Listeners returns the TCP listeners of the network namespace from
+// /proc/net/tcp and /proc/net/tcp6, which list the sockets of every process,
+// traced or not, along with the uid that owns them.
+func Listeners() ([]Listener, error) {
+	var ret []Listener
+	for _, name := range []string{procfs.Path("net/tcp"), procfs.Path("net/tcp6")} {
+		f, err := os.Open(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // no IPv6
+			}
+			return nil, err
+		}
+		lis, err := parseProcNetTCP(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+		ret = append(ret, lis...)
+	}
+	return ret, nil
+}
+
+// tcpListen is the TCP_LISTEN state as printed in /proc/net/tcp.
+const tcpListen = "0A"
+
+func parseProcNetTCP(r io.Reader) ([]Listener, error) {
+	var ret []Listener
+	s := bufio.NewScanner(r)
+	s.Scan() // header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 8 || fields[3] != tcpListen {
+			continue
+		}
+		addr, err := procfs.ParseNetAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return nil, fmt.Errorf("parse uid %q: %w", fields[7], err)
+		}
+		ret = append(ret, Listener{Addr: addr, UID: uid})
+	}
+	return ret, s.Err()
+}
+
+// Istio's default sidecar layout: Envoy runs as istioProxyUID, iptables
+// redirects outgoing connections to istioOutboundPort and incoming ones to
+// istioInboundPort, and Envoy connects to the application from
+// istioInboundSource.
+const (
+	istioProxyUID      = 1337
+	istioOutboundPort  = 15001
+	istioInboundPort   = 15006
+	istioInboundSource = "127.0.0.6"
+)
+
+// Istio is what was found of an Istio sidecar in the network namespace.
+type Istio struct {
+	// Evidence has one line for each sign of the sidecar.
+	Evidence []string
+
+	// ProxyUID is the uid Envoy's listeners are owned by, or -1 if unknown.
+	ProxyUID int
+
+	// Outbound and Inbound are whether Envoy listens on the ports outgoing
+	// and incoming connections are redirected to.
+	Outbound, Inbound bool
+
+	// Redirected is whether iptables was read and has Istio's chains.
+	Redirected bool
+}
+
+// Detected reports whether there are enough signs of a sidecar to act on.
+func (i *Istio) Detected() bool {
+	return i != nil && len(i.Evidence) > 0
+}
+
+// detectIstio looks for Istio's sidecar layout in the environment, the
+// network namespace's listeners and the output of iptables-save (empty if it
+// couldn't be read).
+func detectIstio(environ []string, listeners []Listener, iptables string) *Istio {
+	ret := &Istio{ProxyUID: -1}
+	for _, l := range listeners {
+		switch l.Addr.Port() {
+		case istioOutboundPort:
+			ret.Outbound = true
+		case istioInboundPort:
+			ret.Inbound = true
+		default:
+			continue
+		}
+		ret.ProxyUID = l.UID
+		ret.Evidence = append(ret.Evidence, fmt.Sprintf("uid %d listens on %s", l.UID, l.Addr))
+	}
+	var fromEnv bool
+	for _, kv := range environ {
+		if name, _, _ := strings.Cut(kv, "="); strings.HasPrefix(name, "ISTIO_META_") || name == "ISTIO_PROXY_UID" {
+			fromEnv = true
+			ret.Evidence = append(ret.Evidence, "environment variable "+name+" is set")
+			break
+		}
+	}
+	if strings.Contains(iptables, "ISTIO_REDIRECT") || strings.Contains(iptables, "ISTIO_OUTPUT") {
+		ret.Redirected = true
+		ret.Evidence = append(ret.Evidence, "iptables has Istio's ISTIO_OUTPUT and ISTIO_REDIRECT chains")
+	}
+
+	// Something else may listen on one of Istio's ports.
+	if !fromEnv && !ret.Redirected && !(ret.Outbound && ret.Inbound) && ret.ProxyUID != istioProxyUID {
+		ret.Evidence = nil
+	}
+	return ret
+}
+
+// Guidance returns what to expect from subtrace with the sidecar and what to
+// do about it, one line each.
+func (i *Istio) Guidance(uid int) []string {
+	var ret []string
+	if i.ProxyUID >= 0 && uid == i.ProxyUID {
+		ret = append(ret, fmt.Sprintf("subtrace runs as uid %d, the uid Envoy runs as, which Istio's iptables rules exclude: traced traffic bypasses the mesh. Run the application as another user.", uid))
+	}
+	if i.Outbound {
+		ret = append(ret, fmt.Sprintf("Outgoing connections are captured before iptables redirects them to Envoy on port %d, so events keep their real destinations and plaintext bodies even when the mesh adds mTLS. An application configured to send its requests to Envoy directly is captured as connections to 127.0.0.1:%d; its CONNECT and absolute-form requests still carry the destination.", istioOutboundPort, istioOutboundPort))
+	}
+	if i.Inbound {
+		ret = append(ret, fmt.Sprintf("Incoming connections arrive from Envoy (port %d) on %s, not from the real client: use the x-forwarded-for and x-envoy-external-address request headers for the client's address.", istioInboundPort, istioInboundSource))
+	}
+	if !i.Redirected {
+		ret = append(ret, "iptables couldn't be read to confirm the redirection (it needs root and CAP_NET_ADMIN); `iptables-save -t nat` in the istio-proxy or istio-init container shows it.")
+	}
+	return ret
+}
+
+// Report is the local proxies found on the host.
+type Report struct {
+	Proxies []Proxy
+	Istio   *Istio
+}
+
+// Detect looks for local proxies: forward proxies on a loopback address in
+// environ, transparent proxies iptables redirects to, if it can be read, and
+// Istio's sidecar layout.
+func Detect(environ []string) Report {
+	ret := Report{Proxies: FromEnv(environ)}
+
+	iptables, _ := iptablesSave()
+	listeners, _ := Listeners()
+	for _, port := range ParseIptablesSave(iptables) {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), port)
+		ret.Proxies = append(ret.Proxies, Proxy{Addr: addr, Kind: KindRedirect, Source: "iptables"})
+	}
+	ret.Istio = detectIstio(environ, listeners, iptables)
+	return ret
+}
+
+// Warning explains what the proxy means for the events subtrace produces.
+func (p Proxy) Warning() string {
+	if p.Kind == KindRedirect {
+		return fmt.Sprintf("iptables redirects connections to port %d: subtrace captures them before the redirect, but traffic sent to the port directly is captured as connections to the proxy", p.Addr.Port())
+	}
+	return fmt.Sprintf("%s points to a proxy on %s: connections through it are captured as connections to the proxy, with destinations recovered from CONNECT and absolute-form requests and tagged via_proxy", p.Source, p.Addr)
+}
+
+// Warnings returns one line for each local proxy found and one for an Istio
+// sidecar.
+func (r Report) Warnings() []string {
+	var ret []string
+	for _, p := range r.Proxies {
+		ret = append(ret, p.Warning())
+	}
+	if r.Istio.Detected() {
+		ret = append(ret, "an Istio sidecar was detected ("+strings.Join(r.Istio.Evidence, "; ")+"), run `subtrace doctor` for what to expect")
+	}
+	return ret
+}
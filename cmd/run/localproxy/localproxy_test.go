@@ -0,0 +1,111 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package localproxy
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFromEnv(t *testing.T) {
+	environ := []string{
+		"HTTPS_PROXY=http://127.0.0.1:3128",
+		"http_proxy=localhost:3128",
+		"ALL_PROXY=socks5://[::1]",
+		"HTTP_PROXY=http://proxy.corp.example:8080",
+		"NO_PROXY=127.0.0.1",
+		"https_proxy=",
+	}
+	var got []string
+	for _, p := range FromEnv(environ) {
+		got = append(got, p.Source+" "+p.Addr.String())
+	}
+	want := []string{"HTTPS_PROXY 127.0.0.1:3128", "ALL_PROXY [::1]:1080"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseIptablesSave(t *testing.T) {
+	out := `# Generated by iptables-save
+*nat
+:ISTIO_INBOUND - [0:0]
+:ISTIO_REDIRECT - [0:0]
+-A ISTIO_IN_REDIRECT -p tcp -j REDIRECT --to-ports 15006
+-A ISTIO_OUTPUT -o lo -s 127.0.0.6/32 -j RETURN
+-A ISTIO_REDIRECT -p tcp -j REDIRECT --to-ports 15001
+-A OUTPUT -p tcp --dport 80 -j REDIRECT --to-ports 15001
+COMMIT
+`
+	if got := ParseIptablesSave(out); !slices.Equal(got, []uint16{15006, 15001}) {
+		t.Errorf("got ports %v", got)
+	}
+}
+
+func TestParseProcNetTCP(t *testing.T) {
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:3A99 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1337        0 662 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:3A9E 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1337        0 907 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F90 0100007F:C350 01 00000000:00000000 00:00000000 00000000  1000        0 908 1 0000000000000000 20 4 30 10 -1
+`
+	tcp6 := `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000001000000:1F90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 17 1 0000000000000000 100 0 0 10 0
+`
+	got, err := parseProcNetTCP(strings.NewReader(tcp))
+	if err != nil {
+		t.Fatalf("parse tcp: %v", err)
+	}
+	got6, err := parseProcNetTCP(strings.NewReader(tcp6))
+	if err != nil {
+		t.Fatalf("parse tcp6: %v", err)
+	}
+	want := []Listener{
+		{netip.MustParseAddrPort("0.0.0.0:15001"), 1337},
+		{netip.MustParseAddrPort("127.0.0.1:15006"), 1337},
+		{netip.MustParseAddrPort("[::1]:8080"), 1000},
+	}
+	if got = append(got, got6...); !slices.Equal(got, want) {
+		t.Errorf("got listeners %v, want %v", got, want)
+	}
+}
+
+func TestDetectIstio(t *testing.T) {
+	sidecar := []Listener{
+		{netip.MustParseAddrPort("0.0.0.0:15001"), 1337},
+		{netip.MustParseAddrPort("0.0.0.0:15006"), 1337},
+		{netip.MustParseAddrPort("127.0.0.1:8080"), 1000},
+	}
+	for _, tt := range []struct {
+		name      string
+		environ   []string
+		listeners []Listener
+		iptables  string
+		want      bool
+	}{
+		{"none", nil, []Listener{{netip.MustParseAddrPort("127.0.0.1:8080"), 1000}}, "", false},
+		{"sidecar", nil, sidecar, "", true},
+		{"env", []string{"ISTIO_META_MESH_ID=cluster.local"}, nil, "", true},
+		{"iptables", nil, nil, "-A ISTIO_OUTPUT -j ISTIO_REDIRECT\n", true},
+		{"unrelated port", nil, []Listener{{netip.MustParseAddrPort("0.0.0.0:15001"), 1000}}, "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectIstio(tt.environ, tt.listeners, tt.iptables); got.Detected() != tt.want {
+				t.Errorf("got detected=%v (evidence %q), want %v", got.Detected(), got.Evidence, tt.want)
+			}
+		})
+	}
+
+	istio := detectIstio(nil, sidecar, "")
+	guidance := strings.Join(istio.Guidance(1337), "\n")
+	for _, want := range []string{"uid 1337", "127.0.0.6", "127.0.0.1:15001", "iptables couldn't be read"} {
+		if !strings.Contains(guidance, want) {
+			t.Errorf("guidance doesn't mention %q:\n%s", want, guidance)
+		}
+	}
+	if strings.Contains(strings.Join(istio.Guidance(1000), "\n"), "bypasses the mesh") {
+		t.Errorf("got the uid warning for another uid")
+	}
+}
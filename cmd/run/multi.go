@@ -0,0 +1,367 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package run
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/martian/v3/log"
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/engine"
+	"subtrace.dev/cmd/run/engine/process"
+	"subtrace.dev/cmd/run/journal"
+	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/devtools"
+	"subtrace.dev/global"
+)
+
+// namedCommand is one of the commands started together with -procfile or -cmd.
+type namedCommand struct {
+	name string
+	line string
+
+	pid    int
+	eng    *engine.Engine
+	status unix.WaitStatus
+	exited chan struct{}
+}
+
+type commandFlags []namedCommand
+
+func (f *commandFlags) String() string {
+	var ret []string
+	for _, cmd := range *f {
+		ret = append(ret, fmt.Sprintf("%s=%q", cmd.name, cmd.line))
+	}
+	return strings.Join(ret, " ")
+}
+
+func (f *commandFlags) Set(s string) error {
+	name, line, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("want name=command, got %q", s)
+	}
+	cmd, err := newNamedCommand(name, line)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, cmd)
+	return nil
+}
+
+func newNamedCommand(name, line string) (namedCommand, error) {
+	name, line = strings.TrimSpace(name), strings.TrimSpace(line)
+	if name == "" {
+		return namedCommand{}, fmt.Errorf("empty command name")
+	}
+	if line == "" {
+		return namedCommand{}, fmt.Errorf("%s: empty command", name)
+	}
+	return namedCommand{name: name, line: line}, nil
+}
+
+// parseProcfile parses a Procfile where every line is "name: command". Blank
+// lines and lines starting with # are ignored.
+func parseProcfile(r io.Reader) ([]namedCommand, error) {
+	var cmds []namedCommand
+	s := bufio.NewScanner(r)
+	for i := 1; s.Scan(); i++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, rest, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing colon", i)
+		}
+		cmd, err := newNamedCommand(name, rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i, err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	return cmds, nil
+}
+
+func (c *Command) isMulti() bool {
+	return c.flags.procfile != "" || len(c.flags.cmds) > 0
+}
+
+func (c *Command) getCommands() ([]*namedCommand, error) {
+	all := append([]namedCommand{}, c.flags.cmds...)
+	if c.flags.procfile != "" {
+		f, err := os.Open(c.flags.procfile)
+		if err != nil {
+			return nil, fmt.Errorf("open procfile: %w", err)
+		}
+		defer f.Close()
+
+		parsed, err := parseProcfile(f)
+		if err != nil {
+			return nil, fmt.Errorf("parse procfile: %w", err)
+		}
+		all = append(all, parsed...)
+	}
+
+	seen := make(map[string]bool)
+	var cmds []*namedCommand
+	for i := range all {
+		if seen[all[i].name] {
+			return nil, fmt.Errorf("duplicate command name %q", all[i].name)
+		}
+		seen[all[i].name] = true
+		cmds = append(cmds, &all[i])
+	}
+	if len(cmds) == 0 {
+		return nil, errMissingCommand
+	}
+
+	for _, name := range strings.Split(c.flags.shutdownOrder, ",") {
+		if name = strings.TrimSpace(name); name != "" && !seen[name] {
+			return nil, fmt.Errorf("shutdown order: unknown command %q", name)
+		}
+	}
+	return cmds, nil
+}
+
+// runMulti starts every command under its own tracer engine and waits for all
+// of them to exit. Each command runs in its own process group so that signals
+// received by subtrace can be forwarded in the configured shutdown order. The
+// exit code is that of the first command to fail, or 0.
+func (c *Command) runMulti() (int, error) {
+	cmds, err := c.getCommands()
+	if err != nil {
+		return 1, err
+	}
+
+	if c.flags.devtools != "" && !strings.HasPrefix(c.flags.devtools, "/") {
+		c.flags.devtools = "/" + c.flags.devtools
+	}
+	c.global.Devtools = devtools.NewServer(c.flags.devtools)
+
+	if journal.Enabled {
+		c.global.Journal = journal.New()
+	}
+
+	width := 0
+	for _, cmd := range cmds {
+		width = max(width, len(cmd.name))
+	}
+
+	itab := socket.NewInodeTable()
+
+	progress := newShutdownProgress(c.flags.quiet)
+	c.shutdown.Store(progress)
+
+	var mu sync.Mutex
+	firstFailure := 0
+
+	var wg sync.WaitGroup
+	for _, cmd := range cmds {
+		if err := c.startNamed(cmd, itab, width); err != nil {
+			c.stopCommands(cmds, unix.SIGKILL)
+			if errors.Is(err, errMissingSysPtrace) {
+				printMissingSysPtrace()
+				return 1, nil
+			}
+			return 0, fmt.Errorf("start %s: %w", cmd.name, err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(cmd.exited)
+
+			if _, err := unix.Wait4(cmd.pid, &cmd.status, 0, nil); err != nil {
+				slog.Error("failed to wait for command", "name", cmd.name, "pid", cmd.pid, "err", err)
+				return
+			}
+			slog.Debug("command root process exited", "name", cmd.name, "status", exitCode(cmd.status))
+
+			mu.Lock()
+			if code := exitCode(cmd.status); code != 0 && firstFailure == 0 {
+				firstFailure = code
+			}
+			mu.Unlock()
+		}()
+	}
+
+	log.SetLevel(log.Silent)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM, unix.SIGQUIT, unix.SIGHUP, unix.SIGUSR1, unix.SIGUSR2)
+	defer signal.Stop(sigs)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for waiting := true; waiting; {
+		select {
+		case sig := <-sigs:
+			switch sig {
+			case unix.SIGINT, unix.SIGTERM, unix.SIGQUIT:
+				go c.stopCommands(cmds, sig.(syscall.Signal))
+			default:
+				// Reloads and the like go to every command at once.
+				for _, cmd := range cmds {
+					slog.Debug("forwarding signal to command", "name", cmd.name, "signal", sig)
+					unix.Kill(-cmd.pid, sig.(syscall.Signal))
+				}
+			}
+		case <-done:
+			waiting = false
+		}
+	}
+
+	// See the equivalent shutdown sequence in entrypointParent.
+	for _, cmd := range cmds {
+		progress.engines = append(progress.engines, cmd.eng)
+	}
+	progress.begin()
+	defer progress.end()
+
+	progress.wait()
+	for _, cmd := range cmds {
+		if err := cmd.eng.Close(); err != nil {
+			slog.Debug("failed to close engine cleanly", "name", cmd.name, "err", err) // not fatal
+		}
+	}
+
+	progress.setPhase("connections", shutdownGracePeriod)
+	if abandoned := socket.Drain(shutdownGracePeriod, progress.abandon); abandoned > 0 {
+		slog.Debug("closed proxies still running after shutdown grace period", "count", abandoned)
+	}
+	c.writeHostsFile()
+	c.printBandwidthSummary()
+	c.printCacheSummary()
+	return firstFailure, nil
+}
+
+// startNamed forks the child for a single command and starts its engine.
+// Events from the command and its descendants are tagged with its name.
+func (c *Command) startNamed(cmd *namedCommand, itab *socket.InodeTable, width int) error {
+	prefix := fmt.Sprintf("%-*s | ", width, cmd.name)
+
+	outr, outw, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("stdout pipe: %w", err)
+	}
+	defer outw.Close()
+
+	errr, errw, err := os.Pipe()
+	if err != nil {
+		outr.Close()
+		return fmt.Errorf("stderr pipe: %w", err)
+	}
+	defer errw.Close()
+
+	var jout, jerr io.Writer = io.Discard, io.Discard
+	if c.global.Journal != nil {
+		jout, jerr = c.global.Journal.Stdout, c.global.Journal.Stderr
+	}
+	go copyPrefixed(os.Stdout, jout, outr, prefix)
+	go copyPrefixed(os.Stderr, jerr, errr, prefix)
+
+	env := []string{"_SUBTRACE_CHILD_COMMAND=" + cmd.line}
+	pid, sec, err := c.forkChildWith(env, outw.Fd(), errw.Fd(), &syscall.SysProcAttr{Setpgid: true}, nil)
+	if err != nil {
+		return err
+	}
+	if sec == nil {
+		return fmt.Errorf("child failed to install seccomp filter")
+	}
+
+	g := new(global.Global)
+	*g = *c.global
+	g.Config = c.global.Config.WithTag("process_name", cmd.name)
+
+	root, err := process.New(g, itab, pid)
+	if err != nil {
+		return fmt.Errorf("new process: %w", err)
+	}
+
+	cmd.pid = pid
+	cmd.exited = make(chan struct{})
+	cmd.eng = engine.New(g, sec, itab, root)
+	c.introspect(cmd.eng, itab)
+	go cmd.eng.Start()
+
+	slog.Debug("started command", "name", cmd.name, "pid", pid)
+	return nil
+}
+
+// stopCommands sends sig to each command's process group. Commands named in
+// -shutdown-order are stopped one at a time in that order, each given up to
+// the shutdown grace period to exit, and the rest are signalled together.
+func (c *Command) stopCommands(cmds []*namedCommand, sig syscall.Signal) {
+	byName := make(map[string]*namedCommand)
+	for _, cmd := range cmds {
+		if cmd.pid != 0 {
+			byName[cmd.name] = cmd
+		}
+	}
+
+	for _, name := range strings.Split(c.flags.shutdownOrder, ",") {
+		cmd, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			continue
+		}
+		delete(byName, cmd.name)
+
+		slog.Debug("forwarding signal to command", "name", cmd.name, "signal", sig)
+		unix.Kill(-cmd.pid, sig)
+
+		timer := time.NewTimer(shutdownGracePeriod)
+		select {
+		case <-cmd.exited:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	for _, cmd := range cmds {
+		if _, ok := byName[cmd.name]; ok {
+			slog.Debug("forwarding signal to command", "name", cmd.name, "signal", sig)
+			unix.Kill(-cmd.pid, sig)
+		}
+	}
+}
+
+// copyPrefixed copies lines from r to both w and the journal with the given
+// prefix so that the output of different commands can be told apart.
+func copyPrefixed(w io.Writer, journal io.Writer, r io.ReadCloser, prefix string) {
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			io.WriteString(w, prefix+line)
+			io.WriteString(journal, prefix+line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
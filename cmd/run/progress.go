@@ -0,0 +1,200 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package run
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"subtrace.dev/cmd/run/engine"
+	"subtrace.dev/cmd/run/socket"
+	"subtrace.dev/tracer"
+)
+
+const (
+	// progressDelay is how long shutdown may take before progress is printed
+	// at all so that quick exits stay silent.
+	progressDelay    = 2 * time.Second
+	progressInterval = 5 * time.Second
+)
+
+// shutdownProgress reports what subtrace is still waiting for after the traced
+// command exits: descendant processes that are still running, connections that
+// are draining and events that haven't been published yet. An interrupt during
+// this phase abandons whatever is left.
+type shutdownProgress struct {
+	quiet   bool
+	engines []*engine.Engine
+
+	mu        sync.Mutex
+	phase     string    // empty until the traced command exits
+	deadline  time.Time // zero if the current phase has no time limit
+	abandon   chan struct{}
+	abandoned bool
+	stop      chan struct{}
+}
+
+func newShutdownProgress(quiet bool, engines ...*engine.Engine) *shutdownProgress {
+	return &shutdownProgress{
+		quiet:   quiet,
+		engines: engines,
+		abandon: make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+}
+
+// begin starts printing progress periodically. It must be called once the
+// traced command has exited.
+func (s *shutdownProgress) begin() {
+	s.setPhase("processes", 0)
+	if s.quiet {
+		return
+	}
+
+	go func() {
+		timer := time.NewTimer(progressDelay)
+		defer timer.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-timer.C:
+				fmt.Fprintf(os.Stderr, "subtrace: %s\n", s.status())
+				timer.Reset(progressInterval)
+			}
+		}
+	}()
+}
+
+// end stops printing progress.
+func (s *shutdownProgress) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+}
+
+func (s *shutdownProgress) setPhase(phase string, budget time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase = phase
+	s.deadline = time.Time{}
+	if budget > 0 {
+		s.deadline = time.Now().Add(budget)
+	}
+}
+
+// wait waits for every engine to finish. If the wait is abandoned, the engines
+// are closed without waiting for the remaining processes.
+func (s *shutdownProgress) wait() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, eng := range s.engines {
+			eng.Wait()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-s.abandon:
+	}
+}
+
+// interrupt abandons the rest of the shutdown wait if it's in progress. It
+// returns false if the traced command hasn't exited yet.
+func (s *shutdownProgress) interrupt() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.phase == "" {
+		return false
+	}
+	if s.abandoned {
+		return true
+	}
+	s.abandoned = true
+
+	if !s.quiet {
+		fmt.Fprintf(os.Stderr, "subtrace: interrupted, abandoning %s\n", s.describeLocked(false))
+	}
+	close(s.abandon)
+	return true
+}
+
+func (s *shutdownProgress) status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return "waiting for " + s.describeLocked(true)
+}
+
+func (s *shutdownProgress) describeLocked(withBudget bool) string {
+	var procs []string
+	for _, eng := range s.engines {
+		for _, p := range eng.Status().Processes {
+			if p.Name != "" {
+				procs = append(procs, fmt.Sprintf("%s (pid %d)", p.Name, p.PID))
+			} else {
+				procs = append(procs, fmt.Sprintf("pid %d", p.PID))
+			}
+		}
+	}
+	events := tracer.DefaultPublisher.Pending() + tracer.DefaultManager.Pending()
+	for _, sink := range tracer.Sinks {
+		events += sink.Pending()
+	}
+	return describeShutdown(procs, socket.Running(), events, s.remainingLocked(), withBudget)
+}
+
+func (s *shutdownProgress) remainingLocked() time.Duration {
+	if s.deadline.IsZero() {
+		return -1
+	}
+	return max(0, time.Until(s.deadline))
+}
+
+// describeShutdown formats what's left to wait for. A negative remaining
+// duration means there's no time limit.
+func describeShutdown(procs []string, conns int, events int, remaining time.Duration, withBudget bool) string {
+	var parts []string
+	if len(procs) > 0 {
+		const maxListed = 5
+		list := procs
+		if len(list) > maxListed {
+			list = append(list[:maxListed:maxListed], fmt.Sprintf("%d more", len(procs)-maxListed))
+		}
+		parts = append(parts, fmt.Sprintf("%s still running: %s", plural(len(procs), "process", "processes"), strings.Join(list, ", ")))
+	}
+	if conns > 0 {
+		parts = append(parts, fmt.Sprintf("%s draining", plural(conns, "connection", "connections")))
+	}
+	if events > 0 {
+		parts = append(parts, fmt.Sprintf("%s pending publish", plural(events, "event", "events")))
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "nothing")
+	}
+
+	ret := strings.Join(parts, "; ")
+	if withBudget {
+		if remaining < 0 {
+			ret += " (no time limit, press Ctrl+C to abandon)"
+		} else {
+			ret += fmt.Sprintf(" (%s of grace period left)", remaining.Round(100*time.Millisecond))
+		}
+	}
+	return ret
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, one)
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
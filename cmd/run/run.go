@@ -4,18 +4,23 @@
 package run
 
 import (
+	"cmp"
 	"context"
+	cryptotls "crypto/tls"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime/pprof"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -25,6 +30,10 @@ import (
 	"github.com/peterbourgon/ff/v3"
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"golang.org/x/sys/unix"
+	"subtrace.dev/clock"
+	"subtrace.dev/cmd/run/capability"
+	"subtrace.dev/cmd/run/compat"
+	"subtrace.dev/cmd/run/crash"
 	"subtrace.dev/cmd/run/engine"
 	"subtrace.dev/cmd/run/engine/process"
 	"subtrace.dev/cmd/run/engine/seccomp"
@@ -32,6 +41,7 @@ import (
 	"subtrace.dev/cmd/run/futex"
 	"subtrace.dev/cmd/run/journal"
 	"subtrace.dev/cmd/run/kernel"
+	"subtrace.dev/cmd/run/localproxy"
 	"subtrace.dev/cmd/run/socket"
 	"subtrace.dev/cmd/run/tls"
 	"subtrace.dev/cmd/version"
@@ -39,6 +49,10 @@ import (
 	"subtrace.dev/devtools"
 	"subtrace.dev/global"
 	"subtrace.dev/logging"
+	"subtrace.dev/pcapng"
+	"subtrace.dev/procfs"
+	"subtrace.dev/rpc"
+	"subtrace.dev/span"
 	"subtrace.dev/stats"
 	"subtrace.dev/tracer"
 )
@@ -50,12 +64,79 @@ type Command struct {
 		pprof    string
 		devtools string
 		config   string
+		profile  string
+
+		accountWrites bool
+		traceDNS      bool
+		quiet         bool
+		hostsFile     string
+		tlsReport     string
+		tlsKeyLog     string
+		bandwidthTop  int
+		cacheTop      int
+		debugAddr     string
+		debugTLS      bool
+		debugTLSCert  string
+		debugTLSKey   string
+		debugClientCA string
+		zipkin        string
+		otlp          string
+		otlpProtocol  string
+		capabilities  bool
+		strict        bool
+		assertPassive bool
+		dumpDir       string
+		bypass        string
+		peerAuth      string
+
+		tracelogsFields string
+
+		eventLog      string
+		pcap          string
+		har           string
+		onEvent       string
+		onEventFilter string
+		onEventDryRun bool
+		sinkExec      string
+		spoolDir      string
+		spoolMaxBytes int64
+		sample        float64
+		sampleSeed    string
+
+		procfile      string
+		cmds          commandFlags
+		shutdownOrder string
+
+		attachPID  int
+		noNewPrivs bool
 	}
 
-	global *global.Global
+	global   *global.Global
+	startup  *startup
+	shutdown atomic.Pointer[shutdownProgress]
+
+	// debugServer serves -debug-addr once it's started.
+	debugServer atomic.Pointer[http.Server]
+
+	// child is the traced root process while it's running, which received
+	// signals are forwarded to.
+	child atomic.Pointer[process.Process]
+
+	// inspect is what state dumps look at (see writeStateDump).
+	inspect struct {
+		mu      sync.Mutex
+		engines []*engine.Engine
+		itabs   []*socket.InodeTable
+		dumping atomic.Bool
+	}
 }
 
 func NewCommand() *ffcli.Command {
+	return &newCommand().Command
+}
+
+// newCommand returns the run command. The attach command shares its flags.
+func newCommand() *Command {
 	c := new(Command)
 
 	c.Name = "run"
@@ -65,11 +146,79 @@ func NewCommand() *ffcli.Command {
 	c.FlagSet = flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
 	c.flags.log = c.FlagSet.Bool("log", false, "log trace events to stderr")
 	c.FlagSet.Int64Var(&tracer.PayloadLimitBytes, "payload-limit", 4096, "payload size limit in bytes after which request/response body will be truncated")
+	c.FlagSet.StringVar(&tracer.PayloadMode, "payloads", "always", "which exchanges keep their request/response bodies: always, never, or adaptive (recommended in production) to keep them only for errors, unusually slow requests, incomplete bodies and payloads.keep matches in the config")
+	c.FlagSet.Int64Var(&tracer.PayloadBudgetBytes, "payload-budget", 64<<20, "with -payloads=adaptive, memory limit in bytes for bodies buffered until their exchange finishes")
+	c.FlagSet.IntVar(&tracer.MaxHeaderCount, "max-header-count", 256, "capture at most this many headers of a request or response (and as many trailers) and flag the event if there were more")
+	c.FlagSet.IntVar(&tracer.MaxHeaderBytes, "max-header-bytes", 16<<10, "cut the captured value of a header short so that its name and value fit in this many bytes")
+	c.FlagSet.IntVar(&tracer.MaxHeaderTotalBytes, "max-header-total-bytes", 64<<10, "capture at most this many bytes of header names and values for a request or response")
+	c.FlagSet.IntVar(&tracer.MaxEventBytes, "max-event-size", 1<<20, "cut an event down to this many bytes of HAR entry, tags and log lines, bodies first, then logs, previews, headers and the URL, and list what was cut in its truncations tag (0 for no limit)")
+	c.FlagSet.StringVar(&tracer.BodyPreview, "body-preview", "truncated", "keep a preview of the keys, types and first values of JSON bodies: off, truncated (only when the body is larger than -payload-limit, cut short or redacted), always, or instead (of the body)")
 	c.FlagSet.StringVar(&c.flags.config, "config", "", "configuration file path")
+	c.FlagSet.StringVar(&c.flags.profile, "profile", "", "comma-separated bundled config profiles to merge under -config, which takes precedence: "+strings.Join(config.ProfileNames(), ", "))
 	c.FlagSet.StringVar(&c.flags.devtools, "devtools", "", "path to serve the chrome devtools bundle on")
-	c.FlagSet.BoolVar(&tls.Enabled, "tls", true, "intercept outgoing TLS requests")
+	tls.Enabled = true
+	c.FlagSet.Var(tls.Mode{}, "tls", "intercept outgoing TLS requests: true, false, or dry-run to only report which connections interception would break")
+	c.FlagSet.StringVar(&c.flags.tlsReport, "tls-report", "", "with -tls=dry-run, write the report as JSON to this file at exit")
+	c.FlagSet.StringVar(&c.flags.tlsKeyLog, "tls-keylog", os.Getenv("SSLKEYLOGFILE"), "append the secrets of both sides of intercepted TLS connections to this file in NSS key log format for Wireshark (defaults to $SSLKEYLOGFILE)")
 	c.FlagSet.StringVar(&c.flags.pprof, "pprof", "", "write pprof CPU profile to file")
+	c.FlagSet.StringVar(&c.flags.procfile, "procfile", "", "run the commands in this Procfile together instead of COMMAND")
+	c.FlagSet.Var(&c.flags.cmds, "cmd", "run name=command together with other -cmd commands instead of COMMAND (multiple okay)")
+	c.FlagSet.StringVar(&c.flags.shutdownOrder, "shutdown-order", "", "comma-separated command names to stop one by one before the rest when using -procfile or -cmd")
 	c.FlagSet.BoolVar(&journal.Enabled, "tracelogs", false, "trace stdout and stderr logs")
+	c.FlagSet.BoolVar(&journal.JSON, "tracelogs-json", false, "with -tracelogs, parse log lines that are JSON objects, keep the -tracelogs-fields they have as fields of the line, and append lines that start with whitespace (e.g. stack traces) to the line before them")
+	c.FlagSet.StringVar(&c.flags.tracelogsFields, "tracelogs-fields", "level,msg,trace_id", "comma-separated fields that -tracelogs-json keeps, with dots for nested fields")
+	c.FlagSet.IntVar(&journal.MaxLineBytes, "tracelogs-max-line", 1024, "with -tracelogs, keep at most this many bytes of a log line and discard the rest as it's read")
+	c.FlagSet.StringVar(&tracer.RequestIDHeader, "request-id-header", "X-Request-Id", "with -tracelogs, attach log lines containing this header's value to that request's event instead of concurrent ones (empty to disable)")
+	c.FlagSet.DurationVar(&socket.DialRetryBudget, "dial-retry-budget", 0, "retry outgoing connects that fail with transient errors for up to this long (0 to disable)")
+	c.FlagSet.StringVar(&c.flags.hostsFile, "hosts-file", "", "write the hostnames observed for each external IP to this file in /etc/hosts format at exit")
+	c.FlagSet.IntVar(&c.flags.bandwidthTop, "bandwidth-summary", 0, "print the bytes exchanged with the top N hosts to stderr at exit (0 to disable)")
+	c.FlagSet.IntVar(&c.flags.cacheTop, "cache-summary", 0, "print how effectively the top N hosts used HTTP caching to stderr at exit (0 to disable)")
+	c.FlagSet.BoolVar(&c.flags.accountWrites, "account-writes", false, "account bytes written to sockets with writev, sendmsg and sendmmsg")
+	c.FlagSet.BoolVar(&c.flags.traceDNS, "dns", false, "publish an event for every DNS lookup the tracee makes and link connections to the lookup that resolved their address")
+	c.FlagSet.StringVar(&c.flags.eventLog, "event-log", "", "append every event's tags and HAR entry to this file as a JSON line")
+	c.FlagSet.StringVar(&c.flags.har, "har", "", "write every event as an entry of a HAR file that browsers and HTTP debuggers can import")
+	c.FlagSet.StringVar(&c.flags.pcap, "pcap", "", "write the bytes of every proxied TCP connection to this pcapng file for Wireshark, decrypted for intercepted TLS connections, with the values of redacted headers left out and no payloads where the payload policy denies them")
+	c.FlagSet.StringVar(&c.flags.onEvent, "on-event", "", "shell command to run with the event JSON on stdin for every matching event")
+	c.FlagSet.StringVar(&c.flags.onEventFilter, "on-event-filter", "", "filter expression selecting the events -on-event runs for (all events if unspecified)")
+	c.FlagSet.BoolVar(&c.flags.onEventDryRun, "on-event-dry-run", false, "print what -on-event would run instead of running it")
+	c.FlagSet.Float64Var(&c.flags.sample, "sample", 1, "fraction of connections to parse and publish, decided once per connection by hashing its addresses (the others are still proxied, rewritten and checked against verdicts)")
+	c.FlagSet.StringVar(&c.flags.sampleSeed, "sample-seed", "", "seed hashed with the connection's addresses by -sample, so that tracers with the same seed keep the same connections")
+	c.FlagSet.StringVar(&c.flags.sinkExec, "sink-exec", "", "shell command to run once and stream every event to on stdin as length-prefixed frames, restarted if it exits")
+	c.FlagSet.StringVar(&crash.Dir, "crash-dir", "", "write crash reports to this directory instead of the default temporary directory")
+	c.FlagSet.StringVar(&c.flags.spoolDir, "spool-dir", "", "write events the publisher can't upload in time to this directory, to be uploaded by the next run or subtrace flush-spool, instead of dropping them")
+	c.FlagSet.Int64Var(&c.flags.spoolMaxBytes, "spool-max-bytes", 256<<20, "with -spool-dir, evict the oldest spooled events once they take up more than this many bytes (0 for no limit)")
+	c.FlagSet.StringVar(&c.flags.otlp, "otlp", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "also send events as spans to this OpenTelemetry collector (e.g. http://localhost:4318)")
+	c.FlagSet.StringVar(&c.flags.otlpProtocol, "otlp-protocol", cmp.Or(os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"), span.OTLPProtocolHTTP), "protocol to send spans to -otlp with: http/protobuf or grpc")
+	c.FlagSet.StringVar(&c.flags.zipkin, "zipkin-endpoint", "", "also send events as spans to this Zipkin v2 collector (e.g. http://localhost:9411/api/v2/spans)")
+	c.FlagSet.DurationVar(&socket.ListenStallTimeout, "listen-stall-timeout", 5*time.Second, "stop accepting connections on behalf of a listener whose backlog has gone unaccepted this long, until it accepts again (0 to disable)")
+	c.FlagSet.DurationVar(&socket.ProxyStallTimeout, "proxy-stall-timeout", 30*time.Second, "report proxied connections that have had bytes waiting in both directions without any of them moving for this long, with the occupancy of their socket buffers (0 to disable)")
+	c.FlagSet.DurationVar(&socket.DispatchDialTimeout, "dispatch-dial-timeout", 5*time.Second, "give up handing an accepted connection to a traced listener that hasn't taken it from its backlog after this long")
+	c.FlagSet.BoolVar(&socket.CollapseLoopback, "collapse-loopback", false, "capture loopback connections between traced processes only on the connecting side")
+	c.FlagSet.BoolVar(&socket.StateHistory, "socket-state-history", false, "remember the last 16 state transitions of every socket and include them in /debug/sockets, state dumps and diagnostic events")
+	c.FlagSet.StringVar(&socket.NetnsPolicy, "netns", "follow", "sockets created after a process switches network namespaces: follow (create and dial them from inside its namespace) or passthrough (leave them untraced)")
+	c.FlagSet.DurationVar(&engine.WatchdogThreshold, "watchdog-threshold", 10*time.Second, "report the engine as stalled and dump goroutine stacks to the log if a syscall stays unanswered this long (0 to disable)")
+	c.FlagSet.DurationVar(&engine.WatchdogAbort, "watchdog-abort", 0, "fail syscalls that stay unanswered this long with EINTR so that the traced process unblocks (0 to disable)")
+	c.FlagSet.DurationVar(&clock.Grace, "clock-jump-grace", 10*time.Second, "hold off -watchdog-abort and -listen-stall-timeout for this long after the wall clock jumps, e.g. on resume from suspend")
+	c.FlagSet.IntVar(&socket.ExternalQoS.TOS, "external-tos", -1, "set IP_TOS (IPV6_TCLASS for IPv6) to this value on external connections and listeners, e.g. 0xb8 for DSCP EF (-1 to leave unset)")
+	c.FlagSet.IntVar(&socket.ExternalQoS.Priority, "external-priority", -1, "set SO_PRIORITY to this value on external connections and listeners (-1 to leave unset)")
+	c.FlagSet.IntVar(&socket.ExternalQoS.Mark, "external-mark", -1, "set SO_MARK to this value on external connections and listeners, needs CAP_NET_ADMIN (-1 to leave unset)")
+	c.FlagSet.BoolVar(&socket.MirrorQoS, "mirror-qos", false, "copy IP_TOS, SO_PRIORITY and SO_MARK from the traced process's socket to external connections, taking precedence over -external-*")
+	c.FlagSet.StringVar(&c.flags.peerAuth, "peer-auth", "", "comma-separated listeners that authenticate peers with SO_PEERCRED: unix socket paths that traced clients connect to directly, and TCP addresses (like -bypass) that traced servers listen on without tracing (e.g. /var/run/docker.sock,:5432)")
+	c.FlagSet.StringVar(&c.flags.bypass, "bypass", "", "comma-separated destinations to connect to directly without tracing: addresses, CIDR ranges or the keywords loopback, loopback4 and loopback6, each optionally with a port (e.g. loopback:8125,10.0.0.0/8,[fd00::/8]:53,:6379)")
+	c.FlagSet.BoolVar(&socket.TraceUnix, "unix-sockets", true, "trace AF_UNIX stream sockets (e.g. the Docker API on /var/run/docker.sock) by proxying them like TCP connections")
+	c.FlagSet.BoolVar(&socket.VerifyIntegrity, "verify-integrity", false, "hash the bytes each proxied connection reads from one side and writes to the other and abort if they differ when it closes")
+	c.FlagSet.BoolVar(&process.StrictSockets, "strict-sockets", false, "fail socket(2) for AF_VSOCK and SOCK_SEQPACKET sockets instead of only recording their connections")
+	c.FlagSet.BoolVar(&c.flags.quiet, "quiet", false, "don't print progress while waiting for processes and connections after the command exits")
+	c.FlagSet.StringVar(&c.flags.debugAddr, "debug-addr", "", "serve debug endpoints such as /debug/sockets, /debug/publisher, /debug/bandwidth, /debug/cache, /debug/dispatch, /debug/dump and /capabilities on this address (e.g. localhost:6060)")
+	c.FlagSet.BoolVar(&c.flags.debugTLS, "debug-tls", false, "serve -debug-addr over TLS with a self-signed certificate whose fingerprint is printed at startup")
+	c.FlagSet.StringVar(&c.flags.debugTLSCert, "debug-tls-cert", "", "serve -debug-addr over TLS with this PEM certificate instead of a self-signed one (needs -debug-tls-key)")
+	c.FlagSet.StringVar(&c.flags.debugTLSKey, "debug-tls-key", "", "PEM private key for -debug-tls-cert")
+	c.FlagSet.StringVar(&c.flags.debugClientCA, "debug-client-ca", "", "serve -debug-addr over TLS and require clients to present a certificate signed by a CA in this PEM bundle")
+	c.FlagSet.BoolVar(&c.flags.strict, "strict", false, "use the most faithful implementation of every behavior that differs from running untraced, at the cost of performance, overriding flags that enable faster ones, and print the differences that remain")
+	c.FlagSet.BoolVar(&c.flags.assertPassive, "assert-passive", false, "refuse to start if any feature that changes traffic or process behavior is enabled (e.g. rewrites, -dial-retry-budget, -external-tos)")
+	c.FlagSet.StringVar(&c.flags.dumpDir, "dump-dir", "", "directory to write a tar.gz of the tracer's state to on SIGQUIT (default is the temp dir)")
+	c.FlagSet.IntVar(&logging.RingSize, "log-ring", 0, "keep this many of the most recent debug log lines in memory to include in state dumps, e.g. 2000 (0 to disable)")
+	c.FlagSet.BoolVar(&c.flags.capabilities, "capabilities", false, "print a JSON report of the features, sinks and limits of this run and exit")
 	c.FlagSet.BoolVar(&logging.Verbose, "v", false, "enable verbose debug logging")
 	c.FlagSet.StringVar(&logging.Logfile, "logfile", "", "file for debug logs (stdout if unspecified)")
 	c.UsageFunc = func(fc *ffcli.Command) string {
@@ -78,7 +227,46 @@ func NewCommand() *ffcli.Command {
 
 	c.Options = []ff.Option{ff.WithEnvVarPrefix("SUBTRACE")}
 	c.Exec = c.entrypoint
-	return &c.Command
+	return c
+}
+
+// registerCapabilities registers the features and sinks that depend on the
+// flags of the command being run.
+func (c *Command) registerCapabilities() {
+	capability.RegisterFeature("strict", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: compat.Strict()}
+	})
+
+	// Rewrites come from the config file, which is only known once it's loaded.
+	capability.RegisterFeature("request_rewrites", func() capability.Feature {
+		enabled := c.global != nil && c.global.Config != nil && c.global.Config.HasRewrites()
+		return capability.Feature{Available: true, Enabled: enabled, Intervenes: true}
+	})
+	capability.RegisterFeature("verdict_webhook", func() capability.Feature {
+		enabled := c.global != nil && c.global.Config != nil && c.global.Config.GetVerdicts() != nil
+		return capability.Feature{Available: true, Enabled: enabled, Detail: "HTTP/1 requests only", Intervenes: true}
+	})
+
+	capability.RegisterFeature("publisher_spool", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: c.flags.spoolDir != ""}
+	})
+	capability.RegisterLimit("spool_max_bytes", func() int64 {
+		if c.flags.spoolDir == "" {
+			return 0
+		}
+		return c.flags.spoolMaxBytes
+	})
+
+	capability.RegisterSink("devtools", func() bool { return c.flags.devtools != "" })
+	capability.RegisterSink("log", func() bool { return c.logEnabled() })
+	capability.RegisterSink("on_event", func() bool { return c.flags.onEvent != "" })
+	capability.RegisterSink("sink_exec", func() bool { return c.flags.sinkExec != "" })
+	capability.RegisterSink("event_log", func() bool { return c.flags.eventLog != "" })
+	capability.RegisterSink("har", func() bool { return c.flags.har != "" })
+	capability.RegisterSink("pcap", func() bool { return c.flags.pcap != "" })
+	capability.RegisterSink("zipkin", func() bool { return c.flags.zipkin != "" })
+	capability.RegisterSink("otlp", func() bool { return c.flags.otlp != "" })
+	capability.RegisterSink("routed_sinks", func() bool { return len(tracer.Sinks) > 0 })
 }
 
 func ExtraHelp() string {
@@ -118,8 +306,31 @@ func (c *Command) entrypoint(ctx context.Context, args []string) error {
 	if err := logging.Init(); err != nil {
 		return fmt.Errorf("init logging: %w", err)
 	}
+	if n := os.Getenv("_SUBTRACE_RESPONDER"); n != "" {
+		return entrypointResponder(n)
+	}
+	c.registerCapabilities()
+
+	if c.flags.accountWrites {
+		// Both the parent and the child need this: the child builds the seccomp
+		// filter from the handler table and the parent dispatches notifications.
+		process.EnableWriteAccounting()
+	}
+	if c.flags.traceDNS {
+		// After write accounting, whose sendmsg and sendmmsg handlers observe
+		// queries themselves.
+		process.EnableDNSTracing()
+	}
 
-	if len(args) == 0 {
+	if c.flags.capabilities {
+		// The HTTP/2 and websocket settings come from the environment.
+		if err := socket.Init(); err != nil {
+			return fmt.Errorf("init socket: %w", err)
+		}
+		return c.capabilities().Write(os.Stdout)
+	}
+
+	if len(args) == 0 && !c.isMulti() && !c.attaching() {
 		// Log to stdout so that the usage and help text is greppable (see [1]).
 		// [1] https://news.ycombinator.com/item?id=37682859
 		c.FlagSet.SetOutput(os.Stdout)
@@ -155,6 +366,10 @@ func (c *Command) entrypoint(ctx context.Context, args []string) error {
 
 	default: // child
 		os.Unsetenv("_SUBTRACE_CHILD")
+		if line := os.Getenv("_SUBTRACE_CHILD_COMMAND"); line != "" {
+			os.Unsetenv("_SUBTRACE_CHILD_COMMAND")
+			args = []string{"/bin/sh", "-c", line}
+		}
 		if err := c.entrypointChild(ctx, args); err != nil {
 			fmt.Fprintf(os.Stderr, "child: %v\n", err)
 			os.Exit(1)
@@ -198,29 +413,37 @@ func (c *Command) entrypoint(ctx context.Context, args []string) error {
 func (c *Command) ensureAsyncPreemptionHack() error {
 	orig := os.Getenv("GODEBUG")
 
+	// The runtime goes by the last asyncpreemptoff setting, so that's the one
+	// that decides whether the re-exec can be skipped.
 	var excl []string
+	var setting string
 	for _, kv := range strings.Split(orig, ",") {
 		k, v, _ := strings.Cut(kv, "=")
 		if k != "asyncpreemptoff" {
 			excl = append(excl, kv)
 			continue
 		}
-		if v == "1" {
-			slog.Debug("asyncpreemptoff=1 found", "GODEBUG", os.Getenv("GODEBUG"), "SUBTRACE_ORIG_GODEBUG", os.Getenv("SUBTRACE_ORIG_GODEBUG"))
-			switch prev := os.Getenv("SUBTRACE_ORIG_GODEBUG"); prev {
-			case "<empty>":
-				os.Unsetenv("SUBTRACE_ORIG_GODEBUG")
-				os.Unsetenv("GODEBUG")
-			case "":
-			default:
-				os.Unsetenv("SUBTRACE_ORIG_GODEBUG")
-				os.Setenv("GODEBUG", prev)
-			}
-			return nil
+		setting = v
+	}
+	if setting == "1" {
+		slog.Debug("asyncpreemptoff=1 found", "GODEBUG", os.Getenv("GODEBUG"), "SUBTRACE_ORIG_GODEBUG", os.Getenv("SUBTRACE_ORIG_GODEBUG"))
+		switch prev := os.Getenv("SUBTRACE_ORIG_GODEBUG"); prev {
+		case "<empty>":
+			os.Unsetenv("SUBTRACE_ORIG_GODEBUG")
+			os.Unsetenv("GODEBUG")
+		case "":
+		default:
+			os.Unsetenv("SUBTRACE_ORIG_GODEBUG")
+			os.Setenv("GODEBUG", prev)
 		}
+		return nil
 	}
 
-	slog.Debug("asyncpreemptoff=1 not found, restarting", "GODEBUG", os.Getenv("GODEBUG"))
+	reason := "GODEBUG does not set asyncpreemptoff"
+	if setting != "" {
+		reason = fmt.Sprintf("GODEBUG sets asyncpreemptoff=%s", setting)
+	}
+	slog.Debug("asyncpreemptoff=1 not found, restarting", "GODEBUG", os.Getenv("GODEBUG"), "reason", reason)
 	var environ []string
 	for _, kv := range os.Environ() {
 		switch {
@@ -240,6 +463,8 @@ func (c *Command) ensureAsyncPreemptionHack() error {
 		environ = append(environ, "GODEBUG=asyncpreemptoff=1")
 		environ = append(environ, "SUBTRACE_ORIG_GODEBUG=<empty>")
 	}
+	environ = append(environ, fmt.Sprintf("%s=%d", envStartupBegin, processBegin.UnixNano()))
+	environ = append(environ, envStartupReexec+"="+reason)
 	abspath, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("executable: %w", err)
@@ -264,13 +489,58 @@ const (
 )
 
 func (c *Command) entrypointParent(ctx context.Context, args []string) (int, error) {
-	if len(args) == 0 {
+	defer crash.Recover("run")
+
+	if c.attaching() && (len(args) > 0 || c.isMulti()) {
+		return 0, fmt.Errorf("cannot use COMMAND, -procfile or -cmd with attach")
+	}
+	if c.isMulti() && len(args) > 0 {
+		return 0, fmt.Errorf("cannot use COMMAND with -procfile or -cmd")
+	}
+	if len(args) == 0 && !c.isMulti() && !c.attaching() {
 		return 0, errMissingCommand
 	}
+	if !tracer.ValidBodyPreview(tracer.BodyPreview) {
+		return 0, fmt.Errorf("invalid -body-preview %q: must be off, truncated, always or instead", tracer.BodyPreview)
+	}
+	if !socket.ValidNetnsPolicy(socket.NetnsPolicy) {
+		return 0, fmt.Errorf("invalid -netns %q: must be follow or passthrough", socket.NetnsPolicy)
+	}
+	if !tracer.ValidPayloadMode(tracer.PayloadMode) {
+		return 0, fmt.Errorf("invalid -payloads %q: must be always, never or adaptive", tracer.PayloadMode)
+	}
+	if tracer.PayloadBudgetBytes < 0 {
+		return 0, fmt.Errorf("invalid -payload-budget %d: must not be negative", tracer.PayloadBudgetBytes)
+	}
+	journal.JSONFields = nil
+	for _, f := range strings.Split(c.flags.tracelogsFields, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			journal.JSONFields = append(journal.JSONFields, f)
+		}
+	}
+	if journal.MaxLineBytes <= 0 {
+		return 0, fmt.Errorf("invalid -tracelogs-max-line %d: must be positive", journal.MaxLineBytes)
+	}
+	if tracer.MaxEventBytes < 0 {
+		return 0, fmt.Errorf("invalid -max-event-size %d: must not be negative", tracer.MaxEventBytes)
+	}
+	for _, limit := range []struct {
+		flag string
+		val  int
+	}{
+		{"-max-header-count", tracer.MaxHeaderCount},
+		{"-max-header-bytes", tracer.MaxHeaderBytes},
+		{"-max-header-total-bytes", tracer.MaxHeaderTotalBytes},
+	} {
+		if limit.val <= 0 {
+			return 0, fmt.Errorf("invalid %s %d: must be positive", limit.flag, limit.val)
+		}
+	}
 
 	if err := c.ensureAsyncPreemptionHack(); err != nil {
 		return 0, fmt.Errorf("ensure asyncpreemptoff=1: %w", err)
 	}
+	c.startup = newStartup()
 
 	slog.Debug("starting tracer parent", "pid", os.Getpid())
 
@@ -278,7 +548,32 @@ func (c *Command) entrypointParent(ctx context.Context, args []string) (int, err
 		return 0, fmt.Errorf("check kernel version: %w", err)
 	}
 
+	if degraded := procfs.Init(); len(degraded) > 0 {
+		if !procfs.Has(procfs.FeatureThreads) {
+			return 0, fmt.Errorf("%s is not readable: subtrace needs /proc to track threads", procfs.Path("self/status"))
+		}
+		slog.Warn("/proc is unavailable or restricted, running with degraded features", "degraded", procfs.Describe(degraded))
+	}
+
 	c.global = new(global.Global)
+	// Deferred first so that it runs last: the devtools tabs get every event
+	// that the deferred flushes below publish.
+	defer c.closeServers()
+	c.startup.mark("preflight")
+
+	// The child is forked right away so that its startup and the seccomp
+	// filter installation overlap with loading the config and everything else
+	// below. It holds off running the command until it's started, which it
+	// never is if the parent returns first.
+	var child *heldChild
+	if !c.isMulti() && !c.attaching() {
+		var err error
+		child, err = c.startChild()
+		if err != nil {
+			return 0, fmt.Errorf("start child: %w", err)
+		}
+		defer child.close()
+	}
 
 	if c.flags.pprof != "" {
 		f, err := os.Create(c.flags.pprof)
@@ -294,44 +589,230 @@ func (c *Command) entrypointParent(ctx context.Context, args []string) (int, err
 	}
 
 	c.global.Config = config.New()
+	var profiles []string
+	for _, name := range strings.Split(c.flags.profile, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if err := c.global.Config.AddProfile(name); err != nil {
+				return 1, fmt.Errorf("-profile: %w", err)
+			}
+			profiles = append(profiles, name)
+		}
+	}
 	if c.flags.config != "" {
 		if err := c.global.Config.Load(c.flags.config); err != nil {
 			return 1, fmt.Errorf("load config: %w", err)
 		}
+		for _, p := range c.global.Config.Check(tracer.PayloadLimitBytes) {
+			fmt.Fprintf(os.Stderr, "subtrace: warning: %s: %s\n", c.flags.config, p)
+		}
+	} else if len(profiles) > 0 {
+		if err := c.global.Config.LoadProfiles(); err != nil {
+			return 1, fmt.Errorf("load -profile: %w", err)
+		}
+	}
+	c.applyExternalSockets()
+	c.registerCrashCounts()
+	if err := c.applyBypass(); err != nil {
+		return 1, err
+	}
+	if err := c.applyPeerAuth(); err != nil {
+		return 1, err
+	}
+	if err := c.applySampling(); err != nil {
+		return 1, err
+	}
+	go c.detectLocalProxies()
+	if c.flags.strict {
+		compat.WriteReport(os.Stderr, compat.EnableStrict())
+	}
+
+	if c.flags.onEvent != "" {
+		hook, err := tracer.NewExecHook(c.flags.onEvent, c.flags.onEventFilter, c.flags.onEventDryRun)
+		if err != nil {
+			return 1, fmt.Errorf("init -on-event hook: %w", err)
+		}
+		tracer.DefaultHook = hook
+	}
+
+	if c.flags.eventLog != "" {
+		eventLog, err := tracer.OpenEventLog(c.flags.eventLog)
+		if err != nil {
+			return 1, fmt.Errorf("init -event-log: %w", err)
+		}
+		tracer.DefaultEventLog = eventLog
+		defer eventLog.Close()
+	}
+
+	if c.flags.har != "" {
+		harFile, err := tracer.CreateHARFile(c.flags.har)
+		if err != nil {
+			return 1, fmt.Errorf("init -har: %w", err)
+		}
+		tracer.DefaultHARFile = harFile
+		defer harFile.Close()
+	}
+
+	if c.flags.tlsKeyLog != "" && tls.Enabled {
+		f, err := tls.OpenKeyLog(c.flags.tlsKeyLog)
+		if err != nil {
+			return 1, fmt.Errorf("init -tls-keylog: %w", err)
+		}
+		defer f.Close()
+	}
+
+	if c.flags.pcap != "" {
+		w, err := pcapng.Create(c.flags.pcap)
+		if err != nil {
+			return 1, fmt.Errorf("init -pcap: %w", err)
+		}
+		socket.Pcap = w
+		defer func() {
+			w.WriteNames(socket.Hostnames())
+			if err := w.Close(); err != nil {
+				slog.Error("failed to write pcap", "path", c.flags.pcap, "err", err)
+			}
+		}()
+	}
+
+	if cfgs := c.global.Config.GetSinks(); len(cfgs) > 0 {
+		sinks, err := tracer.OpenSinks(cfgs, c.flags.eventLog)
+		if err != nil {
+			return 1, fmt.Errorf("init sinks: %w", err)
+		}
+		tracer.Sinks = sinks
+		defer func() {
+			for _, sink := range sinks {
+				sink.Close()
+			}
+		}()
 	}
 
 	if err := socket.Init(); err != nil {
 		return 1, fmt.Errorf("init socket: %w", err)
 	}
 
-	if os.Getenv("SUBTRACE_TOKEN") != "" && os.Getenv("SUBTRACE_LINK_ID_OVERRIDE") != "" {
+	if c.flags.assertPassive {
+		if names := c.capabilities().Interventions(); len(names) > 0 {
+			return 1, fmt.Errorf("-assert-passive: features that change traffic or behavior are enabled: %s", strings.Join(names, ", "))
+		}
+	}
+
+	if rpc.Token() != "" && os.Getenv("SUBTRACE_LINK_ID_OVERRIDE") != "" {
 		slog.Debug("SUBTRACE_LINK_ID_OVERRIDE is ignored when SUBTRACE_TOKEN is set")
 	}
 
-	if os.Getenv("SUBTRACE_TOKEN") != "" || c.flags.devtools == "" {
+	// Sinks are flushed after the default publisher, which waits for events
+	// still being finished.
+	for _, sink := range tracer.Sinks {
+		go sink.Loop(ctx)
+		crash.RegisterFlush("sink:"+sink.Name(), sink.FlushQueued)
+		defer func() {
+			if flushed := sink.Flush(time.Second); !flushed {
+				slog.Warn("subtrace might be exiting with unflushed data remaining in buffer", "sink", sink.Name())
+			}
+		}()
+	}
+
+	// The -sink-exec subprocess is flushed after the default publisher too.
+	if c.flags.sinkExec != "" {
+		tracer.DefaultExecSink = tracer.StartExecSink(c.flags.sinkExec)
+		defer func() {
+			if flushed := tracer.DefaultExecSink.Close(5 * time.Second); !flushed {
+				slog.Warn("subtrace might be exiting with events not yet written to -sink-exec")
+			}
+		}()
+	}
+
+	if rpc.Token() != "" || c.flags.devtools == "" {
+		var spool *tracer.Spool
+		if c.flags.spoolDir != "" {
+			s, err := tracer.OpenSpool(c.flags.spoolDir, c.flags.spoolMaxBytes)
+			if err != nil {
+				return 1, fmt.Errorf("open -spool-dir: %w", err)
+			}
+			spool = s
+			tracer.DefaultPublisher.SetSpool(spool)
+		}
+
 		go tracer.DefaultPublisher.Loop(ctx)
+		crash.RegisterFlush("publisher", func(timeout time.Duration) bool {
+			flushed := tracer.DefaultPublisher.FlushQueued(timeout)
+			if spool == nil {
+				return flushed
+			}
+			_, err := tracer.DefaultPublisher.Spill()
+			return err == nil
+		})
 		defer func() {
 			// TODO: should this be a different timeout value? or maybe wait forever
 			// until some kind of forced user cancel (e.g. ctrl+c)? a dumb and simple
 			// one second timeout is a good place to start.
-			if flushed := tracer.DefaultPublisher.Flush(time.Second); !flushed {
-				slog.Warn("subtrace might be exiting with unflushed data remaining in buffer")
+			flushed := tracer.DefaultPublisher.Flush(time.Second)
+			if spool == nil {
+				if !flushed {
+					slog.Warn("subtrace might be exiting with unflushed data remaining in buffer")
+				}
+				return
+			}
+			// Events spooled during the run may still be in memory too.
+			if n, err := tracer.DefaultPublisher.Spill(); err != nil {
+				slog.Warn("subtrace might be exiting with unflushed data remaining in buffer", "err", err)
+			} else if n > 0 {
+				slog.Info("spooled unflushed events, they'll be uploaded by the next run or subtrace flush-spool", "dir", spool.Dir(), "events", n)
+			}
+		}()
+	}
+
+	if c.flags.zipkin != "" {
+		zipkin := span.NewZipkinExporter(c.flags.zipkin)
+		tracer.SpanExporters = append(tracer.SpanExporters, zipkin)
+		go zipkin.Loop(ctx)
+		defer func() {
+			if flushed := zipkin.Flush(5 * time.Second); !flushed {
+				slog.Warn("subtrace might be exiting with spans not yet sent to zipkin")
+			}
+		}()
+	}
+
+	if c.flags.otlp != "" {
+		headers, err := span.ParseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+		if err != nil {
+			return 1, fmt.Errorf("init -otlp: OTEL_EXPORTER_OTLP_HEADERS: %w", err)
+		}
+		otlp, err := span.NewOTLPExporter(c.flags.otlp, c.flags.otlpProtocol, headers)
+		if err != nil {
+			return 1, fmt.Errorf("init -otlp: %w", err)
+		}
+		tracer.SpanExporters = append(tracer.SpanExporters, otlp)
+		go otlp.Loop(ctx)
+		defer func() {
+			if flushed := otlp.Flush(5 * time.Second); !flushed {
+				slog.Warn("subtrace might be exiting with spans not yet sent to the OTLP collector")
 			}
 		}()
 	}
 
 	go stats.Loop(ctx)
+	go clock.Loop(ctx)
+
+	if c.flags.debugAddr != "" {
+		tlsConfig, err := c.debugTLSConfig()
+		if err != nil {
+			return 1, fmt.Errorf("debug endpoints: %w", err)
+		}
+		go c.serveDebug(tlsConfig)
+	}
 
 	go c.watchSignals()
 
 	if c.flags.log == nil {
 		c.flags.log = new(bool)
-		if os.Getenv("SUBTRACE_TOKEN") == "" {
+		if rpc.Token() == "" {
 			*c.flags.log = true
 		} else {
 			*c.flags.log = false
 		}
-	} else if *c.flags.log == false && os.Getenv("SUBTRACE_TOKEN") == "" {
+	} else if *c.flags.log == false && rpc.Token() == "" {
 		exists := false
 		for _, arg := range os.Args {
 			if strings.Contains(arg, "-log") {
@@ -357,26 +838,24 @@ func (c *Command) entrypointParent(ctx context.Context, args []string) (int, err
 		}
 	}()
 
-	if tls.Enabled {
-		if err := tls.GenerateEphemeralCA(); err != nil {
-			return 0, fmt.Errorf("create ephemeral TLS CA: %w", err)
-		}
+	if c.isMulti() {
+		return c.runMulti()
+	}
+	if c.attaching() {
+		return c.runAttach()
 	}
+	c.startup.mark("config")
 
-	pid, sec, err := c.forkChild()
+	pid, sec, err := child.wait()
 	if errors.Is(err, errMissingSysPtrace) {
-		fmt.Fprintf(os.Stderr, "error: subtrace: missing SYS_PTRACE capability\n")
-		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "If you're using Docker, please add the --cap-add=SYS_PTRACE flag to\n")
-		fmt.Fprintf(os.Stderr, "your `docker run` command when you start the container to fix this.\n")
-		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "See https://docs.subtrace.dev/ptrace for more details.\n")
+		printMissingSysPtrace()
 		return 1, nil
 	} else if err != nil {
 		return 0, fmt.Errorf("exec child: %w", err)
 	} else if sec == nil {
 		return 127, nil
 	}
+	c.startup.mark("child")
 
 	if c.flags.devtools != "" && !strings.HasPrefix(c.flags.devtools, "/") {
 		c.flags.devtools = "/" + c.flags.devtools
@@ -391,7 +870,16 @@ func (c *Command) entrypointParent(ctx context.Context, args []string) (int, err
 	}
 
 	eng := engine.New(c.global, sec, itab, root)
+	c.introspect(eng, itab)
 	go eng.Start()
+	if err := child.start(); err != nil {
+		return 0, fmt.Errorf("start child: %w", err)
+	}
+	c.child.Store(root)
+	c.startup.finish("engine")
+
+	progress := newShutdownProgress(c.flags.quiet, eng)
+	c.shutdown.Store(progress)
 
 	log.SetLevel(log.Silent)
 
@@ -399,51 +887,401 @@ func (c *Command) entrypointParent(ctx context.Context, args []string) (int, err
 	if _, err := unix.Wait4(pid, &status, 0, nil); err != nil {
 		return 0, fmt.Errorf("wait4: %w", err)
 	}
-	slog.Debug("root process exited", "status", status.ExitStatus())
+	c.child.Store(nil)
+	slog.Debug("root process exited", "status", exitCode(status))
+
+	// Shut down in order so that no event is produced after the sinks are
+	// flushed: (1) wait for every descendant to exit so that no new seccomp
+	// notifications can arrive, (2) close the engine, (3) let in-flight proxies
+	// finish their requests so that their parsers hand off the final events,
+	// and only then (4) flush the manager and publisher in the deferred calls
+	// above. Progress is printed while waiting in case either step takes long.
+	progress.begin()
+	defer progress.end()
 
-	eng.Wait()
+	progress.wait()
 
 	if err := eng.Close(); err != nil {
 		slog.Debug("failed to close engine cleanly", "err", err) // not fatal
 	}
-	return status.ExitStatus(), nil
+
+	progress.setPhase("connections", shutdownGracePeriod)
+	if abandoned := socket.Drain(shutdownGracePeriod, progress.abandon); abandoned > 0 {
+		slog.Debug("closed proxies still running after shutdown grace period", "count", abandoned)
+	}
+	c.writeHostsFile()
+	c.writeTLSReport()
+	c.printBandwidthSummary()
+	c.printCacheSummary()
+	return exitCode(status), nil
+}
+
+// debugTLSConfig returns the TLS config for -debug-addr, or nil if it's served
+// over plaintext HTTP.
+func (c *Command) debugTLSConfig() (*cryptotls.Config, error) {
+	if !c.flags.debugTLS && c.flags.debugTLSCert == "" && c.flags.debugTLSKey == "" && c.flags.debugClientCA == "" {
+		return nil, nil
+	}
+	cfg, fingerprint, err := tls.NewServerConfig(tls.ListenerConfig{
+		CertFile:     c.flags.debugTLSCert,
+		KeyFile:      c.flags.debugTLSKey,
+		ClientCAFile: c.flags.debugClientCA,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "subtrace: serving debug endpoints on https://%s with certificate %s\n", c.flags.debugAddr, fingerprint)
+	return cfg, nil
+}
+
+// serveDebug serves debug endpoints on -debug-addr. The tracer itself isn't
+// traced, so requests to it never show up as events.
+func (c *Command) serveDebug(tlsConfig *cryptotls.Config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/sockets", socket.ServeDebugSockets)
+	mux.HandleFunc("/debug/publisher", tracer.ServeDebugPublisher)
+	mux.HandleFunc("/debug/bandwidth", socket.ServeDebugBandwidth)
+	mux.HandleFunc("/debug/cache", tracer.ServeDebugCache)
+	mux.HandleFunc("/debug/dispatch", socket.ServeDebugDispatch)
+	mux.HandleFunc("/debug/sampling", socket.ServeDebugSampling)
+	mux.HandleFunc("/debug/parser", socket.ServeDebugParser)
+	mux.HandleFunc("/debug/rules", c.serveDebugRules)
+	mux.HandleFunc("/debug/startup", c.serveDebugStartup)
+	mux.HandleFunc("/debug/dump", c.serveDebugDump)
+	mux.HandleFunc("/capabilities", capability.Handler(c.capabilities))
+
+	srv := &http.Server{Addr: c.flags.debugAddr, Handler: mux, TLSConfig: tlsConfig}
+	c.debugServer.Store(srv)
+	var err error
+	if tlsConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("failed to serve debug endpoints", "addr", c.flags.debugAddr, "err", err)
+	}
+}
+
+// closeServers shuts down the devtools and debug servers at exit, after the
+// sinks are flushed.
+func (c *Command) closeServers() {
+	if c.global.Devtools != nil {
+		c.global.Devtools.Close()
+	}
+	if srv := c.debugServer.Load(); srv != nil {
+		srv.Close()
+	}
+}
+
+// serveDebugRules serves how many events each config rule matched and dropped
+// as JSON.
+func (c *Command) serveDebugRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.global.Config.RuleMetrics()); err != nil {
+		slog.Debug("failed to write debug rules response", "err", err) // not fatal
+	}
+}
+
+// capabilities returns the capability report of the run.
+func (c *Command) capabilities() capability.Report {
+	r := capability.Collect()
+	r.Version = version.GetCanonicalString()
+	r.Engine = "seccomp_unotify"
+	if release, err := kernel.Release(); err == nil {
+		r.Kernel.Release = release
+	}
+	_, _, err := kernel.CheckVersion(minKernelVersion, false)
+	r.Kernel.Supported = err == nil
+	return r
+}
+
+// logEnabled reports whether events are logged to stderr. Without -log, they
+// are unless SUBTRACE_TOKEN is set.
+func (c *Command) logEnabled() bool {
+	if c.flags.log != nil {
+		return *c.flags.log
+	}
+	return rpc.Token() == ""
+}
+
+// applyExternalSockets fills in the external socket options that weren't set
+// with flags from the config file.
+func (c *Command) applyExternalSockets() {
+	cfg := c.global.Config.GetExternalSockets()
+	def := socket.NoQoS
+	if cfg.TOS != nil {
+		def.TOS = *cfg.TOS
+	}
+	if cfg.Priority != nil {
+		def.Priority = *cfg.Priority
+	}
+	if cfg.Mark != nil {
+		def.Mark = *cfg.Mark
+	}
+	socket.ExternalQoS = socket.ExternalQoS.Or(def)
+	socket.MirrorQoS = socket.MirrorQoS || cfg.MirrorProcess
+}
+
+// detectLocalProxies looks for proxies on this host that the traced
+// command's traffic may go through and warns about what they mean for its
+// events. Reading iptables can take a while, so it runs in the background.
+func (c *Command) detectLocalProxies() {
+	report := localproxy.Detect(os.Environ())
+	for _, p := range report.Proxies {
+		socket.AddLocalProxy(p.Addr)
+	}
+	for _, w := range report.Warnings() {
+		fmt.Fprintf(os.Stderr, "subtrace: warning: %s\n", w)
+	}
 }
 
+// applyBypass sets the destinations that aren't traced from -bypass and the
+// config file.
+func (c *Command) applyBypass() error {
+	var rules []config.BypassRule
+	if c.flags.bypass != "" {
+		for _, entry := range strings.Split(c.flags.bypass, ",") {
+			r, err := config.ParseBypassRule(entry)
+			if err != nil {
+				return fmt.Errorf("invalid -bypass: %w", err)
+			}
+			rules = append(rules, r)
+		}
+	}
+	socket.Bypass = append(rules, c.global.Config.GetBypass()...)
+	if len(socket.Bypass) > 0 {
+		slog.Debug("bypassing destinations", "rules", fmt.Sprint(socket.Bypass))
+	}
+	return nil
+}
+
+// applyPeerAuth sets the listeners that authenticate their peers from
+// -peer-auth and the config file.
+func (c *Command) applyPeerAuth() error {
+	var pa config.PeerAuth
+	if c.flags.peerAuth != "" {
+		for _, entry := range strings.Split(c.flags.peerAuth, ",") {
+			if !strings.HasPrefix(entry, "/") && !strings.HasPrefix(entry, "@") && strings.ContainsRune(entry, '/') {
+				entry, _ = filepath.Abs(entry) // a relative path
+			}
+			if err := pa.Parse(entry); err != nil {
+				return fmt.Errorf("invalid -peer-auth: %w", err)
+			}
+		}
+	}
+	cfg := c.global.Config.GetPeerAuth()
+	for _, path := range append(pa.Paths, cfg.Paths...) {
+		socket.AddPeerAuthPath(path)
+	}
+	socket.PeerAuthListeners = append(pa.Listeners, cfg.Listeners...)
+	return nil
+}
+
+// applySampling sets the sampling rate and seed from the flags or, for the
+// ones not given, the config.
+func (c *Command) applySampling() error {
+	cfg := c.global.Config.GetSampling()
+	rate, seed := 1.0, cfg.Seed
+	if cfg.Rate != nil {
+		rate = *cfg.Rate
+	}
+	c.FlagSet.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "sample":
+			rate = c.flags.sample
+		case "sample-seed":
+			seed = c.flags.sampleSeed
+		}
+	})
+	if !(rate >= 0 && rate <= 1) {
+		return fmt.Errorf("invalid -sample %v: want a fraction in [0, 1]", rate)
+	}
+	socket.SampleRate, socket.SampleSeed = rate, seed
+	if rate < 1 {
+		slog.Debug("sampling connections", "rate", rate)
+	}
+	return nil
+}
+
+func (c *Command) writeHostsFile() {
+	if c.flags.hostsFile == "" {
+		return
+	}
+	if err := socket.WriteHostsFile(c.flags.hostsFile); err != nil {
+		slog.Error("failed to write hosts file", "path", c.flags.hostsFile, "err", err)
+	}
+}
+
+func (c *Command) writeTLSReport() {
+	if !tls.DryRun {
+		return
+	}
+	if err := tls.WriteDryRunReport(os.Stderr); err != nil {
+		slog.Error("failed to print TLS dry run report", "err", err)
+	}
+	if c.flags.tlsReport == "" {
+		return
+	}
+	if err := tls.WriteDryRunReportJSON(c.flags.tlsReport); err != nil {
+		slog.Error("failed to write TLS dry run report", "path", c.flags.tlsReport, "err", err)
+	}
+}
+
+func (c *Command) printBandwidthSummary() {
+	if c.flags.bandwidthTop <= 0 {
+		return
+	}
+	if err := socket.WriteBandwidthSummary(os.Stderr, c.flags.bandwidthTop); err != nil {
+		slog.Debug("failed to write bandwidth summary", "err", err) // not fatal
+	}
+}
+
+func (c *Command) printCacheSummary() {
+	if c.flags.cacheTop <= 0 {
+		return
+	}
+	if err := tracer.WriteCacheSummary(os.Stderr, c.flags.cacheTop); err != nil {
+		slog.Debug("failed to write cache summary", "err", err) // not fatal
+	}
+}
+
+// shutdownGracePeriod is how long in-flight proxies are given to finish after
+// all traced processes exit.
+const shutdownGracePeriod = 5 * time.Second
+
+// forwardedSignals are passed on to the traced command so that `docker stop`,
+// reloads and the like reach it instead of subtrace. SIGQUIT isn't: it dumps
+// subtrace's state.
+var forwardedSignals = []os.Signal{unix.SIGINT, unix.SIGTERM, unix.SIGHUP, unix.SIGUSR1, unix.SIGUSR2}
+
 func (c *Command) watchSignals() {
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, unix.SIGINT, unix.SIGTERM, unix.SIGQUIT)
+	signal.Notify(ch, append(forwardedSignals, unix.SIGQUIT)...)
 	for code := range ch {
 		slog.Debug("tracer received signal", "code", code.String())
+		if code == unix.SIGQUIT {
+			go c.dumpStateFile("SIGQUIT")
+			continue
+		}
+		if code == unix.SIGINT || code == unix.SIGTERM {
+			if s := c.shutdown.Load(); s != nil && s.interrupt() {
+				continue // the traced command already exited
+			}
+		}
+		c.forwardSignal(code.(unix.Signal))
 	}
 }
 
-var errMissingSysPtrace = fmt.Errorf("missing SYS_PTRACE")
+// forwardSignal sends sig to the traced command if it's running. It goes
+// through the command's pidfd, so a signal that races with the command's exit
+// is dropped rather than sent to whatever reused its pid. A SIGINT isn't
+// forwarded while subtrace is in the foreground of its terminal: the command
+// shares subtrace's process group, so a Ctrl-C already reached it and a second
+// SIGINT would make many programs skip their graceful shutdown.
+func (c *Command) forwardSignal(sig unix.Signal) {
+	child := c.child.Load()
+	if child == nil {
+		return
+	}
+	if sig == unix.SIGINT && inForeground() {
+		slog.Debug("not forwarding signal from the terminal", "signal", sig.String(), "pid", child.PID)
+		return
+	}
+	if err := child.Signal(sig); err != nil && !errors.Is(err, unix.ESRCH) {
+		slog.Warn("failed to forward signal to traced command", "signal", sig.String(), "pid", child.PID, "err", err)
+		return
+	}
+	slog.Debug("forwarded signal to traced command", "signal", sig.String(), "pid", child.PID)
+}
 
-// forkChild forks and re-executes the subtrace binary to run in child mode. It
-// returns the child PID and the installed seccomp_unotify listener.
-func (c *Command) forkChild() (pid int, sec *seccomp.Listener, err error) {
-	memfd, err := unix.MemfdCreate("subtrace_seccomp_sync", unix.MFD_CLOEXEC)
+// inForeground reports whether subtrace is in the foreground process group of
+// its controlling terminal, which is where the terminal sends Ctrl-C.
+func inForeground() bool {
+	tty, err := os.Open("/dev/tty")
 	if err != nil {
-		return 0, nil, fmt.Errorf("memfd_create: %w", err)
+		return false
 	}
-	defer unix.Close(memfd)
+	defer tty.Close()
+	pgrp, err := unix.IoctlGetInt(int(tty.Fd()), unix.TIOCGPGRP)
+	return err == nil && pgrp == unix.Getpgrp()
+}
 
-	if err := unix.Ftruncate(memfd, 4); err != nil {
-		return 0, nil, fmt.Errorf("ftruncate: %w", err)
+// exitCode returns the exit code subtrace exits with for a traced command's
+// wait status: the command's own, or 128+n like a shell if it was killed by
+// signal n.
+func exitCode(status unix.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
 	}
+	return status.ExitStatus()
+}
 
-	addr, _, errno := unix.Syscall6(unix.SYS_MMAP, 0, 4, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED, uintptr(memfd), 0)
-	if errno != 0 {
-		return 0, nil, fmt.Errorf("mmap: %w", errno)
-	}
-	defer unix.Syscall6(unix.SYS_MUNMAP, addr, 4, 0, 0, 0, 0)
-	*(*uint32)(unsafe.Pointer(addr)) = 0
+var errMissingSysPtrace = fmt.Errorf("missing SYS_PTRACE")
 
-	self, err := os.Executable()
+func printMissingSysPtrace() {
+	fmt.Fprintf(os.Stderr, "error: subtrace: missing SYS_PTRACE capability\n")
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "If you're using Docker, please add the --cap-add=SYS_PTRACE flag to\n")
+	fmt.Fprintf(os.Stderr, "your `docker run` command when you start the container to fix this.\n")
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "See https://docs.subtrace.dev/ptrace for more details.\n")
+}
+
+// heldChild is a child forked ahead of the time it's needed that holds off
+// running the command until it's started.
+type heldChild struct {
+	done    chan struct{}
+	pid     int
+	sec     *seccomp.Listener
+	err     error
+	release *os.File // closing it without a write makes the child exit
+}
+
+// startChild forks the child in the background. The child waits for the
+// release pipe after installing its seccomp filter.
+func (c *Command) startChild() (*heldChild, error) {
+	r, w, err := os.Pipe()
 	if err != nil {
-		return 0, nil, fmt.Errorf("get executable: %w", err)
+		return nil, fmt.Errorf("pipe: %w", err)
+	}
+
+	h := &heldChild{done: make(chan struct{}), release: w}
+	go func() {
+		defer close(h.done)
+		defer r.Close()
+		h.pid, h.sec, h.err = c.forkChild(r)
+	}()
+	return h, nil
+}
+
+// wait waits until the child has installed its seccomp filter and returns
+// what forkChild returned.
+func (h *heldChild) wait() (int, *seccomp.Listener, error) {
+	<-h.done
+	return h.pid, h.sec, h.err
+}
+
+// start lets the child run the command.
+func (h *heldChild) start() error {
+	defer h.close()
+	if _, err := h.release.Write([]byte{1}); err != nil {
+		return fmt.Errorf("release: %w", err)
+	}
+	return nil
+}
+
+func (h *heldChild) close() {
+	if h.release != nil {
+		h.release.Close()
+		h.release = nil
 	}
+}
 
+// forkChild forks and re-executes the subtrace binary to run in child mode. It
+// returns the child PID and the installed seccomp_unotify listener. If hold
+// isn't nil, the child doesn't run the command until it reads a byte from it.
+func (c *Command) forkChild(hold *os.File) (pid int, sec *seccomp.Listener, err error) {
 	outfd := uintptr(1)
 	errfd := uintptr(2)
 
@@ -463,22 +1301,144 @@ func (c *Command) forkChild() (pid int, sec *seccomp.Listener, err error) {
 		outfd = sout.Fd()
 		errfd = serr.Fd()
 
-		go func() {
-			for {
-				io.Copy(io.MultiWriter(os.Stdout, c.global.Journal.Stdout), mout)
-			}
-		}()
+		if tty := terminalFd(); tty >= 0 {
+			c.attachPTYs(tty, sout, serr)
+		}
 
-		go func() {
-			for {
-				io.Copy(io.MultiWriter(os.Stderr, c.global.Journal.Stderr), merr)
+		go copyPTY(io.MultiWriter(os.Stdout, c.global.Journal.Stdout), mout)
+		go copyPTY(io.MultiWriter(os.Stderr, c.global.Journal.Stderr), merr)
+	}
+
+	return c.forkChildWith(nil, outfd, errfd, nil, hold)
+}
+
+// copyPTY copies everything the child writes to the PTY to w. Write errors
+// (e.g. our stdout was closed) don't stop the copy because the child would
+// block once the PTY buffer fills up, but a read error means the PTY is gone
+// and returning is the only way to avoid spinning on it.
+func copyPTY(w io.Writer, master *os.File) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := master.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+		}
+		if err != nil {
+			slog.Debug("stopped copying pty output", "pty", master.Name(), "err", err)
+			return
+		}
+	}
+}
+
+// terminalFd returns the first of subtrace's stdout, stderr and stdin that's a
+// terminal, or -1 if none is.
+func terminalFd() int {
+	for _, fd := range []int{1, 2, 0} {
+		if _, err := unix.IoctlGetTermios(fd, unix.TCGETS); err == nil {
+			return fd
+		}
+	}
+	return -1
+}
+
+// attachPTYs makes the PTYs that -tracelogs puts between the child and the
+// terminal behave like the terminal: they get its window size now and
+// whenever it's resized, and pass output through untouched when stdin is the
+// terminal too, since the terminal then does the output processing. Input
+// doesn't go through the PTYs, so Ctrl-C and Ctrl-Z still reach the child
+// from the terminal.
+func (c *Command) attachPTYs(tty int, ptys ...*os.File) {
+	if _, err := unix.IoctlGetTermios(0, unix.TCGETS); err == nil {
+		for _, pty := range ptys {
+			if err := makeRaw(pty); err != nil {
+				slog.Debug("failed to put pty in raw mode", "pty", pty.Name(), "err", err)
 			}
-		}()
+		}
+	}
+	copyWinsize(tty, ptys)
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, unix.SIGWINCH)
+	go func() {
+		for range ch {
+			copyWinsize(tty, ptys)
+
+			// The terminal signals its foreground process group, which the
+			// child is usually in, but it may have asked for the window size
+			// before it was copied, so it's told again.
+			c.forwardSignal(unix.SIGWINCH)
+		}
+	}()
+}
+
+// copyWinsize sets the window size of the PTYs to that of the terminal.
+func copyWinsize(tty int, ptys []*os.File) {
+	ws, err := unix.IoctlGetWinsize(tty, unix.TIOCGWINSZ)
+	if err != nil {
+		slog.Debug("failed to get terminal window size", "fd", tty, "err", err)
+		return
+	}
+	for _, pty := range ptys {
+		if err := unix.IoctlSetWinsize(int(pty.Fd()), unix.TIOCSWINSZ, ws); err != nil {
+			slog.Debug("failed to set pty window size", "pty", pty.Name(), "err", err)
+		}
+	}
+}
+
+// makeRaw puts the PTY in raw mode like cfmakeraw(3).
+func makeRaw(pty *os.File) error {
+	t, err := unix.IoctlGetTermios(int(pty.Fd()), unix.TCGETS)
+	if err != nil {
+		return fmt.Errorf("get termios: %w", err)
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8
+	t.Cc[unix.VMIN], t.Cc[unix.VTIME] = 1, 0
+	if err := unix.IoctlSetTermios(int(pty.Fd()), unix.TCSETS, t); err != nil {
+		return fmt.Errorf("set termios: %w", err)
+	}
+	return nil
+}
+
+// forkChildWith is like forkChild but lets the caller choose the child's extra
+// environment variables, stdout, stderr and process attributes.
+func (c *Command) forkChildWith(env []string, outfd, errfd uintptr, sys *syscall.SysProcAttr, hold *os.File) (pid int, sec *seccomp.Listener, err error) {
+	memfd, err := unix.MemfdCreate("subtrace_seccomp_sync", unix.MFD_CLOEXEC)
+	if err != nil {
+		return 0, nil, fmt.Errorf("memfd_create: %w", err)
+	}
+	defer unix.Close(memfd)
+
+	if err := unix.Ftruncate(memfd, 4); err != nil {
+		return 0, nil, fmt.Errorf("ftruncate: %w", err)
+	}
+
+	addr, _, errno := unix.Syscall6(unix.SYS_MMAP, 0, 4, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED, uintptr(memfd), 0)
+	if errno != 0 {
+		return 0, nil, fmt.Errorf("mmap: %w", errno)
+	}
+	defer unix.Syscall6(unix.SYS_MUNMAP, addr, 4, 0, 0, 0, 0)
+	*(*uint32)(unsafe.Pointer(addr)) = 0
+
+	self, err := os.Executable()
+	if err != nil {
+		return 0, nil, fmt.Errorf("get executable: %w", err)
+	}
+
+	files := []uintptr{0, outfd, errfd, uintptr(memfd)}
+	env = append(append(os.Environ(), "_SUBTRACE_CHILD=true"), env...)
+	if hold != nil {
+		files = append(files, hold.Fd())
+		env = append(env, "_SUBTRACE_CHILD_HOLD=4")
 	}
 
 	pid, err = syscall.ForkExec(self, os.Args, &syscall.ProcAttr{
-		Env:   append(os.Environ(), "_SUBTRACE_CHILD=true"),
-		Files: []uintptr{0, outfd, errfd, uintptr(memfd)},
+		Env:   env,
+		Files: files,
+		Sys:   sys,
 	})
 	if err != nil {
 		return 0, nil, fmt.Errorf("fork and exec: %w", err)
@@ -517,6 +1477,9 @@ func (c *Command) forkChild() (pid int, sec *seccomp.Listener, err error) {
 }
 
 func (c *Command) entrypointChild(ctx context.Context, args []string) error {
+	hold := os.Getenv("_SUBTRACE_CHILD_HOLD") != ""
+	os.Unsetenv("_SUBTRACE_CHILD_HOLD")
+
 	addr, _, errno := unix.Syscall6(unix.SYS_MMAP, 0, 4, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED, uintptr(3), 0)
 	if errno != 0 {
 		return fmt.Errorf("mmap shared uint32: %w", errno)
@@ -536,14 +1499,7 @@ func (c *Command) entrypointChild(ctx context.Context, args []string) error {
 		environ = append(environ, tls.Environ()...)
 	}
 
-	var syscalls []int
-	for nr, handler := range process.Handlers {
-		if handler != nil {
-			syscalls = append(syscalls, nr)
-		}
-	}
-
-	fd, err := seccomp.InstallFilter(syscalls)
+	fd, err := seccomp.InstallFilter(filteredSyscalls())
 	if err != nil {
 		atomic.StoreUint32((*uint32)(unsafe.Pointer(addr)), ^uint32(0))
 		futex.Wake(unsafe.Pointer(addr), 1)
@@ -559,6 +1515,18 @@ func (c *Command) entrypointChild(ctx context.Context, args []string) error {
 	unix.Close(3)
 	unix.Close(fd)
 
+	if hold {
+		// The parent writes a byte once it's ready to trace the command and
+		// closes the pipe without one if it fails to start.
+		var b [1]byte
+		n, err := unix.Read(4, b[:])
+		unix.Close(4)
+		if n != 1 {
+			slog.Debug("child: parent did not start the command", "err", err)
+			os.Exit(1)
+		}
+	}
+
 	slog.Debug("child: calling execve", "argv0", args[0], "abspath", abspath)
 	if err := unix.Exec(abspath, args, environ); err != nil {
 		return fmt.Errorf("execve: %w", err)
@@ -566,6 +1534,18 @@ func (c *Command) entrypointChild(ctx context.Context, args []string) error {
 	panic("unreachable")
 }
 
+// filteredSyscalls returns the syscalls the seccomp filter notifies the
+// engine of: those with a handler.
+func filteredSyscalls() []int {
+	var syscalls []int
+	for nr, handler := range process.Handlers {
+		if handler != nil {
+			syscalls = append(syscalls, nr)
+		}
+	}
+	return syscalls
+}
+
 func createPTY() (master, slave *os.File, err error) {
 	master, err = os.Open("/dev/ptmx")
 	if err != nil {
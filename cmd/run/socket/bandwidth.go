@@ -0,0 +1,250 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+
+	"subtrace.dev/internal/units"
+)
+
+const (
+	// maxBandwidthHosts bounds the number of hosts tracked individually. Bytes
+	// exchanged with hosts seen after that are attributed to OtherHost.
+	maxBandwidthHosts = 1024
+
+	// OtherHost is the host that bytes are attributed to when a host isn't
+	// tracked individually.
+	OtherHost = "other"
+)
+
+// HostBandwidth is the number of bytes exchanged with a remote host. Ingress
+// and Egress are counted on the wire, from the tracee's point of view. For
+// intercepted TLS connections, the TLS fields hold the part of those bytes
+// that was TLS records and handshakes rather than application payload, so
+// Egress-TLSEgress is what the application itself sent.
+//
+// For outgoing connections, Host is the logical destination (see
+// proxy.destination), so a service reached over both IPv4 and IPv6 is one
+// entry. IPv4 and IPv6 split the connections and bytes by address family.
+type HostBandwidth struct {
+	Host        string          `json:"host"`
+	Connections uint64          `json:"connections"`
+	Ingress     uint64          `json:"ingress"`
+	Egress      uint64          `json:"egress"`
+	TLSIngress  uint64          `json:"tlsIngress,omitempty"`
+	TLSEgress   uint64          `json:"tlsEgress,omitempty"`
+	IPv4        FamilyBandwidth `json:"ipv4"`
+	IPv6        FamilyBandwidth `json:"ipv6"`
+}
+
+// FamilyBandwidth is the part of a HostBandwidth exchanged over one address
+// family.
+type FamilyBandwidth struct {
+	Connections uint64 `json:"connections"`
+	Ingress     uint64 `json:"ingress"`
+	Egress      uint64 `json:"egress"`
+}
+
+func (b *FamilyBandwidth) add(o FamilyBandwidth) {
+	b.Connections += o.Connections
+	b.Ingress += o.Ingress
+	b.Egress += o.Egress
+}
+
+func (b *HostBandwidth) add(o HostBandwidth) {
+	b.Connections += o.Connections
+	b.Ingress += o.Ingress
+	b.Egress += o.Egress
+	b.TLSIngress += o.TLSIngress
+	b.TLSEgress += o.TLSEgress
+	b.IPv4.add(o.IPv4)
+	b.IPv6.add(o.IPv6)
+}
+
+// Total returns the number of bytes exchanged in both directions.
+func (b HostBandwidth) Total() uint64 {
+	return b.Ingress + b.Egress
+}
+
+// IPv6Share returns the fraction of the bytes exchanged over IPv6, or of the
+// connections if no bytes were exchanged yet.
+func (b HostBandwidth) IPv6Share() float64 {
+	if total := b.IPv4.Ingress + b.IPv4.Egress + b.IPv6.Ingress + b.IPv6.Egress; total > 0 {
+		return float64(b.IPv6.Ingress+b.IPv6.Egress) / float64(total)
+	}
+	if total := b.IPv4.Connections + b.IPv6.Connections; total > 0 {
+		return float64(b.IPv6.Connections) / float64(total)
+	}
+	return 0
+}
+
+// bandwidth holds the bytes exchanged by proxies that have finished. Running
+// proxies are added on top in Bandwidth so that long-lived connections show up
+// before they're closed.
+var bandwidth = struct {
+	mu    sync.Mutex
+	hosts map[string]*HostBandwidth
+}{
+	hosts: make(map[string]*HostBandwidth),
+}
+
+// bandwidth returns the bytes exchanged by the proxy so far. Bytes are counted
+// in the proxy, so they include connections that aren't HTTP or that are
+// passed through without being parsed.
+func (p *proxy) bandwidth() HostBandwidth {
+	dest, addr, ok := p.destination("")
+	if !ok {
+		return HostBandwidth{Host: OtherHost, Connections: 1}
+	}
+	ret := HostBandwidth{Host: dest, Connections: 1}
+	if p.wire != nil {
+		ret.Ingress, ret.Egress = p.wire.nread.Load(), p.wire.nwritten.Load()
+		if plain := p.plain.Load(); plain != nil {
+			ret.TLSIngress = ret.Ingress - min(ret.Ingress, plain.nread.Load())
+			ret.TLSEgress = ret.Egress - min(ret.Egress, plain.nwritten.Load())
+		}
+	}
+	family := FamilyBandwidth{Connections: 1, Ingress: ret.Ingress, Egress: ret.Egress}
+	switch {
+	case !addr.IsValid():
+		// A unix domain socket is neither.
+	case addrFamily(addr.Addr()) == familyIPv4:
+		ret.IPv4 = family
+	default:
+		ret.IPv6 = family
+	}
+	return ret
+}
+
+// accountBandwidth adds the bytes exchanged by a proxy that has finished to
+// the totals. It must be called with running.mu held so that Bandwidth never
+// counts a proxy twice.
+func accountBandwidth(b HostBandwidth) {
+	bandwidth.mu.Lock()
+	defer bandwidth.mu.Unlock()
+
+	host, ok := bandwidth.hosts[b.Host]
+	if !ok {
+		name := b.Host
+		if len(bandwidth.hosts) >= maxBandwidthHosts {
+			name = OtherHost
+		}
+		if host, ok = bandwidth.hosts[name]; !ok {
+			host = &HostBandwidth{Host: name}
+			bandwidth.hosts[name] = host
+		}
+	}
+	host.add(b)
+}
+
+// Bandwidth returns the bytes exchanged with each host over the run so far,
+// including connections that are still open. Only the k hosts with the most
+// bytes are returned individually; the rest are summed up in a final entry for
+// OtherHost. A k of zero or less returns every host.
+func Bandwidth(k int) []HostBandwidth {
+	hosts := make(map[string]*HostBandwidth)
+	merge := func(b HostBandwidth) {
+		host, ok := hosts[b.Host]
+		if !ok {
+			host = &HostBandwidth{Host: b.Host}
+			hosts[b.Host] = host
+		}
+		host.add(b)
+	}
+
+	running.mu.Lock()
+	bandwidth.mu.Lock()
+	for _, b := range bandwidth.hosts {
+		merge(*b)
+	}
+	bandwidth.mu.Unlock()
+	for p := range running.proxies {
+		if !p.passthrough {
+			merge(p.bandwidth())
+		}
+	}
+	running.mu.Unlock()
+
+	var other *HostBandwidth
+	ret := make([]HostBandwidth, 0, len(hosts))
+	for _, b := range hosts {
+		if b.Host == OtherHost {
+			other = b
+			continue
+		}
+		ret = append(ret, *b)
+	}
+	slices.SortFunc(ret, func(a, b HostBandwidth) int {
+		if a.Total() != b.Total() {
+			if a.Total() > b.Total() {
+				return -1
+			}
+			return 1
+		}
+		if a.Host < b.Host {
+			return -1
+		}
+		return 1
+	})
+
+	if k > 0 && len(ret) > k {
+		if other == nil {
+			other = &HostBandwidth{Host: OtherHost}
+		}
+		for _, b := range ret[k:] {
+			other.add(b)
+		}
+		ret = ret[:k]
+	}
+	if other != nil {
+		ret = append(ret, *other)
+	}
+	return ret
+}
+
+// WriteBandwidthSummary writes a table of the k hosts with the most bytes
+// exchanged to w. Nothing is written if there was no traffic.
+func WriteBandwidthSummary(w io.Writer, k int) error {
+	hosts := Bandwidth(k)
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "HOST\tCONNS\tINGRESS\tEGRESS\tTLS INGRESS\tTLS EGRESS\tIPV6\t\n")
+	for _, b := range hosts {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%.0f%%\t\n", b.Host, b.Connections, units.Bytes(b.Ingress), units.Bytes(b.Egress), units.Bytes(b.TLSIngress), units.Bytes(b.TLSEgress), 100*b.IPv6Share())
+	}
+	return tw.Flush()
+}
+
+// ServeDebugBandwidth serves the bytes exchanged with each host as JSON. The
+// k query parameter limits the number of hosts returned individually.
+func ServeDebugBandwidth(w http.ResponseWriter, r *http.Request) {
+	k := 0
+	if val := r.URL.Query().Get("k"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid k: %v", err), http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(Bandwidth(k)); err != nil {
+		slog.Debug("failed to write debug bandwidth response", "err", err) // not fatal
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"subtrace.dev/event"
+)
+
+func resetBandwidth(t *testing.T) {
+	reset := func() {
+		bandwidth.mu.Lock()
+		bandwidth.hosts = make(map[string]*HostBandwidth)
+		bandwidth.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	lis, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+
+	a, err := net.DialTCP("tcp", nil, lis.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	b, err := lis.AcceptTCP()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return a, b
+}
+
+func TestBandwidthTopK(t *testing.T) {
+	resetBandwidth(t)
+
+	running.mu.Lock()
+	for i := range 5 {
+		accountBandwidth(HostBandwidth{Host: fmt.Sprintf("host%d", i), Connections: 1, Ingress: uint64(100 * (i + 1)), Egress: 1})
+	}
+	accountBandwidth(HostBandwidth{Host: "host4", Connections: 1, Ingress: 1000})
+	running.mu.Unlock()
+
+	got := Bandwidth(2)
+	if len(got) != 3 {
+		t.Fatalf("got %d hosts, want 2 and other: %+v", len(got), got)
+	}
+	if got[0].Host != "host4" || got[0].Connections != 2 || got[0].Ingress != 1500 {
+		t.Errorf("got top host %+v, want host4 with 2 connections and 1500 bytes in", got[0])
+	}
+	if got[1].Host != "host3" {
+		t.Errorf("got second host %q, want host3", got[1].Host)
+	}
+	if other := got[2]; other.Host != OtherHost || other.Connections != 3 || other.Ingress != 600 || other.Egress != 3 {
+		t.Errorf("got other %+v, want 3 connections with 600 bytes in and 3 out", other)
+	}
+}
+
+func TestBandwidthCardinality(t *testing.T) {
+	resetBandwidth(t)
+
+	running.mu.Lock()
+	for i := range maxBandwidthHosts + 10 {
+		accountBandwidth(HostBandwidth{Host: fmt.Sprintf("host%d", i), Connections: 1, Egress: 1})
+	}
+	running.mu.Unlock()
+
+	got := Bandwidth(0)
+	if len(got) != maxBandwidthHosts+1 {
+		t.Fatalf("got %d hosts, want %d", len(got), maxBandwidthHosts+1)
+	}
+	if other := got[len(got)-1]; other.Host != OtherHost || other.Connections != 10 {
+		t.Errorf("got last entry %+v, want other with 10 connections", other)
+	}
+}
+
+func TestProxyBandwidth(t *testing.T) {
+	app, process := tcpPair(t)
+	external, peer := tcpPair(t)
+
+	p := &proxy{isOutgoing: true, process: process, external: external}
+	p.collectConnInfo()
+	p.wire = newBufConn(external)
+
+	done := make(chan error, 1)
+	go func() { done <- p.proxyFallback(newBufConn(process), p.wire) }()
+
+	if _, err := app.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(peer, make([]byte, 5)); err != nil {
+		t.Fatalf("read at peer: %v", err)
+	}
+	if _, err := peer.Write([]byte("goodbye")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(app, make([]byte, 7)); err != nil {
+		t.Fatalf("read at app: %v", err)
+	}
+	app.CloseWrite()
+	peer.CloseWrite()
+	if err := <-done; err != nil {
+		t.Fatalf("proxy: %v", err)
+	}
+
+	want := external.RemoteAddr().String()
+	got := p.bandwidth()
+	if got.Host != want || got.Egress != 5 || got.Ingress != 7 || got.TLSEgress != 0 || got.TLSIngress != 0 {
+		t.Errorf("got %+v, want 5 bytes out and 7 bytes in to %s", got, want)
+	}
+	if got.IPv4 != (FamilyBandwidth{Connections: 1, Ingress: 7, Egress: 5}) || got.IPv6 != (FamilyBandwidth{}) {
+		t.Errorf("got ipv4 %+v and ipv6 %+v, want every byte over ipv4", got.IPv4, got.IPv6)
+	}
+}
+
+func TestBandwidthDualStack(t *testing.T) {
+	resetBandwidth(t)
+
+	// The same service reached over both families is one destination.
+	name := "api.example.com"
+	v4 := &proxy{isOutgoing: true, externalInfo: ConnInfo{Remote: "192.0.2.1:443"}}
+	v4.tlsServerName.Store(&name)
+	v6 := &proxy{isOutgoing: true, externalInfo: ConnInfo{Remote: "[2001:db8::1]:443"}}
+	v6.tlsServerName.Store(&name)
+
+	running.mu.Lock()
+	for range 9 {
+		accountBandwidth(v4.bandwidth())
+	}
+	accountBandwidth(v6.bandwidth())
+	running.mu.Unlock()
+
+	got := Bandwidth(0)
+	if len(got) != 1 || got[0].Host != "api.example.com:443" {
+		t.Fatalf("got %+v, want a single entry for api.example.com:443", got)
+	}
+	if got[0].IPv4.Connections != 9 || got[0].IPv6.Connections != 1 {
+		t.Errorf("got %d ipv4 and %d ipv6 connections, want 9 and 1", got[0].IPv4.Connections, got[0].IPv6.Connections)
+	}
+	if share := got[0].IPv6Share(); share != 0.1 {
+		t.Errorf("got ipv6 share %v, want 0.1", share)
+	}
+
+	ev := event.New()
+	v6.setDestinationTags(ev, "")
+	if ev.Get("dest") != "api.example.com:443" || ev.Get("dest_addr") != "[2001:db8::1]:443" || ev.Get("dest_family") != "ipv6" {
+		t.Errorf("got dest=%q dest_addr=%q dest_family=%q", ev.Get("dest"), ev.Get("dest_addr"), ev.Get("dest_family"))
+	}
+}
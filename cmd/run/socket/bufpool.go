@@ -0,0 +1,41 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"sync"
+)
+
+// bufferSizes are the sizes of the pooled buffers the proxy copies and parses
+// with. Every proxied connection needs a few of them for as long as it's open,
+// so allocating them per connection makes the garbage collector's work grow
+// with the number of connections rather than the amount of traffic.
+var bufferSizes = [...]int{4 << 10, 32 << 10, 256 << 10}
+
+var bufferPools [len(bufferSizes)]sync.Pool
+
+// getBuffer returns a buffer of the smallest pooled size that's at least size
+// bytes, or of the largest one if none is. Pass it to putBuffer once done.
+func getBuffer(size int) *[]byte {
+	i := 0
+	for i < len(bufferSizes)-1 && bufferSizes[i] < size {
+		i++
+	}
+	if b, ok := bufferPools[i].Get().(*[]byte); ok {
+		return b
+	}
+	b := make([]byte, bufferSizes[i])
+	return &b
+}
+
+// putBuffer returns a buffer from getBuffer to its pool. The caller must not
+// use it after.
+func putBuffer(b *[]byte) {
+	for i, size := range bufferSizes {
+		if len(*b) == size {
+			bufferPools[i].Put(b)
+			return
+		}
+	}
+}
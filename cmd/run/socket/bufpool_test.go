@@ -0,0 +1,86 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestGetBuffer(t *testing.T) {
+	for size, want := range map[int]int{
+		0:         4 << 10,
+		4 << 10:   4 << 10,
+		4<<10 + 1: 32 << 10,
+		1 << 20:   256 << 10,
+	} {
+		b := getBuffer(size)
+		if len(*b) != want {
+			t.Errorf("%d bytes: got a %d byte buffer, want %d", size, len(*b), want)
+		}
+		putBuffer(b)
+	}
+}
+
+// BenchmarkProxyThroughput sends HTTP/1.1 requests one after another on a
+// keep-alive connection to a traced server and reports the allocations the
+// proxy and the parser make per request.
+func BenchmarkProxyThroughput(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("body=%dKiB", size>>10), func(b *testing.B) {
+			lis, addr := listenTraced(b, 8)
+			client, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatalf("dial: %v", err)
+			}
+			defer client.Close()
+			srv, errno, err := lis.Accept(0)
+			if err != nil || errno != 0 {
+				b.Fatalf("accept: errno=%v, err=%v", errno, err)
+			}
+			defer srv.Close()
+			conn := traceeConn(b, srv)
+			if conn == nil {
+				b.FailNow()
+			}
+			defer conn.Close()
+
+			body := payload(1, size)
+			go func() {
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					io.Copy(io.Discard, req.Body)
+					fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", len(body))
+					if _, err := conn.Write(body); err != nil {
+						return
+					}
+				}
+			}()
+
+			br := bufio.NewReader(client)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				fmt.Fprintf(client, "GET /bench HTTP/1.1\r\nHost: example.com\r\n\r\n")
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil {
+					b.Fatalf("read response: %v", err)
+				}
+				if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+					b.Fatalf("read body: %v", err)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
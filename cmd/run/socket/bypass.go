@@ -0,0 +1,62 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"log/slog"
+	"net/netip"
+
+	"subtrace.dev/cmd/run/capability"
+	"subtrace.dev/config"
+)
+
+// Bypass lists the destinations that traced processes connect to directly,
+// with no proxy in between and no events (-bypass and the config's bypass
+// list). It's meant for chatty connections that are already instrumented,
+// like a local sidecar, where two extra TCP hops only add latency.
+var Bypass []config.BypassRule
+
+func init() {
+	capability.RegisterFeature("bypass", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: len(Bypass) > 0}
+	})
+}
+
+// Bypassed reports whether connections to addr bypass subtrace.
+func Bypassed(addr netip.AddrPort) bool {
+	for _, r := range Bypass {
+		if r.Matches(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bypass stops tracking the socket so that the process's connect(2) can go to
+// the kernel, which then connects the process's own socket to the real peer
+// (or binds it, see PeerAuthListener). Only an unbound stream socket that no
+// other file descriptor refers to can be handed back: the kernel knows
+// nothing of an emulated bind(2), and the other descriptors would still be
+// traced. It reports whether the socket was released, after which it's
+// closed.
+func (s *Socket) Bypass() bool {
+	if s.Inode.IsDatagram() {
+		return false
+	}
+	s.Inode.mu.Lock()
+	shared := len(s.Inode.open) != 1
+	s.Inode.mu.Unlock()
+	if shared {
+		return false
+	}
+	if cur := s.Inode.state.Load(); cur.state != StatePassive || cur.passive.bind != nil {
+		return false
+	}
+
+	if errno := s.Close(); errno != 0 {
+		// Our copy of the socket is gone either way.
+		slog.Debug("failed to close bypassed socket cleanly", "sock", s, "errno", errno)
+	}
+	return true
+}
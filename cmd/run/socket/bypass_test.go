@@ -0,0 +1,103 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/fd"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+)
+
+// TestBypass hands a socket back to the kernel before it connects to a
+// bypassed destination. The process's own copy of the socket must then be
+// connected to the real peer with no dummy listener in between.
+func TestBypass(t *testing.T) {
+	r, err := config.ParseBypassRule("loopback")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	prev := Bypass
+	Bypass = []config.BypassRule{r}
+	t.Cleanup(func() { Bypass = prev })
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	addr := netip.MustParseAddrPort(lis.Addr().String())
+	if !Bypassed(addr) || Bypassed(netip.MustParseAddrPort("10.0.0.1:80")) {
+		t.Fatalf("got the wrong destinations bypassed")
+	}
+
+	g := &global.Global{Config: config.New()}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	// The process's copy of the socket, which the kernel connects.
+	tracee, err := unix.Dup(sock.FD.FD())
+	if err != nil {
+		t.Fatalf("dup: %v", err)
+	}
+	defer unix.Close(tracee)
+
+	if !sock.Bypass() {
+		t.Fatalf("didn't bypass an unbound socket")
+	}
+	if info := sock.Inode.Info(); info.State != "closed" {
+		t.Fatalf("got inode %+v after bypassing, want it closed", info)
+	}
+	if err := unix.Connect(tracee, &unix.SockaddrInet4{Addr: addr.Addr().As4(), Port: int(addr.Port())}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	peer, err := unix.Getpeername(tracee)
+	if err != nil {
+		t.Fatalf("getpeername: %v", err)
+	}
+	if sa, ok := peer.(*unix.SockaddrInet4); !ok || netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port)) != addr {
+		t.Fatalf("got peer %+v, want the listener at %s", peer, addr)
+	}
+}
+
+// TestBypassShared doesn't bypass sockets that the kernel can't connect as
+// they are: bound ones and ones other file descriptors refer to.
+func TestBypassShared(t *testing.T) {
+	g := &global.Global{Config: config.New()}
+
+	bound, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer bound.Close()
+	if errno, err := bound.Bind(netip.MustParseAddrPort("127.0.0.1:0")); err != nil || errno != 0 {
+		t.Fatalf("bind: errno=%v, err=%v", errno, err)
+	}
+	if bound.Bypass() {
+		t.Fatalf("bypassed a bound socket")
+	}
+
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	dup, err := unix.Dup(sock.FD.FD())
+	if err != nil {
+		t.Fatalf("dup: %v", err)
+	}
+	dupFD := fd.NewFD(dup)
+	shared := NewSocket(g, event.New(), sock.Inode, dupFD)
+	dupFD.DecRef()
+	defer shared.Close()
+	if sock.Bypass() {
+		t.Fatalf("bypassed a socket shared with another file descriptor")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"subtrace.dev/event"
+	"subtrace.dev/tracer"
+)
+
+// captureState holds the decisions made on what to capture of a proxied
+// connection. Every decision is also recorded on the proxy's event template so
+// that events carry the chain that led to them.
+type captureState struct {
+	mu        sync.Mutex
+	decisions []tracer.Decision
+	level     string
+	reason    string
+}
+
+// decide records a decision on what to capture of the connection. It must
+// only be called by the goroutine that owns p.tmpl at the time, which is the
+// one running the protocol handler.
+func (p *proxy) decide(d tracer.Decision, level string) {
+	p.capture.mu.Lock()
+	p.capture.decisions = append(p.capture.decisions, d)
+	if level == tracer.CaptureNone {
+		p.capture.level, p.capture.reason = level, d.Reason
+	}
+	p.capture.mu.Unlock()
+
+	p.tmpl = p.tmpl.Copy()
+	tracer.AddDecision(p.tmpl, d, level)
+}
+
+// captureInfo returns the capture level, reason and decisions so far.
+func (p *proxy) captureInfo() (string, string, []tracer.Decision) {
+	p.capture.mu.Lock()
+	defer p.capture.mu.Unlock()
+	return p.capture.level, p.capture.reason, slices.Clone(p.capture.decisions)
+}
+
+// proxyUncaptured passes the connection through without parsing it and
+// records why.
+func (p *proxy) proxyUncaptured(cli, srv *bufConn, layer string, reason string, detail string) error {
+	p.decide(tracer.Decision{Layer: layer, Verdict: "not_intercepted", Reason: reason, Detail: detail}, tracer.CaptureNone)
+	return p.proxyFallback(cli, srv)
+}
+
+// publishUncaptured publishes a connection event for a connection that wasn't
+// intercepted, since no exchange event will say what happened to it. The
+// accepting side of a collapsed loopback connection is skipped because the
+// connecting side captures it, and so are connections left out by sampling.
+func (p *proxy) publishUncaptured() {
+	level, reason, _ := p.captureInfo()
+	if level != tracer.CaptureNone || p.unsampled || p.passthrough || p.global == nil || p.global.Config == nil {
+		return
+	}
+
+	ev := p.tmpl.Copy()
+	p.setDestinationTags(ev, "")
+	b := p.bandwidth()
+	ev.Set("connection_ingress_bytes", fmt.Sprintf("%d", b.Ingress))
+	ev.Set("connection_egress_bytes", fmt.Sprintf("%d", b.Egress))
+	p.setAccountedTags(ev)
+
+	dir := "from"
+	if p.isOutgoing {
+		dir = "to"
+	}
+	go tracer.PublishConnection(p.global, ev, fmt.Sprintf("connection %s %s not intercepted (%s)", dir, b.Host, reason))
+}
+
+// setAccountedTags tags ev with the bytes the tracee has written to the
+// connection so far as the emulated writev(2), sendmsg(2) and sendmmsg(2)
+// accounted them, which are only counted with -account-writes.
+func (p *proxy) setAccountedTags(ev *event.Event) {
+	if p.socket == nil {
+		return
+	}
+	if n := p.socket.Inode.Written(); n > 0 {
+		ev.Set("connection_accounted_write_bytes", fmt.Sprintf("%d", n))
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"io"
+	"testing"
+
+	"subtrace.dev/event"
+	"subtrace.dev/tracer"
+)
+
+func TestCaptureUnsupportedProtocol(t *testing.T) {
+	app, process := tcpPair(t)
+	external, peer := tcpPair(t)
+
+	p := &proxy{isOutgoing: true, process: process, external: external, tmpl: event.New()}
+	p.collectConnInfo()
+	p.wire = newBufConn(external)
+
+	done := make(chan error, 1)
+	go func() { done <- p.proxyOptimistic(newBufConn(process), p.wire) }()
+
+	if _, err := app.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(peer, make([]byte, 21)); err != nil {
+		t.Fatalf("read at peer: %v", err)
+	}
+	app.CloseWrite()
+	peer.CloseWrite()
+	if err := <-done; err != nil {
+		t.Fatalf("proxy: %v", err)
+	}
+
+	level, reason, decisions := p.captureInfo()
+	if level != tracer.CaptureNone || reason != tracer.ReasonUnknownProtocol {
+		t.Errorf("got level=%q reason=%q, want none because %s", level, reason, tracer.ReasonUnknownProtocol)
+	}
+	if len(decisions) != 1 || decisions[0].Layer != "protocol" {
+		t.Errorf("got decisions %+v, want a single protocol decision", decisions)
+	}
+	if got := p.tmpl.Get("capture_level"); got != tracer.CaptureNone {
+		t.Errorf("got capture_level tag %q on the template, want %q", got, tracer.CaptureNone)
+	}
+}
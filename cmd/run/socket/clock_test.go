@@ -0,0 +1,91 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/clock"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/tracer"
+)
+
+// TestClockJumpEvent resumes from suspend while a request is in flight. The
+// event must say that the wall clock jumped and its duration must not go
+// negative or include the jump.
+func TestClockJumpEvent(t *testing.T) {
+	prevDefault := clock.Default
+	f := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	clock.Default = clock.NewDetector(f)
+	t.Cleanup(func() { clock.Default = prevDefault })
+	events := captureEvents(t)
+
+	const req = "GET /sleep HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	const resp = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, len(req)))
+		f.Step(-time.Hour) // an NTP step back mid-request
+		io.WriteString(conn, resp)
+	}()
+
+	g := &global.Global{Config: config.New()}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if errno, err := sock.Connect(netip.MustParseAddrPort(lis.Addr().String()), nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v err=%v", errno, err)
+	}
+	conn := traceeConn(t, sock)
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, req)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if b, err := io.ReadAll(io.LimitReader(conn, int64(len(resp)))); err != nil || string(b) != resp {
+		t.Fatalf("got response %q, err=%v", b, err)
+	}
+
+	var lines []tracer.EventLogLine
+	testutil.WaitFor(t, "the event", func() bool { lines = events(); return len(lines) > 0 })
+	line := lines[0]
+	if got := line.Tags["clock_jump"]; got != "backward" {
+		t.Errorf("got clock_jump=%q, want backward", got)
+	}
+	if got := line.Tags["clock_jump_ms"]; got != "-3600000" {
+		t.Errorf("got clock_jump_ms=%q, want -3600000", got)
+	}
+	var entry struct {
+		Time int64 `json:"time"`
+	}
+	if err := json.Unmarshal(line.Entry, &entry); err != nil {
+		t.Fatalf("decode HAR entry: %v", err)
+	}
+	if entry.Time < 0 || entry.Time > 10_000 {
+		t.Errorf("got a %dms request across the jump, want its actual duration", entry.Time)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/fd"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+)
+
+func openFDs(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatalf("read fds: %v", err)
+	}
+	return len(entries)
+}
+
+func dupSocket(t *testing.T, sock *Socket) *Socket {
+	t.Helper()
+	n, err := unix.FcntlInt(uintptr(sock.FD.FD()), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("dup: %v", err)
+	}
+	dup := fd.NewFD(n)
+	defer dup.DecRef()
+	return NewSocket(sock.global, event.New(), sock.Inode, dup)
+}
+
+// TestConcurrentClose closes sockets in every state from 8 threads at once.
+// Each socket must be closed exactly once with the others getting EBADF, its
+// inode must be torn down and no file descriptor may be left open.
+func TestConcurrentClose(t *testing.T) {
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	addr := netip.MustParseAddrPort(lis.Addr().String())
+
+	create := func(t *testing.T) *Socket {
+		g := &global.Global{Config: config.New()}
+		sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+		if err != nil {
+			t.Fatalf("create socket: %v", err)
+		}
+		return sock
+	}
+	bind := func(t *testing.T) *Socket {
+		sock := create(t)
+		if errno, err := sock.Bind(netip.MustParseAddrPort("127.0.0.1:0")); err != nil || errno != 0 {
+			t.Fatalf("bind: errno=%v, err=%v", errno, err)
+		}
+		return sock
+	}
+	connect := func(t *testing.T) *Socket {
+		sock := create(t)
+		if errno, err := sock.Connect(addr, nil); err != nil || errno != 0 {
+			t.Fatalf("connect: errno=%v, err=%v", errno, err)
+		}
+		return sock
+	}
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T) []*Socket
+	}{
+		{"fresh", func(t *testing.T) []*Socket { return []*Socket{create(t)} }},
+		{"bound", func(t *testing.T) []*Socket { return []*Socket{bind(t)} }},
+		{"listening", func(t *testing.T) []*Socket {
+			sock := bind(t)
+			if errno, err := sock.Listen(8); err != nil || errno != 0 {
+				t.Fatalf("listen: errno=%v, err=%v", errno, err)
+			}
+			return []*Socket{sock}
+		}},
+		{"connected", func(t *testing.T) []*Socket { return []*Socket{connect(t)} }},
+		{"connected dup", func(t *testing.T) []*Socket {
+			sock := connect(t)
+			return []*Socket{sock, dupSocket(t, sock), dupSocket(t, sock)}
+		}},
+		{"closed", func(t *testing.T) []*Socket {
+			sock := create(t)
+			if errno := sock.Close(); errno != 0 {
+				t.Fatalf("close: %v", errno)
+			}
+			return []*Socket{sock}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := openFDs(t)
+			for range 20 {
+				socks := tt.setup(t)
+				wantClosed := 1
+				if tt.name == "closed" {
+					wantClosed = 0
+				}
+
+				// Every thread closes every socket, starting at a different one.
+				const threads = 8
+				var wg sync.WaitGroup
+				results := make([][]unix.Errno, len(socks))
+				var mu sync.Mutex
+				start := make(chan struct{})
+				for i := range threads {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						<-start
+						for j := range socks {
+							k := (i + j) % len(socks)
+							errno := socks[k].Close()
+							mu.Lock()
+							results[k] = append(results[k], errno)
+							mu.Unlock()
+						}
+					}()
+				}
+				close(start)
+				wg.Wait()
+
+				for k, errnos := range results {
+					closed := 0
+					for _, errno := range errnos {
+						switch errno {
+						case 0:
+							closed++
+						case unix.EBADF:
+						default:
+							t.Fatalf("socket %d: got errno %v, want 0 or EBADF", k, errno)
+						}
+					}
+					if closed != wantClosed {
+						t.Fatalf("socket %d: closed %d times, want %d: %v", k, closed, wantClosed, errnos)
+					}
+				}
+				if state := socks[0].Inode.state.Load().state; state != StateClosed {
+					t.Fatalf("got inode state %s, want closed", stateName(state))
+				}
+			}
+			testutil.WaitFor(t, "the file descriptors to be closed", func() bool { return openFDs(t) <= before })
+		})
+	}
+}
+
+// TestCloseDupAfterTeardown closes a socket dup'd from a socket whose close
+// already tore the inode down, like a dup(2) racing the last close(2).
+func TestCloseDupAfterTeardown(t *testing.T) {
+	g := &global.Global{Config: config.New()}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	dup := dupSocket(t, sock)
+
+	// Untrack the duplicate until the inode is torn down, as if it was dup'd
+	// just after the close.
+	if last, err := sock.Inode.remove(dup); err != nil || last {
+		t.Fatalf("remove: last=%v, err=%v", last, err)
+	}
+	if errno := sock.Close(); errno != 0 {
+		t.Fatalf("close: %v", errno)
+	}
+	sock.Inode.add(dup)
+	if errno := dup.Close(); errno != 0 {
+		t.Fatalf("close dup: %v", errno)
+	}
+	if errno := dup.Close(); errno != unix.EBADF {
+		t.Fatalf("close dup again: got %v, want EBADF", errno)
+	}
+}
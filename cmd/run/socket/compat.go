@@ -0,0 +1,85 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"subtrace.dev/cmd/run/compat"
+)
+
+func init() {
+	compat.Register(compat.Behavior{
+		Name:       "connect_writability",
+		Divergence: "a non-blocking connect(2) makes the socket writable immediately, before the peer has accepted the connection",
+		Strict:     func() { AccurateConnect = true },
+		Residual:   "a non-blocking connect(2) blocks until the external handshake finishes instead of returning EINPROGRESS right away",
+	})
+	compat.Register(compat.Behavior{
+		Name:       "tcp_maxseg",
+		Divergence: "the process's side of a connection has the loopback MSS unless the external connection is established first, which only blocking connect(2) and accepted connections wait for",
+		Strict:     func() { AccurateConnect = true },
+		Residual:   "getsockopt(TCP_MAXSEG) reports the external MSS, but the kernel segments the loopback connection by the loopback MSS",
+	})
+	compat.Register(compat.Behavior{
+		Name:       "loopback_addresses",
+		Divergence: "traced sockets are connected to a loopback listener owned by subtrace",
+		Residual:   "the loopback connection between the process and subtrace shows up in /proc/net/tcp, ss(8) and SO_PEERCRED",
+	})
+	compat.Register(compat.Behavior{
+		Name:       "parking_reuseaddr",
+		Divergence: "the socket holding a bound port until connect(2) or listen(2) sets SO_REUSEADDR and SO_REUSEPORT",
+		Residual:   "another process can bind a port the traced process has bound but not yet connected or listened on",
+	})
+	compat.Register(compat.Behavior{
+		Name:       "listen_backlog",
+		Divergence: "listen(2) backlogs below 8 are raised to 8 and the external listener queues up to the system maximum",
+		Strict:     func() { EnforceBacklog = true },
+		Residual:   "each dispatch worker holds one accepted connection on top of the backlog while the process accepts it",
+	})
+	compat.Register(compat.Behavior{
+		Name:       "socket_options",
+		Divergence: "external connections use Go's keepalive and TCP_NODELAY defaults instead of the process's options",
+		Strict:     func() { MirrorSockopts = true },
+		Residual:   "options the process sets after connect(2) or listen(2) are not mirrored to the external connection",
+	})
+	compat.Register(compat.Behavior{
+		Name:       "socket_buffers",
+		Divergence: "the proxy adds two pairs of socket buffers between the process and its peer, each at least as large as the process's own",
+		Residual:   "more bytes can be in flight than the process's buffers hold, and SIOCOUTQ on its socket doesn't count the ones the proxy holds",
+	})
+	compat.Register(compat.Behavior{
+		Name:       "qos_options",
+		Divergence: "IP_TOS, SO_PRIORITY and SO_MARK set by the process are not copied to external connections",
+		Strict:     func() { MirrorQoS = true },
+	})
+	compat.Register(compat.Behavior{
+		Name:       "defer_accept",
+		Divergence: "TCP_DEFER_ACCEPT is accepted and ignored",
+		Strict:     func() { MirrorDeferAccept = true },
+	})
+	compat.Register(compat.Behavior{
+		Name:       "dial_retry",
+		Divergence: "external dials that fail with a transient error are retried (-dial-retry-budget)",
+		Strict:     func() { DialRetryBudget = 0 },
+	})
+	compat.Register(compat.Behavior{
+		Name:       "listen_stall",
+		Divergence: "the external accept loop pauses when the process stops accepting (-listen-stall-timeout)",
+		Strict:     func() { ListenStallTimeout = 0 },
+	})
+	compat.Register(compat.Behavior{
+		Name:       "collapse_loopback",
+		Divergence: "the accepting side of a loopback connection between traced processes is not parsed (-collapse-loopback)",
+		Strict:     func() { CollapseLoopback = false },
+	})
+	compat.Register(compat.Behavior{
+		Name:       "unix_sockets",
+		Divergence: "AF_UNIX stream sockets are proxied, so SCM_CREDENTIALS report subtrace, file descriptors sent with SCM_RIGHTS don't reach the peer, and SO_PEERCRED reports subtrace to a traced server on the first connection from a traced client unless its path is in -peer-auth (-unix-sockets)",
+		Strict:     func() { TraceUnix = false },
+	})
+	compat.Register(compat.Behavior{
+		Name:       "internal_errors",
+		Divergence: "failures inside subtrace surface as the closest documented errno",
+		Residual:   "a syscall that fails because of subtrace reports the closest documented errno rather than the one the kernel would have",
+	})
+}
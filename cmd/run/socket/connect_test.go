@@ -0,0 +1,119 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+)
+
+// countingListener accepts connections and counts them until closed. Each
+// connection is closed when the peer closes its side.
+func countingListener(t *testing.T) (netip.AddrPort, *atomic.Int64) {
+	lis, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	var n atomic.Int64
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			n.Add(1)
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return netip.MustParseAddrPort(lis.Addr().String()), &n
+}
+
+func countFDs(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("read /proc/self/fd: %v", err)
+	}
+	return len(entries)
+}
+
+// TestConcurrentConnect races two connect(2) calls to different destinations
+// on the same socket. Exactly one of them must dial, and the other must fail
+// the way it would without subtrace.
+func TestConcurrentConnect(t *testing.T) {
+	a, acceptedA := countingListener(t)
+	b, acceptedB := countingListener(t)
+	g := &global.Global{Config: config.New()}
+
+	baseline := countFDs(t)
+	const iterations = 50
+	for range iterations {
+		sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+		if err != nil {
+			t.Fatalf("create socket: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		var start sync.WaitGroup
+		start.Add(1)
+		errnos := make([]syscall.Errno, 2)
+		for i, addr := range []netip.AddrPort{a, b} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start.Wait()
+				errno, err := sock.Connect(addr, nil)
+				if err != nil {
+					t.Errorf("connect %s: %v", addr, err)
+				}
+				errnos[i] = errno
+			}()
+		}
+		start.Done()
+		wg.Wait()
+
+		ok := 0
+		for _, errno := range errnos {
+			switch errno {
+			case 0:
+				ok++
+			case unix.EALREADY, unix.EISCONN:
+			default:
+				t.Fatalf("got errnos %v, want one success and EALREADY or EISCONN", errnos)
+			}
+		}
+		if ok != 1 {
+			t.Fatalf("got errnos %v, want exactly one success", errnos)
+		}
+
+		if errno := sock.Close(); errno != 0 {
+			t.Fatalf("close: %v", errno)
+		}
+	}
+
+	testutil.WaitFor(t, "external connections", func() bool { return acceptedA.Load()+acceptedB.Load() >= iterations })
+	time.Sleep(50 * time.Millisecond)
+	if n := acceptedA.Load() + acceptedB.Load(); n != iterations {
+		t.Fatalf("got %d external connections, want %d", n, iterations)
+	}
+	testutil.WaitFor(t, "proxies to finish", func() bool { return Running() == 0 })
+	testutil.WaitFor(t, "fds to be closed", func() bool { return countFDs(t) <= baseline })
+}
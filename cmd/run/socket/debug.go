@@ -0,0 +1,224 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/logging"
+	"subtrace.dev/tracer"
+)
+
+// ConnInfo identifies one of the two kernel sockets of a proxy so that it can
+// be found in the output of ss(8) or lsof(8).
+type ConnInfo struct {
+	Inode  uint64 `json:"inode"`
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+// ProxyInfo describes a running proxy. SocketInode is the inode of the socket
+// in the tracee's file descriptor table, which is what ss -p shows next to the
+// tracee's PID. Process is the subtrace end of the loopback connection to it.
+//
+// CaptureLevel and CaptureReason are only set once the proxy decided not to
+// intercept the connection; Decisions is the chain of decisions so far. Writes
+// is how the application writes on the connection.
+type ProxyInfo struct {
+	ConnectionID  string            `json:"connectionId"`
+	Outgoing      bool              `json:"outgoing"`
+	Begin         time.Time         `json:"begin"`
+	SocketInode   uint64            `json:"socketInode,omitempty"`
+	TLSServerName string            `json:"tlsServerName,omitempty"`
+	Process       ConnInfo          `json:"process"`
+	External      ConnInfo          `json:"external"`
+	CaptureLevel  string            `json:"captureLevel,omitempty"`
+	CaptureReason string            `json:"captureReason,omitempty"`
+	Decisions     []tracer.Decision `json:"decisions,omitempty"`
+	StateHistory  []StateTransition `json:"stateHistory,omitempty"`
+	Stalled       bool              `json:"stalled,omitempty"` // see ProxyStallTimeout
+	Writes        *WritePattern     `json:"writes,omitempty"`
+}
+
+// getConnInfo returns the kernel inode and addresses of conn.
+func getConnInfo(conn streamConn) ConnInfo {
+	info := ConnInfo{Local: addrString(conn.LocalAddr()), Remote: addrString(conn.RemoteAddr())}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return info
+	}
+	var stat unix.Stat_t
+	var statErr error
+	if err := raw.Control(func(fd uintptr) { statErr = unix.Fstat(int(fd), &stat) }); err == nil && statErr == nil {
+		info.Inode = stat.Ino
+	}
+	return info
+}
+
+// addrString is addr.String(), or "" if addr is nil or an unnamed unix domain
+// socket.
+func addrString(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case nil:
+		return ""
+	case *net.UnixAddr:
+		return unixAddrName(addr)
+	}
+	return addr.String()
+}
+
+// collectConnInfo records the kernel sockets backing the proxy. It's called
+// once when the proxy starts so that querying running proxies is cheap.
+func (p *proxy) collectConnInfo() {
+	p.processInfo = getConnInfo(p.process)
+	p.externalInfo = getConnInfo(p.external)
+
+	if logging.Verbose {
+		p.tmpl = p.tmpl.Copy()
+		p.tmpl.Set("proxy_process_inode", fmt.Sprintf("%d", p.processInfo.Inode))
+		p.tmpl.Set("proxy_process_local", p.processInfo.Local)
+		p.tmpl.Set("proxy_external_inode", fmt.Sprintf("%d", p.externalInfo.Inode))
+		p.tmpl.Set("proxy_external_local", p.externalInfo.Local)
+	}
+}
+
+// Proxies returns a snapshot of the running proxies ordered by start time.
+func Proxies() []ProxyInfo {
+	running.mu.Lock()
+	ret := make([]ProxyInfo, 0, len(running.proxies))
+	for p := range running.proxies {
+		info := ProxyInfo{
+			ConnectionID: p.connectionID,
+			Outgoing:     p.isOutgoing,
+			Begin:        p.begin,
+			Process:      p.processInfo,
+			External:     p.externalInfo,
+		}
+		if p.socket != nil {
+			info.SocketInode = p.socket.Inode.Number()
+			info.StateHistory = p.socket.Inode.History()
+		}
+		if name := p.tlsServerName.Load(); name != nil {
+			info.TLSServerName = *name
+		}
+		info.CaptureLevel, info.CaptureReason, info.Decisions = p.captureInfo()
+		if w := p.stall.Load(); w != nil {
+			info.Stalled = w.stalled.Load()
+		}
+		if p.writes != nil && !p.passthrough {
+			w := p.writes.load()
+			info.Writes = &w
+		}
+		ret = append(ret, info)
+	}
+	running.mu.Unlock()
+
+	slices.SortFunc(ret, func(a, b ProxyInfo) int { return a.Begin.Compare(b.Begin) })
+	return ret
+}
+
+// InodeInfo describes a socket inode known to the tracer.
+type InodeInfo struct {
+	Number       uint64 `json:"number"`
+	Domain       string `json:"domain"`
+	State        string `json:"state"`
+	Open         int    `json:"open"` // file descriptors referring to it
+	Written      uint64 `json:"written,omitempty"`
+	UrgentSends  uint64 `json:"urgentSends,omitempty"`
+	Bind         string `json:"bind,omitempty"`
+	Peer         string `json:"peer,omitempty"`
+	ConnectionID string `json:"connectionId,omitempty"`
+	Active       bool   `json:"active,omitempty"`   // for listeners: accepting on their behalf
+	Shutdown     string `json:"shutdown,omitempty"` // for connected sockets: "read", "write" or "both"
+
+	History []StateTransition `json:"history,omitempty"` // if StateHistory is set
+}
+
+// Info returns a description of the inode like LogValue without making any
+// syscalls.
+func (ino *Inode) Info() InodeInfo {
+	info := InodeInfo{
+		Number:      ino.number.Load(),
+		Written:     ino.written.Load(),
+		UrgentSends: ino.urgent.Load(),
+	}
+	switch ino.Domain {
+	case unix.AF_INET:
+		info.Domain = "AF_INET"
+	case unix.AF_INET6:
+		info.Domain = "AF_INET6"
+	case unix.AF_UNIX:
+		info.Domain = "AF_UNIX"
+	}
+
+	switch s := ino.state.Load(); s.state {
+	case StatePassive:
+		info.State = "passive"
+	case StateConnected:
+		info.State = "connected"
+		// The proxy's fields are only safe to read once it's running.
+		p := s.connected.proxy
+		running.mu.Lock()
+		if _, ok := running.proxies[p]; ok {
+			info.ConnectionID, info.Bind, info.Peer = p.connectionID, p.externalInfo.Local, p.externalInfo.Remote
+		}
+		running.mu.Unlock()
+		info.Shutdown = shutName(s.connected.shut)
+	case StateConnecting:
+		info.State = "connecting"
+		info.Peer = s.connecting.peer.String()
+		if ino.Domain == unix.AF_UNIX {
+			info.Peer = s.connecting.name
+		}
+	case StateListening:
+		info.State = "listening"
+		info.Bind = s.listening.lis.Addr().String()
+		info.Active = s.listening.active.Load()
+	case StateClosed:
+		info.State = "closed"
+	}
+
+	ino.mu.RLock()
+	info.Open = len(ino.open)
+	ino.mu.RUnlock()
+	info.History = ino.History()
+	return info
+}
+
+// Snapshot returns the known inodes ordered by number.
+func (t *InodeTable) Snapshot() []InodeInfo {
+	t.resolvePending()
+	t.mu.RLock()
+	inodes := make([]*Inode, 0, len(t.known))
+	for _, ino := range t.known {
+		inodes = append(inodes, ino)
+	}
+	t.mu.RUnlock()
+
+	ret := make([]InodeInfo, 0, len(inodes))
+	for _, ino := range inodes {
+		ret = append(ret, ino.Info())
+	}
+	slices.SortFunc(ret, func(a, b InodeInfo) int { return cmp.Compare(a.Number, b.Number) })
+	return ret
+}
+
+// ServeDebugSockets serves the running proxies as JSON.
+func ServeDebugSockets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(Proxies()); err != nil {
+		slog.Debug("failed to write debug sockets response", "err", err) // not fatal
+	}
+}
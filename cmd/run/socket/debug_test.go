@@ -0,0 +1,31 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGetConnInfo(t *testing.T) {
+	lis, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+
+	conn, err := net.DialTCP("tcp", nil, lis.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	info := getConnInfo(conn)
+	if info.Inode == 0 {
+		t.Errorf("got zero inode")
+	}
+	if info.Local != conn.LocalAddr().String() || info.Remote != lis.Addr().String() {
+		t.Errorf("got %+v, want local %s remote %s", info, conn.LocalAddr(), lis.Addr())
+	}
+}
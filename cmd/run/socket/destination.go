@@ -0,0 +1,109 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+
+	"subtrace.dev/event"
+)
+
+// Address families as set in the dest_family tag.
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+	familyUnix = "unix"
+)
+
+func addrFamily(addr netip.Addr) string {
+	if addr.Unmap().Is4() {
+		return familyIPv4
+	}
+	return familyIPv6
+}
+
+// destination returns the logical destination of an outgoing proxy and the
+// literal address it connected to. Services with both A and AAAA records are
+// reached over two IPs that users think of as one dependency, so the logical
+// destination is the name the tracee used (host, if it isn't empty or an IP
+// literal, then TLS SNI, then a name observed for the IP, then the name of a
+// traced DNS lookup that resolved it) and the port. If no
+// name is known, it falls back to the IP and port.
+//
+// For incoming proxies, the remote port is the client's ephemeral port, so the
+// destination is just the client IP.
+//
+// For unix domain sockets, the destination is the peer's address and the
+// returned AddrPort is invalid. Clients of a unix listener are usually
+// unnamed, in which case there's none.
+func (p *proxy) destination(host string) (string, netip.AddrPort, bool) {
+	if _, ok := p.external.(*net.UnixConn); ok {
+		return p.externalInfo.Remote, netip.AddrPort{}, p.externalInfo.Remote != ""
+	}
+
+	ap, err := netip.ParseAddrPort(p.externalInfo.Remote)
+	if err != nil {
+		return "", netip.AddrPort{}, false
+	}
+	ap = unmapAddrPort(ap)
+	if !p.isOutgoing {
+		return ap.Addr().String(), ap, true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		host = ""
+	}
+	if host == "" {
+		if name := p.tlsServerName.Load(); name != nil {
+			host = *name
+		}
+	}
+	if host == "" {
+		host = hostnameFor(ap.Addr())
+	}
+	if host == "" {
+		host, _, _ = dnsResolutionFor(ap.Addr())
+	}
+	if host == "" {
+		host = ap.Addr().String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(ap.Port()))), ap, true
+}
+
+// setDestinationTags tags an event of an outgoing proxy with its logical
+// destination (dest) and the literal peer address and its family (dest_addr,
+// dest_family) so that events can be grouped by dependency and split by
+// address family when drilling down. host is the request's Host or
+// :authority, if known.
+func (p *proxy) setDestinationTags(ev *event.Event, host string) {
+	if !p.isOutgoing {
+		return
+	}
+	dest, addr, ok := p.destination(host)
+	if !ok {
+		return
+	}
+	ev.Set("dest", event.Intern(dest))
+	if !addr.IsValid() {
+		ev.Set("dest_addr", event.Intern(dest))
+		ev.Set("dest_family", familyUnix)
+		return
+	}
+	ev.Set("dest_addr", event.Intern(addr.String()))
+	ev.Set("dest_family", addrFamily(addr.Addr()))
+	if addr.Addr().IsLoopback() && isRemoteName(host) {
+		// Only a proxy on this host passes on requests for other hosts.
+		ev.Set("via_proxy", event.Intern(addr.String()))
+		noteProxiedRequest(addr, host)
+	}
+	if name, eventID, ok := dnsResolutionFor(addr.Addr()); ok {
+		ev.Set("dns_event_id", eventID)
+		ev.Set("dns_name", event.Intern(name))
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/crash"
+)
+
+const (
+	minDispatchWorkers = 4
+	maxDispatchWorkers = 64
+)
+
+// DispatchDialTimeout bounds the loopback dial that hands an accepted
+// connection to the process. The dial only completes once the kernel queues
+// it in the process's backlog, so a tracee that stopped accepting would
+// otherwise pin a dispatch worker forever.
+var DispatchDialTimeout = 5 * time.Second
+
+// dispatchWorkers returns the number of workers dispatching the connections
+// accepted on a listener. Connections beyond that wait in the buffer channel,
+// which is bounded by the backlog too, so a flood of connections can't spawn
+// an unbounded number of goroutines and dials.
+func dispatchWorkers(backlog int) int {
+	return min(max(backlog/2, minDispatchWorkers), maxDispatchWorkers)
+}
+
+// dispatchMetrics counts dispatch worker utilization and loopback dials
+// across all listeners.
+var dispatchMetrics struct {
+	workers  atomic.Int64 // running workers
+	busy     atomic.Int64 // workers dispatching a connection
+	peakBusy atomic.Int64
+
+	dials        atomic.Uint64
+	dialFailures atomic.Uint64
+	dialTimeouts atomic.Uint64
+	dialNanos    atomic.Uint64 // sum over successful dials
+	maxDialNanos atomic.Int64
+}
+
+// storeMax raises v to n if n is larger.
+func storeMax(v *atomic.Int64, n int64) {
+	for {
+		cur := v.Load()
+		if n <= cur || v.CompareAndSwap(cur, n) {
+			return
+		}
+	}
+}
+
+// DispatchMetrics is a snapshot of dispatch worker utilization and loopback
+// dial latency across all listeners.
+type DispatchMetrics struct {
+	Workers      int64   `json:"workers"`
+	Busy         int64   `json:"busy"`
+	PeakBusy     int64   `json:"peakBusy"`
+	Dials        uint64  `json:"dials"`
+	DialFailures uint64  `json:"dialFailures"`
+	DialTimeouts uint64  `json:"dialTimeouts"`
+	DialAvgMs    float64 `json:"dialAvgMs"`
+	DialMaxMs    float64 `json:"dialMaxMs"`
+}
+
+// Dispatch returns the current dispatch metrics.
+func Dispatch() DispatchMetrics {
+	m := DispatchMetrics{
+		Workers:      dispatchMetrics.workers.Load(),
+		Busy:         dispatchMetrics.busy.Load(),
+		PeakBusy:     dispatchMetrics.peakBusy.Load(),
+		Dials:        dispatchMetrics.dials.Load(),
+		DialFailures: dispatchMetrics.dialFailures.Load(),
+		DialTimeouts: dispatchMetrics.dialTimeouts.Load(),
+		DialMaxMs:    float64(dispatchMetrics.maxDialNanos.Load()) / float64(time.Millisecond),
+	}
+	if ok := m.Dials - m.DialFailures; ok > 0 {
+		m.DialAvgMs = float64(dispatchMetrics.dialNanos.Load()) / float64(ok) / float64(time.Millisecond)
+	}
+	return m
+}
+
+// ServeDebugDispatch serves the dispatch metrics as JSON.
+func ServeDebugDispatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(Dispatch()); err != nil {
+		slog.Debug("failed to write debug dispatch response", "err", err) // not fatal
+	}
+}
+
+// runDispatchWorkers starts the workers that hand connections accepted
+// externally to the process until buffer is closed.
+func (s *Socket) runDispatchWorkers(next *ImmutableState, ephemeral net.Addr, buffer <-chan *proxy, backlog int) {
+	for range dispatchWorkers(backlog) {
+		dispatchMetrics.workers.Add(1)
+		go func() {
+			defer crash.Recover("dispatch")
+			defer dispatchMetrics.workers.Add(-1)
+			for p := range buffer {
+				storeMax(&dispatchMetrics.peakBusy, dispatchMetrics.busy.Add(1))
+				s.dispatch(next, ephemeral, p)
+				dispatchMetrics.busy.Add(-1)
+			}
+		}()
+	}
+}
+
+// dispatch dials the process's listener on the ephemeral address and queues
+// the proxy for the accept(2) that returns the process side of the dial,
+// which it identifies by the cookie written on the connection.
+func (s *Socket) dispatch(next *ImmutableState, ephemeral net.Addr, p *proxy) {
+	begin := time.Now()
+	process, err := retryPortExhaustion(s.global, "dispatch_dial", func() (net.Conn, error) {
+		return enterNetns(s.Inode.netns, func() (net.Conn, error) {
+			d := &net.Dialer{Timeout: DispatchDialTimeout}
+			if ephemeral.Network() == "tcp" {
+				d.Control = mirrorMSSControl(p)
+			}
+			return d.Dial(ephemeral.Network(), ephemeral.String())
+		})
+	})
+	dispatchMetrics.dials.Add(1)
+	if err != nil {
+		dispatchMetrics.dialFailures.Add(1)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			dispatchMetrics.dialTimeouts.Add(1)
+		}
+		next.listening.gate.pending.Add(-1)
+		s.releaseOverflow(next.listening.gate, next.listening.lis.Addr().String(), false)
+		p.external.Close()
+		slog.Debug("failed to dial ephemeral address", "err", err) // not fatal: the process probably exited or stopped accepting
+		return
+	}
+	took := time.Since(begin)
+	dispatchMetrics.dialNanos.Add(uint64(took))
+	storeMax(&dispatchMetrics.maxDialNanos, int64(took))
+	p.process = process.(streamConn)
+
+	// The proxy is stored before the cookie is sent so that the accept(2)
+	// that reads it always finds it.
+	cookie := rand.Uint64()
+	next.listening.backlog.Store(cookie, p)
+	if err := writeCookie(p.process, cookie); err != nil {
+		if _, ok := next.listening.backlog.LoadAndDelete(cookie); ok {
+			next.listening.gate.pending.Add(-1)
+			s.releaseOverflow(next.listening.gate, next.listening.lis.Addr().String(), false)
+			p.process.Close()
+			p.external.Close()
+		}
+		slog.Debug("failed to write dispatch cookie", "sock", s, "err", err) // not fatal: same as a failed dial
+		return
+	}
+	slog.Debug("dispatcher enqueued accepted connection", "sock", s, "addr", process.LocalAddr(), "cookie", cookie)
+}
+
+// The loopback port of a dispatch dial is not enough to tell which proxy an
+// accepted connection belongs to: once a dispatched connection is closed
+// before the process accepts it, the port can be reused by the next dial
+// (more so with tcp_tw_reuse and small port ranges), and anyone can connect
+// to the process's ephemeral listener. Instead, every dispatch dial starts
+// with a random cookie that identifies its proxy, which Accept reads and
+// strips before the process sees the connection.
+
+const cookieSize = 8
+
+// DispatchCookieTimeout is how long Accept waits for the cookie of an
+// accepted connection. The dispatcher writes it right after the connection
+// is established, so this only expires for connections that didn't come
+// from the dispatcher.
+var DispatchCookieTimeout = time.Second
+
+func writeCookie(conn net.Conn, cookie uint64) error {
+	var b [cookieSize]byte
+	binary.BigEndian.PutUint64(b[:], cookie)
+	_, err := conn.Write(b[:])
+	return err
+}
+
+// readCookie reads the dispatch cookie from the accepted connection fd without
+// changing its blocking mode, which it shares with the process. The cookie is
+// written right after the dial, so it's usually there by the time the process
+// accepts the connection and poll(2) is only needed when it isn't.
+func readCookie(fd int) (uint64, error) {
+	var b [cookieSize]byte
+	deadline := time.Now().Add(DispatchCookieTimeout)
+	for n := 0; n < len(b); {
+		m, _, err := unix.Recvfrom(fd, b[n:], unix.MSG_DONTWAIT)
+		switch {
+		case errors.Is(err, unix.EINTR):
+			continue
+		case errors.Is(err, unix.EAGAIN):
+			timeout := time.Until(deadline)
+			if timeout <= 0 {
+				return 0, fmt.Errorf("timed out after %d bytes", n)
+			}
+			fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+			if _, err := unix.Poll(fds, int(timeout.Milliseconds())+1); err != nil && !errors.Is(err, unix.EINTR) {
+				return 0, fmt.Errorf("poll: %w", err)
+			}
+			continue
+		case err != nil:
+			return 0, fmt.Errorf("recv: %w", err)
+		case m == 0:
+			return 0, fmt.Errorf("connection closed after %d bytes", n)
+		}
+		n += m
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
@@ -0,0 +1,297 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+)
+
+func TestDispatchFlood(t *testing.T) {
+	const (
+		backlog = 128
+		total   = 5000
+		clients = 64
+	)
+	lis, addr := listenTraced(t, backlog)
+	dispatchMetrics.peakBusy.Store(0)
+	failures := dispatchMetrics.dialFailures.Load()
+
+	// A slow tracee: accepts one connection at a time with a pause in between.
+	accepted := make(chan struct{})
+	go func() {
+		defer close(accepted)
+		for range total {
+			srv, errno, err := lis.Accept(0)
+			if err != nil || errno != 0 {
+				t.Errorf("accept: errno=%v, err=%v", errno, err)
+				return
+			}
+			srv.Close()
+			time.Sleep(50 * time.Microsecond)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := i; j < total; j += clients {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Errorf("dial %d: %v", j, err)
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-accepted:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("timed out waiting for the tracee to accept %d connections", total)
+	}
+
+	m := Dispatch()
+	if max := int64(dispatchWorkers(backlog)); m.PeakBusy > max {
+		t.Errorf("got %d concurrent dispatches, want at most %d", m.PeakBusy, max)
+	}
+	if n := m.DialFailures - failures; n != 0 {
+		t.Errorf("got %d failed dispatch dials, want none", n)
+	}
+}
+
+// readLine reads from fd up to and including the first newline.
+func readLine(t *testing.T, fd int) string {
+	t.Helper()
+	tv := unix.NsecToTimeval((5 * time.Second).Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatalf("set SO_RCVTIMEO: %v", err)
+	}
+	var b []byte
+	buf := make([]byte, 1)
+	for !bytes.HasSuffix(b, []byte("\n")) {
+		n, err := unix.Read(fd, buf)
+		if err != nil || n == 0 {
+			t.Fatalf("read after %q: n=%d, err=%v", b, n, err)
+		}
+		b = append(b, buf[:n]...)
+	}
+	return string(b)
+}
+
+func TestAcceptDropsForeignConnections(t *testing.T) {
+	defer func(prev time.Duration) { DispatchCookieTimeout = prev }(DispatchCookieTimeout)
+	DispatchCookieTimeout = 100 * time.Millisecond
+
+	lis, addr := listenTraced(t, 8)
+	ephemeral, err := unix.Getsockname(lis.FD.FD())
+	if err != nil {
+		t.Fatalf("getsockname: %v", err)
+	}
+	sa := ephemeral.(*unix.SockaddrInet4)
+
+	// Connections to the process's ephemeral listener that don't come from
+	// the dispatcher: one sends nothing, the other sends a bogus cookie.
+	for _, b := range []string{"", "12345678"} {
+		conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", sa.Port))
+		if err != nil {
+			t.Fatalf("dial ephemeral: %v", err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, b)
+	}
+
+	client, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	io.WriteString(client, "hello\n")
+
+	srv, errno, err := lis.Accept(0)
+	if err != nil || errno != 0 {
+		t.Fatalf("accept: errno=%v, err=%v", errno, err)
+	}
+	defer srv.Close()
+	if got := readLine(t, srv.FD.FD()); got != "hello\n" {
+		t.Errorf("got %q, want the client's bytes without the cookie", got)
+	}
+}
+
+func TestDispatchPortReuse(t *testing.T) {
+	ns := newTestNetns(t)
+
+	// Every connection, including the dispatcher's dials to the process,
+	// gets a local port out of these eight.
+	if err := ns.Enter(func() error {
+		return os.WriteFile("/proc/sys/net/ipv4/ip_local_port_range", []byte("40000 40007"), 0o644)
+	}); err != nil {
+		t.Skipf("cannot set port range: %v", err)
+	}
+
+	g := &global.Global{Config: config.New()}
+	lis, err := CreateSocketInNetns(g, event.New(), unix.AF_INET, unix.SOCK_STREAM, ns)
+	if err != nil {
+		t.Fatalf("create listening socket: %v", err)
+	}
+	defer lis.Close()
+	if errno, err := lis.Bind(netip.MustParseAddrPort("127.0.0.1:0")); err != nil || errno != 0 {
+		t.Fatalf("bind: errno=%v, err=%v", errno, err)
+	}
+	if errno, err := lis.Listen(8); err != nil || errno != 0 {
+		t.Fatalf("listen: errno=%v, err=%v", errno, err)
+	}
+	if err := unix.Listen(lis.FD.FD(), 8); err != nil {
+		t.Fatalf("listen(2): %v", err)
+	}
+	addr := lis.Inode.state.Load().listening.lis.Addr().String()
+
+	const total, clients = 300, 4
+	var sent sync.Map // line -> client address
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := i; j < total; j += clients {
+				conn, err := enterNetns(ns, func() (net.Conn, error) { return net.Dial("tcp4", addr) })
+				if err != nil {
+					t.Errorf("dial %d: %v", j, err)
+					return
+				}
+				line := fmt.Sprintf("client %d\n", j)
+				sent.Store(line, conn.LocalAddr().String())
+				io.WriteString(conn, line)
+				io.Copy(io.Discard, conn) // the process closes first
+				conn.Close()
+			}
+		}()
+	}
+
+	// A slow tracee that closes every connection as soon as it knows where
+	// it came from.
+	for range total {
+		srv, errno, err := lis.Accept(0)
+		if err != nil || errno != 0 {
+			t.Fatalf("accept: errno=%v, err=%v", errno, err)
+		}
+		line := readLine(t, srv.FD.FD())
+		want, ok := sent.Load(line)
+		if !ok {
+			t.Fatalf("accepted connection sent unexpected %q", line)
+		}
+		if got := srv.Inode.state.Load().connected.proxy.external.RemoteAddr().String(); got != want {
+			t.Errorf("%q: accepted connection paired with the proxy for client %s, want %s", strings.TrimSpace(line), got, want)
+		}
+		srv.Close()
+		time.Sleep(100 * time.Microsecond)
+	}
+	wg.Wait()
+}
+
+// TestAcceptedInodeNumber checks that accepted sockets, which are created
+// without their inode number, are still found by number in an InodeTable, and
+// that those closed before anything looked them up are dropped.
+func TestAcceptedInodeNumber(t *testing.T) {
+	lis, addr := listenTraced(t, 8)
+	itab := NewInodeTable()
+
+	var accepted []*Socket
+	for range 2 {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		srv, errno, err := lis.Accept(0)
+		if err != nil || errno != 0 {
+			t.Fatalf("accept: errno=%v, err=%v", errno, err)
+		}
+		itab.Add(srv.Inode)
+		accepted = append(accepted, srv)
+	}
+	defer accepted[0].Close()
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(accepted[0].FD.FD(), &stat); err != nil {
+		t.Fatalf("fstat: %v", err)
+	}
+	accepted[1].Close()
+	if ino, ok := itab.Get(stat.Ino); !ok || ino != accepted[0].Inode {
+		t.Errorf("got inode %v for number %d, want the accepted socket's", ino, stat.Ino)
+	}
+	if n := accepted[0].Inode.Number(); n != stat.Ino {
+		t.Errorf("got inode number %d, want %d", n, stat.Ino)
+	}
+	if got := len(itab.Snapshot()); got != 1 {
+		t.Errorf("got %d inodes, want the open one", got)
+	}
+}
+
+// BenchmarkAcceptRate accepts connections dialed at 10k/s and reports the CPU
+// time the accepting thread spends per accepted connection, which is what
+// handling accept(2) for the tracee costs. The dispatcher and the proxies run
+// on other threads and aren't counted.
+func BenchmarkAcceptRate(b *testing.B) {
+	const rate = 10000 // connections per second
+	lis, addr := listenTraced(b, 1024)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		tick := time.NewTicker(time.Millisecond)
+		defer tick.Stop()
+		for dialed := 0; dialed < b.N; {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+			}
+			for i := 0; i < rate/1000 && dialed < b.N; i++ {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					continue
+				}
+				conn.Close()
+				dialed++
+			}
+		}
+	}()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var cpu time.Duration
+	var before, after unix.Rusage
+	b.ResetTimer()
+	for range b.N {
+		unix.Getrusage(unix.RUSAGE_THREAD, &before)
+		srv, errno, err := lis.Accept(0)
+		unix.Getrusage(unix.RUSAGE_THREAD, &after)
+		if err != nil || errno != 0 {
+			b.Fatalf("accept: errno=%v, err=%v", errno, err)
+		}
+		cpu += time.Duration(after.Utime.Nano() + after.Stime.Nano() - before.Utime.Nano() - before.Stime.Nano())
+		srv.Close()
+	}
+	b.ReportMetric(float64(cpu.Nanoseconds())/float64(b.N), "cpu-ns/accept")
+}
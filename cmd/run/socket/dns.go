@@ -0,0 +1,540 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/tracer"
+)
+
+// TraceDNS makes the DNS lookups the tracee does publish an event each, from
+// the query to the response that answers it. Queries over UDP are observed as
+// the tracee sends them on a datagram socket and the response as it receives
+// it, without either being emulated (see EnableDNSTracing in the process
+// package). Queries over TCP, which resolvers fall back to when a UDP response
+// is truncated, are read from the proxied connection.
+//
+// The addresses a lookup resolved are remembered so that the events of
+// connections to them later name the lookup (dns_event_id) and the first
+// exchange on the first such connection has the lookup's DNS timing.
+var TraceDNS bool
+
+const (
+	maxPendingDNSQueries = 1024
+	maxResolvedDNSAddrs  = 4096
+	maxDNSAnswerAddrs    = 16
+
+	// dnsQueryTimeout is how long a query waits for its response before its
+	// event is published without one.
+	dnsQueryTimeout = 10 * time.Second
+
+	// minDNSResolutionTTL keeps resolved addresses long enough to link the
+	// connection that usually follows a lookup right away even if the answer
+	// has a TTL of zero, and maxDNSResolutionTTL bounds how stale a link can
+	// get.
+	minDNSResolutionTTL = time.Minute
+	maxDNSResolutionTTL = time.Hour
+
+	// maxDNSMessage is the largest DNS message, the limit of the two byte
+	// length prefix of DNS over TCP.
+	maxDNSMessage = 65535
+)
+
+// dnsMessage is what a query or response says.
+type dnsMessage struct {
+	id        uint16
+	response  bool
+	name      string // of the first question, without the trailing dot
+	qtype     dnsmessage.Type
+	rcode     dnsmessage.RCode
+	truncated bool         // the TC bit
+	edns0     int          // UDP payload size of the OPT record, 0 if there's none
+	answers   int          // resource records in the answer section
+	addrs     []netip.Addr // A and AAAA answers, at most maxDNSAnswerAddrs
+	cnames    []string
+	ttl       uint32 // smallest TTL of the address answers
+}
+
+// parseDNSMessage parses a query or response. Messages that are cut short
+// after the question, like truncated responses, keep what was read before.
+func parseDNSMessage(b []byte) (dnsMessage, bool) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(b)
+	if err != nil {
+		return dnsMessage{}, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return dnsMessage{}, false
+	}
+	m := dnsMessage{
+		id:        hdr.ID,
+		response:  hdr.Response,
+		name:      strings.TrimSuffix(q.Name.String(), "."),
+		qtype:     q.Type,
+		rcode:     hdr.RCode,
+		truncated: hdr.Truncated,
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return m, true
+	}
+
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		m.answers++
+		var addr netip.Addr
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return m, true
+			}
+			addr = netip.AddrFrom4(r.A)
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return m, true
+			}
+			addr = netip.AddrFrom16(r.AAAA)
+		case dnsmessage.TypeCNAME:
+			r, err := p.CNAMEResource()
+			if err != nil {
+				return m, true
+			}
+			m.cnames = append(m.cnames, strings.TrimSuffix(r.CNAME.String(), "."))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return m, true
+			}
+		}
+		if addr.IsValid() && len(m.addrs) < maxDNSAnswerAddrs {
+			if len(m.addrs) == 0 || h.TTL < m.ttl {
+				m.ttl = h.TTL
+			}
+			m.addrs = append(m.addrs, addr)
+		}
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return m, true
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			break
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			m.edns0 = int(h.Class)
+		}
+		if err := p.SkipAdditional(); err != nil {
+			break
+		}
+	}
+	return m, true
+}
+
+// dnsTypeName returns the mnemonic of a query type, e.g. AAAA.
+func dnsTypeName(t dnsmessage.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+// dnsRCodeName returns the mnemonic of a response code, e.g. NXDOMAIN.
+func dnsRCodeName(rcode dnsmessage.RCode) string {
+	switch rcode {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// dnsKey matches a response to its query: the same transaction ID from the
+// server the query was sent to, on the same socket or connection (which stands
+// in for the local half of the 5-tuple, since an unbound UDP socket only gets
+// its port when the query is sent).
+type dnsKey struct {
+	conn   any
+	server netip.AddrPort
+	id     uint16
+}
+
+// dnsQuery is a query waiting for its response.
+type dnsQuery struct {
+	global    *global.Global
+	tmpl      *event.Event
+	transport string
+	server    netip.AddrPort
+	msg       dnsMessage
+	sent      time.Time
+	timer     *time.Timer
+}
+
+// dnsResolution is an address a lookup resolved.
+type dnsResolution struct {
+	name    string
+	eventID string
+	latency time.Duration
+	expires time.Time
+	claimed bool // by the first connection to the address (see claimDNS)
+}
+
+var dnsLookups = struct {
+	mu       sync.Mutex
+	pending  map[dnsKey]*dnsQuery
+	perConn  map[any]int
+	resolved map[netip.Addr]*dnsResolution
+}{
+	pending:  make(map[dnsKey]*dnsQuery),
+	perConn:  make(map[any]int),
+	resolved: make(map[netip.Addr]*dnsResolution),
+}
+
+// observeDNSQuery records a DNS query sent to server on conn. Retransmissions
+// of a query that's still pending keep the time of the first one.
+func observeDNSQuery(g *global.Global, tmpl *event.Event, conn any, transport string, server netip.AddrPort, b []byte) {
+	m, ok := parseDNSMessage(b)
+	if !ok || m.response {
+		return
+	}
+	server = unmapAddrPort(server)
+	key := dnsKey{conn: conn, server: server, id: m.id}
+
+	dnsLookups.mu.Lock()
+	defer dnsLookups.mu.Unlock()
+	if _, ok := dnsLookups.pending[key]; ok {
+		return
+	}
+	if len(dnsLookups.pending) >= maxPendingDNSQueries {
+		slog.Debug("dns: too many pending queries, dropping", "name", m.name, "server", server)
+		return
+	}
+	q := &dnsQuery{global: g, tmpl: tmpl, transport: transport, server: server, msg: m, sent: time.Now()}
+	q.timer = time.AfterFunc(dnsQueryTimeout, func() {
+		if takeDNSQuery(key, q) {
+			q.publish(nil, dnsQueryTimeout)
+		}
+	})
+	dnsLookups.pending[key] = q
+	dnsLookups.perConn[conn]++
+}
+
+// takeDNSQuery removes the query pending under key if it's still q.
+func takeDNSQuery(key dnsKey, q *dnsQuery) bool {
+	dnsLookups.mu.Lock()
+	defer dnsLookups.mu.Unlock()
+	return takeDNSQueryLocked(key, q)
+}
+
+func takeDNSQueryLocked(key dnsKey, q *dnsQuery) bool {
+	if dnsLookups.pending[key] != q {
+		return false
+	}
+	delete(dnsLookups.pending, key)
+	if dnsLookups.perConn[key.conn]--; dnsLookups.perConn[key.conn] <= 0 {
+		delete(dnsLookups.perConn, key.conn)
+	}
+	return true
+}
+
+// hasPendingDNS reports whether any query sent on conn awaits its response.
+func hasPendingDNS(conn any) bool {
+	dnsLookups.mu.Lock()
+	defer dnsLookups.mu.Unlock()
+	return dnsLookups.perConn[conn] > 0
+}
+
+// observeDNSResponse matches a DNS response received from server on conn to
+// its query and publishes the lookup. Responses to no pending query, like a
+// duplicate or one for a different question, are ignored.
+func observeDNSResponse(conn any, server netip.AddrPort, b []byte) {
+	m, ok := parseDNSMessage(b)
+	if !ok || !m.response {
+		return
+	}
+	key := dnsKey{conn: conn, server: unmapAddrPort(server), id: m.id}
+
+	dnsLookups.mu.Lock()
+	q, ok := dnsLookups.pending[key]
+	if !ok || !strings.EqualFold(q.msg.name, m.name) || q.msg.qtype != m.qtype {
+		dnsLookups.mu.Unlock()
+		return
+	}
+	takeDNSQueryLocked(key, q)
+	dnsLookups.mu.Unlock()
+
+	q.timer.Stop()
+	q.publish(&m, time.Since(q.sent))
+}
+
+// publish publishes the event of a lookup and remembers the addresses it
+// resolved. resp is nil if the query timed out.
+func (q *dnsQuery) publish(resp *dnsMessage, latency time.Duration) {
+	ev := q.tmpl.Copy()
+	ev.Set("dest_addr", event.Intern(q.server.String()))
+	ev.Set("dest_family", addrFamily(q.server.Addr()))
+	ev.Set("dns_transport", q.transport)
+	ev.Set("dns_query_name", q.msg.name)
+	ev.Set("dns_query_type", dnsTypeName(q.msg.qtype))
+	if q.msg.edns0 > 0 {
+		ev.Set("dns_edns0_udp_size", fmt.Sprintf("%d", q.msg.edns0))
+	}
+	ev.Set("dns_latency_ms", fmt.Sprintf("%d", latency.Milliseconds()))
+	tracer.AddDecision(ev, tracer.Decision{Layer: "protocol", Verdict: "dns", Detail: q.transport}, tracer.CaptureMetadata)
+
+	if resp == nil {
+		ev.Set("dns_response_code", "TIMEOUT")
+		if q.global != nil && q.global.Config != nil {
+			go tracer.PublishConnection(q.global, ev, fmt.Sprintf("dns %s %s no response from %s (%s)", dnsTypeName(q.msg.qtype), q.msg.name, q.server, q.transport))
+		}
+		return
+	}
+
+	rcode := dnsRCodeName(resp.rcode)
+	ev.Set("dns_response_code", rcode)
+	ev.Set("dns_answer_count", fmt.Sprintf("%d", resp.answers))
+	addrs := make([]string, len(resp.addrs))
+	for i, addr := range resp.addrs {
+		addrs[i] = addr.String()
+	}
+	if len(addrs) > 0 {
+		ev.Set("dns_answers", strings.Join(addrs, ","))
+	}
+	if len(resp.cnames) > 0 {
+		ev.Set("dns_cnames", strings.Join(resp.cnames, ","))
+	}
+	if resp.truncated {
+		ev.Set("dns_truncated", "true")
+	}
+	if resp.edns0 > 0 {
+		ev.Set("dns_response_edns0_udp_size", fmt.Sprintf("%d", resp.edns0))
+	}
+
+	if resp.rcode == dnsmessage.RCodeSuccess && !resp.truncated {
+		recordDNSResolution(resp.addrs, q.msg.name, ev.Get("event_id"), latency, resp.ttl)
+	}
+
+	if q.global != nil && q.global.Config != nil {
+		summary := fmt.Sprintf("dns %s %s %s", dnsTypeName(q.msg.qtype), q.msg.name, rcode)
+		if len(addrs) > 0 {
+			summary += " " + strings.Join(addrs, ",")
+		}
+		if resp.truncated {
+			summary += " truncated"
+		}
+		go tracer.PublishConnection(q.global, ev, fmt.Sprintf("%s (%s, %s)", summary, q.transport, latency.Round(100*time.Microsecond)))
+	}
+}
+
+// recordDNSResolution remembers that a lookup of name resolved addrs for
+// about ttl seconds. A later lookup that resolves the same address replaces
+// the earlier one.
+func recordDNSResolution(addrs []netip.Addr, name string, eventID string, latency time.Duration, ttl uint32) {
+	if len(addrs) == 0 {
+		return
+	}
+	keep := min(max(time.Duration(ttl)*time.Second, minDNSResolutionTTL), maxDNSResolutionTTL)
+	now := time.Now()
+
+	dnsLookups.mu.Lock()
+	defer dnsLookups.mu.Unlock()
+	if len(dnsLookups.resolved)+len(addrs) > maxResolvedDNSAddrs {
+		for addr, r := range dnsLookups.resolved {
+			if now.After(r.expires) {
+				delete(dnsLookups.resolved, addr)
+			}
+		}
+	}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if _, ok := dnsLookups.resolved[addr]; !ok && len(dnsLookups.resolved) >= maxResolvedDNSAddrs {
+			continue
+		}
+		dnsLookups.resolved[addr] = &dnsResolution{name: name, eventID: eventID, latency: latency, expires: now.Add(keep)}
+	}
+}
+
+// dnsResolutionFor returns the name and event ID of the latest lookup that
+// resolved addr, if it hasn't expired.
+func dnsResolutionFor(addr netip.Addr) (name string, eventID string, ok bool) {
+	dnsLookups.mu.Lock()
+	defer dnsLookups.mu.Unlock()
+	r, ok := dnsLookups.resolved[addr.Unmap()]
+	if !ok || time.Now().After(r.expires) {
+		return "", "", false
+	}
+	return r.name, r.eventID, true
+}
+
+// claimDNS returns how long the lookup that resolved addr took if no
+// connection to addr claimed it before, like a browser attributes a lookup to
+// the first request that needed it.
+func claimDNS(addr netip.Addr) (time.Duration, bool) {
+	dnsLookups.mu.Lock()
+	defer dnsLookups.mu.Unlock()
+	r, ok := dnsLookups.resolved[addr.Unmap()]
+	if !ok || r.claimed || time.Now().After(r.expires) {
+		return 0, false
+	}
+	r.claimed = true
+	return r.latency, true
+}
+
+// DNSDestination returns where a datagram sent on a datagram socket goes if
+// that's port 53: to, the destination passed to sendto(2) or sendmsg(2), or
+// the connected peer if there's none.
+func (s *Socket) DNSDestination(to netip.AddrPort) (netip.AddrPort, bool) {
+	if !to.IsValid() {
+		f := s.Inode.flow
+		f.mu.Lock()
+		to = f.connected
+		f.mu.Unlock()
+	}
+	return to, to.Port() == 53
+}
+
+// ObserveDNSSend records a datagram sent on a datagram socket, by the kernel
+// or by an emulated send. If it's a DNS query, its response is waited for.
+func (s *Socket) ObserveDNSSend(to netip.AddrPort, b []byte) {
+	if to, ok := s.DNSDestination(to); ok {
+		observeDNSQuery(s.global, s.tmpl, s.Inode, "udp", to, b)
+	}
+}
+
+// ObserveDNSReceive peeks at the datagram the tracee is about to receive on a
+// datagram socket, if one is queued and a DNS query sent on the socket awaits
+// its response. The datagram stays queued for the tracee.
+func (s *Socket) ObserveDNSReceive() {
+	if !hasPendingDNS(s.Inode) || !s.FD.IncRef() {
+		return
+	}
+	defer s.FD.DecRef()
+
+	b := make([]byte, maxDNSMessage)
+	n, from, err := unix.Recvfrom(s.FD.FD(), b, unix.MSG_PEEK|unix.MSG_DONTWAIT)
+	if err != nil || from == nil {
+		return
+	}
+	var server netip.AddrPort
+	switch sa := from.(type) {
+	case *unix.SockaddrInet4:
+		server = netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port))
+	case *unix.SockaddrInet6:
+		server = netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), uint16(sa.Port))
+	default:
+		return
+	}
+	observeDNSResponse(s.Inode, server, b[:n])
+}
+
+// isDNSOverTCP reports whether the first bytes a client sent on a connection
+// to port 53 are a length-prefixed DNS query.
+func isDNSOverTCP(sample []byte) bool {
+	if len(sample) < 2+12 {
+		return false
+	}
+	size := int(binary.BigEndian.Uint16(sample))
+	if size < 12 {
+		return false
+	}
+	b := sample[2:]
+	if len(b) > size {
+		b = b[:size]
+	}
+	// Any 12 bytes parse as a header, so also require what every query has:
+	// the QUERY opcode and a single question.
+	var p dnsmessage.Parser
+	hdr, err := p.Start(b)
+	return err == nil && !hdr.Response && b[2]&0x78 == 0 && binary.BigEndian.Uint16(b[4:]) == 1
+}
+
+// dnsStreamTap reassembles the length-prefixed messages of one direction of a
+// DNS over TCP connection from the bytes copied through it.
+type dnsStreamTap struct {
+	buf       []byte
+	onMessage func([]byte)
+}
+
+func (t *dnsStreamTap) Write(b []byte) (int, error) {
+	t.buf = append(t.buf, b...)
+	for len(t.buf) >= 2 {
+		size := int(binary.BigEndian.Uint16(t.buf))
+		if len(t.buf) < 2+size {
+			break
+		}
+		t.onMessage(t.buf[2 : 2+size])
+		t.buf = t.buf[2+size:]
+	}
+	if len(t.buf) == 0 {
+		t.buf = nil
+	}
+	return len(b), nil
+}
+
+// externalAddr returns the literal address the external connection of a proxy
+// is connected to, if it's an IP one.
+func (p *proxy) externalAddr() (netip.AddrPort, bool) {
+	ap, err := netip.ParseAddrPort(p.externalInfo.Remote)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return unmapAddrPort(ap), true
+}
+
+// isDNSServer reports whether an outgoing proxy is connected to port 53.
+func (p *proxy) isDNSServer() bool {
+	ap, ok := p.externalAddr()
+	return ok && ap.Port() == 53
+}
+
+// claimDNS returns how long the lookup of the address an outgoing proxy is
+// connected to took, if this is the first connection to it since (see the
+// claimDNS function).
+func (p *proxy) claimDNS() (time.Duration, bool) {
+	if !TraceDNS {
+		return 0, false
+	}
+	ap, ok := p.externalAddr()
+	if !ok {
+		return 0, false
+	}
+	return claimDNS(ap.Addr())
+}
+
+// proxyDNS forwards a DNS over TCP connection as is and publishes every query
+// on it with its response.
+func (p *proxy) proxyDNS(cli, srv *bufConn) error {
+	server, ok := p.externalAddr()
+	if !ok {
+		return p.proxyFallback(cli, srv)
+	}
+	cliTap := &dnsStreamTap{onMessage: func(b []byte) {
+		observeDNSQuery(p.global, p.tmpl, p, "tcp", server, b)
+	}}
+	srvTap := &dnsStreamTap{onMessage: func(b []byte) {
+		observeDNSResponse(p, server, b)
+	}}
+	return p.proxyRaw(cli, srv, cliTap, srvTap)
+}
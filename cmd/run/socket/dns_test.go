@@ -0,0 +1,205 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/tracer"
+)
+
+// dnsTestMessage builds a query for name, with an EDNS0 OPT record, or the
+// response to it with the given answers.
+func dnsTestMessage(t *testing.T, id uint16, name string, response bool, truncated bool, answers ...netip.Addr) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: response, Truncated: truncated, RecursionDesired: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	qname := dnsmessage.MustNewName(name + ".")
+	b.Question(dnsmessage.Question{Name: qname, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	b.StartAnswers()
+	if len(answers) > 0 {
+		cname := dnsmessage.MustNewName("edge." + name + ".")
+		b.CNAMEResource(dnsmessage.ResourceHeader{Name: qname, Class: dnsmessage.ClassINET, TTL: 300}, dnsmessage.CNAMEResource{CNAME: cname})
+		for _, addr := range answers {
+			b.AResource(dnsmessage.ResourceHeader{Name: cname, Class: dnsmessage.ClassINET, TTL: 30}, dnsmessage.AResource{A: addr.As4()})
+		}
+	}
+	b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatalf("set EDNS0: %v", err)
+	}
+	b.OPTResource(opt, dnsmessage.OPTResource{})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("build DNS message: %v", err)
+	}
+	return msg
+}
+
+// TestDNSLookup sends a query on a traced datagram socket, observes the
+// response without consuming it, and checks the lookup's event and that the
+// resolved addresses link back to it.
+func TestDNSLookup(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer server.Close()
+	serverAddr := server.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	g := &global.Global{Config: config.New()}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_DGRAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+
+	answers := []netip.Addr{netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("192.0.2.11")}
+	query := dnsTestMessage(t, 0x1234, "dns-lookup.example.com", false, false)
+	if err := unix.Sendto(sock.FD.FD(), query, 0, &unix.SockaddrInet4{Addr: serverAddr.Addr().As4(), Port: int(serverAddr.Port())}); err != nil {
+		t.Fatalf("send query: %v", err)
+	}
+	// The process package only observes queries to port 53.
+	observeDNSQuery(sock.global, sock.tmpl, sock.Inode, "udp", serverAddr, query)
+	if !hasPendingDNS(sock.Inode) {
+		t.Fatalf("the query isn't pending")
+	}
+
+	buf := make([]byte, 512)
+	n, client, err := server.ReadFromUDPAddrPort(buf)
+	if err != nil || string(buf[:n]) != string(query) {
+		t.Fatalf("server read %q, %v", buf[:n], err)
+	}
+	server.WriteToUDPAddrPort(dnsTestMessage(t, 0x9999, "dns-lookup.example.com", true, false, answers[0]), client) // another transaction
+	response := dnsTestMessage(t, 0x1234, "dns-lookup.example.com", true, false, answers...)
+	server.WriteToUDPAddrPort(response, client)
+
+	// Observe each datagram like the recvfrom(2) handler does and then receive
+	// it like the tracee.
+	for i := range 2 {
+		fds := []unix.PollFd{{Fd: int32(sock.FD.FD()), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, 5000); err != nil {
+			t.Fatalf("poll: %v", err)
+		}
+		sock.ObserveDNSReceive()
+		n, _, err := unix.Recvfrom(sock.FD.FD(), buf, 0)
+		if err != nil {
+			t.Fatalf("receive %d: %v", i, err)
+		}
+		if i == 1 && string(buf[:n]) != string(response) {
+			t.Errorf("the tracee received %q, want the response", buf[:n])
+		}
+	}
+	if hasPendingDNS(sock.Inode) {
+		t.Errorf("the query is still pending")
+	}
+
+	var tags map[string]string
+	testutil.WaitFor(t, "the lookup's event", func() bool {
+		for _, ev := range tracer.RecentConnections() {
+			if ev["dns_query_name"] == "dns-lookup.example.com" {
+				tags = ev
+				return true
+			}
+		}
+		return false
+	})
+	for k, want := range map[string]string{
+		"dest_addr":          serverAddr.String(),
+		"dns_transport":      "udp",
+		"dns_query_name":     "dns-lookup.example.com",
+		"dns_query_type":     "A",
+		"dns_response_code":  "NOERROR",
+		"dns_answers":        "192.0.2.10,192.0.2.11",
+		"dns_answer_count":   "3",
+		"dns_cnames":         "edge.dns-lookup.example.com",
+		"dns_edns0_udp_size": "1232",
+		"capture_level":      tracer.CaptureMetadata,
+	} {
+		if got := tags[k]; got != want {
+			t.Errorf("tag %s = %q, want %q", k, got, want)
+		}
+	}
+	if tags["dns_latency_ms"] == "" || tags["dns_truncated"] != "" {
+		t.Errorf("got tags %v", tags)
+	}
+
+	for _, addr := range answers {
+		name, eventID, ok := dnsResolutionFor(addr)
+		if !ok || name != "dns-lookup.example.com" || eventID != tags["event_id"] {
+			t.Errorf("%s: got resolution %q %q %v, want the lookup's", addr, name, eventID, ok)
+		}
+	}
+	if _, ok := claimDNS(answers[0]); !ok {
+		t.Errorf("the first connection didn't claim the lookup")
+	}
+	if _, ok := claimDNS(answers[0]); ok {
+		t.Errorf("a second connection claimed the lookup")
+	}
+}
+
+// TestDNSOverTCP checks that queries and responses split across and packed
+// into writes of a DNS over TCP connection are matched, and that a truncated
+// response doesn't link its addresses.
+func TestDNSOverTCP(t *testing.T) {
+	server := netip.MustParseAddrPort("192.0.2.53:53")
+	conn := new(int)
+	var published []*dnsMessage
+	record := func(b []byte) {
+		m, ok := parseDNSMessage(b)
+		if !ok {
+			t.Fatalf("parse %q", b)
+		}
+		published = append(published, &m)
+	}
+
+	frame := func(msgs ...[]byte) []byte {
+		var b []byte
+		for _, msg := range msgs {
+			b = binary.BigEndian.AppendUint16(b, uint16(len(msg)))
+			b = append(b, msg...)
+		}
+		return b
+	}
+	q1 := dnsTestMessage(t, 1, "tcp-one.example.com", false, false)
+	q2 := dnsTestMessage(t, 2, "tcp-two.example.com", false, false)
+	if !isDNSOverTCP(frame(q1)) || isDNSOverTCP([]byte("GET / HTTP/1.1\r\n")) {
+		t.Errorf("isDNSOverTCP is wrong")
+	}
+
+	cli := &dnsStreamTap{onMessage: func(b []byte) {
+		record(b)
+		observeDNSQuery(nil, event.New(), conn, "tcp", server, b)
+	}}
+	both := frame(q1, q2)
+	cli.Write(both[:5])
+	cli.Write(both[5:])
+	if len(published) != 2 || published[0].name != "tcp-one.example.com" || published[1].edns0 != 1232 {
+		t.Fatalf("got queries %+v", published)
+	}
+
+	srv := &dnsStreamTap{onMessage: func(b []byte) { observeDNSResponse(conn, server, b) }}
+	srv.Write(frame(dnsTestMessage(t, 2, "tcp-two.example.com", true, false, netip.MustParseAddr("192.0.2.20"))))
+	srv.Write(frame(dnsTestMessage(t, 1, "tcp-one.example.com", true, true, netip.MustParseAddr("192.0.2.21"))))
+	if hasPendingDNS(conn) {
+		t.Errorf("queries are still pending")
+	}
+	if name, _, ok := dnsResolutionFor(netip.MustParseAddr("192.0.2.20")); !ok || name != "tcp-two.example.com" {
+		t.Errorf("got resolution %q %v", name, ok)
+	}
+	if _, _, ok := dnsResolutionFor(netip.MustParseAddr("192.0.2.21")); ok {
+		t.Errorf("a truncated response was linked")
+	}
+}
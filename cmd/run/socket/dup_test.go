@@ -0,0 +1,84 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/fd"
+	"subtrace.dev/event"
+)
+
+// TestDupSharedInode closes the sockets of a connection that the process
+// duplicated with dup(2) one at a time. The connection must stay usable until
+// the last one is closed.
+func TestDupSharedInode(t *testing.T) {
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	sock, conn := dialTraced(t, netip.MustParseAddrPort(lis.Addr().String()))
+	if sock == nil {
+		return
+	}
+	defer conn.Close()
+
+	var dups []*Socket
+	for range 2 {
+		n, err := unix.FcntlInt(uintptr(sock.FD.FD()), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			t.Fatalf("dup: %v", err)
+		}
+		dup := fd.NewFD(n)
+		dups = append(dups, NewSocket(sock.global, event.New(), sock.Inode, dup))
+		dup.DecRef()
+	}
+
+	echo := func(msg string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != msg {
+			t.Fatalf("got %q, %v, want %q", b, err, msg)
+		}
+	}
+
+	for i, s := range append([]*Socket{sock}, dups...) {
+		echo("before close")
+		if errno := s.Close(); errno != 0 {
+			t.Fatalf("close %d: %v", i, errno)
+		}
+		last := i == len(dups)
+		if closed := sock.Inode.state.Load().state == StateClosed; closed != last {
+			t.Fatalf("after closing %d of %d sockets: got closed=%v, want %v", i+1, len(dups)+1, closed, last)
+		}
+	}
+
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server connection still open after the last socket was closed")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/syscalls"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/tracer"
+)
+
+// When subtrace fails to emulate a syscall because of a failure on one of its
+// own sockets (the dummy listener, the loopback dial, the ephemeral listener),
+// the tracee still needs an answer. It should be an errno the syscall is
+// documented to return so that the application handles it like it would
+// without subtrace, and one that's as close as possible to what actually went
+// wrong. ENOSYS is neither: applications read it as the syscall not existing.
+
+// errnoRule is how internal failures of one syscall are reported to the tracee.
+type errnoRule struct {
+	fallback syscall.Errno          // when the cause has no faithful equivalent
+	allowed  map[syscall.Errno]bool // causes that are passed through as-is
+	resource syscall.Errno          // for resource exhaustion not in allowed, or 0 to use fallback
+}
+
+func errnoSet(errnos ...syscall.Errno) map[syscall.Errno]bool {
+	ret := make(map[syscall.Errno]bool, len(errnos))
+	for _, errno := range errnos {
+		ret[errno] = true
+	}
+	return ret
+}
+
+var sendRule = errnoRule{
+	fallback: unix.ENOBUFS,
+	allowed:  errnoSet(unix.ENOBUFS, unix.ENOMEM, unix.EPIPE, unix.ECONNRESET),
+}
+
+// errnoRules has a rule for every syscall that's emulated rather than only
+// observed. Internal failures of the others are handed back to the kernel to
+// run the syscall itself.
+var errnoRules = map[int]errnoRule{
+	unix.SYS_SOCKET: {
+		fallback: unix.ENOBUFS,
+		allowed:  errnoSet(unix.EMFILE, unix.ENFILE, unix.ENOBUFS, unix.ENOMEM),
+	},
+	unix.SYS_CONNECT: {
+		fallback: unix.ENETUNREACH,
+		allowed:  errnoSet(unix.EADDRNOTAVAIL, unix.EAGAIN, unix.ECONNREFUSED, unix.ENETUNREACH, unix.EHOSTUNREACH, unix.ETIMEDOUT),
+		resource: unix.EAGAIN,
+	},
+	unix.SYS_BIND: {
+		fallback: unix.EADDRNOTAVAIL,
+		allowed:  errnoSet(unix.EADDRINUSE, unix.EADDRNOTAVAIL, unix.ENOMEM),
+	},
+	unix.SYS_LISTEN: {
+		fallback: unix.EADDRINUSE,
+		allowed:  errnoSet(unix.EADDRINUSE),
+	},
+	unix.SYS_ACCEPT: {
+		fallback: unix.ECONNABORTED,
+		allowed:  errnoSet(unix.EMFILE, unix.ENFILE, unix.ENOBUFS, unix.ENOMEM),
+	},
+	unix.SYS_ACCEPT4: {
+		fallback: unix.ECONNABORTED,
+		allowed:  errnoSet(unix.EMFILE, unix.ENFILE, unix.ENOBUFS, unix.ENOMEM),
+	},
+	unix.SYS_SHUTDOWN: {
+		fallback: unix.ENOTCONN,
+	},
+	unix.SYS_GETSOCKNAME: {
+		fallback: unix.ENOBUFS,
+		allowed:  errnoSet(unix.ENOBUFS),
+	},
+	unix.SYS_GETPEERNAME: {
+		fallback: unix.ENOBUFS,
+		allowed:  errnoSet(unix.ENOBUFS, unix.ENOTCONN),
+	},
+	unix.SYS_GETSOCKOPT: {
+		fallback: unix.ENOBUFS,
+		allowed:  errnoSet(unix.ENOBUFS, unix.ENOMEM),
+	},
+	unix.SYS_SETSOCKOPT: {
+		fallback: unix.ENOBUFS,
+		allowed:  errnoSet(unix.ENOBUFS, unix.ENOMEM),
+	},
+	unix.SYS_CLOSE: {
+		fallback: unix.EIO,
+	},
+	unix.SYS_WRITEV:   sendRule,
+	unix.SYS_SENDMSG:  sendRule,
+	unix.SYS_SENDMMSG: sendRule,
+}
+
+func isResourceExhaustion(errno syscall.Errno) bool {
+	switch errno {
+	case unix.EMFILE, unix.ENFILE, unix.ENOBUFS, unix.ENOMEM:
+		return true
+	}
+	return false
+}
+
+// TranslateError returns the errno that syscall nr should fail with in the
+// tracee when subtrace couldn't emulate it because of err. It returns false
+// if the syscall should be handed back to the kernel instead. The errno is
+// never ENOSYS.
+func TranslateError(nr int, err error) (syscall.Errno, bool) {
+	rule, ok := errnoRules[nr]
+	if !ok {
+		return 0, false
+	}
+
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &errno):
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		errno = unix.ETIMEDOUT
+	default:
+		return rule.fallback, true
+	}
+
+	switch {
+	case rule.allowed[errno]:
+		return errno, true
+	case rule.resource != 0 && isResourceExhaustion(errno):
+		return rule.resource, true
+	default:
+		return rule.fallback, true
+	}
+}
+
+// NoteInternalError logs and publishes a diagnostic event for an internal
+// failure at site that the tracee saw as errno from syscall nr. tmpl holds the
+// tags of the tracee's process, if known.
+func NoteInternalError(g *global.Global, tmpl *event.Event, nr int, site string, err error, errno syscall.Errno) {
+	name := syscalls.GetName(nr)
+	slog.Warn("internal failure handed to the tracee as an errno", "syscall", name, "site", site, "errno", errno, "err", err)
+
+	if g == nil || g.Config == nil {
+		return
+	}
+	var ev *event.Event
+	if tmpl != nil {
+		ev = tmpl.Copy()
+	} else {
+		ev = event.New()
+	}
+	ev.Set("internal_error_syscall", name)
+	ev.Set("internal_error_site", site)
+	ev.Set("internal_error_cause", err.Error())
+	ev.Set("internal_error_errno", unix.ErrnoName(errno))
+	go tracer.PublishConnection(g, ev, fmt.Sprintf("%s failed with %s because of an internal error at %s: %v", name, unix.ErrnoName(errno), site, err))
+}
@@ -0,0 +1,42 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"subtrace.dev/tracer"
+)
+
+// captureEvents writes the events published during the test to a temporary
+// event log. It returns a function that reads back the lines written so far.
+func captureEvents(t *testing.T) func() []tracer.EventLogLine {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := tracer.OpenEventLog(path)
+	if err != nil {
+		t.Fatalf("open event log: %v", err)
+	}
+	prev := tracer.DefaultEventLog
+	tracer.DefaultEventLog = l
+	t.Cleanup(func() {
+		tracer.DefaultEventLog = prev
+		l.Close()
+	})
+
+	return func() []tracer.EventLogLine {
+		b, _ := os.ReadFile(path)
+		var lines []tracer.EventLogLine
+		for _, s := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			var line tracer.EventLogLine
+			if json.Unmarshal([]byte(s), &line) == nil {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"subtrace.dev/tracer"
+)
+
+// headerFilter is what the HTTP/1 parser reads one direction of a connection
+// through. While it's armed, it passes the start line of the next message and
+// only the header lines that fit the tracer's header limits, so that a header
+// bomb never reaches net/http, which would buffer all of it. It disarms itself
+// at the end of the header section and passes the body through unchanged.
+//
+// It only changes what the parser sees. The forwarded bytes are copied before
+// the filter, and since the filter keeps consuming its input however long a
+// line is, the copy never stalls on it.
+type headerFilter struct {
+	armNext atomic.Bool
+	last    atomic.Pointer[tracer.HeaderBudget] // of the last header section
+
+	mu      sync.Mutex
+	r       *bufio.Reader
+	armed   bool
+	start   bool    // the next line is the start line
+	framing [2]bool // Content-Length and Transfer-Encoding were passed
+	budget  tracer.HeaderBudget
+	pending []byte // filtered bytes not yet read
+}
+
+func newHeaderFilter(r io.Reader) *headerFilter {
+	return &headerFilter{r: bufio.NewReader(r)}
+}
+
+// arm filters the header section of the next message. Bytes the parser has
+// already buffered aren't filtered again, but there are at most as many as
+// fit in its buffer, and the parser trims whatever gets through (see
+// tracer.Parser.UseRequest).
+func (f *headerFilter) arm() {
+	f.last.Store(nil)
+	f.armNext.Store(true)
+}
+
+// trimmed returns what the filter left out of the last header section.
+func (f *headerFilter) trimmed() tracer.HeaderBudget {
+	if b := f.last.Load(); b != nil {
+		return *b
+	}
+	return tracer.HeaderBudget{}
+}
+
+func (f *headerFilter) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.armNext.Swap(false) {
+		f.armed, f.start, f.framing = true, true, [2]bool{}
+		f.budget = tracer.HeaderBudget{}
+	}
+	for len(f.pending) == 0 {
+		if !f.armed {
+			return f.r.Read(b)
+		}
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// next filters the next line of the header section into pending.
+func (f *headerFilter) next() error {
+	limit := tracer.MaxHeaderBytes + len(": \r\n")
+	if f.start {
+		limit = tracer.MaxHeaderTotalBytes
+	}
+	line, err := f.readLine(limit)
+	if len(line) == 0 {
+		return err
+	}
+
+	switch {
+	case f.start:
+		f.start = false
+		f.pending = line
+	case len(bytes.TrimRight(line, "\r\n")) == 0:
+		f.armed = false
+		budget := f.budget
+		f.last.Store(&budget)
+		f.pending = line
+	case line[0] == ' ' || line[0] == '\t':
+		// Obsolete line folding would let a single header grow without bound,
+		// so the continuation lines are left out.
+		f.budget.Truncated++
+	default:
+		name, value, ok := bytes.Cut(bytes.TrimRight(line, "\r\n"), []byte(":"))
+		if !ok {
+			// Not a header line. net/http rejects it, but only if it gets it.
+			if _, keep := f.budget.Admit(string(name), ""); keep {
+				f.pending = line
+			}
+			break
+		}
+		if i := framingHeader(name); i >= 0 && !f.framing[i] {
+			// The parser needs the first of these to find the end of the
+			// message, whatever the limits.
+			f.framing[i] = true
+			f.pending = line
+			break
+		}
+		if v, keep := f.budget.Admit(string(name), string(value)); keep {
+			f.pending = slices.Concat(name, []byte(":"), []byte(v), []byte("\r\n"))
+		}
+	}
+	return nil
+}
+
+// framingHeader returns the index of Content-Length and Transfer-Encoding in
+// headerFilter.framing, or -1 for other headers.
+func framingHeader(name []byte) int {
+	switch {
+	case bytes.EqualFold(name, []byte("content-length")):
+		return 0
+	case bytes.EqualFold(name, []byte("transfer-encoding")):
+		return 1
+	default:
+		return -1
+	}
+}
+
+// readLine returns the next line with its line ending. A line longer than
+// limit is cut short and the rest of it is skipped without being buffered.
+func (f *headerFilter) readLine(limit int) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := f.r.ReadSlice('\n')
+		if len(line)+len(b) > limit {
+			line = append(line, b[:limit-len(line)]...)
+			for err == bufio.ErrBufferFull {
+				_, err = f.r.ReadSlice('\n')
+			}
+			if err != nil {
+				return nil, err
+			}
+			return append(line, "\r\n"...), nil
+		}
+		line = append(line, b...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
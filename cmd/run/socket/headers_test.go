@@ -0,0 +1,236 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/tracer"
+)
+
+// manyHeaders returns n short header lines.
+func manyHeaders(n int) string {
+	var b strings.Builder
+	for i := range n {
+		fmt.Fprintf(&b, "X-Bomb-%d: %d\r\n", i, i)
+	}
+	return b.String()
+}
+
+func TestHeaderFilter(t *testing.T) {
+	const next = "GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	for _, tt := range []struct {
+		name      string
+		headers   string
+		count     int
+		dropped   int
+		truncated int
+	}{
+		{
+			name:    "small",
+			headers: "Accept: */*\r\n",
+			count:   2,
+		},
+		{
+			name:    "many headers",
+			headers: manyHeaders(100_000),
+			count:   tracer.MaxHeaderCount,
+			dropped: 100_000 - tracer.MaxHeaderCount + 1,
+		},
+		{
+			name:      "large value",
+			headers:   "Cookie: " + strings.Repeat("c", 4<<20) + "\r\n",
+			count:     2,
+			truncated: 1,
+		},
+		{
+			name:      "folded",
+			headers:   "X-Folded: a\r\n" + strings.Repeat(" b\r\n", 100_000),
+			count:     2,
+			truncated: 100_000,
+		},
+		{
+			name:    "content-length after bomb",
+			headers: manyHeaders(10_000) + "Content-Length: 5\r\n",
+			count:   tracer.MaxHeaderCount,
+			dropped: 10_000 - tracer.MaxHeaderCount + 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "POST / HTTP/1.1\r\nHost: example.com\r\n" + tt.headers
+			if !strings.Contains(tt.headers, "Content-Length") {
+				raw += "Content-Length: 5\r\n"
+			}
+			raw += "\r\nhello" + next
+
+			f := newHeaderFilter(strings.NewReader(raw))
+			br := bufio.NewReader(f)
+			f.arm()
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				t.Fatalf("read request: %v", err)
+			}
+			n := 0
+			for _, values := range req.Header {
+				n += len(values)
+			}
+			// net/http moves Host out of the header, which makes room for the
+			// Content-Length that's let through regardless.
+			if n != tt.count {
+				t.Errorf("got %d headers, want %d", n, tt.count)
+			}
+			if b := f.trimmed(); b.Dropped != tt.dropped || b.Truncated != tt.truncated {
+				t.Errorf("got %d dropped and %d truncated, want %d and %d", b.Dropped, b.Truncated, tt.dropped, tt.truncated)
+			}
+			if body, err := io.ReadAll(req.Body); err != nil || string(body) != "hello" {
+				t.Errorf("got body %q, err=%v", body, err)
+			}
+
+			// The next request on the connection is filtered too.
+			f.arm()
+			req, err = http.ReadRequest(br)
+			if err != nil {
+				t.Fatalf("read next request: %v", err)
+			}
+			if req.URL.Path != "/next" || f.trimmed() != (tracer.HeaderBudget{}) {
+				t.Errorf("got next request %s with %+v trimmed", req.URL, f.trimmed())
+			}
+		})
+	}
+}
+
+// FuzzHeaderFilter runs with the default header limits because parsers left
+// running by other tests read them, so its seeds are large enough to hit every
+// one of them.
+func FuzzHeaderFilter(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: x\r\nA: b\r\n c\r\nContent-Length: 1\r\n\r\nx"), uint8(1))
+	f.Add([]byte("GET / HTTP/1.1\r\n"+manyHeaders(tracer.MaxHeaderCount+64)+"\r\n"), uint8(7))
+	f.Add([]byte("GET / HTTP/1.1\r\nX: "+strings.Repeat("v", tracer.MaxHeaderBytes+1000)+"\nno colon\n\n"), uint8(3))
+	f.Add([]byte("GET /"+strings.Repeat("a", tracer.MaxHeaderTotalBytes)+" HTTP/1.1\r\n"+strings.Repeat("X: "+strings.Repeat("v", 8<<10)+"\r\n", 16)+"\r\n"), uint8(255))
+	f.Add([]byte(strings.Repeat("Content-Length: 1\r\n", 100)), uint8(5))
+	f.Fuzz(func(t *testing.T, input []byte, chunk uint8) {
+		r := bytes.NewReader(input)
+		hf := newHeaderFilter(r)
+		hf.arm()
+		var out []byte
+		b := make([]byte, int(chunk)+1)
+		for {
+			n, err := hf.Read(b)
+			out = append(out, b[:n]...)
+			if err != nil {
+				break
+			}
+		}
+
+		// Everything is consumed, so a copy tee'd into the filter never stalls.
+		if r.Len() > 0 {
+			t.Fatalf("filter stopped with %d bytes unread", r.Len())
+		}
+
+		// The start line, the admitted headers, the first Content-Length and
+		// Transfer-Encoding and the blank line.
+		bound := tracer.MaxHeaderTotalBytes + 2 +
+			tracer.MaxHeaderTotalBytes + 3*tracer.MaxHeaderCount +
+			2*(tracer.MaxHeaderBytes+6) + 2
+		section := out
+		if i := bytes.Index(out, []byte("\n\r\n")); i >= 0 {
+			section = out[:i+3]
+		}
+		if i := bytes.Index(section, []byte("\n\n")); i >= 0 {
+			section = section[:i+2]
+		}
+		if len(section) > bound {
+			t.Fatalf("got a %d byte header section, want at most %d", len(section), bound)
+		}
+	})
+}
+
+// TestHeaderBomb sends a request with a header bomb through a traced socket.
+// The server must get it unchanged and in time while the event only keeps
+// what fits the limits and says so.
+func TestHeaderBomb(t *testing.T) {
+	events := captureEvents(t)
+
+	req := "POST /bomb HTTP/1.1\r\nHost: example.com\r\n" + manyHeaders(50_000) +
+		"X-Large: " + strings.Repeat("v", 4<<20) + "\r\nContent-Length: 5\r\n\r\nhello"
+	const resp = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, len(req))
+		n, _ := io.ReadFull(conn, b)
+		got <- b[:n]
+		io.WriteString(conn, resp)
+	}()
+
+	g := &global.Global{Config: config.New()}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if errno, err := sock.Connect(netip.MustParseAddrPort(lis.Addr().String()), nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v err=%v", errno, err)
+	}
+	conn := traceeConn(t, sock)
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	go io.WriteString(conn, req)
+	select {
+	case b := <-got:
+		if !bytes.Equal(b, []byte(req)) {
+			t.Fatalf("server got %d bytes, want the %d bytes sent", len(b), len(req))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for the server to get the request")
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if b, err := io.ReadAll(io.LimitReader(conn, int64(len(resp)))); err != nil || string(b) != resp {
+		t.Fatalf("got response %q, err=%v", b, err)
+	}
+
+	var lines []tracer.EventLogLine
+	testutil.WaitFor(t, "the event", func() bool { lines = events(); return len(lines) > 0 })
+	line := lines[0]
+	want := map[string]string{
+		"request_headers_truncated":        "true",
+		"request_headers_dropped":          fmt.Sprintf("%d", 50_000+2-tracer.MaxHeaderCount),
+		"request_headers_values_truncated": "",
+	}
+	for k, v := range want {
+		if line.Tags[k] != v {
+			t.Errorf("got %s=%q, want %q", k, line.Tags[k], v)
+		}
+	}
+	if len(line.Entry) > 2*tracer.MaxHeaderTotalBytes+64<<10 {
+		t.Errorf("got a %d byte HAR entry", len(line.Entry))
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/event"
+)
+
+// StateHistory makes every inode remember its last stateHistorySize state
+// transitions, including CAS attempts that lost a race, so that state dumps
+// and diagnostic events show how a socket got into the state it's in. It must
+// be set before any sockets are created.
+var StateHistory bool
+
+const stateHistorySize = 16
+
+// StateTransition is one attempt to move an inode from one state to another.
+// If the CAS failed, To is the state that was attempted and Errno is what the
+// caller handed the tracee because of it, if anything.
+type StateTransition struct {
+	At     time.Time `json:"at"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Caller string    `json:"caller"`
+	OK     bool      `json:"ok"`
+	Errno  string    `json:"errno,omitempty"`
+}
+
+// stateHistory is a fixed-size ring of an inode's latest transitions.
+type stateHistory struct {
+	mu   sync.Mutex
+	ring [stateHistorySize]StateTransition
+	n    uint64 // transitions recorded so far
+}
+
+// snapshot returns the recorded transitions from oldest to newest.
+func (h *stateHistory) snapshot() []StateTransition {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	count := min(h.n, stateHistorySize)
+	ret := make([]StateTransition, 0, count)
+	for i := h.n - count; i < h.n; i++ {
+		ret = append(ret, h.ring[i%stateHistorySize])
+	}
+	return ret
+}
+
+func stateName(state int) string {
+	switch state {
+	case StatePassive:
+		return "passive"
+	case StateConnected:
+		return "connected"
+	case StateConnecting:
+		return "connecting"
+	case StateListening:
+		return "listening"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("state%d", state)
+}
+
+// casState moves the inode from old to next if it's still in old and records
+// the attempt in its history. errno is what caller hands the tracee if the CAS
+// fails, or 0 if it retries.
+func (ino *Inode) casState(old, next *ImmutableState, caller string, errno syscall.Errno) bool {
+	h := ino.history
+	if h == nil {
+		return ino.state.CompareAndSwap(old, next)
+	}
+
+	// The CAS is made with the lock held so that the history is in the order
+	// the attempts took effect in.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ok := ino.state.CompareAndSwap(old, next)
+	t := StateTransition{At: time.Now(), From: stateName(old.state), To: stateName(next.state), Caller: caller, OK: ok}
+	if !ok && errno != 0 {
+		t.Errno = unix.ErrnoName(errno)
+	}
+	h.ring[h.n%stateHistorySize] = t
+	h.n++
+	return ok
+}
+
+// History returns the inode's latest state transitions from oldest to newest,
+// or nil if StateHistory wasn't set when it was created.
+func (ino *Inode) History() []StateTransition {
+	if ino.history == nil {
+		return nil
+	}
+	return ino.history.snapshot()
+}
+
+// setHistoryTag tags a diagnostic event about the socket with the inode's
+// state history, if it's recorded.
+func (ino *Inode) setHistoryTag(ev *event.Event) {
+	history := ino.History()
+	if len(history) == 0 {
+		return
+	}
+	parts := make([]string, 0, len(history))
+	for _, t := range history {
+		s := fmt.Sprintf("%s>%s@%s", t.From, t.To, t.Caller)
+		if !t.OK {
+			s += "!"
+			if t.Errno != "" {
+				s += t.Errno
+			}
+		}
+		parts = append(parts, s)
+	}
+	ev.Set("socket_state_history", strings.Join(parts, " "))
+}
+
+// diagnosticTmpl returns the socket's event template with the inode's state
+// history added, for diagnostic events about the socket.
+func (s *Socket) diagnosticTmpl() *event.Event {
+	if s.Inode.history == nil {
+		return s.tmpl
+	}
+	var ev *event.Event
+	if s.tmpl != nil {
+		ev = s.tmpl.Copy()
+	} else {
+		ev = event.New()
+	}
+	s.Inode.setHistoryTag(ev)
+	return ev
+}
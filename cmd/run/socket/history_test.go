@@ -0,0 +1,158 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/event"
+)
+
+func withStateHistory(t *testing.T) {
+	t.Helper()
+	prev := StateHistory
+	StateHistory = true
+	t.Cleanup(func() { StateHistory = prev })
+}
+
+func TestStateHistory(t *testing.T) {
+	withStateHistory(t)
+
+	ino := newInode(unix.AF_INET, 1, &ImmutableState{state: StatePassive})
+	stale := ino.state.Load()
+	if !ino.casState(stale, &ImmutableState{state: StateConnecting}, "connect", 0) {
+		t.Fatalf("first CAS failed")
+	}
+	if ino.casState(stale, &ImmutableState{state: StateListening}, "listen", unix.ERESTART) {
+		t.Fatalf("CAS from a stale state succeeded")
+	}
+	if !ino.casState(ino.state.Load(), &ImmutableState{state: StateClosed}, "close", 0) {
+		t.Fatalf("CAS from the current state failed")
+	}
+
+	got := ino.History()
+	want := []StateTransition{
+		{From: "passive", To: "connecting", Caller: "connect", OK: true},
+		{From: "passive", To: "listening", Caller: "listen", Errno: "ERESTART"},
+		{From: "connecting", To: "closed", Caller: "close", OK: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d transitions, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		got[i].At = got[i].At.Round(0)
+		if got[i].At.IsZero() || (i > 0 && got[i].At.Before(got[i-1].At)) {
+			t.Errorf("transition %d: bad time %s", i, got[i].At)
+		}
+		want[i].At = got[i].At
+		if got[i] != want[i] {
+			t.Errorf("transition %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if info := ino.Info(); len(info.History) != len(want) {
+		t.Errorf("got %d transitions in Info, want %d", len(info.History), len(want))
+	}
+
+	ev := event.New()
+	ino.setHistoryTag(ev)
+	if tag := ev.Get("socket_state_history"); tag != "passive>connecting@connect passive>listening@listen!ERESTART connecting>closed@close" {
+		t.Errorf("got tag %q", tag)
+	}
+}
+
+func TestStateHistoryDisabled(t *testing.T) {
+	ino := newInode(unix.AF_INET, 1, &ImmutableState{state: StatePassive})
+	if !ino.casState(ino.state.Load(), &ImmutableState{state: StateClosed}, "close", 0) {
+		t.Fatalf("CAS failed")
+	}
+	if ino.history != nil || ino.History() != nil {
+		t.Errorf("got history with StateHistory unset")
+	}
+}
+
+func TestStateHistoryRing(t *testing.T) {
+	withStateHistory(t)
+
+	ino := newInode(unix.AF_INET, 1, &ImmutableState{state: StatePassive})
+	for i := range stateHistorySize + 5 {
+		ino.casState(ino.state.Load(), &ImmutableState{state: StatePassive}, fmt.Sprintf("step%d", i), 0)
+	}
+	got := ino.History()
+	if len(got) != stateHistorySize {
+		t.Fatalf("got %d transitions, want %d", len(got), stateHistorySize)
+	}
+	for i, tr := range got {
+		if want := fmt.Sprintf("step%d", i+5); tr.Caller != want {
+			t.Errorf("transition %d: got caller %s, want %s", i, tr.Caller, want)
+		}
+	}
+}
+
+// TestStateHistoryRetries races CAS loops like the one in Shutdown from the
+// same loaded state so that all but one have to retry, and checks that every
+// retry is recorded after the failure that caused it.
+func TestStateHistoryRetries(t *testing.T) {
+	withStateHistory(t)
+
+	const workers = 8
+	ino := newInode(unix.AF_INET, 1, &ImmutableState{state: StateConnected})
+
+	var loaded sync.WaitGroup
+	loaded.Add(workers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			caller := fmt.Sprintf("worker%d", i)
+			prev := ino.state.Load()
+			loaded.Done()
+			loaded.Wait()
+			for {
+				next := &ImmutableState{state: StateConnected}
+				next.connected.shut = prev.connected.shut + 1
+				if ino.casState(prev, next, caller, 0) {
+					return
+				}
+				prev = ino.state.Load()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if shut := ino.state.Load().connected.shut; shut != workers {
+		t.Fatalf("got %d successful transitions, want %d", shut, workers)
+	}
+
+	// At least workers-1 CASes fail, so the ring may have dropped the oldest
+	// entries; every caller's last entry must still be its success.
+	got := ino.History()
+	if want := min(2*workers-1, stateHistorySize); len(got) < want {
+		t.Fatalf("got %d transitions, want at least %d", len(got), want)
+	}
+	failed, last := 0, map[string]StateTransition{}
+	for i, tr := range got {
+		if i > 0 && tr.At.Before(got[i-1].At) {
+			t.Errorf("transition %d is out of order", i)
+		}
+		if prev, ok := last[tr.Caller]; ok && prev.OK {
+			t.Errorf("%s: got a transition after its successful one", tr.Caller)
+		}
+		if !tr.OK {
+			failed++
+		}
+		last[tr.Caller] = tr
+	}
+	if failed == 0 {
+		t.Errorf("got no failed transitions: %+v", got)
+	}
+	for caller, tr := range last {
+		if !tr.OK {
+			t.Errorf("%s: last transition failed", caller)
+		}
+	}
+}
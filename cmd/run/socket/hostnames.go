@@ -0,0 +1,126 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const (
+	maxHostnameAddrs  = 4096
+	maxHostnamesPerIP = 16
+)
+
+// hostnames maps the external IPs the tracee connected to to the names it
+// used to reach them (TLS SNI and HTTP Host / :authority). Only names actually
+// observed on a connection to the IP are recorded.
+var hostnames = struct {
+	mu    sync.Mutex
+	names map[netip.Addr][]string
+}{
+	names: make(map[netip.Addr][]string),
+}
+
+// observeHostname records that name was used on a connection to the remote
+// address of conn. Names that are IP literals are ignored.
+func observeHostname(conn net.Conn, name string) {
+	if conn == nil || name == "" {
+		return
+	}
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	if _, err := netip.ParseAddr(name); err == nil {
+		return
+	}
+
+	ap, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	addr := ap.Addr().Unmap()
+
+	hostnames.mu.Lock()
+	defer hostnames.mu.Unlock()
+
+	names, ok := hostnames.names[addr]
+	if !ok && len(hostnames.names) >= maxHostnameAddrs {
+		return
+	}
+	if slices.Contains(names, name) || len(names) >= maxHostnamesPerIP {
+		return
+	}
+	hostnames.names[addr] = append(names, name)
+}
+
+// Hostnames returns a copy of the names observed for each external IP so far.
+func Hostnames() map[netip.Addr][]string {
+	hostnames.mu.Lock()
+	defer hostnames.mu.Unlock()
+
+	ret := make(map[netip.Addr][]string, len(hostnames.names))
+	for addr, names := range hostnames.names {
+		ret[addr] = slices.Clone(names)
+	}
+	return ret
+}
+
+// hostnameFor returns the first name observed for addr, if any.
+func hostnameFor(addr netip.Addr) string {
+	hostnames.mu.Lock()
+	defer hostnames.mu.Unlock()
+
+	if names := hostnames.names[addr]; len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
+
+// WriteHostsFile atomically writes the observed hostnames to path in the
+// /etc/hosts format so that they can be loaded into Wireshark or other tools
+// analyzing a separate capture.
+func WriteHostsFile(path string) error {
+	names := Hostnames()
+
+	addrs := make([]netip.Addr, 0, len(names))
+	for addr := range names {
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, func(a, b netip.Addr) int { return a.Compare(b) })
+
+	var b bytes.Buffer
+	b.WriteString("# hostnames observed by subtrace\n")
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, "%s", addr)
+		for _, name := range names[addr] {
+			fmt.Fprintf(&b, " %s", name)
+		}
+		b.WriteString("\n")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("create temp: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestWriteHostsFile(t *testing.T) {
+	conn := remoteConn{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 443}}
+	observeHostname(conn, "api.example.com")
+	observeHostname(conn, "api.example.com:443")
+	observeHostname(conn, "cdn.example.com")
+	observeHostname(conn, "192.0.2.10")
+
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := WriteHostsFile(path); err != nil {
+		t.Fatalf("write hosts file: %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read hosts file: %v", err)
+	}
+	if want := "192.0.2.10 api.example.com cdn.example.com\n"; !strings.Contains(string(b), want) {
+		t.Fatalf("hosts file %q does not contain %q", b, want)
+	}
+}
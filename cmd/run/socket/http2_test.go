@@ -0,0 +1,238 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/tracer"
+)
+
+// TestHTTP2Multiplexed sends concurrent requests on one h2c connection through
+// a traced socket, one of them with a header block that needs CONTINUATION
+// frames and one that the client resets, and checks that every stream gets an
+// event of its own with the request and response paired correctly.
+func TestHTTP2Multiplexed(t *testing.T) {
+	events := captureEvents(t)
+
+	const streams = 4
+	var arrived sync.WaitGroup
+	arrived.Add(streams)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		var n int
+		fmt.Sscanf(r.URL.Query().Get("n"), "%d", &n)
+		b, _ := io.ReadAll(r.Body)
+
+		// Answer in reverse order of arrival so that the responses interleave.
+		arrived.Done()
+		arrived.Wait()
+		time.Sleep(time.Duration(streams-n) * 20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK + n)
+		fmt.Fprintf(w, "response %d to %q", n, b)
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	sock, conn := dialTraced(t, netip.MustParseAddrPort(upstream.Listener.Addr().String()))
+	if conn == nil {
+		t.FailNow()
+	}
+	defer sock.Close()
+	defer conn.Close()
+
+	var dialed atomic.Bool
+	transport := &http.Transport{
+		Protocols: new(http.Protocols),
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			if !dialed.CompareAndSwap(false, true) {
+				return nil, fmt.Errorf("unexpected second connection")
+			}
+			return conn, nil
+		},
+	}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	// The slow request opens the connection and stays open while the others
+	// are multiplexed next to it.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://example.com/slow", nil)
+	slow, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("slow: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for n := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", fmt.Sprintf("http://example.com/stream/%d?n=%d", n, n), strings.NewReader(fmt.Sprintf("request %d", n)))
+			if n == 1 {
+				req.Header.Set("X-Large", strings.Repeat("x", 40<<10))
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Errorf("stream %d: %v", n, err)
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			if want := fmt.Sprintf("response %d to \"request %d\"", n, n); resp.StatusCode != http.StatusOK+n || string(b) != want {
+				t.Errorf("stream %d: got %d %q", n, resp.StatusCode, b)
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+	slow.Body.Close()
+
+	type event struct {
+		tags  map[string]string
+		entry har.Entry
+	}
+	var got []event
+	testutil.WaitFor(t, "an event per stream", func() bool {
+		got = nil
+		for _, line := range events() {
+			ev := event{tags: line.Tags}
+			if json.Unmarshal(line.Entry, &ev.entry) == nil {
+				got = append(got, ev)
+			}
+		}
+		return len(got) == streams+1
+	})
+
+	seen := make(map[string]bool)
+	for _, ev := range got {
+		if ev.entry.Request == nil || ev.entry.Response == nil {
+			t.Fatalf("got an event without a request or response: %+v", ev.entry)
+		}
+		u, err := url.Parse(ev.entry.Request.URL)
+		if err != nil {
+			t.Fatalf("parse URL %q: %v", ev.entry.Request.URL, err)
+		}
+		var host string
+		for _, hdr := range ev.entry.Request.Headers {
+			if strings.EqualFold(hdr.Name, "host") {
+				host = hdr.Value
+			}
+		}
+		if host != "example.com" {
+			t.Errorf("%s: got host %q", u.Path, host)
+		}
+		seen[u.Path] = true
+
+		if u.Path == "/slow" {
+			if ev.tags["http2_reset"] != "CANCEL" {
+				t.Errorf("got reset tag %q for the canceled stream", ev.tags["http2_reset"])
+			}
+			continue
+		}
+		var n int
+		fmt.Sscanf(u.Query().Get("n"), "%d", &n)
+		if u.Path != fmt.Sprintf("/stream/%d", n) || ev.entry.Request.Method != "POST" || ev.entry.Response.Status != http.StatusOK+n {
+			t.Errorf("got %s %s paired with status %d", ev.entry.Request.Method, ev.entry.Request.URL, ev.entry.Response.Status)
+		}
+	}
+	if len(seen) != streams+1 {
+		t.Errorf("got events for %v", seen)
+	}
+}
+
+// TestHTTP2GRPC makes a server-streaming gRPC call through a traced socket and
+// checks that its event says which method was called and how it ended.
+func TestHTTP2GRPC(t *testing.T) {
+	events := captureEvents(t)
+
+	frame := func(msg string) []byte {
+		return append([]byte{0, 0, 0, 0, byte(len(msg))}, msg...)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("content-type", "application/grpc+proto")
+		w.Header().Set("trailer", "grpc-status, grpc-message")
+		for _, msg := range []string{"one", "two", "three"} {
+			w.Write(frame(msg))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("grpc-status", "14")
+		w.Header().Set("grpc-message", "backend%20draining")
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	sock, conn := dialTraced(t, netip.MustParseAddrPort(upstream.Listener.Addr().String()))
+	if conn == nil {
+		t.FailNow()
+	}
+	defer sock.Close()
+	defer conn.Close()
+
+	transport := &http.Transport{
+		Protocols:   new(http.Protocols),
+		DialContext: func(context.Context, string, string) (net.Conn, error) { return conn, nil },
+	}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	req, _ := http.NewRequest("POST", "http://example.com/users.UserService/ListUsers", strings.NewReader(string(frame("req"))))
+	req.Header.Set("content-type", "application/grpc")
+	req.Header.Set("te", "trailers")
+	resp, err := (&http.Client{Transport: transport, Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	var lines []tracer.EventLogLine
+	testutil.WaitFor(t, "the event", func() bool { lines = events(); return len(lines) > 0 })
+	line := lines[0]
+	for k, want := range map[string]string{
+		"grpc_service":           "users.UserService",
+		"grpc_method":            "/users.UserService/ListUsers",
+		"grpc_status":            "UNAVAILABLE",
+		"grpc_status_code":       "14",
+		"grpc_message":           "backend draining",
+		"grpc_request_messages":  "1",
+		"grpc_response_messages": "3",
+	} {
+		if got := line.Tags[k]; got != want {
+			t.Errorf("tag %s = %q, want %q", k, got, want)
+		}
+	}
+	var entry struct {
+		GRPC *tracer.GRPCCall `json:"_grpc"`
+	}
+	if err := json.Unmarshal(line.Entry, &entry); err != nil {
+		t.Fatalf("decode entry: %v", err)
+	}
+	if entry.GRPC == nil || entry.GRPC.Summary() != "grpc UNAVAILABLE /users.UserService/ListUsers" {
+		t.Errorf("got _grpc %+v", entry.GRPC)
+	}
+}
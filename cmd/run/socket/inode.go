@@ -32,16 +32,19 @@ type ImmutableState struct {
 	connecting struct {
 		bind *fd.FD
 		peer netip.AddrPort
+		name string // the peer of an AF_UNIX socket
 	}
 
 	connected struct {
 		proxy *proxy
+		shut  int // shutRead and shutWrite, set by shutdown(2)
 	}
 
 	listening struct {
 		active  atomic.Bool
 		lis     net.Listener
-		backlog sync.Map
+		backlog sync.Map // dispatch cookie (uint64) -> *proxy
+		gate    *acceptGate
 	}
 }
 
@@ -62,7 +65,8 @@ func (s *ImmutableState) getRemoteBindAddr() (netip.AddrPort, syscall.Errno, err
 
 	case StateConnecting:
 		if s.connecting.bind == nil {
-			panic("connecting socket has no bind")
+			// The connect(2) that claimed the socket hasn't bound it yet.
+			return netip.AddrPort{}, 0, nil
 		}
 		return getsockname(s.connecting.bind)
 
@@ -105,10 +109,43 @@ func (s *ImmutableState) getRemotePeerAddr() (netip.AddrPort, syscall.Errno, err
 
 type Inode struct {
 	Domain int
-	Number uint64
+
+	// number is the inode number, or zero until Number reads it for an
+	// accepted socket.
+	number atomic.Uint64
 
 	state *atomic.Pointer[ImmutableState]
 
+	// history is the inode's latest state transitions, or nil if StateHistory
+	// isn't set. Transitions must go through casState to be recorded.
+	history *stateHistory
+
+	// written is the number of bytes the tracee wrote to the socket through an
+	// emulated writev(2), sendmsg(2) or sendmmsg(2). Bytes written with any
+	// other syscall are not counted.
+	written atomic.Uint64
+
+	// urgent is the number of urgent (MSG_OOB) sends seen through the same
+	// emulated syscalls. The proxy forwards urgent bytes inline, so the peer
+	// receives them as normal data.
+	urgent atomic.Uint64
+
+	// netns is the network namespace the socket and every socket used to proxy
+	// it are created in, or nil for subtrace's own (see NetnsPolicy).
+	netns *Netns
+
+	// deferAccept is the TCP_DEFER_ACCEPT value set by the tracee, applied to
+	// the external listener if MirrorDeferAccept is set.
+	deferAccept atomic.Int32
+
+	// flow is what has been observed of a datagram socket, or nil for stream
+	// sockets (see IsDatagram).
+	flow *datagramFlow
+
+	// name is the address an AF_UNIX socket is bound to as the tracee passed it
+	// to bind(2), or its listener's for an accepted socket (see UnixBindAddr).
+	name atomic.Pointer[string]
+
 	mu   sync.RWMutex // TODO: replace with a lock-free linked list if bad perf
 	open []*Socket
 }
@@ -118,11 +155,44 @@ func newInode(domain int, number uint64, state *ImmutableState) *Inode {
 		panic(fmt.Errorf("new inode: %d: missing state", number))
 	}
 
-	ino := &Inode{Domain: domain, Number: number, state: new(atomic.Pointer[ImmutableState])}
+	ino := &Inode{Domain: domain, state: new(atomic.Pointer[ImmutableState])}
+	ino.number.Store(number)
 	ino.state.Store(state)
+	if StateHistory {
+		ino.history = new(stateHistory)
+	}
 	return ino
 }
 
+// Number returns the inode number of the socket. Accepted sockets are created
+// without it to save accept(2) an fstat(2), so it's read from the first open
+// socket the first time it's needed, which is only when a forked process
+// looks its sockets up (see InodeTable.Get). It returns zero if every socket
+// on the inode is closed before then.
+func (ino *Inode) Number() uint64 {
+	if n := ino.number.Load(); n != 0 {
+		return n
+	}
+
+	ino.mu.RLock()
+	var f *fd.FD
+	if len(ino.open) > 0 {
+		f = ino.open[0].FD
+	}
+	ino.mu.RUnlock()
+	if f == nil || !f.IncRef() {
+		return 0
+	}
+	defer f.DecRef()
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(f.FD(), &stat); err != nil {
+		return 0
+	}
+	ino.number.CompareAndSwap(0, stat.Ino)
+	return ino.number.Load()
+}
+
 func (ino *Inode) LogValue() slog.Value {
 	var state string
 	var extra []slog.Attr
@@ -134,7 +204,11 @@ func (ino *Inode) LogValue() slog.Value {
 		extra = append(extra, slog.Any("proxy", s.connected.proxy))
 	case StateConnecting:
 		state = "connecting"
-		extra = append(extra, slog.Any("bind", s.connecting.bind), slog.Any("peer", s.connecting.peer))
+		if ino.Domain == unix.AF_UNIX {
+			extra = append(extra, slog.Any("bind", s.connecting.bind), slog.String("peer", s.connecting.name))
+		} else {
+			extra = append(extra, slog.Any("bind", s.connecting.bind), slog.Any("peer", s.connecting.peer))
+		}
 	case StateListening:
 		state = "listening"
 		extra = append(extra, slog.String("bind", s.listening.lis.Addr().String()))
@@ -149,6 +223,8 @@ func (ino *Inode) LogValue() slog.Value {
 		domain = "AF_INET"
 	case unix.AF_INET6:
 		domain = "AF_INET6"
+	case unix.AF_UNIX:
+		domain = "AF_UNIX"
 	}
 
 	ino.mu.RLock()
@@ -157,12 +233,35 @@ func (ino *Inode) LogValue() slog.Value {
 
 	return slog.GroupValue(append([]slog.Attr{
 		slog.String("domain", domain),
-		slog.Uint64("number", ino.Number),
+		slog.Uint64("number", ino.number.Load()),
 		slog.Int("open", open),
+		slog.Uint64("written", ino.written.Load()),
 		slog.String("state", state),
 	}, extra...)...)
 }
 
+// AccountWrite records n bytes as written by the tracee to the socket.
+func (ino *Inode) AccountWrite(n int) {
+	if n > 0 {
+		ino.written.Add(uint64(n))
+	}
+}
+
+// Written returns the number of bytes recorded by AccountWrite so far.
+func (ino *Inode) Written() uint64 {
+	return ino.written.Load()
+}
+
+// AccountUrgent records an urgent (MSG_OOB) send by the tracee.
+func (ino *Inode) AccountUrgent() {
+	ino.urgent.Add(1)
+}
+
+// UrgentSends returns the number of urgent sends recorded so far.
+func (ino *Inode) UrgentSends() uint64 {
+	return ino.urgent.Load()
+}
+
 func (ino *Inode) add(sock *Socket) {
 	ino.mu.Lock()
 	defer ino.mu.Unlock()
@@ -170,21 +269,14 @@ func (ino *Inode) add(sock *Socket) {
 	ino.open = append(ino.open, sock)
 }
 
-func (ino *Inode) remove(sock *Socket) (last bool) {
+// remove stops tracking sock and reports whether it was the last open socket
+// of the inode. Sockets closed concurrently are removed one at a time, so only
+// one of them is the last.
+func (ino *Inode) remove(sock *Socket) (last bool, err error) {
 	ino.mu.Lock()
 	defer ino.mu.Unlock()
 
 	size := len(ino.open)
-
-	if size == 1 {
-		if ino.open[0] != sock {
-			panic(fmt.Errorf("untrack: sock=%p: [0]=%p", sock, ino.open[0]))
-		}
-
-		ino.open = nil
-		return true
-	}
-
 	for i := range ino.open {
 		if ino.open[i] == sock {
 			if i < size-1 {
@@ -192,45 +284,101 @@ func (ino *Inode) remove(sock *Socket) (last bool) {
 			}
 
 			ino.open = ino.open[:size-1]
-			return false
+			if len(ino.open) == 0 {
+				ino.open = nil
+				return true, nil
+			}
+			return false, nil
 		}
 	}
-
-	panic(fmt.Errorf("untrack: sock=%p: cannot find in size=%d list", sock, size))
+	return false, fmt.Errorf("untrack: sock=%p: cannot find in size=%d list", sock, size)
 }
 
 type InodeTable struct {
 	mu    sync.RWMutex
 	known map[uint64]*Inode
+
+	// pending has the inodes added before their number was read, which Get
+	// and Snapshot read when they need them.
+	pending map[*Inode]struct{}
 }
 
 func NewInodeTable() *InodeTable {
 	return &InodeTable{
-		known: make(map[uint64]*Inode),
+		known:   make(map[uint64]*Inode),
+		pending: make(map[*Inode]struct{}),
 	}
 }
 
-func (t *InodeTable) Get(number uint64) (*Inode, bool) {
+// Len returns the number of live inodes in the table.
+func (t *InodeTable) Len() int {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
+	return len(t.known) + len(t.pending)
+}
 
+func (t *InodeTable) Get(number uint64) (*Inode, bool) {
+	t.mu.RLock()
 	ino, ok := t.known[number]
+	pending := len(t.pending)
+	t.mu.RUnlock()
+	if ok || pending == 0 {
+		return ino, ok
+	}
+
+	t.resolvePending()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ino, ok = t.known[number]
 	return ino, ok
 }
 
 func (t *InodeTable) Add(ino *Inode) {
-	if _, ok := t.Get(ino.Number); ok { // fast path
+	number := ino.number.Load()
+	if number == 0 {
+		t.mu.Lock()
+		t.pending[ino] = struct{}{}
+		t.mu.Unlock()
+		return
+	}
+	if _, ok := t.Get(number); ok { // fast path
 		return
 	}
 
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	t.addLocked(number, ino)
+}
 
-	if old, ok := t.known[ino.Number]; ok {
+func (t *InodeTable) addLocked(number uint64, ino *Inode) {
+	if old, ok := t.known[number]; ok {
 		if old != ino {
-			panic(fmt.Errorf("duplicate inode %d (old=%p, new=%p): old=%q, new=%q", ino.Number, old, ino, old.LogValue().String(), ino.LogValue().String()))
+			panic(fmt.Errorf("duplicate inode %d (old=%p, new=%p): old=%q, new=%q", number, old, ino, old.LogValue().String(), ino.LogValue().String()))
 		}
 	} else {
-		t.known[ino.Number] = ino
+		t.known[number] = ino
+	}
+}
+
+// resolvePending reads the numbers of the pending inodes. Those whose sockets
+// are all closed by now are dropped, since no process can have them.
+func (t *InodeTable) resolvePending() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ino := range t.pending {
+		delete(t.pending, ino)
+		if number := ino.Number(); number != 0 {
+			t.addLocked(number, ino)
+		}
+	}
+}
+
+// Remove forgets ino once no socket on it is traced anymore.
+func (t *InodeTable) Remove(ino *Inode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, ino)
+	if number := ino.number.Load(); t.known[number] == ino {
+		delete(t.known, number)
 	}
 }
@@ -0,0 +1,155 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"subtrace.dev/cmd/run/capability"
+)
+
+// VerifyIntegrity makes every proxy check that it forwarded exactly the bytes
+// it received. The bufConns of the two sides hash what's read from them and
+// what's written to them as part of the copy loops, and when the connection is
+// done, what was read from one side must hash to what was written to the
+// other. A mismatch means the proxy corrupted application data and is fatal.
+var VerifyIntegrity = false
+
+// integrityMismatch is called when a proxy forwarded something other than what
+// it received. Tests replace it.
+var integrityMismatch = func(p *proxy, err error) {
+	slog.Error("proxy corrupted application data", "proxy", p, "err", err)
+	panic(fmt.Errorf("verify integrity: %w", err))
+}
+
+func init() {
+	capability.RegisterFeature("integrity_verifier", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: VerifyIntegrity}
+	})
+}
+
+// digest is the running SHA-256 of the bytes read from or written to one side
+// of a proxy.
+type digest struct {
+	mu     sync.Mutex
+	h      hash.Hash
+	n      uint64
+	failed bool // a write failed, so the stream may end early
+}
+
+func (d *digest) add(b []byte, failed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.h == nil {
+		d.h = sha256.New()
+	}
+	d.h.Write(b)
+	d.n += uint64(len(b))
+	d.failed = d.failed || failed
+}
+
+func (d *digest) sum() ([]byte, uint64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.h == nil {
+		d.h = sha256.New()
+	}
+	return d.h.Sum(nil), d.n, d.failed
+}
+
+// integrityStream is one direction of a proxied connection.
+type integrityStream struct {
+	read    digest
+	written digest
+}
+
+// check compares what was read with what was written. It returns false
+// without an error if the stream couldn't be verified because a write failed
+// before everything was forwarded, which happens whenever either side goes
+// away first.
+func (s *integrityStream) check() (bool, error) {
+	rsum, rn, _ := s.read.sum()
+	wsum, wn, failed := s.written.sum()
+	switch {
+	case rn == wn && bytes.Equal(rsum, wsum):
+		return true, nil
+	case wn < rn && failed:
+		return false, nil
+	case rn == wn:
+		return false, fmt.Errorf("read %d bytes with sha256 %x but wrote %d bytes with sha256 %x", rn, rsum, wn, wsum)
+	default:
+		return false, fmt.Errorf("read %d bytes but wrote %d bytes", rn, wn)
+	}
+}
+
+// integrity is what a proxy verifies: the two directions at the layer whose
+// bytes it forwards unchanged.
+type integrity struct {
+	layer    string
+	cli, srv *bufConn
+	c2s, s2c integrityStream
+
+	skipped atomic.Pointer[string] // why the bytes aren't forwarded unchanged
+}
+
+// attachIntegrity starts verifying what's forwarded between cli and srv,
+// replacing whatever was verified before. Intercepted TLS connections move
+// from the encrypted bytes to the decrypted ones this way.
+func (p *proxy) attachIntegrity(layer string, cli, srv *bufConn) {
+	if !VerifyIntegrity {
+		return
+	}
+	v := &integrity{layer: layer, cli: cli, srv: srv}
+	if prev := p.integrity.Swap(v); prev != nil {
+		for _, c := range []*bufConn{prev.cli, prev.srv} {
+			c.rsum.Store(nil)
+			c.wsum.Store(nil)
+		}
+	}
+	cli.rsum.Store(&v.c2s.read)
+	srv.wsum.Store(&v.c2s.written)
+	srv.rsum.Store(&v.s2c.read)
+	cli.wsum.Store(&v.s2c.written)
+}
+
+// skipIntegrity records that the proxy is about to forward something other
+// than what it receives, so its streams aren't expected to match.
+func (p *proxy) skipIntegrity(reason string) {
+	if v := p.integrity.Load(); v != nil {
+		v.skipped.Store(&reason)
+	}
+}
+
+// checkIntegrity compares both directions once the proxy is done and calls
+// integrityMismatch if either one was corrupted.
+func (p *proxy) checkIntegrity() {
+	v := p.integrity.Load()
+	if v == nil {
+		return
+	}
+	if reason := v.skipped.Load(); reason != nil {
+		slog.Debug("skipped integrity check", "proxy", p, "layer", v.layer, "reason", *reason)
+		return
+	}
+	for _, dir := range []struct {
+		name   string
+		stream *integrityStream
+	}{
+		{"client->server", &v.c2s},
+		{"server->client", &v.s2c},
+	} {
+		switch ok, err := dir.stream.check(); {
+		case err != nil:
+			integrityMismatch(p, fmt.Errorf("%s %s: %w", v.layer, dir.name, err))
+		case !ok:
+			slog.Debug("integrity check incomplete after a failed write", "proxy", p, "layer", v.layer, "dir", dir.name)
+		}
+	}
+}
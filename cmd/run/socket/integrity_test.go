@@ -0,0 +1,439 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+)
+
+// verifyIntegrity turns on the runtime verifier for the duration of a test and
+// counts the mismatches it reports instead of panicking.
+func verifyIntegrity(t *testing.T) *atomic.Int64 {
+	var mismatches atomic.Int64
+	prev := integrityMismatch
+	VerifyIntegrity = true
+	integrityMismatch = func(p *proxy, err error) {
+		mismatches.Add(1)
+		t.Errorf("proxy %v: %v", p, err)
+	}
+	t.Cleanup(func() {
+		VerifyIntegrity = false
+		integrityMismatch = prev
+	})
+	return &mismatches
+}
+
+// payload returns n pseudo-random bytes determined by seed.
+func payload(seed uint64, n int) []byte {
+	var key [32]byte
+	binary.BigEndian.PutUint64(key[:], seed)
+	b := make([]byte, n)
+	rand.NewChaCha8(key).Read(b)
+	return b
+}
+
+// serverSeed is set in the seeds of what the server sends.
+const serverSeed = 1 << 63
+
+// chaosConn writes in randomly sized chunks with random pauses and reads into
+// randomly sized buffers so that the proxy sees every kind of fragmentation.
+type chaosConn struct {
+	net.Conn
+	rr, wr *rand.Rand
+	pause  time.Duration
+}
+
+func newChaosConn(conn net.Conn, seed uint64, pause time.Duration) *chaosConn {
+	return &chaosConn{
+		Conn:  conn,
+		rr:    rand.New(rand.NewPCG(seed, 1)),
+		wr:    rand.New(rand.NewPCG(seed, 2)),
+		pause: pause,
+	}
+}
+
+func (c *chaosConn) Write(b []byte) (int, error) {
+	total := 0
+	for len(b) > 0 {
+		n := min(len(b), 1+c.wr.IntN(64<<10))
+		if c.pause > 0 && c.wr.IntN(8) == 0 {
+			time.Sleep(time.Duration(c.wr.Int64N(int64(c.pause))))
+		}
+		m, err := c.Conn.Write(b[:n])
+		total += m
+		if err != nil {
+			return total, err
+		}
+		b = b[n:]
+	}
+	return total, nil
+}
+
+func (c *chaosConn) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1+c.rr.IntN(len(b))]
+	}
+	return c.Conn.Read(b)
+}
+
+// traceeConn returns a net.Conn for the process's side of a traced socket.
+func traceeConn(t testing.TB, sock *Socket) net.Conn {
+	fd, err := unix.Dup(sock.FD.FD())
+	if err != nil {
+		t.Errorf("dup: %v", err)
+		return nil
+	}
+	f := os.NewFile(uintptr(fd), "tracee")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		t.Errorf("file conn: %v", err)
+		return nil
+	}
+	return conn
+}
+
+// dialTraced connects a traced socket to addr with a small receive buffer so
+// that the proxy keeps running into backpressure.
+func dialTraced(t *testing.T, addr netip.AddrPort) (*Socket, net.Conn) {
+	g := &global.Global{Config: config.New()}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Errorf("create socket: %v", err)
+		return nil, nil
+	}
+	if errno, err := sock.Connect(addr, nil); err != nil || errno != 0 {
+		sock.Close()
+		t.Errorf("connect: errno=%v, err=%v", errno, err)
+		return nil, nil
+	}
+	unix.SetsockoptInt(sock.FD.FD(), unix.SOL_SOCKET, unix.SO_RCVBUF, 32<<10)
+	conn := traceeConn(t, sock)
+	if conn == nil {
+		sock.Close()
+		return nil, nil
+	}
+	return sock, conn
+}
+
+// rawServer accepts connections that start with an 8-byte id. It sends
+// payload(id|serverSeed, size) while it reads the client's bytes and then
+// passes everything it read, id included, to received[id].
+func rawServer(t *testing.T, size int, pause time.Duration, received []chan []byte) netip.AddrPort {
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var hdr [8]byte
+				if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+					return
+				}
+				id := binary.BigEndian.Uint64(hdr[:])
+				c := newChaosConn(conn, id|serverSeed, pause)
+				written := make(chan struct{})
+				go func() {
+					defer close(written)
+					c.Write(payload(id|serverSeed, size))
+					conn.(*net.TCPConn).CloseWrite()
+				}()
+				b, _ := io.ReadAll(c)
+				received[id] <- append(hdr[:], b...)
+				<-written
+			}()
+		}
+	}()
+	return netip.MustParseAddrPort(lis.Addr().String())
+}
+
+// rawTransfer sends payload(id, size) through a traced socket while it reads
+// what the server sends. It returns what was sent, what was received and
+// what the server received.
+func rawTransfer(t *testing.T, addr netip.AddrPort, id uint64, size int, pause time.Duration, received chan []byte) (sent, got, srvGot []byte, err error) {
+	sock, conn := dialTraced(t, addr)
+	if conn == nil {
+		return nil, nil, nil, fmt.Errorf("dial failed")
+	}
+	defer sock.Close()
+	defer conn.Close()
+
+	sent = binary.BigEndian.AppendUint64(nil, id)
+	sent = append(sent, payload(id, size)...)
+	c := newChaosConn(conn, id, pause)
+	werr := make(chan error, 1)
+	go func() {
+		_, err := c.Write(sent)
+		conn.(*net.TCPConn).CloseWrite()
+		werr <- err
+	}()
+	got, err = io.ReadAll(c)
+	if err == nil {
+		err = <-werr
+	}
+	select {
+	case srvGot = <-received:
+	case <-time.After(10 * time.Second):
+		return sent, got, nil, fmt.Errorf("timed out waiting for the server")
+	}
+	return sent, got, srvGot, err
+}
+
+// TestIntegrity transfers random payloads through many proxied connections at
+// once, in both directions at the same time, and checks that both ends got
+// exactly what the other sent while the runtime verifier checks the proxies.
+func TestIntegrity(t *testing.T) {
+	mismatches := verifyIntegrity(t)
+
+	conns, size := 32, 2<<20
+	if testing.Short() {
+		conns, size = 8, 256<<10
+	}
+
+	t.Run("raw", func(t *testing.T) {
+		received := make([]chan []byte, conns)
+		for i := range received {
+			received[i] = make(chan []byte, 1)
+		}
+		addr := rawServer(t, size, 200*time.Microsecond, received)
+
+		var wg sync.WaitGroup
+		for id := range uint64(conns) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sent, got, srvGot, err := rawTransfer(t, addr, id, size, 200*time.Microsecond, received[id])
+				if err != nil {
+					t.Errorf("conn %d: %v", id, err)
+					return
+				}
+				if sha256.Sum256(srvGot) != sha256.Sum256(sent) {
+					t.Errorf("conn %d: server got %d bytes with a different sha256 than the %d bytes sent", id, len(srvGot), len(sent))
+				}
+				if sha256.Sum256(got) != sha256.Sum256(payload(id|serverSeed, size)) {
+					t.Errorf("conn %d: client got %d bytes with a different sha256 than the %d bytes sent", id, len(got), size)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("http/1", func(t *testing.T) {
+		const requests = 3
+		lis, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer lis.Close()
+		go http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var seed uint64
+			fmt.Sscanf(r.URL.Path, "/%d", &seed)
+			h := sha256.New()
+			io.Copy(h, r.Body)
+			w.Header().Set("X-Body-Sha256", hex.EncodeToString(h.Sum(nil)))
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+			c := newChaosConn(nil, seed|serverSeed, 0)
+			for b := payload(seed|serverSeed, size); len(b) > 0; {
+				n := min(len(b), 1+c.wr.IntN(64<<10))
+				w.Write(b[:n])
+				b = b[n:]
+			}
+		}))
+		addr := netip.MustParseAddrPort(lis.Addr().String())
+
+		var wg sync.WaitGroup
+		for id := range uint64(conns) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sock, conn := dialTraced(t, addr)
+				if conn == nil {
+					return
+				}
+				defer sock.Close()
+				defer conn.Close()
+				c := newChaosConn(conn, id, 200*time.Microsecond)
+				br := bufio.NewReader(c)
+				for i := range uint64(requests) {
+					seed := id*requests + i
+					body := payload(seed, size)
+					req := fmt.Sprintf("POST /%d HTTP/1.1\r\nHost: integrity\r\nContent-Length: %d\r\n\r\n", seed, len(body))
+					if _, err := c.Write(append([]byte(req), body...)); err != nil {
+						t.Errorf("conn %d: write request %d: %v", id, i, err)
+						return
+					}
+					resp, err := http.ReadResponse(br, nil)
+					if err != nil {
+						t.Errorf("conn %d: read response %d: %v", id, i, err)
+						return
+					}
+					h := sha256.New()
+					_, err = io.Copy(h, resp.Body)
+					resp.Body.Close()
+					if err != nil {
+						t.Errorf("conn %d: read response body %d: %v", id, i, err)
+						return
+					}
+					if want := sha256.Sum256(body); resp.Header.Get("X-Body-Sha256") != hex.EncodeToString(want[:]) {
+						t.Errorf("conn %d: request %d: server got a body with a different sha256", id, i)
+					}
+					if want := sha256.Sum256(payload(seed|serverSeed, size)); !bytes.Equal(h.Sum(nil), want[:]) {
+						t.Errorf("conn %d: request %d: client got a response body with a different sha256", id, i)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	testutil.WaitFor(t, "proxies to finish", func() bool { return Running() == 0 })
+	if n := mismatches.Load(); n > 0 {
+		t.Errorf("verifier reported %d mismatches", n)
+	}
+}
+
+// TestIntegrityDrain drains the proxies in the middle of transfers. Whatever
+// either end got before its connection was cut must still be a prefix of what
+// the other end sent, and the verifier must not mistake the cut for
+// corruption.
+func TestIntegrityDrain(t *testing.T) {
+	mismatches := verifyIntegrity(t)
+	t.Cleanup(func() {
+		running.mu.Lock()
+		running.draining = false
+		running.mu.Unlock()
+	})
+
+	const conns, size = 16, 8 << 20
+	received := make([]chan []byte, conns)
+	for i := range received {
+		received[i] = make(chan []byte, 1)
+	}
+	addr := rawServer(t, size, time.Millisecond, received)
+
+	var wg sync.WaitGroup
+	var cut atomic.Int64
+	for id := range uint64(conns) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sent, got, srvGot, err := rawTransfer(t, addr, id, size, time.Millisecond, received[id])
+			if err != nil && strings.Contains(err.Error(), "dial failed") {
+				return
+			}
+			if len(got) < size || len(srvGot) < len(sent) {
+				cut.Add(1)
+			}
+			if !bytes.HasPrefix(sent, srvGot) {
+				t.Errorf("conn %d: server got %d bytes that aren't a prefix of what was sent", id, len(srvGot))
+			}
+			if !bytes.HasPrefix(payload(id|serverSeed, size), got) {
+				t.Errorf("conn %d: client got %d bytes that aren't a prefix of what was sent", id, len(got))
+			}
+		}()
+	}
+
+	testutil.WaitFor(t, "transfers to start", func() bool { return Running() == conns })
+	time.Sleep(50 * time.Millisecond)
+	if abandoned := Drain(10*time.Millisecond, nil); abandoned == 0 {
+		t.Errorf("drain closed no proxies, want transfers cut short")
+	}
+	wg.Wait()
+	if cut.Load() == 0 {
+		t.Errorf("no transfer was cut short")
+	}
+
+	testutil.WaitFor(t, "proxies to finish", func() bool { return Running() == 0 })
+	if n := mismatches.Load(); n > 0 {
+		t.Errorf("verifier reported %d mismatches", n)
+	}
+}
+
+func TestIntegrityMismatch(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		read, written string
+		failed        bool
+		ok            bool
+		err           string
+	}{
+		{name: "equal", read: "hello", written: "hello", ok: true},
+		{name: "corrupted", read: "hello", written: "hellp", err: "read 5 bytes with sha256"},
+		{name: "truncated", read: "hello", written: "hell", err: "read 5 bytes but wrote 4 bytes"},
+		{name: "duplicated", read: "hello", written: "helllo", err: "read 5 bytes but wrote 6 bytes"},
+		{name: "failed write", read: "hello", written: "he", failed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var s integrityStream
+			s.read.add([]byte(tt.read), false)
+			s.written.add([]byte(tt.written), tt.failed)
+			ok, err := s.check()
+			if ok != tt.ok {
+				t.Errorf("got ok=%t, want %t", ok, tt.ok)
+			}
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	// A proxy that changes a byte on its way through is caught.
+	VerifyIntegrity = true
+	defer func() { VerifyIntegrity = false }()
+	var got error
+	prev := integrityMismatch
+	integrityMismatch = func(p *proxy, err error) { got = err }
+	defer func() { integrityMismatch = prev }()
+
+	process, tracee := tcpPair(t)
+	external, peer := tcpPair(t)
+	p := &proxy{isOutgoing: true}
+	cli, srv := newBufConn(process), newBufConn(external)
+	p.attachIntegrity("tcp", cli, srv)
+
+	tracee.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(cli, b); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	b[4]++
+	srv.Write(b)
+	io.ReadFull(peer, b)
+	p.checkIntegrity()
+	if got == nil || !strings.Contains(got.Error(), "tcp client->server") {
+		t.Errorf("got %v, want a client->server mismatch", got)
+	}
+}
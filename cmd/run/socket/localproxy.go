@@ -0,0 +1,132 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"subtrace.dev/event"
+)
+
+// localProxies has the addresses of the proxies on this host found at
+// startup (see AddLocalProxy). Events of connections to them are tagged
+// via_proxy.
+var localProxies sync.Map // netip.AddrPort -> struct{}
+
+// AddLocalProxy records a local proxy found at startup.
+func AddLocalProxy(addr netip.AddrPort) {
+	localProxies.Store(unmapAddrPort(addr), struct{}{})
+}
+
+// localProxyMinConnects is the number of outgoing connections after which a
+// loopback port that at least half of them went to is reported as a local
+// proxy, such as a sidecar, once it has carried requests for other hosts.
+// Local databases and caches get as many connections but don't carry those.
+var localProxyMinConnects uint64 = 20
+
+var (
+	outgoingConnects       atomic.Uint64
+	loopbackConnectsByPort sync.Map // netip.AddrPort -> *atomic.Uint64
+	localProxyWarned       sync.Map // netip.AddrPort -> struct{}
+)
+
+// noteConnect counts an outgoing connection to addr and reports whether addr
+// is a local proxy found at startup. itab may be nil.
+func noteConnect(addr netip.AddrPort, itab *InodeTable) bool {
+	addr = unmapAddrPort(addr)
+	outgoingConnects.Add(1)
+	if !addr.Addr().IsLoopback() {
+		return false
+	}
+	if _, ok := localProxies.Load(addr); ok {
+		return true
+	}
+	if itab != nil && itab.Listener(addr) != nil {
+		return false // a traced process's
+	}
+	v, _ := loopbackConnectsByPort.LoadOrStore(addr, new(atomic.Uint64))
+	v.(*atomic.Uint64).Add(1)
+	return false
+}
+
+// noteProxiedRequest records that a request for host went to a loopback
+// address, which only a proxy passes on, and warns once per address if most
+// outgoing connections go there.
+func noteProxiedRequest(addr netip.AddrPort, host string) {
+	v, ok := loopbackConnectsByPort.Load(addr)
+	if !ok {
+		return // a traced process's or a local proxy found at startup
+	}
+	n, total := v.(*atomic.Uint64).Load(), outgoingConnects.Load()
+	if total < localProxyMinConnects || 2*n < total {
+		return
+	}
+	if _, warned := localProxyWarned.LoadOrStore(addr, struct{}{}); !warned {
+		slog.Warn("most outgoing connections go to a local proxy, such as a sidecar, which no traced process runs: events of requests that don't carry their destination (CONNECT or absolute-form) show the proxy's port in dest and are tagged via_proxy, see `subtrace doctor`", "addr", addr, "host", host, "connections", n, "total", total)
+	}
+}
+
+// isRemoteName reports whether host, a Host header or :authority, names
+// another host than this one.
+func isRemoteName(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" || strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return false
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return !addr.Unmap().IsLoopback()
+	}
+	return true
+}
+
+// proxiedDestination returns the destination of a request sent to a forward
+// proxy: the authority of a CONNECT, or the host and port of the URL of an
+// absolute-form request.
+func proxiedDestination(req *http.Request) (string, bool) {
+	if req.Method == http.MethodConnect {
+		return req.Host, req.Host != ""
+	}
+	if !strings.HasPrefix(req.RequestURI, "http://") && !strings.HasPrefix(req.RequestURI, "https://") {
+		return "", false
+	}
+	host := req.URL.Hostname()
+	if host == "" {
+		return "", false
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+// setProxiedTags tags an event of an outgoing request sent to a forward proxy
+// with the destination it asked the proxy for (dest) and the proxy's address
+// (via_proxy). dest_addr stays the proxy's address, which is what the process
+// connected to.
+func (p *proxy) setProxiedTags(ev *event.Event, req *http.Request) {
+	if !p.isOutgoing {
+		return
+	}
+	dest, ok := proxiedDestination(req)
+	if !ok {
+		return
+	}
+	if addr := ev.Get("dest_addr"); addr != "" {
+		ev.Set("via_proxy", addr)
+	}
+	ev.Set("dest", event.Intern(dest))
+}
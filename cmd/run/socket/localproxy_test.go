@@ -0,0 +1,138 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"subtrace.dev/internal/testutil"
+)
+
+func TestProxiedDestination(t *testing.T) {
+	for _, tt := range []struct {
+		head string
+		want string
+	}{
+		{"CONNECT api.example.com:443 HTTP/1.1\r\nHost: api.example.com:443\r\n\r\n", "api.example.com:443"},
+		{"GET http://api.example.com/v1 HTTP/1.1\r\nHost: api.example.com\r\n\r\n", "api.example.com:80"},
+		{"GET https://[2001:db8::1]:8443/ HTTP/1.1\r\nHost: [2001:db8::1]:8443\r\n\r\n", "[2001:db8::1]:8443"},
+		{"GET /v1 HTTP/1.1\r\nHost: api.example.com\r\n\r\n", ""},
+	} {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.head)))
+		if err != nil {
+			t.Fatalf("read %q: %v", tt.head, err)
+		}
+		if got, _ := proxiedDestination(req); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestIsRemoteName(t *testing.T) {
+	for host, want := range map[string]bool{
+		"api.example.com":     true,
+		"api.example.com:443": true,
+		"10.0.0.1:8080":       true,
+		"localhost:8080":      false,
+		"app.localhost":       false,
+		"127.0.0.1:15001":     false,
+		"[::1]:80":            false,
+		"":                    false,
+	} {
+		if got := isRemoteName(host); got != want {
+			t.Errorf("%q: got %v, want %v", host, got, want)
+		}
+	}
+}
+
+// connectProxy is a forward proxy that answers every CONNECT with 200 and
+// then echoes whatever is sent through the tunnel.
+func connectProxy(t *testing.T) netip.AddrPort {
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				io.Copy(conn, br)
+			}()
+		}
+	}()
+	return netip.MustParseAddrPort(lis.Addr().String())
+}
+
+// TestConnectTunnel checks that a CONNECT to a forward proxy on loopback gets
+// an event with the destination it asked for, and that the tunnel after it is
+// forwarded untouched.
+func TestConnectTunnel(t *testing.T) {
+	events := captureEvents(t)
+
+	addr := connectProxy(t)
+	sock, conn := dialTraced(t, addr)
+	if conn == nil {
+		t.FailNow()
+	}
+	defer sock.Close()
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT api.example.com:443 HTTP/1.1\r\nHost: api.example.com:443\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect: %v %v", resp, err)
+	}
+
+	// Something that would fail to parse as HTTP/1.
+	tunnel := "\x16\x03\x01\x00\x05hello"
+	if _, err := io.WriteString(conn, tunnel); err != nil {
+		t.Fatalf("write tunnel: %v", err)
+	}
+	got := make([]byte, len(tunnel))
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != tunnel {
+		t.Fatalf("got %q through the tunnel, err=%v", got, err)
+	}
+
+	var tags map[string]string
+	testutil.WaitFor(t, "the CONNECT event", func() bool {
+		for _, line := range events() {
+			var entry struct {
+				Request struct {
+					Method string `json:"method"`
+				} `json:"request"`
+			}
+			if json.Unmarshal(line.Entry, &entry) != nil {
+				continue
+			}
+			if entry.Request.Method == http.MethodConnect {
+				tags = line.Tags
+				return true
+			}
+		}
+		return false
+	})
+	if tags["dest"] != "api.example.com:443" || tags["via_proxy"] != addr.String() || tags["dest_addr"] != addr.String() {
+		t.Errorf("got dest=%q via_proxy=%q dest_addr=%q, want the CONNECT's destination via %s", tags["dest"], tags["via_proxy"], tags["dest_addr"], addr)
+	}
+}
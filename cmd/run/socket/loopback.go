@@ -0,0 +1,163 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/event"
+)
+
+// CollapseLoopback makes loopback connections between two traced processes in
+// the same run go through a single capture point. The connecting side is
+// intercepted as usual and its events carry the listening process's tags with
+// a peer_ prefix. The accepting side only copies bytes between its two
+// connections without parsing them, so every exchange is captured once.
+var CollapseLoopback bool
+
+// loopbackConnects holds the local address of every external connection dialed
+// to a listener owned by a traced socket. The listener's accept loop looks up
+// the remote address of each incoming connection here to decide whether the
+// exchange is already captured on the connecting side.
+var loopbackConnects sync.Map // netip.AddrPort -> struct{}
+
+// Listener returns a traced socket listening on addr, or nil if there is none.
+// A listener bound to the unspecified address matches any address with the
+// same port.
+func (t *InodeTable) Listener(addr netip.AddrPort) *Socket {
+	addr = unmapAddrPort(addr)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, ino := range t.known {
+		state := ino.state.Load()
+		if state.state != StateListening || !state.listening.active.Load() {
+			continue
+		}
+		bind, err := netip.ParseAddrPort(state.listening.lis.Addr().String())
+		if err != nil {
+			continue
+		}
+		bind = unmapAddrPort(bind)
+		if bind.Port() != addr.Port() || (bind.Addr() != addr.Addr() && !bind.Addr().IsUnspecified()) {
+			continue
+		}
+
+		ino.mu.RLock()
+		var sock *Socket
+		if len(ino.open) > 0 {
+			sock = ino.open[0]
+		}
+		ino.mu.RUnlock()
+		if sock != nil {
+			return sock
+		}
+	}
+	return nil
+}
+
+func unmapAddrPort(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// setPeerTags copies the process tags of the socket on the other end of a
+// collapsed loopback connection into tmpl so that events are attributed to
+// both processes.
+func setPeerTags(tmpl *event.Event, peer *event.Event) {
+	for k, v := range peer.Map() {
+		if strings.HasPrefix(k, "process_") {
+			tmpl.Set("peer_"+k, v)
+		}
+	}
+}
+
+// bindLoopbackDial binds the socket of an external dial to a traced listener
+// before it connects, and registers the local address in loopbackConnects so
+// that the listener can't accept the connection before it's known. An
+// unspecified bind address is replaced with the destination address because
+// the listener sees the connection coming from there.
+func bindLoopbackDial(fd int, bind netip.AddrPort, dest netip.AddrPort) (netip.AddrPort, error) {
+	switch {
+	case !bind.IsValid():
+		bind = netip.AddrPortFrom(dest.Addr(), 0)
+	case bind.Addr().IsUnspecified():
+		bind = netip.AddrPortFrom(dest.Addr(), bind.Port())
+	}
+
+	var sa unix.Sockaddr
+	if addr := bind.Addr().Unmap(); addr.Is4() {
+		sa = &unix.SockaddrInet4{Addr: addr.As4(), Port: int(bind.Port())}
+	} else {
+		sa = &unix.SockaddrInet6{Addr: addr.As16(), Port: int(bind.Port())}
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("bind %s: %w", bind, err)
+	}
+
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("getsockname: %w", err)
+	}
+	var local netip.AddrPort
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		local = netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port))
+	case *unix.SockaddrInet6:
+		local = netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), uint16(sa.Port))
+	default:
+		return netip.AddrPort{}, fmt.Errorf("getsockname: unexpected sockaddr type %T", sa)
+	}
+
+	local = unmapAddrPort(local)
+	loopbackConnects.Store(local, struct{}{})
+	return local, nil
+}
+
+// isLoopbackConnect reports whether an accepted connection was dialed by the
+// connecting side of a collapsed loopback connection and forgets about it.
+func isLoopbackConnect(conn net.Conn) bool {
+	addr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	_, ok := loopbackConnects.LoadAndDelete(unmapAddrPort(addr))
+	return ok
+}
+
+// proxyPassthrough copies bytes between the two connections without parsing
+// them. Both are TCP connections, so io.Copy splices the data in the kernel
+// instead of copying it through userspace.
+func (p *proxy) proxyPassthrough() error {
+	slog.Debug("starting proxyPassthrough", "proxy", p)
+
+	errs := make(chan error, 2)
+	copyHalf := func(dir string, w, r streamConn) {
+		defer w.CloseWrite()
+		defer r.CloseRead()
+		if err := p.copyRawSingle(dir, "passthrough", w, r); err != nil {
+			errs <- fmt.Errorf("copy %s: %w", dir, err)
+			return
+		}
+		errs <- nil
+	}
+
+	cli, srv := p.process, p.external
+	if !p.isOutgoing {
+		cli, srv = srv, cli
+	}
+	go copyHalf("client->server", srv, cli)
+	go copyHalf("server->client", cli, srv)
+
+	if err := errors.Join(<-errs, <-errs); err != nil {
+		return fmt.Errorf("passthrough proxy: %w", err)
+	}
+	return nil
+}
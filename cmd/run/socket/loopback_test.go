@@ -0,0 +1,169 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"net/netip"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+)
+
+// loopbackPair creates a traced listening socket and a traced socket connected
+// to it, and returns the connecting socket and the accepted one.
+func loopbackPair(t testing.TB, collapse bool) (*Socket, *Socket) {
+	prev := CollapseLoopback
+	CollapseLoopback = collapse
+	t.Cleanup(func() { CollapseLoopback = prev })
+
+	g := &global.Global{Config: config.New()}
+	itab := NewInodeTable()
+
+	server := event.New()
+	server.Set("process_id", "1")
+	lis, err := CreateSocket(g, server, unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create listening socket: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	itab.Add(lis.Inode)
+
+	if errno, err := lis.Bind(netip.MustParseAddrPort("127.0.0.1:0")); err != nil || errno != 0 {
+		t.Fatalf("bind: errno=%v, err=%v", errno, err)
+	}
+	if errno, err := lis.Listen(8); err != nil || errno != 0 {
+		t.Fatalf("listen: errno=%v, err=%v", errno, err)
+	}
+	// The tracee's listen(2) continues in the kernel after the handler.
+	if err := unix.Listen(lis.FD.FD(), 8); err != nil {
+		t.Fatalf("listen(2): %v", err)
+	}
+	addr, errno, err := lis.Inode.state.Load().getRemoteBindAddr()
+	if err != nil || errno != 0 {
+		t.Fatalf("get listener addr: errno=%v, err=%v", errno, err)
+	}
+
+	client := event.New()
+	client.Set("process_id", "2")
+	cli, err := CreateSocket(g, client, unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create connecting socket: %v", err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	itab.Add(cli.Inode)
+
+	if errno, err := cli.Connect(addr, itab); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v, err=%v", errno, err)
+	}
+
+	srv, errno, err := lis.Accept(0)
+	if err != nil || errno != 0 {
+		t.Fatalf("accept: errno=%v, err=%v", errno, err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return cli, srv
+}
+
+// finishProxy closes socks, which must include the traced socket p belongs to
+// and whatever keeps the other end of the connection open, and waits for p to
+// finish. The proxy's goroutines replace p.tmpl as they go, so tests read it
+// only after this.
+func finishProxy(t *testing.T, p *proxy, socks ...*Socket) {
+	t.Helper()
+	// The proxy can't finish before the socket is closed, so waiting for it
+	// to start first makes sure that it's done rather than not yet started.
+	testutil.WaitFor(t, "the proxy to start", func() bool { return isRunning(p) })
+	for _, sock := range socks {
+		sock.Close()
+	}
+	testutil.WaitFor(t, "the proxy to finish", func() bool { return !isRunning(p) })
+}
+
+func isRunning(p *proxy) bool {
+	running.mu.Lock()
+	defer running.mu.Unlock()
+	_, ok := running.proxies[p]
+	return ok
+}
+
+func TestCollapseLoopback(t *testing.T) {
+	for _, collapse := range []bool{false, true} {
+		cli, srv := loopbackPair(t, collapse)
+
+		if _, err := unix.Write(cli.FD.FD(), []byte("ping")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		buf := make([]byte, 4)
+		if n, err := unix.Read(srv.FD.FD(), buf); err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("read: got %q, err=%v; want ping", buf[:n], err)
+		}
+
+		outgoing := cli.Inode.state.Load().connected.proxy
+		incoming := srv.Inode.state.Load().connected.proxy
+		if incoming.passthrough != collapse {
+			t.Errorf("collapse=%v: got accepting side passthrough=%v", collapse, incoming.passthrough)
+		}
+		if outgoing.passthrough {
+			t.Errorf("collapse=%v: connecting side must always be intercepted", collapse)
+		}
+		want := ""
+		if collapse {
+			want = "1"
+		}
+		finishProxy(t, outgoing, cli, srv)
+		if got := outgoing.tmpl.Get("peer_process_id"); got != want {
+			t.Errorf("collapse=%v: got peer_process_id %q, want %q", collapse, got, want)
+		}
+	}
+}
+
+// BenchmarkLoopbackThroughput measures the throughput between two traced
+// sockets connected over loopback with and without CollapseLoopback.
+func BenchmarkLoopbackThroughput(b *testing.B) {
+	for _, bm := range []struct {
+		name     string
+		collapse bool
+	}{
+		{"intercepted", false},
+		{"collapsed", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			cli, srv := loopbackPair(b, bm.collapse)
+
+			chunk := make([]byte, 64<<10)
+			done := make(chan error, 1)
+			go func() {
+				buf := make([]byte, len(chunk))
+				for total := 0; total < b.N*len(chunk); {
+					n, err := unix.Read(srv.FD.FD(), buf)
+					if err != nil {
+						done <- err
+						return
+					}
+					total += n
+				}
+				done <- nil
+			}()
+
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			for range b.N {
+				for off := 0; off < len(chunk); {
+					n, err := unix.Write(cli.FD.FD(), chunk[off:])
+					if err != nil {
+						b.Fatalf("write: %v", err)
+					}
+					off += n
+				}
+			}
+			if err := <-done; err != nil {
+				b.Fatalf("read: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/procfs"
+	"subtrace.dev/tracer"
+)
+
+// A traced process that calls setns(2) or unshare(2) with CLONE_NEWNET moves
+// to a network namespace where addresses mean something else: its loopback,
+// its interfaces and its routes are not ours. Sockets we create for it and
+// dials we make on its behalf would silently reach different endpoints than
+// the process would without subtrace.
+
+// NetnsPolicy decides what happens to sockets created by a process after it
+// switches to another network namespace: "follow" creates them, and every
+// socket used to proxy them, inside the process's namespace, while
+// "passthrough" leaves them to the kernel untraced. Sockets created before
+// the switch are unaffected.
+var NetnsPolicy = "follow"
+
+// ValidNetnsPolicy reports whether policy is a valid NetnsPolicy.
+func ValidNetnsPolicy(policy string) bool {
+	return policy == "follow" || policy == "passthrough"
+}
+
+// Netns is a network namespace other than subtrace's own.
+type Netns struct {
+	Inode uint64
+	f     *os.File
+
+	once     sync.Once
+	enterErr error
+}
+
+// selfNetns is read during package initialization, before any thread could
+// have entered another namespace.
+var selfNetns, selfNetnsErr = netnsInode(procfs.Path("thread-self/ns/net"))
+
+func netnsInode(path string) (uint64, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0, fmt.Errorf("stat %s: %w", path, err)
+	}
+	return stat.Ino, nil
+}
+
+// InForeignNetns reports whether thread tid is in a network namespace other
+// than subtrace's own, along with that namespace's inode.
+func InForeignNetns(tid int) (uint64, bool, error) {
+	if selfNetnsErr != nil {
+		return 0, false, selfNetnsErr
+	}
+	ino, err := netnsInode(procfs.Path("%d/ns/net", tid))
+	if err != nil {
+		return 0, false, err
+	}
+	return ino, ino != selfNetns, nil
+}
+
+// OpenNetns opens the network namespace of thread tid. The namespace stays
+// alive for as long as the returned Netns does, even if the thread exits.
+func OpenNetns(tid int) (*Netns, error) {
+	path := procfs.Path("%d/ns/net", tid)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &stat); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("fstat %s: %w", path, err)
+	}
+	return &Netns{Inode: stat.Ino, f: f}, nil
+}
+
+// CanEnter reports whether subtrace is allowed to enter the namespace, which
+// needs CAP_SYS_ADMIN in the user namespace that owns it. The answer is
+// checked once.
+func (ns *Netns) CanEnter() error {
+	ns.once.Do(func() {
+		ns.enterErr = ns.Enter(func() error { return nil })
+	})
+	return ns.enterErr
+}
+
+// Enter runs fn on a dedicated OS thread that has joined the namespace, so
+// that every socket fn creates belongs to it. A socket keeps its namespace
+// for life, so only creating it needs to happen in here. The thread is
+// discarded afterwards. Enter on a nil Netns just calls fn.
+func (ns *Netns) Enter(fn func() error) error {
+	if ns == nil {
+		return fn()
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		// Never unlocked: the runtime terminates the thread when the goroutine
+		// exits instead of reusing it in the wrong namespace.
+		runtime.LockOSThread()
+		if err := unix.Setns(int(ns.f.Fd()), unix.CLONE_NEWNET); err != nil {
+			errc <- fmt.Errorf("setns: %w", err)
+			return
+		}
+		errc <- fn()
+	}()
+	return <-errc
+}
+
+// enterNetns is Enter for call sites that return a value.
+func enterNetns[T any](ns *Netns, fn func() (T, error)) (T, error) {
+	var ret T
+	err := ns.Enter(func() error {
+		var err error
+		ret, err = fn()
+		return err
+	})
+	return ret, err
+}
+
+// NoteNetnsSwitch logs and publishes a diagnostic event the first time a
+// process creates a socket in the network namespace ino. policy is how its
+// sockets are handled and err is why they can't follow the process, if so.
+func NoteNetnsSwitch(g *global.Global, tmpl *event.Event, ino uint64, policy string, err error) {
+	if policy == "follow" {
+		slog.Info("process switched network namespaces, tracing its new sockets from inside it", "netns", ino, "pid", tmpl.Get("process_id"))
+		return
+	}
+
+	summary := fmt.Sprintf("process %s switched to network namespace %d, its new sockets are not traced", tmpl.Get("process_id"), ino)
+	if err != nil {
+		summary += fmt.Sprintf(": cannot enter it: %v", err)
+	} else {
+		summary += " (-netns=passthrough)"
+	}
+	slog.Warn(summary)
+
+	if g == nil || g.Config == nil {
+		return
+	}
+	ev := tmpl.Copy()
+	ev.Set("netns_inode", fmt.Sprintf("%d", ino))
+	ev.Set("netns_policy", policy)
+	if err != nil {
+		ev.Set("netns_error", err.Error())
+	}
+	tracer.AddDecision(ev, tracer.Decision{Layer: "socket", Verdict: "passthrough", Reason: tracer.ReasonNetns, Detail: fmt.Sprintf("netns %d", ino)}, tracer.CaptureNone)
+	go tracer.PublishConnection(g, ev, summary)
+}
@@ -0,0 +1,150 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+)
+
+// newTestNetns creates a network namespace joined to ours by a veth pair, with
+// 10.231.0.1 on our side and 10.231.0.2 on its side. It skips the test if that
+// isn't allowed.
+func newTestNetns(t *testing.T) *Netns {
+	if os.Getuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip not found")
+	}
+
+	name := fmt.Sprintf("subtrace-test-%d", os.Getpid())
+	host, peer := fmt.Sprintf("st%dh", os.Getpid()%100000), fmt.Sprintf("st%dp", os.Getpid()%100000)
+	ip := func(args ...string) error {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("ip %s: %w: %s", strings.Join(args, " "), err, out)
+		}
+		return nil
+	}
+	if err := ip("netns", "add", name); err != nil {
+		t.Skipf("cannot create network namespace: %v", err)
+	}
+	t.Cleanup(func() { ip("netns", "del", name) })
+
+	for _, args := range [][]string{
+		{"link", "add", host, "type", "veth", "peer", "name", peer},
+		{"link", "set", peer, "netns", name},
+		{"addr", "add", "10.231.0.1/30", "dev", host},
+		{"link", "set", host, "up"},
+		{"-n", name, "addr", "add", "10.231.0.2/30", "dev", peer},
+		{"-n", name, "link", "set", peer, "up"},
+		{"-n", name, "link", "set", "lo", "up"},
+	} {
+		if err := ip(args...); err != nil {
+			t.Skipf("cannot set up veth: %v", err)
+		}
+	}
+	t.Cleanup(func() { ip("link", "del", host) })
+
+	f, err := os.Open("/run/netns/" + name)
+	if err != nil {
+		t.Fatalf("open netns: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &stat); err != nil {
+		t.Fatalf("fstat netns: %v", err)
+	}
+	ns := &Netns{Inode: stat.Ino, f: f}
+	if err := ns.CanEnter(); err != nil {
+		t.Skipf("cannot enter network namespace: %v", err)
+	}
+	return ns
+}
+
+// echoOnce accepts one connection on lis and writes name to it.
+func echoOnce(lis net.Listener, name string) {
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, name)
+	}()
+}
+
+func TestConnectInNetns(t *testing.T) {
+	ns := newTestNetns(t)
+	g := &global.Global{Config: config.New()}
+
+	// The same loopback port is a different listener on each side.
+	inside, err := enterNetns(ns, func() (net.Listener, error) {
+		return net.Listen("tcp4", "127.0.0.1:0")
+	})
+	if err != nil {
+		t.Fatalf("listen inside: %v", err)
+	}
+	defer inside.Close()
+	echoOnce(inside, "inside")
+	if outside, err := net.Listen("tcp4", inside.Addr().String()); err == nil {
+		defer outside.Close()
+		echoOnce(outside, "outside")
+	}
+
+	// And the veth address of our side is reachable from inside.
+	host, err := net.Listen("tcp4", "10.231.0.1:0")
+	if err != nil {
+		t.Fatalf("listen on veth: %v", err)
+	}
+	defer host.Close()
+	echoOnce(host, "host")
+
+	for addr, want := range map[string]string{
+		inside.Addr().String(): "inside",
+		host.Addr().String():   "host",
+	} {
+		sock, err := CreateSocketInNetns(g, event.New(), unix.AF_INET, unix.SOCK_STREAM, ns)
+		if err != nil {
+			t.Fatalf("create socket: %v", err)
+		}
+		errno, err := sock.Connect(netip.MustParseAddrPort(addr), nil)
+		if err != nil || errno != 0 {
+			t.Fatalf("connect %s: errno=%v err=%v", addr, errno, err)
+		}
+
+		tv := unix.NsecToTimeval((5 * time.Second).Nanoseconds())
+		if err := unix.SetsockoptTimeval(sock.FD.FD(), unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			t.Fatalf("set SO_RCVTIMEO: %v", err)
+		}
+		var b []byte
+		buf := make([]byte, 64)
+		for {
+			n, err := unix.Read(sock.FD.FD(), buf)
+			if err != nil {
+				t.Fatalf("read from %s: %v", addr, err)
+			}
+			if n == 0 {
+				break
+			}
+			b = append(b, buf[:n]...)
+		}
+		if string(b) != want {
+			t.Errorf("connect %s: got %q, want %q", addr, b, want)
+		}
+		sock.Close()
+	}
+}
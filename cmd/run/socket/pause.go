@@ -0,0 +1,319 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"subtrace.dev/clock"
+	"subtrace.dev/procfs"
+	"subtrace.dev/tracer"
+)
+
+// ListenStallTimeout is how long a traced listener may leave a full backlog of
+// connections unaccepted before the external accept loop stops pulling more.
+// Servers doing a graceful restart often just stop calling accept(2) while
+// they finish their existing connections; without subtrace, new clients wait
+// in the kernel's backlog for whoever takes over the port instead of being
+// accepted and later reset when the process exits. Zero disables the
+// heuristic.
+var ListenStallTimeout = 5 * time.Second
+
+// stallCheckInterval is how often the stall heuristic runs.
+var stallCheckInterval = time.Second
+
+const (
+	pauseShutdown = "shutdown" // the process called shutdown(2) on the listener
+	pauseStalled  = "stalled"  // the process stopped calling accept(2)
+	pauseOverflow = "overflow" // the process's enforced backlog is full
+)
+
+// readTCPAbortOnOverflow reads the sysctl that decides what Linux does with a
+// connection that completes the handshake while the accept queue is full. It's
+// a variable so that tests can fake it.
+var readTCPAbortOnOverflow = func() ([]byte, error) {
+	return os.ReadFile(procfs.Path("sys/net/ipv4/tcp_abort_on_overflow"))
+}
+
+// acceptGate pauses and resumes the external accept loop of a listener.
+type acceptGate struct {
+	mu      sync.Mutex
+	paused  bool
+	reason  string
+	since   time.Time
+	resumed chan struct{} // closed when the current pause ends
+
+	done     chan struct{} // closed when the listener is closed
+	doneOnce sync.Once
+
+	pending    atomic.Int64 // accepted externally but not yet by the process
+	lastAccept atomic.Int64 // clock.Mono() at the process's last accept(2)
+
+	// stallTimeout and checkInterval are ListenStallTimeout and
+	// stallCheckInterval when the gate was created, and clock is the clock
+	// they're measured on. They don't change afterwards.
+	stallTimeout  time.Duration
+	checkInterval time.Duration
+	clock         *clock.Detector
+
+	// With EnforceBacklog, the process's backlog overflows once limit
+	// connections are pending. What happens to the next one depends on abort,
+	// which mirrors tcp_abort_on_overflow. Zero limit disables overflows.
+	limit     int64
+	abort     bool
+	overflow  overflow // current episode, guarded by mu
+	overflows int      // episodes so far, guarded by mu
+}
+
+// overflow is an interval during which the process's backlog was full.
+type overflow struct {
+	seq    int       // 1 for the listener's first episode
+	since  time.Time // zero if there's no episode in progress
+	resets int       // connections reset in abort mode
+}
+
+func newAcceptGate() *acceptGate {
+	g := &acceptGate{
+		done:          make(chan struct{}),
+		stallTimeout:  ListenStallTimeout,
+		checkInterval: stallCheckInterval,
+		clock:         clock.Default,
+	}
+	g.accepted()
+	return g
+}
+
+// accepted records that the process accepted a connection.
+func (g *acceptGate) accepted() {
+	g.lastAccept.Store(int64(g.clock.Mono()))
+}
+
+// wait blocks while the gate is paused. It returns false if the listener was
+// closed in the meantime.
+func (g *acceptGate) wait() bool {
+	for {
+		g.mu.Lock()
+		if !g.paused {
+			g.mu.Unlock()
+			return true
+		}
+		ch := g.resumed
+		g.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-g.done:
+			return false
+		}
+	}
+}
+
+// pause pauses the gate and reports whether it wasn't paused already.
+func (g *acceptGate) pause(reason string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return false
+	}
+	g.paused, g.reason, g.since = true, reason, time.Now()
+	g.resumed = make(chan struct{})
+	return true
+}
+
+// resume ends the current pause if it was caused by one of reasons and
+// returns the pause's reason and duration.
+func (g *acceptGate) resume(reasons ...string) (string, time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		return "", 0, false
+	}
+	for _, r := range reasons {
+		if r == g.reason {
+			g.paused = false
+			close(g.resumed)
+			return g.reason, time.Since(g.since), true
+		}
+	}
+	return "", 0, false
+}
+
+// overflowed records that a connection arrived while the process's backlog
+// was full and reports whether it started a new episode.
+func (g *acceptGate) overflowed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	start := g.overflow.since.IsZero()
+	if start {
+		g.overflows++
+		g.overflow = overflow{seq: g.overflows, since: time.Now()}
+	}
+	if g.abort {
+		g.overflow.resets++
+	}
+	return start
+}
+
+// endOverflow ends the current overflow episode and returns it.
+func (g *acceptGate) endOverflow() (overflow, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.overflow.since.IsZero() {
+		return overflow{}, false
+	}
+	ret := g.overflow
+	g.overflow = overflow{}
+	return ret, true
+}
+
+// stop makes wait return false from now on.
+func (g *acceptGate) stop() {
+	g.doneOnce.Do(func() { close(g.done) })
+}
+
+// stalled reports whether the process has left at least backlog connections
+// unaccepted for the stall timeout. Right after the wall clock jumped, which
+// is what a resume from suspend looks like, the process is given time to
+// catch up on the connections that arrived in the meantime instead.
+func (g *acceptGate) stalled(backlog int) bool {
+	if g.stallTimeout <= 0 || g.pending.Load() < int64(backlog) {
+		return false
+	}
+	if g.clock.Mono()-time.Duration(g.lastAccept.Load()) < g.stallTimeout {
+		return false
+	}
+	return !g.clock.InGrace()
+}
+
+// readAbortOnOverflow reports whether tcp_abort_on_overflow is set in the
+// socket's network namespace.
+func (s *Socket) readAbortOnOverflow() bool {
+	if !procfs.Has(procfs.FeatureSysctls) {
+		return false // the kernel's default
+	}
+	b, err := enterNetns(s.Inode.netns, readTCPAbortOnOverflow)
+	if err != nil {
+		slog.Debug("failed to read tcp_abort_on_overflow", "sock", s, "err", err) // not fatal: the kernel defaults to 0
+		return false
+	}
+	return strings.TrimSpace(string(b)) != "0"
+}
+
+// handleOverflow is called by the accept loop with a connection it accepted
+// externally and reports whether the connection should be dispatched. If the
+// process's backlog is full, the overflow is handled the way the kernel would
+// handle it: with tcp_abort_on_overflow set, the connection is reset;
+// otherwise the accept loop is paused until the process accepts a connection
+// so that new clients wait in the external listener's backlog, where their
+// handshakes are retried instead of completed.
+func (s *Socket) handleOverflow(g *acceptGate, addr string, external net.Conn) bool {
+	if g.limit == 0 || g.pending.Load() < g.limit {
+		return true
+	}
+	if g.overflowed() {
+		slog.Debug("process backlog overflowed", "sock", s, "addr", addr, "backlog", g.limit, "abort", g.abort)
+	}
+	if g.abort {
+		if tcp, ok := external.(*net.TCPConn); ok {
+			tcp.SetLinger(0) // RST instead of FIN
+		}
+		external.Close()
+		return false
+	}
+	if g.pause(pauseOverflow) {
+		s.publishAcceptGate(addr, "paused", pauseOverflow, 0)
+	}
+	// The process may have accepted a connection before the pause.
+	s.releaseOverflow(g, addr, false)
+	return true
+}
+
+// releaseOverflow ends the current overflow episode if the process's backlog
+// has room again or force is set, resuming the accept loop and publishing the
+// episode.
+func (s *Socket) releaseOverflow(g *acceptGate, addr string, force bool) {
+	if g.limit == 0 || (!force && g.pending.Load() >= g.limit) {
+		return
+	}
+	if reason, d, ok := g.resume(pauseOverflow); ok {
+		s.publishAcceptGate(addr, "resumed", reason, d)
+	}
+	ep, ok := g.endOverflow()
+	if !ok {
+		return
+	}
+
+	took := time.Since(ep.since)
+	mode := "drop"
+	if g.abort {
+		mode = "abort"
+	}
+	slog.Debug("process backlog overflow ended", "sock", s, "addr", addr, "mode", mode, "episode", ep.seq, "resets", ep.resets, "took", took)
+
+	if s.global == nil || s.global.Config == nil {
+		return
+	}
+	ev := s.tmpl.Copy()
+	s.Inode.setHistoryTag(ev)
+	ev.Set("listener_addr", addr)
+	ev.Set("listener_backlog", fmt.Sprintf("%d", g.limit))
+	ev.Set("listener_overflow_mode", mode)
+	ev.Set("listener_overflow_episode", fmt.Sprintf("%d", ep.seq))
+	ev.Set("listener_overflow_resets", fmt.Sprintf("%d", ep.resets))
+	ev.Set("listener_overflow_ms", fmt.Sprintf("%d", took.Milliseconds()))
+	summary := fmt.Sprintf("listener %s backlog of %d overflowed for %s", addr, g.limit, took.Round(time.Millisecond))
+	if g.abort {
+		summary += fmt.Sprintf(", %d connections reset", ep.resets)
+	}
+	go tracer.PublishConnection(s.global, ev, summary)
+}
+
+// watchStalls pauses the gate when the process stops accepting connections
+// until the listener is closed.
+func (s *Socket) watchStalls(g *acceptGate, addr string, backlog int) {
+	if g.stallTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(g.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			if g.stalled(backlog) && g.pause(pauseStalled) {
+				s.publishAcceptGate(addr, "paused", pauseStalled, 0)
+			}
+		}
+	}
+}
+
+// publishAcceptGate logs a pause or resume of the external accept loop and
+// publishes it as an event so that the intervals during which the listener
+// wasn't taking connections show up next to its requests.
+func (s *Socket) publishAcceptGate(addr string, state string, reason string, paused time.Duration) {
+	slog.Debug("external accept loop "+state, "sock", s, "addr", addr, "reason", reason, "paused", paused)
+
+	if s.global == nil || s.global.Config == nil {
+		return
+	}
+	ev := s.tmpl.Copy()
+	s.Inode.setHistoryTag(ev)
+	ev.Set("listener_addr", addr)
+	ev.Set("listener_accept", state)
+	ev.Set("listener_pause_reason", reason)
+	summary := fmt.Sprintf("listener %s stopped accepting (%s)", addr, reason)
+	if state == "resumed" {
+		ev.Set("listener_paused_ms", fmt.Sprintf("%d", paused.Milliseconds()))
+		summary = fmt.Sprintf("listener %s resumed accepting after %s (%s)", addr, paused.Round(time.Millisecond), reason)
+	}
+	go tracer.PublishConnection(s.global, ev, summary)
+}
@@ -0,0 +1,339 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/clock"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/procfs"
+	"subtrace.dev/tracer"
+)
+
+// listenTraced creates a traced socket listening with the given backlog and
+// returns it along with the external address clients connect to.
+func listenTraced(t testing.TB, backlog int) (*Socket, string) {
+	g := &global.Global{Config: config.New()}
+	lis, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create listening socket: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	if errno, err := lis.Bind(netip.MustParseAddrPort("127.0.0.1:0")); err != nil || errno != 0 {
+		t.Fatalf("bind: errno=%v, err=%v", errno, err)
+	}
+	if errno, err := lis.Listen(backlog); err != nil || errno != 0 {
+		t.Fatalf("listen: errno=%v, err=%v", errno, err)
+	}
+	if err := unix.Listen(lis.FD.FD(), backlog); err != nil {
+		t.Fatalf("listen(2): %v", err)
+	}
+	return lis, lis.Inode.state.Load().listening.lis.Addr().String()
+}
+
+func isPaused(g *acceptGate) (bool, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused, g.reason
+}
+
+func TestListenerStall(t *testing.T) {
+	// The listener's gate copies these when it's created, so changing them
+	// here doesn't affect the gates of other tests' listeners.
+	prevTimeout, prevInterval := ListenStallTimeout, stallCheckInterval
+	ListenStallTimeout, stallCheckInterval = 200*time.Millisecond, 20*time.Millisecond
+	t.Cleanup(func() { ListenStallTimeout, stallCheckInterval = prevTimeout, prevInterval })
+	await := awaitProxies(t)
+
+	const backlog = 8
+	lis, addr := listenTraced(t, backlog)
+	gate := lis.Inode.state.Load().listening.gate
+
+	dial := func() {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+	for range backlog {
+		dial()
+	}
+	testutil.WaitFor(t, "stall", func() bool { paused, _ := isPaused(gate); return paused })
+	if _, reason := isPaused(gate); reason != pauseStalled {
+		t.Fatalf("got pause reason %q, want %q", reason, pauseStalled)
+	}
+
+	// New clients aren't handed to the process while paused.
+	dial()
+	time.Sleep(100 * time.Millisecond)
+	if n := gate.pending.Load(); n != backlog {
+		t.Fatalf("got %d pending connections while paused, want %d", n, backlog)
+	}
+
+	srv, errno, err := lis.Accept(0)
+	if err != nil || errno != 0 {
+		t.Fatalf("accept: errno=%v, err=%v", errno, err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	await(srv)
+	if paused, _ := isPaused(gate); paused {
+		t.Fatalf("still paused after accept")
+	}
+	testutil.WaitFor(t, "queued client", func() bool { return gate.pending.Load() == backlog })
+}
+
+func TestListenerShutdown(t *testing.T) {
+	lis, _ := listenTraced(t, 8)
+	gate := lis.Inode.state.Load().listening.gate
+
+	if errno, err := lis.Shutdown(unix.SHUT_WR); err != nil || errno != 0 {
+		t.Fatalf("shutdown(SHUT_WR): errno=%v, err=%v", errno, err)
+	}
+	if paused, _ := isPaused(gate); paused {
+		t.Fatalf("paused after shutdown(SHUT_WR)")
+	}
+
+	if errno, err := lis.Shutdown(unix.SHUT_RDWR); err != nil || errno != 0 {
+		t.Fatalf("shutdown(SHUT_RDWR): errno=%v, err=%v", errno, err)
+	}
+	if paused, reason := isPaused(gate); !paused || reason != pauseShutdown {
+		t.Fatalf("got paused=%v reason=%q after shutdown(SHUT_RDWR), want paused for %q", paused, reason, pauseShutdown)
+	}
+
+	if errno, err := lis.Listen(8); err != nil || errno != 0 {
+		t.Fatalf("listen again: errno=%v, err=%v", errno, err)
+	}
+	if paused, _ := isPaused(gate); paused {
+		t.Fatalf("still paused after listening again")
+	}
+}
+
+// TestListenerStallClockJump resumes from suspend with a full backlog. The
+// wall clock jumped by an hour, but the process must still get
+// stall timeout after the grace interval to catch up.
+func TestListenerStallClockJump(t *testing.T) {
+	const timeout = 5 * time.Second
+	if clock.Grace <= timeout {
+		t.Skipf("grace interval %s isn't longer than the stall timeout", clock.Grace)
+	}
+	f := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	const backlog = 8
+	g := newAcceptGate()
+	g.clock, g.stallTimeout = clock.NewDetector(f), timeout
+	g.accepted()
+	g.pending.Store(backlog)
+
+	f.Advance(time.Second)
+	f.Step(time.Hour)
+	if g.stalled(backlog) {
+		t.Fatalf("stalled right after resuming")
+	}
+	f.Advance(timeout)
+	if g.stalled(backlog) {
+		t.Fatalf("stalled %s after resuming, within the grace interval", timeout)
+	}
+	f.Advance(clock.Grace)
+	if !g.stalled(backlog) {
+		t.Fatalf("not stalled after the grace interval")
+	}
+
+	g.accepted()
+	f.Step(-time.Hour)
+	f.Advance(clock.Grace)
+	if g.stalled(backlog) {
+		t.Fatalf("stalled after the wall clock was stepped back")
+	}
+}
+
+// enforceBacklog enables EnforceBacklog with tcp_abort_on_overflow set to val.
+func enforceBacklog(t *testing.T, val string) {
+	prevRead, prevEnforce := readTCPAbortOnOverflow, EnforceBacklog
+	readTCPAbortOnOverflow = func() ([]byte, error) { return []byte(val + "\n"), nil }
+	EnforceBacklog = true
+	t.Cleanup(func() { readTCPAbortOnOverflow, EnforceBacklog = prevRead, prevEnforce })
+}
+
+// TestAbortOnOverflowDegraded checks that tcp_abort_on_overflow isn't read
+// when /proc/sys can't be, and that the kernel's default is assumed instead.
+func TestAbortOnOverflowDegraded(t *testing.T) {
+	enforceBacklog(t, "1")
+	s := &Socket{Inode: new(Inode)}
+	if !s.readAbortOnOverflow() {
+		t.Fatalf("got tcp_abort_on_overflow unset, want set")
+	}
+
+	prevRoot := procfs.Root
+	procfs.Root = t.TempDir()
+	procfs.Init()
+	procfs.Root = prevRoot
+	t.Cleanup(func() { procfs.Init() })
+	if s.readAbortOnOverflow() {
+		t.Errorf("got tcp_abort_on_overflow set without network sysctls, want the default")
+	}
+}
+
+// overflowEvents returns the tags of the overflow episodes published for the
+// listener on addr.
+func overflowEvents(addr string) []map[string]string {
+	var ret []map[string]string
+	for _, tags := range tracer.RecentConnections() {
+		if tags["listener_addr"] == addr && tags["listener_overflow_mode"] != "" {
+			ret = append(ret, tags)
+		}
+	}
+	return ret
+}
+
+// awaitProxies returns a function that records the proxy of an accepted
+// socket once it has started. The test's last cleanup waits for the recorded
+// proxies to finish after the other cleanups closed their connections: they
+// start in the background and read the package's settings as they do, so they
+// mustn't outlive the test.
+func awaitProxies(t *testing.T) func(srv *Socket) {
+	var ps []*proxy
+	t.Cleanup(func() {
+		for _, p := range ps {
+			testutil.WaitFor(t, "the proxy to finish", func() bool { return !isRunning(p) })
+		}
+	})
+	return func(srv *Socket) {
+		t.Helper()
+		p := srv.Inode.state.Load().connected.proxy
+		testutil.WaitFor(t, "the proxy to start", func() bool { return isRunning(p) })
+		ps = append(ps, p)
+	}
+}
+
+// floodClients dials n clients at once and returns what each of them read.
+func floodClients(t *testing.T, addr string, n int) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			_, errs[i] = conn.Read(make([]byte, 1))
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestBacklogOverflowAbort(t *testing.T) {
+	enforceBacklog(t, "1")
+	await := awaitProxies(t)
+
+	const backlog, flood = 2, 6
+	lis, addr := listenTraced(t, backlog)
+	gate := lis.Inode.state.Load().listening.gate
+	if !gate.abort || gate.limit != backlog {
+		t.Fatalf("got abort=%v limit=%d", gate.abort, gate.limit)
+	}
+
+	for range backlog {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+	testutil.WaitFor(t, "full backlog", func() bool { return gate.pending.Load() == backlog })
+
+	// Every client past the backlog is accepted and reset, like the kernel
+	// does with tcp_abort_on_overflow.
+	for i, err := range floodClients(t, addr, flood) {
+		if !errors.Is(err, unix.ECONNRESET) {
+			t.Errorf("client %d: got %v, want ECONNRESET", i, err)
+		}
+	}
+	if n := gate.pending.Load(); n != backlog {
+		t.Fatalf("got %d pending connections, want %d", n, backlog)
+	}
+	if paused, _ := isPaused(gate); paused {
+		t.Fatalf("paused in abort mode")
+	}
+
+	srv, errno, err := lis.Accept(0)
+	if err != nil || errno != 0 {
+		t.Fatalf("accept: errno=%v, err=%v", errno, err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	await(srv)
+
+	var events []map[string]string
+	testutil.WaitFor(t, "overflow event", func() bool { events = overflowEvents(addr); return len(events) > 0 })
+	if ev := events[0]; ev["listener_overflow_mode"] != "abort" || ev["listener_overflow_episode"] != "1" || ev["listener_overflow_resets"] != fmt.Sprint(flood) {
+		t.Errorf("got overflow event %v", ev)
+	}
+}
+
+func TestBacklogOverflowDrop(t *testing.T) {
+	enforceBacklog(t, "0")
+	await := awaitProxies(t)
+
+	// The flood fits in the external listener's accept queue so that no
+	// client has to wait for the kernel to retransmit its handshake.
+	const backlog, flood = 2, 3
+	lis, addr := listenTraced(t, backlog)
+	gate := lis.Inode.state.Load().listening.gate
+	if gate.abort {
+		t.Fatalf("got abort mode with tcp_abort_on_overflow=0")
+	}
+
+	// Nobody is reset while the process's backlog is full: the accept loop
+	// stops and the rest wait in the external listener's backlog.
+	done := make(chan []error)
+	go func() { done <- floodClients(t, addr, backlog+flood) }()
+	testutil.WaitFor(t, "overflow", func() bool { _, reason := isPaused(gate); return reason == pauseOverflow })
+	if n := gate.pending.Load(); n != backlog {
+		t.Fatalf("got %d pending connections while paused, want %d", n, backlog)
+	}
+
+	for i := range backlog + flood {
+		srv, errno, err := lis.Accept(0)
+		if err != nil || errno != 0 {
+			t.Fatalf("accept %d: errno=%v, err=%v", i, errno, err)
+		}
+		t.Cleanup(func() { srv.Close() })
+		await(srv)
+	}
+	for i, err := range <-done {
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("client %d: got %v, want a read timeout", i, err)
+		}
+	}
+	if paused, _ := isPaused(gate); paused {
+		t.Fatalf("still paused after the process accepted every client")
+	}
+
+	var events []map[string]string
+	testutil.WaitFor(t, "overflow event", func() bool { events = overflowEvents(addr); return len(events) > 0 })
+	for _, ev := range events {
+		if ev["listener_overflow_mode"] != "drop" || ev["listener_overflow_resets"] != "0" {
+			t.Errorf("got overflow event %v", ev)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"log/slog"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"subtrace.dev/pcapng"
+)
+
+// Pcap is the capture that the bytes of every proxied TCP connection are
+// mirrored into, if it's set. It must be set before any proxies start.
+//
+// Each connection is written as one synthetic TCP stream between the real
+// addresses of the external connection. For intercepted TLS connections, the
+// stream is the decrypted plaintext, so no key material is needed to read it.
+// Collapsed loopback connections and unix domain sockets aren't written.
+//
+// The payload policy applies to the capture too: the bytes of a connection are
+// only mirrored if payloads are allowed for its host. While the policy denies
+// any host, connections whose host isn't known when mirroring would start are
+// left without their bytes as well, since the requests that name it are only
+// parsed after they're forwarded.
+//
+// The values of redacted headers (see config.Redact) are left out of HTTP/1
+// and HTTP/2 traffic, like they are from events.
+var Pcap *pcapng.Writer
+
+// pcapMirror writes the bytes that go through one side of a bufConn to a
+// capture stream in direction dir, with redacted headers left out.
+type pcapMirror struct {
+	stream *pcapng.Stream
+	dir    pcapng.Dir
+
+	mu     sync.Mutex
+	redact *pcapRedactor
+}
+
+func (m *pcapMirror) write(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b = m.redact.redact(b); len(b) > 0 {
+		m.stream.Write(time.Now(), m.dir, b)
+	}
+}
+
+// flush writes the bytes the redactor held back, once no more are coming.
+func (m *pcapMirror) flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b := m.redact.flush(); len(b) > 0 {
+		m.stream.Write(time.Now(), m.dir, b)
+	}
+}
+
+// startPcap starts the proxy's capture stream and mirrors the bytes exchanged
+// on the external connection into it.
+func (p *proxy) startPcap() {
+	if Pcap == nil || p.passthrough {
+		return
+	}
+	local, err := netip.ParseAddrPort(p.externalInfo.Local)
+	if err != nil {
+		return
+	}
+	remote, err := netip.ParseAddrPort(p.externalInfo.Remote)
+	if err != nil {
+		return
+	}
+
+	// The client of the stream is whoever opened the connection: the traced
+	// process for outgoing connections, the peer for incoming ones.
+	out, in := pcapng.ClientToServer, pcapng.ServerToClient
+	if p.isOutgoing {
+		p.pcap = Pcap.NewStream(p.begin, local, remote)
+	} else {
+		p.pcap = Pcap.NewStream(p.begin, remote, local)
+		out, in = in, out
+	}
+
+	var host string
+	if p.isOutgoing {
+		host = hostnameFor(remote.Addr().Unmap())
+	}
+	if !p.pcapAllowed(host) {
+		// The stream still shows the connection, but none of its bytes.
+		slog.Debug("not mirroring connection to pcap because of the payload policy", "proxy", p, "host", host)
+		return
+	}
+	p.mirrorPcap(p.wire, out, in)
+}
+
+// pcapAllowed reports whether the payload policy lets the bytes exchanged with
+// host be mirrored. An empty host is one that isn't known.
+func (p *proxy) pcapAllowed(host string) bool {
+	if p.global == nil || p.global.Config == nil || !p.global.Config.PayloadsRestricted() {
+		return true
+	}
+	return host != "" && p.global.Config.IsPayloadAllowed(host)
+}
+
+// mirrorPcap mirrors the bytes written to c in direction out and the bytes
+// read from it in direction in, and stops mirroring every other bufConn.
+func (p *proxy) mirrorPcap(c *bufConn, out, in pcapng.Dir) {
+	if p.pcap == nil {
+		return
+	}
+	for _, prev := range []*bufConn{p.wire, p.plain.Load()} {
+		if prev != nil && prev != c {
+			for _, m := range []*atomic.Pointer[pcapMirror]{&prev.wmirror, &prev.rmirror} {
+				if m := m.Swap(nil); m != nil {
+					m.flush()
+				}
+			}
+		}
+	}
+	if c != nil {
+		c.wmirror.Store(p.newPcapMirror(out))
+		c.rmirror.Store(p.newPcapMirror(in))
+	}
+}
+
+func (p *proxy) newPcapMirror(dir pcapng.Dir) *pcapMirror {
+	return &pcapMirror{stream: p.pcap, dir: dir, redact: newPcapRedactor(p.redactedHeaders(), dir == pcapng.ClientToServer)}
+}
+
+// stopPcap ends the proxy's capture stream.
+func (p *proxy) stopPcap() {
+	if p.pcap == nil {
+		return
+	}
+	p.mirrorPcap(nil, 0, 0)
+	p.pcap.Close(time.Now())
+	if err := Pcap.Flush(); err != nil {
+		slog.Debug("failed to flush pcap", "proxy", p, "err", err)
+	}
+}
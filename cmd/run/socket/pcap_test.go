@@ -0,0 +1,341 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"golang.org/x/sys/unix"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/pcapng"
+)
+
+// createPcap sets Pcap to a new capture and returns its path.
+func createPcap(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	w, err := pcapng.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	prev := Pcap
+	Pcap = w
+	t.Cleanup(func() {
+		Pcap = prev
+		w.Close()
+	})
+	return path
+}
+
+func TestPcap(t *testing.T) {
+	path := createPcap(t)
+
+	const req = "GET /pcap HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	const resp = "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\npcap!"
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, len(req)))
+		io.WriteString(conn, resp)
+	}()
+
+	sock, conn := dialTraced(t, netip.MustParseAddrPort(lis.Addr().String()))
+	if conn == nil {
+		t.FailNow()
+	}
+	io.WriteString(conn, req)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if b, err := io.ReadAll(conn); err != nil || string(b) != resp {
+		t.Fatalf("got response %q, err=%v", b, err)
+	}
+	conn.Close()
+	sock.Close() // the stream is flushed once the proxy is done
+
+	var b []byte
+	testutil.WaitFor(t, "the connection in the capture", func() bool {
+		b, _ = os.ReadFile(path)
+		return bytes.Contains(b, []byte(req)) && bytes.Contains(b, []byte(resp))
+	})
+	port := netip.MustParseAddrPort(lis.Addr().String()).Port()
+	if !bytes.Contains(b, []byte{byte(port >> 8), byte(port)}) {
+		t.Errorf("capture doesn't have the server's port %d", port)
+	}
+}
+
+// TestPcapPayloadDenied checks that the bytes of a connection to a host whose
+// payloads are denied aren't mirrored.
+func TestPcapPayloadDenied(t *testing.T) {
+	path := createPcap(t)
+	g := &global.Global{Config: newRewriteProxy(t, "payloads:\n  deny: [\"example.com\"]\n").global.Config}
+
+	const req = "POST /login HTTP/1.1\r\nHost: example.com\r\nContent-Length: 15\r\n\r\npassword=hunter"
+	const resp = "HTTP/1.1 200 OK\r\nContent-Length: 13\r\nConnection: close\r\n\r\nsession=s3cr3t"
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, len(req)))
+		io.WriteString(conn, resp)
+	}()
+
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if errno, err := sock.Connect(netip.MustParseAddrPort(lis.Addr().String()), nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v err=%v", errno, err)
+	}
+	conn := traceeConn(t, sock)
+	if conn == nil {
+		t.FailNow()
+	}
+	io.WriteString(conn, req)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if b, err := io.ReadAll(conn); err != nil || string(b) != resp {
+		t.Fatalf("got response %q, err=%v", b, err)
+	}
+	conn.Close()
+	finishProxy(t, sock.Inode.state.Load().connected.proxy, sock)
+
+	b, _ := os.ReadFile(path)
+	for _, s := range []string{"hunter", "s3cr3t", "/login"} {
+		if bytes.Contains(b, []byte(s)) {
+			t.Errorf("capture has %q", s)
+		}
+	}
+	port := netip.MustParseAddrPort(lis.Addr().String()).Port()
+	if !bytes.Contains(b, []byte{byte(port >> 8), byte(port)}) {
+		t.Errorf("capture doesn't have the connection to port %d", port)
+	}
+}
+
+// capturedPayloads decodes the IPv4 TCP segments in the capture at path and
+// returns the payloads of each source port, concatenated.
+func capturedPayloads(t *testing.T, path string) map[uint16][]byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read capture: %v", err)
+	}
+	ret := make(map[uint16][]byte)
+	for len(b) >= 12 {
+		typ, n := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if n < 12 || int(n) > len(b) {
+			t.Fatalf("block %#x: bad length %d", typ, n)
+		}
+		if body := b[8 : n-4]; typ == 6 { // enhanced packet block
+			frame := body[20 : 20+binary.LittleEndian.Uint32(body[12:])]
+			if binary.BigEndian.Uint16(frame[12:]) != 0x0800 {
+				t.Fatalf("unexpected ethertype %x", frame[12:14])
+			}
+			ip := frame[14:]
+			tcp := ip[4*(ip[0]&0xf) : binary.BigEndian.Uint16(ip[2:])]
+			port := binary.BigEndian.Uint16(tcp)
+			ret[port] = append(ret[port], tcp[4*(tcp[12]>>4):]...)
+		}
+		b = b[n:]
+	}
+	return ret
+}
+
+// TestPcapRedactsHeaders checks that the values of redacted headers are left
+// out of the segments in the capture.
+func TestPcapRedactsHeaders(t *testing.T) {
+	path := createPcap(t)
+
+	const req = "GET /me HTTP/1.1\r\nHost: example.com\r\nAuthorization: Bearer s3cr3t-token\r\nCookie: sid=abc123\r\n\r\n"
+	const resp = "HTTP/1.1 200 OK\r\nSet-Cookie: sid=xyz789; HttpOnly\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, len(req)))
+		io.WriteString(conn, resp)
+	}()
+
+	sock, conn := dialTraced(t, netip.MustParseAddrPort(lis.Addr().String()))
+	if conn == nil {
+		t.FailNow()
+	}
+	io.WriteString(conn, req)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if b, err := io.ReadAll(conn); err != nil || string(b) != resp {
+		t.Fatalf("got response %q, err=%v", b, err)
+	}
+	conn.Close()
+	finishProxy(t, sock.Inode.state.Load().connected.proxy, sock)
+
+	port := netip.MustParseAddrPort(lis.Addr().String()).Port()
+	var sent, received []byte
+	for p, payload := range capturedPayloads(t, path) {
+		if p == port {
+			received = payload
+		} else {
+			sent = payload
+		}
+	}
+	if want := "GET /me HTTP/1.1\r\nHost: example.com\r\nAuthorization: [redacted]\r\nCookie: [redacted]\r\n\r\n"; string(sent) != want {
+		t.Errorf("captured request %q, want %q", sent, want)
+	}
+	if want := "HTTP/1.1 200 OK\r\nSet-Cookie: [redacted]\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"; string(received) != want {
+		t.Errorf("captured response %q, want %q", received, want)
+	}
+}
+
+func TestPcapRedactorHTTP1(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		client bool
+		in     string
+		want   string
+	}{
+		{
+			name:   "request",
+			client: true,
+			in:     "POST / HTTP/1.1\r\nX-Api-Key: k\r\nContent-Length: 0\r\n\r\nGET / HTTP/1.1\r\nauthorization: b\r\n\r\n",
+			want:   "POST / HTTP/1.1\r\nX-Api-Key: [redacted]\r\nContent-Length: 0\r\n\r\nGET / HTTP/1.1\r\nauthorization: [redacted]\r\n\r\n",
+		},
+		{
+			name:   "bare LF and folded",
+			client: true,
+			in:     "GET / HTTP/1.1\nCookie: a=1;\n b=2\n\tc=3\nHost: x\n\n",
+			want:   "GET / HTTP/1.1\nCookie: [redacted]\nHost: x\n\n",
+		},
+		{
+			name: "not headers",
+			in:   "HTTP/1.1 200 OK\r\nX-Cookie: v\r\nSet-Cookie2 : v\r\n\r\nCookieless: body\ncookie: in the body",
+			want: "HTTP/1.1 200 OK\r\nX-Cookie: v\r\nSet-Cookie2 : v\r\n\r\nCookieless: body\ncookie: [redacted]",
+		},
+		{
+			name: "switching protocols",
+			in:   "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x05Cookie: x\n",
+			want: "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x05Cookie: x\n",
+		},
+	} {
+		for _, chunk := range []int{1, 3, len(tt.in)} {
+			r := newPcapRedactor(new(proxy).redactedHeaders(), tt.client)
+			var got []byte
+			for in := []byte(tt.in); len(in) > 0; {
+				n := min(chunk, len(in))
+				got = append(got, r.redact(in[:n])...)
+				in = in[n:]
+			}
+			got = append(got, r.flush()...)
+			if string(got) != tt.want {
+				t.Errorf("%s in chunks of %d: got %q, want %q", tt.name, chunk, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestPcapRedactorHTTP2(t *testing.T) {
+	secret := strings.Repeat("s3cr3t", 4000) // more than a frame
+	var in bytes.Buffer
+	in.WriteString(http2.ClientPreface)
+	fr := http2.NewFramer(&in, nil)
+	fr.WriteSettings(http2.Setting{ID: http2.SettingHeaderTableSize, Val: 65536})
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, f := range [][2]string{{":method", "GET"}, {":path", "/me"}, {"authorization", "Bearer " + secret}, {"cookie", "a=1"}, {"cookie", "b=2"}, {"accept", "*/*"}} {
+		enc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]})
+	}
+	b := block.Bytes()
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: b[:100], PadLength: 7, Priority: http2.PriorityParam{Weight: 15}})
+	fr.WriteContinuation(1, true, b[100:])
+	fr.WriteData(1, true, []byte("body"))
+
+	r := newPcapRedactor(new(proxy).redactedHeaders(), true)
+	var out []byte
+	for b := in.Bytes(); len(b) > 0; {
+		n := min(7, len(b))
+		out = append(out, r.redact(b[:n])...)
+		b = b[n:]
+	}
+	if bytes.Contains(out, []byte("s3cr3t")) {
+		t.Fatalf("output has the secret")
+	}
+	if !bytes.HasPrefix(out, []byte(http2.ClientPreface)) {
+		t.Fatalf("output doesn't start with the preface")
+	}
+
+	got := http2.NewFramer(nil, bytes.NewReader(out[len(http2.ClientPreface):]))
+	got.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if f, err := got.ReadFrame(); err != nil || f.Header().Type != http2.FrameSettings {
+		t.Fatalf("got frame %v, err=%v, want SETTINGS", f, err)
+	}
+	f, err := got.ReadFrame()
+	if err != nil {
+		t.Fatalf("read headers: %v", err)
+	}
+	mh, ok := f.(*http2.MetaHeadersFrame)
+	if !ok {
+		t.Fatalf("got frame %v, want HEADERS", f)
+	}
+	var fields []string
+	for _, f := range mh.Fields {
+		fields = append(fields, f.Name+"="+f.Value)
+	}
+	want := ":method=GET :path=/me authorization=[redacted] cookie=[redacted] cookie=[redacted] accept=*/*"
+	if strings.Join(fields, " ") != want || mh.StreamEnded() || mh.Priority.Weight != 15 {
+		t.Errorf("got headers %q (end stream %v, weight %d), want %q", strings.Join(fields, " "), mh.StreamEnded(), mh.Priority.Weight, want)
+	}
+	f, err = got.ReadFrame()
+	if data, ok := f.(*http2.DataFrame); err != nil || !ok || string(data.Data()) != "body" || !data.StreamEnded() {
+		t.Errorf("got frame %v, err=%v, want the DATA frame", f, err)
+	}
+
+	// The server's side starts with its SETTINGS frame rather than a preface.
+	in.Reset()
+	block.Reset()
+	fr.WriteSettings()
+	enc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+	enc.WriteField(hpack.HeaderField{Name: "set-cookie", Value: secret})
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndHeaders: true})
+	r = newPcapRedactor(new(proxy).redactedHeaders(), false)
+	got = http2.NewFramer(nil, bytes.NewReader(r.redact(in.Bytes())))
+	got.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	got.ReadFrame() // SETTINGS
+	f, err = got.ReadFrame()
+	if mh, ok := f.(*http2.MetaHeadersFrame); err != nil || !ok || len(mh.Fields) != 2 || mh.Fields[1].Value != redactedHeaderValue {
+		t.Errorf("got server frame %v, err=%v, want the cookie redacted", f, err)
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"subtrace.dev/config"
+)
+
+// redactedHeaderValue replaces the value of a redacted header in the capture,
+// like it does in events.
+const redactedHeaderValue = "[redacted]"
+
+const (
+	redactSniff = iota // not known yet
+	redactHTTP1
+	redactHTTP2
+	redactDrop // an HTTP/2 header block couldn't be decoded
+)
+
+const (
+	lineStart = iota
+	linePass
+	lineDrop // the value of a redacted header
+	lineSkip // a continuation line of one
+)
+
+// maxHeaderBlock is the largest HTTP/2 header block that's decoded.
+const maxHeaderBlock = 1 << 20
+
+// pcapRedactor removes the values of redacted headers from the bytes sent in
+// one direction of a connection before they're written to the capture.
+//
+// HTTP/1 header lines keep their name and get "[redacted]" as their value. It
+// only sees a byte stream, so it redacts such lines wherever they are, bodies
+// included, rather than miss one in a message that it didn't frame right.
+// HTTP/2 header blocks are decoded and encoded again with the values replaced,
+// without a dynamic table so that the result is valid whatever size the peers
+// agreed on. If a header block can't be decoded, the rest of the direction is
+// left out. Other protocols are written unchanged.
+type pcapRedactor struct {
+	headers []string // lowercase names of the redacted headers
+	client  bool     // from the side that opened the connection
+
+	mode int
+	held []byte // bytes that are only written once it's known what they are
+
+	// HTTP/1
+	line    int
+	folded  bool // the last header was redacted, and so are its continuations
+	cr      bool // the last byte dropped was a CR
+	upgrade bool // a 101 response switches protocols at the end of its head
+
+	// HTTP/2
+	pass   int    // payload bytes of the current frame still to write as is
+	block  []byte // header block so far, nil unless a CONTINUATION is expected
+	head   http2.FrameType
+	flags  http2.Flags
+	prefix []byte // priority or promised stream ID of the first frame
+	stream uint32
+	dec    *hpack.Decoder
+	enc    *hpack.Encoder
+	encBuf bytes.Buffer
+}
+
+func newPcapRedactor(headers []string, client bool) *pcapRedactor {
+	return &pcapRedactor{headers: headers, client: client}
+}
+
+// redactedHeaders returns the lowercase names of the headers whose values are
+// redacted.
+func (p *proxy) redactedHeaders() []string {
+	if p.global == nil || p.global.Config == nil {
+		return config.DefaultRedactedHeaders
+	}
+	return p.global.Config.RedactedHeaders()
+}
+
+// redacts reports whether the values of the named header are redacted.
+func (r *pcapRedactor) redacts(name []byte) bool {
+	return slices.ContainsFunc(r.headers, func(h string) bool { return strings.EqualFold(h, string(name)) })
+}
+
+// mayRedact reports whether a redacted header's name starts with prefix.
+func (r *pcapRedactor) mayRedact(prefix []byte) bool {
+	return slices.ContainsFunc(r.headers, func(h string) bool {
+		return len(prefix) <= len(h) && strings.EqualFold(h[:len(prefix)], string(prefix))
+	})
+}
+
+// redact returns the bytes to write for b, which may include bytes held back
+// from earlier calls.
+func (r *pcapRedactor) redact(b []byte) []byte {
+	buf := b
+	if len(r.held) > 0 {
+		buf = append(r.held, b...)
+	}
+	var out []byte
+	for len(buf) > 0 {
+		var n int
+		var more bool
+		switch r.mode {
+		case redactSniff:
+			n, more = r.sniff(buf)
+		case redactHTTP1:
+			out, n, more = r.http1(out, buf)
+		case redactHTTP2:
+			out, n, more = r.http2(out, buf)
+		default:
+			n = len(buf)
+		}
+		if more {
+			break
+		}
+		buf = buf[n:]
+	}
+	r.held = append(r.held[:0:0], buf...)
+	return out
+}
+
+// flush returns the bytes held back that can be written as they are.
+func (r *pcapRedactor) flush() []byte {
+	held := r.held
+	r.held = nil
+	if r.mode == redactSniff || (r.mode == redactHTTP1 && r.line == lineStart) {
+		return held
+	}
+	return nil // part of a frame or of a redacted value
+}
+
+// sniff picks the protocol from the first bytes. It consumes nothing.
+func (r *pcapRedactor) sniff(b []byte) (int, bool) {
+	if r.client {
+		switch {
+		case bytes.HasPrefix(b, []byte(http2.ClientPreface)):
+			r.mode = redactHTTP2
+		case strings.HasPrefix(http2.ClientPreface, string(b)):
+			return 0, true
+		default:
+			r.mode = redactHTTP1
+		}
+		return 0, false
+	}
+
+	// A server speaking HTTP/2 starts with a SETTINGS frame on stream 0, and
+	// an HTTP/1 response starts with "HTTP/", whose fourth byte isn't 0x4.
+	if len(b) >= 4 && http2.FrameType(b[3]) != http2.FrameSettings {
+		r.mode = redactHTTP1
+		return 0, false
+	}
+	if len(b) < 9 {
+		return 0, true
+	}
+	if binary.BigEndian.Uint32(b[5:])&(1<<31-1) == 0 {
+		r.mode = redactHTTP2
+	} else {
+		r.mode = redactHTTP1
+	}
+	return 0, false
+}
+
+func isTokenByte(c byte) bool {
+	return httpguts.IsTokenRune(rune(c))
+}
+
+// http1 redacts header lines.
+func (r *pcapRedactor) http1(out, b []byte) ([]byte, int, bool) {
+	switch r.line {
+	case linePass:
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			return append(out, b...), len(b), false
+		}
+		r.line = lineStart
+		return append(out, b[:i+1]...), i + 1, false
+
+	case lineDrop, lineSkip:
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			r.cr = b[len(b)-1] == '\r'
+			return out, len(b), false
+		}
+		if r.line == lineDrop {
+			if (i > 0 && b[i-1] == '\r') || (i == 0 && r.cr) {
+				out = append(out, '\r')
+			}
+			out = append(out, '\n')
+		}
+		r.line, r.cr = lineStart, false
+		return out, i + 1, false
+	}
+
+	// The start of a line.
+	if r.folded && (b[0] == ' ' || b[0] == '\t') {
+		r.line = lineSkip // a continuation of a redacted header
+		return out, 0, false
+	}
+	r.folded = false
+
+	if b[0] == '\r' && len(b) < 2 {
+		return out, 0, true
+	}
+	if b[0] == '\n' || (b[0] == '\r' && b[1] == '\n') {
+		// The end of a head. After a 101 response, the connection switches
+		// to whatever protocol was upgraded to.
+		if r.upgrade {
+			r.upgrade = false
+			r.mode = redactSniff
+		}
+		n := 1
+		if b[0] == '\r' {
+			n = 2
+		}
+		return append(out, b[:n]...), n, false
+	}
+
+	if r.client {
+		if bytes.HasPrefix(b, []byte(http2.ClientPreface)) {
+			r.mode = redactSniff // the client's side of an h2c upgrade
+			return out, 0, false
+		}
+		if strings.HasPrefix(http2.ClientPreface, string(b)) {
+			return out, 0, true
+		}
+	} else {
+		const switching = "HTTP/1.1 101 "
+		if bytes.HasPrefix(b, []byte(switching)) {
+			r.upgrade = true
+		} else if strings.HasPrefix(switching, string(b)) {
+			return out, 0, true
+		}
+	}
+
+	n := 0
+	for n < len(b) && isTokenByte(b[n]) && r.mayRedact(b[:n+1]) {
+		n++
+	}
+	if n == len(b) {
+		return out, 0, true // the name of a redacted header may go on
+	}
+	if n > 0 && b[n] == ':' && r.redacts(b[:n]) {
+		out = append(out, b[:n+1]...)
+		out = append(out, " "+redactedHeaderValue...)
+		r.line, r.cr, r.folded = lineDrop, false, true
+		return out, n + 1, false
+	}
+	r.line = linePass
+	return out, 0, false
+}
+
+// http2 passes frames through, except header blocks, which it redacts.
+func (r *pcapRedactor) http2(out, b []byte) ([]byte, int, bool) {
+	if r.pass > 0 {
+		n := min(r.pass, len(b))
+		r.pass -= n
+		return append(out, b[:n]...), n, false
+	}
+	if r.client && r.dec == nil && bytes.HasPrefix(b, []byte(http2.ClientPreface)) {
+		r.start()
+		return append(out, http2.ClientPreface...), len(http2.ClientPreface), false
+	}
+	if r.dec == nil {
+		r.start()
+	}
+
+	if len(b) < 9 {
+		return out, 0, true
+	}
+	length := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	typ, flags := http2.FrameType(b[3]), http2.Flags(b[4])
+	stream := binary.BigEndian.Uint32(b[5:]) & (1<<31 - 1)
+	switch typ {
+	case http2.FrameHeaders, http2.FramePushPromise, http2.FrameContinuation:
+	default:
+		if r.block != nil {
+			r.mode = redactDrop // a header block must go on with a CONTINUATION
+			return out, 0, false
+		}
+		r.pass = length
+		return append(out, b[:9]...), 9, false
+	}
+	if len(b) < 9+length {
+		if length > maxHeaderBlock {
+			r.mode = redactDrop
+			return out, 0, false
+		}
+		return out, 0, true
+	}
+
+	payload := b[9 : 9+length]
+	if typ == http2.FrameContinuation {
+		if r.block == nil || stream != r.stream {
+			r.mode = redactDrop
+			return out, 0, false
+		}
+	} else {
+		if r.block != nil {
+			r.mode = redactDrop
+			return out, 0, false
+		}
+		pad := 0
+		if flags.Has(http2.FlagHeadersPadded) {
+			if len(payload) == 0 {
+				r.mode = redactDrop
+				return out, 0, false
+			}
+			pad, payload = int(payload[0]), payload[1:]
+		}
+		prefix := 0
+		switch {
+		case typ == http2.FramePushPromise:
+			prefix = 4
+		case flags.Has(http2.FlagHeadersPriority):
+			prefix = 5
+		}
+		if len(payload) < prefix+pad {
+			r.mode = redactDrop
+			return out, 0, false
+		}
+		r.head, r.stream = typ, stream
+		r.flags = flags & (http2.FlagHeadersEndStream | http2.FlagHeadersPriority)
+		if typ == http2.FramePushPromise {
+			r.flags = 0
+		}
+		r.prefix = append(r.prefix[:0], payload[:prefix]...)
+		r.block = []byte{}
+		payload = payload[prefix : len(payload)-pad]
+	}
+
+	r.block = append(r.block, payload...)
+	if len(r.block) > maxHeaderBlock {
+		r.mode = redactDrop
+		return out, 0, false
+	}
+	if !flags.Has(http2.FlagHeadersEndHeaders) {
+		return out, 9 + length, false
+	}
+
+	fields, err := r.dec.DecodeFull(r.block)
+	r.block = nil
+	if err != nil {
+		r.mode = redactDrop
+		return out, 0, false
+	}
+	r.encBuf.Reset()
+	for _, f := range fields {
+		if r.redacts([]byte(f.Name)) {
+			f.Value = redactedHeaderValue
+		}
+		r.enc.WriteField(f)
+	}
+	return r.appendHeaderFrames(out, r.encBuf.Bytes()), 9 + length, false
+}
+
+// start sets up the HPACK state of an HTTP/2 direction.
+func (r *pcapRedactor) start() {
+	r.dec = hpack.NewDecoder(4096, func(hpack.HeaderField) {})
+	r.dec.SetAllowedMaxDynamicTableSize(math.MaxUint32) // whatever the peers agreed on
+	r.enc = hpack.NewEncoder(&r.encBuf)
+	r.enc.SetMaxDynamicTableSizeLimit(0)
+}
+
+// appendHeaderFrames appends the header block as the first frame of the block
+// followed by as many CONTINUATION frames as needed.
+func (r *pcapRedactor) appendHeaderFrames(out, block []byte) []byte {
+	typ, flags, prefix := r.head, r.flags, r.prefix
+	for {
+		n := min(len(block), 16384-len(prefix)) // the default SETTINGS_MAX_FRAME_SIZE
+		if n == len(block) {
+			flags |= http2.FlagHeadersEndHeaders
+		}
+		length := len(prefix) + n
+		out = append(out, byte(length>>16), byte(length>>8), byte(length), byte(typ), byte(flags))
+		out = binary.BigEndian.AppendUint32(out, r.stream)
+		out = append(out, prefix...)
+		out = append(out, block[:n]...)
+		block = block[n:]
+		if len(block) == 0 {
+			return out
+		}
+		typ, flags, prefix = http2.FrameContinuation, 0, nil
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+)
+
+// Services like the Docker daemon or PostgreSQL with peer authentication
+// authenticate local clients by the credentials the kernel records for the
+// process that called connect(2) (SO_PEERCRED, SO_PEERSEC). Proxying puts
+// subtrace on both ends of that: the traced server's accepted socket is
+// connected by subtrace, and so is the external connection of a traced
+// client.
+//
+// For AF_UNIX sockets, a traced server asking for its peer's credentials gets
+// those of the external connection's peer, which is the real client unless
+// that client is traced too. Traced clients connect to the paths in
+// peerAuthPaths directly instead of through the proxy, so that the server,
+// traced or not, reads their own credentials. A path is added once a traced
+// server reads subtrace's credentials on a connection to it. TCP has no peer
+// credentials to pass on, so servers that bind to PeerAuthListeners aren't
+// traced at all.
+
+// peerAuthPaths has the AF_UNIX paths whose listeners authenticate their
+// peers (see AddPeerAuthPath).
+var peerAuthPaths sync.Map // string -> struct{}
+
+// PeerAuthListeners matches the TCP addresses that traced servers bind to
+// without subtrace (-peer-auth and the config's peerAuth list).
+var PeerAuthListeners []config.BypassRule
+
+// peerCredWarned has the listeners that were warned about (see warnPeerCred).
+var peerCredWarned sync.Map // string -> struct{}
+
+// AddPeerAuthPath records that the listener on path authenticates its peers
+// (-peer-auth and the config's peerAuth list).
+func AddPeerAuthPath(path string) {
+	peerAuthPaths.Store(path, struct{}{})
+}
+
+// PeerAuthPath reports whether traced clients connect to the AF_UNIX socket
+// at path without the proxy.
+func PeerAuthPath(path string) bool {
+	_, ok := peerAuthPaths.Load(path)
+	return ok
+}
+
+// PeerAuthListener reports whether a traced server that binds to addr isn't
+// traced.
+func PeerAuthListener(addr netip.AddrPort) bool {
+	for _, r := range PeerAuthListeners {
+		if r.Matches(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerCred returns the credentials of the external connection's peer for
+// getsockopt(SO_PEERCRED) on a connected AF_UNIX socket. ok is false if the
+// kernel's answer for the socket itself is the right one.
+func (s *Socket) PeerCred() (cred *unix.Ucred, errno syscall.Errno, ok bool) {
+	p, ok := s.peerCredProxy("SO_PEERCRED")
+	if !ok {
+		return nil, 0, false
+	}
+	err := controlConn(p.external, func(fd int) error {
+		var err error
+		cred, err = unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+		return err
+	})
+	if err != nil {
+		errno, err := asErrno(err, "get SO_PEERCRED")
+		if err != nil {
+			slog.Debug("failed to get peer credentials of external connection", "sock", s, "err", err)
+			return nil, 0, false
+		}
+		return nil, errno, true
+	}
+	if int(cred.Pid) == os.Getpid() && !p.isOutgoing {
+		s.learnPeerAuth(p)
+	}
+	return cred, 0, true
+}
+
+// PeerSec is PeerCred for getsockopt(SO_PEERSEC), the peer's security label.
+func (s *Socket) PeerSec() (label string, errno syscall.Errno, ok bool) {
+	p, ok := s.peerCredProxy("SO_PEERSEC")
+	if !ok {
+		return "", 0, false
+	}
+	err := controlConn(p.external, func(fd int) error {
+		var err error
+		label, err = unix.GetsockoptString(fd, unix.SOL_SOCKET, unix.SO_PEERSEC)
+		return err
+	})
+	if err != nil {
+		errno, err := asErrno(err, "get SO_PEERSEC")
+		if err != nil {
+			slog.Debug("failed to get peer security label of external connection", "sock", s, "err", err)
+			return "", 0, false
+		}
+		return "", errno, true
+	}
+	return label, 0, true
+}
+
+// peerCredProxy returns the proxy of a connected AF_UNIX socket, whose
+// external connection has the peer's credentials. For an accepted TCP socket,
+// which has none to pass on, it warns that the server's peer authentication
+// is unreliable.
+func (s *Socket) peerCredProxy(opt string) (*proxy, bool) {
+	cur := s.Inode.state.Load()
+	if cur.state != StateConnected {
+		return nil, false
+	}
+	p := cur.connected.proxy
+	if s.Inode.Domain != unix.AF_UNIX {
+		if !p.isOutgoing {
+			warnPeerCred(p.external.LocalAddr(), opt)
+		}
+		return nil, false
+	}
+	return p, true
+}
+
+// learnPeerAuth makes traced clients connect directly to the listener of an
+// accepted AF_UNIX socket whose peer turned out to be subtrace.
+func (s *Socket) learnPeerAuth(p *proxy) {
+	path := unixAddrName(p.external.LocalAddr())
+	if path == "" {
+		return
+	}
+	if _, loaded := peerAuthPaths.LoadOrStore(path, struct{}{}); !loaded {
+		slog.Warn(fmt.Sprintf("a traced server on %s read the peer credentials of a traced client, which were subtrace's: its next clients connect to it directly, add -peer-auth=%s to do so from the start", path, path), "sock", s)
+	}
+}
+
+// warnPeerCred warns once per listener that a traced server read the peer
+// credentials of an accepted TCP connection.
+func warnPeerCred(addr net.Addr, opt string) {
+	if _, warned := peerCredWarned.LoadOrStore(addr.String(), struct{}{}); warned {
+		return
+	}
+	slog.Warn(fmt.Sprintf("a traced server on %s read %s of a connection subtrace proxied: peer credential authentication is unreliable under interception, add -peer-auth=%s to not trace the listener", addr, opt, addr), "listener", addr.String())
+}
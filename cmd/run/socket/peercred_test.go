@@ -0,0 +1,61 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestPeerCred checks that a traced server reads the credentials of the
+// client at the other end of the external connection, and that it learns to
+// connect traced clients directly when that client turns out to be subtrace,
+// as it is here.
+func TestPeerCred(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peerauth.sock")
+	lis := createUnixSocket(t)
+	if errno, err := lis.BindUnix(path, path); err != nil || errno != 0 {
+		t.Fatalf("bind: errno=%v, err=%v", errno, err)
+	}
+	if errno, err := lis.Listen(8); err != nil || errno != 0 {
+		t.Fatalf("listen: errno=%v, err=%v", errno, err)
+	}
+	if err := unix.Listen(lis.FD.FD(), 8); err != nil {
+		t.Fatalf("listen(2): %v", err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	srv, errno, err := lis.Accept(0)
+	if err != nil || errno != 0 {
+		t.Fatalf("accept: errno=%v, err=%v", errno, err)
+	}
+	defer srv.Close()
+
+	if PeerAuthPath(path) {
+		t.Fatalf("got %s as a peer auth path before its peer credentials were read", path)
+	}
+	cred, errno, ok := srv.PeerCred()
+	if !ok || errno != 0 {
+		t.Fatalf("got no peer credentials (errno=%v)", errno)
+	}
+	if int(cred.Pid) != os.Getpid() || int(cred.Uid) != os.Getuid() || int(cred.Gid) != os.Getgid() {
+		t.Errorf("got peer credentials %+v, want pid %d uid %d gid %d", cred, os.Getpid(), os.Getuid(), os.Getgid())
+	}
+	if !PeerAuthPath(path) {
+		t.Errorf("didn't learn %s as a peer auth path", path)
+	}
+
+	// The listener has no peer.
+	if _, _, ok := lis.PeerCred(); ok {
+		t.Errorf("got peer credentials of a listener")
+	}
+}
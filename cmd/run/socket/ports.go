@@ -0,0 +1,112 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/stats"
+	"subtrace.dev/tracer"
+)
+
+// Every intercepted connection costs subtrace extra local ports: the dummy
+// listener and the loopback connection to it on the connecting side, and the
+// ephemeral listener and dispatcher connection on the accepting side. A
+// workload that churns through short-lived connections can exhaust
+// net.ipv4.ip_local_port_range under subtrace when it wouldn't without it.
+// The kernel reports that as EADDRNOTAVAIL (or EADDRINUSE from bind(2)),
+// which on its own reads like a networking bug in the application.
+
+var (
+	// portRetryBudget is how long an internal loopback dial or bind is retried
+	// after running out of ports before the failure is reported. Ports in
+	// TIME_WAIT free up continuously, so a short wait usually gets one.
+	portRetryBudget = time.Second
+
+	// portReportInterval is the minimum time between two exhaustion reports.
+	portReportInterval = 10 * time.Second
+)
+
+// isPortExhaustion reports whether err means that no local port was available.
+func isPortExhaustion(err error) bool {
+	return errors.Is(err, unix.EADDRNOTAVAIL) || errors.Is(err, unix.EADDRINUSE)
+}
+
+var portExhaustion struct {
+	mu       sync.Mutex
+	errors   int // since the last report
+	reported time.Time
+	total    int // for tests
+}
+
+// notePortExhaustion records a port exhaustion error from op. The first error
+// and then at most one per portReportInterval is logged and published as a
+// diagnostic event along with the number of errors since the last one.
+func notePortExhaustion(g *global.Global, op string, err error) {
+	portExhaustion.mu.Lock()
+	portExhaustion.errors++
+	portExhaustion.total++
+	now := time.Now()
+	if !portExhaustion.reported.IsZero() && now.Sub(portExhaustion.reported) < portReportInterval {
+		portExhaustion.mu.Unlock()
+		return
+	}
+	count := portExhaustion.errors
+	portExhaustion.errors = 0
+	portExhaustion.reported = now
+	portExhaustion.mu.Unlock()
+
+	portRange, inUse := "unknown", "unknown"
+	if lo, hi, ok := stats.EphemeralPortRange(); ok {
+		portRange = fmt.Sprintf("%d-%d", lo, hi)
+	}
+	if n, size, ok := stats.EphemeralPortsInUse(); ok {
+		inUse = fmt.Sprintf("%d/%d", n, size)
+	}
+
+	slog.Warn("ran out of ephemeral ports, connections may fail; consider widening net.ipv4.ip_local_port_range or enabling net.ipv4.tcp_tw_reuse",
+		"op", op, "err", err, "errors", count, "range", portRange, "inUse", inUse)
+
+	if g == nil || g.Config == nil {
+		return
+	}
+	ev := event.New()
+	ev.Set("ephemeral_port_pressure", "exhausted")
+	ev.Set("ephemeral_port_op", op)
+	ev.Set("ephemeral_port_errors", fmt.Sprintf("%d", count))
+	ev.Set("ephemeral_port_range", portRange)
+	ev.Set("ephemeral_ports_in_use", inUse)
+	go tracer.PublishConnection(g, ev, fmt.Sprintf("ephemeral ports exhausted (%s, range %s, in use %s): widen net.ipv4.ip_local_port_range", op, portRange, inUse))
+}
+
+// retryPortExhaustion calls fn until it succeeds, fails with an error other
+// than port exhaustion, or portRetryBudget runs out. It's only used for
+// subtrace's own loopback sockets; external dials surface the error to the
+// tracee like the kernel would.
+func retryPortExhaustion[T any](g *global.Global, op string, fn func() (T, error)) (T, error) {
+	begin := time.Now()
+	backoff := 5 * time.Millisecond
+	for {
+		ret, err := fn()
+		if err == nil || !isPortExhaustion(err) {
+			return ret, err
+		}
+		notePortExhaustion(g, op, err)
+
+		remaining := portRetryBudget - time.Since(begin)
+		if remaining <= 0 {
+			return ret, err
+		}
+		slog.Debug("retrying after running out of ephemeral ports", "op", op, "err", err, "backoff", backoff)
+		time.Sleep(min(backoff, remaining))
+		backoff = min(2*backoff, 100*time.Millisecond)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRetryPortExhaustion(t *testing.T) {
+	prevBudget, prevInterval := portRetryBudget, portReportInterval
+	portRetryBudget, portReportInterval = 200*time.Millisecond, time.Hour
+	t.Cleanup(func() { portRetryBudget, portReportInterval = prevBudget, prevInterval })
+
+	t.Run("recovers", func(t *testing.T) {
+		calls := 0
+		got, err := retryPortExhaustion(nil, "test", func() (int, error) {
+			calls++
+			if calls < 3 {
+				return 0, fmt.Errorf("connect: %w", unix.EADDRNOTAVAIL)
+			}
+			return 42, nil
+		})
+		if err != nil || got != 42 || calls != 3 {
+			t.Fatalf("got (%d, %v) after %d calls, want (42, nil) after 3", got, err, calls)
+		}
+	})
+
+	t.Run("other errors", func(t *testing.T) {
+		calls := 0
+		_, err := retryPortExhaustion(nil, "test", func() (int, error) {
+			calls++
+			return 0, unix.ECONNREFUSED
+		})
+		if err != unix.ECONNREFUSED || calls != 1 {
+			t.Fatalf("got %v after %d calls, want ECONNREFUSED after 1", err, calls)
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		portExhaustion.mu.Lock()
+		before := portExhaustion.total
+		portExhaustion.mu.Unlock()
+
+		begin := time.Now()
+		_, err := retryPortExhaustion(nil, "test", func() (int, error) {
+			return 0, unix.EADDRINUSE
+		})
+		if !isPortExhaustion(err) {
+			t.Fatalf("got %v, want EADDRINUSE", err)
+		}
+		if took := time.Since(begin); took < portRetryBudget || took > 10*portRetryBudget {
+			t.Errorf("gave up after %v, want about %v", took, portRetryBudget)
+		}
+
+		portExhaustion.mu.Lock()
+		defer portExhaustion.mu.Unlock()
+		if n := portExhaustion.total - before; n < 2 {
+			t.Errorf("recorded %d exhaustion errors, want at least 2", n)
+		}
+	})
+}
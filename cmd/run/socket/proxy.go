@@ -14,8 +14,10 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"runtime"
@@ -24,6 +26,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/martian/v3"
@@ -31,9 +34,12 @@ import (
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
 	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/capability"
+	"subtrace.dev/cmd/run/crash"
 	"subtrace.dev/cmd/run/tls"
 	"subtrace.dev/event"
 	"subtrace.dev/global"
+	"subtrace.dev/pcapng"
 	"subtrace.dev/tracer"
 )
 
@@ -45,11 +51,61 @@ type proxy struct {
 	socket     *Socket
 	isOutgoing bool
 
-	process  *net.TCPConn
-	external *net.TCPConn
+	process  streamConn
+	external streamConn
 
 	tlsServerName atomic.Pointer[string]
 
+	// processInfo and externalInfo identify the kernel sockets of the two
+	// connections. They're set once in start() before the proxy is tracked.
+	processInfo  ConnInfo
+	externalInfo ConnInfo
+
+	// connect is how long connecting to the server took, for outgoing
+	// connections. It's set once before the proxy starts and reported on the
+	// first exchange only (see takeConnect).
+	connect      time.Duration
+	connectTaken atomic.Bool
+
+	// path is the MSS and MTU of the external connection and processMSS is the
+	// MSS of the process's socket. They're set once before the proxy starts.
+	path       pathInfo
+	processMSS int
+
+	// wire counts the bytes exchanged on the external connection. For
+	// intercepted TLS connections, plain counts the decrypted bytes on the same
+	// side so that TLS overhead can be told apart from application payload.
+	wire  *bufConn
+	plain atomic.Pointer[bufConn]
+
+	// passthrough is set on the accepting side of a collapsed loopback
+	// connection, which is already captured on the connecting side. loopback is
+	// the local address of the external connection on the connecting side.
+	passthrough bool
+	loopback    netip.AddrPort
+
+	// unsampled is set before the protocol handlers start if sampling left the
+	// connection out. Its requests are still rewritten and checked against
+	// verdicts, but nothing of it is parsed or published.
+	unsampled bool
+
+	// connectionID is set as the connection_id tag on every event of the
+	// connection.
+	connectionID string
+	capture      captureState
+
+	// integrity is set if VerifyIntegrity is.
+	integrity atomic.Pointer[integrity]
+
+	// stall is set once the proxy copies between the bufConns it watches.
+	stall atomic.Pointer[stallWatch]
+
+	// writes records how the application writes on the connection.
+	writes *writePattern
+
+	// pcap is the connection's stream in Pcap, if it's written there.
+	pcap *pcapng.Stream
+
 	// skipCloseTCP denotes whether the underlying process and external TCPConn
 	// should be closed. Both (*Socket).Close() and (*proxy).start() race to
 	// change this from false to true with a CAS. Whoever loses the CAS will
@@ -57,6 +113,15 @@ type proxy struct {
 	skipCloseTCP atomic.Bool
 }
 
+// streamConn is one side of a proxy: a TCP connection, or a unix domain
+// stream connection for AF_UNIX sockets.
+type streamConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+	SyscallConn() (syscall.RawConn, error)
+}
+
 func newProxy(global *global.Global, tmpl *event.Event, isOutgoing bool) *proxy {
 	return &proxy{
 		global: global,
@@ -64,7 +129,17 @@ func newProxy(global *global.Global, tmpl *event.Event, isOutgoing bool) *proxy
 
 		begin:      time.Now(),
 		isOutgoing: isOutgoing,
+		writes:     new(writePattern),
+	}
+}
+
+// takeConnect returns how long connecting to the server took for the first
+// exchange on an outgoing connection. Later exchanges reuse the connection.
+func (p *proxy) takeConnect() (time.Duration, bool) {
+	if !p.isOutgoing || p.connect == 0 || p.connectTaken.Swap(true) {
+		return 0, false
 	}
+	return p.connect, true
 }
 
 func (p *proxy) Close() error {
@@ -135,18 +210,145 @@ func (p *proxy) LogValue() slog.Value {
 	)
 }
 
+// running tracks the proxies that have started but not finished yet so that
+// shutdown can wait for their events to be finalized before flushing sinks.
+var running struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	proxies  map[*proxy]struct{}
+}
+
+func (p *proxy) track() bool {
+	running.mu.Lock()
+	defer running.mu.Unlock()
+	if running.draining {
+		return false
+	}
+	if running.proxies == nil {
+		running.proxies = make(map[*proxy]struct{})
+	}
+	running.proxies[p] = struct{}{}
+	running.wg.Add(1)
+	return true
+}
+
+func (p *proxy) untrack() {
+	running.mu.Lock()
+	delete(running.proxies, p)
+	if !p.passthrough {
+		accountBandwidth(p.bandwidth())
+	}
+	running.mu.Unlock()
+	running.wg.Done()
+}
+
+// Running returns the number of proxies that have started but not finished.
+func Running() int {
+	running.mu.Lock()
+	defer running.mu.Unlock()
+	return len(running.proxies)
+}
+
+// Drain stops new proxies from starting and waits up to timeout for the
+// running ones to finish. Proxies still running after that, or when abort is
+// closed, are closed so that their parsers finish with whatever was captured
+// so far. It returns the number of proxies that had to be closed.
+func Drain(timeout time.Duration, abort <-chan struct{}) int {
+	running.mu.Lock()
+	running.draining = true
+	running.mu.Unlock()
+
+	if waitTimeout(&running.wg, timeout, abort) {
+		return 0
+	}
+
+	running.mu.Lock()
+	abandoned := make([]*proxy, 0, len(running.proxies))
+	for p := range running.proxies {
+		abandoned = append(abandoned, p)
+	}
+	running.mu.Unlock()
+
+	for _, p := range abandoned {
+		slog.Debug("closing proxy after shutdown grace period", "proxy", p)
+		if err := p.Close(); err != nil {
+			slog.Debug("failed to close proxy during shutdown", "proxy", p, "err", err) // not fatal
+		}
+	}
+
+	// Closing the connections unblocks the copy loops almost immediately, but
+	// don't wait forever if something is still stuck.
+	waitTimeout(&running.wg, time.Second, nil)
+	return len(abandoned)
+}
+
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration, abort <-chan struct{}) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	case <-abort:
+		return false
+	}
+}
+
 func (p *proxy) start() {
+	defer crash.Recover("proxy")
+
 	if p.process == nil || p.external == nil {
 		slog.Error("TCP proxy missing connection", "proxy", p)
 		return
 	}
 
+	if p.loopback.IsValid() {
+		// The listener normally forgets the address when it accepts the
+		// connection, but it may have been closed before that.
+		defer loopbackConnects.Delete(p.loopback)
+	}
+
+	p.collectConnInfo()
+	p.wire = newBufConn(p.external)
+	p.connectionID = uuid.NewString()
+	p.tmpl = p.tmpl.Copy()
+	p.tmpl.Set("connection_id", p.connectionID)
+	if !p.track() {
+		slog.Debug("not starting tcp proxy during shutdown", "proxy", p)
+		if err := p.Close(); err != nil {
+			slog.Debug("failed close tcp proxy", "proxy", p, "err", err) // not fatal
+		}
+		return
+	}
+	defer p.untrack()
+
 	// TODO: should we match the tracee's TCP options on the external side?
 
 	// There's no need for Nagle's algorithm on the process side since it's a
 	// loopback connection.
-	if err := p.process.SetNoDelay(true); err != nil {
-		slog.Debug("failed to set TCP_NODELAY on process side", "proxy", p, "err", err) // not fatal
+	if tcp, ok := p.process.(*net.TCPConn); ok {
+		if err := tcp.SetNoDelay(true); err != nil {
+			slog.Debug("failed to set TCP_NODELAY on process side", "proxy", p, "err", err) // not fatal
+		}
+	}
+
+	// TCP urgent data isn't forwarded as urgent data: the copy loops only see
+	// the normal stream, and without SO_OOBINLINE the kernel would silently drop
+	// the urgent byte from it. Keep it inline on both sides so that no byte is
+	// ever lost. As a result, recv(MSG_OOB) in the tracee always fails with
+	// EINVAL because its socket never has urgent data pending.
+	for _, conn := range []streamConn{p.process, p.external} {
+		if err := setOOBInline(conn); err != nil {
+			slog.Debug("failed to set SO_OOBINLINE", "proxy", p, "conn", conn.LocalAddr(), "err", err) // not fatal
+		}
 	}
 
 	slog.Debug("starting tcp proxy", "proxy", p)
@@ -156,14 +358,38 @@ func (p *proxy) start() {
 		}
 	}()
 
-	cli, srv := newBufConn(p.process), newBufConn(p.external)
+	proc := newBufConn(p.process)
+	proc.process = true
+	if !p.passthrough {
+		proc.pattern, p.wire.pattern = p.writes, p.writes
+	}
+	cli, srv := proc, p.wire
 	if !p.isOutgoing {
 		cli, srv = srv, cli
 	}
+	if !p.passthrough {
+		// Collapsed loopback connections are spliced in the kernel without
+		// going through the bufConns.
+		p.attachIntegrity("tcp", cli, srv)
+		p.watchStalls(proc, p.wire)
+	}
+	p.startPcap()
+	defer p.stopPcap()
 
-	if err := p.proxyOptimistic(cli, srv); err != nil {
+	if p.passthrough {
+		p.decide(tracer.Decision{Layer: "socket", Verdict: "captured_by_peer", Detail: "collapsed loopback connection"}, tracer.CaptureNone)
+		if err := p.proxyPassthrough(); err != nil {
+			slog.Error("failed to run tcp proxy", "proxy", p, "err", err)
+		}
+	} else if !p.sample() && !p.rewrites() {
+		if err := p.proxyFallback(cli, srv); err != nil {
+			slog.Error("failed to run tcp proxy", "proxy", p, "err", err)
+		}
+	} else if err := p.proxyOptimistic(cli, srv); err != nil {
 		slog.Error("failed to run tcp proxy", "proxy", p, "err", err)
 	}
+	p.checkIntegrity()
+	p.publishUncaptured()
 
 	if p.skipCloseTCP.CompareAndSwap(false, true) {
 		// The target program has still not called the close(2) syscall on its file
@@ -176,9 +402,61 @@ func (p *proxy) start() {
 	}
 }
 
+func setOOBInline(conn streamConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("syscall conn: %w", err)
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_OOBINLINE, 1)
+	}); err != nil {
+		return fmt.Errorf("control: %w", err)
+	}
+	return serr
+}
+
 var isHTTP2Enabled = false
 var isWebsocketEnabled = false
-var websocketTimeLimit time.Duration = 110 * time.Second
+
+func init() {
+	capability.RegisterFeature("http2", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: isHTTP2Enabled}
+	})
+	capability.RegisterFeature("websocket", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: isWebsocketEnabled}
+	})
+	capability.RegisterFeature("loopback_collapse", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: CollapseLoopback}
+	})
+	capability.RegisterFeature("qos_mirroring", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: MirrorQoS, Intervenes: true}
+	})
+	capability.RegisterFeature("external_qos", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: !ExternalQoS.IsDefault(), Intervenes: true}
+	})
+	capability.RegisterFeature("connection_sampling", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: SampleRate < 1}
+	})
+	capability.RegisterFeature("dial_retry", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: DialRetryBudget > 0, Intervenes: true}
+	})
+	capability.RegisterLimit("dial_retry_budget_ms", func() int64 {
+		return DialRetryBudget.Milliseconds()
+	})
+	capability.RegisterLimit("listen_stall_timeout_ms", func() int64 {
+		return ListenStallTimeout.Milliseconds()
+	})
+	capability.RegisterLimit("proxy_stall_timeout_ms", func() int64 {
+		return ProxyStallTimeout.Milliseconds()
+	})
+	capability.RegisterLimit("dispatch_dial_timeout_ms", func() int64 {
+		return DispatchDialTimeout.Milliseconds()
+	})
+	capability.RegisterLimit("max_dispatch_workers", func() int64 {
+		return maxDispatchWorkers
+	})
+}
 
 func Init() error {
 	for _, name := range []string{"SUBTRACE_HTTP2", "SUBTRACE_GRPC"} {
@@ -191,14 +469,6 @@ func Init() error {
 	switch strings.ToLower(os.Getenv("SUBTRACE_WEBSOCKET")) {
 	case "1", "t", "true", "y", "yes":
 		isWebsocketEnabled = true
-		val := os.Getenv("SUBTRACE_WEBSOCKET_TIME_LIMIT")
-		if val != "" {
-			t, err := strconv.Atoi(val)
-			if err != nil {
-				return fmt.Errorf("parse SUBTRACE_WEBSOCKET_TIME_LIMIT: %w", err)
-			}
-			websocketTimeLimit = time.Duration(t) * time.Second
-		}
 	}
 	return nil
 }
@@ -272,7 +542,7 @@ func (p *proxy) proxyOptimistic(cli, srv *bufConn) error {
 		// Read and Peek are goroutine-safe. When the second goroutine's peek
 		// returns, it will observe that it has lost the race, thereby releasing
 		// the client bufConn lock and exiting.
-		errs <- p.proxyFallback(cli, srv)
+		errs <- p.proxyUncaptured(cli, srv, "protocol", tracer.ReasonServerFirst, "")
 	}()
 
 	go func() {
@@ -297,19 +567,35 @@ func (p *proxy) proxyOptimistic(cli, srv *bufConn) error {
 
 		protocol := guessProtocol(sample)
 		slog.Debug("guessed protocol", "proxy", p, "protocol", protocol)
+		if p.unsampled && protocol != "http/1" && (protocol != "tls" || !tls.Enabled) {
+			// Only HTTP/1 requests are rewritten or checked against verdicts,
+			// so there's nothing else to do for the rest.
+			errs <- p.proxyFallback(cli, srv)
+			return
+		}
 		switch protocol {
 		case "tls":
+			p.decide(tracer.Decision{Layer: "protocol", Verdict: protocol}, tracer.CaptureFull)
 			if tls.Enabled {
 				errs <- p.proxyTLS(cli, srv)
+			} else if tls.DryRun {
+				errs <- p.proxyTLSDryRun(cli, srv)
 			} else {
-				errs <- p.proxyFallback(cli, srv)
+				errs <- p.proxyUncaptured(cli, srv, "tls", tracer.ReasonTLSDisabled, "")
 			}
 		case "http/1":
+			p.decide(tracer.Decision{Layer: "protocol", Verdict: protocol}, tracer.CaptureFull)
 			errs <- p.proxyHTTP1(cli, srv)
 		case "http/2":
+			p.decide(tracer.Decision{Layer: "protocol", Verdict: protocol}, tracer.CaptureFull)
 			errs <- p.proxyHTTP2(cli, srv)
 		default:
-			errs <- p.proxyFallback(cli, srv)
+			if TraceDNS && p.isOutgoing && p.isDNSServer() && isDNSOverTCP(sample) {
+				p.decide(tracer.Decision{Layer: "protocol", Verdict: "dns"}, tracer.CaptureMetadata)
+				errs <- p.proxyDNS(cli, srv)
+				return
+			}
+			errs <- p.proxyUncaptured(cli, srv, "protocol", tracer.ReasonUnknownProtocol, protocol)
 		}
 	}()
 
@@ -323,14 +609,18 @@ func (p *proxy) proxyTLS(cli, srv *bufConn) error {
 		// We can't intercept incoming TLS requests (yet). Doing so would require
 		// some kind of cooperation from the tracee because the location of the CA
 		// certificate and private key are application-specific.
-		return p.proxyFallback(cli, srv)
+		return p.proxyUncaptured(cli, srv, "tls", tracer.ReasonTLSIncoming, "")
 	}
 
 	if p.tlsServerName.Load() != nil {
 		// TLS server name already exists? Could this be TLS within TLS? Bail out.
-		return p.proxyFallback(cli, srv)
+		return p.proxyUncaptured(cli, srv, "tls", tracer.ReasonTLSNested, "")
 	}
 
+	// The handshakes with the two sides exchange different bytes. If they
+	// succeed, the decrypted bytes are verified instead.
+	p.skipIntegrity("tls interception")
+	p.mirrorPcap(nil, 0, 0) // the plaintext is mirrored instead
 	tcli, tsrv, serverName, err := tls.Handshake(slog.GroupValue(slog.Any("proxy", p)), cli, srv)
 	if err != nil {
 		// If the ephemeral MITM certificate we generated is not recognized, most
@@ -338,11 +628,52 @@ func (p *proxy) proxyTLS(cli, srv *bufConn) error {
 		// means: (a) the application is using an unknown CA root store location,
 		// (b) it's using certificate pinning, (c) it's an mTLS connection, or (d)
 		// something else.
+		p.decide(tracer.Decision{Layer: "tls", Verdict: "handshake_failed", Reason: tracer.ReasonTLSHandshake, Detail: err.Error()}, tracer.CaptureNone)
 		return fmt.Errorf("proxy tls handshake: %w", err)
 	}
 
+	p.decide(tracer.Decision{Layer: "tls", Verdict: "intercepted", Detail: serverName}, tracer.CaptureFull)
 	p.tlsServerName.Store(&serverName)
-	if err := p.proxyOptimistic(newBufConn(tcli), newBufConn(tsrv)); err != nil {
+	observeHostname(p.external, serverName)
+	if serverName != "" {
+		p.tmpl = p.tmpl.Copy()
+		p.tmpl.Set("tls_server_name", event.Intern(serverName))
+	}
+
+	key := serverName
+	if key == "" {
+		key = p.external.RemoteAddr().String()
+	}
+	report := tls.ObserveCertificate(key, tsrv.ConnectionState().PeerCertificates, time.Now())
+	if tags := report.Tags(); len(tags) > 0 {
+		slog.Debug("notable upstream TLS certificate", "proxy", p, "serverName", key, "tags", tags)
+
+		// Every event on this connection carries the diagnostic.
+		p.tmpl = p.tmpl.Copy()
+		for k, v := range tags {
+			p.tmpl.Set(k, v)
+		}
+	}
+	plainCli, plain := newBufConn(tcli), newBufConn(tsrv)
+	p.plain.Store(plain)
+	p.attachIntegrity("tls", plainCli, plain)
+	if p.pcapAllowed(serverName) {
+		p.mirrorPcap(plain, pcapng.ClientToServer, pcapng.ServerToClient)
+	}
+
+	// If ALPN settled on HTTP/2, don't guess from a sample: the server sends its
+	// SETTINGS frame right after the handshake and can win the race against the
+	// client's preface.
+	if tsrv.ConnectionState().NegotiatedProtocol == "h2" {
+		if p.unsampled {
+			return p.proxyFallback(plainCli, plain)
+		}
+		if err := p.proxyHTTP2(plainCli, plain); err != nil {
+			return fmt.Errorf("proxy tls: %w", err)
+		}
+		return nil
+	}
+	if err := p.proxyOptimistic(plainCli, plain); err != nil {
 		return fmt.Errorf("proxy tls: %w", err)
 	}
 
@@ -370,6 +701,7 @@ func (p *proxy) proxyHTTP1(cli, srv *bufConn) error {
 	slog.Debug("starting proxyHTTP1", "proxy", p)
 
 	if !p.isOutgoing && p.global.Devtools != nil && p.global.Devtools.HijackPath != "" {
+		p.skipIntegrity("devtools hijack")
 		lis := newSimpleListener(cli)
 		defer lis.Close()
 
@@ -389,78 +721,176 @@ func (p *proxy) proxyHTTP1(cli, srv *bufConn) error {
 
 	errs := make(chan error, 3)
 
-	cr, cw := io.Pipe()
-	sr, sw := io.Pipe()
+	cp, sp := newTapPipe(), newTapPipe()
+	budget := p.newParseBudget("http/1")
+	ctap, stap := &shedTap{budget: budget, w: cp}, &shedTap{budget: budget, w: sp}
+
+	var src io.Reader = cli
+	var rewrites chan *rewriteResult
+	var sig *blockSignal
+	if p.rewrites() {
+		p.skipIntegrity("rewrites")
+		rewrites = make(chan *rewriteResult, 64)
+		sig = newBlockSignal()
+		rr := p.newRewriter(cli, rewrites, sig)
+		defer rr.Close()
+		src = rr
+	}
+
+	// The parser reads what the copies below tee into the taps. A connection
+	// left out by sampling is only proxied for its rewrites and verdicts, so
+	// nothing is teed.
+	cin, sin := io.TeeReader(src, ctap), io.TeeReader(srv, stap)
+	if p.unsampled {
+		cin, sin = src, srv
+	}
 
 	go func() {
-		bcr, bsr := bufio.NewReader(cr), bufio.NewReader(sr)
-		defer p.discardMulti(bcr, bsr)
+		if p.unsampled {
+			errs <- nil
+			return
+		}
+
+		cf, sf := newHeaderFilter(cp), newHeaderFilter(sp)
+		bcr, bsr := bufio.NewReader(cf), bufio.NewReader(sf)
+		defer func() {
+			if budget.shed.Load() {
+				// The bodies may still be read, so the pipes are closed rather
+				// than drained.
+				cp.CloseRead(errParserShed)
+				sp.CloseRead(errParserShed)
+				return
+			}
+			p.discardMulti(bcr, bsr)
+		}()
 
 		for {
+			cf.arm()
 			req, err := http.ReadRequest(bcr)
 			switch {
 			case err == nil:
-			case errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed):
+			case errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || budget.shed.Load():
 				errs <- nil
 				return
 			default:
 				errs <- fmt.Errorf("tracer: read request: %w", err)
 				return
 			}
+			if !budget.charge(shedMessages, stepsPerMessage+len(req.Header)*stepsPerField, 0) {
+				errs <- nil
+				return
+			}
+
+			if p.isOutgoing {
+				observeHostname(p.external, req.Host)
+			}
 
 			eventID := uuid.New()
 			slog.Debug("proxy: http/1: new event", "proxy", p, "eventID", eventID)
 
 			event := p.tmpl.Copy()
 			event.Set("event_id", eventID.String())
+			p.setDestinationTags(event, req.Host)
+			p.setProxiedTags(event, req)
+			if p.socket != nil {
+				if n := p.socket.Inode.UrgentSends(); n > 0 {
+					event.Set("tcp_urgent_sends_inline", fmt.Sprintf("%d", n))
+				}
+			}
+			if p.writes != nil {
+				if w := p.writes.load(); w.Chatty {
+					event.Set("tcp_small_writes", fmt.Sprintf("%d/%d", w.App.Under100, w.App.Total()))
+				}
+			}
+
+			if rewrites != nil {
+				select {
+				case result := <-rewrites:
+					result.setTags(event)
+				default:
+				}
+			}
 
 			parser := tracer.NewParser(p.global, event)
+			parser.SetOutgoing(p.isOutgoing)
+			if d, ok := p.takeConnect(); ok {
+				parser.SetConnect(d)
+				if d, ok := p.claimDNS(); ok {
+					parser.SetDNS(d)
+				}
+			}
+			parser.TrimmedHeaders(true, false, cf.trimmed())
 			parser.UseRequest(req)
 			go func() {
 				defer req.Body.Close()
 				io.Copy(io.Discard, req.Body)
 			}()
 
+			sf.arm()
 			resp, err := http.ReadResponse(bsr, req)
 			switch {
 			case err == nil:
-			case errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed):
+			case errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || budget.shed.Load():
 				errs <- nil
 				return
 			default:
 				errs <- fmt.Errorf("tracer: read response: %w", err)
 				return
 			}
+			budget.charge(shedMessages, stepsPerMessage+len(resp.Header)*stepsPerField, 0)
+			tunnel := req.Method == http.MethodConnect && resp.StatusCode/100 == 2
+			if tunnel {
+				// What follows isn't the response's body but the tunnel to
+				// the destination the proxy was asked for.
+				resp.Body = http.NoBody
+			}
 
+			parser.TrimmedHeaders(false, false, sf.trimmed())
 			parser.UseResponse(resp)
+			p.setAccountedTags(event)
 			go func() {
 				defer resp.Body.Close()
 				io.Copy(io.Discard, resp.Body)
 			}()
 
+			if tunnel {
+				if err := parser.Finish(); err != nil {
+					slog.Error("failed to finish HAR parser for CONNECT", "eventID", event.Get("event_id"), "err", err)
+				}
+				slog.Debug("proxy: dropping into fallback copy after CONNECT", "proxy", p, "eventID", event.Get("event_id"), "dest", req.Host)
+				if err := p.discardMulti(bcr, bsr); err != nil {
+					errs <- fmt.Errorf("discard after CONNECT: %w", err)
+					return
+				}
+				errs <- nil
+				return
+			}
+
 			if resp.StatusCode == http.StatusSwitchingProtocols {
 				upgrade := req.Header.Get("upgrade")
 				if isWebsocketEnabled && strings.ToLower(upgrade) == "websocket" {
+					// The handshake is published right away and every message
+					// after it gets an event of its own as soon as it's read,
+					// however long the websocket stays open.
+					tmpl, handshakeID := event.Copy(), event.Get("event_id")
+					if err := parser.Finish(); err != nil {
+						slog.Error("failed to finish HAR parser for websocket", "eventID", event.Get("event_id"), "err", err)
+					}
+
 					w, err := newWebsocket(bcr, bsr, resp, p.isOutgoing)
 					if err != nil {
 						errs <- fmt.Errorf("tracer: create websocket: %w", err)
 						return
 					}
-
-					msgs, err := w.proxy()
-					switch {
-					case err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
-						parser.UseWebsocketMessages(msgs)
-					case errors.Is(err, errWebsocketPayloadLimitExceeded), errors.Is(err, errWebsocketTimeLimitExceeded):
-						slog.Debug("tracer: proxy websocket", "err", err)
-						parser.UseWebsocketMessages(msgs)
-					default:
-						errs <- fmt.Errorf("tracer: proxy websocket: %w", err)
-						return
+					w.onMessage = func(msg *tracer.WebsocketMessage) {
+						p.publishWebsocketMessage(tmpl, handshakeID, req, resp, msg)
 					}
 
-					if err := parser.Finish(); err != nil {
-						slog.Error("failed to finish HAR parser for websocket", "eventID", event.Get("event_id"), "err", err)
+					if err := w.proxy(); err != nil && !budget.shed.Load() {
+						// The messages before the one that couldn't be parsed
+						// are already published and the rest is still
+						// forwarded, so it's not worth failing the connection.
+						slog.Debug("tracer: proxy websocket", "proxy", p, "eventID", handshakeID, "err", err)
 					}
 					errs <- nil
 					return
@@ -488,8 +918,19 @@ func (p *proxy) proxyHTTP1(cli, srv *bufConn) error {
 	go func() {
 		defer srv.CloseWrite()
 		defer cli.CloseRead()
-		defer cw.Close()
-		if err := p.copyRawSingle("client->server", "http/1", srv, io.TeeReader(cli, cw)); err != nil {
+		defer cp.CloseWrite(nil)
+		err := p.copyRawSingle("client->server", "http/1", srv, cin)
+		var b *blockedError
+		if errors.As(err, &b) {
+			// Nothing after the blocked request is forwarded. Once the server
+			// has answered the requests before it and seen the end of the
+			// stream, the process gets the blocked response.
+			slog.Debug("proxy: http/1: request blocked", "proxy", p, "method", b.req.Method, "path", b.req.URL.Path, "source", b.result.source)
+			srv.SetReadDeadline(time.Now().Add(blockDrainTimeout))
+			go p.publishBlocked(b)
+			err = nil
+		}
+		if err != nil {
 			errs <- fmt.Errorf("copy raw: client->server: %w", err)
 			return
 		}
@@ -499,15 +940,32 @@ func (p *proxy) proxyHTTP1(cli, srv *bufConn) error {
 	go func() {
 		defer cli.CloseWrite()
 		defer srv.CloseRead()
-		defer sw.Close()
-		if err := p.copyRawSingle("server->client", "http/1", cli, io.TeeReader(srv, sw)); err != nil {
+		defer sp.CloseWrite(nil)
+		err := p.copyRawSingle("server->client", "http/1", cli, sin)
+		var b *blockedError
+		if sig != nil {
+			b = sig.wait()
+		}
+		if b != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = nil // the server kept the connection open
+			}
+			if err == nil {
+				_, err = cli.Write(b.response())
+			}
+		}
+		if err != nil {
 			errs <- fmt.Errorf("copy raw: server->client: %w", err)
 			return
 		}
 		errs <- nil
 	}()
 
-	if err := errors.Join(<-errs, <-errs, <-errs); err != nil {
+	err := errors.Join(<-errs, <-errs, <-errs)
+	if budget.shed.Load() {
+		p.decide(shedDecision("http/1"), tracer.CaptureNone)
+	}
+	if err != nil {
 		return fmt.Errorf("proxy http: %w", err)
 	}
 	return nil
@@ -522,9 +980,6 @@ const (
 	wsOpcodePong         = 0xA
 )
 
-var errWebsocketPayloadLimitExceeded = errors.New("websocket payload limit exceeded")
-var errWebsocketTimeLimitExceeded = errors.New("websocket time limit exceeded")
-
 type websocketFrame struct {
 	rsv1 bool
 	rsv2 bool
@@ -532,15 +987,23 @@ type websocketFrame struct {
 	fin  bool
 	op   byte
 
+	// size is the length of the frame's payload, of which only the first
+	// len(payload) bytes are kept.
+	size    uint64
 	payload []byte
 }
 
+// websocket parses the frames of a connection upgraded to a websocket, in
+// both directions, for as long as the connection lasts.
 type websocket struct {
 	cli        io.Reader
 	srv        io.Reader
 	isOutgoing bool
 
-	n atomic.Uint64
+	// onMessage is called with every message, control messages included, once
+	// its last frame is read. It's called by the goroutine that reads the
+	// message's direction.
+	onMessage func(*tracer.WebsocketMessage)
 
 	clientNoContextTakeover bool
 	serverNoContextTakeover bool
@@ -552,8 +1015,11 @@ type websocket struct {
 	clientInflater      io.ReadCloser
 	serverInflater      io.ReadCloser
 
-	mu   sync.RWMutex
-	msgs []*tracer.WebsocketMessage
+	// clientInflateLost and serverInflateLost are set once a message that
+	// later ones may refer back to couldn't be decompressed, after which none
+	// of the direction's compressed messages can be.
+	clientInflateLost bool
+	serverInflateLost bool
 }
 
 func newWebsocket(cli, srv io.Reader, resp *http.Response, isOutgoing bool) (*websocket, error) {
@@ -562,7 +1028,6 @@ func newWebsocket(cli, srv io.Reader, resp *http.Response, isOutgoing bool) (*we
 		srv:        srv,
 		isOutgoing: isOutgoing,
 	}
-	w.n.Store(uint64(tracer.PayloadLimitBytes))
 
 	h := resp.Header.Get("sec-websocket-extensions")
 	exts := strings.SplitSeq(h, ",")
@@ -629,71 +1094,65 @@ func newWebsocket(cli, srv io.Reader, resp *http.Response, isOutgoing bool) (*we
 	return w, nil
 }
 
-func (w *websocket) addMessage(op byte, payload []byte, isClient bool, t time.Time) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	data := ""
-	if op == wsOpcodeText {
-		data = string(payload)
-	} else {
-		data = base64.StdEncoding.EncodeToString(payload)
-	}
-
+// newMessage starts a message of the direction.
+func (w *websocket) newMessage(op byte, isClient bool, t time.Time) *tracer.WebsocketMessage {
 	var dir string
 	if (isClient && w.isOutgoing) || (!isClient && !w.isOutgoing) {
 		dir = "send"
 	} else {
 		dir = "receive"
 	}
-
-	w.msgs = append(w.msgs, &tracer.WebsocketMessage{
+	return &tracer.WebsocketMessage{
 		Type:   dir,
 		Time:   float64(t.UnixNano()) / 1e9,
 		Opcode: int(op),
-		Data:   data,
-	})
-}
-
-func (w *websocket) getMessages() []*tracer.WebsocketMessage {
-	w.mu.RLock()
-	defer w.mu.RUnlock()
-	return append([]*tracer.WebsocketMessage{}, w.msgs...)
+	}
 }
 
-// readFull reads len(p) bytes from the client or server reader, enforcing a shared
-// byte limit across both. Returns an error if the limit is exceeded. Safe for both
-// the client and server to call concurrently.
-func (w *websocket) readFull(isClient bool, p []byte) (int, error) {
-	l := uint64(len(p))
-
-	for {
-		remaining := w.n.Load()
-		if remaining < l {
-			return 0, fmt.Errorf("%w: limit=%d, have=%d, want=%d, msgsRead=%d", errWebsocketPayloadLimitExceeded, tracer.PayloadLimitBytes, remaining, l, len(w.getMessages()))
+// emit finishes msg with the part of its payload that was kept and hands it to
+// onMessage.
+func (w *websocket) emit(msg *tracer.WebsocketMessage, payload []byte, compressed bool, isClient bool) {
+	msg.Truncated = int64(len(payload)) < msg.Bytes
+	if compressed {
+		data, truncated, ok := w.decompress(payload, msg.Truncated, isClient)
+		if ok {
+			payload, msg.Truncated = data, truncated
+		} else {
+			// It's kept as it was sent rather than dropped.
+			msg.Compressed = true
 		}
+	}
 
-		if w.n.CompareAndSwap(remaining, remaining-l) {
-			var r io.Reader
-			if isClient {
-				r = w.cli
-			} else {
-				r = w.srv
-			}
+	if msg.Opcode == wsOpcodeClose && len(payload) >= 2 {
+		msg.CloseCode = int(binary.BigEndian.Uint16(payload))
+		msg.CloseReason = string(payload[2:])
+	}
+	if msg.Opcode == wsOpcodeText && !msg.Compressed {
+		msg.Data = string(payload)
+	} else {
+		msg.Data = base64.StdEncoding.EncodeToString(payload)
+	}
 
-			n, err := io.ReadFull(r, p)
-			if err != nil {
-				w.n.Add(l - uint64(n))
-				return n, err
-			}
-			return n, nil
-		}
+	if w.onMessage != nil {
+		w.onMessage(msg)
 	}
 }
 
-func (w *websocket) readFrame(isClient bool) (*websocketFrame, error) {
+func (w *websocket) reader(isClient bool) io.Reader {
+	if isClient {
+		return w.cli
+	}
+	return w.srv
+}
+
+// readFrame reads the next frame of the direction and keeps at most keep
+// bytes of its payload. The rest is skipped without being buffered, however
+// large the frame is.
+func (w *websocket) readFrame(isClient bool, keep int64) (*websocketFrame, error) {
+	r := w.reader(isClient)
+
 	header := make([]byte, 2)
-	if _, err := w.readFull(isClient, header); err != nil {
+	if _, err := io.ReadFull(r, header); err != nil {
 		return nil, fmt.Errorf("read header: %w", err)
 	}
 
@@ -724,36 +1183,37 @@ func (w *websocket) readFrame(isClient bool) (*websocketFrame, error) {
 	payloadLen := uint64(header[1] & 0x7F)
 	if payloadLen == 126 {
 		ext := make([]byte, 2)
-		if _, err := w.readFull(isClient, ext); err != nil {
+		if _, err := io.ReadFull(r, ext); err != nil {
 			return nil, fmt.Errorf("read extended length (len=126): %w", err)
 		}
 		payloadLen = uint64(binary.BigEndian.Uint16(ext))
 	} else if payloadLen == 127 {
 		ext := make([]byte, 8)
-		if _, err := w.readFull(isClient, ext); err != nil {
+		if _, err := io.ReadFull(r, ext); err != nil {
 			return nil, fmt.Errorf("read extended length (len=127): %w", err)
 		}
 		payloadLen = binary.BigEndian.Uint64(ext)
+		if payloadLen > math.MaxInt64 {
+			return nil, fmt.Errorf("invalid payload length: %d", payloadLen)
+		}
 	}
 
 	mask := make([]byte, 4)
 	if masked {
-		if _, err := w.readFull(isClient, mask); err != nil {
+		if _, err := io.ReadFull(r, mask); err != nil {
 			return nil, fmt.Errorf("read mask: %w", err)
 		}
 	}
 
-	// Check beforehand so we don't allocate arbitrarily large amounts of memory
-	// for the payload. All the other reads use fixed size buffers, so they're fine.
-	remaining := w.n.Load()
-	if remaining < payloadLen {
-		return nil, fmt.Errorf("%w: limit=%d, have=%d, want=%d, msgsRead=%d", errWebsocketPayloadLimitExceeded, tracer.PayloadLimitBytes, remaining, payloadLen, len(w.getMessages()))
-	}
-
-	payload := make([]byte, payloadLen)
-	if _, err := w.readFull(isClient, payload); err != nil {
+	payload := make([]byte, min(payloadLen, uint64(max(keep, 0))))
+	if _, err := io.ReadFull(r, payload); err != nil {
 		return nil, fmt.Errorf("read payload: %w", err)
 	}
+	if skip := int64(payloadLen) - int64(len(payload)); skip > 0 {
+		if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+			return nil, fmt.Errorf("skip payload: %w", err)
+		}
+	}
 
 	if masked {
 		for i := range payload {
@@ -775,6 +1235,7 @@ func (w *websocket) readFrame(isClient bool) (*websocketFrame, error) {
 		rsv3:    rsv3,
 		fin:     fin,
 		op:      opcode,
+		size:    payloadLen,
 		payload: payload,
 	}, nil
 }
@@ -789,29 +1250,43 @@ func (w *websocket) cleanup() {
 	}
 }
 
-func (w *websocket) decompress(b []byte, isClient bool) ([]byte, error) {
-	bCopy := append([]byte{}, b...)
-
-	// ref: https://datatracker.ietf.org/doc/html/rfc7692#section-7.2.2
-	bCopy = append(bCopy, 0x00, 0x00, 0xff, 0xff)
-
+// decompress decompresses a permessage-deflate message, of which b is all or,
+// if truncated, the start. It returns at most PayloadLimitBytes of it and
+// whether there was more, or false if it can't be decompressed.
+func (w *websocket) decompress(b []byte, truncated bool, isClient bool) ([]byte, bool, bool) {
 	var inflaterPtr *io.ReadCloser
 	var noCtx bool
 	var bits int
 	var window *[]byte
+	var lost *bool
 
 	if isClient {
 		noCtx = w.clientNoContextTakeover
 		inflaterPtr = &w.clientInflater
 		bits = w.clientMaxWindowBits
 		window = &w.clientSlidingWindow
+		lost = &w.clientInflateLost
 	} else {
 		noCtx = w.serverNoContextTakeover
 		inflaterPtr = &w.serverInflater
 		bits = w.serverMaxWindowBits
 		window = &w.serverSlidingWindow
+		lost = &w.serverInflateLost
+	}
+
+	if *lost {
+		return nil, false, false
+	}
+	if truncated {
+		// The window after the message is unknown, and with it everything that
+		// refers back to it.
+		*lost = !noCtx
+		return nil, false, false
 	}
 
+	// ref: https://datatracker.ietf.org/doc/html/rfc7692#section-7.2.2
+	bCopy := append(append([]byte{}, b...), 0x00, 0x00, 0xff, 0xff)
+
 	var r io.ReadCloser
 	if noCtx {
 		r = flate.NewReader(bytes.NewReader(bCopy))
@@ -824,164 +1299,174 @@ func (w *websocket) decompress(b []byte, isClient bool) ([]byte, error) {
 			r = *inflaterPtr
 			zr, ok := r.(flate.Resetter)
 			if !ok {
-				return nil, fmt.Errorf("inflater does not implement flate.Resetter")
+				*lost = true
+				return nil, false, false
 			}
 			if err := zr.Reset(bytes.NewReader(bCopy), *window); err != nil {
-				return nil, fmt.Errorf("reset: %w", err)
+				*lost = true
+				return nil, false, false
 			}
 		}
 	}
 
-	data, err := io.ReadAll(r)
-	switch {
-	case err == nil || errors.Is(err, io.ErrUnexpectedEOF):
-		// Not all websocket implementations send a properly terminated DEFLATE stream,
-		// which might cause an io.ErrUnexpectedEOF. Go's flate.NewReader (correctly)
-		// treats these cases as errors, but that's just how real implementations behave.
+	// Only PayloadLimitBytes are kept, but the rest is still decompressed so
+	// that the window the next message refers back to is right.
+	var data []byte
+	more := false
+	pooled := getBuffer(32 << 10)
+	defer putBuffer(pooled)
+	buf := *pooled
+	for {
+		n, err := r.Read(buf)
+		keep := max(int(tracer.PayloadLimitBytes)-len(data), 0)
+		if n > keep {
+			more = true
+		}
+		data = append(data, buf[:min(n, keep)]...)
 		if !noCtx {
-			maxSize := 1 << bits
-			if len(data) >= maxSize {
-				*window = append([]byte{}, data[len(data)-maxSize:]...)
-			} else {
-				totalLen := len(*window) + len(data)
-				if totalLen <= maxSize {
-					*window = append(*window, data...)
-				} else {
-					newWindow := make([]byte, 0, maxSize)
-					newWindow = append(newWindow, (*window)[totalLen-maxSize:]...)
-					newWindow = append(newWindow, data...)
-					*window = newWindow
-				}
-			}
+			*window = appendWindow(*window, buf[:n], 1<<bits)
+		}
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			// Not all websocket implementations send a properly terminated DEFLATE stream,
+			// which might cause an io.ErrUnexpectedEOF. Go's flate.NewReader (correctly)
+			// treats these cases as errors, but that's just how real implementations behave.
+			return data, more, true
+		default:
+			*lost = !noCtx
+			return nil, false, false
 		}
-		return data, nil
-	default:
-		return nil, fmt.Errorf("read: %w", err)
 	}
 }
 
-func (w *websocket) proxy() ([]*tracer.WebsocketMessage, error) {
-	defer w.cleanup()
-
-	ctx, cancel := context.WithTimeout(context.Background(), websocketTimeLimit)
-	defer cancel()
-	errs := make(chan error, 2)
+// appendWindow appends data to a sliding window of at most maxSize bytes.
+func appendWindow(window []byte, data []byte, maxSize int) []byte {
+	if len(data) >= maxSize {
+		return append(window[:0], data[len(data)-maxSize:]...)
+	}
+	if total := len(window) + len(data); total > maxSize {
+		window = append(window[:0], window[total-maxSize:]...)
+	}
+	return append(window, data...)
+}
 
-	readLoop := func(isClient bool) {
-		var payload []byte
-		var op byte
-		var t time.Time
-		var compressed bool
-		first := true
+// readLoop parses the messages of one direction until it ends or sends a close
+// frame.
+func (w *websocket) readLoop(isClient bool) error {
+	var msg *tracer.WebsocketMessage // a data message whose last frame is yet to come
+	var payload []byte
+	var compressed bool
 
-		type frameResult struct {
-			frame *websocketFrame
-			err   error
+	for {
+		// Control frames are kept whole whatever the limit since they're at
+		// most 125 bytes.
+		keep := max(tracer.PayloadLimitBytes-int64(len(payload)), 125)
+		frame, err := w.readFrame(isClient, keep)
+		switch {
+		case err == nil:
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, errParserShed):
+			return nil
+		default:
+			return fmt.Errorf("read frame: %w", err)
 		}
-		for {
-			ch := make(chan frameResult, 1)
-			go func() {
-				frame, err := w.readFrame(isClient)
-				select {
-				case <-ctx.Done():
-				case ch <- frameResult{frame, err}:
-				}
-			}()
 
-			var frame *websocketFrame
-			select {
-			case <-ctx.Done():
-				return
-			case result := <-ch:
-				if result.err != nil {
-					errs <- fmt.Errorf("read frame (isClient=%t): %w", isClient, result.err)
-					return
-				}
-				frame = result.frame
+		switch frame.op {
+		case wsOpcodeContinuation:
+			if msg == nil {
+				return fmt.Errorf("unexpected continuation frame")
 			}
+		case wsOpcodeText, wsOpcodeBinary:
+			if msg != nil {
+				return fmt.Errorf("received new data frame before previous message finished")
+			}
+			msg = w.newMessage(frame.op, isClient, time.Now())
+			compressed = frame.rsv1
+		default:
+			// Control frames can come between the frames of a data message, but
+			// they're never fragmented themselves.
+			if !frame.fin {
+				return fmt.Errorf("received fragmented control frame")
+			}
+			ctl := w.newMessage(frame.op, isClient, time.Now())
+			ctl.Bytes = int64(frame.size)
+			w.emit(ctl, frame.payload, false, isClient)
+			if frame.op == wsOpcodeClose {
+				return nil
+			}
+			continue
+		}
 
-			switch frame.op {
-			case wsOpcodeContinuation:
-				if first {
-					errs <- fmt.Errorf("unexpected continuation frame (isClient=%t)", isClient)
-					return
-				}
-				payload = append(payload, frame.payload...)
-				if frame.fin {
-					if compressed {
-						var err error
-						payload, err = w.decompress(payload, isClient)
-						if err != nil {
-							errs <- fmt.Errorf("decompress: %w", err)
-							return
-						}
-					}
-					w.addMessage(op, payload, isClient, t)
-					payload = nil
-					first = true
-				}
-			case wsOpcodeText, wsOpcodeBinary:
-				if !first {
-					errs <- fmt.Errorf("received new data frame before previous message finished (isClient=%t)", isClient)
-					return
-				}
-				t = time.Now()
-				op = frame.op
-				compressed = frame.rsv1
-
-				payload = append(payload, frame.payload...)
-				first = frame.fin
-				if frame.fin {
-					if compressed {
-						var err error
-						payload, err = w.decompress(payload, isClient)
-						if err != nil {
-							errs <- fmt.Errorf("decompress: %w", err)
-							return
-						}
-					}
-
-					w.addMessage(op, payload, isClient, t)
-					payload = nil
-				}
-			case wsOpcodePing, wsOpcodePong, wsOpcodeClose:
-				if !frame.fin {
-					errs <- fmt.Errorf("received fragmented control frame (isClient=%t)", isClient)
-					return
-				}
+		msg.Bytes += int64(frame.size)
+		keep = max(tracer.PayloadLimitBytes-int64(len(payload)), 0)
+		payload = append(payload, frame.payload[:min(int64(len(frame.payload)), keep)]...)
+		if frame.fin {
+			w.emit(msg, payload, compressed, isClient)
+			msg, payload = nil, nil
+		}
+	}
+}
 
-				if frame.op == wsOpcodeClose {
-					errs <- nil
-					return
-				}
+// proxy parses both directions until both have ended. Whatever's left of a
+// direction after a close frame or a frame that can't be parsed is skipped so
+// that copying it never stalls.
+func (w *websocket) proxy() error {
+	defer w.cleanup()
 
-				continue
-			default:
-				errs <- fmt.Errorf("unknown opcode (isClient=%t): %x", isClient, frame.op)
-				return
+	errs := make(chan error, 2)
+	for _, isClient := range []bool{true, false} {
+		go func() {
+			err := w.readLoop(isClient)
+			io.Copy(io.Discard, w.reader(isClient))
+			if err != nil {
+				err = fmt.Errorf("read loop (isClient=%t): %w", isClient, err)
 			}
-		}
+			errs <- err
+		}()
 	}
+	return errors.Join(<-errs, <-errs)
+}
 
-	go readLoop(true)
-	go readLoop(false)
-
-	select {
-	case err1 := <-errs:
-		if err1 != nil {
-			cancel()
-			<-ctx.Done()
-			return w.getMessages(), fmt.Errorf("read loop: %w", err1)
+// publishWebsocketMessage publishes an event for a message of the websocket
+// that the handshake with the given event ID opened. The event has the tags of
+// tmpl and carries the handshake's request and response so that filters and
+// sinks see it like an exchange on the same URL.
+func (p *proxy) publishWebsocketMessage(tmpl *event.Event, handshakeID string, req *http.Request, resp *http.Response, msg *tracer.WebsocketMessage) {
+	ev := tmpl.Copy()
+	ev.Set("websocket_handshake_event_id", handshakeID)
+	ev.Set("websocket_direction", msg.Type)
+	ev.Set("websocket_opcode", msg.OpcodeName())
+	ev.Set("websocket_payload_bytes", fmt.Sprintf("%d", msg.Bytes))
+	if msg.Truncated {
+		ev.Set("websocket_payload_truncated", "true")
+	}
+	if msg.Compressed {
+		ev.Set("websocket_payload_compressed", "true")
+	}
+	if msg.Opcode == wsOpcodeClose && msg.CloseCode != 0 {
+		ev.Set("websocket_close_code", fmt.Sprintf("%d", msg.CloseCode))
+		if msg.CloseReason != "" {
+			ev.Set("websocket_close_reason", msg.CloseReason)
 		}
+	}
 
-		err2 := <-errs
-		if err2 != nil {
-			return w.getMessages(), fmt.Errorf("read loop: %w", err2)
-		}
+	r := req.Clone(context.Background())
+	r.Body = http.NoBody
+	rs := *resp
+	rs.Header = resp.Header.Clone()
+	rs.Body = http.NoBody
 
-		return w.getMessages(), nil
-	case <-ctx.Done():
-		return w.getMessages(), fmt.Errorf("%w: bytesRead=%d, limit=%d, msgsRead=%d", errWebsocketTimeLimitExceeded, uint64(tracer.PayloadLimitBytes)-w.n.Load(), tracer.PayloadLimitBytes, len(w.getMessages()))
+	parser := tracer.NewParser(p.global, ev)
+	parser.SetOutgoing(p.isOutgoing)
+	parser.SetWebsocketHandshake(handshakeID)
+	parser.UseRequest(r)
+	parser.UseResponse(&rs)
+	go io.Copy(io.Discard, r.Body)
+	go io.Copy(io.Discard, rs.Body)
+	parser.UseWebsocketMessages([]*tracer.WebsocketMessage{msg})
+	if err := parser.Finish(); err != nil {
+		slog.Error("failed to finish HAR parser for websocket message", "eventID", ev.Get("event_id"), "err", err)
 	}
 }
 
@@ -991,33 +1476,69 @@ type http2Stream struct {
 	event  *event.Event
 	parser *tracer.Parser
 
-	active sync.WaitGroup
+	active    sync.WaitGroup
+	ended     atomic.Int32
+	finishing *sync.WaitGroup
 
 	req struct {
 		Request      *http.Request
 		buf          *io.PipeWriter
 		headersEnded bool
+		ended        atomic.Bool
 	}
 
 	resp struct {
 		Response     *http.Response
 		buf          *io.PipeWriter
 		headersEnded bool
+		ended        atomic.Bool
+	}
+}
+
+// end ends one direction of the stream unless it has already ended, either
+// with END_STREAM or because the stream was reset.
+func (st *http2Stream) end(isClient bool) {
+	ended, buf := &st.resp.ended, st.resp.buf
+	if isClient {
+		ended, buf = &st.req.ended, st.req.buf
+	}
+	if ended.CompareAndSwap(false, true) {
+		buf.Close()
+		st.endHalf()
+	}
+}
+
+// endHalf records that one direction of the stream has ended. The event is
+// finished in the background once both have, and finishing covers that so that
+// the proxy doesn't return before the event is published.
+func (st *http2Stream) endHalf() {
+	if st.ended.Add(1) == 2 {
+		st.finishing.Add(1)
 	}
+	st.active.Done()
 }
 
-func (p *proxy) newHTTP2Stream(streamID uint32) *http2Stream {
+func (p *proxy) newHTTP2Stream(streamID uint32, finishing *sync.WaitGroup) *http2Stream {
 	eventID := uuid.New()
 	slog.Debug("proxy: http/2: new event", "proxy", p, "eventID", eventID)
 
-	event := p.global.Config.GetEventTemplate()
+	event := p.tmpl.Copy()
 	event.Set("event_id", eventID.String())
+	p.setDestinationTags(event, "")
 
 	st := new(http2Stream)
 	st.streamID = streamID
+	st.finishing = finishing
 
 	st.event = event
 	st.parser = tracer.NewParser(p.global, event)
+	st.parser.SetOutgoing(p.isOutgoing)
+	if d, ok := p.takeConnect(); ok {
+		st.parser.SetConnect(d)
+		if d, ok := p.claimDNS(); ok {
+			st.parser.SetDNS(d)
+		}
+	}
 
 	st.active.Add(2)
 
@@ -1040,6 +1561,8 @@ func (p *proxy) newHTTP2Stream(streamID uint32) *http2Stream {
 
 	go func() {
 		st.active.Wait()
+		defer finishing.Done()
+		p.setAccountedTags(st.event)
 		if err := st.parser.Finish(); err != nil {
 			slog.Error("failed to finish HAR parser", "eventID", st.event.Get("event_id"), "err", err)
 		}
@@ -1051,6 +1574,10 @@ func (p *proxy) newHTTP2Stream(streamID uint32) *http2Stream {
 func (p *proxy) proxyHTTP2(cli, srv *bufConn) error {
 	slog.Debug("starting proxyHTTP2", "proxy", p)
 
+	// Frames are decoded and written again, which needn't reproduce the same
+	// bytes (e.g. padding is dropped).
+	p.skipIntegrity("http/2 reframing")
+
 	preface := make([]byte, len(http2.ClientPreface))
 	if _, err := io.ReadFull(cli, preface); err != nil {
 		return fmt.Errorf("read preface: %w", err)
@@ -1063,15 +1590,24 @@ func (p *proxy) proxyHTTP2(cli, srv *bufConn) error {
 	}
 
 	var mu sync.Mutex
+	var finishing sync.WaitGroup
 	state := make(map[uint32]*http2Stream)
+	budget := p.newParseBudget("http/2")
 
+	// getStream returns the stream with the ID, starting it if it's new. Only
+	// HEADERS frames start streams; other frames use lookupStream so that frames
+	// that arrive after a stream ended don't start an event of their own. It
+	// returns nil once the connection is shed.
 	getStream := func(streamID uint32) *http2Stream {
 		mu.Lock()
 		defer mu.Unlock()
+		if budget.shed.Load() {
+			return nil
+		}
 
 		st, ok := state[streamID]
 		if !ok {
-			st = p.newHTTP2Stream(streamID)
+			st = p.newHTTP2Stream(streamID, &finishing)
 			state[streamID] = st
 			go func() {
 				st.active.Wait()
@@ -1082,117 +1618,196 @@ func (p *proxy) proxyHTTP2(cli, srv *bufConn) error {
 		}
 		return st
 	}
+	lookupStream := func(streamID uint32) *http2Stream {
+		mu.Lock()
+		defer mu.Unlock()
+		return state[streamID]
+	}
 
-	copySingle := func(dst *http2.Framer, src *http2.Framer, isClient bool) error {
-		dec := hpack.NewDecoder(4096, nil)
-		for {
-			fr, err := src.ReadFrame()
-			switch {
-			case err == nil:
-			case errors.Is(err, io.EOF):
-				return nil
-			case errors.Is(err, net.ErrClosed):
-				return nil
-			case strings.Contains(err.Error(), "connection reset by peer"):
-				return nil
-			default:
-				return fmt.Errorf("read frame: %w", err)
+	copySingle := func(w io.Writer, r io.Reader, isClient bool) error {
+		dir := "server->client"
+		if isClient {
+			dir = "client->server"
+		}
+		dst, src := http2.NewFramer(w, nil), http2.NewFramer(nil, r)
+
+		// Fields are handled as they're decoded instead of being collected first,
+		// since a small header block can expand into any number of references
+		// to large entries of the dynamic table. That's also why each one is
+		// charged to the budget.
+		var emit func(hpack.HeaderField)
+		dec := hpack.NewDecoder(4096, func(hdr hpack.HeaderField) {
+			if budget.charge(shedHeaders, fieldSteps(hdr.Name, hdr.Value), 0) {
+				emit(hdr)
 			}
+		})
+
+		// block is the header block being decoded. It starts with a HEADERS or
+		// PUSH_PROMISE frame and continues in CONTINUATION frames until one has
+		// END_HEADERS. st is nil for PUSH_PROMISE, whose fields are only decoded
+		// to keep the dynamic table in sync.
+		var block struct {
+			st        *http2Stream
+			isTrailer bool
+			endStream bool
+			budget    tracer.HeaderBudget
+		}
 
-			switch fr := fr.(type) {
-			case *http2.HeadersFrame:
-				st := getStream(fr.StreamID)
-
-				headers, err := dec.DecodeFull(fr.HeaderBlockFragment())
-				if err != nil {
-					return fmt.Errorf("%T: decode fields: %w", fr, err)
-				}
-
-				var isTrailer bool
-				if isClient {
-					isTrailer = st.req.headersEnded
-				} else {
-					isTrailer = st.resp.headersEnded
-				}
-
-				for _, hdr := range headers {
-					switch hdr.Name {
-					case ":method":
-						st.req.Request.Method = hdr.Value
-					case ":path":
-						st.req.Request.URL.RawPath = hdr.Value
+		startHeaders := func(st *http2Stream, endStream bool) {
+			if st == nil {
+				block.st = nil
+				emit = func(hpack.HeaderField) {}
+				return
+			}
+			var isTrailer bool
+			if isClient {
+				isTrailer = st.req.headersEnded
+			} else {
+				isTrailer = st.resp.headersEnded
+			}
+			block.st, block.isTrailer, block.endStream, block.budget = st, isTrailer, endStream, tracer.HeaderBudget{}
+
+			emit = func(hdr hpack.HeaderField) {
+				switch hdr.Name {
+				case ":method":
+					st.req.Request.Method = hdr.Value
+				case ":path":
+					if u, err := url.ParseRequestURI(hdr.Value); err == nil {
+						st.req.Request.URL = u
+					} else {
 						st.req.Request.URL.Path = hdr.Value
-					case ":scheme":
-					case ":authority":
-					case ":status":
-						code := 0
-						for i := 0; i < len(hdr.Value); i++ {
-							if hdr.Value[i] < '0' || hdr.Value[i] > '9' {
-								break
-							}
-							code *= 10
-							code += int(byte(hdr.Value[i])) - int(byte('0'))
-						}
-						st.resp.Response.StatusCode = code
-						st.resp.Response.Status = http.StatusText(code)
-					default:
-						if !isTrailer {
-							if isClient {
-								st.req.Request.Header.Add(hdr.Name, hdr.Value)
-							} else {
-								st.resp.Response.Header.Add(hdr.Name, hdr.Value)
-							}
-						} else {
-							if isClient {
-								st.req.Request.Trailer.Add(hdr.Name, hdr.Value)
-							} else {
-								st.resp.Response.Trailer.Add(hdr.Name, hdr.Value)
-							}
-						}
 					}
-				}
-
-				if fr.HeadersEnded() {
-					if !isTrailer {
-						if isClient {
-							st.req.headersEnded = true
-						} else {
-							st.resp.headersEnded = true
+				case ":scheme":
+				case ":authority":
+					st.req.Request.Host = hdr.Value
+					if isClient && p.isOutgoing {
+						observeHostname(p.external, hdr.Value)
+						p.setDestinationTags(st.event, hdr.Value)
+					}
+				case ":status":
+					code := 0
+					for i := 0; i < len(hdr.Value); i++ {
+						if hdr.Value[i] < '0' || hdr.Value[i] > '9' {
+							break
 						}
+						code *= 10
+						code += int(byte(hdr.Value[i])) - int(byte('0'))
+					}
+					st.resp.Response.StatusCode = code
+					st.resp.Response.Status = http.StatusText(code)
+				default:
+					val, ok := block.budget.Admit(hdr.Name, hdr.Value)
+					if !ok {
+						break
 					}
-				}
-
-				if fr.HeadersEnded() {
 					if !isTrailer {
 						if isClient {
-							st.parser.UseRequest(st.req.Request)
-							go func() {
-								defer st.req.Request.Body.Close()
-								io.Copy(io.Discard, st.req.Request.Body)
-							}()
+							st.req.Request.Header.Add(hdr.Name, val)
 						} else {
-							st.parser.UseResponse(st.resp.Response)
-							go func() {
-								defer st.resp.Response.Body.Close()
-								io.Copy(io.Discard, st.resp.Response.Body)
-							}()
+							st.resp.Response.Header.Add(hdr.Name, val)
 						}
 					} else {
 						if isClient {
-							st.parser.SetRequestTrailer(st.req.Request.Trailer)
+							st.req.Request.Trailer.Add(hdr.Name, val)
 						} else {
-							st.parser.SetResponseTrailer(st.resp.Response.Trailer)
+							st.resp.Response.Trailer.Add(hdr.Name, val)
 						}
 					}
 				}
+			}
+		}
 
-				if fr.StreamEnded() {
-					if isClient {
-						st.req.buf.Close()
-					} else {
-						st.resp.buf.Close()
-					}
-					st.active.Done()
+		// endHeaders hands a complete header block to the stream's parser.
+		endHeaders := func() {
+			st := block.st
+			if st == nil {
+				return
+			}
+			st.parser.TrimmedHeaders(isClient, block.isTrailer, block.budget)
+
+			if !block.isTrailer {
+				budget.charge(shedMessages, stepsPerMessage, 0)
+				if isClient {
+					st.req.headersEnded = true
+					st.parser.UseRequest(st.req.Request)
+					go func() {
+						defer st.req.Request.Body.Close()
+						io.Copy(io.Discard, st.req.Request.Body)
+					}()
+				} else {
+					st.resp.headersEnded = true
+					st.parser.UseResponse(st.resp.Response)
+					go func() {
+						defer st.resp.Response.Body.Close()
+						io.Copy(io.Discard, st.resp.Response.Body)
+					}()
+				}
+			} else {
+				if isClient {
+					st.parser.SetRequestTrailer(st.req.Request.Trailer)
+				} else {
+					st.parser.SetResponseTrailer(st.resp.Response.Trailer)
+				}
+			}
+
+			// END_STREAM on a HEADERS frame only takes effect once its header
+			// block is complete.
+			if block.endStream {
+				st.end(isClient)
+			}
+		}
+
+		decodeFragment := func(fragment []byte, ended bool) error {
+			if _, err := dec.Write(fragment); err != nil {
+				return fmt.Errorf("decode fields: %w", err)
+			}
+			if !ended || budget.shed.Load() {
+				return nil
+			}
+			if err := dec.Close(); err != nil {
+				return fmt.Errorf("decode fields: %w", err)
+			}
+			endHeaders()
+			return nil
+		}
+
+		for {
+			if budget.shed.Load() {
+				// Nothing more of this direction is parsed, so its half of the open
+				// streams ends here. Frames are only read and written whole, so the
+				// rest can be copied as is, and the peers' HPACK tables stay in sync
+				// without the proxy decoding anything.
+				mu.Lock()
+				open := make([]*http2Stream, 0, len(state))
+				for _, st := range state {
+					open = append(open, st)
+				}
+				mu.Unlock()
+				for _, st := range open {
+					st.end(isClient)
+				}
+				return p.copyRawSingle(dir, "http/2", w, r)
+			}
+
+			fr, err := src.ReadFrame()
+			switch {
+			case err == nil:
+			case errors.Is(err, io.EOF):
+				return nil
+			case errors.Is(err, net.ErrClosed):
+				return nil
+			case strings.Contains(err.Error(), "connection reset by peer"):
+				return nil
+			default:
+				return fmt.Errorf("read frame: %w", err)
+			}
+			budget.charge(shedFrames, frameSteps(fr), http2FrameHeaderLen+int(fr.Header().Length))
+
+			switch fr := fr.(type) {
+			case *http2.HeadersFrame:
+				startHeaders(getStream(fr.StreamID), fr.StreamEnded())
+				if err := decodeFragment(fr.HeaderBlockFragment(), fr.HeadersEnded()); err != nil {
+					return fmt.Errorf("%T: %w", fr, err)
 				}
 
 				p := http2.HeadersFrameParam{
@@ -1206,29 +1821,34 @@ func (p *proxy) proxyHTTP2(cli, srv *bufConn) error {
 					return fmt.Errorf("%T: write headers: %w", fr, err)
 				}
 
+			case *http2.ContinuationFrame:
+				if err := decodeFragment(fr.HeaderBlockFragment(), fr.HeadersEnded()); err != nil {
+					return fmt.Errorf("%T: %w", fr, err)
+				}
+				if err := dst.WriteContinuation(fr.StreamID, fr.HeadersEnded(), fr.HeaderBlockFragment()); err != nil {
+					return fmt.Errorf("%T: forward: %w", fr, err)
+				}
+
 			case *http2.DataFrame:
-				st := getStream(fr.StreamID)
 				if err := dst.WriteData(fr.StreamID, fr.StreamEnded(), fr.Data()); err != nil {
 					return fmt.Errorf("%T: write data: %w", fr, err)
 				}
 
+				st := lookupStream(fr.StreamID)
+				if st == nil {
+					break
+				}
+				buf := st.resp.buf
 				if isClient {
-					if _, err := st.req.buf.Write(fr.Data()); err != nil {
-						return fmt.Errorf("%T: write pipe: %w", fr, err)
-					}
-				} else {
-					if _, err := st.resp.buf.Write(fr.Data()); err != nil {
-						return fmt.Errorf("%T: write pipe: %w", fr, err)
-					}
+					buf = st.req.buf
+				}
+				// The pipe is closed if the stream was reset while the frame was in
+				// flight.
+				if _, err := buf.Write(fr.Data()); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+					return fmt.Errorf("%T: write pipe: %w", fr, err)
 				}
-
 				if fr.StreamEnded() {
-					if isClient {
-						st.req.buf.Close()
-					} else {
-						st.resp.buf.Close()
-					}
-					st.active.Done()
+					st.end(isClient)
 				}
 
 			case *http2.SettingsFrame:
@@ -1261,6 +1881,14 @@ func (p *proxy) proxyHTTP2(cli, srv *bufConn) error {
 					return fmt.Errorf("%T: forward: %w", fr, err)
 				}
 
+				// Neither side sends anything more on a reset stream, so its event is
+				// finished with whatever was exchanged.
+				if st := lookupStream(fr.StreamID); st != nil {
+					st.event.Set("http2_reset", fr.ErrCode.String())
+					st.end(true)
+					st.end(false)
+				}
+
 			case *http2.GoAwayFrame:
 				if err := dst.WriteGoAway(fr.LastStreamID, fr.ErrCode, fr.DebugData()); err != nil {
 					return fmt.Errorf("%T: forward: %w", fr, err)
@@ -1272,6 +1900,12 @@ func (p *proxy) proxyHTTP2(cli, srv *bufConn) error {
 				}
 
 			case *http2.PushPromiseFrame:
+				block.st = nil
+				emit = func(hpack.HeaderField) {}
+				if err := decodeFragment(fr.HeaderBlockFragment(), fr.HeadersEnded()); err != nil {
+					return fmt.Errorf("%T: %w", fr, err)
+				}
+
 				param := http2.PushPromiseParam{
 					StreamID:      fr.StreamID,
 					PromiseID:     fr.PromiseID,
@@ -1292,7 +1926,7 @@ func (p *proxy) proxyHTTP2(cli, srv *bufConn) error {
 	go func() {
 		defer srv.CloseWrite()
 		defer cli.CloseRead()
-		if err := copySingle(http2.NewFramer(srv, nil), http2.NewFramer(nil, cli), true); err != nil {
+		if err := copySingle(srv, cli, true); err != nil {
 			errs <- fmt.Errorf("client->server: %w", err)
 			return
 		}
@@ -1300,30 +1934,61 @@ func (p *proxy) proxyHTTP2(cli, srv *bufConn) error {
 	}()
 
 	go func() {
-		defer srv.CloseWrite()
-		defer cli.CloseRead()
-		if err := copySingle(http2.NewFramer(cli, nil), http2.NewFramer(nil, srv), false); err != nil {
+		defer cli.CloseWrite()
+		defer srv.CloseRead()
+		if err := copySingle(cli, srv, false); err != nil {
 			errs <- fmt.Errorf("server->client: %w", err)
 			return
 		}
 		errs <- nil
 	}()
 
-	if err := errors.Join(<-errs, <-errs); err != nil {
+	err := errors.Join(<-errs, <-errs)
+
+	// Streams still open when the connection ends won't get any more frames.
+	mu.Lock()
+	open := make([]*http2Stream, 0, len(state))
+	for _, st := range state {
+		open = append(open, st)
+	}
+	mu.Unlock()
+	for _, st := range open {
+		st.end(true)
+		st.end(false)
+	}
+
+	finishing.Wait()
+	if budget.shed.Load() {
+		p.decide(shedDecision("http/2"), tracer.CaptureNone)
+	}
+	if err != nil {
 		return fmt.Errorf("http/2 proxy: %w", err)
 	}
 	return nil
 }
 
 func (p *proxy) proxyFallback(cli, srv *bufConn) error {
+	return p.proxyRaw(cli, srv, nil, nil)
+}
+
+// proxyRaw copies bytes between the client and server without parsing them.
+// A copy of what each side sends is also written to its tap, if any.
+func (p *proxy) proxyRaw(cli, srv *bufConn, cliTap, srvTap io.Writer) error {
 	slog.Debug("starting proxyFallback", "proxy", p)
+	var fromCli, fromSrv io.Reader = cli, srv
+	if cliTap != nil {
+		fromCli = io.TeeReader(cli, cliTap)
+	}
+	if srvTap != nil {
+		fromSrv = io.TeeReader(srv, srvTap)
+	}
 
 	errs := make(chan error, 2)
 
 	go func() {
 		defer srv.CloseWrite()
 		defer cli.CloseRead()
-		if err := p.copyRawSingle("client->server", "unknown", srv, cli); err != nil {
+		if err := p.copyRawSingle("client->server", "unknown", srv, fromCli); err != nil {
 			errs <- fmt.Errorf("copy client->server: %w", err)
 			return
 		}
@@ -1333,7 +1998,7 @@ func (p *proxy) proxyFallback(cli, srv *bufConn) error {
 	go func() {
 		defer cli.CloseWrite()
 		defer srv.CloseRead()
-		if err := p.copyRawSingle("server->client", "unknown", cli, srv); err != nil {
+		if err := p.copyRawSingle("server->client", "unknown", cli, fromSrv); err != nil {
 			errs <- fmt.Errorf("copy server->client: %w", err)
 			return
 		}
@@ -1347,7 +2012,11 @@ func (p *proxy) proxyFallback(cli, srv *bufConn) error {
 }
 
 func (p *proxy) copyRawSingle(dir, proto string, w io.Writer, r io.Reader) error {
-	n, err := io.Copy(w, r)
+	// Neither side is usually a plain TCP connection that io.Copy could
+	// splice, so it would allocate a buffer for every copy.
+	buf := getBuffer(32 << 10)
+	defer putBuffer(buf)
+	n, err := io.CopyBuffer(w, r, *buf)
 	dur := time.Since(p.begin).Nanoseconds() / 1000
 	switch {
 	case err == nil:
@@ -1362,11 +2031,27 @@ func (p *proxy) copyRawSingle(dir, proto string, w io.Writer, r io.Reader) error
 	return nil
 }
 
-// bufConn is a net.Conn wrapper that supports peeking on the read side.
+// bufConn is a net.Conn wrapper that supports peeking on the read side. It
+// counts the bytes consumed by Read and written by Write, and hashes them into
+// rsum and wsum if they're set (see VerifyIntegrity).
 type bufConn struct {
 	mu sync.Mutex
 	r  *bufio.Reader
 	net.Conn
+
+	nread    atomic.Uint64
+	nwritten atomic.Uint64
+
+	rsum atomic.Pointer[digest]
+	wsum atomic.Pointer[digest]
+
+	rmirror atomic.Pointer[pcapMirror]
+	wmirror atomic.Pointer[pcapMirror]
+
+	// pattern is told the size of every read, and of every write on the
+	// external side, if it's set. It's set before the proxy starts copying.
+	pattern *writePattern
+	process bool // the process side of the proxy
 }
 
 func newBufConn(c net.Conn) *bufConn {
@@ -1376,7 +2061,33 @@ func newBufConn(c net.Conn) *bufConn {
 func (c *bufConn) Read(b []byte) (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.r.Read(b)
+	n, err := c.r.Read(b)
+	c.nread.Add(uint64(n))
+	if c.pattern != nil {
+		c.pattern.read(c.process, n)
+	}
+	if d := c.rsum.Load(); d != nil {
+		d.add(b[:n], false)
+	}
+	if m := c.rmirror.Load(); m != nil {
+		m.write(b[:n])
+	}
+	return n, err
+}
+
+func (c *bufConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.nwritten.Add(uint64(n))
+	if c.pattern != nil && !c.process {
+		c.pattern.wrote(n)
+	}
+	if d := c.wsum.Load(); d != nil {
+		d.add(b[:n], err != nil)
+	}
+	if m := c.wmirror.Load(); m != nil {
+		m.write(b[:n])
+	}
+	return n, err
 }
 
 func (c *bufConn) Buffered() int {
@@ -1410,7 +2121,7 @@ func (c *bufConn) peekSample() ([]byte, error) {
 }
 
 // CloseWrite half-closes the write side of the connection. If the underlying
-// net.Conn is not half-closeable (i.e. not a *net.TCPConn), this is a no-op.
+// net.Conn is not half-closeable (e.g. a *tls.Conn), this is a no-op.
 func (c *bufConn) CloseWrite() error {
 	if c, ok := c.Conn.(interface{ CloseWrite() error }); ok {
 		return c.CloseWrite()
@@ -1419,7 +2130,7 @@ func (c *bufConn) CloseWrite() error {
 }
 
 // CloseRead half-closes the read side of the connection. If the underlying
-// net.Conn is not half-closeable (i.e. not a *net.TCPConn), this is a no-op.
+// net.Conn is not half-closeable (e.g. a *tls.Conn), this is a no-op.
 func (c *bufConn) CloseRead() error {
 	if c, ok := c.Conn.(interface{ CloseRead() error }); ok {
 		return c.CloseRead()
@@ -1438,6 +2149,7 @@ func guessProtocol(sample []byte) string {
 		{"http/1", 0, []byte("HEAD ")},
 		{"http/1", 0, []byte("PUT ")},
 		{"http/1", 0, []byte("DELETE ")},
+		{"http/1", 0, []byte("CONNECT ")}, // to a forward proxy
 
 		{"http/2", 0, []byte("PRI ")},
 
@@ -1543,6 +2255,7 @@ func (h *hijacker) RoundTrip(req *http.Request) (*http.Response, error) {
 	event.Set("event_id", uuid.New().String())
 
 	parser := tracer.NewParser(h.proxy.global, event)
+	parser.SetOutgoing(h.proxy.isOutgoing)
 	parser.UseRequest(req)
 
 	tr := &http.Transport{
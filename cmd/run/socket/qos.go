@@ -0,0 +1,178 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/tracer"
+)
+
+// QoS holds the socket options that classify a socket's traffic for quality of
+// service. A negative value leaves the option at the kernel's default.
+type QoS struct {
+	TOS      int // IP_TOS, or IPV6_TCLASS on IPv6 sockets (DSCP is the upper six bits)
+	Priority int // SO_PRIORITY
+	Mark     int // SO_MARK, which needs CAP_NET_ADMIN
+}
+
+// NoQoS leaves every option alone.
+var NoQoS = QoS{TOS: -1, Priority: -1, Mark: -1}
+
+var (
+	// ExternalQoS is applied to every external connection and listener that
+	// subtrace creates on behalf of a traced process. Without it, they carry
+	// the tracer's default class no matter how the process marked its own
+	// socket.
+	ExternalQoS = NoQoS
+
+	// MirrorQoS copies the options the traced process set on its socket to the
+	// external one. They take precedence over ExternalQoS, which still applies
+	// to the options the process didn't set.
+	MirrorQoS bool
+)
+
+// IsDefault reports whether q leaves every option alone.
+func (q QoS) IsDefault() bool {
+	return q.TOS < 0 && q.Priority < 0 && q.Mark < 0
+}
+
+// Or returns q with every option it leaves alone taken from def.
+func (q QoS) Or(def QoS) QoS {
+	if q.TOS < 0 {
+		q.TOS = def.TOS
+	}
+	if q.Priority < 0 {
+		q.Priority = def.Priority
+	}
+	if q.Mark < 0 {
+		q.Mark = def.Mark
+	}
+	return q
+}
+
+func (q QoS) String() string {
+	var opts []string
+	if q.TOS >= 0 {
+		opts = append(opts, fmt.Sprintf("tos=0x%02x", q.TOS))
+	}
+	if q.Priority >= 0 {
+		opts = append(opts, fmt.Sprintf("priority=%d", q.Priority))
+	}
+	if q.Mark >= 0 {
+		opts = append(opts, fmt.Sprintf("mark=%d", q.Mark))
+	}
+	if len(opts) == 0 {
+		return "default"
+	}
+	return strings.Join(opts, " ")
+}
+
+// addIntervention records q on the proxy's events unless it leaves every
+// option alone.
+func (q QoS) addIntervention(p *proxy) {
+	if q.IsDefault() {
+		return
+	}
+	p.tmpl = p.tmpl.Copy()
+	tracer.AddIntervention(p.tmpl, tracer.Intervention{Feature: "external_qos", Summary: "set " + q.String() + " on the external socket"})
+}
+
+// externalQoS returns the options for the external side of the traced socket
+// fd.
+func externalQoS(fd int) QoS {
+	if !MirrorQoS {
+		return ExternalQoS
+	}
+	return traceeQoS(fd).Or(ExternalQoS)
+}
+
+// traceeQoS reads the options the traced process set on its socket. Options
+// at the kernel's default of zero count as not set.
+func traceeQoS(fd int) QoS {
+	get := func(level, opt int) int {
+		val, err := unix.GetsockoptInt(fd, level, opt)
+		if err != nil || val == 0 {
+			return -1
+		}
+		return val
+	}
+
+	ret := QoS{
+		TOS:      get(unix.IPPROTO_IP, unix.IP_TOS),
+		Priority: get(unix.SOL_SOCKET, unix.SO_PRIORITY),
+		Mark:     get(unix.SOL_SOCKET, unix.SO_MARK),
+	}
+	if domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN); err == nil && domain == unix.AF_INET6 {
+		ret.TOS = get(unix.IPPROTO_IPV6, unix.IPV6_TCLASS)
+	}
+	return ret
+}
+
+// qosWarnings makes sure that an option the kernel refuses (e.g. SO_MARK
+// without CAP_NET_ADMIN) is only warned about once instead of once per
+// connection.
+var qosWarnings sync.Map // string -> struct{}
+
+// apply sets the options on fd. Failures aren't fatal: the connection works
+// without them, just not in the requested class.
+func (q QoS) apply(fd int) {
+	set := func(name string, level, opt, val int) {
+		if err := unix.SetsockoptInt(fd, level, opt, val); err != nil {
+			if _, loaded := qosWarnings.LoadOrStore(name, struct{}{}); !loaded {
+				slog.Warn(fmt.Sprintf("failed to set %s on external socket", name), "val", val, "err", err) // not fatal
+			}
+		}
+	}
+
+	if q.TOS >= 0 {
+		domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if err == nil && domain == unix.AF_INET6 {
+			set("IPV6_TCLASS", unix.IPPROTO_IPV6, unix.IPV6_TCLASS, q.TOS)
+			// IPv4-mapped traffic on a dual-stack socket uses IP_TOS instead.
+			unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, q.TOS)
+		} else {
+			set("IP_TOS", unix.IPPROTO_IP, unix.IP_TOS, q.TOS)
+		}
+	}
+	if q.Priority >= 0 {
+		set("SO_PRIORITY", unix.SOL_SOCKET, unix.SO_PRIORITY, q.Priority)
+	}
+	if q.Mark >= 0 {
+		set("SO_MARK", unix.SOL_SOCKET, unix.SO_MARK, q.Mark)
+	}
+}
+
+// control returns a net.Dialer or net.ListenConfig Control function that runs
+// next (if any) and then applies q.
+func (q QoS) control(next func(network, address string, c syscall.RawConn) error) func(string, string, syscall.RawConn) error {
+	if q.IsDefault() {
+		return next
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if next != nil {
+			if err := next(network, address, c); err != nil {
+				return err
+			}
+		}
+		if err := c.Control(func(fd uintptr) { q.apply(int(fd)) }); err != nil {
+			return fmt.Errorf("control: %w", err)
+		}
+		return nil
+	}
+}
+
+// listenExternal is net.Listen for the external side of a traced listening
+// socket.
+func listenExternal(network, addr string, q QoS) (net.Listener, error) {
+	lc := &net.ListenConfig{Control: q.control(nil)}
+	return lc.Listen(context.TODO(), network, addr)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+)
+
+func setQoS(t *testing.T, q QoS, mirror bool) {
+	prevQoS, prevMirror := ExternalQoS, MirrorQoS
+	ExternalQoS, MirrorQoS = q, mirror
+	t.Cleanup(func() { ExternalQoS, MirrorQoS = prevQoS, prevMirror })
+}
+
+// canSetMark reports whether SO_MARK can be set, which needs CAP_NET_ADMIN.
+func canSetMark(t *testing.T) bool {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socket: %v", err)
+	}
+	defer unix.Close(fd)
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, 1) == nil
+}
+
+// readQoS reads the options back from a connection or listener subtrace
+// created.
+func readQoS(t *testing.T, conn interface {
+	SyscallConn() (syscall.RawConn, error)
+}) QoS {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("syscall conn: %v", err)
+	}
+	var ret QoS
+	var errs []error
+	raw.Control(func(fd uintptr) {
+		get := func(level, opt int) int {
+			val, err := unix.GetsockoptInt(int(fd), level, opt)
+			errs = append(errs, err)
+			return val
+		}
+		ret.TOS = get(unix.IPPROTO_IP, unix.IP_TOS)
+		ret.Priority = get(unix.SOL_SOCKET, unix.SO_PRIORITY)
+		ret.Mark = get(unix.SOL_SOCKET, unix.SO_MARK)
+	})
+	if err := errors.Join(errs...); err != nil {
+		t.Fatalf("getsockopt: %v", err)
+	}
+	return ret
+}
+
+func TestExternalQoS(t *testing.T) {
+	addr, _ := countingListener(t)
+	g := &global.Global{Config: config.New()}
+
+	want := QoS{TOS: 0xb8, Priority: 3, Mark: -1}
+	if canSetMark(t) {
+		want.Mark = 42
+	}
+
+	tests := []struct {
+		name   string
+		fixed  QoS
+		mirror bool
+		tracee QoS // set on the traced socket before connecting
+		want   QoS
+	}{
+		{name: "default", fixed: NoQoS, want: QoS{TOS: 0, Priority: 0, Mark: 0}},
+		{name: "fixed", fixed: want, want: QoS{TOS: want.TOS, Priority: want.Priority, Mark: max(want.Mark, 0)}},
+		{name: "mirror", fixed: NoQoS, mirror: true, tracee: QoS{TOS: 0x28, Priority: 5, Mark: -1}, want: QoS{TOS: 0x28, Priority: 5, Mark: 0}},
+		// Setting IP_TOS also sets SO_PRIORITY from the TOS bits, 2 for 0x28.
+		{name: "mirror preferred", fixed: want, mirror: true, tracee: QoS{TOS: 0x28, Priority: -1, Mark: -1}, want: QoS{TOS: 0x28, Priority: 2, Mark: max(want.Mark, 0)}},
+		{name: "mirror disabled", fixed: NoQoS, tracee: QoS{TOS: 0x28, Priority: 5, Mark: -1}, want: QoS{TOS: 0, Priority: 0, Mark: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setQoS(t, tt.fixed, tt.mirror)
+
+			sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+			if err != nil {
+				t.Fatalf("create socket: %v", err)
+			}
+			defer sock.Close()
+			if tt.tracee.TOS >= 0 {
+				unix.SetsockoptInt(sock.FD.FD(), unix.IPPROTO_IP, unix.IP_TOS, tt.tracee.TOS)
+			}
+			if tt.tracee.Priority >= 0 {
+				unix.SetsockoptInt(sock.FD.FD(), unix.SOL_SOCKET, unix.SO_PRIORITY, tt.tracee.Priority)
+			}
+
+			if errno, err := sock.Connect(addr, nil); err != nil || errno != 0 {
+				t.Fatalf("connect: errno=%v, err=%v", errno, err)
+			}
+			proxy := sock.Inode.state.Load().connected.proxy
+			if got := readQoS(t, proxy.external); got != tt.want {
+				t.Errorf("got external connection %+v, want %+v", got, tt.want)
+			}
+
+			finishProxy(t, proxy, sock)
+			recorded := strings.Contains(proxy.tmpl.Get("interventions"), `"feature":"external_qos"`)
+			if want := !tt.fixed.IsDefault() || (tt.mirror && !tt.tracee.IsDefault()); recorded != want {
+				t.Errorf("got external_qos intervention recorded=%v, want %v (interventions: %q)", recorded, want, proxy.tmpl.Get("interventions"))
+			}
+		})
+	}
+}
+
+func TestExternalQoSListener(t *testing.T) {
+	setQoS(t, QoS{TOS: 0x48, Priority: 2, Mark: -1}, false)
+
+	g := &global.Global{Config: config.New()}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+
+	if errno, err := sock.Bind(netip.MustParseAddrPort("127.0.0.1:0")); err != nil || errno != 0 {
+		t.Fatalf("bind: errno=%v, err=%v", errno, err)
+	}
+	if errno, err := sock.Listen(8); err != nil || errno != 0 {
+		t.Fatalf("listen: errno=%v, err=%v", errno, err)
+	}
+
+	lis := sock.Inode.state.Load().listening.lis.(*net.TCPListener)
+	if got, want := readQoS(t, lis), (QoS{TOS: 0x48, Priority: 2, Mark: 0}); got != want {
+		t.Errorf("got external listener %+v, want %+v", got, want)
+	}
+}
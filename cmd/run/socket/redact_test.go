@@ -0,0 +1,137 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/tracer"
+)
+
+// TestRedact sends credentials in headers and bodies through a traced socket
+// and checks that none of them are in the event while the server gets them
+// unchanged.
+func TestRedact(t *testing.T) {
+	events := captureEvents(t)
+	dir := t.TempDir()
+
+	cfgPath := filepath.Join(dir, "subtrace.yaml")
+	if err := os.WriteFile(cfgPath, []byte(`
+redact:
+  headers: [x-session-token]
+  jsonPaths: [$.user.password]
+  patterns: ["secret=([a-z0-9]+)"]
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.New()
+	if err := cfg.Load(cfgPath); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	got := make(chan *http.Request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		got <- r
+		w.Header().Set("set-cookie", "session=cookie-secret")
+		w.Header().Set("content-type", "text/plain")
+		io.WriteString(w, "token issued: secret=response1secret")
+	}))
+	defer srv.Close()
+
+	g := &global.Global{Config: cfg}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if errno, err := sock.Connect(netip.MustParseAddrPort(srv.Listener.Addr().String()), nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v err=%v", errno, err)
+	}
+	conn := traceeConn(t, sock)
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	const body = `{"user": {"name": "ann", "password": "hunter2"}}`
+	req, _ := http.NewRequest("POST", "http://example.com/login", strings.NewReader(body))
+	req.Header.Set("authorization", "Bearer header-secret")
+	req.Header.Set("x-session-token", "session-secret")
+	req.Header.Set("x-api-key", "key-secret")
+	req.Header.Set("content-type", "application/json")
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	if b, err := io.ReadAll(io.LimitReader(conn, 1)); err != nil || len(b) != 1 {
+		t.Fatalf("read response: %q, err=%v", b, err)
+	}
+
+	r := <-got
+	if r.Header.Get("authorization") != "Bearer header-secret" || r.Header.Get("x-session-token") != "session-secret" {
+		t.Errorf("server got headers %v", r.Header)
+	}
+	if b, _ := io.ReadAll(r.Body); string(b) != body {
+		t.Errorf("server got body %q", b)
+	}
+
+	var lines []tracer.EventLogLine
+	testutil.WaitFor(t, "the event", func() bool { lines = events(); return len(lines) > 0 })
+	line := lines[0]
+	var entry struct {
+		Request struct {
+			Headers []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			} `json:"headers"`
+			PostData struct {
+				Text string `json:"text"`
+			} `json:"postData"`
+		} `json:"request"`
+		Response struct {
+			Content struct {
+				Text []byte `json:"text"`
+			} `json:"content"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(line.Entry, &entry); err != nil {
+		t.Fatalf("decode entry: %v", err)
+	}
+	for _, secret := range []string{"header-secret", "session-secret", "key-secret", "hunter2", "cookie-secret", "response1secret"} {
+		if strings.Contains(string(line.Entry), secret) || strings.Contains(string(entry.Response.Content.Text), secret) {
+			t.Errorf("event contains %q: %s", secret, line.Entry)
+		}
+	}
+	var auth string
+	for _, h := range entry.Request.Headers {
+		if strings.EqualFold(h.Name, "authorization") {
+			auth = h.Value
+		}
+	}
+	if auth != "[redacted]" {
+		t.Errorf("got authorization %q, want [redacted]", auth)
+	}
+	if want := `{"user":{"name":"ann","password":"[redacted]"}}`; entry.Request.PostData.Text != want {
+		t.Errorf("got request body %q, want %q", entry.Request.PostData.Text, want)
+	}
+	if want := "token issued: secret=[redacted]"; string(entry.Response.Content.Text) != want {
+		t.Errorf("got response body %q, want %q", entry.Response.Content.Text, want)
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/tracer"
+)
+
+// maxRequestHeadSize is the largest request head (request line and headers)
+// the rewriter will buffer. Requests with a larger head are forwarded as-is.
+const maxRequestHeadSize = 1 << 20
+
+// rewriteRecord is a single modification made to an outgoing request. It's
+// recorded on the event so that traces show what was actually sent.
+type rewriteRecord struct {
+	Op       string `json:"op"`
+	Name     string `json:"name"`
+	Original string `json:"original,omitempty"`
+	Modified string `json:"modified,omitempty"`
+
+	rule int // index into rewriteResult.rules
+}
+
+// rewriteResult is what the rewriter did to one request.
+type rewriteResult struct {
+	records []rewriteRecord
+	rules   []string // names of the rules that changed the request
+	skipped string   // reason the matching rules were skipped, if any
+
+	verdict *verdictResult // if the request was a verdict candidate
+}
+
+func (r *rewriteResult) setTags(ev *event.Event) {
+	if r == nil {
+		return
+	}
+	if r.verdict != nil {
+		r.verdict.setTags(ev)
+	}
+	if r.skipped != "" {
+		ev.Set("request_rewrite_skipped", r.skipped)
+	}
+	if len(r.records) > 0 {
+		b, err := json.Marshal(r.records)
+		if err == nil {
+			ev.Set("request_rewrites", string(b))
+		}
+	}
+	for i, rule := range r.rules {
+		var changes []string
+		for _, rec := range r.records {
+			if rec.rule == i {
+				changes = append(changes, rec.Op+" "+rec.Name)
+			}
+		}
+		tracer.AddIntervention(ev, tracer.Intervention{Feature: "request_rewrite", Rule: rule, Summary: strings.Join(changes, ", ")})
+	}
+}
+
+// rewrites reports whether the requests of the connection go through the
+// rewriter, which applies the rewrite rules and the verdict webhook.
+func (p *proxy) rewrites() bool {
+	if !p.isOutgoing || p.global == nil || p.global.Config == nil {
+		return false
+	}
+	return p.global.Config.HasRewrites() || p.global.Config.GetVerdicts() != nil
+}
+
+// newRewriter returns a reader that yields the HTTP/1 requests read from r
+// with the configured rewrite rules applied. Only the request line and header
+// lines that a rule touches are changed; everything else, including bodies, is
+// forwarded byte-for-byte. For each request head, one result is sent on
+// results before the head is made available to the reader. Requests that the
+// verdict webhook blocks end the reader with a *blockedError instead, after
+// it's recorded on sig.
+func (p *proxy) newRewriter(r io.Reader, results chan<- *rewriteResult, sig *blockSignal) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(p.rewriteHTTP1(pw, bufio.NewReader(r), results, sig))
+	}()
+	return pr
+}
+
+// blockSignal tells the server->client copy of an HTTP/1 connection about a
+// blocked request. That copy can end while a request is still waiting for its
+// verdict, for example when the server closes the connection because it was
+// idle, so it waits for the verdict before closing the process's side.
+type blockSignal struct {
+	mu       sync.Mutex
+	cond     sync.Cond
+	checking bool
+	blocked  *blockedError
+}
+
+func newBlockSignal() *blockSignal {
+	s := new(blockSignal)
+	s.cond.L = &s.mu
+	return s
+}
+
+// check marks a request as waiting for its verdict.
+func (s *blockSignal) check() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checking = true
+}
+
+// decided ends the check. b is the request if it was blocked, or nil if it's
+// forwarded.
+func (s *blockSignal) decided(b *blockedError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checking = false
+	if b != nil {
+		s.blocked = b
+	}
+	s.cond.Broadcast()
+}
+
+// wait returns the blocked request, if any, once no request is waiting for
+// its verdict.
+func (s *blockSignal) wait() *blockedError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.checking {
+		s.cond.Wait()
+	}
+	return s.blocked
+}
+
+func (p *proxy) rewriteHTTP1(w io.Writer, br *bufio.Reader, results chan<- *rewriteResult, sig *blockSignal) error {
+	for {
+		head, err := readRequestHead(br)
+		if err != nil {
+			if len(head) > 0 {
+				if _, err := w.Write(head); err != nil {
+					return err
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if errors.Is(err, errRequestHeadTooLarge) {
+				_, err = io.Copy(w, br)
+			}
+			return err
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+		if err != nil {
+			// Not something we understand. Get out of the way and let the server
+			// decide what to do with it.
+			if _, err := w.Write(head); err != nil {
+				return err
+			}
+			_, err = io.Copy(w, br)
+			return err
+		}
+
+		// The policy judges the request as the process sent it.
+		sig.check()
+		vr := p.checkVerdict(req)
+		if vr != nil && vr.Verdict == verdictBlock {
+			b := &blockedError{req: req, result: vr}
+			sig.decided(b)
+			return b
+		}
+		sig.decided(nil)
+
+		head, result := p.applyRewrites(head, req)
+		if vr != nil {
+			if result == nil {
+				result = new(rewriteResult)
+			}
+			result.verdict = vr
+		}
+		select {
+		case results <- result:
+		default:
+		}
+		if _, err := w.Write(head); err != nil {
+			return err
+		}
+
+		switch {
+		case req.Method == http.MethodConnect || req.Header.Get("upgrade") != "":
+			// Whatever follows isn't HTTP/1 anymore (or won't be once the server
+			// switches protocols).
+			_, err := io.Copy(w, br)
+			return err
+		case slices.Contains(req.TransferEncoding, "chunked"):
+			if err := copyChunked(w, br); err != nil {
+				return fmt.Errorf("copy chunked body: %w", err)
+			}
+		case req.ContentLength > 0:
+			if _, err := io.CopyN(w, br, req.ContentLength); err != nil {
+				return fmt.Errorf("copy body: %w", err)
+			}
+		}
+	}
+}
+
+var errRequestHeadTooLarge = errors.New("request head too large")
+
+// readRequestHead reads up to and including the empty line that ends the
+// request head. On error, it returns whatever was read so far.
+func readRequestHead(br *bufio.Reader) ([]byte, error) {
+	var head []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		head = append(head, line...)
+		switch {
+		case err == nil:
+		case errors.Is(err, bufio.ErrBufferFull):
+		default:
+			if len(head) > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return head, err
+		}
+		if len(head) > maxRequestHeadSize {
+			return head, errRequestHeadTooLarge
+		}
+		if err == nil && (string(line) == "\r\n" || string(line) == "\n") && len(head) > len(line) {
+			return head, nil
+		}
+	}
+}
+
+// copyChunked copies a chunked body including the trailer section without
+// decoding it.
+func copyChunked(w io.Writer, br *bufio.Reader) error {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+
+		sizeStr, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid chunk size %q", sizeStr)
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(w, br, size+2); err != nil { // chunk data and CRLF
+			return err
+		}
+	}
+
+	for { // trailer section
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+		if line == "\r\n" || line == "\n" {
+			return nil
+		}
+	}
+}
+
+// detectSignature returns a description of the request signing scheme if the
+// request looks signed. Changing anything in a signed request would invalidate
+// the signature, so rewrites are skipped for such requests.
+func detectSignature(req *http.Request) string {
+	switch auth := req.Header.Get("authorization"); {
+	case strings.HasPrefix(auth, "AWS4-HMAC-SHA256"):
+		return "aws sigv4"
+	case strings.HasPrefix(auth, "AWS "):
+		return "aws sigv2"
+	}
+	if req.URL.Query().Has("X-Amz-Signature") {
+		return "aws sigv4 presigned url"
+	}
+	if req.Header.Get("signature-input") != "" {
+		return "http message signature"
+	}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.Contains(lower, "signature") || strings.Contains(lower, "hmac") {
+			return fmt.Sprintf("signature header %s", name)
+		}
+	}
+	return ""
+}
+
+func (p *proxy) applyRewrites(head []byte, req *http.Request) ([]byte, *rewriteResult) {
+	rules := p.global.Config.GetRewrites(req.Host, req.URL.Path)
+	if len(rules) == 0 {
+		return head, nil
+	}
+
+	if sig := detectSignature(req); sig != "" {
+		slog.Debug("skipping request rewrites for signed request", "proxy", p, "host", req.Host, "path", req.URL.Path, "signature", sig)
+		return head, &rewriteResult{skipped: "signed request: " + sig}
+	}
+
+	result := new(rewriteResult)
+	lines := strings.SplitAfter(string(head), "\n")
+	for _, r := range rules {
+		n := len(result.records)
+		lines = p.rewriteHeadLines(lines, r, result)
+		if len(result.records) > n {
+			for i := n; i < len(result.records); i++ {
+				result.records[i].rule = len(result.rules)
+			}
+			result.rules = append(result.rules, r.String())
+		}
+	}
+	return []byte(strings.Join(lines, "")), result
+}
+
+// rewriteHeadLines applies a single rule to the request head split into lines
+// (each including its line terminator). lines[0] is the request line and the
+// last line is the empty line ending the head.
+func (p *proxy) rewriteHeadLines(lines []string, r *config.Rewrite, result *rewriteResult) []string {
+	eol := "\r\n"
+	if !strings.HasSuffix(lines[0], "\r\n") {
+		eol = "\n"
+	}
+
+	redact := func(name, val string) string {
+		if p.global.Config.RedactsHeader(name) {
+			return p.global.Config.SantizeCredential(val)
+		}
+		return val
+	}
+
+	headerName := func(line string) string {
+		name, _, ok := strings.Cut(line, ":")
+		if !ok {
+			return ""
+		}
+		return strings.TrimSpace(name)
+	}
+
+	for _, name := range r.RemoveHeaders {
+		for i := 1; i < len(lines)-1; i++ {
+			if strings.EqualFold(headerName(lines[i]), name) {
+				_, val, _ := strings.Cut(lines[i], ":")
+				result.records = append(result.records, rewriteRecord{Op: "remove-header", Name: name, Original: redact(name, strings.TrimSpace(val))})
+				lines = slices.Delete(lines, i, i+1)
+				i--
+			}
+		}
+	}
+
+	names := make([]string, 0, len(r.SetHeaders))
+	for name := range r.SetHeaders {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		val := r.SetHeaders[name]
+		set := false
+		for i := 1; i < len(lines)-1; i++ {
+			if !strings.EqualFold(headerName(lines[i]), name) {
+				continue
+			}
+			if set {
+				lines = slices.Delete(lines, i, i+1)
+				i--
+				continue
+			}
+			_, orig, _ := strings.Cut(lines[i], ":")
+			lines[i] = name + ": " + val + eol
+			result.records = append(result.records, rewriteRecord{Op: "set-header", Name: name, Original: redact(name, strings.TrimSpace(orig)), Modified: redact(name, val)})
+			set = true
+		}
+		if !set {
+			lines = slices.Insert(lines, len(lines)-1, name+": "+val+eol)
+			result.records = append(result.records, rewriteRecord{Op: "set-header", Name: name, Modified: redact(name, val)})
+		}
+	}
+
+	if len(r.SetQueryParams) > 0 {
+		method, rest, _ := strings.Cut(strings.TrimRight(lines[0], "\r\n"), " ")
+		target, proto, _ := strings.Cut(rest, " ")
+
+		keys := make([]string, 0, len(r.SetQueryParams))
+		for key := range r.SetQueryParams {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			var orig string
+			target, orig = setQueryParam(target, key, r.SetQueryParams[key])
+			result.records = append(result.records, rewriteRecord{Op: "set-query-param", Name: key, Original: orig, Modified: r.SetQueryParams[key]})
+		}
+		lines[0] = method + " " + target + " " + proto + eol
+	}
+
+	return lines
+}
+
+// setQueryParam sets key=val in the request target's query string, replacing
+// all existing values for key, and leaves every other parameter untouched. It
+// returns the new target and the first original value.
+func setQueryParam(target, key, val string) (string, string) {
+	path, query, _ := strings.Cut(target, "?")
+	frag := ""
+	if i := strings.IndexByte(query, '#'); i >= 0 {
+		query, frag = query[:i], query[i:]
+	}
+
+	enc := url.QueryEscape(key) + "=" + url.QueryEscape(val)
+
+	var orig string
+	var found bool
+	var params []string
+	if query != "" {
+		for _, param := range strings.Split(query, "&") {
+			k, v, _ := strings.Cut(param, "=")
+			if uk, err := url.QueryUnescape(k); err == nil && uk == key {
+				if !found {
+					orig, _ = url.QueryUnescape(v)
+					params = append(params, enc)
+					found = true
+				}
+				continue
+			}
+			params = append(params, param)
+		}
+	}
+	if !found {
+		params = append(params, enc)
+	}
+	return path + "?" + strings.Join(params, "&") + frag, orig
+}
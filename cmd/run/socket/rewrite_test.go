@@ -0,0 +1,119 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+)
+
+func newRewriteProxy(t *testing.T, yaml string) *proxy {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	c := new(config.Config)
+	if err := c.Load(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	return &proxy{global: &global.Global{Config: c}, isOutgoing: true}
+}
+
+func rewrite(t *testing.T, p *proxy, in string) (string, []*rewriteResult) {
+	t.Helper()
+
+	results := make(chan *rewriteResult, 16)
+	out, err := io.ReadAll(p.newRewriter(strings.NewReader(in), results, newBlockSignal()))
+	if err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	close(results)
+
+	var ret []*rewriteResult
+	for r := range results {
+		ret = append(ret, r)
+	}
+	return string(out), ret
+}
+
+const rewriteConfig = `
+rewrites:
+  - name: feature-flag
+    match: { host: "*.example.com", path: "/api/*" }
+    setHeaders: { X-Feature: "on" }
+    removeHeaders: [ Authorization ]
+    setQueryParams: { debug: "1" }
+`
+
+func TestRewriteHTTP1(t *testing.T) {
+	p := newRewriteProxy(t, rewriteConfig)
+
+	in := "" +
+		"POST /api/items?a=%20b&debug=0 HTTP/1.1\r\nHost: api.example.com\r\nAuthorization: Bearer secret\r\nX-Feature: off\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n0\r\nX-Trailer: t\r\n\r\n" +
+		"GET /other HTTP/1.1\r\nHost: api.example.com\r\nAuthorization: Bearer keep\r\n\r\n"
+	want := "" +
+		"POST /api/items?a=%20b&debug=1 HTTP/1.1\r\nHost: api.example.com\r\nX-Feature: on\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n0\r\nX-Trailer: t\r\n\r\n" +
+		"GET /other HTTP/1.1\r\nHost: api.example.com\r\nAuthorization: Bearer keep\r\n\r\n"
+
+	got, results := rewrite(t, p, in)
+	if got != want {
+		t.Fatalf("rewritten stream mismatch\ngot:  %q\nwant: %q", got, want)
+	}
+	if len(results) != 2 || results[0] == nil || results[1] != nil {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	for _, rec := range results[0].records {
+		if strings.Contains(rec.Original, "secret") || strings.Contains(rec.Modified, "secret") {
+			t.Errorf("credential leaked into rewrite record: %+v", rec)
+		}
+	}
+
+	ev := event.New()
+	results[0].setTags(ev)
+	want = `[{"feature":"request_rewrite","rule":"feature-flag","summary":"remove-header Authorization, set-header X-Feature, set-query-param debug"}]`
+	if got := ev.Get("interventions"); got != want {
+		t.Errorf("got interventions %s, want %s", got, want)
+	}
+}
+
+func TestRewriteSkipsSignedRequests(t *testing.T) {
+	p := newRewriteProxy(t, rewriteConfig)
+
+	in := "GET /api/x HTTP/1.1\r\nHost: s3.example.com\r\nAuthorization: AWS4-HMAC-SHA256 Credential=x\r\n\r\n"
+	got, results := rewrite(t, p, in)
+	if got != in {
+		t.Fatalf("signed request was modified\ngot:  %q\nwant: %q", got, in)
+	}
+	if len(results) != 1 || results[0] == nil || results[0].skipped == "" {
+		t.Fatalf("expected skip diagnostic, got %+v", results)
+	}
+}
+
+func TestSetQueryParam(t *testing.T) {
+	for _, tt := range []struct {
+		target, key, val string
+		want, orig       string
+	}{
+		{"/", "a", "1", "/?a=1", ""},
+		{"/p?x=1&a=2&a=3", "a", "b c", "/p?x=1&a=b+c", "2"},
+		{"/p?x=%2F", "y", "1", "/p?x=%2F&y=1", ""},
+	} {
+		got, orig := setQueryParam(tt.target, tt.key, tt.val)
+		if got != tt.want || orig != tt.orig {
+			t.Errorf("setQueryParam(%q, %q, %q) = %q, %q; want %q, %q", tt.target, tt.key, tt.val, got, orig, tt.want, tt.orig)
+		}
+	}
+}
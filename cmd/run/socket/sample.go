@@ -0,0 +1,100 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"subtrace.dev/tracer"
+)
+
+// SampleRate is the fraction of proxied connections that are parsed and
+// published, between 0 and 1. The others are still proxied, but only their
+// bytes are copied, and their requests rewritten and checked against verdicts
+// if those are configured. The decision is made once per connection so that every
+// exchange on a kept connection is recorded.
+var SampleRate = 1.0
+
+// SampleSeed is hashed along with the connection's addresses to decide whether
+// it's kept. Tracers with the same rate and seed, such as the ones on both
+// ends of a connection, make the same decision.
+var SampleSeed string
+
+// sampleMetrics counts the connections kept and left out by sampling.
+var sampleMetrics struct {
+	in, out atomic.Uint64
+}
+
+// SampleMetrics is the number of connections sampled in and out so far.
+type SampleMetrics struct {
+	Rate float64 `json:"rate"`
+	In   uint64  `json:"in"`
+	Out  uint64  `json:"out"`
+}
+
+// Sampled returns the sampling metrics.
+func Sampled() SampleMetrics {
+	return SampleMetrics{Rate: SampleRate, In: sampleMetrics.in.Load(), Out: sampleMetrics.out.Load()}
+}
+
+// ServeDebugSampling serves the sampling metrics as JSON.
+func ServeDebugSampling(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(Sampled()); err != nil {
+		slog.Debug("failed to write debug sampling response", "err", err) // not fatal
+	}
+}
+
+// sampleConnection reports whether a connection between the two addresses is
+// kept at the given rate. The order of the addresses doesn't matter.
+func sampleConnection(rate float64, seed, a, b string) bool {
+	switch {
+	case rate >= 1:
+		return true
+	case rate <= 0:
+		return false
+	}
+	if a > b {
+		a, b = b, a
+	}
+	h := sha256.New()
+	for _, s := range []string{seed, a, b} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	sum := h.Sum(nil)
+	return float64(binary.BigEndian.Uint64(sum))/math.Exp2(64) < rate
+}
+
+// sample decides whether the proxy's connection is parsed and published and
+// sets p.unsampled if it isn't. The external connection is the one whose
+// addresses the peer sees too.
+func (p *proxy) sample() bool {
+	if SampleRate >= 1 {
+		return true
+	}
+	a, b := p.externalInfo.Local, p.externalInfo.Remote
+	if a == "" && b == "" {
+		// Unnamed unix domain sockets have no addresses to agree on.
+		a = p.connectionID
+	}
+	if !sampleConnection(SampleRate, SampleSeed, a, b) {
+		sampleMetrics.out.Add(1)
+		p.unsampled = true
+		p.decide(tracer.Decision{Layer: "socket", Verdict: "not_intercepted", Reason: tracer.ReasonSampled, Detail: fmt.Sprintf("-sample %g", SampleRate)}, tracer.CaptureNone)
+		return false
+	}
+	sampleMetrics.in.Add(1)
+	p.tmpl = p.tmpl.Copy()
+	p.tmpl.Set("sample_rate", strconv.FormatFloat(SampleRate, 'g', -1, 64))
+	return true
+}
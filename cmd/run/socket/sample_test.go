@@ -0,0 +1,93 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"subtrace.dev/internal/testutil"
+)
+
+func TestSampleConnection(t *testing.T) {
+	const n = 10000
+	kept := 0
+	for i := range n {
+		a, b := fmt.Sprintf("10.0.0.1:%d", 30000+i), "10.0.0.2:443"
+		keep := sampleConnection(0.25, "seed", a, b)
+		if keep != sampleConnection(0.25, "seed", b, a) {
+			t.Fatalf("%s %s: decision depends on the order of the addresses", a, b)
+		}
+		if keep && !sampleConnection(0.5, "seed", a, b) {
+			t.Fatalf("%s %s: kept at rate 0.25 but not 0.5", a, b)
+		}
+		if keep {
+			kept++
+		}
+	}
+	if kept < n/5 || kept > 3*n/10 {
+		t.Errorf("kept %d of %d connections at rate 0.25", kept, n)
+	}
+
+	differ := false
+	for i := range 100 {
+		a := fmt.Sprintf("10.0.0.1:%d", 30000+i)
+		if sampleConnection(0.5, "seed", a, "10.0.0.2:443") != sampleConnection(0.5, "other", a, "10.0.0.2:443") {
+			differ = true
+		}
+	}
+	if !differ {
+		t.Errorf("the seed doesn't change any decision")
+	}
+	if !sampleConnection(1, "", "a", "b") || sampleConnection(0, "", "a", "b") {
+		t.Errorf("rates 1 and 0 don't keep everything and nothing")
+	}
+}
+
+// TestSampledOut checks that a connection left out by sampling is still
+// proxied but never published.
+func TestSampledOut(t *testing.T) {
+	events := captureEvents(t)
+	prevRate := SampleRate
+	SampleRate = 0
+	t.Cleanup(func() { SampleRate = prevRate })
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	const resp = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 1024)
+		conn.Read(b)
+		io.WriteString(conn, resp)
+	}()
+
+	before := Sampled()
+	_, conn := connectTraced(t, netip.MustParseAddrPort(lis.Addr().String()), nil)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if b, err := io.ReadAll(conn); err != nil || string(b) != resp {
+		t.Fatalf("got response %q, err=%v", b, err)
+	}
+
+	testutil.WaitFor(t, "the sampling decision", func() bool { return Sampled().Out > before.Out })
+	if Sampled().In != before.In {
+		t.Errorf("got metrics %+v, want the connection sampled out", Sampled())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if lines := events(); len(lines) > 0 {
+		t.Errorf("sampled out connection published %d events", len(lines))
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/fd"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/tracer"
+)
+
+// newLoopbackPair returns a connected pair of loopback TCP connections.
+func newLoopbackPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	lis, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+
+	cli, err := net.DialTCP("tcp", nil, lis.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	srv, err := lis.AcceptTCP()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() {
+		cli.Close()
+		srv.Close()
+	})
+	return cli, srv
+}
+
+func rawFD(t *testing.T, conn *net.TCPConn) int {
+	t.Helper()
+
+	f, err := conn.File()
+	if err != nil {
+		t.Fatalf("file: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return int(f.Fd())
+}
+
+// TestSendDifferential checks that (*Socket).Send returns exactly what the
+// same send(2) returns on a socket that isn't traced.
+func TestSendDifferential(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		data     string
+		flags    int
+		shutdown bool
+	}{
+		{name: "empty", data: ""},
+		{name: "data", data: "hello"},
+		{name: "empty dontwait", data: "", flags: unix.MSG_DONTWAIT},
+		{name: "oob", data: "!", flags: unix.MSG_OOB},
+		{name: "empty after shutdown", data: "", shutdown: true},
+		{name: "data after shutdown", data: "x", shutdown: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			run := func(traced bool) (int, syscall.Errno) {
+				cli, _ := newLoopbackPair(t)
+				if tt.shutdown {
+					cli.CloseWrite()
+				}
+				dup, err := unix.Dup(rawFD(t, cli))
+				if err != nil {
+					t.Fatalf("dup: %v", err)
+				}
+
+				if !traced {
+					defer unix.Close(dup)
+					n, err := unix.SendmsgN(dup, []byte(tt.data), nil, nil, tt.flags|unix.MSG_NOSIGNAL)
+					errno, _ := err.(syscall.Errno)
+					return n, errno
+				}
+
+				f := fd.NewFD(dup)
+				defer func() {
+					if f.ClosingIncRef() {
+						defer f.DecRef()
+						f.Lock()
+						unix.Close(f.FD())
+					}
+				}()
+				defer f.DecRef()
+
+				sock := &Socket{Inode: newInode(unix.AF_INET, 0, &ImmutableState{state: StatePassive}), FD: f}
+				return sock.Send([]byte(tt.data), tt.flags)
+			}
+
+			wantN, wantErrno := run(false)
+			gotN, gotErrno := run(true)
+			if gotN != wantN || gotErrno != wantErrno {
+				t.Fatalf("got (%d, %v), want (%d, %v)", gotN, gotErrno, wantN, wantErrno)
+			}
+		})
+	}
+}
+
+func TestOOBInline(t *testing.T) {
+	cli, srv := newLoopbackPair(t)
+	if err := setOOBInline(srv); err != nil {
+		t.Fatalf("set SO_OOBINLINE: %v", err)
+	}
+
+	if _, err := unix.SendmsgN(rawFD(t, cli), []byte("a"), nil, nil, 0); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if _, err := unix.SendmsgN(rawFD(t, cli), []byte("!"), nil, nil, unix.MSG_OOB); err != nil {
+		t.Fatalf("send oob: %v", err)
+	}
+	if _, err := unix.SendmsgN(rawFD(t, cli), []byte("b"), nil, nil, 0); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	srv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(srv, b); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(b) != "a!b" {
+		t.Fatalf("got %q, want urgent byte inline in %q", b, "a!b")
+	}
+}
+
+// TestAccountedWriteEvent checks that the bytes sent through Send, which is
+// what the emulated writev(2), sendmsg(2) and sendmmsg(2) use, end up on the
+// connection event and that bytes the tracee writes directly don't.
+func TestAccountedWriteEvent(t *testing.T) {
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		got <- b
+	}()
+
+	sock, conn := connectTraced(t, netip.MustParseAddrPort(lis.Addr().String()), nil)
+	const sent, direct = "SSH-2.0-OpenSSH_9.6\r\n", "direct"
+	if n, errno := sock.Send([]byte(sent), 0); n != len(sent) || errno != 0 {
+		t.Fatalf("send: got (%d, %v)", n, errno)
+	}
+	if _, err := io.WriteString(conn, direct); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	select {
+	case b := <-got:
+		if string(b) != sent+direct {
+			t.Fatalf("server got %q, want %q", b, sent+direct)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the server")
+	}
+	if n := sock.Inode.Written(); n != uint64(len(sent)) {
+		t.Errorf("got %d bytes accounted, want %d", n, len(sent))
+	}
+	conn.Close()
+	finishProxy(t, sock.Inode.state.Load().connected.proxy, sock)
+
+	var tags map[string]string
+	testutil.WaitFor(t, "the connection event", func() bool {
+		for _, ev := range tracer.RecentConnections() {
+			if ev["connection_accounted_write_bytes"] != "" {
+				tags = ev
+			}
+		}
+		return tags != nil
+	})
+	if want := fmt.Sprintf("%d", len(sent)); tags["connection_accounted_write_bytes"] != want {
+		t.Errorf("got connection_accounted_write_bytes %q, want %q", tags["connection_accounted_write_bytes"], want)
+	}
+}
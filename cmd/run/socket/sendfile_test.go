@@ -0,0 +1,158 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/tracer"
+)
+
+// TestSendfile checks that a response whose body a traced server sends with
+// sendfile(2), as nginx and caddy do for static files, is captured like one
+// sent with write(2): the proxy reads the body off the process's connection
+// in whatever chunks the kernel coalesced it into.
+func TestSendfile(t *testing.T) {
+	const size = 10 << 20
+
+	events := captureEvents(t)
+
+	body := payload(1, size)
+	file, err := os.Create(filepath.Join(t.TempDir(), "static.bin"))
+	if err != nil {
+		t.Fatalf("create file: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(body); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	lis, addr := listenTraced(t, 8)
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	srv, errno, err := lis.Accept(0)
+	if err != nil || errno != 0 {
+		t.Fatalf("accept: errno=%v, err=%v", errno, err)
+	}
+	defer srv.Close()
+	conn := traceeConn(t, srv)
+	if conn == nil {
+		t.FailNow()
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		defer conn.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			served <- fmt.Errorf("read request: %w", err)
+			return
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", size)
+		served <- sendfile(conn.(*net.TCPConn), file, size)
+	}()
+
+	fmt.Fprintf(client, "GET /static.bin HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("got a %d byte body, err=%v, want the file's %d bytes", len(got), err, size)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+
+	var tags map[string]string
+	var entry struct {
+		Response struct {
+			Headers []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			} `json:"headers"`
+			Content struct {
+				Size int    `json:"size"`
+				Text []byte `json:"text"`
+			} `json:"content"`
+		} `json:"response"`
+	}
+	testutil.WaitFor(t, "the response's event", func() bool {
+		for _, line := range events() {
+			if json.Unmarshal(line.Entry, &entry) == nil && len(entry.Response.Headers) > 0 {
+				tags = line.Tags
+				return true
+			}
+		}
+		return false
+	})
+
+	var contentLength string
+	for _, h := range entry.Response.Headers {
+		if strings.EqualFold(h.Name, "content-length") {
+			contentLength = h.Value
+		}
+	}
+	if contentLength != fmt.Sprint(size) {
+		t.Errorf("got content-length %q, want %d", contentLength, size)
+	}
+	text := entry.Response.Content.Text
+	if int64(len(text)) != tracer.PayloadLimitBytes || !bytes.Equal(text, body[:len(text)]) {
+		t.Errorf("got %d bytes of body, want the first %d bytes of the file", len(text), tracer.PayloadLimitBytes)
+	}
+	if tags["response_body_incomplete"] != "" {
+		t.Errorf("body reported incomplete: declared %s, got %s", tags["response_body_declared_bytes"], tags["response_body_actual_bytes"])
+	}
+	if !strings.Contains(tags["capture_decisions"], tracer.ReasonPayloadLimit) {
+		t.Errorf("got decisions %q, want the body truncated at the payload limit", tags["capture_decisions"])
+	}
+}
+
+// sendfile sends n bytes of f on conn with sendfile(2) directly, which is what
+// (*net.TCPConn).ReadFrom does too but without falling back to copying.
+func sendfile(conn *net.TCPConn, f *os.File, n int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("syscall conn: %w", err)
+	}
+	var offset int64
+	var serr error
+	err = raw.Write(func(fd uintptr) bool {
+		for offset < int64(n) {
+			_, serr = syscall.Sendfile(int(fd), int(f.Fd()), &offset, n-int(offset))
+			switch serr {
+			case nil:
+			case syscall.EAGAIN:
+				return false // wait until the socket is writable
+			case syscall.EINTR:
+			default:
+				return true
+			}
+		}
+		serr = nil
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if serr != nil {
+		return fmt.Errorf("sendfile: %w", serr)
+	}
+	return nil
+}
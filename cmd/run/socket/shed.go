@@ -0,0 +1,411 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"subtrace.dev/tracer"
+)
+
+// What the parser of a connection spends its work on, as set in the
+// parser_shed_pattern tag of the event of a shed connection.
+const (
+	shedReads    = iota // reads handed to the parser, e.g. a body dribbled a byte at a time
+	shedFrames          // HTTP/2 frames, e.g. a flood of PINGs or empty DATA frames
+	shedHeaders         // header fields, e.g. an HPACK bomb
+	shedMessages        // requests and responses
+	shedBacklog         // none: the parser fell behind the copy by more than a tap holds
+	numShedPatterns
+)
+
+var shedPatterns = [numShedPatterns]string{"reads", "frames", "headers", "messages", "backlog"}
+
+// Parser work is counted in steps. What a step is worth is only meaningful
+// relative to the other weights: a large transfer costs a step per read or
+// DATA frame, which carries kilobytes, while the patterns above cost steps for
+// a handful of bytes each.
+const (
+	stepsPerRead      = 8
+	stepsPerFrame     = 8
+	stepsPerControl   = 96 // frames that carry no payload
+	stepsPerField     = 1
+	fieldBytesPerStep = 64 // of decoded header fields
+	stepsPerMessage   = 8
+)
+
+// A connection is shed once its parser does more than shedStepsPerByte steps
+// per byte fed to it within a shedWindow, but only after the first shedBurst
+// steps of the window, so that short bursts and slow connections never are.
+// They're variables so that tests can lower them, and a budget keeps the ones
+// it started with.
+var (
+	shedWindow       = time.Second
+	shedBurst        = int64(16384)
+	shedStepsPerByte = int64(4)
+)
+
+// errParserShed is what the parser of a shed connection reads.
+var errParserShed = errors.New("parser shed")
+
+// parseBudget bounds the work the parsers of a connection do per byte. Once
+// it's exceeded, the connection is shed: it isn't parsed for the rest of its
+// life, only forwarded and counted.
+type parseBudget struct {
+	shed   atomic.Bool
+	onShed func(shedReport)
+
+	window       time.Duration
+	burst        int64
+	stepsPerByte int64
+
+	mu    sync.Mutex
+	start time.Time
+	bytes int64
+	steps [numShedPatterns]int64
+}
+
+// shedReport is what the window that exceeded a budget was spent on.
+type shedReport struct {
+	pattern int // that cost the most steps
+	steps   int64
+	bytes   int64
+}
+
+func newParseBudget(onShed func(shedReport)) *parseBudget {
+	return &parseBudget{
+		onShed:       onShed,
+		window:       shedWindow,
+		burst:        shedBurst,
+		stepsPerByte: shedStepsPerByte,
+		start:        time.Now(),
+	}
+}
+
+// charge adds steps of work on pattern and the bytes they parsed. It reports
+// whether the connection is still parsed, calling onShed once if this is what
+// exceeded the budget.
+func (b *parseBudget) charge(pattern int, steps int, bytes int) bool {
+	if b.shed.Load() {
+		return false
+	}
+
+	b.mu.Lock()
+	if now := time.Now(); now.Sub(b.start) >= b.window {
+		b.start, b.bytes, b.steps = now, 0, [numShedPatterns]int64{}
+	}
+	b.bytes += int64(bytes)
+	b.steps[pattern] += int64(steps)
+
+	var total int64
+	top := 0
+	for i, n := range b.steps {
+		total += n
+		if n > b.steps[top] {
+			top = i
+		}
+	}
+	if total <= b.burst || total <= b.bytes*b.stepsPerByte {
+		b.mu.Unlock()
+		return true
+	}
+	r := shedReport{pattern: top, steps: total, bytes: b.bytes}
+	b.mu.Unlock()
+
+	if b.shed.CompareAndSwap(false, true) && b.onShed != nil {
+		b.onShed(r)
+	}
+	return false
+}
+
+// fallBehind sheds the connection because its parser stopped keeping up with
+// the copy, however little work it did.
+func (b *parseBudget) fallBehind() {
+	b.mu.Lock()
+	r := shedReport{pattern: shedBacklog, bytes: b.bytes}
+	for _, n := range b.steps {
+		r.steps += n
+	}
+	b.mu.Unlock()
+
+	if b.shed.CompareAndSwap(false, true) && b.onShed != nil {
+		b.onShed(r)
+	}
+}
+
+// http2FrameHeaderLen is the length of the header every HTTP/2 frame starts
+// with, which http2.FrameHeader.Length doesn't count.
+const http2FrameHeaderLen = 9
+
+// frameSteps returns what parsing fr costs. Frames without a payload cost a
+// lot more per byte than the rest because that's what floods of them are made
+// of.
+func frameSteps(fr http2.Frame) int {
+	switch fr := fr.(type) {
+	case *http2.DataFrame:
+		if len(fr.Data()) > 0 {
+			return stepsPerFrame
+		}
+	case *http2.HeadersFrame:
+		if len(fr.HeaderBlockFragment()) > 0 {
+			return stepsPerFrame
+		}
+	case *http2.ContinuationFrame:
+		if len(fr.HeaderBlockFragment()) > 0 {
+			return stepsPerFrame
+		}
+	case *http2.PushPromiseFrame, *http2.GoAwayFrame:
+		return stepsPerFrame
+	}
+	return stepsPerControl
+}
+
+// fieldSteps returns what decoding a header field costs.
+func fieldSteps(name, value string) int {
+	return stepsPerField + (len(name)+len(value))/fieldBytesPerStep
+}
+
+// Writes to a tap never wait for the parser as long as it's less than
+// maxTapBacklog bytes behind, and past that for at most tapStallTimeout
+// before the connection is shed. The parser of an HTTP/1 connection reads the
+// request and the response in turn, so without that a pipelined request would
+// stop the copy to the server until the response before it ended, which is a
+// deadlock if the server reads ahead. They're variables so that tests can
+// lower them.
+var (
+	maxTapBacklog   = 1 << 20
+	tapStallTimeout = time.Second
+)
+
+// maxTapSpare is the most memory a tap keeps for reuse once it's empty.
+const maxTapSpare = 64 << 10
+
+// errTapBacklog is what a write to a tap returns once the parser has been
+// behind for too long.
+var errTapBacklog = errors.New("parser backlog full")
+
+// tapPipe is an in-memory pipe like io.Pipe, except that writes are queued
+// instead of waiting for the reader (see maxTapBacklog).
+type tapPipe struct {
+	mu      sync.Mutex
+	buf     []byte
+	spare   []byte        // the memory of buf to reuse once it's empty, see Write
+	rerr    error         // returned by Read once buf is empty, set by CloseWrite
+	werr    error         // returned by Write, set by CloseRead
+	changed chan struct{} // closed and replaced whenever any of the above change
+}
+
+func newTapPipe() *tapPipe {
+	return &tapPipe{changed: make(chan struct{})}
+}
+
+// notify wakes up whoever waits for the pipe. p.mu must be held.
+func (p *tapPipe) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *tapPipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	for len(p.buf) == 0 && p.rerr == nil {
+		changed := p.changed
+		p.mu.Unlock()
+		<-changed
+		p.mu.Lock()
+	}
+	defer p.mu.Unlock()
+	if len(p.buf) == 0 {
+		return 0, p.rerr
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	if len(p.buf) == 0 {
+		p.buf = nil // don't hold on to the memory of a burst, see Write
+	}
+	p.notify()
+	return n, nil
+}
+
+// Write queues b for the reader. If the reader is more than maxTapBacklog
+// bytes behind, it waits up to tapStallTimeout for it to catch up and fails
+// with errTapBacklog if it doesn't.
+func (p *tapPipe) Write(b []byte) (int, error) {
+	var timeout <-chan time.Time
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		switch {
+		case p.werr != nil:
+			return 0, p.werr
+		case p.rerr != nil:
+			return 0, io.ErrClosedPipe
+		case len(p.buf) == 0 || len(p.buf)+len(b) <= maxTapBacklog:
+			if len(p.buf) == 0 {
+				// The reader has caught up, which is most of the time, so
+				// the same memory can take every write. Only memory of up to
+				// maxTapSpare bytes is kept so that a burst doesn't hold on
+				// to all of its memory for the rest of the connection.
+				p.buf = append(p.spare[:0], b...)
+				if cap(p.buf) <= maxTapSpare {
+					p.spare = p.buf
+				}
+			} else {
+				p.buf = append(p.buf, b...)
+			}
+			p.notify()
+			return len(b), nil
+		}
+
+		if timeout == nil {
+			t := time.NewTimer(tapStallTimeout)
+			defer t.Stop()
+			timeout = t.C
+		}
+		changed := p.changed
+		p.mu.Unlock()
+		select {
+		case <-changed:
+			p.mu.Lock()
+		case <-timeout:
+			p.mu.Lock()
+			return 0, errTapBacklog
+		}
+	}
+}
+
+// CloseWrite closes the writing side. The reader gets what's queued and then
+// io.EOF if err is nil, or err right away otherwise.
+func (p *tapPipe) CloseWrite(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rerr != nil {
+		return
+	}
+	if err == nil {
+		err = io.EOF
+	} else {
+		p.buf, p.spare = nil, nil
+	}
+	p.rerr = err
+	p.notify()
+}
+
+// CloseRead closes the reading side, after which writes fail with err, or
+// io.ErrClosedPipe if it's nil.
+func (p *tapPipe) CloseRead(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.werr != nil {
+		return
+	}
+	p.werr = cmp.Or(err, io.ErrClosedPipe)
+	p.buf, p.spare = nil, nil
+	p.notify()
+}
+
+// shedTap is what one direction of an HTTP/1 connection is copied into for its
+// parser. It charges every write to the connection's budget and passes it to
+// the parser until the connection is shed. From then on the parser reads
+// errParserShed and the copy goes on without it, even if the parser closed
+// the pipe. A parser that falls too far behind sheds the connection too.
+type shedTap struct {
+	budget *parseBudget
+	w      *tapPipe
+	once   sync.Once
+}
+
+func (t *shedTap) Write(b []byte) (int, error) {
+	if t.budget.charge(shedReads, stepsPerRead, len(b)) {
+		n, err := t.w.Write(b)
+		if errors.Is(err, errTapBacklog) {
+			t.budget.fallBehind()
+		}
+		if err == nil || !t.budget.shed.Load() {
+			return n, err
+		}
+	}
+	t.once.Do(func() { t.w.CloseWrite(errParserShed) })
+	return len(b), nil
+}
+
+// shedMetrics counts the connections shed across all proxies.
+var shedMetrics struct {
+	shed      atomic.Uint64
+	byPattern [numShedPatterns]atomic.Uint64
+}
+
+// ParserMetrics is a snapshot of how many connections were shed, in total and
+// by the pattern that cost their parser the most.
+type ParserMetrics struct {
+	Shed      uint64            `json:"shed"`
+	ByPattern map[string]uint64 `json:"byPattern"`
+}
+
+// Parser returns the current parser metrics.
+func Parser() ParserMetrics {
+	m := ParserMetrics{Shed: shedMetrics.shed.Load(), ByPattern: make(map[string]uint64)}
+	for i, name := range shedPatterns {
+		m.ByPattern[name] = shedMetrics.byPattern[i].Load()
+	}
+	return m
+}
+
+// ServeDebugParser serves the parser metrics as JSON.
+func ServeDebugParser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(Parser()); err != nil {
+		slog.Debug("failed to write debug parser response", "err", err) // not fatal
+	}
+}
+
+// newParseBudget returns the budget of the connection's parsers. Shedding it
+// counts the connection in the metrics and publishes a connection event that
+// says why.
+func (p *proxy) newParseBudget(proto string) *parseBudget {
+	return newParseBudget(func(r shedReport) {
+		shedMetrics.shed.Add(1)
+		shedMetrics.byPattern[r.pattern].Add(1)
+		slog.Debug("proxy: shedding parser", "proxy", p, "proto", proto, "pattern", shedPatterns[r.pattern], "steps", r.steps, "bytes", r.bytes)
+		p.publishShed(proto, r)
+	})
+}
+
+// shedDecision is recorded by the protocol handler of a shed connection once
+// it's done, since only it may change p.tmpl.
+func shedDecision(proto string) tracer.Decision {
+	return tracer.Decision{Layer: "protocol", Verdict: "shed", Reason: tracer.ReasonParserShed, Detail: proto}
+}
+
+// publishShed publishes a connection event for a connection that's shed, with
+// what its parser was spending the work on.
+func (p *proxy) publishShed(proto string, r shedReport) {
+	if p.global == nil || p.global.Config == nil {
+		return
+	}
+
+	ev := p.tmpl.Copy()
+	p.setDestinationTags(ev, "")
+	tracer.AddDecision(ev, shedDecision(proto), tracer.CaptureNone)
+	ev.Set("parser_shed_pattern", shedPatterns[r.pattern])
+	ev.Set("parser_shed_steps", fmt.Sprintf("%d", r.steps))
+	ev.Set("parser_shed_bytes", fmt.Sprintf("%d", r.bytes))
+	ev.Set("parser_shed_steps_per_byte", fmt.Sprintf("%.1f", float64(r.steps)/float64(max(r.bytes, 1))))
+
+	b := p.bandwidth()
+	dir := "from"
+	if p.isOutgoing {
+		dir = "to"
+	}
+	go tracer.PublishConnection(p.global, ev, fmt.Sprintf("connection %s %s shed to byte counting (%s %s)", dir, b.Host, proto, shedPatterns[r.pattern]))
+}
@@ -0,0 +1,370 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/tracer"
+)
+
+// TestParseBudget charges the budget with what the parsers of some ordinary
+// and some pathological connections cost and checks that only the latter are
+// shed, each because of the pattern it's made of.
+func TestParseBudget(t *testing.T) {
+	// read returns the frame that write writes.
+	read := func(write func(*http2.Framer) error) http2.Frame {
+		var buf bytes.Buffer
+		if err := write(http2.NewFramer(&buf, nil)); err != nil {
+			t.Fatalf("write frame: %v", err)
+		}
+		fr, err := http2.NewFramer(nil, &buf).ReadFrame()
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		return fr
+	}
+	data := func(n int) http2.Frame {
+		return read(func(fr *http2.Framer) error { return fr.WriteData(1, false, make([]byte, n)) })
+	}
+	ping := read(func(fr *http2.Framer) error { return fr.WritePing(false, [8]byte{}) })
+	frame := func(b *parseBudget, fr http2.Frame, n int) bool {
+		return b.charge(shedFrames, frameSteps(fr), http2FrameHeaderLen+n)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		repeat  int
+		charge  func(b *parseBudget) bool
+		pattern string // empty if it mustn't be shed
+	}{
+		{"http/1 large transfer", 1 << 15, func(b *parseBudget) bool {
+			return b.charge(shedReads, stepsPerRead, 32<<10)
+		}, ""},
+		{"http/1 large transfer in segments", 1 << 16, func(b *parseBudget) bool {
+			return b.charge(shedReads, stepsPerRead, 1448)
+		}, ""},
+		{"http/1 health checks", 5000, func(b *parseBudget) bool {
+			return b.charge(shedReads, stepsPerRead, len("GET /healthz HTTP/1.1\r\nHost: x\r\n\r\n")) &&
+				b.charge(shedMessages, stepsPerMessage+stepsPerField, 0) &&
+				b.charge(shedReads, stepsPerRead, len("HTTP/1.1 204 No Content\r\n\r\n")) &&
+				b.charge(shedMessages, stepsPerMessage, 0)
+		}, ""},
+		{"http/2 large transfer", 1 << 16, func(b *parseBudget) bool {
+			return frame(b, data(16<<10), 16<<10)
+		}, ""},
+		{"grpc unary calls", 5000, func(b *parseBudget) bool {
+			ok := true
+			for _, n := range []int{60, 20, 8, 8, 30, 20, 10} { // HEADERS, DATA, PING, PING ack, HEADERS, DATA, trailers
+				fr := data(n)
+				if n == 8 {
+					fr = ping
+				}
+				ok = ok && frame(b, fr, n)
+			}
+			for range 12 {
+				ok = ok && b.charge(shedHeaders, fieldSteps("content-type", "application/grpc"), 0)
+			}
+			return ok && b.charge(shedMessages, stepsPerMessage, 0) && b.charge(shedMessages, stepsPerMessage, 0)
+		}, ""},
+		{"dribbled body", 1 << 14, func(b *parseBudget) bool {
+			return b.charge(shedReads, stepsPerRead, 1)
+		}, "reads"},
+		{"ping flood", 1 << 14, func(b *parseBudget) bool {
+			return frame(b, ping, 8)
+		}, "frames"},
+		{"empty data frames", 1 << 14, func(b *parseBudget) bool {
+			return frame(b, data(0), 0)
+		}, "frames"},
+		{"hpack bomb", 1 << 14, func(b *parseBudget) bool {
+			return frame(b, data(1), 1) && b.charge(shedHeaders, fieldSteps("x-bomb", strings.Repeat("v", 4000)), 0)
+		}, "headers"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var shed []shedReport
+			b := newParseBudget(func(r shedReport) { shed = append(shed, r) })
+			ok := true
+			for i := 0; i < tt.repeat && ok; i++ {
+				ok = tt.charge(b)
+			}
+			switch {
+			case tt.pattern == "" && !ok:
+				t.Fatalf("shed after %+v", shed)
+			case tt.pattern == "":
+			case ok:
+				t.Fatalf("not shed")
+			case len(shed) != 1 || shedPatterns[shed[0].pattern] != tt.pattern:
+				t.Fatalf("got %+v, want to be shed once for %s", shed, tt.pattern)
+			case b.charge(shedReads, stepsPerRead, 1<<20):
+				t.Fatalf("parsed again after being shed")
+			}
+		})
+	}
+}
+
+func FuzzParseBudget(f *testing.F) {
+	f.Add([]byte{0, 8, 0, 1, 1, 96, 0, 0})
+	f.Add(bytes.Repeat([]byte{2, 255, 0, 0}, 100))
+	f.Add(bytes.Repeat([]byte{0, 8, 128, 0, 3, 8, 0, 0}, 1000))
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		prev := shedWindow
+		shedWindow = time.Hour
+		defer func() { shedWindow = prev }()
+
+		var shed []shedReport
+		b := newParseBudget(func(r shedReport) { shed = append(shed, r) })
+		var steps, bytes int64
+		var wasShed bool
+		for ; len(ops) >= 4; ops = ops[4:] {
+			pattern := int(ops[0]) % numShedPatterns
+			n := int(ops[1])
+			m := int(binary.BigEndian.Uint16(ops[2:]))
+			steps, bytes = steps+int64(n), bytes+int64(m)
+
+			ok := b.charge(pattern, n, m)
+			switch {
+			case wasShed && ok:
+				t.Fatalf("parsed again after being shed")
+			case !ok && !wasShed && (steps <= shedBurst || steps <= bytes*shedStepsPerByte):
+				t.Fatalf("shed at %d steps for %d bytes", steps, bytes)
+			case ok && steps > shedBurst && steps > bytes*shedStepsPerByte:
+				t.Fatalf("not shed at %d steps for %d bytes", steps, bytes)
+			}
+			wasShed = !ok
+		}
+		if want := map[bool]int{true: 1}[wasShed]; len(shed) != want {
+			t.Fatalf("shed %d times", len(shed))
+		}
+		if wasShed && (shed[0].steps <= shedBurst || shed[0].steps <= shed[0].bytes*shedStepsPerByte) {
+			t.Fatalf("got report %+v", shed[0])
+		}
+	})
+}
+
+// shedEvent waits for the connection event of a connection shed because of
+// pattern and returns its tags.
+func shedEvent(t *testing.T, pattern string) map[string]string {
+	t.Helper()
+	var tags map[string]string
+	testutil.WaitFor(t, "the shed event", func() bool {
+		for _, ev := range tracer.RecentConnections() {
+			if ev["parser_shed_pattern"] == pattern {
+				tags = ev
+			}
+		}
+		return tags != nil
+	})
+	return tags
+}
+
+// TestShedDribbledBody dribbles a chunked request body a byte at a time
+// through a traced socket. The connection is shed, and both that request and
+// the next one must still get to the server unchanged.
+func TestShedDribbledBody(t *testing.T) {
+	prev := shedBurst
+	shedBurst = 256
+	t.Cleanup(func() { shedBurst = prev })
+
+	events := captureEvents(t)
+
+	head := "POST /dribble HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n"
+	body := strings.Repeat("1\r\nx\r\n", 200) + "0\r\n\r\n"
+	next := "GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	const resp = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	got := make(chan []byte, 2)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, req := range []string{head + body, next} {
+			b := make([]byte, len(req))
+			n, _ := io.ReadFull(conn, b)
+			got <- b[:n]
+			io.WriteString(conn, resp)
+		}
+	}()
+
+	before := Parser().ByPattern["reads"]
+	sock, conn := dialTraced(t, netip.MustParseAddrPort(lis.Addr().String()))
+	if conn == nil {
+		t.FailNow()
+	}
+	defer sock.Close()
+	defer conn.Close()
+
+	io.WriteString(conn, head)
+	for i := range len(body) {
+		conn.Write([]byte{body[i]})
+		time.Sleep(time.Millisecond)
+	}
+	for _, req := range []string{head + body, next} {
+		if req == next {
+			io.WriteString(conn, next)
+		}
+		select {
+		case b := <-got:
+			if string(b) != req {
+				t.Fatalf("server got %q, want %q", b, req)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for the server")
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if b, err := io.ReadAll(io.LimitReader(conn, int64(len(resp)))); err != nil || string(b) != resp {
+			t.Fatalf("got response %q, err=%v", b, err)
+		}
+	}
+
+	tags := shedEvent(t, "reads")
+	if tags["capture_level"] != tracer.CaptureNone || tags["capture_reason"] != tracer.ReasonParserShed {
+		t.Errorf("got capture level %q reason %q", tags["capture_level"], tags["capture_reason"])
+	}
+	if Parser().ByPattern["reads"] <= before {
+		t.Errorf("shed counter not incremented: %+v", Parser())
+	}
+	if lines := events(); len(lines) > 0 {
+		t.Errorf("got %d events for a shed connection", len(lines))
+	}
+}
+
+// TestShedHPACKBomb sends a header block that references a large entry of
+// the dynamic table thousands of times through a traced socket. The
+// connection is shed and everything sent, including a request after it, must
+// reach the server as it was sent.
+func TestShedHPACKBomb(t *testing.T) {
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		got <- b
+	}()
+
+	before := Parser().ByPattern["headers"]
+	sock, conn := dialTraced(t, netip.MustParseAddrPort(lis.Addr().String()))
+	if conn == nil {
+		t.FailNow()
+	}
+	defer sock.Close()
+	defer conn.Close()
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, hdr := range [][2]string{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "example.com"}, {"x-bomb", strings.Repeat("v", 3900)}} {
+		enc.WriteField(hpack.HeaderField{Name: hdr[0], Value: hdr[1]})
+	}
+	block.Write(bytes.Repeat([]byte{0x80 | 62}, 8000)) // the x-bomb entry, the newest in the table
+
+	var sent bytes.Buffer
+	sent.WriteString(http2.ClientPreface)
+	fr := http2.NewFramer(&sent, nil)
+	fr.WriteSettings()
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndStream: true, EndHeaders: true})
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: []byte{0x82, 0x86, 0x84, 0xbf}, EndStream: true, EndHeaders: true})
+	fr.WritePing(false, [8]byte{})
+
+	if _, err := conn.Write(sent.Bytes()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+	select {
+	case b := <-got:
+		if !bytes.Equal(b, sent.Bytes()) {
+			t.Fatalf("server got %d bytes, want the %d bytes sent", len(b), sent.Len())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for the server")
+	}
+
+	tags := shedEvent(t, "headers")
+	if tags["capture_reason"] != tracer.ReasonParserShed || tags["parser_shed_steps"] == "" {
+		t.Errorf("got tags %v", tags)
+	}
+	if Parser().ByPattern["headers"] <= before {
+		t.Errorf("shed counter not incremented: %+v", Parser())
+	}
+}
+
+// TestShedLargeTransfer uploads and downloads a large body through a traced
+// socket, which must be parsed all the way.
+func TestShedLargeTransfer(t *testing.T) {
+	events := captureEvents(t)
+
+	const size = 32 << 20
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		w.Header().Set("content-type", "application/octet-stream")
+		io.CopyN(w, zeros{}, n)
+	}))
+	defer upstream.Close()
+
+	before := Parser().Shed
+	sock, conn := dialTraced(t, netip.MustParseAddrPort(upstream.Listener.Addr().String()))
+	if conn == nil {
+		t.FailNow()
+	}
+	defer sock.Close()
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", size)
+	go io.CopyN(conn, zeros{}, size)
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if n, err := io.Copy(io.Discard, resp.Body); err != nil || n != size {
+		t.Fatalf("got %d bytes, err=%v", n, err)
+	}
+
+	var lines []tracer.EventLogLine
+	testutil.WaitFor(t, "the event", func() bool { lines = events(); return len(lines) > 0 })
+	line := lines[0]
+	var entry har.Entry
+	if err := json.Unmarshal(line.Entry, &entry); err != nil || entry.Response == nil || entry.Response.Status != http.StatusOK {
+		t.Fatalf("got entry %s, err=%v", line.Entry, err)
+	}
+	if Parser().Shed != before {
+		t.Errorf("shed: %+v", Parser())
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+)
+
+// TestShutdownHalfClose checks that a client can signal the end of its request
+// with shutdown(SHUT_WR) and still read the response, like `nc -N` does.
+func TestShutdownHalfClose(t *testing.T) {
+	for _, tt := range []struct {
+		name, req, resp string
+	}{
+		{name: "raw", req: "COPY 1\n", resp: "OK\n"},
+		{name: "http/1", req: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", resp: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The server only answers once it has read the whole request, which ends
+			// with the client's FIN.
+			lis, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			defer lis.Close()
+			got := make(chan string, 1)
+			go func() {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				b, _ := io.ReadAll(conn)
+				got <- string(b)
+				io.WriteString(conn, tt.resp)
+			}()
+
+			g := &global.Global{Config: config.New()}
+			sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+			if err != nil {
+				t.Fatalf("create socket: %v", err)
+			}
+			defer sock.Close()
+			if errno, err := sock.Connect(netip.MustParseAddrPort(lis.Addr().String()), nil); err != nil || errno != 0 {
+				t.Fatalf("connect: errno=%v err=%v", errno, err)
+			}
+
+			if n, errno := sock.Send([]byte(tt.req), 0); errno != 0 || n != len(tt.req) {
+				t.Fatalf("send: n=%d, errno=%v", n, errno)
+			}
+			// The handler leaves the shutdown itself to the kernel.
+			if errno, err := sock.Shutdown(unix.SHUT_WR); err != nil || errno != 0 {
+				t.Fatalf("shutdown: errno=%v err=%v", errno, err)
+			}
+			if err := unix.Shutdown(sock.FD.FD(), unix.SHUT_WR); err != nil {
+				t.Fatalf("shutdown(2): %v", err)
+			}
+			if _, errno := sock.Send([]byte("x"), 0); errno != unix.EPIPE {
+				t.Errorf("send after shutdown: got errno=%v, want EPIPE", errno)
+			}
+			if got := sock.Inode.Info().Shutdown; got != "write" {
+				t.Errorf("got shutdown %q, want write", got)
+			}
+
+			select {
+			case req := <-got:
+				if req != tt.req {
+					t.Errorf("server got %q, want %q", req, tt.req)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("server didn't see the end of the request")
+			}
+
+			tv := unix.NsecToTimeval((5 * time.Second).Nanoseconds())
+			if err := unix.SetsockoptTimeval(sock.FD.FD(), unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+				t.Fatalf("set SO_RCVTIMEO: %v", err)
+			}
+			var resp []byte
+			buf := make([]byte, 64)
+			for {
+				n, err := unix.Read(sock.FD.FD(), buf)
+				if err != nil {
+					t.Fatalf("read response: %v", err)
+				}
+				if n == 0 {
+					break
+				}
+				resp = append(resp, buf[:n]...)
+			}
+			if string(resp) != tt.resp {
+				t.Errorf("got response %q, want %q", resp, tt.resp)
+			}
+		})
+	}
+}
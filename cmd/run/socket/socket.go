@@ -18,6 +18,7 @@ import (
 	"subtrace.dev/cmd/run/fd"
 	"subtrace.dev/event"
 	"subtrace.dev/global"
+	"subtrace.dev/tracer"
 )
 
 type Socket struct {
@@ -35,7 +36,17 @@ func NewSocket(global *global.Global, tmpl *event.Event, inode *Inode, fd *fd.FD
 }
 
 func CreateSocket(global *global.Global, tmpl *event.Event, domain int, typ int) (*Socket, error) {
-	if domain != unix.AF_INET && domain != unix.AF_INET6 {
+	return CreateSocketInNetns(global, tmpl, domain, typ, nil)
+}
+
+// CreateSocketInNetns is CreateSocket for a process in the network namespace
+// ns. The socket is created there, and so are the sockets that connect(2) and
+// listen(2) on it use to proxy it.
+func CreateSocketInNetns(global *global.Global, tmpl *event.Event, domain int, typ int, ns *Netns) (*Socket, error) {
+	switch {
+	case domain == unix.AF_INET || domain == unix.AF_INET6:
+	case domain == unix.AF_UNIX && !isDatagramType(typ):
+	default:
 		return nil, fmt.Errorf("unsupported domain 0x%x", domain)
 	}
 
@@ -45,7 +56,16 @@ func CreateSocket(global *global.Global, tmpl *event.Event, domain int, typ int)
 	// CLOEXEC flag will be set so that the target's expectation is satisfied.
 	typ |= unix.SOCK_CLOEXEC
 
-	ret, err := unix.Socket(domain, typ, unix.IPPROTO_TCP)
+	protocol := unix.IPPROTO_TCP
+	switch {
+	case domain == unix.AF_UNIX:
+		protocol = 0
+	case isDatagramType(typ):
+		protocol = unix.IPPROTO_UDP
+	}
+	ret, err := enterNetns(ns, func() (int, error) {
+		return unix.Socket(domain, typ, protocol)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("socket syscall: %w", err)
 	}
@@ -60,7 +80,12 @@ func CreateSocket(global *global.Global, tmpl *event.Event, domain int, typ int)
 	defer fd.DecRef()
 
 	state := &ImmutableState{state: StatePassive}
-	sock := NewSocket(global, tmpl, newInode(domain, stat.Ino, state), fd)
+	inode := newInode(domain, stat.Ino, state)
+	inode.netns = ns
+	if isDatagramType(typ) {
+		inode.flow = new(datagramFlow)
+	}
+	sock := NewSocket(global, tmpl, inode, fd)
 	slog.Debug("created socket", "method", "new", "sock", sock)
 
 	return sock, nil
@@ -73,96 +98,146 @@ func (s *Socket) LogValue() slog.Value {
 	}...)
 }
 
-func (s *Socket) Connect(addr netip.AddrPort) (syscall.Errno, error) {
+// Connect connects the socket to addr. If CollapseLoopback is set and addr is
+// a listener in itab, the connection is only captured here and not again when
+// the listener accepts it. itab may be nil.
+func (s *Socket) Connect(addr netip.AddrPort, itab *InodeTable) (syscall.Errno, error) {
 	if !s.FD.IncRef() {
 		return unix.EBADF, nil
 	}
 	defer s.FD.DecRef()
 
-	prev := s.Inode.state.Load()
-	switch prev.state {
-	case StatePassive:
-		break
-	case StateConnected:
-		return unix.EISCONN, nil
-	case StateConnecting:
-		flags, err := unix.FcntlInt(uintptr(s.FD.FD()), unix.F_GETFL, 0)
-		if err != nil {
-			return 0, fmt.Errorf("fcntl: %w", err)
-		}
-		if isBlocking := flags&unix.O_NONBLOCK == 0; isBlocking {
-			// TODO: can this even happen? If the socket is a blocking socket, how
-			// can it ever end up in the connecting state? The connect(2) manpage
-			// doesn't prescribe any explicit behavior.
+	// Claim the socket by moving it to StateConnecting before doing anything
+	// expensive. If two threads race connect(2) on the same socket, only one of
+	// them wins the CAS and dials. The other sees the socket as connecting and
+	// gets EALREADY, which is what Linux returns in that case.
+	var prev, mid *ImmutableState
+	for {
+		prev = s.Inode.state.Load()
+		switch prev.state {
+		case StatePassive:
+			break
+		case StateConnected:
+			return unix.EISCONN, nil
+		case StateConnecting:
 			return unix.EALREADY, nil
-		} else {
-			return unix.EINPROGRESS, nil
+		case StateListening:
+			return unix.EINVAL, nil // TODO: what does linux say if you try to connect a listening socket?
+		case StateClosed:
+			return unix.EBADF, nil
+		}
+
+		mid = &ImmutableState{state: StateConnecting}
+		mid.connecting.bind = prev.passive.bind
+		mid.connecting.peer = addr
+		if s.Inode.casState(prev, mid, "connect", 0) {
+			break
 		}
-	case StateListening:
-		return unix.EINVAL, nil // TODO: what does linux say if you try to connect a listening socket?
-	case StateClosed:
-		return unix.EBADF, nil
+	}
+
+	// release undoes the claim if the connect fails before the dial starts.
+	release := func() {
+		s.Inode.casState(mid, prev, "connect_release", 0)
 	}
 
 	proxy := newProxy(s.global, s.tmpl, true)
 	proxy.socket = s
+	qos := externalQoS(s.FD.FD())
+	qos.addIntervention(proxy)
+	opts := externalSockopts(s.FD.FD())
+
+	var peer *Socket
+	// Loopback addresses in another network namespace aren't our listeners'.
+	if CollapseLoopback && itab != nil && s.Inode.netns == nil && addr.Addr().Unmap().IsLoopback() {
+		if peer = itab.Listener(addr); peer != nil {
+			proxy.tmpl = proxy.tmpl.Copy()
+			setPeerTags(proxy.tmpl, peer.tmpl)
+		}
+	}
+
+	// Connections to a proxy on this host go on to a destination that events
+	// only show if the requests carry it, so they're tagged.
+	if s.Inode.netns == nil && noteConnect(addr, itab) {
+		slog.Debug("connecting to a local proxy, events show it as the destination unless the requests carry theirs", "sock", s, "addr", addr)
+		proxy.tmpl = proxy.tmpl.Copy()
+		proxy.tmpl.Set("via_proxy", unmapAddrPort(addr).String())
+	}
 
 	flags, err := unix.FcntlInt(uintptr(s.FD.FD()), unix.F_GETFL, 0)
 	if err != nil {
+		release()
 		return 0, fmt.Errorf("fcntl: %w", err)
 	}
 	isBlocking := flags&unix.O_NONBLOCK == 0
 
 	bind, errno, err := prev.getRemoteBindAddr()
 	if err != nil {
+		release()
 		return 0, fmt.Errorf("get bind addr: %w", err)
 	}
 	if errno != 0 {
+		release()
 		return errno, nil
 	}
 
 	slog.Debug("attempting socket connect", "sock", s, "addr", addr, "bind", bind, "isBlocking", isBlocking)
 
-	mid := &ImmutableState{state: StateConnecting}
-	mid.connecting.bind = prev.passive.bind
-	mid.connecting.peer = addr
-
 	if mid.connecting.bind == nil {
-		var err error
-		mid.connecting.bind, err = newTempBindSocket(s.Inode.Domain)
+		tmp, err := enterNetns(s.Inode.netns, func() (*fd.FD, error) {
+			return newTempBindSocket(s.Inode.Domain)
+		})
 		if err != nil {
+			release()
 			return 0, fmt.Errorf("create temp bind socket: %w", err)
 		}
-		bind, err = bindEphemeral(s.Inode.Domain, mid.connecting.bind, false)
-		if err != nil {
-			if !mid.connecting.bind.ClosingIncRef() {
-				panic("failed to incref local temp bind socket?") // there should be no other refs
+		closeTmp := func() {
+			if tmp.ClosingIncRef() {
+				defer tmp.DecRef()
+				tmp.Lock()
+				unix.Close(tmp.FD())
 			}
-			defer mid.connecting.bind.DecRef()
-			mid.connecting.bind.Lock()
-			unix.Close(mid.connecting.bind.FD())
+		}
+		bind, err = retryPortExhaustion(s.global, "bind", func() (netip.AddrPort, error) {
+			return bindEphemeral(s.Inode.Domain, tmp, false)
+		})
+		if err != nil {
+			closeTmp()
+			release()
 			return 0, fmt.Errorf("bind ephemeral: %w", err)
 		}
-	}
 
-	if !s.Inode.state.CompareAndSwap(prev, mid) {
-		if prev.passive.bind == nil && mid.connecting.bind.ClosingIncRef() {
-			defer mid.connecting.bind.DecRef()
-			mid.connecting.bind.Lock()
-			unix.Close(mid.connecting.bind.FD())
+		// Publish the temp bind socket so that getsockname(2) calls made while
+		// the connect is in progress see the local address.
+		next := &ImmutableState{state: StateConnecting}
+		next.connecting.bind = tmp
+		next.connecting.peer = addr
+		if !s.Inode.casState(mid, next, "connect_temp_bind", unix.EBADF) {
+			// Only close(2) can move a connecting socket to another state.
+			closeTmp()
+			return unix.EBADF, nil
 		}
-		return unix.ERESTART, nil
+		mid = next
 	}
 
 	dummyCtx, dummyCancel := context.WithCancel(context.Background())
-	dummy, err := newDummyListener(dummyCtx, s.Inode.Domain)
+	dummy, err := retryPortExhaustion(s.global, "dummy_listen", func() (*dummyListener, error) {
+		return enterNetns(s.Inode.netns, func() (*dummyListener, error) {
+			return newDummyListener(dummyCtx, s.Inode.Domain)
+		})
+	})
 	if err != nil {
 		dummyCancel()
+		if s.Inode.casState(mid, prev, "connect_release", 0) && prev.passive.bind == nil && mid.connecting.bind.ClosingIncRef() {
+			defer mid.connecting.bind.DecRef()
+			mid.connecting.bind.Lock()
+			unix.Close(mid.connecting.bind.FD())
+		}
 		return 0, fmt.Errorf("create dummy listener: %w", err)
 	}
 
 	var wg sync.WaitGroup
 	var errDummyAccept, errDialExternal error
+	dialed := make(chan struct{})
 
 	wg.Add(1)
 	go func() {
@@ -180,6 +255,7 @@ func (s *Socket) Connect(addr netip.AddrPort) (syscall.Errno, error) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		defer close(dialed)
 
 		d := &net.Dialer{
 			Control: func(_, _ string, c syscall.RawConn) error {
@@ -193,24 +269,56 @@ func (s *Socket) Connect(addr netip.AddrPort) (syscall.Errno, error) {
 						ret = fmt.Errorf("set SO_REUSEPORT=1: %w", err)
 						return
 					}
+					if peer != nil {
+						if proxy.loopback.IsValid() {
+							loopbackConnects.Delete(proxy.loopback) // from a failed attempt
+						}
+						local, err := bindLoopbackDial(int(fd), bind, addr)
+						if err != nil {
+							// Fall back to capturing the connection on both sides.
+							slog.Debug("failed to bind loopback dial, not collapsing", "sock", s, "addr", addr, "err", err) // not fatal
+							return
+						}
+						proxy.loopback = local
+					}
 				}); err != nil {
 					return fmt.Errorf("control: %w", err)
 				}
 				return ret
 			},
 		}
-		if bind.IsValid() {
+		if bind.IsValid() && peer == nil {
+			// The loopback dial binds in Control instead.
 			d.LocalAddr = &net.TCPAddr{IP: bind.Addr().AsSlice(), Port: int(bind.Port())}
 		}
 
-		conn, err := d.DialContext(context.TODO(), "tcp", addr.String())
+		var conn net.Conn
+		var retries int
+		err := s.Inode.netns.Enter(func() error {
+			var err error
+			conn, retries, err = dialExternal(d, addr.String(), qos)
+			return err
+		})
+		if DialRetryBudget > 0 {
+			proxy.tmpl = proxy.tmpl.Copy()
+			proxy.tmpl.Set("connect_retry_count", fmt.Sprintf("%d", retries))
+			proxy.tmpl.Set("connect_duration_ms", fmt.Sprintf("%d", time.Since(proxy.begin).Milliseconds()))
+			if retries > 0 && err == nil {
+				tracer.AddIntervention(proxy.tmpl, tracer.Intervention{Feature: "dial_retry", Summary: fmt.Sprintf("connect retried %d times after transient errors", retries)})
+			}
+		}
 		if err != nil {
-			slog.Debug("failed to connect to external", "sock", s, "addr", addr, "err", err, "duration", time.Since(proxy.begin).Nanoseconds()/1000)
+			if isPortExhaustion(err) {
+				notePortExhaustion(s.global, "external_dial", err)
+			}
+			slog.Debug("failed to connect to external", "sock", s, "addr", addr, "err", err, "retries", retries, "duration", time.Since(proxy.begin).Nanoseconds()/1000)
 			errDialExternal = fmt.Errorf("non-blocking connect: dial external: %w", err)
 			return
 		}
-		slog.Debug("connected to external", "sock", s, "addr", addr, "took", time.Since(proxy.begin).Nanoseconds()/1000)
+		slog.Debug("connected to external", "sock", s, "addr", addr, "retries", retries, "took", time.Since(proxy.begin).Nanoseconds()/1000)
 		proxy.external = conn.(*net.TCPConn)
+		proxy.connect = time.Since(proxy.begin)
+		opts.mirror(conn)
 	}()
 
 	errnoConnect := make(chan syscall.Errno, 1)
@@ -226,16 +334,18 @@ func (s *Socket) Connect(addr netip.AddrPort) (syscall.Errno, error) {
 			// accept will almost never fail while the external dial may fail in many
 			// ways (maybe the remote address is unreachable, maybe the connection was
 			// refused, or maybe something else).
-			slog.Error("failed to accept on dummy listener", "err", err)
-			errno = unix.ENOSYS
+			errno, _ = TranslateError(unix.SYS_CONNECT, err)
+			NoteInternalError(s.global, s.diagnosticTmpl(), unix.SYS_CONNECT, "dummy_accept", err, errno)
 			goto out
 		}
 
 		if err := errDialExternal; err != nil {
 			if !errors.As(err, &errno) {
-				slog.Error("failed to interpret non-blocking dial external error as syscall.Errno", "err", err, "type", fmt.Sprintf("%T", err))
-				errno = unix.ENOSYS
-				goto out
+				// Not a connect(2) error from the kernel, e.g. a timeout or a failed
+				// control function on our socket. The connect still failed like any
+				// other, so it's reported through SO_ERROR the same way.
+				errno, _ = TranslateError(unix.SYS_CONNECT, err)
+				NoteInternalError(s.global, s.diagnosticTmpl(), unix.SYS_CONNECT, "dial_external", err, errno)
 			}
 
 			next = &ImmutableState{state: StatePassive}
@@ -244,6 +354,8 @@ func (s *Socket) Connect(addr netip.AddrPort) (syscall.Errno, error) {
 			goto out
 		}
 
+		proxy.recordPath(s.FD.FD())
+		proxy.matchBuffers(s.FD.FD())
 		next = &ImmutableState{state: StateConnected}
 		next.connected.proxy = proxy
 		go proxy.start()
@@ -252,7 +364,7 @@ func (s *Socket) Connect(addr netip.AddrPort) (syscall.Errno, error) {
 
 		shouldCloseBind := true
 		if next != nil {
-			if !s.Inode.state.CompareAndSwap(mid, next) {
+			if !s.Inode.casState(mid, next, "connect_finish", unix.ERESTART) {
 				errno = unix.ERESTART
 			} else {
 				// We created a temporary socket earlier (mid.connecting.bind) in case this
@@ -278,6 +390,9 @@ func (s *Socket) Connect(addr netip.AddrPort) (syscall.Errno, error) {
 		errnoConnect <- errno
 
 		if errno != 0 {
+			if proxy.loopback.IsValid() {
+				loopbackConnects.Delete(proxy.loopback)
+			}
 			if proxy.process != nil {
 				proxy.process.Close()
 			}
@@ -365,8 +480,30 @@ func (s *Socket) Connect(addr netip.AddrPort) (syscall.Errno, error) {
 	// applications to behave exactly the same way with and without subtrace.
 	//
 	// TODO(adtac): find a better approach
+	//
+	// AccurateConnect trades the other way: the socket only becomes writable
+	// once the external handshake has finished, at the cost of connect(2)
+	// itself taking that long.
+	//
+	// A blocking connect(2) waits for the external dial too. That doesn't delay
+	// it, since it only returns once the dial is done anyway, and it lets the
+	// external MSS apply to the loopback handshake.
+	if AccurateConnect || isBlocking {
+		<-dialed
+		if proxy.external != nil {
+			if path, err := connPath(proxy.external); err == nil {
+				if err := setMaxseg(s.FD.FD(), path.clamp); err != nil {
+					slog.Debug("failed to mirror external MSS", "sock", s, "mss", path.clamp, "err", err) // not fatal
+				}
+			}
+		}
+	}
+
 	var dummyErrno syscall.Errno
-	if err := unix.Connect(s.FD.FD(), dummy.sockaddr()); err != nil {
+	_, err = retryPortExhaustion(s.global, "dummy_connect", func() (struct{}, error) {
+		return struct{}{}, unix.Connect(s.FD.FD(), dummy.sockaddr())
+	})
+	if err != nil {
 		if !errors.As(err, &dummyErrno) {
 			panic(fmt.Errorf("failed to interpret connect(2) error as errno: %w", err))
 		}
@@ -386,6 +523,72 @@ func (s *Socket) Connect(addr netip.AddrPort) (syscall.Errno, error) {
 	return dummyErrno, nil
 }
 
+var (
+	// AccurateConnect makes a non-blocking connect(2) wait for the external
+	// dial before returning EINPROGRESS so that the socket never becomes
+	// writable before the peer has accepted the connection.
+	AccurateConnect bool
+
+	// EnforceBacklog passes the backlog the traced process asked for to the
+	// external listener unchanged. By default, backlogs below 8 are raised to
+	// 8 and the external listener queues up to the system maximum, with more
+	// connections buffered for dispatch on top of that. Connections that
+	// arrive while the backlog is full are handled the way the host's
+	// tcp_abort_on_overflow says.
+	EnforceBacklog bool
+)
+
+// DialRetryBudget is the maximum amount of time spent retrying an external dial
+// that failed with a transient error before the failure is reported to the
+// tracee. Zero disables retries.
+var DialRetryBudget time.Duration
+
+// dialExternal dials addr, retrying with backoff for up to DialRetryBudget if
+// the dial fails with a transient error. Without subtrace, the kernel would
+// keep retransmitting the SYN for a while before giving up, so a brief network
+// blip wouldn't surface to the application as a connect error. Every external
+// dial goes through here so that qos is applied consistently.
+func dialExternal(d *net.Dialer, addr string, qos QoS) (net.Conn, int, error) {
+	d.Control = qos.control(d.Control)
+
+	begin := time.Now()
+	backoff := 100 * time.Millisecond
+	for retries := 0; ; retries++ {
+		start := time.Now()
+		conn, err := d.DialContext(context.TODO(), "tcp", addr)
+		if err == nil || DialRetryBudget <= 0 || !isTransientDialError(err, time.Since(start)) {
+			return conn, retries, err
+		}
+
+		remaining := DialRetryBudget - time.Since(begin)
+		if remaining <= 0 {
+			return nil, retries, err
+		}
+		slog.Debug("retrying external dial after transient error", "addr", addr, "err", err, "retries", retries, "backoff", backoff)
+		time.Sleep(min(backoff, remaining))
+		backoff = min(2*backoff, time.Second)
+	}
+}
+
+// isTransientDialError reports whether a failed dial is worth retrying.
+// ETIMEDOUT only counts if the attempt failed quickly; if it took long, the
+// kernel has already retransmitted the SYN as many times as it would have
+// without subtrace.
+func isTransientDialError(err error, took time.Duration) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case unix.EHOSTUNREACH, unix.ENETUNREACH:
+		return true
+	case unix.ETIMEDOUT:
+		return took < time.Second
+	default:
+		return false
+	}
+}
+
 // Bind binds the socket to the given address. Internally, it uses a dummy
 // temporary socket in order to check if the address is bindable and also
 // reserve the address for future operations.
@@ -444,13 +647,13 @@ func (s *Socket) Bind(addr netip.AddrPort) (syscall.Errno, error) {
 		if !errors.As(err, &next.passive.errno) {
 			return 0, fmt.Errorf("bind: %w", err)
 		}
-		if !s.Inode.state.CompareAndSwap(prev, next) {
+		if !s.Inode.casState(prev, next, "bind_failed", unix.ERESTART) {
 			return unix.ERESTART, nil
 		}
 		return next.passive.errno, nil
 	}
 
-	if !s.Inode.state.CompareAndSwap(prev, next) { // TODO: unbind?
+	if !s.Inode.casState(prev, next, "bind", unix.ERESTART) { // TODO: unbind?
 		if prev.passive.bind == nil {
 			unix.Close(next.passive.bind.FD())
 		}
@@ -506,6 +709,10 @@ func (s *Socket) Listen(backlog int) (syscall.Errno, error) {
 	case StateConnected, StateConnecting:
 		return unix.EINVAL, nil // TODO: what does linux say if you try to listen a connected socket?
 	case StateListening:
+		// listen(2) after shutdown(2) makes the socket listen again.
+		if reason, d, ok := prev.listening.gate.resume(pauseShutdown); ok {
+			s.publishAcceptGate(prev.listening.lis.Addr().String(), "resumed", reason, d)
+		}
 		return 0, nil
 	case StateClosed:
 		return unix.EBADF, nil
@@ -513,11 +720,17 @@ func (s *Socket) Listen(backlog int) (syscall.Errno, error) {
 
 	// TODO(adtac): I think the Linux kernel also enforces a minimum like this,
 	// but maybe it's configurable?
-	if backlog < 8 {
+	if !EnforceBacklog && backlog < 8 {
 		backlog = 8
 	}
 
-	ephemeral, err := bindEphemeral(s.Inode.Domain, s.FD, true)
+	if s.Inode.Domain == unix.AF_UNIX {
+		return s.listenUnix(prev, backlog)
+	}
+
+	ephemeral, err := retryPortExhaustion(s.global, "bind", func() (netip.AddrPort, error) {
+		return bindEphemeral(s.Inode.Domain, s.FD, true)
+	})
 	if err != nil {
 		return 0, fmt.Errorf("bind ephemeral: %w", err)
 	}
@@ -531,24 +744,30 @@ func (s *Socket) Listen(backlog int) (syscall.Errno, error) {
 	}
 
 	var lis net.Listener
+	qos := externalQoS(s.FD.FD())
+	opts := externalSockopts(s.FD.FD())
 
-	switch s.Inode.Domain {
-	case unix.AF_INET:
-		if !bind.IsValid() {
-			lis, err = net.Listen("tcp4", "127.0.0.1:0")
-		} else {
-			lis, err = net.Listen("tcp4", bind.String())
-		}
-	case unix.AF_INET6:
-		if !bind.IsValid() {
-			lis, err = net.Listen("tcp6", "[::1]:0")
-		} else if bind.Addr().IsUnspecified() {
-			// [::]:80 seems to listen on both IPv4 and IPv6 but 127.0.0.1:80 doesn't?
-			lis, err = net.Listen("tcp", bind.String())
-		} else {
-			lis, err = net.Listen("tcp6", bind.String())
+	err = s.Inode.netns.Enter(func() error {
+		var err error
+		switch s.Inode.Domain {
+		case unix.AF_INET:
+			if !bind.IsValid() {
+				lis, err = listenExternal("tcp4", "127.0.0.1:0", qos)
+			} else {
+				lis, err = listenExternal("tcp4", bind.String(), qos)
+			}
+		case unix.AF_INET6:
+			if !bind.IsValid() {
+				lis, err = listenExternal("tcp6", "[::1]:0", qos)
+			} else if bind.Addr().IsUnspecified() {
+				// [::]:80 seems to listen on both IPv4 and IPv6 but 127.0.0.1:80 doesn't?
+				lis, err = listenExternal("tcp", bind.String(), qos)
+			} else {
+				lis, err = listenExternal("tcp6", bind.String(), qos)
+			}
 		}
-	}
+		return err
+	})
 	if err != nil {
 		var errno syscall.Errno
 		if errors.As(err, &errno) {
@@ -556,6 +775,17 @@ func (s *Socket) Listen(backlog int) (syscall.Errno, error) {
 		}
 		return 0, fmt.Errorf("external side listen: %w", err)
 	}
+	if EnforceBacklog && backlog >= 0 {
+		// listen(2) on a listening socket only changes its backlog.
+		if err := controlConn(lis, func(fd int) error { return unix.Listen(fd, backlog) }); err != nil {
+			slog.Debug("failed to enforce backlog on external listener", "sock", s, "backlog", backlog, "err", err) // not fatal
+		}
+	}
+	if secs := s.Inode.deferAccept.Load(); MirrorDeferAccept && secs > 0 {
+		if err := setDeferAccept(lis, int(secs)); err != nil {
+			slog.Debug("failed to set TCP_DEFER_ACCEPT on external listener", "sock", s, "err", err) // not fatal
+		}
+	}
 
 	if prev.passive.bind != nil {
 		// Close after starting the actual listener so that we don't race with any
@@ -570,28 +800,67 @@ func (s *Socket) Listen(backlog int) (syscall.Errno, error) {
 		}
 	}
 
+	return s.serve(prev, lis, net.TCPAddrFromAddrPort(ephemeral), backlog, qos, opts), nil
+}
+
+// serve moves the socket from prev to listening on lis and starts accepting
+// connections on its behalf, which are dispatched to the process by dialing
+// the ephemeral address its socket listens on.
+func (s *Socket) serve(prev *ImmutableState, lis net.Listener, ephemeral net.Addr, backlog int, qos QoS, opts *sockopts) syscall.Errno {
 	next := &ImmutableState{state: StateListening}
 	next.listening.active.Store(true)
 	next.listening.lis = lis
-	if !s.Inode.state.CompareAndSwap(prev, next) {
+	next.listening.gate = newAcceptGate()
+	if EnforceBacklog && backlog > 0 {
+		next.listening.gate.limit = int64(backlog)
+		next.listening.gate.abort = ephemeral.Network() == "tcp" && s.readAbortOnOverflow()
+	}
+	if !s.Inode.casState(prev, next, "listen", unix.ERESTART) {
 		lis.Close()
-		return unix.ERESTART, nil
+		return unix.ERESTART
 	}
 
-	// Separate goroutines for the accept loop and the dispatch loop so that
+	// Separate goroutines for the accept loop and the dispatch workers so that
 	// buffer channel can act as both a fixed size buffer and a rate limiter.
 	buffer := make(chan *proxy, backlog*2)
+	if EnforceBacklog {
+		// Connections wait in the external listener's backlog instead.
+		buffer = make(chan *proxy)
+	}
+
+	gate := next.listening.gate
+	addr := lis.Addr().String()
+	go s.watchStalls(gate, addr, backlog)
 
 	go func() { // accept loop
 		defer lis.Close()
 		defer next.listening.active.Store(false)
+		defer gate.stop()
 		defer close(buffer)
 		for {
 			external, err := lis.Accept()
 			switch {
 			case err == nil:
+				// While paused, hold on to the connection accepted last and let
+				// the rest queue in the kernel's backlog.
+				if !gate.wait() {
+					external.Close()
+					return
+				}
+				if !s.handleOverflow(gate, addr, external) {
+					continue
+				}
+				// Wait out the pause if the process's backlog is full.
+				if !gate.wait() {
+					external.Close()
+					return
+				}
+				gate.pending.Add(1)
 				p := newProxy(s.global, s.tmpl, false)
-				p.external = external.(*net.TCPConn)
+				p.external = external.(streamConn)
+				qos.addIntervention(p)
+				opts.mirror(external)
+				p.passthrough = isLoopbackConnect(external)
 				buffer <- p
 			case errors.Is(err, net.ErrClosed):
 				return
@@ -602,37 +871,111 @@ func (s *Socket) Listen(backlog int) (syscall.Errno, error) {
 		}
 	}()
 
-	go func() { // dispatch loop
-		for p := range buffer {
-			go func(p *proxy) {
-				process, err := net.Dial("tcp", ephemeral.String())
-				if err != nil {
-					p.external.Close()
-					slog.Debug("failed to dial ephemeral address", "err", err) // not fatal: the process probably exited
-					return
-				}
-				p.process = process.(*net.TCPConn)
+	s.runDispatchWorkers(next, ephemeral, buffer, backlog)
 
-				addr := netip.MustParseAddrPort(process.LocalAddr().String())
-				if addr.Addr().Is4In6() {
-					addr = netip.AddrPortFrom(netip.AddrFrom4(addr.Addr().As4()), addr.Port())
-				}
+	slog.Debug("marked socket as listening", "sock", s, "addr", lis.Addr(), "backlog", backlog)
+	return 0
+}
 
-				ch := make(chan *proxy, 1)
-				if found, loaded := next.listening.backlog.LoadOrStore(addr, ch); loaded {
-					ch = found.(chan *proxy)
-					next.listening.backlog.Delete(addr)
-				}
-				ch <- p
-				slog.Debug("dispatcher enqueued accepted connection", "sock", s, "addr", addr)
-			}(p)
-		}
-	}()
+// Shutdown handles shutdown(2). The shutdown itself is always left to the
+// kernel.
+//
+// On a connected socket, the kernel's FIN reaches the proxy after every byte
+// written before it, and the proxy half-closes the other side of the
+// connection when it reads it, so a shutdown(SHUT_WR) reaches the peer in
+// order and the process keeps reading the response. Half-closing the external
+// connection here instead would cut off whatever the proxy hasn't forwarded
+// yet. The half-closed directions are recorded so that emulated sends fail
+// with EPIPE like the kernel's.
+//
+// On a listening socket, Linux stops listening: connections in the backlog
+// are reset and new ones are refused. The external accept loop is paused until
+// the process calls listen(2) again so that new clients wait in the external
+// listener's backlog instead of being accepted on behalf of a process that
+// won't take them.
+func (s *Socket) Shutdown(how int) (syscall.Errno, error) {
+	if !s.FD.IncRef() {
+		return unix.EBADF, nil
+	}
+	defer s.FD.DecRef()
+
+	cur := s.Inode.state.Load()
+	if cur.state == StateConnected {
+		s.markShutdown(how)
+		return 0, nil
+	}
+	if cur.state != StateListening || (how != unix.SHUT_RD && how != unix.SHUT_RDWR) {
+		return 0, nil
+	}
+
+	gate := cur.listening.gate
+	addr := cur.listening.lis.Addr().String()
+	s.releaseOverflow(gate, addr, true)
+	if gate.pause(pauseShutdown) {
+		s.publishAcceptGate(addr, "paused", pauseShutdown, 0)
+	}
 
-	slog.Debug("marked socket as listening", "sock", s, "addr", bind, "backlog", backlog)
+	// The kernel resets the process side of the connections dispatched but
+	// not accepted yet, so close their external side to match.
+	cur.listening.backlog.Range(func(key, _ any) bool {
+		if val, ok := cur.listening.backlog.LoadAndDelete(key); ok {
+			p := val.(*proxy)
+			gate.pending.Add(-1)
+			p.process.Close()
+			p.external.Close()
+		}
+		return true
+	})
 	return 0, nil
 }
 
+const (
+	shutRead = 1 << iota
+	shutWrite
+)
+
+func shutName(shut int) string {
+	switch shut {
+	case shutRead:
+		return "read"
+	case shutWrite:
+		return "write"
+	case shutRead | shutWrite:
+		return "both"
+	}
+	return ""
+}
+
+// markShutdown records the directions of a connected socket closed by
+// shutdown(2).
+func (s *Socket) markShutdown(how int) {
+	var shut int
+	switch how {
+	case unix.SHUT_RD:
+		shut = shutRead
+	case unix.SHUT_WR:
+		shut = shutWrite
+	case unix.SHUT_RDWR:
+		shut = shutRead | shutWrite
+	default:
+		return // the kernel fails it with EINVAL
+	}
+
+	for {
+		prev := s.Inode.state.Load()
+		if prev.state != StateConnected || prev.connected.shut|shut == prev.connected.shut {
+			return
+		}
+		next := &ImmutableState{state: StateConnected}
+		next.connected.proxy = prev.connected.proxy
+		next.connected.shut = prev.connected.shut | shut
+		if s.Inode.casState(prev, next, "shutdown", 0) {
+			slog.Debug("shut down connected socket", "sock", s, "shutdown", shutName(next.connected.shut))
+			return
+		}
+	}
+}
+
 func (s *Socket) Accept(flags int) (*Socket, syscall.Errno, error) {
 	if !s.FD.IncRef() {
 		return nil, unix.EBADF, nil
@@ -651,44 +994,46 @@ func (s *Socket) Accept(flags int) (*Socket, syscall.Errno, error) {
 		return nil, unix.EBADF, nil
 	}
 
-	ret, sa, err := unix.Accept4(s.FD.FD(), flags|unix.SOCK_CLOEXEC)
-	if err != nil {
-		var errno syscall.Errno
-		if !errors.As(err, &errno) {
-			return nil, 0, fmt.Errorf("failed to interpret accept error as errno: %w", err)
+	var ret int
+	var p *proxy
+	for p == nil {
+		var err error
+		ret, _, err = unix.Accept4(s.FD.FD(), flags|unix.SOCK_CLOEXEC)
+		if err != nil {
+			var errno syscall.Errno
+			if !errors.As(err, &errno) {
+				return nil, 0, fmt.Errorf("failed to interpret accept error as errno: %w", err)
+			}
+			// If accept(2) fails, Linux does not put the socket in an error state.
+			return nil, errno, nil
 		}
-		// If accept(2) fails, Linux does not put the socket in an error state.
-		return nil, errno, nil
-	}
-
-	var addr netip.AddrPort
-	switch sa := sa.(type) {
-	case *unix.SockaddrInet4:
-		addr = netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port))
-	case *unix.SockaddrInet6:
-		addr = netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), uint16(sa.Port))
-	}
-	if addr.Addr().Is4In6() {
-		addr = netip.AddrPortFrom(netip.AddrFrom4(addr.Addr().As4()), addr.Port())
-	}
 
-	ch := make(chan *proxy, 1)
-	if found, loaded := cur.listening.backlog.LoadOrStore(addr, ch); loaded {
-		ch = found.(chan *proxy)
-		cur.listening.backlog.Delete(addr)
-	}
-
-	p := <-ch
-	if p.process.LocalAddr().String() != addr.String() {
-		panic(fmt.Sprintf("dialed process-side local does not match accepted connection: %s != %s", p.process.LocalAddr(), addr))
+		cookie, err := readCookie(ret)
+		if err != nil {
+			// Not from the dispatcher, or reset before the process got to it
+			// (e.g. by shutdown(2)). Either way, the process wouldn't have
+			// seen it without subtrace.
+			slog.Debug("dropping accepted connection without a dispatch cookie", "sock", s, "err", err)
+			unix.Close(ret)
+			continue
+		}
+		val, ok := cur.listening.backlog.LoadAndDelete(cookie)
+		if !ok {
+			slog.Debug("dropping accepted connection with an unknown dispatch cookie", "sock", s, "cookie", cookie)
+			unix.Close(ret)
+			continue
+		}
+		p = val.(*proxy)
 	}
-	slog.Debug("accepter dequeued accepted connection", "sock", s, "addr", addr)
+	slog.Debug("accepter dequeued accepted connection", "sock", s, "addr", p.process.LocalAddr())
 
-	var stat unix.Stat_t
-	if err := unix.Fstat(ret, &stat); err != nil {
-		unix.Close(ret)
-		return nil, 0, fmt.Errorf("stat after channel receive: %w", err)
+	gate := cur.listening.gate
+	gate.pending.Add(-1)
+	gate.accepted()
+	if reason, d, ok := gate.resume(pauseStalled); ok {
+		s.publishAcceptGate(cur.listening.lis.Addr().String(), "resumed", reason, d)
 	}
+	s.releaseOverflow(gate, cur.listening.lis.Addr().String(), false)
 
 	fd := fd.NewFD(ret)
 	defer fd.DecRef()
@@ -696,7 +1041,10 @@ func (s *Socket) Accept(flags int) (*Socket, syscall.Errno, error) {
 	state := &ImmutableState{state: StateConnected}
 	state.connected.proxy = p
 
-	child := NewSocket(s.global, s.tmpl, newInode(s.Inode.Domain, stat.Ino, state), fd)
+	p.recordPath(ret)
+	p.matchBuffers(ret)
+	child := NewSocket(s.global, s.tmpl, newInode(s.Inode.Domain, 0, state), fd) // see Inode.Number
+	child.Inode.name.Store(s.Inode.name.Load())
 	p.socket = child
 	slog.Debug("created socket", "method", "accept", "sock", child)
 
@@ -705,23 +1053,76 @@ func (s *Socket) Accept(flags int) (*Socket, syscall.Errno, error) {
 	return child, 0, nil
 }
 
+// Send writes b to the socket on behalf of the tracee with send(2) semantics
+// and accounts the number of bytes actually written. Since the socket's file
+// description is shared with the tracee, the result (including partial writes
+// and O_NONBLOCK behavior) is exactly what the tracee would have observed.
+func (s *Socket) Send(b []byte, flags int) (int, syscall.Errno) {
+	if !s.FD.IncRef() {
+		return 0, unix.EBADF
+	}
+	defer s.FD.DecRef()
+
+	if cur := s.Inode.state.Load(); cur.state == StateConnected && cur.connected.shut&shutWrite != 0 {
+		return 0, unix.EPIPE
+	}
+
+	// Always set MSG_NOSIGNAL because a SIGPIPE would be delivered to us, not
+	// the tracee. The caller is responsible for raising the signal in the
+	// tracee if it didn't ask for MSG_NOSIGNAL.
+	n, err := unix.SendmsgN(s.FD.FD(), b, nil, nil, flags|unix.MSG_NOSIGNAL)
+	if err != nil {
+		var errno syscall.Errno
+		if !errors.As(err, &errno) {
+			panic(fmt.Errorf("cannot interpret sendmsg(2) error as errno: %w", err))
+		}
+		return 0, errno
+	}
+
+	s.Inode.AccountWrite(n)
+	if flags&unix.MSG_OOB != 0 && n > 0 {
+		s.Inode.AccountUrgent()
+	}
+	if s.Inode.flow != nil {
+		s.Inode.flow.record(netip.AddrPort{}, b[:n])
+		if TraceDNS {
+			s.ObserveDNSSend(netip.AddrPort{}, b[:n])
+		}
+	}
+	return n, 0
+}
+
+// Close closes the socket. Only the first call for a socket closes it, even if
+// several threads race to; the others get EBADF like the kernel returns for a
+// file descriptor that's already closed. The inode is torn down once, by the
+// close of its last open socket.
 func (s *Socket) Close() syscall.Errno {
 	if !s.FD.ClosingIncRef() {
 		return unix.EBADF
 	}
 	defer s.FD.DecRef()
 
+	// close(2) releases the file descriptor even when it fails, so the inode
+	// must be untracked and torn down either way.
 	s.FD.Lock()
+	var ret syscall.Errno
 	if err := unix.Close(s.FD.FD()); err != nil {
-		var errno syscall.Errno
-		if !errors.As(err, &errno) {
-			panic(fmt.Errorf("cannot interpret close(2) error as errno: %w", err))
+		if !errors.As(err, &ret) {
+			slog.Error("cannot interpret close(2) error as errno", "sock", s, "err", err)
+			ret = unix.EIO
 		}
-		return errno
 	}
 
-	if last := s.Inode.remove(s); !last {
-		return 0
+	last, err := s.Inode.remove(s)
+	if err != nil {
+		slog.Error("failed to untrack closed socket", "sock", s, "err", err)
+		return ret
+	}
+	if !last {
+		return ret
+	}
+	if s.Inode.flow != nil {
+		s.publishDatagramFlow()
 	}
 
 	var errs []error
@@ -729,11 +1130,14 @@ func (s *Socket) Close() syscall.Errno {
 	for {
 		prev = s.Inode.state.Load()
 		if prev.state == StateClosed {
-			panic(fmt.Errorf("final socket close for inode %d: inode state is already closed", s.Inode.Number))
+			// A socket dup'd while the inode's last socket was being closed is
+			// added after the teardown; there's nothing left to tear down.
+			slog.Debug("closed socket of already closed inode", "sock", s, "inode", s.Inode.number.Load())
+			return ret
 		}
 
 		next := &ImmutableState{state: StateClosed}
-		if s.Inode.state.CompareAndSwap(prev, next) {
+		if s.Inode.casState(prev, next, "close", 0) {
 			break
 		}
 	}
@@ -765,7 +1169,7 @@ func (s *Socket) Close() syscall.Errno {
 		}
 
 	case StateConnecting:
-		if prev.connecting.bind.ClosingIncRef() {
+		if prev.connecting.bind != nil && prev.connecting.bind.ClosingIncRef() {
 			defer prev.connecting.bind.DecRef()
 			prev.connecting.bind.Lock()
 			if err := unix.Close(prev.connecting.bind.FD()); err != nil {
@@ -781,6 +1185,11 @@ func (s *Socket) Close() syscall.Errno {
 				errs = append(errs, fmt.Errorf("close listener: %w", err))
 			}
 		}
+		s.releaseOverflow(prev.listening.gate, prev.listening.lis.Addr().String(), true)
+		if reason, d, ok := prev.listening.gate.resume(pauseShutdown, pauseStalled); ok {
+			s.publishAcceptGate(prev.listening.lis.Addr().String(), "resumed", reason, d)
+		}
+		prev.listening.gate.stop()
 	}
 
 	if len(errs) > 0 {
@@ -788,7 +1197,7 @@ func (s *Socket) Close() syscall.Errno {
 	} else {
 		slog.Debug("closed socket", "sock", s)
 	}
-	return 0
+	return ret
 }
 
 type dummyListener struct {
@@ -0,0 +1,356 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// MirrorSockopts copies the TCP behavior options the traced process set
+	// on its socket (keepalive, TCP_NODELAY and TCP_USER_TIMEOUT) to the
+	// external connection. By default, external connections get Go's
+	// defaults instead: keepalive probes every 15 seconds and TCP_NODELAY.
+	MirrorSockopts bool
+
+	// MirrorDeferAccept applies TCP_DEFER_ACCEPT set by the traced process on
+	// a listening socket to the external listener. By default, the option is
+	// accepted and ignored.
+	MirrorDeferAccept bool
+)
+
+// sockopts holds the options copied by MirrorSockopts.
+type sockopts struct {
+	keepalive   int
+	idle        int // TCP_KEEPIDLE
+	intvl       int // TCP_KEEPINTVL
+	cnt         int // TCP_KEEPCNT
+	nodelay     int
+	userTimeout int // TCP_USER_TIMEOUT
+}
+
+// traceeSockopts reads the options from the traced socket fd. Listening
+// sockets pass them on to the sockets they accept, so this works for both.
+func traceeSockopts(fd int) (sockopts, error) {
+	var ret sockopts
+	for _, opt := range []struct {
+		dst         *int
+		level, name int
+	}{
+		{&ret.keepalive, unix.SOL_SOCKET, unix.SO_KEEPALIVE},
+		{&ret.idle, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE},
+		{&ret.intvl, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL},
+		{&ret.cnt, unix.IPPROTO_TCP, unix.TCP_KEEPCNT},
+		{&ret.nodelay, unix.IPPROTO_TCP, unix.TCP_NODELAY},
+		{&ret.userTimeout, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT},
+	} {
+		val, err := unix.GetsockoptInt(fd, opt.level, opt.name)
+		if err != nil {
+			return sockopts{}, err
+		}
+		*opt.dst = val
+	}
+	return ret, nil
+}
+
+// apply sets the options on fd.
+func (o sockopts) apply(fd int) error {
+	for _, opt := range []struct {
+		name       string
+		level, opt int
+		val        int
+	}{
+		{"SO_KEEPALIVE", unix.SOL_SOCKET, unix.SO_KEEPALIVE, o.keepalive},
+		{"TCP_KEEPIDLE", unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, o.idle},
+		{"TCP_KEEPINTVL", unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, o.intvl},
+		{"TCP_KEEPCNT", unix.IPPROTO_TCP, unix.TCP_KEEPCNT, o.cnt},
+		{"TCP_NODELAY", unix.IPPROTO_TCP, unix.TCP_NODELAY, o.nodelay},
+		{"TCP_USER_TIMEOUT", unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, o.userTimeout},
+	} {
+		if err := unix.SetsockoptInt(fd, opt.level, opt.opt, opt.val); err != nil {
+			return fmt.Errorf("set %s=%d: %w", opt.name, opt.val, err)
+		}
+	}
+	return nil
+}
+
+// externalSockopts returns the options to mirror from the traced socket fd
+// to its external connections, or nil if MirrorSockopts isn't set. They're
+// read when the process connects or listens.
+func externalSockopts(fd int) *sockopts {
+	if !MirrorSockopts {
+		return nil
+	}
+	o, err := traceeSockopts(fd)
+	if err != nil {
+		slog.Debug("failed to read socket options from traced socket", "fd", fd, "err", err) // not fatal
+		return nil
+	}
+	return &o
+}
+
+// mirror applies o to conn. Go sets keepalive and TCP_NODELAY on every
+// connection once it's established, so this must run afterwards. Failures
+// aren't fatal: the connection works with Go's defaults.
+func (o *sockopts) mirror(conn net.Conn) {
+	if o == nil {
+		return
+	}
+	if err := controlConn(conn, o.apply); err != nil {
+		slog.Debug("failed to mirror socket options to external connection", "err", err) // not fatal
+	}
+}
+
+// setDeferAccept sets TCP_DEFER_ACCEPT on the listener.
+func setDeferAccept(lis net.Listener, secs int) error {
+	return controlConn(lis, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, secs)
+	})
+}
+
+// controlConn runs fn on the file descriptor of a connection or listener.
+func controlConn(c any, fn func(fd int) error) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T has no file descriptor", c)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("syscall conn: %w", err)
+	}
+	var ret error
+	if err := raw.Control(func(fd uintptr) { ret = fn(int(fd)) }); err != nil {
+		return fmt.Errorf("control: %w", err)
+	}
+	return ret
+}
+
+// DeferAccept handles setsockopt(TCP_DEFER_ACCEPT) on the socket. The value
+// is kept so that it applies to the external listener when the socket starts
+// listening, or right away if it already is.
+func (s *Socket) DeferAccept(secs int) {
+	s.Inode.deferAccept.Store(int32(secs))
+	cur := s.Inode.state.Load()
+	if cur.state != StateListening {
+		return
+	}
+	if err := setDeferAccept(cur.listening.lis, secs); err != nil {
+		slog.Debug("failed to set TCP_DEFER_ACCEPT on external listener", "sock", s, "err", err) // not fatal
+	}
+}
+
+// The proxy puts two more pairs of socket buffers between the process and its
+// peer. An application that writes a whole request before it reads anything
+// relies on the buffers along the path to hold what it writes while its peer
+// does the same, so with smaller ones in the middle it would deadlock at a
+// size where it doesn't untraced. Both of the proxy's sockets are therefore
+// given buffers at least as large as the process's socket, whenever it
+// connects and whenever it sets SO_SNDBUF or SO_RCVBUF afterwards.
+
+// socketBuffers is what SO_SNDBUF and SO_RCVBUF read on a socket, which is
+// twice what was set with setsockopt(2).
+type socketBuffers struct {
+	snd, rcv int
+}
+
+func readBuffers(fd int) (socketBuffers, error) {
+	var ret socketBuffers
+	var err error
+	if ret.snd, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF); err != nil {
+		return socketBuffers{}, fmt.Errorf("get SO_SNDBUF: %w", err)
+	}
+	if ret.rcv, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF); err != nil {
+		return socketBuffers{}, fmt.Errorf("get SO_RCVBUF: %w", err)
+	}
+	return ret, nil
+}
+
+// raiseBuffers grows the buffers of fd that are smaller than want. The others
+// are left alone so that the kernel keeps sizing them automatically, which
+// setting them turns off.
+func raiseBuffers(fd int, want socketBuffers) error {
+	cur, err := readBuffers(fd)
+	if err != nil {
+		return err
+	}
+	for _, opt := range []struct {
+		name      string
+		opt       int
+		cur, want int
+	}{
+		{"SO_SNDBUF", unix.SO_SNDBUF, cur.snd, want.snd},
+		{"SO_RCVBUF", unix.SO_RCVBUF, cur.rcv, want.rcv},
+	} {
+		if opt.cur >= opt.want {
+			continue
+		}
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt.opt, opt.want/2); err != nil {
+			return fmt.Errorf("set %s=%d: %w", opt.name, opt.want/2, err)
+		}
+	}
+	return nil
+}
+
+// matchBuffers raises the buffers of both of the proxy's sockets to those of
+// the process's socket fd. Failures aren't fatal: the connection works, it
+// just deadlocks sooner for applications that depend on buffer sizes.
+func (p *proxy) matchBuffers(fd int) {
+	want, err := readBuffers(fd)
+	if err != nil {
+		slog.Debug("failed to read socket buffers of traced socket", "proxy", p, "err", err) // not fatal
+		return
+	}
+	for _, conn := range []streamConn{p.process, p.external} {
+		if err := controlConn(conn, func(fd int) error { return raiseBuffers(fd, want) }); err != nil {
+			slog.Debug("failed to match socket buffers of traced socket", "proxy", p, "conn", conn.LocalAddr(), "err", err) // not fatal
+		}
+	}
+}
+
+// SetBuffer handles setsockopt(SO_SNDBUF or SO_RCVBUF) on the socket. It's set
+// on the socket like the kernel would, and the proxy of a connected socket
+// raises its own sockets to match.
+func (s *Socket) SetBuffer(name int, val int) syscall.Errno {
+	if !s.FD.IncRef() {
+		return unix.EBADF
+	}
+	defer s.FD.DecRef()
+
+	if err := unix.SetsockoptInt(s.FD.FD(), unix.SOL_SOCKET, name, val); err != nil {
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			return errno
+		}
+		return unix.EINVAL
+	}
+	if cur := s.Inode.state.Load(); cur.state == StateConnected {
+		cur.connected.proxy.matchBuffers(s.FD.FD())
+	}
+	return 0
+}
+
+// The loopback connection between the process and subtrace has an MSS of
+// about 64KB, while the external path's is usually around 1460. Applications
+// that size their writes by TCP_MAXSEG would behave differently than in
+// production, so the external MSS is set on the process side of the loopback
+// connection before its handshake where possible, which is when the external
+// connection is established first. Otherwise, getsockopt(TCP_MAXSEG) reports
+// the external MSS (see MaxSeg).
+
+// tcpDefaultMSS is what TCP_MAXSEG reads on a socket that isn't connected
+// and has no user-set value (TCP_MSS_DEFAULT in include/net/tcp.h).
+const tcpDefaultMSS = 536
+
+// pathInfo is the MSS and path MTU of a connection.
+type pathInfo struct {
+	mss int
+	mtu int // zero if unknown
+
+	// clamp is the value of TCP_MAXSEG that gives a new connection the same
+	// MSS. TCP_MAXSEG reads the MSS net of TCP options, while setting it
+	// limits the MSS before options are taken off.
+	clamp int
+}
+
+// tcpTimestampLen is the space the TCP timestamps option takes in every
+// segment (TCPOLEN_TSTAMP_ALIGNED in include/net/tcp.h).
+const tcpTimestampLen = 12
+
+// tcpiOptTimestamps is TCPI_OPT_TIMESTAMPS in include/uapi/linux/tcp.h.
+const tcpiOptTimestamps = 1
+
+// connPath reads the MSS and the path MTU of an established connection.
+func connPath(conn net.Conn) (pathInfo, error) {
+	var ret pathInfo
+	err := controlConn(conn, func(fd int) error {
+		var err error
+		if ret.mss, err = unix.GetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_MAXSEG); err != nil {
+			return fmt.Errorf("get TCP_MAXSEG: %w", err)
+		}
+		if ret.mtu, err = unix.GetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU); err != nil {
+			ret.mtu, _ = unix.GetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MTU)
+		}
+		ret.clamp = ret.mss
+		if info, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO); err == nil && info.Options&tcpiOptTimestamps != 0 {
+			ret.clamp += tcpTimestampLen
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// setMaxseg sets TCP_MAXSEG on a socket that isn't connected yet unless the
+// process already set a smaller value itself.
+func setMaxseg(fd int, mss int) error {
+	if cur, err := unix.GetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_MAXSEG); err == nil && cur != tcpDefaultMSS && cur < mss {
+		return nil
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_MAXSEG, mss)
+}
+
+// recordPath reads the MSS of the external connection and of the process's
+// socket fd once both are established, and tags the connection with both so
+// that a mismatch is visible. Unix domain connections have no MSS.
+func (p *proxy) recordPath(fd int) {
+	if _, ok := p.external.(*net.TCPConn); !ok {
+		return
+	}
+	ext := p.path // read by the dispatcher for an accepted connection
+	if ext.mss == 0 {
+		var err error
+		if ext, err = connPath(p.external); err != nil {
+			slog.Debug("failed to read external path MSS", "proxy", p, "err", err) // not fatal
+			return
+		}
+		p.path = ext
+	}
+	p.processMSS, _ = unix.GetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+
+	p.tmpl = p.tmpl.Copy()
+	p.tmpl.Set("tcp_mss_external", fmt.Sprintf("%d", ext.mss))
+	p.tmpl.Set("tcp_mss_process", fmt.Sprintf("%d", p.processMSS))
+	if ext.mtu > 0 {
+		p.tmpl.Set("tcp_path_mtu_external", fmt.Sprintf("%d", ext.mtu))
+	}
+}
+
+// MaxSeg returns the value getsockopt(TCP_MAXSEG) should report on a connected
+// socket: the external MSS, if it couldn't be mirrored onto the process side.
+// ok is false if the kernel's answer is already right.
+func (s *Socket) MaxSeg() (mss int, ok bool) {
+	cur := s.Inode.state.Load()
+	if cur.state != StateConnected {
+		return 0, false
+	}
+	p := cur.connected.proxy
+	if p.path.mss == 0 || p.processMSS == p.path.mss {
+		return 0, false
+	}
+	return p.path.mss, true
+}
+
+// mirrorMSSControl returns a net.Dialer Control function that sets the MSS of
+// the external connection of p on the dispatch dial to the process's
+// listener, so that the accepted socket's MSS matches it. The path is kept in
+// p for recordPath.
+func mirrorMSSControl(p *proxy) func(string, string, syscall.RawConn) error {
+	path, err := connPath(p.external)
+	if err != nil {
+		return nil
+	}
+	p.path = path
+	return func(_, _ string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			if err := setMaxseg(int(fd), path.clamp); err != nil {
+				slog.Debug("failed to mirror external MSS on dispatch dial", "mss", path.clamp, "err", err) // not fatal
+			}
+		})
+	}
+}
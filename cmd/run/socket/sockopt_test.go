@@ -0,0 +1,133 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+)
+
+func TestMirrorSockopts(t *testing.T) {
+	defer func(prev bool) { MirrorSockopts = prev }(MirrorSockopts)
+	MirrorSockopts = true
+
+	tracee, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socket: %v", err)
+	}
+	defer unix.Close(tracee)
+	for _, opt := range []struct{ level, name, val int }{
+		{unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, 42},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, 7},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 3},
+		{unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, 1234},
+	} {
+		if err := unix.SetsockoptInt(tracee, opt.level, opt.name, opt.val); err != nil {
+			t.Fatalf("setsockopt: %v", err)
+		}
+	}
+	want, err := traceeSockopts(tracee)
+	if err != nil {
+		t.Fatalf("read tracee options: %v", err)
+	}
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	conn, err := net.Dial("tcp4", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Go enables TCP_NODELAY and its own keepalive on every connection.
+	externalSockopts(tracee).mirror(conn)
+
+	var got sockopts
+	if err := controlConn(conn, func(fd int) error {
+		got, err = traceeSockopts(fd)
+		return err
+	}); err != nil {
+		t.Fatalf("read external options: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got.nodelay != 0 {
+		t.Errorf("got TCP_NODELAY=%d, want it off like on the traced socket", got.nodelay)
+	}
+}
+
+// smallMSSListener listens on loopback with an advertised MSS well below the
+// loopback MTU, which stands in for a real network path.
+func smallMSSListener(t *testing.T) net.Listener {
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG, 1000); err != nil {
+				t.Fatalf("set TCP_MAXSEG: %v", err)
+			}
+		})
+	}}
+	lis, err := lc.Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return lis
+}
+
+func TestMirrorMaxseg(t *testing.T) {
+	lis := smallMSSListener(t)
+
+	untraced, err := net.Dial("tcp4", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer untraced.Close()
+	want, err := connPath(untraced)
+	if err != nil {
+		t.Fatalf("read untraced MSS: %v", err)
+	}
+
+	g := &global.Global{Config: config.New()}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if errno, err := sock.Connect(netip.MustParseAddrPort(lis.Addr().String()), nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v err=%v", errno, err)
+	}
+
+	got, err := unix.GetsockoptInt(sock.FD.FD(), unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+	if err != nil {
+		t.Fatalf("get TCP_MAXSEG: %v", err)
+	}
+	if got != want.mss {
+		t.Errorf("got TCP_MAXSEG=%d on the traced socket, want %d like untraced", got, want.mss)
+	}
+	if mss, ok := sock.MaxSeg(); ok {
+		t.Errorf("got MaxSeg()=%d, want the kernel's value to stand", mss)
+	}
+}
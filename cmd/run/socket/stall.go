@@ -0,0 +1,220 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/tracer"
+)
+
+// ProxyStallTimeout is how long both directions of a proxied connection may
+// have bytes waiting to be forwarded without a single one moving before the
+// connection is reported as deadlocked. Applications deadlock like that
+// untraced too, when both ends write more than the buffers between them hold
+// before they read anything, but the report shows which buffers hold the
+// bytes so that a deadlock the proxy caused can be told apart. Zero disables
+// the watchdog.
+var ProxyStallTimeout = 30 * time.Second
+
+// proxyStallInterval is how often the watchdog looks at every proxy.
+const proxyStallInterval = time.Second
+
+var startStallWatchdog sync.Once
+
+// stallWatch is what the watchdog knows about a proxy. The bufConns are the
+// two sides of the proxy, which count every byte it forwards.
+type stallWatch struct {
+	timeout           time.Duration
+	process, external *bufConn
+
+	// Only the watchdog goroutine uses these.
+	last     [4]uint64 // the byte counts at the last progress
+	since    time.Time // of the last progress
+	reported bool
+
+	stalled atomic.Bool // whether the connection is stalled right now
+}
+
+// watchStalls starts watching the proxy for stalls once it copies between
+// process and external.
+func (p *proxy) watchStalls(process, external *bufConn) {
+	if ProxyStallTimeout <= 0 {
+		return
+	}
+	p.stall.Store(&stallWatch{timeout: ProxyStallTimeout, process: process, external: external, since: time.Now()})
+	startStallWatchdog.Do(func() { go stallWatchdog() })
+}
+
+func stallWatchdog() {
+	ticker := time.NewTicker(proxyStallInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		running.mu.Lock()
+		proxies := make([]*proxy, 0, len(running.proxies))
+		for p := range running.proxies {
+			proxies = append(proxies, p)
+		}
+		running.mu.Unlock()
+
+		for _, p := range proxies {
+			if w := p.stall.Load(); w != nil {
+				w.check(p, now)
+			}
+		}
+	}
+}
+
+// check reports the proxy if nothing moved in either direction for the
+// timeout although both have bytes waiting. It's reported once per stall.
+func (w *stallWatch) check(p *proxy, now time.Time) {
+	counts := [4]uint64{w.process.nread.Load(), w.process.nwritten.Load(), w.external.nread.Load(), w.external.nwritten.Load()}
+	if counts != w.last {
+		w.last, w.since, w.reported = counts, now, false
+		w.stalled.Store(false)
+		return
+	}
+	if w.reported || now.Sub(w.since) < w.timeout {
+		return
+	}
+
+	b := p.readOccupancy()
+	if b.sending() == 0 || b.receiving() == 0 {
+		return
+	}
+	w.reported = true
+	w.stalled.Store(true)
+	stallMetrics.stalls.Add(1)
+	p.publishStall(now.Sub(w.since), b)
+}
+
+// bufferOccupancy is how many bytes a socket holds that the application on it
+// hasn't read yet (inq) or that its peer hasn't acknowledged yet (outq), and
+// the size of the buffers they're in.
+type bufferOccupancy struct {
+	inq, outq int
+	socketBuffers
+}
+
+func (o bufferOccupancy) String() string {
+	return fmt.Sprintf("in %d/%d out %d/%d", o.inq, o.rcv, o.outq, o.snd)
+}
+
+// readOccupancy reads the occupancy of socket fd.
+func readOccupancy(fd int) (bufferOccupancy, error) {
+	var ret bufferOccupancy
+	var err error
+	if ret.socketBuffers, err = readBuffers(fd); err != nil {
+		return bufferOccupancy{}, err
+	}
+	if ret.inq, err = unix.IoctlGetInt(fd, unix.SIOCINQ); err != nil {
+		return bufferOccupancy{}, fmt.Errorf("ioctl SIOCINQ: %w", err)
+	}
+	if ret.outq, err = unix.IoctlGetInt(fd, unix.SIOCOUTQ); err != nil {
+		return bufferOccupancy{}, fmt.Errorf("ioctl SIOCOUTQ: %w", err)
+	}
+	return ret, nil
+}
+
+// proxyOccupancy is the occupancy of the three sockets of a proxy: the
+// tracee's, and the process and external sides of the proxy. held is the
+// number of bytes the proxy read from one side and hasn't written to the
+// other yet in each direction. It's only meaningful if the proxy forwards the
+// bytes unchanged, so it isn't counted as waiting, but it's reported.
+type proxyOccupancy struct {
+	tracee, process, external  bufferOccupancy
+	heldSending, heldReceiving int64
+}
+
+// sending is the number of bytes waiting on their way from the tracee to its
+// peer.
+func (o proxyOccupancy) sending() int64 {
+	return int64(o.tracee.outq + o.process.inq + o.external.outq)
+}
+
+// receiving is the number of bytes waiting on their way from the peer to the
+// tracee.
+func (o proxyOccupancy) receiving() int64 {
+	return int64(o.external.inq + o.process.outq + o.tracee.inq)
+}
+
+func (p *proxy) readOccupancy() proxyOccupancy {
+	var ret proxyOccupancy
+	if p.socket != nil && p.socket.FD.IncRef() {
+		ret.tracee, _ = readOccupancy(p.socket.FD.FD())
+		p.socket.FD.DecRef()
+	}
+	for _, side := range []struct {
+		conn streamConn
+		dst  *bufferOccupancy
+	}{
+		{p.process, &ret.process},
+		{p.external, &ret.external},
+	} {
+		if err := controlConn(side.conn, func(fd int) error {
+			var err error
+			*side.dst, err = readOccupancy(fd)
+			return err
+		}); err != nil {
+			slog.Debug("failed to read socket buffer occupancy", "proxy", p, "conn", side.conn.LocalAddr(), "err", err) // not fatal
+		}
+	}
+	if w := p.stall.Load(); w != nil {
+		ret.heldSending = int64(w.process.nread.Load()) - int64(w.external.nwritten.Load())
+		ret.heldReceiving = int64(w.external.nread.Load()) - int64(w.process.nwritten.Load())
+	}
+	return ret
+}
+
+// stallMetrics counts the stalls reported across all proxies.
+var stallMetrics struct {
+	stalls atomic.Uint64
+}
+
+// Stalls returns the number of stalled connections reported so far.
+func Stalls() uint64 {
+	return stallMetrics.stalls.Load()
+}
+
+// publishStall logs a stalled connection and publishes a connection event
+// with the buffer occupancy of its sockets.
+func (p *proxy) publishStall(d time.Duration, b proxyOccupancy) {
+	slog.Warn("proxied connection stalled with bytes waiting in both directions", "proxy", p, "duration", d.Round(time.Second),
+		"tracee", b.tracee, "process", b.process, "external", b.external, "heldSending", b.heldSending, "heldReceiving", b.heldReceiving)
+
+	if p.global == nil || p.global.Config == nil {
+		return
+	}
+	ev := p.tmpl.Copy()
+	p.setDestinationTags(ev, "")
+	ev.Set("proxy_stall_seconds", fmt.Sprintf("%d", int64(d.Seconds())))
+	ev.Set("proxy_stall_sending_bytes", fmt.Sprintf("%d", b.sending()))
+	ev.Set("proxy_stall_receiving_bytes", fmt.Sprintf("%d", b.receiving()))
+	for _, side := range []struct {
+		name string
+		o    bufferOccupancy
+	}{
+		{"tracee", b.tracee},
+		{"process", b.process},
+		{"external", b.external},
+	} {
+		ev.Set(fmt.Sprintf("proxy_stall_%s_inq", side.name), fmt.Sprintf("%d", side.o.inq))
+		ev.Set(fmt.Sprintf("proxy_stall_%s_outq", side.name), fmt.Sprintf("%d", side.o.outq))
+		ev.Set(fmt.Sprintf("proxy_stall_%s_rcvbuf", side.name), fmt.Sprintf("%d", side.o.rcv))
+		ev.Set(fmt.Sprintf("proxy_stall_%s_sndbuf", side.name), fmt.Sprintf("%d", side.o.snd))
+	}
+	ev.Set("proxy_stall_held_sending", fmt.Sprintf("%d", b.heldSending))
+	ev.Set("proxy_stall_held_receiving", fmt.Sprintf("%d", b.heldReceiving))
+
+	dir := "from"
+	if p.isOutgoing {
+		dir = "to"
+	}
+	go tracer.PublishConnection(p.global, ev, fmt.Sprintf("connection %s %s stalled for %s with %d bytes waiting to be sent and %d to be received", dir, p.bandwidth().Host, d.Round(time.Second), b.sending(), b.receiving()))
+}
@@ -0,0 +1,358 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/tracer"
+)
+
+// connectTraced connects a traced socket to addr with the kernel's default
+// buffers, after calling setup on it if it's set.
+func connectTraced(t *testing.T, addr netip.AddrPort, setup func(fd int)) (*Socket, net.Conn) {
+	g := &global.Global{Config: config.New()}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	if setup != nil {
+		setup(sock.FD.FD())
+	}
+	if errno, err := sock.Connect(addr, nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v, err=%v", errno, err)
+	}
+	conn := traceeConn(t, sock)
+	if conn == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return sock, conn
+}
+
+// defaultBuffers returns the default size of TCP send and receive buffers.
+func defaultBuffers() (int, int) {
+	read := func(path string, fallback int) int {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fallback
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) != 3 {
+			return fallback
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return fallback
+		}
+		return n
+	}
+	return read("/proc/sys/net/ipv4/tcp_wmem", 16384), read("/proc/sys/net/ipv4/tcp_rmem", 131072)
+}
+
+// echoRequest writes the whole request before it reads anything from conn,
+// like an application that waits for the response. It reports false if the
+// write didn't finish within the timeout, which is a deadlock since the server
+// echoes the request while it reads it.
+func echoRequest(t *testing.T, conn net.Conn, head string, size int, timeout time.Duration) ([]byte, bool) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(append([]byte(head), body...)); err != nil {
+		return nil, false
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return body, true
+}
+
+// TestLargeRequestEcho writes requests of sizes around the default socket
+// buffers to servers that echo them while they read them, before reading
+// anything back. Whatever doesn't deadlock untraced mustn't through the proxy.
+func TestLargeRequestEcho(t *testing.T) {
+	raw, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer raw.Close()
+	go func() {
+		for {
+			conn, err := raw.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).EnableFullDuplex()
+		w.Header().Set("content-type", "application/octet-stream")
+		io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+
+	snd, rcv := defaultBuffers()
+	var sizes []int
+	for _, n := range []int{snd, rcv} {
+		sizes = append(sizes, n-1, n, n+1)
+	}
+	sizes = append(sizes, snd+rcv, 2*rcv)
+
+	for _, tt := range []struct {
+		name string
+		addr string
+		head func(size int) string
+		read func(r io.Reader, size int) ([]byte, error)
+	}{
+		{"raw", raw.Addr().String(), func(int) string { return "" }, func(r io.Reader, size int) ([]byte, error) {
+			b := make([]byte, size)
+			_, err := io.ReadFull(r, b)
+			return b, err
+		}},
+		{"http/1", echo.Listener.Addr().String(), func(size int) string {
+			return fmt.Sprintf("POST /echo HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", size)
+		}, func(r io.Reader, size int) ([]byte, error) {
+			resp, err := http.ReadResponse(bufio.NewReader(r), nil)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			return io.ReadAll(resp.Body)
+		}},
+	} {
+		addr := netip.MustParseAddrPort(tt.addr)
+		for _, size := range sizes {
+			untraced, err := net.Dial("tcp4", tt.addr)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			_, ok := echoRequest(t, untraced, tt.head(size), size, 2*time.Second)
+			untraced.Close()
+			if !ok {
+				t.Logf("%s: %d bytes deadlock untraced", tt.name, size)
+				continue
+			}
+
+			_, conn := connectTraced(t, addr, nil)
+			body, ok := echoRequest(t, conn, tt.head(size), size, 10*time.Second)
+			if !ok {
+				t.Errorf("%s: %d bytes deadlock through the proxy but not untraced", tt.name, size)
+				continue
+			}
+			if got, err := tt.read(conn, size); err != nil || !bytes.Equal(got, body) {
+				t.Errorf("%s: %d bytes: got %d bytes back, err=%v", tt.name, size, len(got), err)
+			}
+			conn.Close()
+		}
+	}
+}
+
+// TestMatchBuffers checks that the proxy's sockets are at least as large as
+// the ones of the traced socket, both when it connects and when it sets them
+// afterwards.
+func TestMatchBuffers(t *testing.T) {
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	sock, conn := connectTraced(t, netip.MustParseAddrPort(lis.Addr().String()), func(fd int) {
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, 150000)
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, 160000)
+	})
+	check := func(when string) {
+		t.Helper()
+		want, err := readBuffers(sock.FD.FD())
+		if err != nil {
+			t.Fatalf("read traced socket buffers: %v", err)
+		}
+		p := sock.Inode.state.Load().connected.proxy
+		for _, conn := range []streamConn{p.process, p.external} {
+			var got socketBuffers
+			if err := controlConn(conn, func(fd int) error {
+				got, err = readBuffers(fd)
+				return err
+			}); err != nil {
+				t.Fatalf("read proxy socket buffers: %v", err)
+			}
+			if got.snd < want.snd || got.rcv < want.rcv {
+				t.Errorf("%s: got buffers %+v on %s, want at least %+v", when, got, conn.LocalAddr(), want)
+			}
+		}
+	}
+	check("connect")
+
+	if errno := sock.SetBuffer(unix.SO_RCVBUF, 200000); errno != 0 {
+		t.Fatalf("set SO_RCVBUF: %v", errno)
+	}
+	check("setsockopt")
+
+	// The proxy reads ProxyStallTimeout once it starts, so it mustn't outlive
+	// the test.
+	lis.Close()
+	conn.Close()
+	finishProxy(t, sock.Inode.state.Load().connected.proxy, sock)
+}
+
+// TestProxyStall deadlocks a connection whose ends both write without ever
+// reading and checks that it's reported with the occupancy of its buffers.
+func TestProxyStall(t *testing.T) {
+	prev := ProxyStallTimeout
+	ProxyStallTimeout = time.Second
+	t.Cleanup(func() { ProxyStallTimeout = prev })
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	blast := func(conn net.Conn) {
+		b := make([]byte, 64<<10)
+		for {
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		blast(conn)
+	}()
+
+	before := Stalls()
+	_, conn := connectTraced(t, netip.MustParseAddrPort(lis.Addr().String()), nil)
+	go blast(conn)
+
+	dest := lis.Addr().String()
+	var tags map[string]string
+	testutil.WaitFor(t, "the stall event", func() bool {
+		for _, ev := range tracer.RecentConnections() {
+			if ev["dest_addr"] == dest && ev["proxy_stall_seconds"] != "" {
+				tags = ev
+			}
+		}
+		return tags != nil
+	})
+	for _, tag := range []string{"proxy_stall_sending_bytes", "proxy_stall_receiving_bytes", "proxy_stall_process_rcvbuf", "proxy_stall_external_sndbuf"} {
+		if n, err := strconv.Atoi(tags[tag]); err != nil || n <= 0 {
+			t.Errorf("got %s=%q, want a positive number", tag, tags[tag])
+		}
+	}
+	if Stalls() <= before {
+		t.Errorf("stall counter not incremented")
+	}
+	for _, info := range Proxies() {
+		if info.External.Remote == dest && !info.Stalled {
+			t.Errorf("proxy not reported as stalled: %+v", info)
+		}
+	}
+}
+
+// TestPipelinedReadAhead pipelines a large request behind a small one to a
+// server that reads both before it answers either, which the proxy must
+// forward without waiting for the parser to get to the second one.
+func TestPipelinedReadAhead(t *testing.T) {
+	const size = 256 << 10
+	first := "GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	second := fmt.Sprintf("POST /second HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\n\r\n%s", size, strings.Repeat("x", size))
+	const resp = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+	for _, tt := range []struct {
+		name    string
+		backlog int
+		shed    bool
+	}{
+		{"buffered", maxTapBacklog, false},
+		{"shed", 64 << 10, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			prevBacklog, prevTimeout := maxTapBacklog, tapStallTimeout
+			maxTapBacklog, tapStallTimeout = tt.backlog, 100*time.Millisecond
+			t.Cleanup(func() { maxTapBacklog, tapStallTimeout = prevBacklog, prevTimeout })
+
+			lis, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			defer lis.Close()
+			got := make(chan string, 1)
+			go func() {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				b := make([]byte, len(first)+len(second))
+				n, _ := io.ReadFull(conn, b)
+				got <- string(b[:n])
+				io.WriteString(conn, resp+resp)
+			}()
+
+			before := Parser().ByPattern["backlog"]
+			sock, conn := dialTraced(t, netip.MustParseAddrPort(lis.Addr().String()))
+			if conn == nil {
+				t.FailNow()
+			}
+			defer sock.Close()
+			defer conn.Close()
+
+			go io.WriteString(conn, first+second)
+			select {
+			case b := <-got:
+				if b != first+second {
+					t.Fatalf("server got %d bytes, want %d", len(b), len(first+second))
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for the server")
+			}
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if b, err := io.ReadAll(io.LimitReader(conn, int64(2*len(resp)))); err != nil || string(b) != resp+resp {
+				t.Fatalf("got responses %q, err=%v", b, err)
+			}
+
+			if tt.shed {
+				shedEvent(t, "backlog")
+				if Parser().ByPattern["backlog"] <= before {
+					t.Errorf("shed counter not incremented: %+v", Parser())
+				}
+			} else if Parser().ByPattern["backlog"] != before {
+				t.Errorf("shed a parser that was only behind by %d bytes", size)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+
+	"subtrace.dev/cmd/run/tls"
+	"subtrace.dev/tracer"
+)
+
+// proxyTLSDryRun passes a TLS connection through like with -tls=false while
+// watching its handshake to forecast whether intercepting it would work.
+func (p *proxy) proxyTLSDryRun(cli, srv *bufConn) error {
+	if !p.isOutgoing {
+		return p.proxyUncaptured(cli, srv, "tls", tracer.ReasonTLSIncoming, "")
+	}
+	p.decide(tracer.Decision{Layer: "tls", Verdict: "not_intercepted", Reason: tracer.ReasonTLSDryRun}, tracer.CaptureNone)
+
+	// The forecast is recorded as soon as the server's plaintext flight is
+	// complete so that long-lived connections are in the report too, or when
+	// the connection ends if that never happens.
+	obs := new(tls.HandshakeObserver)
+	var once sync.Once
+	var outcome string
+	record := func() { once.Do(func() { outcome = p.recordTLSDryRun(obs) }) }
+	srvTap := writerFunc(func(b []byte) (int, error) {
+		obs.Server().Write(b)
+		if obs.Complete() {
+			record()
+		}
+		return len(b), nil
+	})
+
+	err := p.proxyRaw(cli, srv, obs.Client(), srvTap)
+	record()
+	p.tmpl = p.tmpl.Copy()
+	p.tmpl.Set("tls_dry_run_outcome", outcome)
+	return err
+}
+
+// recordTLSDryRun adds the forecast for the observed handshake to the report
+// and returns its outcome.
+func (p *proxy) recordTLSDryRun(obs *tls.HandshakeObserver) string {
+	hello, flight, err := obs.Result()
+	key := p.external.RemoteAddr().String()
+	if hello != nil && hello.ServerName != "" {
+		key = hello.ServerName
+		observeHostname(p.external, hello.ServerName)
+	}
+
+	var findings []tls.Finding
+	if err != nil {
+		findings = []tls.Finding{{Outcome: tls.OutcomeExclude, Reason: "cannot parse ClientHello: " + err.Error()}}
+	} else {
+		ts := tls.ProcessTrustStore(p.tmpl.Get("process_id"), p.tmpl.Get("process_executable_name"))
+		findings = tls.Forecast(hello, flight, ts)
+	}
+	tls.RecordDryRun(key, p.tmpl.Get("process_executable_name"), hello, flight, findings)
+
+	outcome := tls.OutcomeClean
+	for _, f := range findings {
+		if f.Outcome != tls.OutcomeClean {
+			outcome = f.Outcome
+		}
+	}
+	slog.Debug("forecast TLS interception", "proxy", p, "serverName", key, "outcome", outcome, "findings", findings)
+	return outcome
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
+
+var _ io.Writer = writerFunc(nil)
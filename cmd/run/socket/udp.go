@@ -0,0 +1,188 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+	"subtrace.dev/event"
+	"subtrace.dev/tracer"
+)
+
+// Datagram (SOCK_DGRAM) sockets are tracked, but unlike stream sockets they're
+// not proxied through a second socket. The tracee's socket is created by us in
+// its network namespace, so it already is the external socket: the kernel
+// binds, connects and carries every datagram itself. That keeps datagram
+// boundaries, the destination of every sendto(2) and the source address that
+// recvfrom(2) reports exactly as they'd be without subtrace. A relay on
+// loopback couldn't do the last one, and resolvers like glibc's drop answers
+// that don't come from the nameserver's address.
+//
+// What the tracee does with the socket is observed instead: connect(2) always,
+// every datagram sent through an emulated sendmsg(2) if write accounting is
+// enabled, and DNS queries and responses if TraceDNS is. It's published as a
+// connection event when the socket is closed.
+
+// isDatagramType reports whether a socket(2) type, including SOCK_NONBLOCK and
+// SOCK_CLOEXEC, is SOCK_DGRAM.
+func isDatagramType(typ int) bool {
+	return typ&^(unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC) == unix.SOCK_DGRAM
+}
+
+const (
+	maxDatagramPeers     = 16
+	maxDatagramQuestions = 16
+)
+
+// datagramFlow is what has been observed of a datagram socket.
+type datagramFlow struct {
+	mu        sync.Mutex
+	connected netip.AddrPort
+	peers     []netip.AddrPort // in order of first use, at most maxDatagramPeers
+	morePeers int
+	datagrams uint64 // sent through an emulated send
+	bytes     uint64
+	questions []string // DNS question names, at most maxDatagramQuestions
+}
+
+func (f *datagramFlow) addPeerLocked(addr netip.AddrPort) {
+	for _, peer := range f.peers {
+		if peer == addr {
+			return
+		}
+	}
+	if len(f.peers) < maxDatagramPeers {
+		f.peers = append(f.peers, addr)
+	} else {
+		f.morePeers++
+	}
+}
+
+// record accounts a datagram sent to addr, or to the connected peer if addr
+// isn't valid.
+func (f *datagramFlow) record(addr netip.AddrPort, b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !addr.IsValid() {
+		addr = f.connected
+	}
+	f.datagrams++
+	f.bytes += uint64(len(b))
+	if !addr.IsValid() {
+		return
+	}
+	f.addPeerLocked(addr)
+	if addr.Port() == 53 && len(f.questions) < maxDatagramQuestions {
+		if name, ok := dnsQuestion(b); ok && !slices.Contains(f.questions, name) {
+			f.questions = append(f.questions, name)
+		}
+	}
+}
+
+// dnsQuestion returns the name asked by a DNS query.
+func dnsQuestion(b []byte) (string, bool) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(b)
+	if err != nil || hdr.Response {
+		return "", false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(q.Name.String(), "."), true
+}
+
+// IsDatagram reports whether the socket is a SOCK_DGRAM socket, whose
+// syscalls are left to the kernel.
+func (ino *Inode) IsDatagram() bool {
+	return ino.flow != nil
+}
+
+// ObserveConnect records a connect(2) on a datagram socket. The kernel does
+// the connect itself.
+func (s *Socket) ObserveConnect(addr netip.AddrPort) {
+	f := s.Inode.flow
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = unmapAddrPort(addr)
+	f.addPeerLocked(f.connected)
+	slog.Debug("observed datagram socket connect", "sock", s, "addr", addr)
+}
+
+// SendTo is Send with a destination address, for datagram sockets.
+func (s *Socket) SendTo(b []byte, flags int, addr netip.AddrPort) (int, syscall.Errno) {
+	if !s.FD.IncRef() {
+		return 0, unix.EBADF
+	}
+	defer s.FD.DecRef()
+
+	var sa unix.Sockaddr
+	switch s.Inode.Domain {
+	case unix.AF_INET:
+		if !addr.Addr().Is4() {
+			return 0, unix.EAFNOSUPPORT
+		}
+		sa = &unix.SockaddrInet4{Addr: addr.Addr().As4(), Port: int(addr.Port())}
+	case unix.AF_INET6:
+		sa = &unix.SockaddrInet6{Addr: addr.Addr().As16(), Port: int(addr.Port())}
+	}
+
+	n, err := unix.SendmsgN(s.FD.FD(), b, nil, sa, flags|unix.MSG_NOSIGNAL)
+	if err != nil {
+		var errno syscall.Errno
+		if !errors.As(err, &errno) {
+			panic(fmt.Errorf("cannot interpret sendmsg(2) error as errno: %w", err))
+		}
+		return 0, errno
+	}
+
+	s.Inode.AccountWrite(n)
+	s.Inode.flow.record(unmapAddrPort(addr), b[:n])
+	if TraceDNS {
+		s.ObserveDNSSend(addr, b[:n])
+	}
+	return n, 0
+}
+
+// publishDatagramFlow publishes what was observed of a datagram socket once
+// its last file descriptor is closed. Sockets that were never connected and
+// never sent anything through an emulated send aren't published.
+func (s *Socket) publishDatagramFlow() {
+	f := s.Inode.flow
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.peers) == 0 {
+		return
+	}
+
+	ev := s.tmpl.Copy()
+	ev.Set("socket_type", "dgram")
+	ev.Set("dest_addr", event.Intern(f.peers[0].String()))
+	ev.Set("dest_family", addrFamily(f.peers[0].Addr()))
+	ev.Set("udp_peer_count", fmt.Sprintf("%d", len(f.peers)+f.morePeers))
+	if f.datagrams > 0 {
+		ev.Set("udp_datagrams_sent", fmt.Sprintf("%d", f.datagrams))
+		ev.Set("udp_bytes_sent", fmt.Sprintf("%d", f.bytes))
+	}
+	if len(f.questions) > 0 {
+		ev.Set("dns_question", strings.Join(f.questions, ","))
+	}
+	tracer.AddDecision(ev, tracer.Decision{Layer: "socket", Verdict: "observed", Reason: tracer.ReasonNotProxied, Detail: "udp"}, tracer.CaptureNone)
+
+	summary := fmt.Sprintf("udp %s", f.peers[0])
+	if len(f.questions) > 0 {
+		summary += " " + strings.Join(f.questions, ",")
+	}
+	go tracer.PublishConnection(s.global, ev, summary)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+)
+
+// udpEcho serves a UDP socket that echoes every datagram back.
+func udpEcho(t *testing.T) netip.AddrPort {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		b := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDPAddrPort(b[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestDatagramSocket(t *testing.T) {
+	g := &global.Global{Config: config.New()}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_DGRAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if !sock.Inode.IsDatagram() {
+		t.Fatalf("got a stream socket, want a datagram socket")
+	}
+
+	other, connected := udpEcho(t), udpEcho(t)
+
+	recv := func(want []byte, from netip.AddrPort) {
+		t.Helper()
+		b := make([]byte, 65536)
+		n, sa, err := unix.Recvfrom(sock.FD.FD(), b, 0)
+		if err != nil {
+			t.Fatalf("recvfrom: %v", err)
+		}
+		sa4 := sa.(*unix.SockaddrInet4)
+		if got := netip.AddrPortFrom(netip.AddrFrom4(sa4.Addr), uint16(sa4.Port)); got != from {
+			t.Errorf("got datagram from %v, want %v", got, from)
+		}
+		if !slices.Equal(b[:n], want) {
+			t.Errorf("got %d byte datagram, want %d bytes", n, len(want))
+		}
+	}
+
+	// Datagrams keep their boundaries whether they're sent to an address or to
+	// the connected peer.
+	if n, errno := sock.SendTo([]byte("other"), 0, other); errno != 0 || n != 5 {
+		t.Fatalf("sendto: n=%d, errno=%v", n, errno)
+	}
+	recv([]byte("other"), other)
+
+	// The tracee's connect(2) continues in the kernel after the handler.
+	sock.ObserveConnect(connected)
+	if err := unix.Connect(sock.FD.FD(), &unix.SockaddrInet4{Addr: connected.Addr().As4(), Port: int(connected.Port())}); err != nil {
+		t.Fatalf("connect(2): %v", err)
+	}
+	sizes := []int{1, 1400, 3}
+	for _, size := range sizes {
+		b := make([]byte, size)
+		if n, errno := sock.Send(b, 0); errno != 0 || n != size {
+			t.Fatalf("send: n=%d, errno=%v", n, errno)
+		}
+	}
+	for _, size := range sizes {
+		recv(make([]byte, size), connected)
+	}
+
+	f := sock.Inode.flow
+	if want := []netip.AddrPort{other, connected}; !slices.Equal(f.peers, want) {
+		t.Errorf("got peers %v, want %v", f.peers, want)
+	}
+	if f.datagrams != 4 || f.bytes != 1409 {
+		t.Errorf("got %d datagrams and %d bytes, want 4 and 1409", f.datagrams, f.bytes)
+	}
+}
+
+func TestDNSQuestion(t *testing.T) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatalf("build query: %v", err)
+	}
+
+	var f datagramFlow
+	f.record(netip.MustParseAddrPort("10.0.0.53:53"), query)
+	f.record(netip.MustParseAddrPort("10.0.0.53:53"), query)
+	f.record(netip.MustParseAddrPort("10.0.0.53:5353"), query)
+	f.record(netip.MustParseAddrPort("10.0.0.53:53"), []byte("not dns"))
+	if want := []string{"example.com"}; !slices.Equal(f.questions, want) {
+		t.Errorf("got questions %q, want %q", f.questions, want)
+	}
+}
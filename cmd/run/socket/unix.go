@@ -0,0 +1,405 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/cmd/run/capability"
+	"subtrace.dev/cmd/run/fd"
+	"subtrace.dev/event"
+)
+
+// AF_UNIX stream sockets are proxied like TCP sockets so that HTTP over unix
+// domain sockets (the Docker API on /var/run/docker.sock, gunicorn behind
+// nginx) is parsed like any other connection. The process side of the proxy
+// is a connection to a listener in the abstract namespace instead of a
+// loopback TCP connection, and the external side is a connection to the path
+// the tracee connected to or a listener bound to the path it listens on.
+//
+// Addresses are strings like net.UnixAddr names: a path, a name in the
+// abstract namespace with a leading "@", or "" for an unnamed socket. Only the
+// byte stream goes through the proxy, so file descriptors and credentials sent
+// as ancillary data (SCM_RIGHTS, SCM_CREDENTIALS) never reach the peer.
+// SO_PEERCRED is answered from the external connection (see peercred.go).
+
+// TraceUnix makes socket(2) create traced AF_UNIX stream sockets. Without it,
+// they're left to the kernel.
+var TraceUnix = true
+
+func init() {
+	capability.RegisterFeature("unix_sockets", func() capability.Feature {
+		return capability.Feature{Available: true, Enabled: TraceUnix}
+	})
+}
+
+// unixAddrName returns the name of a unix domain socket address. Go reports
+// unnamed sockets as "@".
+func unixAddrName(addr net.Addr) string {
+	if addr, ok := addr.(*net.UnixAddr); ok && addr.Name != "@" {
+		return addr.Name
+	}
+	return ""
+}
+
+// newTempUnixSocket creates an AF_UNIX stream socket to hold the address an
+// AF_UNIX socket is bound to until it's connected or listening. Unlike a
+// temporary TCP socket, it can't share the address with another socket, so it
+// becomes the external side itself.
+func newTempUnixSocket() (*fd.FD, error) {
+	ret, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("create temp unix socket: %w", err)
+	}
+	fd := fd.NewFD(ret)
+	defer fd.DecRef()
+	return fd, nil
+}
+
+// closeTemp closes a temporary socket unless it's already closed.
+func closeTemp(f *fd.FD) {
+	if f.ClosingIncRef() {
+		defer f.DecRef()
+		f.Lock()
+		unix.Close(f.FD())
+	}
+}
+
+// dupFile returns a duplicate of f as an *os.File for net.FileConn and
+// net.FileListener, which duplicate it again. The caller closes both.
+func dupFile(f *fd.FD) (*os.File, error) {
+	if !f.IncRef() {
+		return nil, unix.EBADF
+	}
+	defer f.DecRef()
+
+	dup, err := unix.FcntlInt(uintptr(f.FD()), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("dup: %w", err)
+	}
+	return os.NewFile(uintptr(dup), "unix"), nil
+}
+
+func asErrno(err error, op string) (syscall.Errno, error) {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return errno, nil
+}
+
+// BindUnix binds an AF_UNIX socket to name, which the tracee passed to bind(2)
+// and which path is the same address relative to subtrace's working directory.
+// Like the tracee's bind(2) would, it creates the socket file right away, so
+// the tracee can chmod(2) it before listen(2). name is "" for autobind.
+func (s *Socket) BindUnix(name, path string) (syscall.Errno, error) {
+	if !s.FD.IncRef() {
+		return unix.EBADF, nil
+	}
+	defer s.FD.DecRef()
+
+	prev := s.Inode.state.Load()
+	switch prev.state {
+	case StatePassive:
+		if prev.passive.bind != nil {
+			return unix.EINVAL, nil // already bound
+		}
+	case StateConnected, StateConnecting, StateListening:
+		return unix.EINVAL, nil
+	case StateClosed:
+		return unix.EBADF, nil
+	}
+
+	tmp, err := enterNetns(s.Inode.netns, newTempUnixSocket)
+	if err != nil {
+		return 0, err
+	}
+	if !tmp.IncRef() {
+		return unix.EBADF, nil
+	}
+	err = unix.Bind(tmp.FD(), &unix.SockaddrUnix{Name: path})
+	if err == nil && name == "" {
+		var sa unix.Sockaddr
+		if sa, err = unix.Getsockname(tmp.FD()); err == nil {
+			name = sa.(*unix.SockaddrUnix).Name
+		}
+	}
+	tmp.DecRef()
+	if err != nil {
+		closeTemp(tmp)
+		return asErrno(err, "bind")
+	}
+
+	next := &ImmutableState{state: StatePassive}
+	next.passive.bind = tmp
+	if !s.Inode.casState(prev, next, "bind_unix", unix.ERESTART) {
+		closeTemp(tmp)
+		if path != "" && path[0] != '@' {
+			os.Remove(path)
+		}
+		return unix.ERESTART, nil
+	}
+	s.Inode.name.Store(&name)
+
+	slog.Debug("bound unix socket", "sock", s, "name", name)
+	return 0, nil
+}
+
+// ConnectUnix connects an AF_UNIX socket to name, which path is the same
+// address relative to subtrace's working directory. Unlike Connect, the
+// external connection is made before returning: there's no handshake to wait
+// for, and a connect that fails does so right away with the errno the tracee
+// sees, including EAGAIN for a non-blocking socket whose peer has a full
+// backlog. A blocking connect(2) waits for room in the backlog like it would
+// without subtrace.
+func (s *Socket) ConnectUnix(name, path string) (syscall.Errno, error) {
+	if !s.FD.IncRef() {
+		return unix.EBADF, nil
+	}
+	defer s.FD.DecRef()
+
+	var prev, mid *ImmutableState
+	for {
+		prev = s.Inode.state.Load()
+		switch prev.state {
+		case StatePassive:
+			break
+		case StateConnected:
+			return unix.EISCONN, nil
+		case StateConnecting:
+			return unix.EALREADY, nil
+		case StateListening:
+			return unix.EINVAL, nil
+		case StateClosed:
+			return unix.EBADF, nil
+		}
+
+		mid = &ImmutableState{state: StateConnecting}
+		mid.connecting.bind = prev.passive.bind
+		mid.connecting.name = name
+		if s.Inode.casState(prev, mid, "connect_unix", 0) {
+			break
+		}
+	}
+	release := func() {
+		s.Inode.casState(mid, prev, "connect_unix_release", 0)
+	}
+
+	flags, err := unix.FcntlInt(uintptr(s.FD.FD()), unix.F_GETFL, 0)
+	if err != nil {
+		release()
+		return 0, fmt.Errorf("fcntl: %w", err)
+	}
+	isBlocking := flags&unix.O_NONBLOCK == 0
+
+	slog.Debug("attempting unix socket connect", "sock", s, "name", name, "isBlocking", isBlocking)
+
+	external, errno, err := s.dialUnix(prev.passive.bind, path, isBlocking)
+	if err != nil || errno != 0 {
+		release()
+		if err != nil {
+			return 0, fmt.Errorf("dial external: %w", err)
+		}
+		return errno, nil
+	}
+
+	process, errno, err := s.connectDummyUnix()
+	if err != nil || errno != 0 {
+		external.Close()
+		release()
+		if err != nil {
+			return 0, fmt.Errorf("connect dummy: %w", err)
+		}
+		return errno, nil
+	}
+
+	proxy := newProxy(s.global, s.tmpl, true)
+	proxy.socket = s
+	proxy.process = process
+	proxy.external = external
+	proxy.tmpl = proxy.tmpl.Copy()
+	proxy.tmpl.Set("socket_family", "unix")
+	proxy.tmpl.Set("unix_peer", event.Intern(name))
+	proxy.matchBuffers(s.FD.FD())
+
+	next := &ImmutableState{state: StateConnected}
+	next.connected.proxy = proxy
+	if !s.Inode.casState(mid, next, "connect_unix_finish", unix.ERESTART) {
+		// Only close(2) can move a connecting socket to another state.
+		proxy.Close()
+		return unix.ERESTART, nil
+	}
+	if prev.passive.bind != nil {
+		// The external connection holds the address now.
+		closeTemp(prev.passive.bind)
+	}
+	go proxy.start()
+
+	slog.Debug("connected unix socket", "sock", s, "name", name)
+	return 0, nil
+}
+
+// dialUnix connects to path from bind, the temporary socket holding the
+// address the tracee bound its socket to, so that the peer sees that address,
+// or from a new unnamed socket if bind is nil.
+func (s *Socket) dialUnix(bind *fd.FD, path string, isBlocking bool) (streamConn, syscall.Errno, error) {
+	sock := bind
+	if sock == nil {
+		var err error
+		if sock, err = enterNetns(s.Inode.netns, newTempUnixSocket); err != nil {
+			return nil, 0, err
+		}
+		defer closeTemp(sock)
+	}
+	if !sock.IncRef() {
+		return nil, unix.EBADF, nil
+	}
+	defer sock.DecRef()
+
+	if !isBlocking {
+		if err := unix.SetNonblock(sock.FD(), true); err != nil {
+			return nil, 0, fmt.Errorf("set O_NONBLOCK: %w", err)
+		}
+	}
+	for {
+		err := unix.Connect(sock.FD(), &unix.SockaddrUnix{Name: path})
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			if !isBlocking && bind != nil {
+				unix.SetNonblock(sock.FD(), false)
+			}
+			errno, err := asErrno(err, "connect")
+			return nil, errno, err
+		}
+		break
+	}
+
+	f, err := dupFile(sock)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("file conn: %w", err)
+	}
+	return conn.(*net.UnixConn), 0, nil
+}
+
+// connectDummyUnix connects the tracee's socket to a listener in the abstract
+// namespace and returns the other end. Connecting a unix socket to a listener
+// with room in its backlog completes immediately, even if it's non-blocking.
+func (s *Socket) connectDummyUnix() (streamConn, syscall.Errno, error) {
+	name := fmt.Sprintf("@subtrace/%d/%016x", os.Getpid(), rand.Uint64())
+	lis, err := enterNetns(s.Inode.netns, func() (*net.UnixListener, error) {
+		return net.ListenUnix("unix", &net.UnixAddr{Name: name, Net: "unix"})
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("listen: %w", err)
+	}
+	defer lis.Close()
+
+	if err := unix.Connect(s.FD.FD(), &unix.SockaddrUnix{Name: name}); err != nil {
+		errno, err := asErrno(err, "connect")
+		return nil, errno, err
+	}
+	conn, err := lis.AcceptUnix()
+	if err != nil {
+		return nil, 0, fmt.Errorf("accept: %w", err)
+	}
+	return conn, 0, nil
+}
+
+// listenUnix is Listen for AF_UNIX sockets. The temporary socket holding the
+// tracee's address becomes the external listener, since no other socket can
+// bind it, and the tracee's own socket is autobound to a name in the abstract
+// namespace for the dispatch workers to dial.
+func (s *Socket) listenUnix(prev *ImmutableState, backlog int) (syscall.Errno, error) {
+	if prev.passive.bind == nil {
+		// Like the kernel, listen(2) on an unbound socket autobinds it.
+		if errno, err := s.BindUnix("", ""); err != nil || errno != 0 {
+			return errno, err
+		}
+		if prev = s.Inode.state.Load(); prev.state != StatePassive {
+			return unix.EINVAL, nil
+		}
+	}
+	bind := prev.passive.bind
+
+	f, err := dupFile(bind)
+	if err != nil {
+		return 0, fmt.Errorf("listener: %w", err)
+	}
+	defer f.Close()
+	n := unix.SOMAXCONN
+	if EnforceBacklog && backlog >= 0 {
+		n = backlog
+	}
+	if err := unix.Listen(int(f.Fd()), n); err != nil {
+		return asErrno(err, "external side listen")
+	}
+	lis, err := net.FileListener(f)
+	if err != nil {
+		return 0, fmt.Errorf("file listener: %w", err)
+	}
+
+	if err := unix.Bind(s.FD.FD(), &unix.SockaddrUnix{}); err != nil {
+		lis.Close()
+		return 0, fmt.Errorf("autobind: %w", err)
+	}
+	sa, err := unix.Getsockname(s.FD.FD())
+	if err != nil {
+		lis.Close()
+		return 0, fmt.Errorf("getsockname: %w", err)
+	}
+	ephemeral := &net.UnixAddr{Name: sa.(*unix.SockaddrUnix).Name, Net: "unix"}
+
+	// The listener holds the address now.
+	closeTemp(bind)
+	return s.serve(prev, lis, ephemeral, backlog, NoQoS, nil), nil
+}
+
+// UnixBindAddr returns the address of an AF_UNIX socket for getsockname(2).
+func (s *Socket) UnixBindAddr() (string, syscall.Errno) {
+	if !s.FD.IncRef() {
+		return "", unix.EBADF
+	}
+	defer s.FD.DecRef()
+
+	if s.Inode.state.Load().state == StateClosed {
+		return "", unix.EBADF
+	}
+	if name := s.Inode.name.Load(); name != nil {
+		return *name, 0
+	}
+	return "", 0
+}
+
+// UnixPeerAddr returns the address of the peer of an AF_UNIX socket for
+// getpeername(2) and accept(2): the address it's bound to. It fails with
+// ENOTCONN if the socket isn't connected.
+func (s *Socket) UnixPeerAddr() (string, syscall.Errno) {
+	if !s.FD.IncRef() {
+		return "", unix.EBADF
+	}
+	defer s.FD.DecRef()
+
+	switch cur := s.Inode.state.Load(); cur.state {
+	case StateConnected:
+		return unixAddrName(cur.connected.proxy.external.RemoteAddr()), 0
+	case StateClosed:
+		return "", unix.EBADF
+	default:
+		return "", unix.ENOTCONN
+	}
+}
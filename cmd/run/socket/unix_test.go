@@ -0,0 +1,146 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+)
+
+func createUnixSocket(t *testing.T) *Socket {
+	g := &global.Global{Config: config.New()}
+	sock, err := CreateSocket(g, event.New(), unix.AF_UNIX, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	return sock
+}
+
+// readAll reads from fd until the peer closes the connection.
+func readAll(t *testing.T, fd int) string {
+	t.Helper()
+	var b []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if n == 0 {
+			return string(b)
+		}
+		b = append(b, buf[:n]...)
+	}
+}
+
+func TestUnixConnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "docker.sock")
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	go http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+
+	sock := createUnixSocket(t)
+	if errno, err := sock.ConnectUnix("/nonexistent.sock", "/nonexistent.sock"); err != nil || errno != unix.ENOENT {
+		t.Fatalf("connect to a missing path: errno=%v, err=%v, want ENOENT", errno, err)
+	}
+	if errno, err := sock.ConnectUnix(path, path); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v, err=%v", errno, err)
+	}
+	if name, errno := sock.UnixPeerAddr(); errno != 0 || name != path {
+		t.Errorf("got peer %q (errno=%v), want %q", name, errno, path)
+	}
+	if name, errno := sock.UnixBindAddr(); errno != 0 || name != "" {
+		t.Errorf("got bind %q (errno=%v), want an unnamed socket", name, errno)
+	}
+
+	req := "GET /v1.47/containers/json HTTP/1.1\r\nHost: docker\r\nConnection: close\r\n\r\n"
+	if n, errno := sock.Send([]byte(req), 0); errno != 0 || n != len(req) {
+		t.Fatalf("send: n=%d, errno=%v", n, errno)
+	}
+	if resp := readAll(t, sock.FD.FD()); !strings.HasSuffix(resp, "GET /v1.47/containers/json") {
+		t.Errorf("got response %q", resp)
+	}
+
+	p := sock.Inode.state.Load().connected.proxy
+	finishProxy(t, p, sock)
+	if dest, addr, ok := p.destination(""); !ok || dest != path || addr.IsValid() {
+		t.Errorf("got destination %q %v, want %q", dest, addr, path)
+	}
+}
+
+func TestUnixListen(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		addr string
+	}{
+		{name: "path", addr: filepath.Join(t.TempDir(), "gunicorn.sock")},
+		{name: "abstract", addr: fmt.Sprintf("@subtrace-test/%d", os.Getpid())},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lis := createUnixSocket(t)
+			if errno, err := lis.BindUnix(tt.addr, tt.addr); err != nil || errno != 0 {
+				t.Fatalf("bind: errno=%v, err=%v", errno, err)
+			}
+			if tt.addr[0] != '@' {
+				// Like bind(2), it creates the socket file for the tracee to chmod.
+				if fi, err := os.Stat(tt.addr); err != nil || fi.Mode().Type() != os.ModeSocket {
+					t.Fatalf("stat: %v", err)
+				}
+			}
+			if errno, err := lis.Listen(8); err != nil || errno != 0 {
+				t.Fatalf("listen: errno=%v, err=%v", errno, err)
+			}
+			if err := unix.Listen(lis.FD.FD(), 8); err != nil {
+				t.Fatalf("listen(2): %v", err)
+			}
+			if name, errno := lis.UnixBindAddr(); errno != 0 || name != tt.addr {
+				t.Errorf("got bind %q (errno=%v), want %q", name, errno, tt.addr)
+			}
+
+			go func() {
+				conn, err := net.Dial("unix", tt.addr)
+				if err != nil {
+					t.Errorf("dial: %v", err)
+					return
+				}
+				defer conn.Close()
+				io.WriteString(conn, "ping")
+				conn.(*net.UnixConn).CloseWrite()
+				io.Copy(io.Discard, conn)
+			}()
+
+			srv, errno, err := lis.Accept(0)
+			if err != nil || errno != 0 {
+				t.Fatalf("accept: errno=%v, err=%v", errno, err)
+			}
+			defer srv.Close()
+			if name, errno := srv.UnixBindAddr(); errno != 0 || name != tt.addr {
+				t.Errorf("got accepted bind %q (errno=%v), want %q", name, errno, tt.addr)
+			}
+			if name, errno := srv.UnixPeerAddr(); errno != 0 || name != "" {
+				t.Errorf("got accepted peer %q (errno=%v), want an unnamed socket", name, errno)
+			}
+			if got := readAll(t, srv.FD.FD()); got != "ping" {
+				t.Errorf("got %q, want ping", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"subtrace.dev/clock"
+	"subtrace.dev/config"
+	"subtrace.dev/event"
+	"subtrace.dev/tracer"
+)
+
+const (
+	verdictAllow    = "allow"
+	verdictBlock    = "block"
+	verdictAnnotate = "annotate"
+)
+
+// verdict is the policy endpoint's decision about a request.
+type verdict struct {
+	Verdict string            `json:"verdict"`
+	Reason  string            `json:"reason,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"` // set on the event of an annotated request
+}
+
+// verdictRequest is the compact description of a request that's POSTed to the
+// policy endpoint.
+type verdictRequest struct {
+	Method      string            `json:"method"`
+	Host        string            `json:"host"`
+	Path        string            `json:"path"`
+	Template    string            `json:"template"`
+	TLS         bool              `json:"tls"`
+	Destination string            `json:"destination,omitempty"`
+	Process     verdictProcess    `json:"process"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type verdictProcess struct {
+	ID         string `json:"id,omitempty"`
+	Executable string `json:"executable,omitempty"`
+}
+
+// verdictResult is the verdict enforced on one request and where it came
+// from: the endpoint, the cache, or the configured default because the
+// endpoint failed.
+type verdictResult struct {
+	verdict
+	key    string
+	source string
+}
+
+const (
+	verdictFromEndpoint = "endpoint"
+	verdictFromCache    = "cache"
+	verdictFromError    = "error"
+)
+
+// setTags records the verdict on the request's event.
+func (r *verdictResult) setTags(ev *event.Event) {
+	ev.Set("verdict", r.Verdict)
+	ev.Set("verdict_source", r.source)
+	if r.Verdict == verdictAnnotate {
+		for k, v := range r.Tags {
+			ev.Set(k, v)
+		}
+	}
+	summary := r.Verdict + " (" + r.source + ")"
+	if r.Reason != "" {
+		summary += ": " + r.Reason
+	}
+	tracer.AddIntervention(ev, tracer.Intervention{Feature: "verdict_webhook", Rule: r.key, Summary: summary})
+}
+
+// verdictErrorTTL bounds how long the default verdict is reused after the
+// endpoint failed, so that an endpoint that's down costs one timeout per
+// second rather than one per request.
+var verdictErrorTTL = time.Second
+
+// verdictCacheMaxEntries bounds the verdict cache. Once full, new verdicts
+// aren't cached until old ones expire.
+const verdictCacheMaxEntries = 4096
+
+// verdictClient asks the policy endpoint for verdicts and caches them.
+type verdictClient struct {
+	cfg    *config.Verdicts
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedVerdict
+}
+
+type cachedVerdict struct {
+	verdict
+	expires time.Duration // clock.Default.Mono()
+}
+
+// verdictClients has a client for every verdict config, which copies of a
+// config share.
+var verdictClients sync.Map // *config.Verdicts -> *verdictClient
+
+func getVerdictClient(cfg *config.Verdicts) *verdictClient {
+	if c, ok := verdictClients.Load(cfg); ok {
+		return c.(*verdictClient)
+	}
+	c, _ := verdictClients.LoadOrStore(cfg, &verdictClient{
+		cfg: cfg,
+		// subtrace's own connections aren't traced, and the endpoint must not
+		// be reached through a proxy from the environment either.
+		client: &http.Client{Transport: &http.Transport{Proxy: nil, MaxIdleConnsPerHost: 16}},
+		cache:  make(map[string]cachedVerdict),
+	})
+	return c.(*verdictClient)
+}
+
+// get returns the verdict for a request, asking the endpoint if there's no
+// cached verdict for its key.
+func (c *verdictClient) get(key string, req *verdictRequest) *verdictResult {
+	now := clock.Default.Mono()
+	c.mu.Lock()
+	cached, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && now < cached.expires {
+		return &verdictResult{verdict: cached.verdict, key: key, source: verdictFromCache}
+	}
+
+	v, err := c.ask(req)
+	ttl, source := c.cfg.TTL(), verdictFromEndpoint
+	if err != nil {
+		slog.Debug("verdict endpoint failed, using the default verdict", "url", c.cfg.URL, "key", key, "verdict", c.cfg.OnError, "err", err)
+		v = verdict{Verdict: c.cfg.OnError, Reason: err.Error()}
+		ttl, source = min(ttl, verdictErrorTTL), verdictFromError
+	}
+	if ttl > 0 {
+		c.store(key, cachedVerdict{verdict: v, expires: clock.Default.Mono() + ttl})
+	}
+	return &verdictResult{verdict: v, key: key, source: source}
+}
+
+func (c *verdictClient) store(key string, v cachedVerdict) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.cache) >= verdictCacheMaxEntries {
+		now := clock.Default.Mono()
+		for k, old := range c.cache {
+			if now >= old.expires {
+				delete(c.cache, k)
+			}
+		}
+		if len(c.cache) >= verdictCacheMaxEntries {
+			return
+		}
+	}
+	c.cache[key] = v
+}
+
+// ask POSTs req to the endpoint and returns its verdict.
+func (c *verdictClient) ask(req *verdictRequest) (verdict, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return verdict{}, fmt.Errorf("encode: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, bytes.NewReader(b))
+	if err != nil {
+		return verdict{}, fmt.Errorf("new request: %w", err)
+	}
+	hreq.Header.Set("content-type", "application/json")
+
+	resp, err := c.client.Do(hreq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return verdict{}, fmt.Errorf("timed out after %s", c.cfg.Timeout)
+		}
+		return verdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return verdict{}, fmt.Errorf("status %s", resp.Status)
+	}
+
+	var v verdict
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&v); err != nil {
+		if ctx.Err() != nil {
+			return verdict{}, fmt.Errorf("timed out after %s", c.cfg.Timeout)
+		}
+		return verdict{}, fmt.Errorf("decode: %w", err)
+	}
+	switch v.Verdict {
+	case verdictAllow, verdictBlock, verdictAnnotate:
+	default:
+		return verdict{}, fmt.Errorf("invalid verdict %q", v.Verdict)
+	}
+	return v, nil
+}
+
+// pathTemplate replaces the path segments that look like identifiers
+// (numbers, UUIDs and long hex strings) with ":id" so that requests for
+// different resources of the same kind share a cached verdict.
+func pathTemplate(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		if isIdentifier(seg) {
+			segs[i] = ":id"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+func isIdentifier(seg string) bool {
+	if seg == "" {
+		return false
+	}
+	if _, err := uuid.Parse(seg); err == nil {
+		return true
+	}
+	digits, hex := true, len(seg) >= 16
+	for _, c := range seg {
+		switch {
+		case c >= '0' && c <= '9':
+		case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+			digits = false
+		default:
+			return false
+		}
+	}
+	return digits || hex
+}
+
+// checkVerdict returns the verdict for an outgoing request, or nil if it isn't
+// a candidate.
+func (p *proxy) checkVerdict(req *http.Request) *verdictResult {
+	cfg := p.global.Config.GetVerdicts()
+	if cfg == nil || !p.global.Config.IsVerdictCandidate(req.Method, req.Host, req.URL.Path) {
+		return nil
+	}
+
+	dest, _, ok := p.destination(req.Host)
+	if !ok {
+		dest = req.Host
+	}
+	vreq := &verdictRequest{
+		Method:      req.Method,
+		Host:        req.Host,
+		Path:        req.URL.Path,
+		Template:    pathTemplate(req.URL.Path),
+		TLS:         p.plain.Load() != nil,
+		Destination: dest,
+		Process: verdictProcess{
+			ID:         p.tmpl.Get("process_id"),
+			Executable: p.tmpl.Get("process_executable_name"),
+		},
+	}
+	if cfg.IncludeHeaders {
+		vreq.Headers = make(map[string]string, len(req.Header))
+		for name := range req.Header {
+			val := req.Header.Get(name)
+			if p.global.Config.RedactsHeader(name) {
+				val = p.global.Config.SantizeCredential(val)
+			}
+			vreq.Headers[name] = val
+		}
+	}
+
+	key := fmt.Sprintf("%s %s %s %s", vreq.Process.ID, dest, req.Method, vreq.Template)
+	return getVerdictClient(cfg).get(key, vreq)
+}
+
+// blockedError stops the rewriter at a request that was blocked, which is
+// never forwarded.
+type blockedError struct {
+	req    *http.Request
+	result *verdictResult
+}
+
+func (e *blockedError) Error() string {
+	return fmt.Sprintf("request %s %s blocked by verdict webhook", e.req.Method, e.req.URL.Path)
+}
+
+// response returns what the process gets instead of a response from the
+// server. The connection is closed after it because the rest of what the
+// process sent on it was never forwarded.
+func (e *blockedError) response() []byte {
+	body := "blocked by policy"
+	if e.result.Reason != "" {
+		body += ": " + e.result.Reason
+	}
+	body += "\n"
+	proto := "HTTP/1.1"
+	if e.req.ProtoMajor == 1 && e.req.ProtoMinor == 0 {
+		proto = "HTTP/1.0"
+	}
+	return []byte(fmt.Sprintf("%s 403 Forbidden\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", proto, len(body), body))
+}
+
+// blockDrainTimeout bounds how long a blocked request's response waits for the
+// server to finish the responses to the requests before it, after the server
+// was told that no more requests are coming.
+var blockDrainTimeout = 2 * time.Second
+
+// publishBlocked publishes the event of a blocked request with the response
+// the process got instead.
+func (p *proxy) publishBlocked(b *blockedError) {
+	ev := p.tmpl.Copy()
+	ev.Set("event_id", uuid.New().String())
+	p.setDestinationTags(ev, b.req.Host)
+	b.result.setTags(ev)
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b.response())), b.req)
+	if err != nil {
+		slog.Error("failed to parse blocked response", "proxy", p, "err", err)
+		return
+	}
+	b.req.Body = http.NoBody
+
+	parser := tracer.NewParser(p.global, ev)
+	parser.SetOutgoing(true)
+	parser.UseRequest(b.req)
+	parser.UseResponse(resp)
+	go io.Copy(io.Discard, b.req.Body)
+	go func() {
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+	}()
+	if err := parser.Finish(); err != nil {
+		slog.Error("failed to finish HAR parser for blocked request", "eventID", ev.Get("event_id"), "err", err)
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"subtrace.dev/clock"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/tracer"
+)
+
+// policyServer is a fake policy endpoint. It returns the verdict named by the
+// last segment of the request's template after sleeping for delay.
+type policyServer struct {
+	*httptest.Server
+	calls atomic.Int64
+	delay atomic.Int64
+	last  atomic.Pointer[verdictRequest]
+}
+
+func newPolicyServer(t *testing.T) *policyServer {
+	s := new(policyServer)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		var req verdictRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.last.Store(&req)
+		select {
+		case <-time.After(time.Duration(s.delay.Load())):
+		case <-r.Context().Done():
+			return
+		}
+		v := verdict{Verdict: req.Template[strings.LastIndexByte(req.Template, '/')+1:], Reason: "test"}
+		if v.Verdict == verdictAnnotate {
+			v.Tags = map[string]string{"policy": "flagged"}
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func verdictConfig(url, extra string) string {
+	return fmt.Sprintf(`
+verdicts:
+  url: %s
+  timeout: 100ms
+  includeHeaders: true
+%s  candidates:
+    - path: /api/*
+    - path: /api/*/*
+`, url, extra)
+}
+
+func fakeClock(t *testing.T) *clock.Fake {
+	prev := clock.Default
+	f := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	clock.Default = clock.NewDetector(f)
+	t.Cleanup(func() { clock.Default = prev })
+	return f
+}
+
+func newVerdictRequest(t *testing.T, method, path string) *http.Request {
+	req, err := http.NewRequest(method, "http://example.com"+path, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret-token")
+	return req
+}
+
+func TestVerdictCache(t *testing.T) {
+	f := fakeClock(t)
+	srv := newPolicyServer(t)
+	p := newRewriteProxy(t, verdictConfig(srv.URL, "  cacheTTL: 10s\n"))
+	p.tmpl = event.New()
+	p.tmpl.Set("process_id", "42")
+
+	if vr := p.checkVerdict(newVerdictRequest(t, "GET", "/other")); vr != nil {
+		t.Fatalf("got verdict %+v for a request that isn't a candidate", vr)
+	}
+	if n := srv.calls.Load(); n != 0 {
+		t.Fatalf("endpoint called %d times for a request that isn't a candidate", n)
+	}
+
+	vr := p.checkVerdict(newVerdictRequest(t, "GET", "/api/123/allow?q=1"))
+	if vr == nil || vr.Verdict != verdictAllow || vr.source != verdictFromEndpoint {
+		t.Fatalf("got verdict %+v, want allow from the endpoint", vr)
+	}
+	last := srv.last.Load()
+	if last.Template != "/api/:id/allow" || last.Process.ID != "42" || last.Method != "GET" {
+		t.Errorf("got descriptor %+v", last)
+	}
+	if auth := last.Headers["Authorization"]; auth == "" || strings.Contains(auth, "secret-token") {
+		t.Errorf("got authorization header %q, want it sanitized", auth)
+	}
+
+	// Another resource of the same kind is answered from the cache.
+	vr = p.checkVerdict(newVerdictRequest(t, "GET", "/api/456/allow"))
+	if vr == nil || vr.Verdict != verdictAllow || vr.source != verdictFromCache {
+		t.Fatalf("got verdict %+v, want allow from the cache", vr)
+	}
+	if n := srv.calls.Load(); n != 1 {
+		t.Fatalf("endpoint called %d times, want 1", n)
+	}
+
+	// A different method isn't.
+	p.checkVerdict(newVerdictRequest(t, "POST", "/api/456/allow"))
+	if n := srv.calls.Load(); n != 2 {
+		t.Fatalf("endpoint called %d times, want 2", n)
+	}
+
+	f.Advance(10 * time.Second)
+	vr = p.checkVerdict(newVerdictRequest(t, "GET", "/api/789/allow"))
+	if vr == nil || vr.source != verdictFromEndpoint {
+		t.Fatalf("got verdict %+v after the TTL, want one from the endpoint", vr)
+	}
+	if n := srv.calls.Load(); n != 3 {
+		t.Fatalf("endpoint called %d times, want 3", n)
+	}
+}
+
+func TestVerdictTimeout(t *testing.T) {
+	f := fakeClock(t)
+	srv := newPolicyServer(t)
+	srv.delay.Store(int64(5 * time.Second))
+
+	for _, tt := range []struct {
+		onError string
+		want    string
+	}{
+		{"", verdictAllow},
+		{"block", verdictBlock},
+	} {
+		extra := ""
+		if tt.onError != "" {
+			extra = "  onError: " + tt.onError + "\n"
+		}
+		p := newRewriteProxy(t, verdictConfig(srv.URL, extra))
+		p.tmpl = event.New()
+
+		start := time.Now()
+		vr := p.checkVerdict(newVerdictRequest(t, "GET", "/api/block"))
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("onError=%q: waited %s for a verdict, want at most the timeout", tt.onError, d)
+		}
+		if vr == nil || vr.Verdict != tt.want || vr.source != verdictFromError {
+			t.Fatalf("onError=%q: got verdict %+v, want %s because of the timeout", tt.onError, vr, tt.want)
+		}
+
+		// A failing endpoint isn't asked again right away, but isn't given up
+		// on for the whole TTL either.
+		calls := srv.calls.Load()
+		if vr := p.checkVerdict(newVerdictRequest(t, "GET", "/api/block")); vr == nil || vr.source != verdictFromCache {
+			t.Fatalf("onError=%q: got verdict %+v, want the cached default", tt.onError, vr)
+		}
+		f.Advance(verdictErrorTTL)
+		p.checkVerdict(newVerdictRequest(t, "GET", "/api/block"))
+		if n := srv.calls.Load(); n != calls+1 {
+			t.Fatalf("onError=%q: endpoint called %d more times after %s, want 1", tt.onError, n-calls, verdictErrorTTL)
+		}
+	}
+}
+
+// TestVerdictEnforced sends an annotated and a blocked request through a traced
+// connection. The blocked request must never reach the server and the process
+// must get a 403 for it.
+func TestVerdictEnforced(t *testing.T) {
+	fakeClock(t)
+	policy := newPolicyServer(t)
+	p := newRewriteProxy(t, verdictConfig(policy.URL, ""))
+
+	events := captureEvents(t)
+
+	served := make(chan string, 8)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served <- r.URL.Path
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	g := &global.Global{Config: p.global.Config}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if errno, err := sock.Connect(netip.MustParseAddrPort(upstream.Listener.Addr().String()), nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v err=%v", errno, err)
+	}
+	conn := traceeConn(t, sock)
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	io.WriteString(conn, "GET /api/annotate HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read annotated response: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d for the annotated request, want 200", resp.StatusCode)
+	}
+
+	io.WriteString(conn, "POST /api/block HTTP/1.1\r\nHost: example.com\r\nContent-Type: text/plain\r\nContent-Length: 4\r\n\r\nbody")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read blocked response: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got status %d for the blocked request, want 403", resp.StatusCode)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("got err=%v after the blocked response, want the connection closed", err)
+	}
+	if len(served) != 1 || <-served != "/api/annotate" {
+		t.Errorf("server got %d requests, want only the annotated request", len(served)+1)
+	}
+
+	var lines []tracer.EventLogLine
+	testutil.WaitFor(t, "two events", func() bool { lines = events(); return len(lines) == 2 })
+	got := make(map[string]map[string]string)
+	for _, line := range lines {
+		got[line.Tags["verdict"]] = line.Tags
+	}
+	if tags := got[verdictAnnotate]; tags == nil || tags["policy"] != "flagged" || !strings.Contains(tags["interventions"], "verdict_webhook") {
+		t.Errorf("got annotated event tags %v", tags)
+	}
+	if tags := got[verdictBlock]; tags == nil || tags["verdict_source"] != verdictFromEndpoint || !strings.Contains(tags["interventions"], "verdict_webhook") {
+		t.Errorf("got blocked event tags %v", tags)
+	}
+}
+
+// TestVerdictSampledOut checks that requests to a blocked host are blocked on
+// connections left out by sampling too, and that only the blocked request is
+// published.
+func TestVerdictSampledOut(t *testing.T) {
+	fakeClock(t)
+	policy := newPolicyServer(t)
+	p := newRewriteProxy(t, fmt.Sprintf(`
+verdicts:
+  url: %s
+  timeout: 100ms
+  candidates:
+    - host: blocked.example.com
+`, policy.URL))
+
+	events := captureEvents(t)
+	prevRate := SampleRate
+	SampleRate = 0
+	t.Cleanup(func() { SampleRate = prevRate })
+
+	served := make(chan string, 8)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served <- r.Host
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	before := Sampled()
+	g := &global.Global{Config: p.global.Config}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if errno, err := sock.Connect(netip.MustParseAddrPort(upstream.Listener.Addr().String()), nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v err=%v", errno, err)
+	}
+	conn := traceeConn(t, sock)
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	io.WriteString(conn, "GET /api/allow HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read allowed response: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d for the allowed request, want 200", resp.StatusCode)
+	}
+
+	io.WriteString(conn, "GET /api/block HTTP/1.1\r\nHost: blocked.example.com\r\n\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read blocked response: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got status %d for the blocked request, want 403", resp.StatusCode)
+	}
+	if len(served) != 1 || <-served != "example.com" {
+		t.Errorf("server got %d requests, want only the allowed request", len(served)+1)
+	}
+	if Sampled().Out == before.Out {
+		t.Errorf("got metrics %+v, want the connection sampled out", Sampled())
+	}
+
+	var lines []tracer.EventLogLine
+	testutil.WaitFor(t, "the blocked request's event", func() bool { lines = events(); return len(lines) > 0 })
+	time.Sleep(100 * time.Millisecond)
+	if lines = events(); len(lines) != 1 || lines[0].Tags["verdict"] != verdictBlock {
+		t.Errorf("got %d events, want only the blocked request's", len(lines))
+	}
+}
+
+// TestVerdictServerClosed checks that the process gets the blocked response
+// when the server closes the connection while the request waits for its
+// verdict.
+func TestVerdictServerClosed(t *testing.T) {
+	fakeClock(t)
+	policy := newPolicyServer(t)
+	policy.delay.Store(int64(300 * time.Millisecond))
+	p := newRewriteProxy(t, fmt.Sprintf(`
+verdicts:
+  url: %s
+  timeout: 5s
+  candidates:
+    - path: /api/*
+`, policy.URL))
+
+	events := captureEvents(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		// Close the connection like a server whose idle timeout fired, once
+		// the request is being checked.
+		for policy.calls.Load() == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		conn.Close()
+	}()
+
+	g := &global.Global{Config: p.global.Config}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if errno, err := sock.Connect(netip.MustParseAddrPort(lis.Addr().String()), nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v err=%v", errno, err)
+	}
+	conn := traceeConn(t, sock)
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	io.WriteString(conn, "GET /api/block HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read blocked response: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got status %d, want 403", resp.StatusCode)
+	}
+	testutil.WaitFor(t, "the blocked request's event", func() bool {
+		lines := events()
+		return len(lines) > 0 && lines[0].Tags["verdict_source"] == verdictFromEndpoint
+	})
+}
+
+// TestVerdictHTTP2Unchecked checks that verdicts only apply to HTTP/1: an h2c
+// request that the endpoint would block is forwarded without asking it, even
+// with onError set to block.
+func TestVerdictHTTP2Unchecked(t *testing.T) {
+	policy := newPolicyServer(t)
+	p := newRewriteProxy(t, verdictConfig(policy.URL, "  onError: block\n"))
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	g := &global.Global{Config: p.global.Config}
+	sock, err := CreateSocket(g, event.New(), unix.AF_INET, unix.SOCK_STREAM)
+	if err != nil {
+		t.Fatalf("create socket: %v", err)
+	}
+	defer sock.Close()
+	if errno, err := sock.Connect(netip.MustParseAddrPort(upstream.Listener.Addr().String()), nil); err != nil || errno != 0 {
+		t.Fatalf("connect: errno=%v err=%v", errno, err)
+	}
+	conn := traceeConn(t, sock)
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	transport := &http.Transport{
+		Protocols: new(http.Protocols),
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return conn, nil
+		},
+	}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	resp, err := client.Get("http://example.com/api/block")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(b) != "HTTP/2.0" {
+		t.Errorf("got %d %q, want the request forwarded over HTTP/2", resp.StatusCode, b)
+	}
+	if n := policy.calls.Load(); n != 0 {
+		t.Errorf("got %d calls to the endpoint, want none", n)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	ws "nhooyr.io/websocket"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/tracer"
+)
+
+// wsClientFrame returns a masked frame as a client sends it.
+func wsClientFrame(fin bool, op byte, payload []byte) []byte {
+	b := []byte{op, 0x80}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b[1] |= byte(len(payload))
+	case len(payload) <= 0xffff:
+		b[1] |= 126
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b[1] |= 127
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// TestWebsocketMessages sends messages through a traced websocket to an echo
+// server, one of them fragmented around a ping and one larger than the payload
+// limit, and checks that each message in either direction gets an event that
+// points back to the handshake's.
+func TestWebsocketMessages(t *testing.T) {
+	events := captureEvents(t)
+	prevEnabled, prevLimit := isWebsocketEnabled, tracer.PayloadLimitBytes
+	isWebsocketEnabled, tracer.PayloadLimitBytes = true, 1024
+	t.Cleanup(func() { isWebsocketEnabled, tracer.PayloadLimitBytes = prevEnabled, prevLimit })
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := ws.Accept(w, r, &ws.AcceptOptions{CompressionMode: ws.CompressionDisabled})
+		if err != nil {
+			return
+		}
+		c.SetReadLimit(1 << 20)
+		for {
+			typ, b, err := c.Read(r.Context())
+			if err != nil {
+				return
+			}
+			if err := c.Write(r.Context(), typ, b); err != nil {
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	sock, conn := dialTraced(t, netip.MustParseAddrPort(upstream.Listener.Addr().String()))
+	if conn == nil {
+		t.FailNow()
+	}
+	defer sock.Close()
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: %v %v", resp, err)
+	}
+
+	large := bytes.Repeat([]byte("x"), 3000)
+	var frames []byte
+	frames = append(frames, wsClientFrame(true, wsOpcodeText, []byte("hello"))...)
+	frames = append(frames, wsClientFrame(false, wsOpcodeText, []byte("frag"))...)
+	frames = append(frames, wsClientFrame(true, wsOpcodePing, []byte("p"))...)
+	frames = append(frames, wsClientFrame(true, wsOpcodeContinuation, []byte("mented"))...)
+	frames = append(frames, wsClientFrame(true, wsOpcodeBinary, large)...)
+	frames = append(frames, wsClientFrame(true, wsOpcodeClose, append([]byte{0x03, 0xe8}, "bye"...))...)
+	if _, err := conn.Write(frames); err != nil {
+		t.Fatalf("write frames: %v", err)
+	}
+	io.Copy(io.Discard, br) // until the server closes the connection
+
+	type event struct {
+		tags map[string]string
+		msgs []*tracer.WebsocketMessage
+	}
+	var handshake string
+	var messages []event
+	testutil.WaitFor(t, "an event per message", func() bool {
+		handshake, messages = "", nil
+		for _, line := range events() {
+			var entry struct {
+				Response struct {
+					Status int `json:"status"`
+				} `json:"response"`
+				Messages []*tracer.WebsocketMessage `json:"_webSocketMessages"`
+			}
+			if json.Unmarshal(line.Entry, &entry) != nil {
+				continue
+			}
+			if line.Tags["websocket_handshake_event_id"] == "" {
+				if entry.Response.Status == http.StatusSwitchingProtocols {
+					handshake = line.Tags["event_id"]
+				}
+				continue
+			}
+			messages = append(messages, event{tags: line.Tags, msgs: entry.Messages})
+		}
+		return handshake != "" && len(messages) == 10
+	})
+
+	got := make(map[string]string)
+	for _, ev := range messages {
+		if ev.tags["websocket_handshake_event_id"] != handshake {
+			t.Errorf("got handshake event ID %q, want %q", ev.tags["websocket_handshake_event_id"], handshake)
+		}
+		if len(ev.msgs) != 1 {
+			t.Fatalf("got %d messages in an event, want 1", len(ev.msgs))
+		}
+		msg := ev.msgs[0]
+		key := ev.tags["websocket_direction"] + " " + ev.tags["websocket_opcode"]
+		if msg.Type+" "+msg.OpcodeName() != key {
+			t.Errorf("got message %s %s in an event tagged %s", msg.Type, msg.OpcodeName(), key)
+		}
+		switch msg.Opcode {
+		case wsOpcodeBinary:
+			got[key] = fmt.Sprintf("%d bytes, %s kept, truncated %s", msg.Bytes, ev.tags["websocket_payload_bytes"], ev.tags["websocket_payload_truncated"])
+			if b, _ := base64.StdEncoding.DecodeString(msg.Data); len(b) != 1024 {
+				t.Errorf("got %d bytes of %s kept, want 1024", len(b), key)
+			}
+		case wsOpcodeClose:
+			got[key] = fmt.Sprintf("%s %s", ev.tags["websocket_close_code"], ev.tags["websocket_close_reason"])
+		case wsOpcodeText:
+			if got[key] != "" {
+				key += " 2"
+			}
+			got[key] = msg.Data
+		default:
+			got[key] = fmt.Sprintf("%d bytes", msg.Bytes)
+		}
+	}
+	for key, want := range map[string]string{
+		"send text":      "hello",
+		"send text 2":    "fragmented",
+		"send ping":      "1 bytes",
+		"send binary":    "3000 bytes, 3000 kept, truncated true",
+		"send close":     "1000 bye",
+		"receive text":   "hello",
+		"receive text 2": "fragmented",
+		"receive pong":   "1 bytes",
+		"receive binary": "3000 bytes, 3000 kept, truncated true",
+		"receive close":  "1000 bye", // echoed
+	} {
+		if got[key] != want {
+			t.Errorf("%s: got %q, want %q", key, got[key], want)
+		}
+	}
+}
+
+// TestWebsocketDecompress checks that permessage-deflate messages are
+// decompressed with the context of the ones before them, and that once a
+// message is too large to be, the direction's later messages are kept as they
+// were sent.
+func TestWebsocketDecompress(t *testing.T) {
+	resp := &http.Response{Header: http.Header{"Sec-Websocket-Extensions": {"permessage-deflate"}}}
+	w, err := newWebsocket(nil, nil, resp, true)
+	if err != nil {
+		t.Fatalf("new websocket: %v", err)
+	}
+	defer w.cleanup()
+
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	compress := func(msg string) []byte {
+		buf.Reset()
+		fw.Write([]byte(msg))
+		fw.Flush()
+		return bytes.Clone(bytes.TrimSuffix(buf.Bytes(), []byte{0x00, 0x00, 0xff, 0xff}))
+	}
+
+	msg := strings.Repeat("subtrace ", 20)
+	for i := range 3 {
+		b := compress(msg)
+		data, truncated, ok := w.decompress(b, false, true)
+		if !ok || truncated || string(data) != msg {
+			t.Fatalf("message %d: got %q, %v, %v", i, data, truncated, ok)
+		}
+	}
+
+	b := compress(msg)
+	if _, _, ok := w.decompress(b[:len(b)/2], true, true); ok {
+		t.Errorf("decompressed a truncated message")
+	}
+	if _, _, ok := w.decompress(compress(msg), false, true); ok {
+		t.Errorf("decompressed a message after the context was lost")
+	}
+}
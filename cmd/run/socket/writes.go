@@ -0,0 +1,118 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// smallWrite is the size under which a write counts as small.
+	smallWrite = 100
+
+	// chattyMinWrites is the number of writes the application must have made
+	// on a connection before its pattern is judged.
+	chattyMinWrites = 32
+)
+
+// WriteSizes counts the reads or writes on one side of a proxy by size.
+type WriteSizes struct {
+	Under100 uint64 `json:"under100"`
+	Under1K  uint64 `json:"under1k"`
+	Under16K uint64 `json:"under16k"`
+	Larger   uint64 `json:"larger"`
+}
+
+// Total returns the number of reads or writes.
+func (s WriteSizes) Total() uint64 {
+	return s.Under100 + s.Under1K + s.Under16K + s.Larger
+}
+
+// WritePattern describes how the application writes on a proxied connection
+// and how the proxy writes on its behalf.
+//
+// App counts the reads on the process side, which see one write of the
+// application each unless the proxy fell behind and the kernel merged some.
+// External counts the proxy's writes on the external connection. Turns is the
+// number of times the data changed direction.
+//
+// Chatty is set for connections that go back and forth in mostly small
+// writes. On a real network, Nagle's algorithm holds back a small write until
+// the previous one is acknowledged and delayed ACKs hold back that
+// acknowledgement, so every exchange can wait up to the delayed ACK timeout
+// (40ms on Linux). The loopback connection to the proxy hides that from the
+// application, and the external connection has TCP_NODELAY unless the
+// process's options are mirrored (see MirrorSockopts).
+type WritePattern struct {
+	App      WriteSizes `json:"app"`
+	External WriteSizes `json:"external"`
+	Turns    uint64     `json:"turns"`
+	Chatty   bool       `json:"chatty,omitempty"`
+}
+
+// sizeCounts is the concurrent version of WriteSizes.
+type sizeCounts [4]atomic.Uint64
+
+func (c *sizeCounts) add(n int) {
+	switch {
+	case n < smallWrite:
+		c[0].Add(1)
+	case n < 1<<10:
+		c[1].Add(1)
+	case n < 16<<10:
+		c[2].Add(1)
+	default:
+		c[3].Add(1)
+	}
+}
+
+func (c *sizeCounts) load() WriteSizes {
+	return WriteSizes{Under100: c[0].Load(), Under1K: c[1].Load(), Under16K: c[2].Load(), Larger: c[3].Load()}
+}
+
+// Directions of the data for writePattern.dir.
+const (
+	dirNone = iota
+	dirToExternal
+	dirToProcess
+)
+
+// writePattern records a proxy's WritePattern. The bufConns of both sides
+// report every read and write to it.
+type writePattern struct {
+	app      sizeCounts
+	external sizeCounts
+	turns    atomic.Uint64
+	dir      atomic.Int32
+}
+
+// read records a read of n bytes on the process side if process is set, or on
+// the external side otherwise.
+func (w *writePattern) read(process bool, n int) {
+	if n <= 0 {
+		return
+	}
+	dir := int32(dirToProcess)
+	if process {
+		w.app.add(n)
+		dir = dirToExternal
+	}
+	if prev := w.dir.Swap(dir); prev != dirNone && prev != dir {
+		w.turns.Add(1)
+	}
+}
+
+// wrote records a write of n bytes on the external side.
+func (w *writePattern) wrote(n int) {
+	if n > 0 {
+		w.external.add(n)
+	}
+}
+
+func (w *writePattern) load() WritePattern {
+	ret := WritePattern{App: w.app.load(), External: w.external.load(), Turns: w.turns.Load()}
+	total := ret.App.Total()
+	ret.Chatty = total >= chattyMinWrites && 2*ret.App.Under100 >= total && 4*ret.Turns >= total
+	return ret
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socket
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// TestWritePattern checks that a traced server answering small requests with
+// small responses is flagged as chatty and one sending a bulk response isn't.
+func TestWritePattern(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		rounds int
+		size   int
+		chatty bool
+	}{
+		{"pingpong", 64, 16, true},
+		{"bulk", 1, 1 << 20, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lis, addr := listenTraced(t, 8)
+			client, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer client.Close()
+			srv, errno, err := lis.Accept(0)
+			if err != nil || errno != 0 {
+				t.Fatalf("accept: errno=%v, err=%v", errno, err)
+			}
+			defer srv.Close()
+			conn := traceeConn(t, srv)
+			if conn == nil {
+				t.FailNow()
+			}
+			defer conn.Close()
+
+			// The server writes tt.size bytes for every byte the client sends
+			// and the client waits for all of them before sending the next.
+			body := payload(2, tt.size)
+			served := make(chan error, 1)
+			go func() {
+				b := make([]byte, 1)
+				for range tt.rounds {
+					if _, err := io.ReadFull(conn, b); err != nil {
+						served <- err
+						return
+					}
+					if _, err := conn.Write(body); err != nil {
+						served <- err
+						return
+					}
+				}
+				served <- nil
+			}()
+			got := make([]byte, tt.size)
+			for i := range tt.rounds {
+				if _, err := client.Write([]byte{'?'}); err != nil {
+					t.Fatalf("round %d: write: %v", i, err)
+				}
+				if _, err := io.ReadFull(client, got); err != nil || !bytes.Equal(got, body) {
+					t.Fatalf("round %d: read: %v", i, err)
+				}
+			}
+			if err := <-served; err != nil {
+				t.Fatalf("serve: %v", err)
+			}
+
+			var w *WritePattern
+			for _, info := range Proxies() {
+				if info.External.Remote == client.LocalAddr().String() {
+					w = info.Writes
+				}
+			}
+			if w == nil {
+				t.Fatalf("no write pattern for the proxy")
+			}
+			if w.App.Total() == 0 || w.External.Total() == 0 {
+				t.Errorf("got app writes %+v and external writes %+v", w.App, w.External)
+			}
+			if tt.chatty && (w.App.Under100 < uint64(tt.rounds) || w.Turns < uint64(2*tt.rounds-1)) {
+				t.Errorf("got %+v, want %d small writes and %d turns", w, tt.rounds, 2*tt.rounds-1)
+			}
+			if w.Chatty != tt.chatty {
+				t.Errorf("got chatty %v, want %v: %+v", w.Chatty, tt.chatty, w)
+			}
+		})
+	}
+}
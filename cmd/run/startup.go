@@ -0,0 +1,120 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package run
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// processBegin is when this process started, as near as a package variable
+// gets to it.
+var processBegin = time.Now()
+
+// The parent passes these to the process it re-executes itself as so that the
+// time spent before the re-exec is counted and the reason is known.
+const (
+	envStartupBegin  = "_SUBTRACE_STARTUP_BEGIN" // unix nanoseconds
+	envStartupReexec = "_SUBTRACE_STARTUP_REEXEC"
+)
+
+// startup records how long each phase of starting up took before the command
+// could run. Phases are marked in order, each one taking the time since the
+// one before it.
+type startup struct {
+	mu     sync.Mutex
+	begin  time.Time
+	last   time.Time
+	reexec string
+	phases []StartupPhase
+	done   bool
+}
+
+// StartupPhase is a phase of starting up and how long it took.
+type StartupPhase struct {
+	Name   string  `json:"name"`
+	TookMs float64 `json:"tookMs"`
+}
+
+// StartupTimings is what starting up took in total and by phase.
+type StartupTimings struct {
+	TotalMs      float64        `json:"totalMs"`
+	ReexecReason string         `json:"reexecReason,omitempty"` // empty unless the parent re-executed itself
+	Phases       []StartupPhase `json:"phases"`
+	Done         bool           `json:"done"` // the command was started
+}
+
+// newStartup returns the startup of this process. If it was re-executed by
+// the parent, the time before the re-exec counts as the "reexec" phase.
+func newStartup() *startup {
+	s := &startup{begin: processBegin, last: processBegin}
+	if v := os.Getenv(envStartupBegin); v != "" {
+		os.Unsetenv(envStartupBegin)
+		if ns, err := strconv.ParseInt(v, 10, 64); err == nil && ns <= processBegin.UnixNano() {
+			s.begin = time.Unix(0, ns)
+			s.reexec = os.Getenv(envStartupReexec)
+			s.phases = append(s.phases, StartupPhase{Name: "reexec", TookMs: ms(processBegin.Sub(s.begin))})
+		}
+	}
+	os.Unsetenv(envStartupReexec)
+	return s
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// mark ends the phase with the given name.
+func (s *startup) mark(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.phases = append(s.phases, StartupPhase{Name: name, TookMs: ms(now.Sub(s.last))})
+	s.last = now
+}
+
+// finish ends the last phase once the command is started and logs the
+// timings.
+func (s *startup) finish(name string) {
+	s.mark(name)
+	s.mu.Lock()
+	s.done = true
+	s.mu.Unlock()
+
+	t := s.timings()
+	attrs := []any{"total", fmt.Sprintf("%.1fms", t.TotalMs)}
+	for _, p := range t.Phases {
+		attrs = append(attrs, p.Name, fmt.Sprintf("%.1fms", p.TookMs))
+	}
+	if t.ReexecReason != "" {
+		attrs = append(attrs, "reexecReason", t.ReexecReason)
+	}
+	slog.Debug("started command", attrs...)
+}
+
+// timings returns the phases so far.
+func (s *startup) timings() StartupTimings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StartupTimings{
+		TotalMs:      ms(s.last.Sub(s.begin)),
+		ReexecReason: s.reexec,
+		Phases:       append([]StartupPhase(nil), s.phases...),
+		Done:         s.done,
+	}
+}
+
+// serveDebugStartup serves the startup timings as JSON.
+func (c *Command) serveDebugStartup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.startup.timings()); err != nil {
+		slog.Debug("failed to write debug startup response", "err", err) // not fatal
+	}
+}
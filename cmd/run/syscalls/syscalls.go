@@ -16,6 +16,13 @@ func GetNumber(name string) int {
 	return nr
 }
 
+// Lookup returns the number of the named syscall on this architecture, if it
+// has one.
+func Lookup(name string) (int, bool) {
+	nr, ok := names[name]
+	return nr, ok
+}
+
 func GetName(nr int) string {
 	for name := range names {
 		if nr == names[name] {
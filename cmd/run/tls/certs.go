@@ -0,0 +1,123 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// maxObservedServers bounds the number of server names whose upstream leaf
+// certificate is remembered.
+const maxObservedServers = 4096
+
+// CertificateReport describes notable things about the upstream certificate
+// presented in a TLS handshake. The zero value means nothing is notable.
+type CertificateReport struct {
+	Changed    bool
+	SelfSigned bool
+	Expired    bool
+
+	Current  CertificateInfo
+	Previous CertificateInfo // only set if Changed
+}
+
+// CertificateInfo is a summary of a leaf certificate.
+type CertificateInfo struct {
+	SHA256    string
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Tags returns the report as event tags.
+func (r *CertificateReport) Tags() map[string]string {
+	tags := make(map[string]string)
+	if r.Changed {
+		tags["tls_certificate_changed"] = "true"
+		tags["tls_certificate_previous_sha256"] = r.Previous.SHA256
+		tags["tls_certificate_previous_issuer"] = r.Previous.Issuer
+		tags["tls_certificate_previous_not_before"] = r.Previous.NotBefore.UTC().Format(time.RFC3339)
+		tags["tls_certificate_previous_not_after"] = r.Previous.NotAfter.UTC().Format(time.RFC3339)
+	}
+	if r.SelfSigned {
+		tags["tls_certificate_self_signed"] = "true"
+	}
+	if r.Expired {
+		tags["tls_certificate_expired"] = "true"
+	}
+	if len(tags) > 0 {
+		tags["tls_certificate_sha256"] = r.Current.SHA256
+		tags["tls_certificate_issuer"] = r.Current.Issuer
+		tags["tls_certificate_not_before"] = r.Current.NotBefore.UTC().Format(time.RFC3339)
+		tags["tls_certificate_not_after"] = r.Current.NotAfter.UTC().Format(time.RFC3339)
+	}
+	return tags
+}
+
+var observed = struct {
+	mu     sync.Mutex
+	leaves map[string]CertificateInfo
+}{
+	leaves: make(map[string]CertificateInfo),
+}
+
+// ObserveCertificate records the leaf certificate presented by the upstream
+// server for serverName. It reports whether the certificate differs from the
+// one seen in the previous handshake with the same server name, and whether it
+// is self-signed or expired. The latter two are only reported the first time a
+// certificate is seen for the server name so that every request to a server
+// with a bad certificate isn't flagged.
+func ObserveCertificate(serverName string, chain []*x509.Certificate, now time.Time) CertificateReport {
+	if len(chain) == 0 {
+		return CertificateReport{}
+	}
+
+	leaf := chain[0]
+	sum := sha256.Sum256(leaf.Raw)
+	info := CertificateInfo{
+		SHA256:    hex.EncodeToString(sum[:]),
+		Issuer:    leaf.Issuer.String(),
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}
+
+	observed.mu.Lock()
+	prev, seen := observed.leaves[serverName]
+	if !seen && len(observed.leaves) >= maxObservedServers {
+		for name := range observed.leaves { // evict an arbitrary entry
+			delete(observed.leaves, name)
+			break
+		}
+	}
+	observed.leaves[serverName] = info
+	observed.mu.Unlock()
+
+	var r CertificateReport
+	if seen && prev.SHA256 == info.SHA256 {
+		return r
+	}
+
+	r.Current = info
+	if seen {
+		r.Changed = true
+		r.Previous = prev
+	}
+	r.SelfSigned = isSelfSigned(leaf)
+	r.Expired = now.Before(leaf.NotBefore) || now.After(leaf.NotAfter)
+	return r
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return false
+	}
+	// CheckSignatureFrom would reject leaf certificates that aren't marked as a
+	// CA, so check the signature directly.
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
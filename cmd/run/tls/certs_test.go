@@ -0,0 +1,64 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newSelfSignedCert(t *testing.T, serial int64, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+		DNSNames:     []string{"example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return cert
+}
+
+func TestObserveCertificate(t *testing.T) {
+	now := time.Now()
+	a := newSelfSignedCert(t, 1, now.Add(time.Hour))
+	b := newSelfSignedCert(t, 2, now.Add(-time.Hour))
+
+	r := ObserveCertificate("certs-test.example.com", []*x509.Certificate{a}, now)
+	if r.Changed || !r.SelfSigned || r.Expired {
+		t.Fatalf("first observation: got %+v, want self-signed only", r)
+	}
+
+	r = ObserveCertificate("certs-test.example.com", []*x509.Certificate{a}, now)
+	if tags := r.Tags(); len(tags) != 0 {
+		t.Fatalf("repeat observation: got tags %v, want none", tags)
+	}
+
+	r = ObserveCertificate("certs-test.example.com", []*x509.Certificate{b}, now)
+	if !r.Changed || !r.Expired || r.Previous.SHA256 == r.Current.SHA256 {
+		t.Fatalf("changed observation: got %+v", r)
+	}
+	if tags := r.Tags(); tags["tls_certificate_changed"] != "true" || tags["tls_certificate_previous_sha256"] == "" {
+		t.Fatalf("changed observation: got tags %v", tags)
+	}
+}
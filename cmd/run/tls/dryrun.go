@@ -0,0 +1,338 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"subtrace.dev/procfs"
+)
+
+// DryRun passes TLS connections through without intercepting them and
+// forecasts whether interception would work for each of them instead (see
+// Forecast). Enabled is false when DryRun is set.
+var DryRun bool
+
+// Mode is the value of the -tls flag: true, false or dry-run.
+type Mode struct{}
+
+func (Mode) String() string {
+	switch {
+	case DryRun:
+		return "dry-run"
+	case Enabled:
+		return "true"
+	default:
+		return "false"
+	}
+}
+
+func (Mode) Set(s string) error {
+	if s == "dry-run" {
+		Enabled, DryRun = false, true
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("want true, false or dry-run")
+	}
+	Enabled, DryRun = b, false
+	return nil
+}
+
+func (Mode) IsBoolFlag() bool { return true }
+
+// Outcomes of a forecast, from best to worst.
+const (
+	OutcomeClean   = "would_intercept_cleanly"
+	OutcomeTrust   = "needs_client_trust_configuration"
+	OutcomeExclude = "needs_exclusion"
+)
+
+func outcomeRank(outcome string) int {
+	switch outcome {
+	case OutcomeClean:
+		return 0
+	case OutcomeTrust:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Finding is one reason for a forecast's outcome.
+type Finding struct {
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason"`
+}
+
+// TrustStore describes where a process loads its trusted CA certificates
+// from, as far as its environment tells.
+type TrustStore struct {
+	Var   string // the environment variable that points to a custom bundle
+	Path  string
+	Certs int // number of certificates in the bundle, or -1 if unreadable
+	Java  bool
+}
+
+// smallTrustStore is the number of certificates at or below which a custom
+// bundle is more likely a pinned set than a CA store.
+const smallTrustStore = 3
+
+// trustVars are the environment variables that point common runtimes to a
+// CA bundle. Environ sets them to a known path when they're unset, which the
+// CA injection covers; anything else was set by the user.
+var trustVars = []string{"SSL_CERT_FILE", "REQUESTS_CA_BUNDLE", "CURL_CA_BUNDLE", "NODE_EXTRA_CA_CERTS", "DENO_CERT"}
+
+// trustStores caches the trust store of every process by pid.
+var trustStores sync.Map // string -> TrustStore
+
+// ProcessTrustStore returns the trust store of process pid given the name of
+// its executable.
+func ProcessTrustStore(pid string, executable string) TrustStore {
+	if ts, ok := trustStores.Load(pid); ok {
+		return ts.(TrustStore)
+	}
+	ts := TrustStore{Java: executable == "java"}
+	if b, err := os.ReadFile(procfs.Path("%s/environ", pid)); err == nil {
+		for _, kv := range strings.Split(string(b), "\x00") {
+			name, val, _ := strings.Cut(kv, "=")
+			if val == "" || !slices.Contains(trustVars, name) || IsKnownPath(val) {
+				continue
+			}
+			path := procfs.Path("%s/root/%s", pid, val)
+			if !filepath.IsAbs(val) {
+				path = procfs.Path("%s/cwd/%s", pid, val)
+			}
+			ts.Var, ts.Path, ts.Certs = name, val, countCerts(path)
+			break
+		}
+	}
+	trustStores.Store(pid, ts)
+	return ts
+}
+
+func countCerts(path string) int {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	n := 0
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return n
+		}
+		if block.Type == "CERTIFICATE" {
+			n++
+		}
+	}
+}
+
+// pinningHosts are server names of services whose official SDKs are known to
+// ship their own pinned certificates instead of using the system trust store.
+var pinningHosts = []string{
+	"api.dropboxapi.com",
+	"content.dropboxapi.com",
+	"notify.dropboxapi.com",
+}
+
+// ecdsaP256SHA256 is the signature scheme of the ephemeral leaf certificates
+// (ECDSA P-256, see newLeafCertificate).
+const ecdsaP256SHA256 = uint16(tls.ECDSAWithP256AndSHA256)
+
+// Forecast predicts whether intercepting a connection would work from its
+// ClientHello, the plaintext part of the server's flight (nil if none was
+// seen) and the client's trust store.
+func Forecast(h *ClientHello, s *ServerFlight, ts TrustStore) []Finding {
+	var ret []Finding
+	add := func(outcome, format string, args ...any) {
+		ret = append(ret, Finding{Outcome: outcome, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	// The intercepting server uses crypto/tls defaults: TLS 1.2 or newer and,
+	// with an ECDSA certificate, ECDHE_ECDSA suites for TLS 1.2.
+	var tls12, tls13 bool
+	for _, v := range h.Versions() {
+		tls12 = tls12 || v == tls.VersionTLS12
+		tls13 = tls13 || v == tls.VersionTLS13
+	}
+	if !tls12 && !tls13 {
+		add(OutcomeExclude, "client only offers TLS versions older than 1.2 (%s)", versionNames(h.Versions()))
+	}
+	if tls12 && !tls13 && !offersSuite(h, func(cs *tls.CipherSuite) bool {
+		return strings.Contains(cs.Name, "_ECDHE_ECDSA_") && slices.Contains(cs.SupportedVersions, tls.VersionTLS12)
+	}) {
+		add(OutcomeExclude, "client offers no ECDHE_ECDSA cipher suite for TLS 1.2")
+	}
+	if len(h.SignatureSchemes) > 0 && !slices.Contains(h.SignatureSchemes, ecdsaP256SHA256) {
+		add(OutcomeExclude, "client doesn't accept ECDSA P-256 signatures")
+	}
+	if len(h.SupportedGroups) > 0 && !slices.ContainsFunc(h.SupportedGroups, func(g uint16) bool {
+		switch tls.CurveID(g) {
+		case tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521, tls.X25519MLKEM768:
+			return true
+		}
+		return false
+	}) {
+		add(OutcomeExclude, "client offers no supported key exchange group")
+	}
+
+	for _, host := range pinningHosts {
+		if strings.EqualFold(h.ServerName, host) {
+			add(OutcomeExclude, "official SDKs for %s pin certificates", host)
+		}
+	}
+
+	if s != nil && s.CertificateRequest {
+		add(OutcomeExclude, "server requests a client certificate (mTLS), which can't be forwarded")
+	}
+
+	switch {
+	case ts.Path != "" && ts.Certs >= 0 && ts.Certs <= smallTrustStore:
+		add(OutcomeExclude, "%s points to a bundle of %d certificate(s) (%s), likely pinning", ts.Var, ts.Certs, ts.Path)
+	case ts.Path != "":
+		add(OutcomeTrust, "%s points to a custom bundle (%s) that the CA injection doesn't cover", ts.Var, ts.Path)
+	case ts.Java:
+		add(OutcomeTrust, "Java uses its own keystore, which needs the subtrace CA imported")
+	}
+
+	if len(ret) == 0 {
+		ret = append(ret, Finding{Outcome: OutcomeClean})
+	}
+	return ret
+}
+
+func offersSuite(h *ClientHello, ok func(*tls.CipherSuite) bool) bool {
+	for _, cs := range tls.CipherSuites() {
+		if ok(cs) && slices.Contains(h.CipherSuites, cs.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+func versionNames(versions []uint16) string {
+	var names []string
+	for _, v := range versions {
+		if !isGREASE(v) {
+			names = append(names, tls.VersionName(v))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// DryRunEntry is the forecast for every connection to one server name.
+type DryRunEntry struct {
+	ServerName  string    `json:"serverName"`
+	Outcome     string    `json:"outcome"`
+	Findings    []Finding `json:"findings"`
+	Connections int       `json:"connections"`
+	Processes   []string  `json:"processes"`
+	JA3         []string  `json:"ja3"`
+	// Unverified lists what couldn't be checked, e.g. client certificate
+	// requests under TLS 1.3.
+	Unverified []string `json:"unverified,omitempty"`
+}
+
+var dryRunReport struct {
+	mu      sync.Mutex
+	entries map[string]*DryRunEntry
+}
+
+// RecordDryRun adds the forecast of a connection to the report. key is the
+// server name, or the address if the client sent none.
+func RecordDryRun(key, process string, h *ClientHello, s *ServerFlight, findings []Finding) {
+	dryRunReport.mu.Lock()
+	defer dryRunReport.mu.Unlock()
+	if dryRunReport.entries == nil {
+		dryRunReport.entries = make(map[string]*DryRunEntry)
+	}
+	e, ok := dryRunReport.entries[key]
+	if !ok {
+		e = &DryRunEntry{ServerName: key, Outcome: OutcomeClean}
+		dryRunReport.entries[key] = e
+	}
+	e.Connections++
+	addUnique := func(list []string, val string) []string {
+		if val == "" || slices.Contains(list, val) {
+			return list
+		}
+		return append(list, val)
+	}
+	e.Processes = addUnique(e.Processes, process)
+	if h != nil {
+		e.JA3 = addUnique(e.JA3, h.JA3())
+	}
+	switch {
+	case s == nil:
+		e.Unverified = addUnique(e.Unverified, "no ServerHello seen")
+	case s.Encrypted:
+		e.Unverified = addUnique(e.Unverified, "client certificate requests (TLS 1.3 encrypts them)")
+	}
+	for _, f := range findings {
+		if outcomeRank(f.Outcome) > outcomeRank(e.Outcome) {
+			e.Outcome = f.Outcome
+		}
+		if f.Outcome != OutcomeClean && !slices.Contains(e.Findings, f) {
+			e.Findings = append(e.Findings, f)
+		}
+	}
+}
+
+// DryRunReport returns the forecast for every server name seen, worst first.
+func DryRunReport() []DryRunEntry {
+	dryRunReport.mu.Lock()
+	defer dryRunReport.mu.Unlock()
+	ret := make([]DryRunEntry, 0, len(dryRunReport.entries))
+	for _, e := range dryRunReport.entries {
+		ret = append(ret, *e)
+	}
+	slices.SortFunc(ret, func(a, b DryRunEntry) int {
+		if d := outcomeRank(b.Outcome) - outcomeRank(a.Outcome); d != 0 {
+			return d
+		}
+		return strings.Compare(a.ServerName, b.ServerName)
+	})
+	return ret
+}
+
+// WriteDryRunReport writes the report in a human-readable form.
+func WriteDryRunReport(w io.Writer) error {
+	entries := DryRunReport()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "subtrace: TLS interception dry run: %d server name(s)\n", len(entries))
+	for _, e := range entries {
+		fmt.Fprintf(&b, "  %s: %s (%d connection(s))\n", e.ServerName, strings.ReplaceAll(e.Outcome, "_", " "), e.Connections)
+		for _, f := range e.Findings {
+			fmt.Fprintf(&b, "    - %s\n", f.Reason)
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// WriteDryRunReportJSON writes the report as JSON for rollout tooling.
+func WriteDryRunReportJSON(path string) error {
+	b, err := json.MarshalIndent(DryRunReport(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,475 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"crypto/md5"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ClientHello is the metadata of a TLS ClientHello message.
+type ClientHello struct {
+	Version           uint16   // legacy_version
+	SupportedVersions []uint16 // from the supported_versions extension, if any
+	CipherSuites      []uint16
+	Extensions        []uint16
+	ServerName        string
+	ALPN              []string
+	SupportedGroups   []uint16
+	SignatureSchemes  []uint16
+	PointFormats      []uint8
+}
+
+// Versions returns the versions the client offers.
+func (h *ClientHello) Versions() []uint16 {
+	if len(h.SupportedVersions) > 0 {
+		return h.SupportedVersions
+	}
+	return []uint16{h.Version}
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello, which identifies the
+// TLS library and configuration that produced it. GREASE values are skipped.
+func (h *ClientHello) JA3() string {
+	join := func(vals []uint16) string {
+		var parts []string
+		for _, v := range vals {
+			if !isGREASE(v) {
+				parts = append(parts, fmt.Sprintf("%d", v))
+			}
+		}
+		return strings.Join(parts, "-")
+	}
+	var formats []string
+	for _, f := range h.PointFormats {
+		formats = append(formats, fmt.Sprintf("%d", f))
+	}
+	s := fmt.Sprintf("%d,%s,%s,%s,%s", h.Version, join(h.CipherSuites), join(h.Extensions), join(h.SupportedGroups), strings.Join(formats, "-"))
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ServerFlight is the metadata of the plaintext part of a TLS server's first
+// flight. Everything after ServerHello is encrypted in TLS 1.3, so only
+// TLS 1.2 and older reveal the certificates and whether the server asks for
+// a client certificate.
+type ServerFlight struct {
+	Version            uint16 // negotiated
+	CipherSuite        uint16
+	Certificates       []*x509.Certificate
+	CertificateRequest bool
+	Encrypted          bool // the rest of the handshake is encrypted
+}
+
+// byteReader reads the length-prefixed fields of TLS messages.
+type byteReader []byte
+
+var errShort = errors.New("message too short")
+
+func (r *byteReader) uint8() (uint8, error) {
+	if len(*r) < 1 {
+		return 0, errShort
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, nil
+}
+
+func (r *byteReader) uint16() (uint16, error) {
+	if len(*r) < 2 {
+		return 0, errShort
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, nil
+}
+
+func (r *byteReader) bytes(n int) (byteReader, error) {
+	if len(*r) < n {
+		return nil, errShort
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, nil
+}
+
+// vector reads a vector with a length prefix of size bytes.
+func (r *byteReader) vector(size int) (byteReader, error) {
+	hdr, err := r.bytes(size)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, b := range hdr {
+		n = n<<8 | int(b)
+	}
+	return r.bytes(n)
+}
+
+func (r byteReader) uint16s() ([]uint16, error) {
+	var ret []uint16
+	for len(r) > 0 {
+		v, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+// ParseClientHello parses the body of a ClientHello handshake message.
+func ParseClientHello(b []byte) (*ClientHello, error) {
+	r := byteReader(b)
+	h := &ClientHello{}
+	var err error
+	if h.Version, err = r.uint16(); err != nil {
+		return nil, fmt.Errorf("version: %w", err)
+	}
+	if _, err := r.bytes(32); err != nil {
+		return nil, fmt.Errorf("random: %w", err)
+	}
+	if _, err := r.vector(1); err != nil {
+		return nil, fmt.Errorf("session id: %w", err)
+	}
+	suites, err := r.vector(2)
+	if err != nil {
+		return nil, fmt.Errorf("cipher suites: %w", err)
+	}
+	if h.CipherSuites, err = suites.uint16s(); err != nil {
+		return nil, fmt.Errorf("cipher suites: %w", err)
+	}
+	if _, err := r.vector(1); err != nil {
+		return nil, fmt.Errorf("compression methods: %w", err)
+	}
+	if len(r) == 0 {
+		return h, nil // no extensions
+	}
+
+	exts, err := r.vector(2)
+	if err != nil {
+		return nil, fmt.Errorf("extensions: %w", err)
+	}
+	for len(exts) > 0 {
+		typ, err := exts.uint16()
+		if err != nil {
+			return nil, fmt.Errorf("extension type: %w", err)
+		}
+		data, err := exts.vector(2)
+		if err != nil {
+			return nil, fmt.Errorf("extension %d: %w", typ, err)
+		}
+		h.Extensions = append(h.Extensions, typ)
+		if err := h.parseExtension(typ, data); err != nil {
+			return nil, fmt.Errorf("extension %d: %w", typ, err)
+		}
+	}
+	return h, nil
+}
+
+func (h *ClientHello) parseExtension(typ uint16, data byteReader) error {
+	switch typ {
+	case 0: // server_name
+		names, err := data.vector(2)
+		if err != nil {
+			return err
+		}
+		for len(names) > 0 {
+			kind, err := names.uint8()
+			if err != nil {
+				return err
+			}
+			name, err := names.vector(2)
+			if err != nil {
+				return err
+			}
+			if kind == 0 && h.ServerName == "" {
+				h.ServerName = string(name)
+			}
+		}
+	case 10: // supported_groups
+		groups, err := data.vector(2)
+		if err != nil {
+			return err
+		}
+		h.SupportedGroups, err = groups.uint16s()
+		return err
+	case 11: // ec_point_formats
+		formats, err := data.vector(1)
+		if err != nil {
+			return err
+		}
+		h.PointFormats = append([]uint8(nil), formats...)
+	case 13: // signature_algorithms
+		schemes, err := data.vector(2)
+		if err != nil {
+			return err
+		}
+		h.SignatureSchemes, err = schemes.uint16s()
+		return err
+	case 16: // application_layer_protocol_negotiation
+		protos, err := data.vector(2)
+		if err != nil {
+			return err
+		}
+		for len(protos) > 0 {
+			proto, err := protos.vector(1)
+			if err != nil {
+				return err
+			}
+			h.ALPN = append(h.ALPN, string(proto))
+		}
+	case 43: // supported_versions
+		versions, err := data.vector(1)
+		if err != nil {
+			return err
+		}
+		h.SupportedVersions, err = versions.uint16s()
+		return err
+	}
+	return nil
+}
+
+// parseServerHello parses the body of a ServerHello handshake message into f.
+func (f *ServerFlight) parseServerHello(b []byte) error {
+	r := byteReader(b)
+	var err error
+	if f.Version, err = r.uint16(); err != nil {
+		return fmt.Errorf("version: %w", err)
+	}
+	if _, err := r.bytes(32); err != nil {
+		return fmt.Errorf("random: %w", err)
+	}
+	if _, err := r.vector(1); err != nil {
+		return fmt.Errorf("session id: %w", err)
+	}
+	if f.CipherSuite, err = r.uint16(); err != nil {
+		return fmt.Errorf("cipher suite: %w", err)
+	}
+	if _, err := r.uint8(); err != nil {
+		return fmt.Errorf("compression method: %w", err)
+	}
+	if len(r) == 0 {
+		return nil
+	}
+	exts, err := r.vector(2)
+	if err != nil {
+		return fmt.Errorf("extensions: %w", err)
+	}
+	for len(exts) > 0 {
+		typ, err := exts.uint16()
+		if err != nil {
+			return fmt.Errorf("extension type: %w", err)
+		}
+		data, err := exts.vector(2)
+		if err != nil {
+			return fmt.Errorf("extension %d: %w", typ, err)
+		}
+		if typ == 43 { // supported_versions
+			if f.Version, err = data.uint16(); err != nil {
+				return fmt.Errorf("supported_versions: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseCertificate parses the body of a TLS 1.2 Certificate message into f.
+// Certificates that don't parse are skipped.
+func (f *ServerFlight) parseCertificate(b []byte) error {
+	r := byteReader(b)
+	certs, err := r.vector(3)
+	if err != nil {
+		return fmt.Errorf("certificate list: %w", err)
+	}
+	for len(certs) > 0 {
+		der, err := certs.vector(3)
+		if err != nil {
+			return fmt.Errorf("certificate: %w", err)
+		}
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			f.Certificates = append(f.Certificates, cert)
+		}
+	}
+	return nil
+}
+
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+
+	handshakeClientHello        = 1
+	handshakeServerHello        = 2
+	handshakeCertificate        = 11
+	handshakeCertificateRequest = 13
+	handshakeServerHelloDone    = 14
+
+	// maxObservedBytes bounds how much of each side's handshake is buffered.
+	maxObservedBytes = 64 << 10
+)
+
+// handshakeStream reassembles the plaintext handshake messages sent by one
+// side of a connection from its TLS records.
+type handshakeStream struct {
+	records  []byte // bytes of the current, incomplete record
+	messages []byte // handshake bytes not consumed as whole messages yet
+	total    int
+	done     bool // encrypted, not TLS, or over the limit
+}
+
+// write adds the bytes b sent by this side and calls fn for every complete
+// handshake message. fn returns false to stop observing.
+func (s *handshakeStream) write(b []byte, fn func(typ uint8, body []byte) bool) {
+	if s.done {
+		return
+	}
+	s.total += len(b)
+	if s.total > maxObservedBytes {
+		s.done = true
+		return
+	}
+
+	s.records = append(s.records, b...)
+	for len(s.records) >= 5 {
+		typ, n := s.records[0], int(binary.BigEndian.Uint16(s.records[3:5]))
+		if len(s.records) < 5+n {
+			return
+		}
+		payload := s.records[5 : 5+n]
+		s.records = s.records[5+n:]
+
+		switch typ {
+		case recordHandshake:
+			s.messages = append(s.messages, payload...)
+		case recordAlert:
+			continue
+		default: // ChangeCipherSpec, application data or not TLS at all
+			s.done = true
+			return
+		}
+
+		for len(s.messages) >= 4 {
+			typ := s.messages[0]
+			n := int(s.messages[1])<<16 | int(s.messages[2])<<8 | int(s.messages[3])
+			if len(s.messages) < 4+n {
+				break
+			}
+			body := s.messages[4 : 4+n]
+			s.messages = s.messages[4+n:]
+			if !fn(typ, body) {
+				s.done = true
+				return
+			}
+		}
+	}
+}
+
+// HandshakeObserver extracts the handshake metadata of a TLS connection from
+// copies of the bytes each side sends. It never decrypts anything and never
+// affects the connection: its writers always succeed.
+type HandshakeObserver struct {
+	mu             sync.Mutex
+	client, server handshakeStream
+
+	hello    *ClientHello
+	helloErr error
+	flight   ServerFlight
+	seen     bool // ServerHello seen
+	complete bool // nothing more to learn from the server
+}
+
+// Client returns the writer for the bytes sent by the client.
+func (o *HandshakeObserver) Client() io.Writer {
+	return &observerWriter{o: o, client: true}
+}
+
+// Server returns the writer for the bytes sent by the server.
+func (o *HandshakeObserver) Server() io.Writer {
+	return &observerWriter{o: o}
+}
+
+type observerWriter struct {
+	o      *HandshakeObserver
+	client bool
+}
+
+func (w *observerWriter) Write(b []byte) (int, error) {
+	o := w.o
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if w.client {
+		o.client.write(b, func(typ uint8, body []byte) bool {
+			if typ == handshakeClientHello {
+				o.hello, o.helloErr = ParseClientHello(body)
+			}
+			return false // the client's next messages come after the server's flight
+		})
+		return len(b), nil
+	}
+
+	o.server.write(b, func(typ uint8, body []byte) bool {
+		switch typ {
+		case handshakeServerHello:
+			o.seen = true
+			if err := o.flight.parseServerHello(body); err != nil {
+				o.complete = true
+				return false
+			}
+			if o.flight.Version >= 0x0304 {
+				o.flight.Encrypted = true
+				o.complete = true
+				return false
+			}
+		case handshakeCertificate:
+			o.flight.parseCertificate(body)
+		case handshakeCertificateRequest:
+			o.flight.CertificateRequest = true
+		case handshakeServerHelloDone:
+			o.complete = true
+			return false
+		}
+		return true
+	})
+	if o.server.done {
+		o.complete = true
+	}
+	return len(b), nil
+}
+
+// Complete reports whether the server's plaintext flight has been observed.
+func (o *HandshakeObserver) Complete() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.complete
+}
+
+// Result returns what has been observed so far. The server flight is nil if
+// no ServerHello was seen.
+func (o *HandshakeObserver) Result() (*ClientHello, *ServerFlight, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var flight *ServerFlight
+	if o.seen {
+		f := o.flight
+		flight = &f
+	}
+	err := o.helloErr
+	if o.hello == nil && err == nil {
+		err = fmt.Errorf("no ClientHello seen")
+	}
+	return o.hello, flight, err
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"slices"
+	"testing"
+)
+
+// observeHandshake runs a handshake between a client and a server through a
+// relay that copies both directions into a HandshakeObserver.
+func observeHandshake(t *testing.T, clientCfg, serverCfg *tls.Config) *HandshakeObserver {
+	cli, relayCli := net.Pipe()
+	relaySrv, srv := net.Pipe()
+	obs := new(HandshakeObserver)
+	go io.Copy(relaySrv, io.TeeReader(relayCli, obs.Client()))
+	go io.Copy(relayCli, io.TeeReader(relaySrv, obs.Server()))
+	defer relayCli.Close()
+	defer relaySrv.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		s := tls.Server(srv, serverCfg)
+		errs <- s.Handshake()
+		s.Close()
+	}()
+	c := tls.Client(cli, clientCfg)
+	c.Handshake() // may fail, e.g. without a client certificate
+	c.Close()
+	<-errs
+	return obs
+}
+
+func TestHandshakeObserver(t *testing.T) {
+	_, certPath, keyPath := writePEM(t, t.TempDir(), "server", false)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("load key pair: %v", err)
+	}
+
+	t.Run("tls13", func(t *testing.T) {
+		obs := observeHandshake(t,
+			&tls.Config{ServerName: "api.example.com", NextProtos: []string{"h2", "http/1.1"}, InsecureSkipVerify: true},
+			&tls.Config{Certificates: []tls.Certificate{cert}},
+		)
+		hello, flight, err := obs.Result()
+		if err != nil {
+			t.Fatalf("result: %v", err)
+		}
+		if hello.ServerName != "api.example.com" {
+			t.Errorf("got server name %q, want api.example.com", hello.ServerName)
+		}
+		if !slices.Equal(hello.ALPN, []string{"h2", "http/1.1"}) {
+			t.Errorf("got ALPN %q, want [h2 http/1.1]", hello.ALPN)
+		}
+		if !slices.Contains(hello.Versions(), tls.VersionTLS13) {
+			t.Errorf("got versions %v, want TLS 1.3 among them", hello.Versions())
+		}
+		if flight == nil || !flight.Encrypted {
+			t.Errorf("got server flight %+v, want it marked encrypted", flight)
+		}
+		if got := Forecast(hello, flight, TrustStore{}); got[0].Outcome != OutcomeClean {
+			t.Errorf("got forecast %+v, want %s", got, OutcomeClean)
+		}
+	})
+
+	t.Run("mtls12", func(t *testing.T) {
+		obs := observeHandshake(t,
+			&tls.Config{ServerName: "mtls.example.com", MaxVersion: tls.VersionTLS12, InsecureSkipVerify: true},
+			&tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAnyClientCert},
+		)
+		hello, flight, err := obs.Result()
+		if err != nil {
+			t.Fatalf("result: %v", err)
+		}
+		if flight == nil || flight.Encrypted || !flight.CertificateRequest || len(flight.Certificates) != 1 {
+			t.Fatalf("got server flight %+v, want one certificate and a certificate request in plaintext", flight)
+		}
+		findings := Forecast(hello, flight, TrustStore{})
+		if !slices.ContainsFunc(findings, func(f Finding) bool { return f.Outcome == OutcomeExclude }) {
+			t.Errorf("got forecast %+v, want %s", findings, OutcomeExclude)
+		}
+	})
+}
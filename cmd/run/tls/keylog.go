@@ -0,0 +1,44 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// KeyLog receives the secrets of both sessions of every intercepted TLS
+// connection in the NSS key log format, if it's set, so that packet captures
+// taken on the wire can be decrypted with Wireshark. It must be set before any
+// connections are intercepted.
+var KeyLog io.Writer
+
+// keyLogFile is a key log shared by concurrent handshakes. crypto/tls writes
+// each line with a single call and the file is unbuffered, so every line is
+// on disk as soon as it's written and a live capture can be decrypted in real
+// time.
+type keyLogFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenKeyLog opens the key log at path for appending, since the traced
+// programs may be writing their own secrets to the same file (SSLKEYLOGFILE),
+// and sets KeyLog to it.
+func OpenKeyLog(path string) (io.Closer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open TLS key log: %w", err)
+	}
+	KeyLog = &keyLogFile{f: f}
+	return f, nil
+}
+
+func (w *keyLogFile) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Write(b)
+}
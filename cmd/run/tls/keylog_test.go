@@ -0,0 +1,88 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// clientRandoms returns the client randoms of the sessions in an NSS key log
+// that have application traffic secrets.
+func clientRandoms(log string) map[string]bool {
+	ret := make(map[string]bool)
+	for _, line := range strings.Split(log, "\n") {
+		if f := strings.Fields(line); len(f) == 3 && f[0] == "CLIENT_TRAFFIC_SECRET_0" {
+			ret[f[1]] = true
+		}
+	}
+	return ret
+}
+
+func TestKeyLog(t *testing.T) {
+	if generatedCert == nil {
+		if err := GenerateEphemeralCA(); err != nil {
+			t.Fatalf("generate CA: %v", err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "keylog.txt")
+	f, err := OpenKeyLog(path)
+	if err != nil {
+		t.Fatalf("open key log: %v", err)
+	}
+	t.Cleanup(func() {
+		KeyLog = nil
+		f.Close()
+	})
+
+	_, certPath, keyPath := writePEM(t, t.TempDir(), "server", false)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("load key pair: %v", err)
+	}
+
+	tracee, down := net.Pipe()
+	up, server := net.Pipe()
+	for _, c := range []net.Conn{tracee, down, up, server} {
+		defer c.Close()
+	}
+	var traceeLog, serverLog bytes.Buffer
+	done := make(chan struct{}, 2)
+	go func() {
+		tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}, KeyLogWriter: &serverLog}).Handshake()
+		done <- struct{}{}
+	}()
+	go func() {
+		tls.Client(tracee, &tls.Config{InsecureSkipVerify: true, KeyLogWriter: &traceeLog}).Handshake()
+		done <- struct{}{}
+	}()
+
+	if _, _, _, err := Handshake(slog.StringValue("test"), down, up); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	<-done
+	<-done
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read key log: %v", err)
+	}
+	got := clientRandoms(string(b))
+	if len(got) != 2 {
+		t.Fatalf("got %d sessions in the key log, want both sides:\n%s", len(got), b)
+	}
+	for name, log := range map[string]string{"tracee": traceeLog.String(), "server": serverLog.String()} {
+		for random := range clientRandoms(log) {
+			if !got[random] {
+				t.Errorf("the %s's session %s isn't in the key log", name, random)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ListenerConfig configures TLS on the tracer's own listeners, such as the
+// debug endpoints, for when they have to be reachable beyond localhost.
+type ListenerConfig struct {
+	// CertFile and KeyFile are a PEM certificate and key to serve. If both are
+	// empty, a self-signed certificate is generated and clients are expected
+	// to pin its fingerprint.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile is a PEM bundle of CAs. If set, clients must present a
+	// certificate signed by one of them.
+	ClientCAFile string
+}
+
+// NewServerConfig returns the TLS config for a listener and the fingerprint of
+// the certificate it serves.
+func NewServerConfig(cfg ListenerConfig) (*tls.Config, string, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case cfg.CertFile != "" && cfg.KeyFile != "":
+		if cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile); err != nil {
+			return nil, "", fmt.Errorf("load key pair: %w", err)
+		}
+	case cfg.CertFile != "" || cfg.KeyFile != "":
+		return nil, "", fmt.Errorf("certificate and key must be given together")
+	default:
+		if cert, err = newSelfSignedCertificate(); err != nil {
+			return nil, "", fmt.Errorf("generate self-signed certificate: %w", err)
+		}
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("parse certificate: %w", err)
+	}
+
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCAFile != "" {
+		b, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, "", fmt.Errorf("client CA %s: no PEM certificates found", cfg.ClientCAFile)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, Fingerprint(leaf), nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate as printed for
+// manual verification and accepted by PinnedClientConfig.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// PinnedClientConfig returns a client TLS config that accepts a server only if
+// its certificate has the given fingerprint, as is needed to connect to a
+// listener serving a self-signed certificate. The usual chain and hostname
+// verification is skipped because the pin is stronger than either.
+func PinnedClientConfig(fingerprint string) *tls.Config {
+	want := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	want = strings.TrimPrefix(want, "sha256")
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			sum := sha256.Sum256(raw[0])
+			if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(want)) != 1 {
+				return fmt.Errorf("server certificate fingerprint sha256:%x doesn't match the pinned %s", sum, fingerprint)
+			}
+			return nil
+		},
+	}
+}
+
+// newSelfSignedCertificate generates a certificate for the local hostname and
+// loopback addresses that's only meant to be verified by fingerprint.
+func newSelfSignedCertificate() (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate private key: %w", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Subtrace"}, CommonName: hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{hostname, "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("create certificate: %w", err)
+	}
+
+	privDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("marshal private key: %w", err)
+	}
+
+	ret, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDER}),
+	)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("x509 key pair: %w", err)
+	}
+	return ret, nil
+}
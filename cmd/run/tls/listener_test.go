@@ -0,0 +1,166 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveTLS serves a trivial HTTP handler with cfg and returns its URL.
+func serveTLS(t *testing.T, cfg *tls.Config) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), TLSConfig: cfg}
+	go srv.ServeTLS(lis, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + lis.Addr().String()
+}
+
+func get(url string, cfg *tls.Config) error {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}, Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// writePEM writes a self-signed certificate and its key to dir and returns the
+// certificate and the paths.
+func writePEM(t *testing.T, dir string, name string, isCA bool) (*x509.Certificate, string, string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return cert, certPath, keyPath
+}
+
+func TestListenerSelfSigned(t *testing.T) {
+	cfg, fingerprint, err := NewServerConfig(ListenerConfig{})
+	if err != nil {
+		t.Fatalf("new server config: %v", err)
+	}
+	url := serveTLS(t, cfg)
+
+	if err := get(url, PinnedClientConfig(fingerprint)); err != nil {
+		t.Errorf("pinned client: %v", err)
+	}
+	if err := get(url, &tls.Config{}); err == nil {
+		t.Errorf("client verifying against system roots accepted a self-signed certificate")
+	}
+	wrong := "sha256:" + "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	if err := get(url, PinnedClientConfig(wrong)); err == nil {
+		t.Errorf("client pinned to another fingerprint accepted the certificate")
+	}
+}
+
+func TestListenerUserCertificate(t *testing.T) {
+	dir := t.TempDir()
+	cert, certPath, keyPath := writePEM(t, dir, "server", false)
+
+	if _, _, err := NewServerConfig(ListenerConfig{CertFile: certPath}); err == nil {
+		t.Errorf("got no error for a certificate without a key")
+	}
+
+	cfg, fingerprint, err := NewServerConfig(ListenerConfig{CertFile: certPath, KeyFile: keyPath})
+	if err != nil {
+		t.Fatalf("new server config: %v", err)
+	}
+	if want := Fingerprint(cert); fingerprint != want {
+		t.Fatalf("got fingerprint %s, want %s", fingerprint, want)
+	}
+	url := serveTLS(t, cfg)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	if err := get(url, &tls.Config{RootCAs: roots}); err != nil {
+		t.Errorf("client trusting the certificate: %v", err)
+	}
+	if err := get(url, PinnedClientConfig(fingerprint)); err != nil {
+		t.Errorf("pinned client: %v", err)
+	}
+}
+
+func TestListenerClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	_, caPath, caKeyPath := writePEM(t, dir, "ca", true)
+	ca, err := tls.LoadX509KeyPair(caPath, caKeyPath)
+	if err != nil {
+		t.Fatalf("load CA key pair: %v", err)
+	}
+	_, otherPath, otherKeyPath := writePEM(t, dir, "other", false)
+	other, err := tls.LoadX509KeyPair(otherPath, otherKeyPath)
+	if err != nil {
+		t.Fatalf("load other key pair: %v", err)
+	}
+
+	cfg, fingerprint, err := NewServerConfig(ListenerConfig{ClientCAFile: caPath})
+	if err != nil {
+		t.Fatalf("new server config: %v", err)
+	}
+	url := serveTLS(t, cfg)
+
+	if err := get(url, PinnedClientConfig(fingerprint)); err == nil {
+		t.Errorf("client without a certificate was accepted")
+	}
+
+	withCert := func(cert tls.Certificate) *tls.Config {
+		c := PinnedClientConfig(fingerprint)
+		c.Certificates = []tls.Certificate{cert}
+		return c
+	}
+	if err := get(url, withCert(other)); err == nil {
+		t.Errorf("client with a certificate from another CA was accepted")
+	}
+	if err := get(url, withCert(ca)); err != nil {
+		t.Errorf("client with a certificate from the client CA: %v", err)
+	}
+}
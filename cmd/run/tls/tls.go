@@ -16,16 +16,46 @@ import (
 	"math/big"
 	"net"
 	"os"
+	"sync"
 	"time"
+
+	"subtrace.dev/cmd/run/capability"
 )
 
 var Enabled bool
 
+func init() {
+	capability.RegisterFeature("tls_interception", func() capability.Feature {
+		if DryRun {
+			return capability.Feature{Available: true, Detail: "dry run"}
+		}
+		return capability.Feature{Available: true, Enabled: Enabled}
+	})
+}
+
 var (
 	generatedCert *x509.Certificate
 	generatedKey  *ecdsa.PrivateKey
+
+	// The ephemeral CA is generated the first time it's needed rather than at
+	// startup so that commands that never use TLS don't wait for it.
+	generateOnce sync.Once
+	generateErr  error
 )
 
+// ensureEphemeralCA generates the ephemeral CA unless it already exists.
+func ensureEphemeralCA() error {
+	generateOnce.Do(func() {
+		if generatedCert != nil {
+			return
+		}
+		begin := time.Now()
+		generateErr = GenerateEphemeralCA()
+		slog.Debug("generated ephemeral TLS CA", "err", generateErr, "took", time.Since(begin).Round(time.Microsecond))
+	})
+	return generateErr
+}
+
 // GenerateEphemeralCA creates an in-memory ephemeral CA certificate and
 // private key that will be used to transparently intercept, decrypt and
 // re-encrypt outgoing TLS requests.
@@ -81,14 +111,18 @@ func GenerateEphemeralCA() error {
 
 // GetEphemeralCAPEM returns the PEM-encoded ephemeral CA certificate bytes
 // that should be appended to the system root CA certificate file.
-func GetEphemeralCAPEM() []byte {
+func GetEphemeralCAPEM() ([]byte, error) {
+	if err := ensureEphemeralCA(); err != nil {
+		return nil, fmt.Errorf("create ephemeral CA: %w", err)
+	}
+
 	var b []byte
 	b = append(b, "\n"...)
 	b = append(b, generatedCert.Subject.CommonName...)
 	b = append(b, "\n"...)
 	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: generatedCert.Raw})...)
 	b = append(b, "\n"...)
-	return b
+	return b, nil
 }
 
 func Environ() []string {
@@ -145,9 +179,13 @@ func IsKnownPath(path string) bool {
 
 // newLeafCertificate generates an ephemeral X.509 leaf certificate for a TLS
 // server that's similar to the TLS certificate received by the upstream
-// client. The new certificate will be signed by the in-memory CA generated at
-// process initialization.
+// client. The new certificate will be signed by the in-memory CA, which is
+// generated on first use.
 func newLeafCertificate(orig *x509.Certificate) (tls.Certificate, error) {
+	if err := ensureEphemeralCA(); err != nil {
+		return tls.Certificate{}, fmt.Errorf("create ephemeral CA: %w", err)
+	}
+
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("generate key: %w", err)
@@ -221,6 +259,8 @@ func newConfigFromClientHello(chi *tls.ClientHelloInfo) *tls.Config {
 		// (ex: signed by an unknown CA)? The ephemeral certificate we generate and
 		// present to the downstream client would be valid.
 		InsecureSkipVerify: true,
+
+		KeyLogWriter: KeyLog,
 	}
 
 	for _, v := range chi.SupportedVersions {
@@ -238,7 +278,7 @@ func newConfigFromClientHello(chi *tls.ClientHelloInfo) *tls.Config {
 // Handshake proxies a TLS handshake between upstream and downstream
 // connections. It returns the plaintext version of each connection. It does
 // not verify the validity of the TLS certificate presented by the upstream
-// server.
+// server. The secrets of both handshakes are written to KeyLog, if it's set.
 func Handshake(logctx slog.Value, downCipher, upCipher net.Conn) (*tls.Conn, *tls.Conn, string, error) {
 	var upPlain *tls.Conn
 	var serverName string
@@ -253,7 +293,7 @@ func Handshake(logctx slog.Value, downCipher, upCipher net.Conn) (*tls.Conn, *tl
 			}
 			slog.Debug("upstream TLS handshake complete", "serverName", upPlain.ConnectionState().ServerName, "logctx", logctx)
 
-			ret := &tls.Config{ServerName: chi.ServerName}
+			ret := &tls.Config{ServerName: chi.ServerName, KeyLogWriter: KeyLog}
 			if proto := upPlain.ConnectionState().NegotiatedProtocol; proto != "" {
 				ret.NextProtos = []string{proto}
 			}
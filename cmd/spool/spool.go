@@ -0,0 +1,87 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package spool
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/peterbourgon/ff/v3"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"subtrace.dev/logging"
+	"subtrace.dev/tracer"
+)
+
+type Flush struct {
+	ffcli.Command
+	flags struct {
+		dir     string
+		timeout time.Duration
+	}
+}
+
+func NewFlushCommand() *ffcli.Command {
+	c := new(Flush)
+
+	c.Name = "flush-spool"
+	c.ShortUsage = "subtrace flush-spool [flags]"
+	c.ShortHelp = "upload the events that subtrace run -spool-dir couldn't"
+
+	c.FlagSet = flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	c.FlagSet.StringVar(&c.flags.dir, "spool-dir", "", "directory that subtrace run -spool-dir wrote events to")
+	c.FlagSet.DurationVar(&c.flags.timeout, "timeout", time.Minute, "give up if the events aren't uploaded after this long")
+	c.FlagSet.BoolVar(&logging.Verbose, "v", false, "enable verbose logging")
+	c.FlagSet.StringVar(&logging.Logfile, "logfile", "", "file for debug logs (stdout if unspecified)")
+
+	// The same environment variables as subtrace run so that SUBTRACE_SPOOL_DIR
+	// works for both.
+	c.Options = []ff.Option{ff.WithEnvVarPrefix("SUBTRACE")}
+	c.Exec = c.entrypoint
+	return &c.Command
+}
+
+func (c *Flush) entrypoint(ctx context.Context, args []string) error {
+	if err := logging.Init(); err != nil {
+		return fmt.Errorf("init logging: %w", err)
+	}
+	if c.flags.dir == "" {
+		return fmt.Errorf("missing -spool-dir")
+	}
+	if _, err := os.Stat(c.flags.dir); err != nil {
+		return fmt.Errorf("spool dir: %w", err)
+	}
+
+	s, err := tracer.OpenSpool(c.flags.dir, 0)
+	if err != nil {
+		return err
+	}
+	batches, err := s.Batches()
+	if err != nil {
+		return fmt.Errorf("list batches: %w", err)
+	}
+	if len(batches) == 0 {
+		fmt.Fprintf(os.Stderr, "subtrace: nothing to upload in %s\n", c.flags.dir)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, c.flags.timeout, fmt.Errorf("timed out after %v", c.flags.timeout))
+	defer cancel()
+
+	slog.Debug("uploading spooled events", "dir", c.flags.dir, "batches", len(batches))
+	n, err := tracer.DefaultPublisher.ReplaySpool(ctx, s)
+	m := s.Metrics()
+	if m["corrupt"] > 0 {
+		fmt.Fprintf(os.Stderr, "subtrace: skipped %d corrupt batches\n", m["corrupt"])
+	}
+	if err != nil {
+		return fmt.Errorf("uploaded %d events: %w", n, err)
+	}
+	fmt.Fprintf(os.Stderr, "subtrace: uploaded %d events from %s\n", n, c.flags.dir)
+	return nil
+}
@@ -74,7 +74,7 @@ func (t *Tail) entrypoint(ctx context.Context, args []string) error {
 		return fmt.Errorf("init logging: %w", err)
 	}
 
-	if os.Getenv("SUBTRACE_TOKEN") == "" {
+	if rpc.Token() == "" {
 		fmt.Fprintf(os.Stderr, "subtrace: error: missing SUBTRACE_TOKEN")
 		os.Exit(1)
 		return nil
@@ -0,0 +1,302 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/cmd/version"
+	"subtrace.dev/tracer"
+)
+
+// testEvent is a line of `go test -json` output (see `go doc test2json`).
+type testEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string
+	Output  string
+}
+
+// window is an interval during which a test was running, i.e. not paused by
+// t.Parallel waiting for its turn.
+type window struct {
+	from time.Time
+	to   time.Time
+}
+
+type testRun struct {
+	pkg  string
+	name string
+
+	windows []window
+	running time.Time // start of the open window, or zero if paused
+	output  []string  // held back until the test fails unless verbose
+	failed  bool
+
+	exchanges []*exchange
+}
+
+func (t *testRun) resume(at time.Time) {
+	if t.running.IsZero() {
+		t.running = at
+	}
+}
+
+func (t *testRun) pause(at time.Time) {
+	if !t.running.IsZero() {
+		t.windows = append(t.windows, window{from: t.running, to: at})
+		t.running = time.Time{}
+	}
+}
+
+func (t *testRun) ranAt(at time.Time) bool {
+	for _, w := range t.windows {
+		if !at.Before(w.from) && !at.After(w.to) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchange is an event read back from the event log.
+type exchange struct {
+	entry har.Entry
+	raw   json.RawMessage
+	exe   string
+	tests []*testRun
+}
+
+// report follows the tests of a `go test -json` run, prints their output like
+// `go test` would, and attributes the captured exchanges to the tests that were
+// running when each started.
+type report struct {
+	out     io.Writer
+	verbose bool
+
+	tests map[[2]string]*testRun
+	order []*testRun
+}
+
+func newReport(out io.Writer, verbose bool) *report {
+	return &report{out: out, verbose: verbose, tests: make(map[[2]string]*testRun)}
+}
+
+func (r *report) test(pkg string, name string) *testRun {
+	t, ok := r.tests[[2]string{pkg, name}]
+	if !ok {
+		t = &testRun{pkg: pkg, name: name}
+		r.tests[[2]string{pkg, name}] = t
+		r.order = append(r.order, t)
+	}
+	return t
+}
+
+// consume reads `go test -json` output until EOF. Lines that aren't test
+// events, such as build errors, are printed as they are.
+func (r *report) consume(rd io.Reader) error {
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var ev testEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil || ev.Action == "" {
+			fmt.Fprintf(r.out, "%s\n", sc.Bytes())
+			continue
+		}
+		r.handle(ev)
+	}
+	return sc.Err()
+}
+
+func (r *report) handle(ev testEvent) {
+	if ev.Test == "" {
+		if ev.Action == "output" {
+			fmt.Fprint(r.out, ev.Output)
+		}
+		return
+	}
+
+	t := r.test(ev.Package, ev.Test)
+	switch ev.Action {
+	case "run", "cont":
+		t.resume(ev.Time)
+	case "pause":
+		t.pause(ev.Time)
+	case "output":
+		if r.verbose {
+			fmt.Fprint(r.out, ev.Output)
+		} else {
+			t.output = append(t.output, ev.Output)
+		}
+	case "pass", "skip":
+		t.pause(ev.Time)
+		t.output = nil
+	case "fail":
+		t.pause(ev.Time)
+		t.failed = true
+		for _, line := range t.output {
+			fmt.Fprint(r.out, line)
+		}
+		t.output = nil
+	}
+}
+
+// finish closes the windows of tests that never finished, e.g. because the
+// test binary timed out or crashed.
+func (r *report) finish(at time.Time) {
+	for _, t := range r.order {
+		t.pause(at)
+	}
+}
+
+// attribute assigns each event in the event log to the tests that were running
+// when it started. Tests in other packages are ruled out when the event came
+// from a test binary, which `go test` names after the package; events from
+// other processes, such as servers started by a test, go to every running test.
+func (r *report) attribute(rd io.Reader) error {
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		var line tracer.EventLogLine
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			return fmt.Errorf("decode event log: %w", err)
+		}
+		x := &exchange{raw: line.Entry, exe: line.Tags["process_executable_name"]}
+		if err := json.Unmarshal(line.Entry, &x.entry); err != nil {
+			return fmt.Errorf("decode HAR entry: %w", err)
+		}
+
+		for _, t := range r.order {
+			if !t.ranAt(x.entry.StartedDateTime) {
+				continue
+			}
+			if strings.HasSuffix(x.exe, ".test") && x.exe != path.Base(t.pkg)+".test" {
+				continue
+			}
+			x.tests = append(x.tests, t)
+			t.exchanges = append(t.exchanges, x)
+		}
+	}
+	return sc.Err()
+}
+
+// shared reports whether the exchange was attributed to tests other than t
+// and its parents.
+func (x *exchange) shared(t *testRun) bool {
+	for _, other := range x.tests {
+		if other.pkg != t.pkg || !strings.HasPrefix(t.name+"/", other.name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// summarize prints the exchanges of every failed test and writes them to a HAR
+// file per test in dir. If all is set, HAR files are written for tests that
+// passed too.
+func (r *report) summarize(dir string, all bool) error {
+	ambiguous := false
+	for _, t := range r.order {
+		if len(t.exchanges) == 0 || !(t.failed || all) {
+			continue
+		}
+
+		file := ""
+		if dir != "" {
+			file = filepath.Join(dir, sanitize(t.pkg), sanitize(t.name)+".har")
+			if err := writeHAR(file, t.exchanges); err != nil {
+				return fmt.Errorf("%s: %w", t.name, err)
+			}
+		}
+		if !t.failed {
+			continue
+		}
+
+		fmt.Fprintf(r.out, "subtrace: %s (%s) made %d request(s) while running:\n", t.name, t.pkg, len(t.exchanges))
+		for _, x := range t.exchanges {
+			mark := ""
+			if x.shared(t) {
+				mark, ambiguous = " *", true
+			}
+			status := "-"
+			if x.entry.Response != nil {
+				status = fmt.Sprintf("%d", x.entry.Response.Status)
+			}
+			method, url := "-", "-"
+			if x.entry.Request != nil {
+				method, url = x.entry.Request.Method, x.entry.Request.URL
+			}
+			fmt.Fprintf(r.out, "    %s %s %s %s (%s)%s\n", x.entry.StartedDateTime.Local().Format("15:04:05.000"), status, method, url, time.Duration(x.entry.Time)*time.Millisecond, mark)
+		}
+		if file != "" {
+			fmt.Fprintf(r.out, "    HAR: %s\n", file)
+		}
+	}
+	if ambiguous {
+		fmt.Fprintf(r.out, "subtrace: * also made while other tests were running; use -serial to attribute every request to exactly one test\n")
+	}
+	return nil
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func sanitize(name string) string {
+	return unsafeFileChars.ReplaceAllString(name, "_")
+}
+
+// writeHAR writes the exchanges to a HAR file, adding a _goTests field to each
+// entry with the tests it was attributed to.
+func writeHAR(file string, exchanges []*exchange) error {
+	entries := make([]json.RawMessage, 0, len(exchanges))
+	for _, x := range exchanges {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(x.raw, &fields); err != nil {
+			return fmt.Errorf("decode HAR entry: %w", err)
+		}
+		var names []string
+		for _, t := range x.tests {
+			names = append(names, t.pkg+"."+t.name)
+		}
+		b, err := json.Marshal(names)
+		if err != nil {
+			return fmt.Errorf("encode tests: %w", err)
+		}
+		fields["_goTests"] = b
+
+		entry, err := json.Marshal(fields)
+		if err != nil {
+			return fmt.Errorf("encode HAR entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	b, err := json.MarshalIndent(map[string]any{
+		"log": map[string]any{
+			"version": "1.2",
+			"creator": har.Creator{Name: "subtrace", Version: version.Release},
+			"entries": entries,
+		},
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode HAR: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	if err := os.WriteFile(file, b, 0o644); err != nil {
+		return fmt.Errorf("write HAR: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func at(ms int) time.Time {
+	return t0.Add(time.Duration(ms) * time.Millisecond)
+}
+
+func goTestJSON(t *testing.T, events ...testEvent) string {
+	var b strings.Builder
+	for _, ev := range events {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatalf("encode test event: %v", err)
+		}
+		b.Write(append(line, '\n'))
+	}
+	return b.String()
+}
+
+func eventLogLine(t *testing.T, exe string, start time.Time, url string) string {
+	entry := fmt.Sprintf(`{"startedDateTime":%q,"time":5,"request":{"method":"GET","url":%q},"response":{"status":500},"_captureLevel":"full"}`, start.Format(time.RFC3339Nano), url)
+	line, err := json.Marshal(map[string]any{
+		"tags":  map[string]string{"process_executable_name": exe},
+		"entry": json.RawMessage(entry),
+	})
+	if err != nil {
+		t.Fatalf("encode event log line: %v", err)
+	}
+	return string(line) + "\n"
+}
+
+func TestReportAttribution(t *testing.T) {
+	const pkg, other = "example.com/app/api", "example.com/app/db"
+	stream := goTestJSON(t,
+		testEvent{Time: at(0), Action: "run", Package: pkg, Test: "TestList"},
+		testEvent{Time: at(0), Action: "output", Package: pkg, Test: "TestList", Output: "=== RUN   TestList\n"},
+		testEvent{Time: at(1), Action: "run", Package: pkg, Test: "TestSlow"},
+		testEvent{Time: at(2), Action: "pause", Package: pkg, Test: "TestSlow"},
+		testEvent{Time: at(5), Action: "run", Package: other, Test: "TestQuery"},
+		testEvent{Time: at(10), Action: "output", Package: pkg, Test: "TestList", Output: "--- FAIL: TestList (0.01s)\n"},
+		testEvent{Time: at(10), Action: "fail", Package: pkg, Test: "TestList"},
+		testEvent{Time: at(10), Action: "cont", Package: pkg, Test: "TestSlow"},
+		testEvent{Time: at(20), Action: "output", Package: pkg, Test: "TestSlow", Output: "--- PASS: TestSlow (0.02s)\n"},
+		testEvent{Time: at(20), Action: "pass", Package: pkg, Test: "TestSlow"},
+		testEvent{Time: at(20), Action: "pass", Package: other, Test: "TestQuery"},
+		testEvent{Time: at(21), Action: "output", Package: pkg, Output: "FAIL\n"},
+	)
+
+	var out bytes.Buffer
+	r := newReport(&out, false)
+	if err := r.consume(strings.NewReader(stream + "not json\n")); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	r.finish(at(30))
+
+	if got, want := out.String(), "=== RUN   TestList\n--- FAIL: TestList (0.01s)\nFAIL\nnot json\n"; got != want {
+		t.Errorf("got output %q, want only the failing test and package lines %q", got, want)
+	}
+
+	log := eventLogLine(t, "api.test", at(3), "http://users/list") + // only TestList is running in api
+		eventLogLine(t, "api.test", at(12), "http://users/slow") + // only TestSlow, after TestList ended
+		eventLogLine(t, "fake-server", at(6), "http://fake/x") // any running test in any package
+	if err := r.attribute(strings.NewReader(log)); err != nil {
+		t.Fatalf("attribute: %v", err)
+	}
+
+	urls := func(name string) []string {
+		var ret []string
+		for _, x := range r.test(pkgOf(name), name).exchanges {
+			ret = append(ret, x.entry.Request.URL)
+		}
+		return ret
+	}
+	for name, want := range map[string][]string{
+		"TestList":  {"http://users/list", "http://fake/x"},
+		"TestSlow":  {"http://users/slow"},
+		"TestQuery": {"http://fake/x"},
+	} {
+		if got := urls(name); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got exchanges %v, want %v", name, got, want)
+		}
+	}
+
+	dir := t.TempDir()
+	out.Reset()
+	if err := r.summarize(dir, false); err != nil {
+		t.Fatalf("summarize: %v", err)
+	}
+	if s := out.String(); !strings.Contains(s, "TestList (example.com/app/api) made 2 request(s)") || !strings.Contains(s, "http://fake/x (5ms) *") || strings.Contains(s, "TestSlow") {
+		t.Errorf("got summary %q, want the failing test's requests with the shared one marked", s)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "example.com_app_api", "TestList.har"))
+	if err != nil {
+		t.Fatalf("read HAR: %v", err)
+	}
+	var harFile struct {
+		Log struct {
+			Entries []struct {
+				GoTests      []string `json:"_goTests"`
+				CaptureLevel string   `json:"_captureLevel"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(b, &harFile); err != nil {
+		t.Fatalf("decode HAR: %v", err)
+	}
+	if n := len(harFile.Log.Entries); n != 2 {
+		t.Fatalf("got %d HAR entries, want 2", n)
+	}
+	if e := harFile.Log.Entries[1]; len(e.GoTests) != 2 || e.CaptureLevel != "full" {
+		t.Errorf("got entry %+v, want both tests it was attributed to and the original fields", e)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com_app_api", "TestSlow.har")); err == nil {
+		t.Errorf("got a HAR file for a test that passed without -har-all")
+	}
+}
+
+func pkgOf(name string) string {
+	if name == "TestQuery" {
+		return "example.com/app/db"
+	}
+	return "example.com/app/api"
+}
@@ -0,0 +1,140 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package test
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/peterbourgon/ff/v3"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"subtrace.dev/logging"
+)
+
+type Command struct {
+	ffcli.Command
+	flags struct {
+		goBin  string
+		config string
+		harDir string
+		harAll bool
+		serial bool
+	}
+}
+
+func NewCommand() *ffcli.Command {
+	c := new(Command)
+
+	c.Name = "test"
+	c.ShortUsage = "subtrace test [flags] [-- go test flags and packages]"
+	c.ShortHelp = "run go test with subtrace and show the requests made by failing tests"
+
+	c.FlagSet = flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	c.FlagSet.StringVar(&c.flags.goBin, "go", "go", "go command to run the tests with")
+	c.FlagSet.StringVar(&c.flags.config, "config", "", "configuration file path passed to subtrace run")
+	c.FlagSet.StringVar(&c.flags.harDir, "har-dir", "subtrace-har", "write the requests made by each failing test to a HAR file in this directory (empty to disable)")
+	c.FlagSet.BoolVar(&c.flags.harAll, "har-all", false, "also write HAR files for tests that passed")
+	c.FlagSet.BoolVar(&c.flags.serial, "serial", false, "run one package and one test at a time (-p=1 -parallel=1) so that every request is attributed to exactly one test")
+	c.FlagSet.BoolVar(&logging.Verbose, "v", false, "enable verbose debug logging")
+	c.FlagSet.StringVar(&logging.Logfile, "logfile", "", "file for debug logs (stdout if unspecified)")
+
+	c.Options = []ff.Option{ff.WithEnvVarPrefix("SUBTRACE_TEST")}
+	c.Exec = c.entrypoint
+	return &c.Command
+}
+
+func (c *Command) entrypoint(ctx context.Context, args []string) error {
+	if err := logging.Init(); err != nil {
+		return fmt.Errorf("init logging: %w", err)
+	}
+
+	code, err := c.run(ctx, args)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
+	return nil
+}
+
+// run runs the tests and returns the exit code of `go test`.
+func (c *Command) run(ctx context.Context, args []string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("executable: %w", err)
+	}
+
+	tmp, err := os.MkdirTemp("", "subtrace-test-*")
+	if err != nil {
+		return 0, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	eventLog := filepath.Join(tmp, "events.jsonl")
+
+	runArgs := []string{"run", "-event-log", eventLog}
+	if c.flags.config != "" {
+		runArgs = append(runArgs, "-config", c.flags.config)
+	}
+	runArgs = append(runArgs, "--", c.flags.goBin, "test", "-json")
+	if c.flags.serial {
+		runArgs = append(runArgs, "-p=1", "-parallel=1")
+	}
+	runArgs = append(runArgs, args...)
+
+	cmd := exec.CommandContext(ctx, exe, runArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, fmt.Errorf("stdout pipe: %w", err)
+	}
+	slog.Debug("running tests", "args", runArgs)
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("start subtrace run: %w", err)
+	}
+
+	// Like `go test`, print the output of passing tests only with -v.
+	verbose := slices.Contains(args, "-v") || slices.Contains(args, "-test.v")
+	r := newReport(os.Stdout, verbose)
+	if err := r.consume(stdout); err != nil {
+		slog.Error("failed to read go test output", "err", err) // not fatal: the rest is still useful
+	}
+
+	code := 0
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return 0, fmt.Errorf("subtrace run: %w", err)
+		}
+		code = exitErr.ExitCode()
+	}
+	r.finish(time.Now())
+
+	f, err := os.Open(eventLog)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// No events were captured.
+	case err != nil:
+		return 0, fmt.Errorf("open event log: %w", err)
+	default:
+		defer f.Close()
+		if err := r.attribute(f); err != nil {
+			return 0, fmt.Errorf("read event log: %w", err)
+		}
+	}
+
+	if err := r.summarize(c.flags.harDir, c.flags.harAll); err != nil {
+		return 0, fmt.Errorf("write HAR files: %w", err)
+	}
+	return code, nil
+}
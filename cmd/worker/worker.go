@@ -73,7 +73,7 @@ func (c *Command) entrypoint(ctx context.Context, args []string) error {
 		return fmt.Errorf("init logging: %w", err)
 	}
 
-	if val := os.Getenv("SUBTRACE_TOKEN"); val == "" {
+	if val := rpc.Token(); val == "" {
 		return fmt.Errorf("SUBTRACE_TOKEN is empty")
 	}
 
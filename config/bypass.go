@@ -0,0 +1,150 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// BypassRule matches the destinations of connections that aren't traced at
+// all, e.g. a local sidecar that's called thousands of times per second.
+type BypassRule struct {
+	Prefixes []netip.Prefix // empty matches every address
+	Port     uint16         // 0 matches every port
+}
+
+// bypassKeywords are the shortcuts accepted in place of an address.
+var bypassKeywords = map[string][]netip.Prefix{
+	"loopback":  {netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+	"loopback4": {netip.MustParsePrefix("127.0.0.0/8")},
+	"loopback6": {netip.MustParsePrefix("::1/128")},
+}
+
+// ParseBypassRule parses a bypass entry: an address, a CIDR range or one of
+// the keywords loopback (127.0.0.0/8 and ::1), loopback4 and loopback6,
+// optionally followed by a port, or a port alone. IPv6 addresses and ranges
+// must be bracketed when followed by a port. For example: loopback,
+// 10.0.0.0/8, 127.0.0.1:8125, [fd00::/8]:53, loopback:6379 or :6379.
+func ParseBypassRule(s string) (BypassRule, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return BypassRule{}, fmt.Errorf("empty bypass rule")
+	}
+	if prefixes, ok := parseBypassHost(s); ok {
+		return BypassRule{Prefixes: prefixes}, nil
+	}
+
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return BypassRule{}, fmt.Errorf("invalid bypass rule %q: not an address, range or keyword", s)
+	}
+	host, port := s[:i], s[i+1:]
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return BypassRule{}, fmt.Errorf("invalid bypass rule %q: invalid port %q", s, port)
+	}
+	if host == "" {
+		return BypassRule{Port: uint16(n)}, nil
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	} else if strings.Contains(host, ":") {
+		return BypassRule{}, fmt.Errorf("invalid bypass rule %q: IPv6 addresses must be bracketed when followed by a port", s)
+	}
+	prefixes, ok := parseBypassHost(host)
+	if !ok {
+		return BypassRule{}, fmt.Errorf("invalid bypass rule %q: %q is not an address, range or keyword", s, host)
+	}
+	return BypassRule{Prefixes: prefixes, Port: uint16(n)}, nil
+}
+
+func parseBypassHost(s string) ([]netip.Prefix, bool) {
+	if prefixes, ok := bypassKeywords[strings.ToLower(s)]; ok {
+		return prefixes, true
+	}
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return []netip.Prefix{p.Masked()}, true
+	}
+	if a, err := netip.ParseAddr(s); err == nil && a.Zone() == "" {
+		return []netip.Prefix{netip.PrefixFrom(a, a.BitLen())}, true
+	}
+	return nil, false
+}
+
+// Matches reports whether the rule matches a connection to addr.
+func (r BypassRule) Matches(addr netip.AddrPort) bool {
+	if r.Port != 0 && r.Port != addr.Port() {
+		return false
+	}
+	if len(r.Prefixes) == 0 {
+		return true
+	}
+	a := addr.Addr().Unmap()
+	for _, p := range r.Prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r BypassRule) String() string {
+	var hosts []string
+	for _, p := range r.Prefixes {
+		if p.IsSingleIP() {
+			hosts = append(hosts, p.Addr().String())
+		} else {
+			hosts = append(hosts, p.String())
+		}
+	}
+	host := strings.Join(hosts, ",")
+	switch {
+	case r.Port == 0:
+		return host
+	case len(hosts) == 1 && r.Prefixes[0].Addr().Is4():
+		return fmt.Sprintf("%s:%d", host, r.Port)
+	case len(hosts) == 0:
+		return fmt.Sprintf(":%d", r.Port)
+	default:
+		return fmt.Sprintf("[%s]:%d", host, r.Port)
+	}
+}
+
+// GetBypass returns the parsed bypass rules.
+func (c *Config) GetBypass() []BypassRule {
+	return c.bypass
+}
+
+// PeerAuth lists the local listeners that authenticate their peers by the
+// credentials of the process that connected, like the Docker daemon or
+// PostgreSQL with peer authentication.
+type PeerAuth struct {
+	Paths     []string     // AF_UNIX sockets, absolute or abstract ("@name")
+	Listeners []BypassRule // TCP addresses
+}
+
+// Parse parses a peerAuth entry into p: the path of an AF_UNIX socket
+// or, like a bypass entry, the address of a TCP listener. For example:
+// /var/run/docker.sock, @dbus, :5432 or 127.0.0.1:5432.
+func (p *PeerAuth) Parse(s string) error {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "/") || strings.HasPrefix(s, "@") {
+		p.Paths = append(p.Paths, s)
+		return nil
+	}
+	r, err := ParseBypassRule(s)
+	if err != nil {
+		return fmt.Errorf("invalid peer auth entry %q: not an absolute path, abstract name or address", s)
+	}
+	p.Listeners = append(p.Listeners, r)
+	return nil
+}
+
+// GetPeerAuth returns the parsed peerAuth entries.
+func (c *Config) GetPeerAuth() PeerAuth {
+	return c.peerAuth
+}
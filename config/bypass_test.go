@@ -0,0 +1,98 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestBypassRule(t *testing.T) {
+	for _, tt := range []struct {
+		rule  string
+		match []string
+		miss  []string
+	}{
+		{rule: "loopback", match: []string{"127.0.0.1:80", "127.1.2.3:1", "[::1]:443", "[::ffff:127.0.0.1]:80"}, miss: []string{"10.0.0.1:80", "[::2]:80"}},
+		{rule: "loopback4", match: []string{"127.0.0.1:80"}, miss: []string{"[::1]:80"}},
+		{rule: "loopback6:8125", match: []string{"[::1]:8125"}, miss: []string{"[::1]:8126", "127.0.0.1:8125"}},
+		{rule: "10.0.0.0/8", match: []string{"10.1.2.3:5432"}, miss: []string{"11.0.0.1:5432"}},
+		{rule: "10.1.2.3/8:5432", match: []string{"10.9.9.9:5432"}, miss: []string{"10.9.9.9:5433"}},
+		{rule: "127.0.0.1:8125", match: []string{"127.0.0.1:8125"}, miss: []string{"127.0.0.2:8125"}},
+		{rule: "[fd00::/8]:53", match: []string{"[fd12::1]:53"}, miss: []string{"[fe80::1]:53", "[fd12::1]:54"}},
+		{rule: "fd00::1", match: []string{"[fd00::1]:1"}, miss: []string{"[fd00::2]:1"}},
+		{rule: ":6379", match: []string{"1.2.3.4:6379", "[::1]:6379"}, miss: []string{"1.2.3.4:6380"}},
+	} {
+		r, err := ParseBypassRule(tt.rule)
+		if err != nil {
+			t.Errorf("parse %q: %v", tt.rule, err)
+			continue
+		}
+		for _, addr := range tt.match {
+			if !r.Matches(netip.MustParseAddrPort(addr)) {
+				t.Errorf("rule %q (%s) doesn't match %s", tt.rule, r, addr)
+			}
+		}
+		for _, addr := range tt.miss {
+			if r.Matches(netip.MustParseAddrPort(addr)) {
+				t.Errorf("rule %q (%s) matches %s", tt.rule, r, addr)
+			}
+		}
+	}
+
+	for _, rule := range []string{"", "localhost", "fd00::/8:53", "10.0.0.0/8:0", "10.0.0.0/8:http", "[10.0.0.0/33]:1", ":"} {
+		if r, err := ParseBypassRule(rule); err == nil {
+			t.Errorf("parse %q: got %s, want an error", rule, r)
+		}
+	}
+}
+
+func TestBypassConfig(t *testing.T) {
+	c, err := loadConfig(t, `
+bypass:
+  - loopback:8125
+  - 10.0.0.0/8
+`)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := c.GetBypass(); len(got) != 2 || got[1].String() != "10.0.0.0/8" {
+		t.Fatalf("got bypass rules %v, want 2 ending with 10.0.0.0/8", got)
+	}
+
+	_, err = loadConfig(t, `
+bypass:
+  - loopback
+  - 10.0.0.0/40
+`)
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Fatalf("got error %v for an invalid range, want one pointing at line 4", err)
+	}
+}
+
+func TestPeerAuthConfig(t *testing.T) {
+	c, err := loadConfig(t, `
+peerAuth:
+  - /var/run/postgresql/.s.PGSQL.5432
+  - "@dbus"
+  - loopback:5432
+`)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	got := c.GetPeerAuth()
+	if len(got.Paths) != 2 || got.Paths[1] != "@dbus" || len(got.Listeners) != 1 || got.Listeners[0].Port != 5432 {
+		t.Fatalf("got %+v, want 2 paths and the loopback:5432 listener", got)
+	}
+
+	_, err = loadConfig(t, `
+peerAuth:
+  - /run/docker.sock
+  - run/docker.sock
+`)
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Fatalf("got error %v for a relative path, want one pointing at line 4", err)
+	}
+}
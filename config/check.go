@@ -0,0 +1,197 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a part of the config that loads fine but can't do what it says,
+// e.g. a rule that never gets to match because an earlier one always matches
+// first.
+type Problem struct {
+	Line    int // 0 if unknown
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+}
+
+// line returns the line of the YAML node at path, where every element is a
+// mapping key (string) or a sequence index (int). It returns 0 if the config
+// wasn't loaded from a file, there's no such node or it comes from a profile.
+func (c *Config) line(path ...any) int {
+	if c.source == nil {
+		return 0
+	}
+	node := c.source
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, elem := range path {
+		var next *yaml.Node
+		switch elem := elem.(type) {
+		case string:
+			if node.Kind != yaml.MappingNode {
+				return 0
+			}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == elem {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && elem < len(node.Content) {
+				next = node.Content[elem]
+			}
+		}
+		if next == nil || c.fromProfile[next] {
+			return 0
+		}
+		node = next
+	}
+	return node.Line
+}
+
+// Check looks for rules and settings that can never take effect. payloadLimit
+// is the -payload-limit in force, which decides whether bodies are captured at
+// all. Syntax errors aren't reported here because Load already fails on them.
+func (c *Config) Check(payloadLimit int64) []Problem {
+	var ret []Problem
+	ret = append(ret, c.checkRules()...)
+	ret = append(ret, c.checkPayloads(payloadLimit)...)
+	ret = append(ret, c.checkRewrites()...)
+	return ret
+}
+
+// normalizeExpr makes trivially different spellings of the same rule
+// expression compare equal.
+func normalizeExpr(expr string) string {
+	expr = strings.Join(strings.Fields(expr), " ")
+	for strings.HasPrefix(expr, "(") && strings.HasSuffix(expr, ")") && strings.Count(expr, "(") == 1 {
+		expr = strings.TrimSpace(expr[1 : len(expr)-1])
+	}
+	return expr
+}
+
+// ruleExpr returns the effective expression of the i-th rule, which includes
+// its match block, if any.
+func (c *Config) ruleExpr(i int) string {
+	rule := c.parsed.Rules[i]
+	expr := normalizeExpr(rule.If)
+	if expr == "" && (rule.Process != nil || rule.Match != nil) {
+		expr = "true"
+	}
+	if rule.Match != nil {
+		expr = fmt.Sprintf("match(%s) && %s", rule.Match, expr)
+	}
+	return expr
+}
+
+// covers reports whether every process that b selects is also selected by a.
+// A nil match selects every process.
+func covers(a, b *ProcessMatch) bool {
+	switch {
+	case a == nil:
+		return true
+	case b == nil:
+		return false
+	}
+	return a.Executable == b.Executable && a.Argv == b.Argv && a.Env == b.Env && a.Container == b.Container
+}
+
+// checkRules reports rules that are shadowed by an earlier rule. Only the
+// first matching rule applies to an event, so a rule after one that matches
+// at least the same events is dead: redundant if both have the same action,
+// contradictory otherwise.
+func (c *Config) checkRules() []Problem {
+	var ret []Problem
+	for j := range c.parsed.Rules {
+		expr := c.ruleExpr(j)
+		if expr == "false" {
+			ret = append(ret, Problem{c.line("rules", j), fmt.Sprintf("rule %d never matches", j)})
+			continue
+		}
+
+		for i := 0; i < j; i++ {
+			prev := c.ruleExpr(i)
+			if prev != "true" && prev != expr {
+				continue
+			}
+			if !covers(c.parsed.Rules[i].Process, c.parsed.Rules[j].Process) {
+				continue
+			}
+
+			then, prevThen := c.parsed.Rules[j].Then, c.parsed.Rules[i].Then
+			var msg string
+			if c.rules[j].then() == c.rules[i].then() {
+				msg = fmt.Sprintf("rule %d is unreachable: rule %d (line %d) already matches every event it does", j, i, c.line("rules", i))
+			} else {
+				msg = fmt.Sprintf("rule %d (%s) never applies: rule %d (line %d) matches the same events first and decides %s", j, then, i, c.line("rules", i), prevThen)
+			}
+			ret = append(ret, Problem{c.line("rules", j), msg})
+			break
+		}
+	}
+	return ret
+}
+
+// checkPayloads reports payload patterns that are shadowed by an earlier
+// pattern and payload settings that are moot because no body is captured.
+func (c *Config) checkPayloads(payloadLimit int64) []Problem {
+	var ret []Problem
+	p := c.parsed.Payloads
+
+	if payloadLimit <= 0 && (len(p.Allow) > 0 || len(p.Processes) > 0) {
+		ret = append(ret, Problem{c.line("payloads"), "payloads has no effect: the payload limit is 0, so no request or response body is captured"})
+	}
+
+	// Allow patterns are checked first, so a deny pattern that only matches
+	// hosts an allow pattern matches too never denies anything.
+	shadowed := func(earlier []string, pattern string) (int, bool) {
+		for i, prev := range earlier {
+			if ok, _ := filepath.Match(strings.ToLower(prev), strings.ToLower(pattern)); ok {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+	for j, pattern := range p.Allow {
+		if i, ok := shadowed(p.Allow[:j], pattern); ok {
+			ret = append(ret, Problem{c.line("payloads", "allow", j), fmt.Sprintf("allow pattern %q is redundant: %q (line %d) already allows it", pattern, p.Allow[i], c.line("payloads", "allow", i))})
+		}
+	}
+	for j, pattern := range p.Deny {
+		if i, ok := shadowed(p.Allow, pattern); ok {
+			ret = append(ret, Problem{c.line("payloads", "deny", j), fmt.Sprintf("deny pattern %q never applies: allow pattern %q (line %d) takes precedence", pattern, p.Allow[i], c.line("payloads", "allow", i))})
+		} else if i, ok := shadowed(p.Deny[:j], pattern); ok {
+			ret = append(ret, Problem{c.line("payloads", "deny", j), fmt.Sprintf("deny pattern %q is redundant: %q (line %d) already denies it", pattern, p.Deny[i], c.line("payloads", "deny", i))})
+		}
+	}
+	return ret
+}
+
+// checkRewrites reports headers that a rewrite both sets and removes.
+func (c *Config) checkRewrites() []Problem {
+	var ret []Problem
+	for i, r := range c.parsed.Rewrites {
+		for _, name := range r.RemoveHeaders {
+			for set := range r.SetHeaders {
+				if strings.EqualFold(name, set) {
+					ret = append(ret, Problem{c.line("rewrites", i), fmt.Sprintf("rewrite %d both sets and removes header %q", i, set)})
+				}
+			}
+		}
+	}
+	return ret
+}
@@ -7,9 +7,13 @@ import (
 	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 
 	"github.com/google/martian/v3/har"
 	"gopkg.in/yaml.v3"
@@ -18,18 +22,114 @@ import (
 	"subtrace.dev/tags"
 )
 
+// Rewrite is a rule that modifies outgoing HTTP requests that match the given
+// host and path patterns (filepath.Match syntax, empty matches everything)
+// before they are forwarded.
+type Rewrite struct {
+	// Name identifies the rule in the interventions recorded on events.
+	Name string `yaml:"name"`
+
+	Match struct {
+		Host string `yaml:"host"`
+		Path string `yaml:"path"`
+	} `yaml:"match"`
+
+	SetHeaders     map[string]string `yaml:"setHeaders"`
+	RemoveHeaders  []string          `yaml:"removeHeaders"`
+	SetQueryParams map[string]string `yaml:"setQueryParams"`
+}
+
+// String returns the rule's name, or a description of what it matches if it
+// has none.
+func (r *Rewrite) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	host, path := r.Match.Host, r.Match.Path
+	if host == "" {
+		host = "*"
+	}
+	if path == "" {
+		path = "*"
+	}
+	return fmt.Sprintf("host=%s path=%s", host, path)
+}
+
+// ExternalSockets sets the quality of service options of the external
+// connections and listeners that subtrace creates on behalf of traced
+// processes. Unset options are left at the kernel's default.
+type ExternalSockets struct {
+	TOS      *int `yaml:"tos"`      // IP_TOS or IPV6_TCLASS
+	Priority *int `yaml:"priority"` // SO_PRIORITY
+	Mark     *int `yaml:"mark"`     // SO_MARK
+
+	// MirrorProcess copies the options set on the traced process's socket,
+	// which take precedence over the fixed values above.
+	MirrorProcess bool `yaml:"mirrorProcess"`
+}
+
 type Config struct {
 	parsed struct {
 		AuthCredentials string            `yaml:"authCredentials"`
 		Tags            map[string]string `yaml:"tags"`
 		Rules           []struct {
-			If   string `yaml:"if"`
-			Then string `yaml:"then"`
+			If      string        `yaml:"if"`
+			Then    string        `yaml:"then"`
+			Process *ProcessMatch `yaml:"process"`
+			Match   *EventMatch   `yaml:"match"`
 		} `yaml:"rules"`
+		Payloads struct {
+			Allow     []string       `yaml:"allow"`
+			Deny      []string       `yaml:"deny"`
+			Processes []ProcessMatch `yaml:"processes"`
+			Keep      []string       `yaml:"keep"`
+		} `yaml:"payloads"`
+		Rewrites        []*Rewrite      `yaml:"rewrites"`
+		ExternalSockets ExternalSockets `yaml:"externalSockets"`
+		Sinks           []*Sink         `yaml:"sinks"`
+		Bypass          []string        `yaml:"bypass"`
+		PeerAuth        []string        `yaml:"peerAuth"`
+		Verdicts        *Verdicts       `yaml:"verdicts"`
+		Redact          Redact          `yaml:"redact"`
+		Sampling        Sampling        `yaml:"sampling"`
 	}
 
-	filters  []*filter.Filter
+	// rules has a filter for every rule in the config. filters are the ones
+	// that apply to events, which excludes rules for specific processes unless
+	// the config was resolved for a process that matches (see ForProcess).
+	rules   []*Rule
+	filters []*Rule
+
+	// keep has a filter for every payloads.keep expression (see KeepsPayload).
+	keep []*filter.Filter
+
+	// matchers has the compiled host and path patterns (see match.go).
+	matchers *matchers
+
+	// payloadsDenied is set if payloads are only captured for some processes
+	// and the config isn't resolved for one of them.
+	payloadsDenied bool
+
+	// bypass has the parsed bypass entries (see GetBypass).
+	bypass []BypassRule
+
+	// peerAuth has the parsed peerAuth entries (see GetPeerAuth).
+	peerAuth PeerAuth
+
+	// redactor has the compiled redact section (see redact.go).
+	redactor *redactor
+
+	// source is the parsed YAML document, kept to report line numbers.
+	source *yaml.Node
+
+	// profiles are the bundled profiles merged under the config file, and
+	// fromProfile has the nodes they added to source, which have no line in
+	// the config file (see profile.go).
+	profiles    []*yaml.Node
+	fromProfile map[*yaml.Node]bool
+
 	template *event.Event
+	extra    map[string]string
 }
 
 func New() *Config {
@@ -49,38 +149,188 @@ func (c *Config) Load(path string) error {
 	}
 	defer f.Close()
 
-	if err := yaml.NewDecoder(bufio.NewReader(f)).Decode(&c.parsed); err != nil {
+	c.source = new(yaml.Node)
+	if err := yaml.NewDecoder(bufio.NewReader(f)).Decode(c.source); err != nil {
 		return fmt.Errorf("decode: %w", err)
 	}
+	return c.load()
+}
+
+// load decodes and validates the config in source. It reports every problem
+// it finds, not just the first, so that they can all be fixed at once.
+func (c *Config) load() error {
+	c.mergeProfiles()
+
+	// Values of the wrong type are left unset, so the rest of the config can
+	// still be validated.
+	var errs []error
+	var te *yaml.TypeError
+	if err := c.source.Decode(&c.parsed); errors.As(err, &te) {
+		errs = append(errs, fmt.Errorf("decode: %w", err))
+	} else if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	for _, err := range unknownFields(c.source, reflect.TypeOf(c.parsed), "") {
+		errs = append(errs, fmt.Errorf("decode: %w", err))
+	}
 
 	for key, val := range c.parsed.Tags {
-		for _, c := range key {
-			switch {
-			case c >= 'a' && c <= 'z':
-			case c >= 'A' && c <= 'Z':
-			case c >= '0' && c <= '9':
-			case c == '_':
-			default:
-				return fmt.Errorf("validate tags: invalid key %q: only letters, digits and underscores allowed", key)
-			}
+		if !isValidTagKey(key) {
+			errs = append(errs, fmt.Errorf("validate tags: line %d: invalid key %q: only letters, digits and underscores allowed", c.line("tags", key), key))
+			continue
 		}
-
 		c.template.Set(key, val)
 	}
 
 	for i, rule := range c.parsed.Rules {
-		f, err := filter.NewFilter(rule.If, filter.Action(rule.Then))
+		r := &Rule{Index: i}
+		var err error
+		if r.Action, r.Rate, err = parseThen(rule.Then); err != nil {
+			errs = append(errs, fmt.Errorf("validate rules: rule %d: line %d: %w", i, c.line("rules", i), err))
+			continue
+		}
+		if rule.Process != nil {
+			if err := rule.Process.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("validate rules: rule %d: %w", i, err))
+				continue
+			}
+		}
+		if rule.Match != nil {
+			if r.match, err = rule.Match.compile(); err != nil {
+				errs = append(errs, fmt.Errorf("validate rules: rule %d: %w", i, err))
+				continue
+			}
+		}
+
+		expr := rule.If
+		if expr == "" && rule.Process != nil && rule.Match == nil {
+			expr = "true" // match every event from the process
+		}
+		if expr != "" || rule.Match == nil {
+			// The filter only evaluates the expression; the rule decides.
+			if r.expr, err = filter.NewFilter(expr, filter.ActionInclude); err != nil {
+				errs = append(errs, fmt.Errorf("validate rules: rule %d: line %d: new filter: %w", i, c.line("rules", i), err))
+				continue
+			}
+		}
+		c.rules = append(c.rules, r)
+		if rule.Process == nil {
+			c.filters = append(c.filters, r)
+		}
+	}
+
+	for i, r := range c.parsed.Rewrites {
+		for _, m := range []struct{ key, pattern string }{{"host", r.Match.Host}, {"path", r.Match.Path}} {
+			if _, err := filepath.Match(m.pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("validate rewrites: rewrite %d: line %d: invalid pattern %q: %w", i, c.line("rewrites", i, "match", m.key), m.pattern, err))
+			}
+		}
+		for name := range r.SetHeaders {
+			if !isValidHeaderName(name) {
+				errs = append(errs, fmt.Errorf("validate rewrites: rewrite %d: line %d: invalid header name %q", i, c.line("rewrites", i, "setHeaders"), name))
+			}
+		}
+		for j, name := range r.RemoveHeaders {
+			if !isValidHeaderName(name) {
+				errs = append(errs, fmt.Errorf("validate rewrites: rewrite %d: line %d: invalid header name %q", i, c.line("rewrites", i, "removeHeaders", j), name))
+			}
+		}
+	}
+
+	if tos := c.parsed.ExternalSockets.TOS; tos != nil && (*tos < 0 || *tos > 255) {
+		errs = append(errs, fmt.Errorf("validate externalSockets: line %d: tos %d out of range [0, 255]", c.line("externalSockets", "tos"), *tos))
+	}
+	if prio := c.parsed.ExternalSockets.Priority; prio != nil && *prio < 0 {
+		errs = append(errs, fmt.Errorf("validate externalSockets: line %d: negative priority %d", c.line("externalSockets", "priority"), *prio))
+	}
+	if mark := c.parsed.ExternalSockets.Mark; mark != nil && *mark < 0 {
+		errs = append(errs, fmt.Errorf("validate externalSockets: line %d: negative mark %d", c.line("externalSockets", "mark"), *mark))
+	}
+
+	if rate := c.parsed.Sampling.Rate; rate != nil && !(*rate >= 0 && *rate <= 1) {
+		errs = append(errs, fmt.Errorf("validate sampling: line %d: rate %v out of range [0, 1]", c.line("sampling", "rate"), *rate))
+	}
+
+	if v := c.parsed.Verdicts; v != nil {
+		if err := v.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("validate verdicts: line %d: %w", c.line("verdicts"), err))
+		}
+	}
+
+	for i, entry := range c.parsed.Bypass {
+		r, err := ParseBypassRule(entry)
 		if err != nil {
-			return fmt.Errorf("validate rules: rule %d: new filter: %w", i, err)
-		} else {
-			c.filters = append(c.filters, f)
+			errs = append(errs, fmt.Errorf("validate bypass: line %d: %w", c.line("bypass", i), err))
+			continue
 		}
+		c.bypass = append(c.bypass, r)
 	}
 
-	slog.Debug("parsed config", "rules", len(c.parsed.Rules), "tags", len(c.parsed.Tags))
+	for i, entry := range c.parsed.PeerAuth {
+		if err := c.peerAuth.Parse(entry); err != nil {
+			errs = append(errs, fmt.Errorf("validate peerAuth: line %d: %w", c.line("peerAuth", i), err))
+		}
+	}
+
+	for _, list := range []string{"allow", "deny"} {
+		patterns := c.parsed.Payloads.Allow
+		if list == "deny" {
+			patterns = c.parsed.Payloads.Deny
+		}
+		for i, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("validate payloads: line %d: invalid %s pattern %q: %w", c.line("payloads", list, i), list, pattern, err))
+			}
+		}
+	}
+	for i := range c.parsed.Payloads.Processes {
+		if err := c.parsed.Payloads.Processes[i].validate(); err != nil {
+			errs = append(errs, fmt.Errorf("validate payloads: processes %d: %w", i, err))
+		}
+	}
+	c.payloadsDenied = len(c.parsed.Payloads.Processes) > 0
+	for i, expr := range c.parsed.Payloads.Keep {
+		f, err := filter.NewFilter(expr, filter.ActionInclude)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("validate payloads: line %d: keep expression %d: new filter: %w", c.line("payloads", "keep", i), i, err))
+			continue
+		}
+		c.keep = append(c.keep, f)
+	}
+
+	var err error
+	if c.redactor, err = c.parsed.Redact.compile(c.line); err != nil {
+		errs = append(errs, fmt.Errorf("validate redact: %w", err))
+	}
+
+	if err := c.compileSinks(); err != nil {
+		errs = append(errs, fmt.Errorf("validate sinks: %w", err))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	c.matchers = c.compileMatchers()
+
+	slog.Debug("parsed config", "rules", len(c.parsed.Rules), "tags", len(c.parsed.Tags), "payloadAllow", len(c.parsed.Payloads.Allow), "payloadDeny", len(c.parsed.Payloads.Deny))
 	return nil
 }
 
+// isValidTagKey reports whether key may be used as a tag: only letters,
+// digits and underscores are allowed.
+func isValidTagKey(key string) bool {
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z':
+		case c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9':
+		case c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func (c *Config) SantizeCredential(val string) string {
 	switch c.parsed.AuthCredentials {
 	case "keep":
@@ -90,23 +340,159 @@ func (c *Config) SantizeCredential(val string) string {
 		h.Write([]byte(val))
 		return fmt.Sprintf("<redacted:sha256:%s>", hex.EncodeToString(h.Sum(nil)))
 	default:
-		return "<redacted>"
+		return redactedValue
 	}
 }
 
-func (c *Config) GetMatchingFilter(tags map[string]string, entry *har.Entry) (*filter.Filter, error) {
-	for i := 0; i < len(c.filters); i++ {
-		match, err := c.filters[i].Eval(tags, entry)
+// IsPayloadAllowed reports whether request and response bodies exchanged with
+// the given host may be captured. If payloads are restricted to some
+// processes, nothing is allowed unless the config was resolved for one of
+// them with ForProcess. Otherwise, hosts matching an allow pattern are always
+// allowed, otherwise hosts matching a deny pattern are denied. Everything else
+// is allowed. Patterns use filepath.Match syntax (e.g. "*.example.com").
+func (c *Config) IsPayloadAllowed(host string) bool {
+	if c.payloadsDenied {
+		return false
+	}
+	m := c.getMatchers().payloadMatch(normalizeHost(host))
+	return m.allow >= 0 || m.deny < 0
+}
+
+// PayloadsRestricted reports whether IsPayloadAllowed denies payloads for any
+// host. Outputs that can't tell which host some bytes were exchanged with must
+// leave them out if it does.
+func (c *Config) PayloadsRestricted() bool {
+	return c.payloadsDenied || len(c.parsed.Payloads.Deny) > 0
+}
+
+// HasRewrites reports whether any request rewrite rules are configured.
+func (c *Config) HasRewrites() bool {
+	return len(c.parsed.Rewrites) > 0
+}
+
+// GetRewrites returns the rewrite rules that apply to a request for the given
+// host and path, in the order they appear in the config.
+func (c *Config) GetRewrites(host, path string) []*Rewrite {
+	var ret []*Rewrite
+	for _, i := range c.getMatchers().rewriteIndices(normalizeHost(host), path) {
+		ret = append(ret, c.parsed.Rewrites[i])
+	}
+	return ret
+}
+
+// Sampling is the config equivalent of -sample and -sample-seed, which take
+// precedence over it.
+type Sampling struct {
+	Rate *float64 `yaml:"rate"`
+	Seed string   `yaml:"seed"`
+}
+
+// GetSampling returns the configured connection sampling.
+func (c *Config) GetSampling() Sampling {
+	return c.parsed.Sampling
+}
+
+// GetExternalSockets returns the configured options for external sockets.
+func (c *Config) GetExternalSockets() ExternalSockets {
+	return c.parsed.ExternalSockets
+}
+
+func isValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z':
+		case c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RedactPayload returns the placeholder that replaces a body that may not be
+// captured.
+func (c *Config) RedactPayload(b []byte) string {
+	h := sha256.Sum256(b)
+	return fmt.Sprintf("<redacted:size:%d:sha256:%s>", len(b), hex.EncodeToString(h[:]))
+}
+
+// KeepsPayload reports whether an event matches one of the payloads.keep
+// expressions, which keep its bodies with -payloads=adaptive even if the
+// exchange looks normal. Expressions that fail to evaluate don't match.
+func (c *Config) KeepsPayload(tags map[string]string, entry *har.Entry) bool {
+	for i, f := range c.keep {
+		match, err := f.Eval(tags, entry)
 		if err != nil {
-			return nil, fmt.Errorf("filter %d: eval: %w", i, err)
+			slog.Debug("failed to evaluate payloads.keep expression", "index", i, "err", err) // not fatal
+			continue
 		}
 		if match {
-			return c.filters[i], nil
+			return true
 		}
 	}
-	return nil, nil
+	return false
 }
 
 func (c *Config) GetEventTemplate() *event.Event {
-	return c.template.Copy()
+	tmpl := c.template.Copy()
+	for key, val := range c.extra {
+		tmpl.Set(key, val)
+	}
+	return tmpl
+}
+
+// Dump returns the config in force as YAML for state dumps. Header and query
+// parameter values set by rewrites are redacted since they're often
+// credentials.
+func (c *Config) Dump() ([]byte, error) {
+	parsed := c.parsed
+	parsed.Rewrites = make([]*Rewrite, len(c.parsed.Rewrites))
+	for i, rw := range c.parsed.Rewrites {
+		cp := *rw
+		cp.SetHeaders = redactValues(rw.SetHeaders)
+		cp.SetQueryParams = redactValues(rw.SetQueryParams)
+		parsed.Rewrites[i] = &cp
+	}
+	parsed.Sinks = make([]*Sink, len(c.parsed.Sinks))
+	for i, s := range c.parsed.Sinks {
+		cp := *s
+		if cp.Token != "" {
+			cp.Token = "<redacted>"
+		}
+		parsed.Sinks[i] = &cp
+	}
+	b, err := yaml.Marshal(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("marshal config: %w", err)
+	}
+	return b, nil
+}
+
+func redactValues(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	ret := make(map[string]string, len(m))
+	for k := range m {
+		ret[k] = "<redacted>"
+	}
+	return ret
+}
+
+// WithTag returns a copy of the config that additionally sets the given tag on
+// every event template. The copy shares everything else, including tags that
+// are fetched asynchronously after the copy is made.
+func (c *Config) WithTag(key, val string) *Config {
+	ret := *c
+	ret.extra = make(map[string]string, len(c.extra)+1)
+	for k, v := range c.extra {
+		ret.extra[k] = v
+	}
+	ret.extra[key] = val
+	return &ret
 }
@@ -0,0 +1,198 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsPayloadAllowed(t *testing.T) {
+	c := &Config{}
+	c.parsed.Payloads.Allow = []string{"*.mycorp.com"}
+	c.parsed.Payloads.Deny = []string{"*"}
+
+	for _, tt := range []struct {
+		host string
+		want bool
+	}{
+		{"api.mycorp.com", true},
+		{"API.MyCorp.com:8443", true},
+		{"api.mycorp.com.", true},
+		{"mycorp.com", false},
+		{"example.com", false},
+		{"10.0.0.1:80", false},
+		{"", false},
+	} {
+		if got := c.IsPayloadAllowed(tt.host); got != tt.want {
+			t.Errorf("IsPayloadAllowed(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	if empty := (&Config{}); !empty.IsPayloadAllowed("example.com") {
+		t.Errorf("IsPayloadAllowed with no patterns = false, want true")
+	}
+}
+
+func TestRedactPayload(t *testing.T) {
+	c := &Config{}
+	secret := "super secret body"
+	got := c.RedactPayload([]byte(secret))
+	if strings.Contains(got, secret) {
+		t.Fatalf("RedactPayload leaked body: %q", got)
+	}
+	if !strings.HasPrefix(got, "<redacted:size:17:sha256:") {
+		t.Fatalf("RedactPayload = %q, want size and hash", got)
+	}
+}
+
+func TestExternalSockets(t *testing.T) {
+	for _, tt := range []struct {
+		yaml    string
+		wantErr string
+	}{
+		{yaml: "externalSockets:\n  tos: 256\n", wantErr: "tos 256 out of range"},
+		{yaml: "externalSockets:\n  priority: -1\n", wantErr: "negative priority"},
+		{yaml: "externalSockets:\n  mark: -1\n", wantErr: "negative mark"},
+	} {
+		if _, err := loadConfig(t, tt.yaml); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Load(%q): got err %v, want %q", tt.yaml, err, tt.wantErr)
+		}
+	}
+
+	c, err := loadConfig(t, "externalSockets:\n  tos: 184\n  mirrorProcess: true\n")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	got := c.GetExternalSockets()
+	if got.TOS == nil || *got.TOS != 184 || got.Priority != nil || got.Mark != nil || !got.MirrorProcess {
+		t.Errorf("got %+v, want tos 184 and mirrorProcess only", got)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	for _, rate := range []string{"1.5", "-0.1"} {
+		if _, err := loadConfig(t, "sampling:\n  rate: "+rate+"\n"); err == nil || !strings.Contains(err.Error(), "line 2: rate "+rate+" out of range") {
+			t.Errorf("rate %s: got err %v", rate, err)
+		}
+	}
+
+	c, err := loadConfig(t, "sampling:\n  rate: 0.1\n  seed: fleet\n")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := c.GetSampling(); got.Rate == nil || *got.Rate != 0.1 || got.Seed != "fleet" {
+		t.Errorf("got %+v, want rate 0.1 and seed fleet", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	c, err := loadConfig(t, `rules:
+  - if: request.url == "/healthz"
+    then: exclude
+  - if: true
+    then: include
+  - if: request.url == "/metrics"
+    then: exclude
+  - if: false
+    then: exclude
+payloads:
+  allow: ["*.mycorp.com", "api.mycorp.com"]
+  deny: ["internal.mycorp.com", "*"]
+rewrites:
+  - setHeaders: {x-env: staging}
+    removeHeaders: [X-Env]
+`)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	var got []string
+	for _, p := range c.Check(4096) {
+		got = append(got, p.String())
+	}
+	want := []string{
+		`line 6: rule 2 (exclude) never applies: rule 1 (line 4) matches the same events first and decides include`,
+		`line 8: rule 3 never matches`,
+		`line 11: allow pattern "api.mycorp.com" is redundant: "*.mycorp.com" (line 11) already allows it`,
+		`line 12: deny pattern "internal.mycorp.com" never applies: allow pattern "*.mycorp.com" (line 11) takes precedence`,
+		`line 14: rewrite 0 both sets and removes header "x-env"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if problems := c.Check(0); len(problems) != len(want)+1 || !strings.Contains(problems[2].Message, "payload limit is 0") {
+		t.Errorf("Check(0) = %v, want a payload limit problem too", problems)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	c, err := loadConfig(t, `rules:
+  - if: request.url.endsWith("/healthz")
+    then: exclude
+  - then: exclude
+    process: {executable: cron}
+  - if: response.status >= 500
+    then: include
+payloads:
+  deny: ["*.internal"]
+rewrites:
+  - match: {host: "api.internal"}
+    setHeaders: {x-env: staging}
+`)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	var s Sample
+	s.Request.URL = "http://api.internal:8080/v1/users"
+	s.Response.Status = 503
+	ex, err := c.Explain(s)
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	if ex.Decision != 2 || ex.Action != "include" {
+		t.Errorf("got decision %d (%s), want rule 2 (include)", ex.Decision, ex.Action)
+	}
+	if ex.Rules[1].Applies {
+		t.Errorf("rule 1 applies without a process")
+	}
+	if ex.PayloadsAllowed || !strings.Contains(ex.PayloadsReason, `"*.internal" (line 9)`) {
+		t.Errorf("got payloads allowed=%v (%s), want denied by line 9", ex.PayloadsAllowed, ex.PayloadsReason)
+	}
+	if len(ex.Rewrites) != 1 || ex.Rewrites[0].Line != 11 {
+		t.Errorf("got rewrites %v, want rewrite 0 on line 11", ex.Rewrites)
+	}
+}
+
+func TestDump(t *testing.T) {
+	c, err := loadConfig(t, `tags:
+  team: payments
+rewrites:
+  - name: inject-auth
+    setHeaders: {authorization: "Bearer s3cr3t"}
+    setQueryParams: {key: abc123}
+`)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	b, err := c.Dump()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	got := string(b)
+	for _, secret := range []string{"s3cr3t", "abc123"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("dump contains rewrite value %q:\n%s", secret, got)
+		}
+	}
+	if !strings.Contains(got, "inject-auth") || !strings.Contains(got, "payments") {
+		t.Errorf("dump is missing the rest of the config:\n%s", got)
+	}
+	if v := c.parsed.Rewrites[0].SetHeaders["authorization"]; v != "Bearer s3cr3t" {
+		t.Errorf("dump changed the config in force: got header value %q", v)
+	}
+}
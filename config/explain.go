@@ -0,0 +1,158 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/filter"
+)
+
+// Sample is a synthetic event to explain, as read from JSON.
+type Sample struct {
+	Tags    map[string]string `json:"tags"`
+	Process *struct {
+		Executable string   `json:"executable"`
+		Argv       []string `json:"argv"`
+		Env        []string `json:"env"`
+		Container  string   `json:"container"`
+	} `json:"process"`
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+	} `json:"response"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// RuleResult is how one rule treated the sample.
+type RuleResult struct {
+	Index   int
+	Line    int
+	If      string
+	Match   string // the match block, described by EventMatch.String
+	Then    filter.Action
+	Applies bool  // false if the rule is for other processes
+	Matched bool  // whether the expression matched; only set if Applies
+	Err     error // evaluation error, which counts as not matching
+}
+
+// Explanation describes how the config treats a sample event.
+type Explanation struct {
+	Rules []RuleResult
+	// Decision is the index of the rule that decides the event's fate, or -1
+	// if none matched and the event is included.
+	Decision int
+	Action   filter.Action
+
+	Host            string
+	PayloadsAllowed bool
+	PayloadsReason  string
+
+	Rewrites []RewriteResult // the rewrites applied to the request
+}
+
+// RewriteResult identifies a rewrite that applies to the sample.
+type RewriteResult struct {
+	Index int
+	Line  int
+}
+
+// Explain runs the sample through the same decisions that the tracer makes
+// for a real event and records each step.
+func (c *Config) Explain(s Sample) (*Explanation, error) {
+	var u *url.URL
+	if s.Request.URL != "" {
+		var err error
+		if u, err = url.Parse(s.Request.URL); err != nil {
+			return nil, fmt.Errorf("parse request url: %w", err)
+		}
+	} else {
+		u = new(url.URL)
+	}
+	method := s.Request.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	resolved := c
+	var info *ProcessInfo
+	if s.Process != nil {
+		info = &ProcessInfo{
+			Executable:  s.Process.Executable,
+			CommandLine: strings.Join(s.Process.Argv, " "),
+			Env:         s.Process.Env,
+			ContainerID: s.Process.Container,
+		}
+		resolved = c.ForProcess(*info)
+	}
+
+	tags := make(map[string]string)
+	for k, v := range c.parsed.Tags {
+		tags[k] = v
+	}
+	for k, v := range s.Tags {
+		tags[k] = v
+	}
+	entry := &har.Entry{
+		Time:     int64(s.DurationMs),
+		Request:  &har.Request{Method: method, URL: s.Request.URL},
+		Response: &har.Response{Status: s.Response.Status},
+	}
+
+	host, path := requestTarget(entry.Request)
+	ret := &Explanation{Decision: -1, Action: filter.ActionInclude, Host: u.Host}
+	for i, rule := range c.parsed.Rules {
+		r := RuleResult{Index: i, Line: c.line("rules", i), If: rule.If, Then: filter.Action(rule.Then), Applies: true}
+		if rule.Match != nil {
+			r.Match = rule.Match.String()
+		}
+		if rule.Process != nil {
+			r.Applies = info != nil && rule.Process.matches(*info)
+		}
+		if r.Applies {
+			r.Matched, r.Err = c.rules[i].eval(tags, entry, host, path)
+			if r.Matched && ret.Decision < 0 {
+				ret.Decision, ret.Action = i, r.Then
+			}
+		}
+		ret.Rules = append(ret.Rules, r)
+	}
+
+	if u.Host != "" {
+		ret.PayloadsAllowed, ret.PayloadsReason = resolved.ExplainPayloads(u.Host)
+		for _, i := range c.getMatchers().rewriteIndices(normalizeHost(u.Host), u.Path) {
+			ret.Rewrites = append(ret.Rewrites, RewriteResult{Index: i, Line: c.line("rewrites", i)})
+		}
+	}
+	return ret, nil
+}
+
+// ExplainPayloads is IsPayloadAllowed with the reason for the decision.
+func (c *Config) ExplainPayloads(host string) (bool, string) {
+	if c.payloadsDenied {
+		return false, fmt.Sprintf("payloads are only captured for the processes in payloads.processes (line %d)", c.line("payloads", "processes"))
+	}
+	m := c.getMatchers().payloadMatch(normalizeHost(host))
+	if i := m.allow; i >= 0 {
+		return true, fmt.Sprintf("allow pattern %q (line %d)", c.parsed.Payloads.Allow[i], c.line("payloads", "allow", i))
+	}
+	if i := m.deny; i >= 0 {
+		return false, fmt.Sprintf("deny pattern %q (line %d)", c.parsed.Payloads.Deny[i], c.line("payloads", "deny", i))
+	}
+	return true, "no pattern matched"
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,280 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Host and path patterns are evaluated for every request, so they're compiled
+// once when the config is loaded. Almost every pattern in practice is a
+// literal, "*", "*.example.com" or "/prefix/*", which are matched without
+// filepath.Match. Results that only depend on the host are memoized: they're
+// the same for every request to it. Process-dependent settings are already
+// resolved once per process by ForProcess, and CEL rules are compiled by
+// package filter and depend on the whole event, so they're not memoized.
+
+type globKind int
+
+const (
+	globGeneral globKind = iota // anything else, matched with filepath.Match
+	globAny                     // "*"
+	globExact                   // no metacharacters
+	globSuffix                  // "*" followed by no metacharacters
+)
+
+// glob is a compiled filepath.Match pattern.
+type glob struct {
+	pattern string
+	kind    globKind
+	lit     string // the literal, the suffix after "*", or the prefix before the first metacharacter
+}
+
+const globMeta = `*?[\`
+
+func compileGlob(pattern string) glob {
+	g := glob{pattern: pattern}
+	switch {
+	case pattern == "*":
+		g.kind = globAny
+	case !strings.ContainsAny(pattern, globMeta):
+		g.kind, g.lit = globExact, pattern
+	case pattern[0] == '*' && !strings.ContainsAny(pattern[1:], globMeta):
+		g.kind, g.lit = globSuffix, pattern[1:]
+	default:
+		g.kind, g.lit = globGeneral, pattern[:strings.IndexAny(pattern, globMeta)]
+	}
+	return g
+}
+
+// match is filepath.Match(g.pattern, s), where "*" doesn't match '/'.
+func (g glob) match(s string) bool {
+	switch g.kind {
+	case globAny:
+		return !strings.Contains(s, "/")
+	case globExact:
+		return s == g.lit
+	case globSuffix:
+		return strings.HasSuffix(s, g.lit) && !strings.Contains(s[:len(s)-len(g.lit)], "/")
+	default:
+		if !strings.HasPrefix(s, g.lit) {
+			return false
+		}
+		ok, _ := filepath.Match(g.pattern, s)
+		return ok
+	}
+}
+
+// hostSet finds the first of a list of host patterns that matches a host.
+// Exact hosts and "*.example.com" patterns are looked up by every suffix of
+// the host that starts at a dot, like walking a trie of its labels from the
+// right, so the cost doesn't grow with the number of patterns.
+type hostSet struct {
+	globs  []glob
+	exact  map[string]int // host -> index of the first pattern
+	suffix map[string]int // ".example.com" -> index of the first pattern
+	any    int            // index of the first "*", or -1
+	other  []int          // indices of every other pattern, in order
+}
+
+func newHostSet(patterns []string) *hostSet {
+	h := &hostSet{exact: make(map[string]int), suffix: make(map[string]int), any: -1}
+	for i, pattern := range patterns {
+		g := compileGlob(strings.ToLower(pattern))
+		h.globs = append(h.globs, g)
+		switch {
+		case g.kind == globAny:
+			if h.any < 0 {
+				h.any = i
+			}
+		case g.kind == globExact:
+			if _, ok := h.exact[g.lit]; !ok {
+				h.exact[g.lit] = i
+			}
+		case g.kind == globSuffix && strings.HasPrefix(g.lit, ".") && !strings.Contains(g.lit, "/"):
+			if _, ok := h.suffix[g.lit]; !ok {
+				h.suffix[g.lit] = i
+			}
+		default:
+			h.other = append(h.other, i)
+		}
+	}
+	return h
+}
+
+// first returns the index of the first pattern that matches host, which must
+// be normalized.
+func (h *hostSet) first(host string) (int, bool) {
+	if strings.Contains(host, "/") {
+		// "*" can't match across a slash; not worth handling in the index.
+		for i, g := range h.globs {
+			if g.match(host) {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	best := math.MaxInt
+	if i, ok := h.exact[host]; ok {
+		best = i
+	}
+	if h.any >= 0 {
+		best = min(best, h.any)
+	}
+	if len(h.suffix) > 0 {
+		for i := 0; i < len(host); i++ {
+			if host[i] != '.' {
+				continue
+			}
+			if j, ok := h.suffix[host[i:]]; ok {
+				best = min(best, j)
+			}
+		}
+	}
+	for _, i := range h.other {
+		if i >= best {
+			break
+		}
+		if h.globs[i].match(host) {
+			best = i
+			break
+		}
+	}
+	if best == math.MaxInt {
+		return 0, false
+	}
+	return best, true
+}
+
+// memo is a bounded cache of results keyed by host. Once full, new hosts are
+// computed every time instead of evicting old ones: the set of hosts a
+// program talks to is usually small and stable.
+type memo[V any] struct {
+	mu sync.RWMutex
+	m  map[string]V
+}
+
+const memoMaxEntries = 4096
+
+func (m *memo[V]) get(key string, compute func() V) V {
+	m.mu.RLock()
+	val, ok := m.m[key]
+	m.mu.RUnlock()
+	if ok {
+		return val
+	}
+
+	val = compute()
+	m.mu.Lock()
+	if m.m == nil {
+		m.m = make(map[string]V)
+	}
+	if len(m.m) < memoMaxEntries {
+		m.m[key] = val
+	}
+	m.mu.Unlock()
+	return val
+}
+
+// matchers holds the compiled host and path patterns of a config. It's
+// shared by every copy made with WithTag and ForProcess.
+type matchers struct {
+	allow, deny *hostSet
+	rewrites    []rewriteMatch
+	verdicts    []rewriteMatch // one per verdict candidate
+
+	payloads     memo[payloadMatch]
+	rewriteHosts memo[[]int]
+}
+
+// payloadMatch is the index of the first allow and deny pattern matching a
+// host, or -1.
+type payloadMatch struct {
+	allow, deny int
+}
+
+// rewriteMatch is a compiled pair of host and path patterns, used by rewrites
+// and verdict candidates.
+type rewriteMatch struct {
+	host, path *glob // nil matches everything
+}
+
+func compileRewriteMatch(host, path string) rewriteMatch {
+	var rm rewriteMatch
+	if host != "" {
+		g := compileGlob(strings.ToLower(host))
+		rm.host = &g
+	}
+	if path != "" {
+		g := compileGlob(path)
+		rm.path = &g
+	}
+	return rm
+}
+
+func (c *Config) compileMatchers() *matchers {
+	m := &matchers{
+		allow: newHostSet(c.parsed.Payloads.Allow),
+		deny:  newHostSet(c.parsed.Payloads.Deny),
+	}
+	for _, r := range c.parsed.Rewrites {
+		m.rewrites = append(m.rewrites, compileRewriteMatch(r.Match.Host, r.Match.Path))
+	}
+	if v := c.parsed.Verdicts; v != nil {
+		for _, cand := range v.Candidates {
+			m.verdicts = append(m.verdicts, compileRewriteMatch(cand.Host, cand.Path))
+		}
+	}
+	return m
+}
+
+// getMatchers returns the matchers compiled by Load. Configs that weren't
+// loaded from a file get them compiled on every call.
+func (c *Config) getMatchers() *matchers {
+	if c.matchers != nil {
+		return c.matchers
+	}
+	return c.compileMatchers()
+}
+
+// payloadMatch returns the first allow and deny patterns matching host, which
+// must be normalized.
+func (m *matchers) payloadMatch(host string) payloadMatch {
+	return m.payloads.get(host, func() payloadMatch {
+		ret := payloadMatch{allow: -1, deny: -1}
+		if i, ok := m.allow.first(host); ok {
+			ret.allow = i
+		}
+		if i, ok := m.deny.first(host); ok {
+			ret.deny = i
+		}
+		return ret
+	})
+}
+
+// rewriteIndices returns the indices of the rewrites that apply to a request
+// for host and path, in order. host must be normalized.
+func (m *matchers) rewriteIndices(host, path string) []int {
+	candidates := m.rewriteHosts.get(host, func() []int {
+		var ret []int
+		for i, r := range m.rewrites {
+			if r.host == nil || r.host.match(host) {
+				ret = append(ret, i)
+			}
+		}
+		return ret
+	})
+
+	var ret []int
+	for _, i := range candidates {
+		if r := m.rewrites[i]; r.path == nil || r.path.match(path) {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
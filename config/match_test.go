@@ -0,0 +1,178 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// naivePayloadMatch and naiveRewrites are the reference implementations that
+// the compiled matchers must agree with.
+func naivePayloadMatch(c *Config, host string) payloadMatch {
+	first := func(patterns []string) int {
+		for i, pattern := range patterns {
+			if ok, _ := filepath.Match(strings.ToLower(pattern), host); ok {
+				return i
+			}
+		}
+		return -1
+	}
+	return payloadMatch{allow: first(c.parsed.Payloads.Allow), deny: first(c.parsed.Payloads.Deny)}
+}
+
+func naiveRewrites(c *Config, host, path string) []int {
+	var ret []int
+	for i, r := range c.parsed.Rewrites {
+		if r.Match.Host != "" {
+			if ok, _ := filepath.Match(strings.ToLower(r.Match.Host), host); !ok {
+				continue
+			}
+		}
+		if r.Match.Path != "" {
+			if ok, _ := filepath.Match(r.Match.Path, path); !ok {
+				continue
+			}
+		}
+		ret = append(ret, i)
+	}
+	return ret
+}
+
+var (
+	testHostPatterns = []string{
+		"*", "api.example.com", "*.example.com", "*example.com", ".example.com", "*.EXAMPLE.org",
+		"api.*.com", "a?i.example.com", "[ab]pi.example.com", `api\.example.com`, "*.com", "[",
+		"*/x", "10.0.0.*", "10.0.0.1", "*.internal", "svc-?.internal", "",
+	}
+	testPathPatterns = []string{
+		"", "*", "/", "/api/*", "/api/*/users", "/api/v1/users", "*/users", "/api/v?/*", "/[ab]pi/*",
+		`/api\*`, "/health*", "/*/*", "[",
+	}
+	testHosts = []string{
+		"", "api.example.com", "example.com", ".example.com", "a.b.example.com", "myexample.com",
+		"api.example.org", "api.foo.com", "bpi.example.com", "api.EXAMPLE.com", "10.0.0.1", "10.0.0.12",
+		"db.internal", "svc-1.internal", "svc-12.internal", "a/x", "a/b.example.com", "com", "[",
+	}
+	testPaths = []string{
+		"", "/", "/api", "/api/", "/api/v1/users", "/api/v1/users/42", "/api/v2/orders", "/bpi/x",
+		"/api*", "/healthz", "/health", "users", "a/users", "/a/b", "/a/b/c",
+	}
+)
+
+func TestCompiledMatchersMatchNaive(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	pick := func(from []string, n int) []string {
+		var ret []string
+		for range n {
+			ret = append(ret, from[rng.IntN(len(from))])
+		}
+		return ret
+	}
+
+	for iter := range 200 {
+		c := &Config{}
+		c.parsed.Payloads.Allow = pick(testHostPatterns, rng.IntN(6))
+		c.parsed.Payloads.Deny = pick(testHostPatterns, rng.IntN(6))
+		for range rng.IntN(8) {
+			r := &Rewrite{}
+			r.Match.Host = pick(testHostPatterns, 1)[0]
+			r.Match.Path = pick(testPathPatterns, 1)[0]
+			c.parsed.Rewrites = append(c.parsed.Rewrites, r)
+		}
+		c.matchers = c.compileMatchers()
+
+		for _, host := range testHosts {
+			host = normalizeHost(host)
+			for range 2 { // the second time comes from the memo
+				if got, want := c.matchers.payloadMatch(host), naivePayloadMatch(c, host); got != want {
+					t.Fatalf("iteration %d: allow=%q deny=%q host %q: got %+v, want %+v", iter, c.parsed.Payloads.Allow, c.parsed.Payloads.Deny, host, got, want)
+				}
+			}
+			for _, path := range testPaths {
+				if got, want := c.matchers.rewriteIndices(host, path), naiveRewrites(c, host, path); !slices.Equal(got, want) {
+					t.Fatalf("iteration %d: host %q path %q: got rewrites %v, want %v", iter, host, path, got, want)
+				}
+			}
+		}
+	}
+}
+
+// benchConfig returns a config with 100 host and path rules: 25 allow and 25
+// deny patterns for payloads and 50 rewrites.
+func benchConfig() *Config {
+	c := &Config{}
+	for i := range 25 {
+		c.parsed.Payloads.Allow = append(c.parsed.Payloads.Allow, fmt.Sprintf("*.team%d.example.com", i))
+		c.parsed.Payloads.Deny = append(c.parsed.Payloads.Deny, fmt.Sprintf("billing%d.example.net", i))
+	}
+	for i := range 50 {
+		r := &Rewrite{}
+		switch i % 3 {
+		case 0:
+			r.Match.Host = fmt.Sprintf("svc%d.internal", i)
+		case 1:
+			r.Match.Host = fmt.Sprintf("*.region%d.example.com", i)
+			r.Match.Path = fmt.Sprintf("/api/v%d/*", i)
+		case 2:
+			r.Match.Path = fmt.Sprintf("/legacy%d/*/items", i)
+		}
+		c.parsed.Rewrites = append(c.parsed.Rewrites, r)
+	}
+	c.matchers = c.compileMatchers()
+	return c
+}
+
+// benchEvents returns 10k synthetic (host, path) pairs over a few hundred
+// hosts, like a service talking to its dependencies.
+func benchEvents() [][2]string {
+	rng := rand.New(rand.NewPCG(3, 4))
+	var ret [][2]string
+	for range 10000 {
+		var host string
+		switch rng.IntN(4) {
+		case 0:
+			host = fmt.Sprintf("api.team%d.example.com", rng.IntN(40))
+		case 1:
+			host = fmt.Sprintf("billing%d.example.net", rng.IntN(40))
+		case 2:
+			host = fmt.Sprintf("svc%d.internal", rng.IntN(60))
+		case 3:
+			host = fmt.Sprintf("edge.region%d.example.com", rng.IntN(60))
+		}
+		path := fmt.Sprintf("/api/v%d/users/%d", rng.IntN(60), rng.IntN(1000))
+		if rng.IntN(4) == 0 {
+			path = fmt.Sprintf("/legacy%d/%d/items", rng.IntN(60), rng.IntN(1000))
+		}
+		ret = append(ret, [2]string{host, path})
+	}
+	return ret
+}
+
+// matchBudget is the most one event may take on average to be evaluated
+// against the 100 rules of benchConfig. It's generous on purpose so that the
+// check only fails on a regression to per-pattern evaluation, not on a slow
+// machine.
+const matchBudget = 20 * time.Microsecond
+
+func BenchmarkMatchers(b *testing.B) {
+	c, events := benchConfig(), benchEvents()
+	b.ResetTimer()
+	for range b.N {
+		for _, ev := range events {
+			c.IsPayloadAllowed(ev[0])
+			c.GetRewrites(ev[0], ev[1])
+		}
+	}
+	perEvent := b.Elapsed() / time.Duration(b.N*len(events))
+	b.ReportMetric(float64(perEvent.Nanoseconds()), "ns/event")
+	if perEvent > matchBudget {
+		b.Fatalf("took %v per event, want at most %v", perEvent, matchBudget)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"subtrace.dev/filter"
+)
+
+// ProcessInfo identifies the program a traced process is running.
+type ProcessInfo struct {
+	Executable  string   // base name of the executable
+	CommandLine string   // arguments joined by spaces
+	Env         []string // NAME=value pairs, only set if NeedsProcessEnv
+	ContainerID string   // empty if not running in a container
+}
+
+// ProcessMatch selects processes in rules and payload settings. Every field
+// that is set must match.
+type ProcessMatch struct {
+	// Executable is a filepath.Match pattern for the executable's base name.
+	Executable string `yaml:"executable"`
+	// Argv is a substring of the command line (arguments joined by spaces).
+	Argv string `yaml:"argv"`
+	// Env is the name of an environment variable that must be set, or
+	// NAME=value to require a specific value.
+	Env string `yaml:"env"`
+	// Container is the container ID or a prefix of it (e.g. a short ID).
+	Container string `yaml:"container"`
+
+	line int
+}
+
+func (m *ProcessMatch) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		for i := 0; i < len(value.Content); i += 2 {
+			switch key := value.Content[i].Value; key {
+			case "executable", "argv", "env", "container":
+			default:
+				return fmt.Errorf("line %d: unknown process field %q", value.Content[i].Line, key)
+			}
+		}
+	}
+
+	type plain ProcessMatch
+	if err := value.Decode((*plain)(m)); err != nil {
+		return err
+	}
+	m.line = value.Line
+	return nil
+}
+
+func (m *ProcessMatch) validate() error {
+	if *m == (ProcessMatch{line: m.line}) {
+		return fmt.Errorf("line %d: process: at least one of executable, argv, env or container is required", m.line)
+	}
+	if _, err := filepath.Match(m.Executable, ""); err != nil {
+		return fmt.Errorf("line %d: process: invalid executable pattern %q: %w", m.line, m.Executable, err)
+	}
+	if name, _, _ := strings.Cut(m.Env, "="); m.Env != "" && (name == "" || strings.ContainsAny(name, " \t\x00")) {
+		return fmt.Errorf("line %d: process: invalid env %q: want NAME or NAME=value", m.line, m.Env)
+	}
+	for _, c := range m.Container {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return fmt.Errorf("line %d: process: invalid container %q: want a hex container ID", m.line, m.Container)
+		}
+	}
+	return nil
+}
+
+func (m *ProcessMatch) matches(info ProcessInfo) bool {
+	if m.Executable != "" {
+		if ok, _ := filepath.Match(m.Executable, info.Executable); !ok {
+			return false
+		}
+	}
+	if m.Argv != "" && !strings.Contains(info.CommandLine, m.Argv) {
+		return false
+	}
+	if m.Env != "" && !hasEnv(info.Env, m.Env) {
+		return false
+	}
+	if m.Container != "" && (info.ContainerID == "" || !strings.HasPrefix(info.ContainerID, m.Container)) {
+		return false
+	}
+	return true
+}
+
+func hasEnv(env []string, want string) bool {
+	name, val, exact := strings.Cut(want, "=")
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		if k == name && (!exact || v == val) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasProcessRules reports whether any rule or payload setting depends on the
+// process, in which case ForProcess must be used to resolve the config.
+func (c *Config) HasProcessRules() bool {
+	if len(c.parsed.Payloads.Processes) > 0 {
+		return true
+	}
+	for _, rule := range c.parsed.Rules {
+		if rule.Process != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsProcessEnv reports whether resolving the config for a process requires
+// its environment, which is comparatively expensive to read.
+func (c *Config) NeedsProcessEnv() bool {
+	for _, m := range c.processMatches() {
+		if m.Env != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsProcessCommandLine reports whether resolving the config for a process
+// requires its command line.
+func (c *Config) NeedsProcessCommandLine() bool {
+	for _, m := range c.processMatches() {
+		if m.Argv != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsContainerID reports whether resolving the config for a process requires
+// its container ID.
+func (c *Config) NeedsContainerID() bool {
+	for _, m := range c.processMatches() {
+		if m.Container != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) processMatches() []*ProcessMatch {
+	var ret []*ProcessMatch
+	for _, rule := range c.parsed.Rules {
+		if rule.Process != nil {
+			ret = append(ret, rule.Process)
+		}
+	}
+	for i := range c.parsed.Payloads.Processes {
+		ret = append(ret, &c.parsed.Payloads.Processes[i])
+	}
+	return ret
+}
+
+// ForProcess returns a copy of the config with every process-dependent
+// setting resolved for the given process: rules that don't apply to it are
+// dropped and payload capture is decided once. Events are then evaluated
+// against the copy without looking at the process again. Like WithTag, the
+// copy shares everything else.
+func (c *Config) ForProcess(info ProcessInfo) *Config {
+	if !c.HasProcessRules() {
+		return c
+	}
+
+	ret := *c
+	ret.filters = nil
+	for i, f := range c.rules {
+		if m := c.parsed.Rules[i].Process; m == nil || m.matches(info) {
+			ret.filters = append(ret.filters, f)
+		}
+	}
+
+	if len(c.parsed.Payloads.Processes) > 0 {
+		ret.payloadsDenied = true
+		for i := range c.parsed.Payloads.Processes {
+			if c.parsed.Payloads.Processes[i].matches(info) {
+				ret.payloadsDenied = false
+				break
+			}
+		}
+	}
+	return &ret
+}
+
+// ExcludesProcess reports whether every event from the given process is
+// excluded, which is the case if the first rule that applies to it is a
+// process rule without a condition whose action is exclude. Such a process
+// doesn't need to be traced at all.
+func (c *Config) ExcludesProcess(info ProcessInfo) bool {
+	for i, rule := range c.parsed.Rules {
+		if rule.Process != nil && !rule.Process.matches(info) {
+			continue
+		}
+		return rule.Process != nil && rule.If == "" && rule.Match == nil && c.rules[i].Action == filter.ActionExclude
+	}
+	return false
+}
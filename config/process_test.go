@@ -0,0 +1,172 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/event"
+	"subtrace.dev/filter"
+)
+
+func loadConfig(t *testing.T, content string) (*Config, error) {
+	path := filepath.Join(t.TempDir(), "subtrace.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{template: event.New()}
+	return c, c.Load(path)
+}
+
+var testEntry = &har.Entry{
+	Request:  &har.Request{Method: "GET", URL: "/metrics"},
+	Response: &har.Response{Status: 200},
+}
+
+func TestForProcess(t *testing.T) {
+	c, err := loadConfig(t, `
+rules:
+  - process:
+      executable: "metrics-exporter*"
+    then: exclude
+  - if: request.method == "GET"
+    process:
+      env: DEBUG_TRACE=1
+    then: include
+payloads:
+  processes:
+    - executable: api-server
+    - argv: "--capture"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a process, process rules don't apply and payloads aren't
+	// captured.
+	if match, _ := c.GetMatchingRule(nil, testEntry); match != nil {
+		t.Errorf("unresolved config matched %v, want no match", match)
+	}
+	if c.IsPayloadAllowed("example.com") {
+		t.Errorf("unresolved config allows payloads")
+	}
+
+	for _, tt := range []struct {
+		name    string
+		info    ProcessInfo
+		action  filter.Action
+		payload bool
+	}{
+		{"sidecar", ProcessInfo{Executable: "metrics-exporter-v2"}, filter.ActionExclude, false},
+		{"api", ProcessInfo{Executable: "api-server"}, filter.ActionInvalid, true},
+		{"argv", ProcessInfo{Executable: "python3", CommandLine: "python3 app.py --capture"}, filter.ActionInvalid, true},
+		{"env", ProcessInfo{Executable: "worker", Env: []string{"HOME=/", "DEBUG_TRACE=1"}}, filter.ActionInclude, false},
+		{"env mismatch", ProcessInfo{Executable: "worker", Env: []string{"DEBUG_TRACE=0"}}, filter.ActionInvalid, false},
+	} {
+		r := c.ForProcess(tt.info)
+		match, err := r.GetMatchingRule(nil, testEntry)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var action filter.Action
+		if match != nil {
+			action = match.Action
+		}
+		if action != tt.action {
+			t.Errorf("%s: got action %q, want %q", tt.name, action, tt.action)
+		}
+		if got := r.IsPayloadAllowed("example.com"); got != tt.payload {
+			t.Errorf("%s: IsPayloadAllowed = %v, want %v", tt.name, got, tt.payload)
+		}
+	}
+
+	if !c.NeedsProcessEnv() || c.NeedsContainerID() {
+		t.Errorf("NeedsProcessEnv = %v, NeedsContainerID = %v, want true, false", c.NeedsProcessEnv(), c.NeedsContainerID())
+	}
+}
+
+func TestForProcessContainer(t *testing.T) {
+	c, err := loadConfig(t, `
+rules:
+  - process: {container: 3f4e1b2a9c8d}
+    then: exclude
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match, _ := c.ForProcess(ProcessInfo{ContainerID: "3f4e1b2a9c8d7e6f"}).GetMatchingRule(nil, testEntry); match == nil {
+		t.Errorf("container prefix didn't match")
+	}
+	if match, _ := c.ForProcess(ProcessInfo{}).GetMatchingRule(nil, testEntry); match != nil {
+		t.Errorf("process outside a container matched")
+	}
+}
+
+func TestExcludesProcess(t *testing.T) {
+	c, err := loadConfig(t, `
+rules:
+  - process: {executable: ssh}
+    if: request.method == "GET"
+    then: exclude
+  - process: {executable: git}
+    then: include
+  - process: {argv: "--quiet"}
+    then: exclude
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		info ProcessInfo
+		want bool
+	}{
+		{ProcessInfo{Executable: "curl", CommandLine: "curl --quiet example.com"}, true},
+		{ProcessInfo{Executable: "curl", CommandLine: "curl example.com"}, false},
+		{ProcessInfo{Executable: "git", CommandLine: "git fetch --quiet"}, false}, // an earlier rule applies
+		{ProcessInfo{Executable: "ssh", CommandLine: "ssh --quiet"}, false},       // only some events are excluded
+	} {
+		if got := c.ExcludesProcess(tt.info); got != tt.want {
+			t.Errorf("ExcludesProcess(%+v) = %v, want %v", tt.info, got, tt.want)
+		}
+	}
+	if !c.NeedsProcessCommandLine() {
+		t.Errorf("NeedsProcessCommandLine = false with an argv rule")
+	}
+}
+
+func TestForProcessWithoutProcessRules(t *testing.T) {
+	c, err := loadConfig(t, `
+rules:
+  - if: "true"
+    then: exclude
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ForProcess(ProcessInfo{Executable: "x"}) != c {
+		t.Errorf("ForProcess copied a config without process rules")
+	}
+}
+
+func TestProcessValidation(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		want   string
+	}{
+		{"rules:\n  - then: exclude\n    process:\n      executable: \"[\"\n", "rule 0: line 4: process: invalid executable pattern"},
+		{"rules:\n  - then: exclude\n    process:\n      exe: foo\n", "line 4: unknown process field \"exe\""},
+		{"rules:\n  - if: \"true\"\n    then: exclude\n  - then: exclude\n    process: {}\n", "rule 1: line 5: process: at least one of"},
+		{"payloads:\n  processes:\n    - env: \"=x\"\n", "processes 0: line 3: process: invalid env"},
+		{"rules:\n  - then: exclude\n    process: {container: \"not-hex\"}\n", "invalid container"},
+	} {
+		_, err := loadConfig(t, tt.config)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("config:\n%s\ngot error %v, want it to contain %q", tt.config, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// profiles are the config rule sets bundled with subtrace that -profile
+// selects by name, one file per profile.
+//
+//go:embed profiles/*.yaml
+var profiles embed.FS
+
+// ProfileNames returns the names of the bundled profiles.
+func ProfileNames() []string {
+	entries, _ := profiles.ReadDir("profiles")
+	var ret []string
+	for _, e := range entries {
+		ret = append(ret, strings.TrimSuffix(e.Name(), ".yaml"))
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+// AddProfile merges a bundled profile under the config. It must be called
+// before Load or LoadProfiles. The config file takes precedence over every
+// profile and a profile over the ones added after it: scalars and map entries
+// that are already set are kept and lists are appended to, so the rules of the
+// config file match before those of the profiles.
+func (c *Config) AddProfile(name string) error {
+	b, err := profiles.ReadFile(path.Join("profiles", name+".yaml"))
+	if err != nil {
+		return fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(ProfileNames(), ", "))
+	}
+	node := new(yaml.Node)
+	if err := yaml.Unmarshal(b, node); err != nil {
+		return fmt.Errorf("profile %s: decode: %w", name, err)
+	}
+	c.profiles = append(c.profiles, node)
+	return nil
+}
+
+// LoadProfiles loads the profiles added with AddProfile when there's no config
+// file.
+func (c *Config) LoadProfiles() error {
+	c.source = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	return c.load()
+}
+
+// mergeProfiles merges the profiles under the config file.
+func (c *Config) mergeProfiles() {
+	root := c.source
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	c.fromProfile = make(map[*yaml.Node]bool)
+	for _, p := range c.profiles {
+		if p.Kind == yaml.DocumentNode && len(p.Content) > 0 {
+			c.mergeNode(root, p.Content[0])
+		}
+	}
+}
+
+func (c *Config) mergeNode(dst, src *yaml.Node) {
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			key, val := src.Content[i], src.Content[i+1]
+			found := false
+			for j := 0; j+1 < len(dst.Content); j += 2 {
+				if dst.Content[j].Value == key.Value {
+					c.mergeNode(dst.Content[j+1], val)
+					found = true
+					break
+				}
+			}
+			if !found {
+				dst.Content = append(dst.Content, key, val)
+				c.fromProfile[val] = true
+			}
+		}
+	case dst.Kind == yaml.ScalarNode && dst.Tag == "!!null":
+		// An empty section in the config file (e.g. "payloads:" with nothing
+		// under it) doesn't hide the profile's.
+		*dst = *src
+		c.fromProfile[dst] = true
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode:
+		for _, elem := range src.Content {
+			dst.Content = append(dst.Content, elem)
+			c.fromProfile[elem] = true
+		}
+	}
+}
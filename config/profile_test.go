@@ -0,0 +1,119 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"subtrace.dev/event"
+)
+
+func TestBundledProfiles(t *testing.T) {
+	names := ProfileNames()
+	if len(names) == 0 {
+		t.Fatal("no bundled profiles")
+	}
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			c := &Config{template: event.New()}
+			if err := c.AddProfile(name); err != nil {
+				t.Fatalf("add profile: %v", err)
+			}
+			if err := c.LoadProfiles(); err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if problems := c.Check(4096); len(problems) > 0 {
+				t.Errorf("got problems %v", problems)
+			}
+		})
+	}
+}
+
+func TestProfileMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subtrace.yaml")
+	content := `
+tags:
+  subtrace_profile: mine
+  team: build
+payloads:
+  allow: ["artifacts.internal"]
+rules:
+  - if: "request.url.contains('/metrics')"
+    then: exclude
+  - then: bogus
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{template: event.New()}
+	if err := c.AddProfile("build-tools"); err != nil {
+		t.Fatalf("add profile: %v", err)
+	}
+	err := c.Load(path)
+	if err == nil || !strings.Contains(err.Error(), "rule 1: line 10:") {
+		t.Fatalf("got error %v, want the config file's line for rule 1", err)
+	}
+
+	content = strings.ReplaceAll(content, "  - then: bogus\n", "")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c = &Config{template: event.New()}
+	if err := c.AddProfile("build-tools"); err != nil {
+		t.Fatalf("add profile: %v", err)
+	}
+	if err := c.Load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	tmpl := c.GetEventTemplate()
+	if got := tmpl.Get("subtrace_profile"); got != "mine" {
+		t.Errorf("got tag subtrace_profile=%q, want the config file's", got)
+	}
+	if got := tmpl.Get("team"); got != "build" {
+		t.Errorf("got tag team=%q", got)
+	}
+	if c.IsPayloadAllowed("registry.npmjs.org") {
+		t.Errorf("payloads allowed despite the profile's deny")
+	}
+	if !c.IsPayloadAllowed("artifacts.internal") {
+		t.Errorf("payloads denied despite the config file's allow")
+	}
+	if len(c.rules) != 1 {
+		t.Errorf("got %d rules, want 1", len(c.rules))
+	}
+}
+
+// TestProfileEmptySection checks that an empty section in the config file
+// doesn't hide the profile's.
+func TestProfileEmptySection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subtrace.yaml")
+	if err := os.WriteFile(path, []byte("payloads:\ntags:\n  team: build\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{template: event.New()}
+	if err := c.AddProfile("build-tools"); err != nil {
+		t.Fatalf("add profile: %v", err)
+	}
+	if err := c.Load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if c.IsPayloadAllowed("proxy.golang.org") {
+		t.Errorf("payloads allowed despite the profile's deny")
+	}
+	if got := c.line("payloads", "deny"); got != 0 {
+		t.Errorf("got line %d for a profile setting, want 0", got)
+	}
+}
+
+func TestUnknownProfile(t *testing.T) {
+	c := &Config{template: event.New()}
+	err := c.AddProfile("nope")
+	if err == nil || !strings.Contains(err.Error(), "build-tools") {
+		t.Fatalf("got error %v, want one that lists the profiles", err)
+	}
+}
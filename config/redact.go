@@ -0,0 +1,404 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultRedactedHeaders are the headers whose values are redacted unless the
+// redact section sets defaultHeaders to false.
+var DefaultRedactedHeaders = []string{"authorization", "proxy-authorization", "cookie", "set-cookie", "x-api-key"}
+
+// redactedValue replaces the header and body values that are redacted.
+const redactedValue = "[redacted]"
+
+// Redact configures what is scrubbed from events before they leave the
+// tracer, so that no sink, the devtools endpoint or the HAR file ever sees it.
+// Header values are replaced as configured by authCredentials.
+type Redact struct {
+	// Headers are redacted in addition to DefaultRedactedHeaders. Names are
+	// compared case-insensitively.
+	Headers []string `yaml:"headers"`
+	// DefaultHeaders can be set to false to redact only Headers.
+	DefaultHeaders *bool `yaml:"defaultHeaders"`
+	// JSONPaths select the values to redact in JSON bodies, like
+	// "$.user.password", "$.items[*].card" or "$..token".
+	JSONPaths []string `yaml:"jsonPaths"`
+	// Patterns are regular expressions whose matches are redacted in bodies
+	// that aren't JSON. If a pattern has groups, only the groups are redacted
+	// (e.g. "password=([^&]*)").
+	Patterns []string `yaml:"patterns"`
+}
+
+// redactor is the compiled redact section.
+type redactor struct {
+	headers  map[string]bool
+	paths    [][]pathSegment
+	patterns []*regexp.Regexp
+}
+
+func (r *Redact) compile(line func(path ...any) int) (*redactor, error) {
+	ret := &redactor{headers: make(map[string]bool)}
+	if r.DefaultHeaders == nil || *r.DefaultHeaders {
+		for _, name := range DefaultRedactedHeaders {
+			ret.headers[name] = true
+		}
+	}
+	for i, name := range r.Headers {
+		if !isValidHeaderName(name) {
+			return nil, fmt.Errorf("line %d: invalid header name %q", line("redact", "headers", i), name)
+		}
+		ret.headers[strings.ToLower(name)] = true
+	}
+	for i, expr := range r.JSONPaths {
+		path, err := parseJSONPath(expr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid JSON path %q: %w", line("redact", "jsonPaths", i), expr, err)
+		}
+		ret.paths = append(ret.paths, path)
+	}
+	for i, expr := range r.Patterns {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern: %w", line("redact", "patterns", i), err)
+		}
+		ret.patterns = append(ret.patterns, re)
+	}
+	return ret, nil
+}
+
+// defaultRedactor applies if the config wasn't loaded from a file.
+var defaultRedactor, _ = new(Redact).compile(nil)
+
+func (c *Config) getRedactor() *redactor {
+	if c.redactor != nil {
+		return c.redactor
+	}
+	return defaultRedactor
+}
+
+// RedactsHeader reports whether the values of the named header are redacted.
+func (c *Config) RedactsHeader(name string) bool {
+	return c.getRedactor().headers[strings.ToLower(name)]
+}
+
+// RedactedHeaders returns the lowercase names of the headers whose values are
+// redacted, sorted.
+func (c *Config) RedactedHeaders() []string {
+	return slices.Sorted(maps.Keys(c.getRedactor().headers))
+}
+
+// RedactsJSONValues reports whether any values of JSON bodies are redacted,
+// in which case body previews mustn't show any.
+func (c *Config) RedactsJSONValues() bool {
+	return len(c.getRedactor().paths) > 0
+}
+
+// RedactBody returns the body with the values selected by the JSON paths
+// redacted if the mime type is JSON, or with the matches of the patterns
+// redacted otherwise. A JSON body that ends early is redacted up to where it
+// ends and cut there. It reports whether anything was redacted.
+func (c *Config) RedactBody(mimeType string, body []byte) ([]byte, bool) {
+	r := c.getRedactor()
+	if len(body) == 0 {
+		return body, false
+	}
+	if len(r.paths) > 0 && isJSON(mimeType) {
+		if ret, ok, err := r.redactJSON(body); err == nil {
+			return ret, ok
+		}
+		// Not JSON after all: fall back to the patterns.
+	}
+	return r.redactPatterns(body)
+}
+
+func isJSON(mimeType string) bool {
+	mt, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+func (r *redactor) redactPatterns(body []byte) ([]byte, bool) {
+	redacted := false
+	for _, re := range r.patterns {
+		matches := re.FindAllSubmatchIndex(body, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var b bytes.Buffer
+		prev := 0
+		for _, m := range matches {
+			if len(m) > 2 {
+				m = m[2:] // only the groups
+			}
+			for i := 0; i+1 < len(m); i += 2 {
+				if m[i] < prev {
+					continue // didn't participate, or nested in one that did
+				}
+				b.Write(body[prev:m[i]])
+				b.WriteString(redactedValue)
+				prev = m[i+1]
+				redacted = true
+			}
+		}
+		b.Write(body[prev:])
+		body = b.Bytes()
+	}
+	return body, redacted
+}
+
+// pathSegment is a step of a JSON path: a key, an array index, or either if
+// wildcard is set. descend matches any number of steps before it, as in "..".
+type pathSegment struct {
+	key      string
+	index    int // -1 if the segment is a key
+	wildcard bool
+	descend  bool
+}
+
+// parseJSONPath parses the subset of JSONPath made of "$" followed by
+// ".key", "['key']", "[0]", ".*", "[*]" and "..key" steps.
+func parseJSONPath(expr string) ([]pathSegment, error) {
+	rest, ok := strings.CutPrefix(expr, "$")
+	if !ok {
+		return nil, fmt.Errorf("must start with $")
+	}
+	var ret []pathSegment
+	for rest != "" {
+		seg := pathSegment{index: -1}
+		if after, ok := strings.CutPrefix(rest, ".."); ok {
+			seg.descend, rest = true, after
+			if !strings.HasPrefix(rest, "[") {
+				rest = "." + rest
+			}
+		}
+		switch {
+		case rest[0] == '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			seg.key, rest = rest[:end], rest[end:]
+			if seg.key == "" {
+				return nil, fmt.Errorf("empty key")
+			}
+			seg.wildcard = seg.key == "*"
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [")
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				seg.wildcard = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				seg.key = inner[1 : len(inner)-1]
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid index %q", inner)
+				}
+				seg.index = n
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+		ret = append(ret, seg)
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("selects the whole body")
+	}
+	return ret, nil
+}
+
+// pathStep is a step into a JSON value: a key, or an index if key is nil.
+type pathStep struct {
+	key   *string
+	index int
+}
+
+func (s pathSegment) matches(step pathStep) bool {
+	switch {
+	case s.wildcard:
+		return true
+	case step.key != nil:
+		return s.index < 0 && s.key == *step.key
+	default:
+		return s.index == step.index
+	}
+}
+
+func matchPath(pattern []pathSegment, path []pathStep) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	s := pattern[0]
+	if s.descend {
+		for i := range path {
+			if s.matches(path[i]) && matchPath(pattern[1:], path[i+1:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return len(path) > 0 && s.matches(path[0]) && matchPath(pattern[1:], path[1:])
+}
+
+func (r *redactor) selects(path []pathStep) bool {
+	for _, pattern := range r.paths {
+		if matchPath(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactJSON re-encodes the body compactly, replacing the selected values. It
+// returns the body unchanged if nothing was selected and an error if the body
+// isn't JSON.
+func (r *redactor) redactJSON(body []byte) ([]byte, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	type frame struct {
+		object bool
+		n      int // values so far
+		key    string
+	}
+	var (
+		out      bytes.Buffer
+		stack    []frame
+		path     []pathStep
+		redacted bool
+	)
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	writeString := func(s string) {
+		enc.Encode(s)
+		out.Truncate(out.Len() - 1) // the newline added by Encode
+	}
+	// valuePath returns the path of the value about to be read.
+	valuePath := func() []pathStep {
+		path = path[:0]
+		for i := range stack {
+			if stack[i].object {
+				path = append(path, pathStep{key: &stack[i].key})
+			} else {
+				path = append(path, pathStep{index: stack[i].n})
+			}
+		}
+		return path
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF && len(stack) == 0 {
+			break
+		}
+		if err != nil {
+			if cutShort(err) && out.Len() > 0 {
+				break // keep what was redacted
+			}
+			return nil, false, err
+		}
+
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			out.WriteByte(byte(d))
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 {
+				stack[len(stack)-1].n++
+			}
+			continue
+		}
+
+		if len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if top.object {
+				key, _ := tok.(string)
+				if top.n > 0 {
+					out.WriteByte(',')
+				}
+				writeString(key)
+				out.WriteByte(':')
+				top.key = key
+				if tok, err = dec.Token(); err != nil {
+					if cutShort(err) {
+						break
+					}
+					return nil, false, err
+				}
+			} else if top.n > 0 {
+				out.WriteByte(',')
+			}
+		} else if out.Len() > 0 {
+			out.WriteByte('\n') // another value in a stream of them
+		}
+
+		if len(stack) > 0 && r.selects(valuePath()) {
+			writeString(redactedValue)
+			redacted = true
+			if d, ok := tok.(json.Delim); ok && (d == '{' || d == '[') {
+				for depth := 1; depth > 0; {
+					tok, err := dec.Token()
+					if err != nil {
+						break
+					}
+					switch tok {
+					case json.Delim('{'), json.Delim('['):
+						depth++
+					case json.Delim('}'), json.Delim(']'):
+						depth--
+					}
+				}
+			}
+			if len(stack) > 0 {
+				stack[len(stack)-1].n++
+			}
+			continue
+		}
+
+		switch tok := tok.(type) {
+		case json.Delim:
+			out.WriteByte(byte(tok))
+			stack = append(stack, frame{object: tok == '{'})
+			continue
+		case string:
+			writeString(tok)
+		case json.Number:
+			out.WriteString(tok.String())
+		case bool:
+			out.WriteString(strconv.FormatBool(tok))
+		case nil:
+			out.WriteString("null")
+		}
+		if len(stack) > 0 {
+			stack[len(stack)-1].n++
+		}
+	}
+	if !redacted {
+		return body, false, nil
+	}
+	return out.Bytes(), true, nil
+}
+
+// cutShort reports whether a decoding error is due to the body ending early.
+func cutShort(err error) bool {
+	return err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,149 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"subtrace.dev/event"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	defaults := &Config{template: event.New()}
+	extended, err := loadConfig(t, "redact:\n  headers: [X-Session-Token]\n")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	disabled, err := loadConfig(t, "redact:\n  defaultHeaders: false\n  headers: [x-session-token]\n")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name                         string
+		defaults, extended, disabled bool
+	}{
+		{"Authorization", true, true, false},
+		{"set-cookie", true, true, false},
+		{"X-Api-Key", true, true, false},
+		{"x-session-token", false, true, true},
+		{"content-type", false, false, false},
+	} {
+		for _, c := range []struct {
+			name string
+			c    *Config
+			want bool
+		}{
+			{"defaults", defaults, tt.defaults},
+			{"extended", extended, tt.extended},
+			{"disabled", disabled, tt.disabled},
+		} {
+			if got := c.c.RedactsHeader(tt.name); got != c.want {
+				t.Errorf("%s: RedactsHeader(%q) = %v, want %v", c.name, tt.name, got, c.want)
+			}
+		}
+	}
+	if got, want := strings.Join(disabled.RedactedHeaders(), ","), "x-session-token"; got != want {
+		t.Errorf("disabled: RedactedHeaders() = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(defaults.RedactedHeaders(), ","), "authorization,cookie,proxy-authorization,set-cookie,x-api-key"; got != want {
+		t.Errorf("defaults: RedactedHeaders() = %q, want %q", got, want)
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	c, err := loadConfig(t, `
+redact:
+  jsonPaths:
+    - $.user.password
+    - $.cards[*].number
+    - $..token
+    - $['api key']
+  patterns:
+    - "password=([^&]*)"
+    - "\\b[0-9]{16}\\b"
+`)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		mimeType string
+		body     string
+		want     string
+	}{
+		{
+			name:     "json",
+			mimeType: "application/json; charset=utf-8",
+			body:     `{"user": {"name": "<ann>", "password": "hunter2"}, "cards": [{"number": 4111, "exp": "12/30"}], "api key": {"a": [1]}}`,
+			want:     `{"user":{"name":"<ann>","password":"[redacted]"},"cards":[{"number":"[redacted]","exp":"12/30"}],"api key":"[redacted]"}`,
+		},
+		{
+			name:     "recursive",
+			mimeType: "application/vnd.api+json",
+			body:     `[{"token": "a"}, {"nested": {"token": ["b"]}}, "token"]`,
+			want:     `[{"token":"[redacted]"},{"nested":{"token":"[redacted]"}},"token"]`,
+		},
+		{
+			name:     "nothing selected",
+			mimeType: "application/json",
+			body:     `{"user": {"name": "ann"}}`,
+			want:     `{"user": {"name": "ann"}}`,
+		},
+		{
+			name:     "cut short",
+			mimeType: "application/json",
+			body:     `{"user": {"password": "hunter2"}, "cards": [{"numb`,
+			want:     `{"user":{"password":"[redacted]"},"cards":[{`,
+		},
+		{
+			name:     "not json after all",
+			mimeType: "application/json",
+			body:     `password=hunter2&user=ann`,
+			want:     `password=[redacted]&user=ann`,
+		},
+		{
+			name:     "form",
+			mimeType: "application/x-www-form-urlencoded",
+			body:     `user=ann&password=hunter2&card=4111111111111111`,
+			want:     `user=ann&password=[redacted]&card=[redacted]`,
+		},
+		{
+			name:     "json path in text",
+			mimeType: "text/plain",
+			body:     `{"token": "a"}`,
+			want:     `{"token": "a"}`,
+		},
+	} {
+		got, redacted := c.RedactBody(tt.mimeType, []byte(tt.body))
+		if string(got) != tt.want || redacted != (tt.want != tt.body) {
+			t.Errorf("%s: got %s, %v, want %s", tt.name, got, redacted, tt.want)
+		}
+	}
+	if !c.RedactsJSONValues() {
+		t.Errorf("JSON paths configured but values not reported as redacted")
+	}
+}
+
+func TestRedactValidation(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		want   string
+	}{
+		{"redact:\n  headers: [\"x y\"]\n", `line 2: invalid header name "x y"`},
+		{"redact:\n  jsonPaths: [user.password]\n", "must start with $"},
+		{"redact:\n  jsonPaths: [$]\n", "selects the whole body"},
+		{"redact:\n  jsonPaths: [\"$.a[x]\"]\n", `invalid index "x"`},
+		{"redact:\n  jsonPaths: [\"$.a[0\"]\n", "unterminated ["},
+		{"redact:\n  jsonPaths: [\"$..\"]\n", "empty key"},
+		{"redact:\n  patterns: [\"(\"]\n", "line 2: invalid pattern"},
+	} {
+		_, err := loadConfig(t, tt.config)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("config:\n%s\ngot error %v, want it to contain %q", tt.config, err, tt.want)
+		}
+	}
+}
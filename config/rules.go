@@ -0,0 +1,310 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/martian/v3/har"
+	"gopkg.in/yaml.v3"
+	"subtrace.dev/filter"
+)
+
+// EventMatch selects events in rules by their request and response without
+// a CEL expression, which is cheap enough for rules that drop most requests
+// like health checks. Every field that is set must match.
+type EventMatch struct {
+	// Host is a filepath.Match pattern for the request's host, without the
+	// port (e.g. "*.internal").
+	Host string `yaml:"host"`
+	// Path is a filepath.Match pattern for the request's path, where "*"
+	// doesn't match '/' (e.g. "/healthz", "/api/*/status").
+	Path string `yaml:"path"`
+	// PathRegex is a regular expression that the path must contain a match of.
+	PathRegex string `yaml:"pathRegex"`
+	// Method is the request method, compared case-insensitively.
+	Method string `yaml:"method"`
+	// Status is a response status ("404"), a class ("5xx") or an inclusive
+	// range ("200-299").
+	Status string `yaml:"status"`
+
+	line int
+}
+
+func (m *EventMatch) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		for i := 0; i < len(value.Content); i += 2 {
+			switch key := value.Content[i].Value; key {
+			case "host", "path", "pathRegex", "method", "status":
+			default:
+				return fmt.Errorf("line %d: unknown match field %q", value.Content[i].Line, key)
+			}
+		}
+	}
+
+	type plain EventMatch
+	if err := value.Decode((*plain)(m)); err != nil {
+		return err
+	}
+	m.line = value.Line
+	return nil
+}
+
+// String describes the match in the same terms as the config.
+func (m *EventMatch) String() string {
+	var parts []string
+	for _, f := range []struct{ key, val string }{
+		{"host", m.Host}, {"path", m.Path}, {"pathRegex", m.PathRegex}, {"method", m.Method}, {"status", m.Status},
+	} {
+		if f.val != "" {
+			parts = append(parts, f.key+"="+f.val)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// eventMatcher is a compiled EventMatch.
+type eventMatcher struct {
+	host, path *glob // nil matches everything
+	pathRegex  *regexp.Regexp
+	method     string
+	statusLo   int
+	statusHi   int // 0 if any status matches
+
+	// request is set if the match looks at the request, which connection
+	// events don't have.
+	request bool
+}
+
+func (m *EventMatch) compile() (*eventMatcher, error) {
+	if *m == (EventMatch{line: m.line}) {
+		return nil, fmt.Errorf("line %d: match: at least one of host, path, pathRegex, method or status is required", m.line)
+	}
+
+	em := &eventMatcher{method: strings.ToUpper(m.Method)}
+	em.request = m.Host != "" || m.Path != "" || m.PathRegex != "" || m.Method != ""
+	for _, pattern := range []string{m.Host, m.Path} {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("line %d: match: invalid pattern %q: %w", m.line, pattern, err)
+		}
+	}
+	if m.Host != "" {
+		g := compileGlob(strings.ToLower(m.Host))
+		em.host = &g
+	}
+	if m.Path != "" {
+		g := compileGlob(m.Path)
+		em.path = &g
+	}
+	if m.PathRegex != "" {
+		re, err := regexp.Compile(m.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: match: invalid pathRegex: %w", m.line, err)
+		}
+		em.pathRegex = re
+	}
+	if m.Status != "" {
+		lo, hi, err := parseStatusRange(m.Status)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: match: %w", m.line, err)
+		}
+		em.statusLo, em.statusHi = lo, hi
+	}
+	return em, nil
+}
+
+// parseStatusRange parses "404", "5xx" or "200-299".
+func parseStatusRange(s string) (int, int, error) {
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") && s[0] >= '1' && s[0] <= '5' {
+		lo := int(s[0]-'0') * 100
+		return lo, lo + 99, nil
+	}
+	from, to, isRange := strings.Cut(s, "-")
+	lo, err1 := strconv.Atoi(strings.TrimSpace(from))
+	hi, err2 := lo, error(nil)
+	if isRange {
+		hi, err2 = strconv.Atoi(strings.TrimSpace(to))
+	}
+	if err1 != nil || err2 != nil || lo < 100 || hi > 599 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid status %q: want a status, a class like 5xx or a range like 200-299", s)
+	}
+	return lo, hi, nil
+}
+
+// matches reports whether an event matches. host must be normalized.
+func (m *eventMatcher) matches(entry *har.Entry, host, path string) bool {
+	if m.request {
+		if entry.Request == nil || entry.Request.URL == "" {
+			return false
+		}
+		if m.host != nil && (host == "" || !m.host.match(host)) {
+			return false
+		}
+		if m.path != nil && !m.path.match(path) {
+			return false
+		}
+		if m.pathRegex != nil && !m.pathRegex.MatchString(path) {
+			return false
+		}
+		if m.method != "" && !strings.EqualFold(entry.Request.Method, m.method) {
+			return false
+		}
+	}
+	if m.statusHi != 0 {
+		if entry.Response == nil || entry.Response.Status < m.statusLo || entry.Response.Status > m.statusHi {
+			return false
+		}
+	}
+	return true
+}
+
+// requestTarget returns the normalized host and the path of a request. The
+// URL of a request received by a server is just the path, in which case the
+// host comes from the Host header.
+func requestTarget(req *har.Request) (string, string) {
+	if req == nil {
+		return "", ""
+	}
+	var host, path string
+	if u, err := url.Parse(req.URL); err == nil {
+		host, path = u.Host, u.Path
+	}
+	if host == "" {
+		for _, hdr := range req.Headers {
+			if strings.EqualFold(hdr.Name, "host") {
+				host = hdr.Value
+				break
+			}
+		}
+	}
+	return normalizeHost(host), path
+}
+
+// Rule is a compiled entry of the rules section.
+type Rule struct {
+	Index  int
+	Action filter.Action // include, exclude or sample
+	Rate   float64       // the fraction of matching events that a sample rule keeps
+
+	expr  *filter.Filter // nil if the rule has only a match
+	match *eventMatcher  // nil if the rule has no match
+
+	matched atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// parseThen parses the action of a rule: include or keep, exclude or drop, or
+// "sample <rate>" with a rate in (0, 1].
+func parseThen(then string) (filter.Action, float64, error) {
+	switch then {
+	case "include", "keep":
+		return filter.ActionInclude, 0, nil
+	case "exclude", "drop":
+		return filter.ActionExclude, 0, nil
+	}
+	if arg, ok := strings.CutPrefix(then, "sample "); ok {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil || !(rate > 0 && rate <= 1) {
+			return "", 0, fmt.Errorf("invalid sample rate %q: want a fraction in (0, 1]", arg)
+		}
+		return filter.ActionSample, rate, nil
+	}
+	return "", 0, fmt.Errorf("invalid action %q: want include, exclude, keep, drop or sample <rate>", then)
+}
+
+// then returns the rule's action as it's compared between rules.
+func (r *Rule) then() string {
+	if r.Action == filter.ActionSample {
+		return fmt.Sprintf("sample %g", r.Rate)
+	}
+	return string(r.Action)
+}
+
+func (r *Rule) LogValue() slog.Value {
+	if r == nil {
+		return slog.AnyValue(nil)
+	}
+	return slog.GroupValue(slog.Int("index", r.Index), slog.String("then", r.then()))
+}
+
+// eval reports whether the rule matches an event.
+func (r *Rule) eval(tags map[string]string, entry *har.Entry, host, path string) (bool, error) {
+	if r.match != nil && !r.match.matches(entry, host, path) {
+		return false, nil
+	}
+	if r.expr == nil {
+		return true, nil
+	}
+	return r.expr.Eval(tags, entry)
+}
+
+// Keep decides whether an event that the rule matched is kept and counts the
+// ones it drops. Sample rules keep a random fraction of them.
+func (r *Rule) Keep() bool {
+	switch r.Action {
+	case filter.ActionInclude:
+		return true
+	case filter.ActionSample:
+		if rand.Float64() < r.Rate {
+			return true
+		}
+	}
+	r.dropped.Add(1)
+	return false
+}
+
+// GetMatchingRule returns the first rule that matches an event, or nil if
+// none does and the event is kept.
+func (c *Config) GetMatchingRule(tags map[string]string, entry *har.Entry) (*Rule, error) {
+	var host, path string
+	parsed := false
+	for _, r := range c.filters {
+		if r.match != nil && r.match.request && !parsed {
+			host, path = requestTarget(entry.Request)
+			parsed = true
+		}
+		match, err := r.eval(tags, entry, host, path)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: eval: %w", r.Index, err)
+		}
+		if match {
+			r.matched.Add(1)
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// RuleMetric counts the events a rule decided.
+type RuleMetric struct {
+	Index   int    `json:"index"`
+	Line    int    `json:"line"`
+	Then    string `json:"then"`
+	Matched uint64 `json:"matched"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// RuleMetrics returns how many events each rule matched and dropped so far,
+// across every process.
+func (c *Config) RuleMetrics() []RuleMetric {
+	ret := make([]RuleMetric, 0, len(c.rules))
+	for _, r := range c.rules {
+		ret = append(ret, RuleMetric{
+			Index:   r.Index,
+			Line:    c.line("rules", r.Index),
+			Then:    c.parsed.Rules[r.Index].Then,
+			Matched: r.matched.Load(),
+			Dropped: r.dropped.Load(),
+		})
+	}
+	return ret
+}
@@ -0,0 +1,153 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/filter"
+)
+
+func TestMatchRules(t *testing.T) {
+	c, err := loadConfig(t, `
+rules:
+  - match: {path: /healthz}
+    then: drop
+  - match: {host: "poller.internal", method: get}
+    then: sample 0.01
+  - match: {pathRegex: "^/api/v[0-9]+/", status: 5xx}
+    then: keep
+  - match: {status: 200-399}
+    if: request.method == "POST"
+    then: drop
+`)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	entry := func(method, url string, status int, headers ...har.Header) *har.Entry {
+		return &har.Entry{
+			Request:  &har.Request{Method: method, URL: url, Headers: headers},
+			Response: &har.Response{Status: status},
+		}
+	}
+	for _, tt := range []struct {
+		name  string
+		entry *har.Entry
+		want  int // index of the matching rule, -1 for none
+	}{
+		{"health check", entry("GET", "http://api.internal:8080/healthz", 200), 0},
+		{"health check with host header", entry("GET", "/healthz", 200, har.Header{Name: "Host", Value: "api.internal"}), 0},
+		{"nested health check", entry("GET", "/v1/healthz", 200), -1},
+		{"poll", entry("GET", "/", 304, har.Header{Name: "host", Value: "Poller.Internal:80"}), 1},
+		{"poll with another method", entry("PUT", "http://poller.internal/", 200), -1},
+		{"api error", entry("GET", "/api/v2/users", 503), 2},
+		{"api success", entry("GET", "/api/v2/users", 200), -1},
+		{"post", entry("POST", "/api/v2/users", 201), 3},
+		{"connection", &har.Entry{Request: &har.Request{}, Response: &har.Response{}}, -1},
+	} {
+		rule, err := c.GetMatchingRule(nil, tt.entry)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := -1
+		if rule != nil {
+			got = rule.Index
+		}
+		if got != tt.want {
+			t.Errorf("%s: got rule %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRuleActions(t *testing.T) {
+	c, err := loadConfig(t, `
+rules:
+  - match: {path: /healthz}
+    then: drop
+  - match: {path: /poll}
+    then: sample 0.1
+  - if: "true"
+    then: keep
+`)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	kept := make(map[string]int)
+	const n = 10000
+	for _, path := range []string{"/healthz", "/poll", "/users"} {
+		for i := 0; i < n; i++ {
+			rule, err := c.GetMatchingRule(nil, &har.Entry{
+				Request:  &har.Request{Method: "GET", URL: path},
+				Response: &har.Response{Status: 200},
+			})
+			if err != nil || rule == nil {
+				t.Fatalf("%s: got rule %v, %v, want a match", path, rule, err)
+			}
+			if rule.Keep() {
+				kept[path]++
+			}
+		}
+	}
+	if kept["/healthz"] != 0 || kept["/users"] != n {
+		t.Errorf("kept %d health checks and %d users requests, want 0 and %d", kept["/healthz"], kept["/users"], n)
+	}
+	if k := kept["/poll"]; k < n/20 || k > n/5 {
+		t.Errorf("sample 0.1 kept %d of %d events", k, n)
+	}
+
+	m := c.RuleMetrics()
+	if len(m) != 3 || m[0].Dropped != n || m[1].Dropped != uint64(n-kept["/poll"]) || m[2].Dropped != 0 {
+		t.Errorf("got metrics %+v, want every health check and the unsampled polls dropped", m)
+	}
+	if m[1].Matched != n || m[1].Line != 5 || m[1].Then != "sample 0.1" {
+		t.Errorf("got metric %+v for the sample rule", m[1])
+	}
+	if c.rules[1].Action != filter.ActionSample || c.rules[1].Rate != 0.1 {
+		t.Errorf("got action %q rate %v, want sample 0.1", c.rules[1].Action, c.rules[1].Rate)
+	}
+}
+
+func TestRuleValidation(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		want   string
+	}{
+		{"rules:\n  - then: sample 2\n    match: {path: /x}\n", "rule 0: line 2: invalid sample rate"},
+		{"rules:\n  - then: discard\n    match: {path: /x}\n", `invalid action "discard"`},
+		{"rules:\n  - then: drop\n    match: {}\n", "rule 0: line 3: match: at least one of"},
+		{"rules:\n  - then: drop\n    match: {url: /x}\n", `unknown match field "url"`},
+		{"rules:\n  - then: drop\n    match: {path: \"[\"}\n", "invalid pattern"},
+		{"rules:\n  - then: drop\n    match: {pathRegex: \"(\"}\n", "invalid pathRegex"},
+		{"rules:\n  - then: drop\n    match: {status: 5x}\n", `invalid status "5x"`},
+		{"rules:\n  - then: drop\n    match: {status: 299-200}\n", "invalid status"},
+	} {
+		_, err := loadConfig(t, tt.config)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("config:\n%s\ngot error %v, want it to contain %q", tt.config, err, tt.want)
+		}
+	}
+}
+
+func TestCheckMatchRules(t *testing.T) {
+	c, err := loadConfig(t, `
+rules:
+  - match: {path: /healthz}
+    then: drop
+  - match: {path: /healthz}
+    then: exclude
+  - match: {path: /readyz}
+    then: keep
+`)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	problems := c.Check(1)
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "rule 1 is unreachable") {
+		t.Errorf("got problems %v, want rule 1 reported as unreachable", problems)
+	}
+}
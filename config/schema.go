@@ -0,0 +1,115 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// unknownFields returns an error for every mapping key in node that the
+// fields of t, the Go type node decodes into, don't have. yaml.v3 ignores
+// unknown keys, so a misspelled setting would otherwise silently do nothing.
+// Types with their own UnmarshalYAML check their keys themselves. where names
+// node in errors, e.g. "rules[2]".
+func unknownFields(node *yaml.Node, t reflect.Type, where string) []error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if reflect.PointerTo(t).Implements(reflect.TypeFor[yaml.Unmarshaler]()) {
+		return nil
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+
+	var ret []error
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return nil // Decode reports the type mismatch
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, val := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				continue // merge key
+			}
+			field, ok := yamlField(t, key.Value)
+			if !ok {
+				loc := where
+				if loc == "" {
+					loc = "the top level"
+				}
+				ret = append(ret, fmt.Errorf("line %d: unknown field %q in %s%s", key.Line, key.Value, loc, knownFieldsHint(t)))
+				continue
+			}
+			ret = append(ret, unknownFields(val, field.Type, joinWhere(where, key.Value))...)
+		}
+	case reflect.Slice, reflect.Array:
+		if node.Kind != yaml.SequenceNode {
+			return nil
+		}
+		for i, elem := range node.Content {
+			ret = append(ret, unknownFields(elem, t.Elem(), fmt.Sprintf("%s[%d]", where, i))...)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			ret = append(ret, unknownFields(node.Content[i+1], t.Elem(), joinWhere(where, node.Content[i].Value))...)
+		}
+	}
+	return ret
+}
+
+// yamlField returns the field of struct type t that the mapping key name
+// decodes into.
+func yamlField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if f.IsExported() && yamlName(f) == name && name != "-" {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// yamlName returns the mapping key of a struct field, which is its name in
+// lower case unless the yaml tag says otherwise.
+func yamlName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+	return name
+}
+
+// knownFieldsHint lists the fields of struct type t for an unknown field
+// error.
+func knownFieldsHint(t reflect.Type) string {
+	var names []string
+	for i := range t.NumField() {
+		if f := t.Field(i); f.IsExported() && yamlName(f) != "-" {
+			names = append(names, yamlName(f))
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (want one of %s)", strings.Join(names, ", "))
+}
+
+func joinWhere(where, key string) string {
+	if where == "" {
+		return key
+	}
+	return where + "." + key
+}
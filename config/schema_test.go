@@ -0,0 +1,77 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnknownFields(t *testing.T) {
+	for _, tt := range []struct {
+		yaml string
+		want string
+	}{
+		{"tag:\n  team: payments\n", `line 1: unknown field "tag" in the top level`},
+		{"payloads:\n  allow: [\"*\"]\n  denny: [\"*\"]\n", `line 3: unknown field "denny" in payloads (want one of allow, deny, processes, keep)`},
+		{"rewrites:\n  - match: {host: a}\n  - match: {hots: b}\n", `line 3: unknown field "hots" in rewrites[1].match`},
+		{"sinks:\n  - name: audit\n    routes:\n      - header: \"X-A: *\"\n        iff: \"true\"\n", `line 5: unknown field "iff" in sinks[0].routes[0]`},
+		{"sampling:\n  rate: 0.5\n  sed: fleet\n", `line 3: unknown field "sed" in sampling`},
+		{"rules:\n  - then: exclude\n    match: {paths: /x}\n", `line 3: unknown match field "paths"`},
+	} {
+		if _, err := loadConfig(t, tt.yaml); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got err %v, want %q", tt.yaml, err, tt.want)
+		}
+	}
+
+	if _, err := loadConfig(t, "base: &base\n  then: exclude\nrules:\n  - <<: *base\n    if: \"true\"\n"); err != nil && strings.Contains(err.Error(), `"<<"`) {
+		t.Errorf("got err %v for a merge key", err)
+	}
+}
+
+// TestLoadReportsEveryError checks that Load reports every invalid setting
+// with its line instead of stopping at the first.
+func TestLoadReportsEveryError(t *testing.T) {
+	_, err := loadConfig(t, `tags:
+  bad-key: x
+rules:
+  - if: "true"
+    then: sample 1.5
+  - then: exclude
+    match: {pathRegex: "("}
+payloads:
+  allow: ["["]
+bypass: ["10.0.0.0/33"]
+sampling:
+  rate: 2
+unknown: true
+externalSockets:
+  tos: [1]
+`)
+	if err == nil {
+		t.Fatalf("got no error")
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("got a single error %v", err)
+	}
+	var got []string
+	for _, err := range joined.Unwrap() {
+		got = append(got, err.Error())
+	}
+	for _, want := range []string{
+		`line 13: unknown field "unknown"`,
+		`line 15: cannot unmarshal !!seq into int`,
+		`line 2: invalid key "bad-key"`,
+		`rule 0: line 4: invalid sample rate`,
+		`rule 1: line 7: match: invalid pathRegex`,
+		`line 9: invalid allow pattern "["`,
+		`validate bypass: line 10:`,
+		`line 12: rate 2 out of range [0, 1]`,
+	} {
+		if !strings.Contains(strings.Join(got, "\n"), want) {
+			t.Errorf("missing %q in:\n%s", want, strings.Join(got, "\n"))
+		}
+	}
+}
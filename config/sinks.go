@@ -0,0 +1,217 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/filter"
+)
+
+// Sink is a named destination for the events matched by its routes, so that
+// one tracer can send each tenant's traffic to that tenant's project. Events
+// that match no sink's routes go to the default sink: the token, endpoint and
+// -event-log of the run itself. An event that matches several sinks goes to
+// each of them.
+type Sink struct {
+	Name string `yaml:"name"`
+
+	// Token or TokenFile authenticates the sink's publisher and Endpoint
+	// overrides SUBTRACE_ENDPOINT for it. Without either token, events are only
+	// written to the sink's event log.
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"tokenFile"`
+	Endpoint  string `yaml:"endpoint"`
+
+	// EventLog is the sink's JSON lines file. If it's empty and -event-log is
+	// set, the sink's name is added to that path instead (see EventLogPath).
+	EventLog string `yaml:"eventLog"`
+
+	Routes []*SinkRoute `yaml:"routes"`
+
+	// Payloads overrides the global payload policy for this sink. It can only
+	// take more away: bodies exchanged with denied hosts are redacted in the
+	// events this sink receives, on top of anything the global policy redacts.
+	Payloads struct {
+		Deny []string `yaml:"deny"`
+	} `yaml:"payloads"`
+
+	deny *hostSet
+}
+
+// SinkRoute selects events for a sink. Every field that is set must match.
+type SinkRoute struct {
+	// Header is "Name: pattern" and matches requests with a header of that name
+	// whose value matches the pattern (filepath.Match syntax).
+	Header string `yaml:"header"`
+
+	// ServerName matches the TLS server name of the connection, or the host of
+	// the request if the connection isn't TLS.
+	ServerName string `yaml:"serverName"`
+
+	// If is a filter expression like the ones in rules.
+	If string `yaml:"if"`
+
+	headerName string
+	headerGlob glob
+	serverName glob
+	filter     *filter.Filter
+}
+
+// defaultSinkName is reserved for the sink of events that match no route.
+const defaultSinkName = "default"
+
+func (c *Config) compileSinks() error {
+	seen := make(map[string]bool)
+	for i, s := range c.parsed.Sinks {
+		switch {
+		case s.Name == "":
+			return fmt.Errorf("sink %d: line %d: missing name", i, c.line("sinks", i))
+		case s.Name == defaultSinkName:
+			return fmt.Errorf("sink %d: line %d: name %q is reserved for unmatched events", i, c.line("sinks", i), s.Name)
+		case strings.ContainsAny(s.Name, `/\`):
+			return fmt.Errorf("sink %q: line %d: name must not contain path separators", s.Name, c.line("sinks", i))
+		case seen[s.Name]:
+			return fmt.Errorf("sink %q: line %d: duplicate name", s.Name, c.line("sinks", i))
+		case s.Token != "" && s.TokenFile != "":
+			return fmt.Errorf("sink %q: line %d: token and tokenFile are mutually exclusive", s.Name, c.line("sinks", i))
+		case len(s.Routes) == 0:
+			return fmt.Errorf("sink %q: line %d: no routes", s.Name, c.line("sinks", i))
+		}
+		seen[s.Name] = true
+
+		for j, r := range s.Routes {
+			if err := r.compile(); err != nil {
+				return fmt.Errorf("sink %q: route %d: line %d: %w", s.Name, j, c.line("sinks", i, "routes", j), err)
+			}
+		}
+		for j, pattern := range s.Payloads.Deny {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("sink %q: line %d: invalid deny pattern %q: %w", s.Name, c.line("sinks", i, "payloads", "deny", j), pattern, err)
+			}
+		}
+		s.deny = newHostSet(s.Payloads.Deny)
+	}
+	return nil
+}
+
+func (r *SinkRoute) compile() error {
+	if r.Header == "" && r.ServerName == "" && r.If == "" {
+		return fmt.Errorf("empty route: set header, serverName or if")
+	}
+	if r.Header != "" {
+		name, pattern, ok := strings.Cut(r.Header, ":")
+		name, pattern = strings.TrimSpace(name), strings.TrimSpace(pattern)
+		if !ok || !isValidHeaderName(name) {
+			return fmt.Errorf("invalid header %q: want \"Name: pattern\"", r.Header)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid header pattern %q: %w", pattern, err)
+		}
+		r.headerName, r.headerGlob = name, compileGlob(pattern)
+	}
+	if r.ServerName != "" {
+		if _, err := filepath.Match(r.ServerName, ""); err != nil {
+			return fmt.Errorf("invalid serverName pattern %q: %w", r.ServerName, err)
+		}
+		r.serverName = compileGlob(strings.ToLower(r.ServerName))
+	}
+	if r.If != "" {
+		f, err := filter.NewFilter(r.If, filter.ActionInclude)
+		if err != nil {
+			return fmt.Errorf("new filter: %w", err)
+		}
+		r.filter = f
+	}
+	return nil
+}
+
+func (r *SinkRoute) match(tags map[string]string, entry *har.Entry) bool {
+	if r.headerName != "" {
+		found := false
+		if entry.Request != nil {
+			for _, hdr := range entry.Request.Headers {
+				if strings.EqualFold(hdr.Name, r.headerName) && r.headerGlob.match(hdr.Value) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.ServerName != "" {
+		name := tags["tls_server_name"]
+		if name == "" {
+			name = requestHost(entry)
+		}
+		if name == "" || !r.serverName.match(normalizeHost(name)) {
+			return false
+		}
+	}
+	if r.filter != nil {
+		ok, err := r.filter.Eval(tags, entry)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// requestHost returns the host an HTTP request was sent to.
+func requestHost(entry *har.Entry) string {
+	if entry.Request == nil {
+		return ""
+	}
+	for _, hdr := range entry.Request.Headers {
+		if strings.EqualFold(hdr.Name, "host") || hdr.Name == ":authority" {
+			return hdr.Value
+		}
+	}
+	if _, rest, ok := strings.Cut(entry.Request.URL, "://"); ok {
+		host, _, _ := strings.Cut(rest, "/")
+		return host
+	}
+	return ""
+}
+
+// Matches reports whether an event is routed to the sink.
+func (s *Sink) Matches(tags map[string]string, entry *har.Entry) bool {
+	for _, r := range s.Routes {
+		if r.match(tags, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeniesPayload reports whether the sink's own payload policy redacts the
+// bodies exchanged with host.
+func (s *Sink) DeniesPayload(host string) bool {
+	if s.deny == nil {
+		return false
+	}
+	_, ok := s.deny.first(normalizeHost(host))
+	return ok
+}
+
+// EventLogPath returns the sink's event log path given the -event-log path
+// of the run, or "" if the sink has no event log. The sink's name goes before
+// the extension: "events.jsonl" becomes "events.tenant-a.jsonl".
+func (s *Sink) EventLogPath(eventLog string) string {
+	if s.EventLog != "" || eventLog == "" {
+		return s.EventLog
+	}
+	ext := filepath.Ext(eventLog)
+	return strings.TrimSuffix(eventLog, ext) + "." + s.Name + ext
+}
+
+// GetSinks returns the configured sinks in the order they appear.
+func (c *Config) GetSinks() []*Sink {
+	return c.parsed.Sinks
+}
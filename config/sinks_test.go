@@ -0,0 +1,111 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3/har"
+)
+
+func TestSinks(t *testing.T) {
+	c, err := loadConfig(t, `
+sinks:
+  - name: tenant-a
+    token: token-a
+    routes:
+      - header: "X-Tenant: a"
+      - serverName: "*.a.example.com"
+    payloads:
+      deny: ["*.internal"]
+  - name: tenant-b
+    eventLog: /tmp/b.jsonl
+    routes:
+      - header: "X-Tenant: b*"
+        if: 'request.method == "POST"'
+`)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	sinks := c.GetSinks()
+	if len(sinks) != 2 {
+		t.Fatalf("got %d sinks, want 2", len(sinks))
+	}
+	a, b := sinks[0], sinks[1]
+
+	entry := func(method string, headers ...string) *har.Entry {
+		req := &har.Request{Method: method, URL: "/"}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Headers = append(req.Headers, har.Header{Name: headers[i], Value: headers[i+1]})
+		}
+		return &har.Entry{Request: req, Response: &har.Response{Status: 200}}
+	}
+	for _, tt := range []struct {
+		name  string
+		tags  map[string]string
+		entry *har.Entry
+		wantA bool
+		wantB bool
+	}{
+		{name: "header a", entry: entry("GET", "x-tenant", "a"), wantA: true},
+		{name: "header b post", entry: entry("POST", "X-Tenant", "b-2"), wantB: true},
+		{name: "header b get", entry: entry("GET", "X-Tenant", "b-2")},
+		{name: "sni", tags: map[string]string{"tls_server_name": "api.a.example.com"}, entry: entry("GET"), wantA: true},
+		{name: "host", entry: entry("GET", "Host", "API.a.example.com:443"), wantA: true},
+		{name: "unmatched", entry: entry("GET", "X-Tenant", "c", "Host", "example.com")},
+	} {
+		if tt.tags == nil {
+			tt.tags = map[string]string{}
+		}
+		if got := a.Matches(tt.tags, tt.entry); got != tt.wantA {
+			t.Errorf("%s: tenant-a matches = %v, want %v", tt.name, got, tt.wantA)
+		}
+		if got := b.Matches(tt.tags, tt.entry); got != tt.wantB {
+			t.Errorf("%s: tenant-b matches = %v, want %v", tt.name, got, tt.wantB)
+		}
+	}
+
+	if !a.DeniesPayload("db.internal:5432") || a.DeniesPayload("api.a.example.com") || b.DeniesPayload("db.internal") {
+		t.Errorf("per-sink payload deny patterns applied incorrectly")
+	}
+
+	if got, want := a.EventLogPath("/var/log/events.jsonl"), "/var/log/events.tenant-a.jsonl"; got != want {
+		t.Errorf("derived event log path = %q, want %q", got, want)
+	}
+	if got := a.EventLogPath(""); got != "" {
+		t.Errorf("event log path without -event-log = %q, want none", got)
+	}
+	if got := b.EventLogPath("/var/log/events.jsonl"); got != "/tmp/b.jsonl" {
+		t.Errorf("explicit event log path = %q, want /tmp/b.jsonl", got)
+	}
+
+	dump, err := c.Dump()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if strings.Contains(string(dump), "token-a") {
+		t.Errorf("dump contains a sink token:\n%s", dump)
+	}
+}
+
+func TestSinksInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		yaml    string
+		wantErr string
+	}{
+		{yaml: "sinks:\n  - token: x\n    routes: [{header: 'X-Tenant: a'}]\n", wantErr: "missing name"},
+		{yaml: "sinks:\n  - name: default\n    routes: [{header: 'X-Tenant: a'}]\n", wantErr: "reserved"},
+		{yaml: "sinks:\n  - name: a\n    routes: [{header: 'X-Tenant: a'}]\n  - name: a\n    routes: [{header: 'X-Tenant: b'}]\n", wantErr: "duplicate name"},
+		{yaml: "sinks:\n  - name: a\n", wantErr: "no routes"},
+		{yaml: "sinks:\n  - name: a\n    routes: [{}]\n", wantErr: "empty route"},
+		{yaml: "sinks:\n  - name: a\n    routes: [{header: 'X-Tenant'}]\n", wantErr: "invalid header"},
+		{yaml: "sinks:\n  - name: a\n    routes: [{if: 'tags.x'}]\n", wantErr: "new filter"},
+		{yaml: "sinks:\n  - name: a\n    token: x\n    tokenFile: y\n    routes: [{header: 'X-Tenant: a'}]\n", wantErr: "mutually exclusive"},
+	} {
+		if _, err := loadConfig(t, tt.yaml); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Load(%q): got err %v, want %q", tt.yaml, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Verdicts configures the verdict webhook. Outgoing HTTP/1 requests that match
+// one of the candidates are described to a policy endpoint before they're
+// forwarded, and its verdict decides whether they're allowed, blocked or
+// annotated. It's meant to be a local service: every candidate request waits
+// for it, up to Timeout, unless a verdict for the same kind of request is
+// cached.
+//
+// HTTP/2 requests, whether h2 negotiated over TLS or h2c, aren't checked and
+// are always forwarded, whatever OnError says.
+type Verdicts struct {
+	URL string `yaml:"url"`
+
+	// Timeout bounds how long a request waits for a verdict. The OnError
+	// verdict applies to requests that don't get one in time.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// OnError is the verdict when the endpoint fails or times out: "allow"
+	// (fail open, the default) or "block" (fail closed for HTTP/1).
+	OnError string `yaml:"onError"`
+
+	// CacheTTL is how long a verdict is reused for requests from the same
+	// process to the same destination with the same method and path template.
+	// Zero asks the endpoint every time.
+	CacheTTL *time.Duration `yaml:"cacheTTL"`
+
+	// IncludeHeaders sends the request headers, with the ones listed in the
+	// redact section sanitized. Bodies are never sent.
+	IncludeHeaders bool `yaml:"includeHeaders"`
+
+	Candidates []VerdictCandidate `yaml:"candidates"`
+}
+
+// VerdictCandidate selects the requests that need a verdict by host and path
+// patterns (filepath.Match syntax, empty matches everything) and methods
+// (empty matches every method).
+type VerdictCandidate struct {
+	Host    string   `yaml:"host"`
+	Path    string   `yaml:"path"`
+	Methods []string `yaml:"methods"`
+}
+
+// Verdict defaults.
+const (
+	DefaultVerdictTimeout  = 50 * time.Millisecond
+	DefaultVerdictCacheTTL = 30 * time.Second
+)
+
+// TTL returns how long verdicts are cached.
+func (v *Verdicts) TTL() time.Duration {
+	if v.CacheTTL == nil {
+		return DefaultVerdictCacheTTL
+	}
+	return *v.CacheTTL
+}
+
+func (v *Verdicts) validate() error {
+	u, err := url.Parse(v.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %w", v.URL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q: must be an http or https URL", v.URL)
+	}
+	if v.Timeout < 0 {
+		return fmt.Errorf("negative timeout %s", v.Timeout)
+	}
+	if v.Timeout == 0 {
+		v.Timeout = DefaultVerdictTimeout
+	}
+	switch v.OnError {
+	case "":
+		v.OnError = "allow"
+	case "allow", "block":
+	default:
+		return fmt.Errorf("invalid onError %q: must be allow or block", v.OnError)
+	}
+	if v.CacheTTL != nil && *v.CacheTTL < 0 {
+		return fmt.Errorf("negative cacheTTL %s", *v.CacheTTL)
+	}
+	if len(v.Candidates) == 0 {
+		return fmt.Errorf("no candidates: at least one is needed to select the requests that need a verdict")
+	}
+	for i, c := range v.Candidates {
+		for _, pattern := range []string{c.Host, c.Path} {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("candidate %d: invalid pattern %q: %w", i, pattern, err)
+			}
+		}
+		for j, m := range c.Methods {
+			v.Candidates[i].Methods[j] = strings.ToUpper(m)
+		}
+	}
+	return nil
+}
+
+// GetVerdicts returns the verdict webhook's config, or nil if there's none.
+func (c *Config) GetVerdicts() *Verdicts {
+	return c.parsed.Verdicts
+}
+
+// IsVerdictCandidate reports whether a request with the given method, host and
+// path needs a verdict.
+func (c *Config) IsVerdictCandidate(method, host, path string) bool {
+	v := c.parsed.Verdicts
+	if v == nil {
+		return false
+	}
+	m := c.getMatchers()
+	host = normalizeHost(host)
+	for i, cand := range v.Candidates {
+		if len(cand.Methods) > 0 && !slices.Contains(cand.Methods, method) {
+			continue
+		}
+		if r := m.verdicts[i]; (r.host == nil || r.host.match(host)) && (r.path == nil || r.path.match(path)) {
+			return true
+		}
+	}
+	return false
+}
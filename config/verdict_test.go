@@ -0,0 +1,83 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerdicts(t *testing.T) {
+	c, err := loadConfig(t, `
+verdicts:
+  url: http://127.0.0.1:9000/verdict
+  cacheTTL: 0s
+  candidates:
+    - host: "*.stripe.com"
+      path: /v1/charges*
+      methods: [post]
+    - host: internal.example.com
+`)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	v := c.GetVerdicts()
+	if v == nil {
+		t.Fatalf("got no verdicts config")
+	}
+	if v.Timeout != DefaultVerdictTimeout || v.OnError != "allow" || v.TTL() != 0 {
+		t.Errorf("got timeout=%s onError=%q ttl=%s, want the defaults with caching off", v.Timeout, v.OnError, v.TTL())
+	}
+
+	for _, tt := range []struct {
+		method, host, path string
+		want               bool
+	}{
+		{"POST", "api.stripe.com", "/v1/charges", true},
+		{"POST", "api.stripe.com:443", "/v1/charges", true},
+		{"POST", "api.stripe.com", "/v1/charges/ch_1", false}, // * doesn't cross a slash
+		{"GET", "api.stripe.com", "/v1/charges", false},
+		{"POST", "api.stripe.com", "/v1/customers", false},
+		{"DELETE", "internal.example.com", "/anything", true},
+		{"GET", "example.com", "/", false},
+	} {
+		if got := c.IsVerdictCandidate(tt.method, tt.host, tt.path); got != tt.want {
+			t.Errorf("IsVerdictCandidate(%s, %s, %s) = %v, want %v", tt.method, tt.host, tt.path, got, tt.want)
+		}
+	}
+
+	c, err = loadConfig(t, "tags: {}\n")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if c.GetVerdicts() != nil || c.IsVerdictCandidate("GET", "example.com", "/") {
+		t.Errorf("got verdicts without a verdicts section")
+	}
+}
+
+func TestVerdictsInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		yaml, want string
+	}{
+		{"verdicts:\n  url: unix:///tmp/sock\n  candidates: [{host: a}]\n", "must be an http or https URL"},
+		{"verdicts:\n  url: http://localhost/\n", "no candidates"},
+		{"verdicts:\n  url: http://localhost/\n  onError: deny\n  candidates: [{host: a}]\n", "invalid onError"},
+		{"verdicts:\n  url: http://localhost/\n  timeout: -1s\n  candidates: [{host: a}]\n", "negative timeout"},
+		{"verdicts:\n  url: http://localhost/\n  candidates: [{path: \"/[\"}]\n", "invalid pattern"},
+	} {
+		_, err := loadConfig(t, tt.yaml)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("load %q: got err=%v, want %q", tt.yaml, err, tt.want)
+		}
+	}
+
+	c, err := loadConfig(t, "verdicts:\n  url: https://localhost/\n  timeout: 20ms\n  onError: block\n  candidates: [{}]\n")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if v := c.GetVerdicts(); v.Timeout != 20*time.Millisecond || v.OnError != "block" || v.TTL() != DefaultVerdictCacheTTL {
+		t.Errorf("got %+v", v)
+	}
+}
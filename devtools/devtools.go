@@ -14,6 +14,7 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -87,20 +88,32 @@ func bundleOnce() {
 type Server struct {
 	HijackPath string
 
-	mu    sync.Mutex
-	conns []*websocket.Conn
+	mu     sync.Mutex
+	conns  []*websocket.Conn
+	closed chan struct{}
+	once   sync.Once
+	open   sync.WaitGroup // websocket handlers still running
 }
 
 var _ http.Handler = new(Server)
 
 func NewServer(hijackPath string) *Server {
-	return &Server{HijackPath: hijackPath}
+	return &Server{HijackPath: hijackPath, closed: make(chan struct{})}
 }
 
-func (s *Server) add(conn *websocket.Conn) {
+// add registers conn to get events. It returns false once the server is
+// closed.
+func (s *Server) add(conn *websocket.Conn) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		return false
+	default:
+	}
 	s.conns = append(s.conns, conn)
+	s.open.Add(1)
+	return true
 }
 
 func (s *Server) remove(conn *websocket.Conn) {
@@ -132,8 +145,26 @@ func (s *Server) Send(b []byte) {
 	wg.Wait()
 }
 
+// Close closes every devtools connection with a going away status, waiting a
+// few seconds at most for the browsers to acknowledge, and turns away new
+// ones. It's called once every event has been sent.
+func (s *Server) Close() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		close(s.closed)
+		s.mu.Unlock()
+		s.open.Wait()
+	})
+}
+
 func (s *Server) websocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		InsecureSkipVerify: true,
+
+		// Events are HAR entries with mostly the same keys and headers, so keeping
+		// the sliding window across messages compresses them well.
+		CompressionMode: websocket.CompressionContextTakeover,
+	})
 	if err != nil {
 		w.Header().Set("content-type", "text/plain")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -142,7 +173,11 @@ func (s *Server) websocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close(websocket.StatusNormalClosure, "")
 
-	s.add(conn)
+	if !s.add(conn) {
+		conn.Close(websocket.StatusGoingAway, "subtrace is exiting")
+		return
+	}
+	defer s.open.Done()
 	defer s.remove(conn)
 
 	go func() {
@@ -155,12 +190,17 @@ func (s *Server) websocket(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	ticker := time.NewTicker(time.Second)
+	// Pings only keep the connection from looking idle to intermediaries, so
+	// there's no need to wake up often.
+	ticker := time.NewTicker(15 * time.Second)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-r.Context().Done():
 			return
+		case <-s.closed:
+			conn.Close(websocket.StatusGoingAway, "subtrace is exiting")
+			return
 		case <-ticker.C:
 			if err := conn.Ping(r.Context()); err != nil {
 				return
@@ -175,23 +215,16 @@ func (s *Server) html(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("cross-origin-opener-policy", "same-origin")
 	w.Header().Set("cross-origin-embedder-policy", "require-corp")
 
-	accept := make(map[string]bool)
-	for _, val := range strings.Split(r.Header.Get("accept-encoding"), ",") {
-		val = strings.TrimSpace(val)
-		if val == "" {
-			continue
-		}
-		accept[val] = true
-	}
+	w.Header().Set("vary", "accept-encoding")
 
 	var body io.Writer = w
-	switch {
-	case accept["br"]:
+	switch negotiateEncoding(r.Header.Get("accept-encoding")) {
+	case "br":
 		w.Header().Set("content-encoding", "br")
 		bw := brotli.NewWriter(w)
 		defer bw.Close()
 		body = bw
-	case accept["gzip"]:
+	case "gzip":
 		w.Header().Set("content-encoding", "gzip")
 		gw := gzip.NewWriter(w)
 		defer gw.Close()
@@ -202,6 +235,56 @@ func (s *Server) html(w http.ResponseWriter, r *http.Request) {
 	body.Write(html)
 }
 
+// parseAcceptEncoding returns the qvalue of each content coding listed in an
+// accept-encoding header. Codings without a valid qvalue get 1.
+func parseAcceptEncoding(header string) map[string]float64 {
+	accept := make(map[string]float64)
+	for _, val := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(val, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(k)) != "q" {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && f >= 0 && f <= 1 {
+				q = f
+			}
+		}
+		accept[name] = q
+	}
+	return accept
+}
+
+// negotiateEncoding returns the coding to compress the page with, "br" or
+// "gzip", or "" to send it as is. Codings that aren't listed get the qvalue of
+// "*", if any. The one with the highest qvalue wins, preferring br on a tie,
+// unless identity is listed with a higher qvalue than both. A zero qvalue
+// refuses a coding. If the client refuses everything, the page is sent as is
+// anyway.
+func negotiateEncoding(header string) string {
+	accept := parseAcceptEncoding(header)
+	qvalue := func(name string) float64 {
+		if q, ok := accept[name]; ok {
+			return q
+		}
+		return accept["*"]
+	}
+
+	ret, best := "", accept["identity"]
+	for _, name := range []string{"br", "gzip"} {
+		if q := qvalue(name); q > 0 && q >= best && (ret == "" || q > best) {
+			ret, best = name, q
+		}
+	}
+	return ret
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("upgrade") == "websocket" {
 		s.websocket(w, r)
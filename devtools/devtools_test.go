@@ -0,0 +1,225 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package devtools
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestParseAcceptEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   map[string]float64
+	}{
+		{"", map[string]float64{}},
+		{"gzip, br", map[string]float64{"gzip": 1, "br": 1}},
+		{"GZip ; Q=0.5,br;q=0.8", map[string]float64{"gzip": 0.5, "br": 0.8}},
+		{"gzip;q=0, identity", map[string]float64{"gzip": 0, "identity": 1}},
+		{"*;q=0.1, deflate", map[string]float64{"*": 0.1, "deflate": 1}},
+		{"br;level=5;q=0.3", map[string]float64{"br": 0.3}},
+		{"br;q=2, gzip;q=-1, zstd;q=x", map[string]float64{"br": 1, "gzip": 1, "zstd": 1}},
+		{" , ;q=1,", map[string]float64{}},
+	} {
+		if got := parseAcceptEncoding(tt.header); !maps.Equal(got, tt.want) {
+			t.Errorf("parseAcceptEncoding(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip, deflate, br, zstd", "br"},
+		{"gzip", "gzip"},
+		{"gzip;q=1, br;q=0.5", "gzip"},
+		{"gzip;q=0.5, br;q=0.5", "br"},
+		{"br;q=0, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.5, br;q=0", "gzip"},
+		{"*;q=0", ""},
+		{"*;q=0, gzip;q=0.1", "gzip"},
+		{"identity;q=1, gzip;q=0.5", ""},
+		{"identity;q=0.5, gzip", "gzip"},
+		{"identity;q=0, gzip;q=0.2", "gzip"},
+		{"identity;q=0", ""},
+	} {
+		if got := negotiateEncoding(tt.header); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+// TestClose checks that closing the server tells open tabs it's going away
+// and turns away new ones.
+func TestClose(t *testing.T) {
+	s := NewServer("")
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.CloseNow()
+	for deadline := time.Now().Add(5 * time.Second); len(s.snapshot()) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the server never registered the websocket")
+		}
+	}
+
+	// The tab has to keep reading to see the close and acknowledge it.
+	closed := make(chan error, 1)
+	go func() {
+		_, _, err := conn.Read(ctx)
+		closed <- err
+	}()
+	s.Close()
+	if err := <-closed; websocket.CloseStatus(err) != websocket.StatusGoingAway {
+		t.Errorf("got %v from an open tab, want status %v", err, websocket.StatusGoingAway)
+	}
+	s.Send([]byte("{}")) // dropped
+
+	late, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatalf("dial after close: %v", err)
+	}
+	defer late.CloseNow()
+	if _, _, err := late.Read(ctx); websocket.CloseStatus(err) != websocket.StatusGoingAway {
+		t.Errorf("got %v from a tab opened after close, want status %v", err, websocket.StatusGoingAway)
+	}
+}
+
+// sessionEvents is the number of events BenchmarkSession streams, like a
+// session left open for a while against a busy service.
+const sessionEvents = 5000
+
+// sessionEvent returns a HAR entry the size and shape of what the parser
+// publishes for a JSON API call.
+func sessionEvent(i int) []byte {
+	var items []string
+	for j := range 20 {
+		items = append(items, fmt.Sprintf(`{"id":%d,"name":"item %d","price":%d.99,"tags":["a","b"]}`, i*20+j, j, j))
+	}
+	body := strings.ReplaceAll("["+strings.Join(items, ",")+"]", `"`, `\"`)
+	return fmt.Appendf(nil, `{"_id":"%08x-0000-4000-8000-%012x","startedDateTime":"2026-01-01T00:00:%02d.%03dZ","time":%d,`+
+		`"request":{"method":"GET","url":"http://api.internal:8080/v1/items?page=%d","httpVersion":"HTTP/1.1",`+
+		`"headers":[{"name":"Host","value":"api.internal:8080"},{"name":"User-Agent","value":"Go-http-client/1.1"},{"name":"Accept","value":"application/json"}],`+
+		`"queryString":[{"name":"page","value":"%d"}],"headersSize":-1,"bodySize":0},`+
+		`"response":{"status":200,"statusText":"OK","httpVersion":"HTTP/1.1",`+
+		`"headers":[{"name":"Content-Type","value":"application/json"},{"name":"Date","value":"Thu, 01 Jan 2026 00:00:00 GMT"}],`+
+		`"content":{"size":%d,"mimeType":"application/json","text":"%s"},"headersSize":-1,"bodySize":%d},`+
+		`"timings":{"send":0,"wait":%d,"receive":1}}`, i, i, i%60, i%1000, i%50, i, i, len(body), body, len(body), i%50)
+}
+
+// BenchmarkSession measures how many bytes a devtools tab receives and how
+// long it takes to load a session of sessionEvents events with and without
+// permessage-deflate.
+func BenchmarkSession(b *testing.B) {
+	events := make([][]byte, sessionEvents)
+	var raw int
+	for i := range events {
+		events[i] = sessionEvent(i)
+		raw += len(events[i])
+	}
+
+	for _, bm := range []struct {
+		name string
+		mode websocket.CompressionMode
+	}{
+		{"uncompressed", websocket.CompressionDisabled},
+		{"deflate", websocket.CompressionContextTakeover},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var wire atomic.Int64
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+					if err != nil {
+						return nil, err
+					}
+					return &countingConn{Conn: conn, n: &wire}, nil
+				},
+			}}
+
+			for range b.N {
+				// Every session gets a server of its own so that the tabs of
+				// the previous ones don't get the events too.
+				b.StopTimer()
+				s := NewServer("")
+				srv := httptest.NewServer(s)
+				b.StartTimer()
+
+				conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), &websocket.DialOptions{
+					HTTPClient:      client,
+					CompressionMode: bm.mode,
+				})
+				if err != nil {
+					b.Fatalf("dial: %v", err)
+				}
+				conn.SetReadLimit(-1)
+				for deadline := time.Now().Add(5 * time.Second); len(s.snapshot()) == 0; time.Sleep(time.Millisecond) {
+					if time.Now().After(deadline) {
+						b.Fatalf("the server never registered the websocket")
+					}
+				}
+
+				done := make(chan error, 1)
+				go func() {
+					for range events {
+						if _, _, err := conn.Read(context.Background()); err != nil {
+							done <- err
+							return
+						}
+					}
+					done <- nil
+				}()
+				for _, ev := range events {
+					s.Send(ev)
+				}
+				if err := <-done; err != nil {
+					b.Fatalf("read: %v", err)
+				}
+
+				b.StopTimer()
+				conn.CloseNow()
+				srv.Close()
+				b.StartTimer()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(wire.Load())/float64(b.N), "wire-bytes/session")
+			b.ReportMetric(float64(raw), "event-bytes/session")
+		})
+	}
+}
+
+// countingConn counts the bytes read from the connection.
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -65,6 +65,10 @@ class Client {
 class Manager {
   #client = null;
 
+  // Requests of websocket handshakes by event ID, so that the messages that
+  // come after each handshake in events of their own go into its frames tab.
+  #websockets = new Map();
+
   constructor() {
     this.spawn();
   }
@@ -76,6 +80,57 @@ class Manager {
     const msg = JSON.parse(json);
     console.log(`subtrace: received message id=${msg._id}`);
 
+    // Exchanges that subtrace modified get a pseudo-header listing what did
+    // it so that they stand out from passively captured ones.
+    const interventions = Array.isArray(msg._interventions) ? msg._interventions : [];
+    if (interventions.length > 0 && msg.request) {
+      const summary = interventions.map((iv) => (iv.rule ? `${iv.feature} (${iv.rule})` : iv.feature)).join(", ");
+      msg.request.headers = [{ name: "x-subtrace-modified-by", value: summary }, ...(msg.request.headers || [])];
+    }
+
+    // The capture level goes into a pseudo-header too so that exchanges whose
+    // payload is missing can be found with the header filters of the network
+    // panel and say why.
+    if (msg._captureLevel && msg.request) {
+      const value = msg._captureReason ? `${msg._captureLevel}; reason=${msg._captureReason}` : msg._captureLevel;
+      msg.request.headers = [{ name: "x-subtrace-capture", value }, ...(msg.request.headers || [])];
+    }
+
+    // gRPC calls all look like a POST with status 200, so the status text
+    // and a pseudo-header say what the call was and how it ended.
+    if (msg._grpc && msg.request) {
+      const status = msg._grpc.status || "-";
+      const value = `${status} ${msg._grpc.method}; messages=${msg._grpc.requestMessages}/${msg._grpc.responseMessages}`;
+      msg.request.headers = [{ name: "x-subtrace-grpc", value }, ...(msg.request.headers || [])];
+      if (msg.response) {
+        msg.response.statusText = `grpc ${status}`;
+      }
+    }
+
+    // Messages of a websocket whose handshake is already in the network log
+    // are added to it instead of showing up as requests of their own.
+    const handshake = msg._webSocketHandshake ? this.#websockets.get(msg._webSocketHandshake) : undefined;
+    if (handshake && typeof handshake.addProtocolFrame === "function") {
+      for (const m of msg._webSocketMessages || []) {
+        handshake.addProtocolFrame({ type: m.type, time: m.time, text: m.data, opCode: m.opcode, mask: false });
+      }
+      return;
+    }
+
+    const isHandshake = msg.response?.status === 101 && !msg._webSocketHandshake;
+    if (isHandshake) {
+      msg._resourceType = "websocket";
+    }
+
+    // Bodies that weren't kept in full are replaced with their JSON preview so
+    // that the preview tab renders its structure as a tree.
+    if (msg._requestBodyPreview !== undefined && msg.request && (msg._captureLevel !== "full" || !msg.request.postData?.text)) {
+      msg.request.postData = { mimeType: "application/json", text: JSON.stringify(msg._requestBodyPreview) };
+    }
+    if (msg._responseBodyPreview !== undefined && msg.response && (msg._captureLevel !== "full" || !msg.response.content?.text)) {
+      msg.response.content = { ...msg.response.content, mimeType: "application/json", text: JSON.stringify(msg._responseBodyPreview), encoding: undefined };
+    }
+
     const entry = new window.subtrace.HAREntry(msg);
     console.log("entry", entry);
 
@@ -83,9 +138,19 @@ class Manager {
     console.log("request pre-fill", request);
 
     window.subtrace.Importer.fillRequestFromHAREntry(request, entry, null);
+    if (interventions.length > 0 && typeof request.setWasIntercepted === "function") {
+      request.setWasIntercepted(true);
+    }
     console.log("request post-fill", request);
 
     window.subtrace.NetworkLog.instance().addRequest(request);
+
+    if (isHandshake) {
+      this.#websockets.set(msg._id, request);
+      if (this.#websockets.size > 1000) {
+        this.#websockets.delete(this.#websockets.keys().next().value);
+      }
+    }
   }
 
   onClose(ev) {
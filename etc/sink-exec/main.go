@@ -0,0 +1,84 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Command sink-exec is an example of a sink for subtrace run -sink-exec. It
+// prints a line for every event:
+//
+//	subtrace run -sink-exec 'go run ./etc/sink-exec' -- curl -s example.com
+//
+// Every frame on stdin is a 4-byte big-endian length followed by that many
+// bytes. The first frame is the handshake, {"schemaVersion":1,...}, and every
+// other frame is an event: {"tags":{...},"entry":{...}}, the same JSON as a
+// line of -event-log. Exiting with status 78 refuses the tracer, which isn't
+// retried; exiting with any other status restarts the sink. stdin is closed
+// at shutdown once every event was written.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const schemaVersion = 1
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(n[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+func main() {
+	r := bufio.NewReader(os.Stdin)
+
+	b, err := readFrame(r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sink-exec: read handshake: %v\n", err)
+		os.Exit(1)
+	}
+	var hello struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(b, &hello); err != nil || hello.SchemaVersion != schemaVersion {
+		fmt.Fprintf(os.Stderr, "sink-exec: unsupported handshake %s\n", b)
+		os.Exit(78)
+	}
+
+	for {
+		b, err := readFrame(r)
+		if errors.Is(err, io.EOF) {
+			return // the tracer is done
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sink-exec: read event: %v\n", err)
+			os.Exit(1)
+		}
+		var ev struct {
+			Tags  map[string]string `json:"tags"`
+			Entry struct {
+				Request struct {
+					Method string `json:"method"`
+					URL    string `json:"url"`
+				} `json:"request"`
+				Response struct {
+					Status int `json:"status"`
+				} `json:"response"`
+			} `json:"entry"`
+		}
+		if err := json.Unmarshal(b, &ev); err != nil {
+			fmt.Fprintf(os.Stderr, "sink-exec: decode event: %v\n", err)
+			continue
+		}
+		fmt.Printf("%s %d %s %s\n", ev.Tags["event_id"], ev.Entry.Response.Status, ev.Entry.Request.Method, ev.Entry.Request.URL)
+	}
+}
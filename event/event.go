@@ -4,26 +4,92 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unique"
 
 	"github.com/google/uuid"
 )
 
+// Events are created for every connection and exchange, almost always by
+// copying a template and setting a few tags on top. Tags are therefore stored
+// copy-on-write: Copy and CopyFrom share the source's tags until either side
+// modifies them. "time" and "event_id" are unique to every event and are kept
+// out of the shared tags so that a fresh copy doesn't have to clone anything.
+
+type fields struct {
+	keys   []string
+	vals   map[string]string
+	frozen atomic.Bool // shared by more than one event; never modified again
+}
+
+func newFields(n int) *fields {
+	return &fields{keys: make([]string, 0, n), vals: make(map[string]string, n)}
+}
+
+// hasReserved reports whether f holds "time" or "event_id", which only happens
+// in events that weren't created by New.
+func (f *fields) hasReserved() bool {
+	_, t := f.vals["time"]
+	_, id := f.vals["event_id"]
+	return t || id
+}
+
+// fieldsSlack is the room left for new tags when tags are cloned so that the
+// few tags usually set on a copy don't grow the storage again.
+const fieldsSlack = 8
+
 type Event struct {
-	mu   sync.RWMutex
-	keys []string
-	vals map[string]string
+	mu    sync.RWMutex
+	f     *fields
+	spare *fields // emptied storage from before Release, reused on the next clone
+
+	stamped  bool // time and id hold "time" and "event_id", as set by New
+	time, id string
+
+	view map[string]string // result of View, until the next modification
 	lazy sync.WaitGroup
 }
 
+var pool = sync.Pool{New: func() any { return new(Event) }}
+
 func New() *Event {
-	return &Event{
-		keys: []string{"time", "event_id"},
-		vals: map[string]string{
-			"time":     time.Now().UTC().Format(time.RFC3339Nano),
-			"event_id": uuid.NewString(),
-		},
+	ev := pool.Get().(*Event)
+	ev.stamped = true
+	ev.time = time.Now().UTC().Format(time.RFC3339Nano)
+	ev.id = uuid.NewString()
+	return ev
+}
+
+// Release returns ev to the pool that New allocates from. ev must not be used
+// afterwards, but maps returned by Map and View remain valid.
+func Release(ev *Event) {
+	if ev == nil {
+		return
 	}
+	ev.lazy.Wait()
+
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if f := ev.f; f != nil && !f.frozen.Load() && cap(f.keys) <= maxSpareFields {
+		clear(f.vals)
+		f.keys = f.keys[:0]
+		ev.spare = f
+	}
+	ev.f, ev.view = nil, nil
+	ev.stamped, ev.time, ev.id = false, "", ""
+	pool.Put(ev)
+}
+
+// maxSpareFields bounds the storage kept by a pooled event so that one event
+// with unusually many tags doesn't pin its storage forever.
+const maxSpareFields = 256
+
+// Intern returns a canonical copy of s. Values built for every event that
+// repeat across many of them, like hostnames and addresses, should be interned
+// so that only one copy of each is retained.
+func Intern(s string) string {
+	return unique.Make(s).Value()
 }
 
 func (src *Event) Copy() *Event {
@@ -45,14 +111,53 @@ func (dst *Event) CopyFrom(src *Event) {
 	dst.mu.Lock()
 	defer dst.mu.Unlock()
 
-	for _, key := range src.keys {
+	if src.f == nil || len(src.f.keys) == 0 {
+		return
+	}
+	if (dst.f == nil || len(dst.f.keys) == 0) && !src.f.hasReserved() {
+		if dst.f != nil && !dst.f.frozen.Load() && dst.spare == nil {
+			dst.spare = dst.f
+		}
+		src.f.frozen.Store(true)
+		dst.f, dst.view = src.f, nil
+		return
+	}
+
+	dst.writableLocked(len(src.f.keys))
+	for _, key := range src.f.keys {
 		switch key {
 		case "time":
 		case "event_id":
 		default:
-			dst.setLocked(key, src.vals[key])
+			dst.setLocked(key, src.f.vals[key])
+		}
+	}
+}
+
+// writableLocked makes ev's tags safe to modify, cloning them if they're
+// shared, with room for extra more tags.
+func (ev *Event) writableLocked(extra int) *fields {
+	ev.view = nil
+	switch {
+	case ev.f == nil:
+		ev.f = ev.takeSpareLocked(extra + fieldsSlack)
+	case ev.f.frozen.Load():
+		f := ev.takeSpareLocked(len(ev.f.keys) + extra + fieldsSlack)
+		f.keys = append(f.keys, ev.f.keys...)
+		for key, val := range ev.f.vals {
+			f.vals[key] = val
 		}
+		ev.f = f
 	}
+	return ev.f
+}
+
+func (ev *Event) takeSpareLocked(n int) *fields {
+	if f := ev.spare; f != nil {
+		ev.spare = nil
+		return f
+	}
+	return newFields(n)
 }
 
 func (ev *Event) Set(key string, val string) {
@@ -62,24 +167,45 @@ func (ev *Event) Set(key string, val string) {
 }
 
 func (ev *Event) setLocked(key string, val string) {
-	if ev.vals == nil {
-		ev.vals = make(map[string]string)
+	if ev.stamped {
+		switch key {
+		case "time":
+			ev.time, ev.view = val, nil
+			return
+		case "event_id":
+			ev.id, ev.view = val, nil
+			return
+		}
 	}
 
-	if _, ok := ev.vals[key]; ok {
-		ev.vals[key] = val
-		return
+	if ev.f != nil {
+		if cur, ok := ev.f.vals[key]; ok && cur == val {
+			return // don't clone shared tags for nothing
+		}
 	}
 
-	ev.keys = append(ev.keys, key)
-	ev.vals[key] = val
+	f := ev.writableLocked(1)
+	if _, ok := f.vals[key]; !ok {
+		f.keys = append(f.keys, key)
+	}
+	f.vals[key] = val
 }
 
 func (ev *Event) Get(key string) string {
 	ev.mu.RLock()
 	defer ev.mu.RUnlock()
-	val, _ := ev.vals[key]
-	return val
+	if ev.stamped {
+		switch key {
+		case "time":
+			return ev.time
+		case "event_id":
+			return ev.id
+		}
+	}
+	if ev.f == nil {
+		return ""
+	}
+	return ev.f.vals[key]
 }
 
 func (ev *Event) NewLazy(key string) chan<- string {
@@ -87,7 +213,7 @@ func (ev *Event) NewLazy(key string) chan<- string {
 	ev.lazy.Add(1)
 
 	ev.mu.Lock()
-	ev.keys = append(ev.keys, key)
+	ev.setLocked(key, "")
 	ev.mu.Unlock()
 
 	go func() {
@@ -101,24 +227,63 @@ func (ev *Event) WaitLazy() {
 	ev.lazy.Wait()
 }
 
+// rangeLocked calls fn for every tag in order.
+func (ev *Event) rangeLocked(fn func(key, val string)) {
+	if ev.stamped {
+		fn("time", ev.time)
+		fn("event_id", ev.id)
+	}
+	if ev.f != nil {
+		for _, key := range ev.f.keys {
+			fn(key, ev.f.vals[key])
+		}
+	}
+}
+
+func (ev *Event) len() int {
+	n := 0
+	if ev.stamped {
+		n += 2
+	}
+	if ev.f != nil {
+		n += len(ev.f.keys)
+	}
+	return n
+}
+
 func (ev *Event) String() string {
 	ev.mu.RLock()
 	defer ev.mu.RUnlock()
 
-	var arr []string
-	for _, key := range ev.keys {
-		arr = append(arr, fmt.Sprintf("%s=%q", key, ev.vals[key]))
-	}
+	arr := make([]string, 0, ev.len())
+	ev.rangeLocked(func(key, val string) {
+		arr = append(arr, fmt.Sprintf("%s=%q", key, val))
+	})
 	return strings.Join(arr, " ")
 }
 
 func (ev *Event) Map() map[string]string {
 	ev.mu.RLock()
 	defer ev.mu.RUnlock()
+	return ev.mapLocked()
+}
 
-	m := make(map[string]string)
-	for key, val := range ev.vals {
+func (ev *Event) mapLocked() map[string]string {
+	m := make(map[string]string, ev.len())
+	ev.rangeLocked(func(key, val string) {
 		m[key] = val
-	}
+	})
 	return m
 }
+
+// View is like Map, but the map is shared by every caller until the event is
+// next modified and must not be modified. Use it to hand the finished tags of
+// an event to several consumers without copying them for each one.
+func (ev *Event) View() map[string]string {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if ev.view == nil {
+		ev.view = ev.mapLocked()
+	}
+	return ev.view
+}
@@ -0,0 +1,240 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package event
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCopyOnWrite(t *testing.T) {
+	tmpl := New()
+	tmpl.Set("process_id", "1")
+	tmpl.Set("hostname", "a")
+
+	ev := tmpl.Copy()
+	if ev.Get("event_id") == tmpl.Get("event_id") {
+		t.Errorf("copy has the same event_id as its template")
+	}
+	ev.Set("hostname", "b")
+	tmpl.Set("process_id", "2")
+	if got := tmpl.Get("hostname"); got != "a" {
+		t.Errorf("template hostname changed to %q by its copy", got)
+	}
+	if got := ev.Get("process_id"); got != "1" {
+		t.Errorf("copy process_id changed to %q by its template", got)
+	}
+
+	ev.Set("extra", "x")
+	want := fmt.Sprintf("time=%q event_id=%q process_id=\"1\" hostname=\"b\" extra=\"x\"", ev.Get("time"), ev.Get("event_id"))
+	if got := ev.String(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	view := ev.View()
+	if len(view) != 5 {
+		t.Errorf("got view %v, want 5 tags", view)
+	}
+	Release(ev)
+	if view["hostname"] != "b" || view["extra"] != "x" {
+		t.Errorf("view changed after release: %v", view)
+	}
+
+	reused := New()
+	if got := reused.Map(); len(got) != 2 {
+		t.Errorf("got %v on a new event, want only time and event_id", got)
+	}
+}
+
+// naiveEvent is the event implementation before tags were copy-on-write, kept
+// as the baseline for the benchmarks.
+type naiveEvent struct {
+	mu   sync.RWMutex
+	keys []string
+	vals map[string]string
+}
+
+func newNaive() *naiveEvent {
+	return &naiveEvent{
+		keys: []string{"time", "event_id"},
+		vals: map[string]string{
+			"time":     time.Now().UTC().Format(time.RFC3339Nano),
+			"event_id": uuid.NewString(),
+		},
+	}
+}
+
+func (src *naiveEvent) Copy() *naiveEvent {
+	dst := newNaive()
+	dst.CopyFrom(src)
+	return dst
+}
+
+func (dst *naiveEvent) CopyFrom(src *naiveEvent) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	for _, key := range src.keys {
+		if key != "time" && key != "event_id" {
+			dst.setLocked(key, src.vals[key])
+		}
+	}
+}
+
+func (ev *naiveEvent) Set(key, val string) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.setLocked(key, val)
+}
+
+func (ev *naiveEvent) setLocked(key, val string) {
+	if _, ok := ev.vals[key]; !ok {
+		ev.keys = append(ev.keys, key)
+	}
+	ev.vals[key] = val
+}
+
+func (ev *naiveEvent) Map() map[string]string {
+	ev.mu.RLock()
+	defer ev.mu.RUnlock()
+	m := make(map[string]string)
+	for key, val := range ev.vals {
+		m[key] = val
+	}
+	return m
+}
+
+// The cycle mirrors what the tracer does for every exchange: the config
+// template is copied, the proxy's tags are merged on top, a few tags of the
+// exchange are set and the result is handed to the filters and sinks.
+
+var (
+	cycleConfigTags = 4
+	cycleSocketTags = 24
+	cycleSinks      = 4
+)
+
+func templateTags(n int, prefix string) [][2]string {
+	var ret [][2]string
+	for i := range n {
+		ret = append(ret, [2]string{fmt.Sprintf("%s_%d", prefix, i), strings.Repeat("v", 16)})
+	}
+	return ret
+}
+
+var sink int
+
+func consume(m map[string]string) { sink += len(m) }
+
+func cycle(config, socket *Event) {
+	tags := config.Copy()
+	tags.CopyFrom(socket)
+	tags.Set("event_id", socket.Get("event_id"))
+	tags.Set("time", socket.Get("time"))
+	tags.Set("http_cache_status", "miss")
+	tags.Set("capture_level", "full")
+	view := tags.View()
+	for range cycleSinks {
+		consume(view)
+	}
+	Release(tags)
+}
+
+func naiveCycle(config, socket *naiveEvent) {
+	tags := config.Copy()
+	tags.CopyFrom(socket)
+	tags.Set("http_cache_status", "miss")
+	tags.Set("capture_level", "full")
+	for range cycleSinks {
+		consume(tags.Map())
+	}
+}
+
+func newTemplates() (*Event, *Event) {
+	config, socket := New(), New()
+	for _, kv := range templateTags(cycleConfigTags, "config") {
+		config.Set(kv[0], kv[1])
+	}
+	for _, kv := range templateTags(cycleSocketTags, "socket") {
+		socket.Set(kv[0], kv[1])
+	}
+	return config, socket
+}
+
+func newNaiveTemplates() (*naiveEvent, *naiveEvent) {
+	config, socket := newNaive(), newNaive()
+	for _, kv := range templateTags(cycleConfigTags, "config") {
+		config.Set(kv[0], kv[1])
+	}
+	for _, kv := range templateTags(cycleSocketTags, "socket") {
+		socket.Set(kv[0], kv[1])
+	}
+	return config, socket
+}
+
+func BenchmarkCycle(b *testing.B) {
+	config, socket := newTemplates()
+	b.ReportAllocs()
+	for range b.N {
+		cycle(config, socket)
+	}
+}
+
+func BenchmarkCycleNaive(b *testing.B) {
+	config, socket := newNaiveTemplates()
+	b.ReportAllocs()
+	for range b.N {
+		naiveCycle(config, socket)
+	}
+}
+
+// soak runs n cycles and returns the bytes allocated and the GC pause time
+// during them and the live heap at the end.
+func soak(n int, fn func()) (allocated uint64, pause time.Duration, live uint64) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for range n {
+		fn()
+	}
+	runtime.ReadMemStats(&after)
+	runtime.GC()
+	var end runtime.MemStats
+	runtime.ReadMemStats(&end)
+	return after.TotalAlloc - before.TotalAlloc, time.Duration(after.PauseTotalNs - before.PauseTotalNs), end.HeapAlloc
+}
+
+func TestSoak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping soak test in short mode")
+	}
+
+	config, socket := newTemplates()
+	naiveConfig, naiveSocket := newNaiveTemplates()
+	const n = 1_000_000
+
+	_, _, warm := soak(n/10, func() { cycle(config, socket) })
+	allocated, pause, live := soak(n, func() { cycle(config, socket) })
+	// The baseline is several times slower, so it's extrapolated from fewer
+	// events.
+	const naiveN = n / 100
+	naiveAllocated, naivePause, _ := soak(naiveN, func() { naiveCycle(naiveConfig, naiveSocket) })
+	t.Logf("%d events: %d B/event allocated, %v GC pause, live heap %d KiB after warmup and %d KiB after", n, allocated/n, pause, warm>>10, live>>10)
+	t.Logf("baseline: %d B/event allocated, %v GC pause per %d events", naiveAllocated/naiveN, naivePause*(n/naiveN), n)
+
+	// Memory must stay flat: nothing may be retained per event.
+	if live > warm+4<<20 {
+		t.Errorf("live heap grew from %d KiB to %d KiB over %d events", warm>>10, live>>10, n)
+	}
+	if got, baseline := allocated/n, naiveAllocated/naiveN; got*2 > baseline {
+		t.Errorf("allocated %d B/event, want at most half of the baseline's %d B/event", got, baseline)
+	}
+}
@@ -15,6 +15,10 @@ const (
 	ActionInvalid Action = ""
 	ActionInclude Action = "include"
 	ActionExclude Action = "exclude"
+
+	// ActionSample keeps a fraction of the events, chosen at random. Only
+	// config rules decide with it; filters themselves include or exclude.
+	ActionSample Action = "sample"
 )
 
 type Filter struct {
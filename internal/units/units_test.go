@@ -0,0 +1,24 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package units
+
+import "testing"
+
+func TestBytes(t *testing.T) {
+	for n, want := range map[uint64]string{
+		0:                 "0 B",
+		1023:              "1023 B",
+		1024:              "1.0 KiB",
+		1536:              "1.5 KiB",
+		10 << 20:          "10.0 MiB",
+		3 << 30:           "3.0 GiB",
+		1 << 50:           "1.0 PiB",
+		1 << 60:           "1024.0 PiB",
+		^uint64(0) - 1023: "16384.0 PiB",
+	} {
+		if got := Bytes(n); got != want {
+			t.Errorf("Bytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -4,17 +4,27 @@
 package logging
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
 )
 
 var Verbose bool
 var Logfile string
 
+// RingSize is how many of the most recent log lines, including debug ones even
+// without -v, are kept in memory for state dumps (see Recent). 0 disables it.
+var RingSize int
+
+var ring *lineRing
+
 func Init() error {
 	_, path, _, _ := runtime.Caller(0)
 	prefix := strings.TrimSuffix(path, "/logging/logging.go")
@@ -54,7 +64,74 @@ func Init() error {
 		}
 		out = f
 	}
-	slog.SetDefault(slog.New(slog.NewTextHandler(out, opts)))
+	var handler slog.Handler = slog.NewTextHandler(out, opts)
+	if RingSize > 0 {
+		ring = &lineRing{lines: make([]string, 0, RingSize)}
+		ringOpts := *opts
+		ringOpts.Level = slog.LevelDebug
+		handler = teeHandler{handler, slog.NewTextHandler(ring, &ringOpts)}
+	}
+	slog.SetDefault(slog.New(handler))
 
 	return nil
 }
+
+// Recent returns the most recent log lines, oldest first, or nil if RingSize
+// is 0.
+func Recent() []string {
+	if ring == nil {
+		return nil
+	}
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	return append(slices.Clone(ring.lines[ring.next:]), ring.lines[:ring.next]...)
+}
+
+// lineRing keeps the last lines written to it. The text handler writes each
+// record with a single Write.
+type lineRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int // oldest line once the ring is full
+}
+
+func (r *lineRing) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	line := strings.TrimSuffix(string(b), "\n")
+	if len(r.lines) < cap(r.lines) {
+		r.lines = append(r.lines, line)
+	} else {
+		r.lines[r.next] = line
+		r.next = (r.next + 1) % len(r.lines)
+	}
+	return len(b), nil
+}
+
+// teeHandler sends every record to both handlers if they're enabled for it.
+type teeHandler struct {
+	a, b slog.Handler
+}
+
+func (h teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.a.Enabled(ctx, level) || h.b.Enabled(ctx, level)
+}
+
+func (h teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	if h.a.Enabled(ctx, r.Level) {
+		err = h.a.Handle(ctx, r.Clone())
+	}
+	if h.b.Enabled(ctx, r.Level) {
+		err = errors.Join(err, h.b.Handle(ctx, r))
+	}
+	return err
+}
+
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return teeHandler{h.a.WithAttrs(attrs), h.b.WithAttrs(attrs)}
+}
+
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	return teeHandler{h.a.WithGroup(name), h.b.WithGroup(name)}
+}
@@ -28,6 +28,10 @@ cmd:proto() {
     --go_out=. --go_opt=paths=source_relative
 }
 
+cmd:conformance() {
+  go test -tags conformance -v -count=1 ./cmd/run/conformance
+}
+
 main() {
   if [[ "$1" != "" ]]; then
     cmd=$(echo "$1" | tr ':' ' ')
@@ -0,0 +1,192 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package pcapng writes reconstructed TCP streams as a pcapng capture that
+// Wireshark and tcpdump can open. The packets are synthesized: Ethernet, IP
+// and TCP headers are made up around the payload bytes with consistent
+// sequence numbers, so the capture shows what each side sent, not how the
+// kernel segmented it.
+package pcapng
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// Block types and options, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+const (
+	blockSHB = 0x0a0d0d0a
+	blockIDB = 0x00000001
+	blockNRB = 0x00000004
+	blockEPB = 0x00000006
+
+	byteOrderMagic = 0x1a2b3c4d
+	linkTypeEther  = 1
+
+	optEnd       = 0
+	optUserAppl  = 4 // shb_userappl
+	optTSResol   = 9 // if_tsresol
+	nrbEnd       = 0
+	nrbIPv4      = 1
+	nrbIPv6      = 2
+	tsResolNanos = 9 // timestamps are in 10^-9 seconds
+)
+
+// Writer writes a pcapng capture with a single Ethernet interface. It's safe
+// for concurrent use. Write failures are logged once and otherwise ignored so
+// that the capture can never break the connections it mirrors.
+type Writer struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	c   io.Closer
+	err error
+
+	ipID uint16
+}
+
+// Create creates the capture file at path, truncating it if it exists.
+func Create(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("create pcapng file: %w", err)
+	}
+	w, err := NewWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.c = f
+	return w, nil
+}
+
+// NewWriter writes the section header and the interface description to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	ret := &Writer{w: bufio.NewWriterSize(w, 64<<10)}
+
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, byteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	shb = appendOption(shb, optUserAppl, []byte("subtrace"))
+	shb = appendOption(shb, optEnd, nil)
+
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, linkTypeEther)
+	idb = binary.LittleEndian.AppendUint16(idb, 0) // reserved
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // no snap length
+	idb = appendOption(idb, optTSResol, []byte{tsResolNanos})
+	idb = appendOption(idb, optEnd, nil)
+
+	ret.writeBlock(blockSHB, shb)
+	ret.writeBlock(blockIDB, idb)
+	if ret.err != nil {
+		return nil, fmt.Errorf("write pcapng header: %w", ret.err)
+	}
+	return ret, nil
+}
+
+func appendOption(b []byte, code uint16, val []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(val)))
+	return appendPadded(b, val)
+}
+
+func appendPadded(b, val []byte) []byte {
+	b = append(b, val...)
+	return append(b, make([]byte, (4-len(val)%4)%4)...)
+}
+
+// writeBlock writes a block with the given body, which must already be padded
+// to 32 bits. w.mu must be held unless w isn't shared yet.
+func (w *Writer) writeBlock(typ uint32, body []byte) {
+	if w.err != nil {
+		return
+	}
+	n := uint32(12 + len(body))
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:], typ)
+	binary.LittleEndian.PutUint32(hdr[4:], n)
+	w.w.Write(hdr[:])
+	w.w.Write(body)
+	_, err := w.w.Write(hdr[4:])
+	if err != nil {
+		slog.Error("failed to write pcapng block, dropping the rest of the capture", "err", err)
+		w.err = err
+	}
+}
+
+// writePacket writes an enhanced packet block with the given frame.
+func (w *Writer) writePacket(ts time.Time, frame []byte) {
+	nanos := uint64(ts.UnixNano())
+	body := make([]byte, 0, 20+len(frame)+3)
+	body = binary.LittleEndian.AppendUint32(body, 0) // interface
+	body = binary.LittleEndian.AppendUint32(body, uint32(nanos>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(nanos))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(frame)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(frame)))
+	body = appendPadded(body, frame)
+	w.writeBlock(blockEPB, body)
+}
+
+// WriteNames writes a name resolution block so that Wireshark shows the
+// hostnames the traced processes used instead of bare addresses.
+func (w *Writer) WriteNames(names map[netip.Addr][]string) {
+	var body []byte
+	for addr, hosts := range names {
+		if len(hosts) == 0 {
+			continue
+		}
+		var val []byte
+		typ := uint16(nrbIPv6)
+		if addr = addr.Unmap(); addr.Is4() {
+			typ = nrbIPv4
+		}
+		val = append(val, addr.AsSlice()...)
+		for _, h := range hosts {
+			val = append(append(val, h...), 0)
+		}
+		body = appendOption(body, typ, val)
+	}
+	if body == nil {
+		return
+	}
+	body = appendOption(body, nrbEnd, nil)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writeBlock(blockNRB, body)
+}
+
+// Flush writes buffered blocks to the file.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.w.Flush(); err != nil {
+		slog.Error("failed to write pcapng block, dropping the rest of the capture", "err", err)
+		w.err = err
+	}
+	return w.err
+}
+
+// Close flushes the capture and closes the file if the writer created it.
+func (w *Writer) Close() error {
+	err := w.Flush()
+	if w.c != nil {
+		if cerr := w.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
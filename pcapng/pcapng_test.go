@@ -0,0 +1,160 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+type block struct {
+	typ  uint32
+	body []byte
+}
+
+func readBlocks(t *testing.T, b []byte) []block {
+	t.Helper()
+	var ret []block
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block: %x", b)
+		}
+		typ, n := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if n%4 != 0 || int(n) > len(b) || binary.LittleEndian.Uint32(b[n-4:]) != n {
+			t.Fatalf("block %#x: bad length %d", typ, n)
+		}
+		ret = append(ret, block{typ: typ, body: b[8 : n-4]})
+		b = b[n:]
+	}
+	return ret
+}
+
+type segment struct {
+	ts       time.Time
+	src, dst netip.AddrPort
+	seq, ack uint32
+	flags    byte
+	payload  []byte
+}
+
+func parseSegment(t *testing.T, body []byte) segment {
+	t.Helper()
+	ts := time.Unix(0, int64(binary.LittleEndian.Uint64(append(body[8:12:12], body[4:8]...))))
+	frame := body[20 : 20+binary.LittleEndian.Uint32(body[12:])]
+
+	var s segment
+	s.ts = ts
+	var src, dst netip.Addr
+	var tcp []byte
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case 0x0800:
+		ip := frame[14:34]
+		if checksum(0, ip) != 0xffff {
+			t.Fatalf("bad IPv4 header checksum")
+		}
+		src, dst = netip.AddrFrom4([4]byte(ip[12:16])), netip.AddrFrom4([4]byte(ip[16:20]))
+		tcp = frame[34 : 14+binary.BigEndian.Uint16(ip[2:])]
+	case 0x86dd:
+		ip := frame[14:54]
+		src, dst = netip.AddrFrom16([16]byte(ip[8:24])), netip.AddrFrom16([16]byte(ip[24:40]))
+		tcp = frame[54 : 54+binary.BigEndian.Uint16(ip[4:])]
+	default:
+		t.Fatalf("unexpected ethertype %x", frame[12:14])
+	}
+	if tcpChecksum(src, dst, tcp) != 0 {
+		t.Fatalf("bad TCP checksum")
+	}
+	s.src = netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp[0:]))
+	s.dst = netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:]))
+	s.seq, s.ack = binary.BigEndian.Uint32(tcp[4:]), binary.BigEndian.Uint32(tcp[8:])
+	s.flags = tcp[13]
+	s.payload = tcp[20:]
+	return s
+}
+
+func TestStream(t *testing.T) {
+	for _, tt := range []struct {
+		client, server string
+	}{
+		{"10.0.0.1:40000", "93.184.216.34:443"},
+		{"[fd00::1]:40000", "[2606:2800:220:1::1]:80"},
+		{"[::ffff:10.0.0.1]:40000", "[::1]:80"}, // mixed families after unmapping
+	} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("new writer: %v", err)
+		}
+		client, server := netip.MustParseAddrPort(tt.client), netip.MustParseAddrPort(tt.server)
+		ts := time.Date(2026, 1, 1, 0, 0, 0, 123456789, time.UTC)
+		s := w.NewStream(ts, client, server)
+		req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		resp := []byte("HTTP/1.1 200 OK\r\nContent-Length: 40000\r\n\r\n" + strings.Repeat("x", 40000))
+		s.Write(ts, ClientToServer, req)
+		s.Write(ts.Add(time.Millisecond), ServerToClient, resp)
+		s.CloseWrite(ts, ClientToServer)
+		s.Write(ts, ClientToServer, []byte("after FIN"))
+		s.Close(ts.Add(2 * time.Millisecond))
+		w.WriteNames(map[netip.Addr][]string{server.Addr(): {"example.com"}})
+		if err := w.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+
+		blocks := readBlocks(t, buf.Bytes())
+		if blocks[0].typ != blockSHB || binary.LittleEndian.Uint32(blocks[0].body) != byteOrderMagic || blocks[1].typ != blockIDB {
+			t.Fatalf("%s: capture doesn't start with a section header and an interface", tt.client)
+		}
+		if last := blocks[len(blocks)-1]; last.typ != blockNRB || !bytes.Contains(last.body, []byte("example.com\x00")) {
+			t.Errorf("%s: capture doesn't end with the names", tt.client)
+		}
+
+		var got [2][]byte
+		var segs []segment
+		for _, b := range blocks[2 : len(blocks)-1] {
+			if b.typ != blockEPB {
+				t.Fatalf("%s: unexpected block %#x", tt.client, b.typ)
+			}
+			segs = append(segs, parseSegment(t, b.body))
+		}
+		if segs[0].flags != tcpSYN || segs[1].flags != tcpSYN|tcpACK || segs[1].ack != segs[0].seq+1 || segs[2].ack != segs[1].seq+1 {
+			t.Fatalf("%s: got handshake %+v", tt.client, segs[:3])
+		}
+		if !segs[0].ts.Equal(ts) {
+			t.Errorf("%s: got timestamp %s, want %s", tt.client, segs[0].ts, ts)
+		}
+		if segs[0].src.Port() != client.Port() || segs[0].dst.Port() != server.Port() {
+			t.Errorf("%s: got SYN from %s to %s", tt.client, segs[0].src, segs[0].dst)
+		}
+		next := [2]uint32{segs[0].seq + 1, segs[1].seq + 1}
+		fins := 0
+		for _, s := range segs[3:] {
+			d := ClientToServer
+			if s.src.Port() == server.Port() {
+				d = ServerToClient
+			}
+			if s.seq != next[d] {
+				t.Fatalf("%s: got seq %d in direction %d, want %d", tt.client, s.seq, d, next[d])
+			}
+			if len(s.payload) > MaxSegment {
+				t.Fatalf("%s: got a %d byte segment", tt.client, len(s.payload))
+			}
+			got[d] = append(got[d], s.payload...)
+			next[d] += uint32(len(s.payload))
+			if s.flags&tcpFIN != 0 {
+				next[d]++
+				fins++
+			}
+		}
+		if !bytes.Equal(got[ClientToServer], req) || !bytes.Equal(got[ServerToClient], resp) {
+			t.Errorf("%s: got streams of %d and %d bytes, want the request and response", tt.client, len(got[0]), len(got[1]))
+		}
+		if fins != 2 {
+			t.Errorf("%s: got %d FINs, want 2", tt.client, fins)
+		}
+	}
+}
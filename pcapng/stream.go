@@ -0,0 +1,202 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package pcapng
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Dir is the direction of a stream's bytes.
+type Dir int
+
+const (
+	// ClientToServer is from the side that opened the connection.
+	ClientToServer Dir = iota
+	// ServerToClient is from the side that accepted it.
+	ServerToClient
+)
+
+// MaxSegment is the most payload bytes put in one synthesized TCP segment.
+// Larger writes are split.
+const MaxSegment = 16 << 10
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// Stream is one synthesized TCP connection in a capture. It's safe for
+// concurrent use by the two directions.
+type Stream struct {
+	w *Writer
+
+	mu     sync.Mutex
+	addr   [2]netip.AddrPort // indexed by the direction of the sender
+	mac    [2][6]byte
+	seq    [2]uint32
+	closed [2]bool
+}
+
+// NewStream writes the handshake of a TCP connection from client to server at
+// ts and returns the stream that its bytes are written to.
+func (w *Writer) NewStream(ts time.Time, client, server netip.AddrPort) *Stream {
+	s := &Stream{w: w}
+	c, sv := client.Addr().Unmap(), server.Addr().Unmap()
+	if c.Is4() != sv.Is4() {
+		c, sv = netip.AddrFrom16(c.As16()), netip.AddrFrom16(sv.As16())
+	}
+	s.addr[ClientToServer] = netip.AddrPortFrom(c, client.Port())
+	s.addr[ServerToClient] = netip.AddrPortFrom(sv, server.Port())
+	s.mac[ClientToServer] = [6]byte{0x02, 0, 0, 0, 0, 0x01} // locally administered
+	s.mac[ServerToClient] = [6]byte{0x02, 0, 0, 0, 0, 0x02}
+	s.seq[ClientToServer] = rand.Uint32()
+	s.seq[ServerToClient] = rand.Uint32()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.segment(ts, ClientToServer, tcpSYN, nil)
+	s.segment(ts, ServerToClient, tcpSYN|tcpACK, nil)
+	s.segment(ts, ClientToServer, tcpACK, nil)
+	return s
+}
+
+// Write writes payload sent in direction d at ts.
+func (s *Stream) Write(ts time.Time, d Dir, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed[d] {
+		return
+	}
+	for len(payload) > 0 {
+		n := min(len(payload), MaxSegment)
+		s.segment(ts, d, tcpPSH|tcpACK, payload[:n])
+		payload = payload[n:]
+	}
+}
+
+// CloseWrite writes a FIN in direction d at ts, if there hasn't been one.
+func (s *Stream) CloseWrite(ts time.Time, d Dir) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed[d] {
+		s.segment(ts, d, tcpFIN|tcpACK, nil)
+		s.closed[d] = true
+	}
+}
+
+// Close writes a FIN in both directions, if there hasn't been one, and the
+// last ACK.
+func (s *Stream) Close(ts time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var last Dir
+	for _, d := range []Dir{ClientToServer, ServerToClient} {
+		if !s.closed[d] {
+			s.segment(ts, d, tcpFIN|tcpACK, nil)
+			s.closed[d] = true
+			last = d
+		}
+	}
+	s.segment(ts, 1-last, tcpACK, nil)
+}
+
+// segment writes one segment from direction d and advances its sequence
+// number. s.mu must be held.
+func (s *Stream) segment(ts time.Time, d Dir, flags byte, payload []byte) {
+	src, dst := s.addr[d], s.addr[1-d]
+	var ack uint32
+	if flags&tcpACK != 0 {
+		ack = s.seq[1-d]
+	}
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], s.seq[d])
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // data offset
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff) // window
+	tcp = append(tcp, payload...)
+	binary.BigEndian.PutUint16(tcp[16:], tcpChecksum(src.Addr(), dst.Addr(), tcp))
+
+	frame := make([]byte, 0, 14+40+len(tcp))
+	frame = append(frame, s.mac[1-d][:]...)
+	frame = append(frame, s.mac[d][:]...)
+	if src.Addr().Is4() {
+		frame = binary.BigEndian.AppendUint16(frame, 0x0800)
+		frame = s.appendIPv4(frame, src.Addr(), dst.Addr(), len(tcp))
+	} else {
+		frame = binary.BigEndian.AppendUint16(frame, 0x86dd)
+		frame = appendIPv6(frame, src.Addr(), dst.Addr(), len(tcp))
+	}
+	frame = append(frame, tcp...)
+
+	s.w.mu.Lock()
+	s.w.writePacket(ts, frame)
+	s.w.mu.Unlock()
+
+	s.seq[d] += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		s.seq[d]++
+	}
+}
+
+func (s *Stream) appendIPv4(b []byte, src, dst netip.Addr, n int) []byte {
+	s.w.mu.Lock()
+	s.w.ipID++
+	id := s.w.ipID
+	s.w.mu.Unlock()
+
+	hdr := make([]byte, 20)
+	hdr[0] = 0x45 // version 4, 20 byte header
+	binary.BigEndian.PutUint16(hdr[2:], uint16(20+n))
+	binary.BigEndian.PutUint16(hdr[4:], id)
+	binary.BigEndian.PutUint16(hdr[6:], 0x4000) // don't fragment
+	hdr[8] = 64                                 // TTL
+	hdr[9] = 6                                  // TCP
+	s4, d4 := src.As4(), dst.As4()
+	copy(hdr[12:], s4[:])
+	copy(hdr[16:], d4[:])
+	binary.BigEndian.PutUint16(hdr[10:], ^checksum(0, hdr))
+	return append(b, hdr...)
+}
+
+func appendIPv6(b []byte, src, dst netip.Addr, n int) []byte {
+	b = binary.BigEndian.AppendUint32(b, 6<<28)
+	b = binary.BigEndian.AppendUint16(b, uint16(n))
+	b = append(b, 6, 64) // TCP, hop limit
+	b = append(b, src.AsSlice()...)
+	return append(b, dst.AsSlice()...)
+}
+
+func tcpChecksum(src, dst netip.Addr, tcp []byte) uint16 {
+	var pseudo []byte
+	pseudo = append(pseudo, src.AsSlice()...)
+	pseudo = append(pseudo, dst.AsSlice()...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(tcp)))
+	pseudo = binary.BigEndian.AppendUint32(pseudo, 6)
+	return ^checksum(checksum(0, pseudo), tcp)
+}
+
+// checksum adds b to the ones' complement sum.
+func checksum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
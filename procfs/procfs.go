@@ -0,0 +1,216 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package procfs centralizes access to /proc so that features depending on it
+// can be degraded explicitly when it is missing or restricted (e.g. hidepid=2
+// or paths masked by a hardened container runtime).
+package procfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Root is the procfs mount point. It's a variable so that tests can point it
+// at a fake directory.
+var Root = "/proc"
+
+// Feature is a group of /proc paths that some part of subtrace depends on.
+type Feature string
+
+const (
+	// FeatureThreads is /proc/<pid>/status, used to map thread IDs to thread
+	// group IDs. Tracing isn't possible without it.
+	FeatureThreads Feature = "thread tracking"
+
+	// FeatureMetadata is /proc/<pid>/exe and /proc/<pid>/cmdline, used for the
+	// process_* event fields.
+	FeatureMetadata Feature = "process metadata"
+
+	// FeatureFDs is /proc/<pid>/fd and /proc/<pid>/cwd, used to import sockets
+	// inherited by a new process and to resolve relative paths.
+	FeatureFDs Feature = "fd reconciliation"
+
+	// FeatureStats is /proc/loadavg and /proc/meminfo, used for the
+	// subtrace_linux_* event fields.
+	FeatureStats Feature = "system stats"
+
+	// FeatureSysctls is /proc/sys/net/ipv4/ip_local_port_range and
+	// tcp_abort_on_overflow, used to report ephemeral port pressure and to
+	// handle backlog overflows like the kernel would. Without them, the
+	// kernel defaults are assumed.
+	FeatureSysctls Feature = "network sysctls"
+)
+
+// Unavailable is the value event fields are set to when the feature that
+// provides them is degraded.
+const Unavailable = "unavailable"
+
+var (
+	mu          sync.RWMutex
+	unavailable = make(map[Feature]bool)
+)
+
+// Path returns the path to the given /proc entry (e.g. Path("%d/status", pid)).
+func Path(format string, args ...any) string {
+	return filepath.Join(Root, fmt.Sprintf(format, args...))
+}
+
+// Has reports whether the given feature can be used. Features are assumed to be
+// available until Init says otherwise.
+func Has(f Feature) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return !unavailable[f]
+}
+
+// Init probes each feature once against the current process, which runs as the
+// same user as the tracee, and returns the features that were degraded. It's
+// meant to be called once at startup so that failing /proc reads are never
+// retried in hot paths. Reads of the tracee's entries can still be denied
+// later, which Degrade handles.
+func Init() []Feature {
+	probes := []struct {
+		feature Feature
+		probe   func() error
+	}{
+		{FeatureThreads, func() error { return probeRead(Path("self/status")) }},
+		{FeatureMetadata, func() error {
+			if _, err := os.Readlink(Path("self/exe")); err != nil {
+				return err
+			}
+			return probeRead(Path("self/cmdline"))
+		}},
+		{FeatureFDs, func() error {
+			if _, err := os.ReadDir(Path("self/fd")); err != nil {
+				return err
+			}
+			_, err := os.Readlink(Path("self/cwd"))
+			return err
+		}},
+		{FeatureStats, func() error {
+			if err := probeRead(Path("loadavg")); err != nil {
+				return err
+			}
+			return probeRead(Path("meminfo"))
+		}},
+		{FeatureSysctls, func() error {
+			if err := probeRead(Path("sys/net/ipv4/ip_local_port_range")); err != nil {
+				return err
+			}
+			return probeRead(Path("sys/net/ipv4/tcp_abort_on_overflow"))
+		}},
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var degraded []Feature
+	unavailable = make(map[Feature]bool)
+	for _, p := range probes {
+		if err := p.probe(); err != nil {
+			unavailable[p.feature] = true
+			degraded = append(degraded, p.feature)
+		}
+	}
+	return degraded
+}
+
+// Degrade marks f as unavailable if err is a permission error from reading
+// another process's entry, and reports whether it was. Init can't predict those
+// from /proc/self: a tracee that isn't dumpable after a setuid exec, or one
+// that changed credentials under hidepid, denies reads that the probes passed.
+// Other errors are ignored since they usually mean that the process exited.
+// It's not meant for FeatureThreads, which tracing can't do without.
+func Degrade(f Feature, err error) bool {
+	if err == nil || !errors.Is(err, fs.ErrPermission) {
+		return false
+	}
+
+	mu.Lock()
+	first := !unavailable[f]
+	unavailable[f] = true
+	mu.Unlock()
+
+	if first {
+		slog.Warn("/proc is restricted for a traced process, running with degraded features", "degraded", string(f), "err", err)
+	}
+	return true
+}
+
+// Describe formats a list of degraded features for a startup warning.
+func Describe(degraded []Feature) string {
+	var names []string
+	for _, f := range degraded {
+		names = append(names, string(f))
+	}
+	return strings.Join(names, ", ")
+}
+
+func probeRead(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf [1]byte
+	if _, err := f.Read(buf[:]); err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	return nil
+}
+
+// ContainerID returns the ID of the container the process with the given PID
+// runs in, based on its cgroup paths. It returns an empty string if the
+// process doesn't appear to be in a container.
+func ContainerID(pid int) string {
+	b, err := os.ReadFile(Path("%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	return parseContainerID(string(b))
+}
+
+// parseContainerID finds a 64-character hex container ID in the contents of a
+// /proc/<pid>/cgroup file. Runtimes name the cgroup differently, e.g.
+// "/docker/<id>", "/system.slice/docker-<id>.scope" or
+// "/kubepods/.../cri-containerd-<id>.scope".
+func parseContainerID(cgroup string) string {
+	for _, line := range strings.Split(cgroup, "\n") {
+		_, path, ok := strings.Cut(line, "::")
+		if !ok {
+			if i := strings.LastIndexByte(line, ':'); i >= 0 {
+				path = line[i+1:]
+			}
+		}
+		for _, elem := range strings.Split(path, "/") {
+			elem = strings.TrimSuffix(elem, ".scope")
+			if i := strings.LastIndexAny(elem, "-:"); i >= 0 {
+				elem = elem[i+1:]
+			}
+			if isContainerID(elem) {
+				return elem
+			}
+		}
+	}
+	return ""
+}
+
+func isContainerID(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
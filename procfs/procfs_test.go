@@ -0,0 +1,128 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package procfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestInitEmptyRoot(t *testing.T) {
+	orig := Root
+	defer func() {
+		Root = orig
+		Init()
+	}()
+
+	Root = t.TempDir()
+
+	degraded := Init()
+	for _, f := range []Feature{FeatureThreads, FeatureMetadata, FeatureFDs, FeatureStats, FeatureSysctls} {
+		if Has(f) {
+			t.Errorf("Has(%q) = true with empty proc root, want false", f)
+		}
+	}
+	if len(degraded) != 5 {
+		t.Errorf("Init() degraded %d features, want 5: %s", len(degraded), Describe(degraded))
+	}
+}
+
+// TestDegrade checks that a feature that passed the probes is degraded once a
+// read of another process's entry is denied, but not when the process is gone.
+func TestDegrade(t *testing.T) {
+	orig := Root
+	defer func() {
+		Root = orig
+		Init()
+	}()
+
+	Root = t.TempDir()
+	os.MkdirAll(Path("self/fd"), 0o755)
+	os.MkdirAll(Path("sys/net/ipv4"), 0o755)
+	os.Symlink("/usr/bin/true", Path("self/exe"))
+	os.Symlink("/", Path("self/cwd"))
+	for _, name := range []string{"self/status", "self/cmdline", "loadavg", "meminfo", "sys/net/ipv4/ip_local_port_range", "sys/net/ipv4/tcp_abort_on_overflow"} {
+		if err := os.WriteFile(Path("%s", name), []byte("0\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if degraded := Init(); len(degraded) != 0 {
+		t.Fatalf("Init() degraded %s, want nothing", Describe(degraded))
+	}
+
+	gone := &fs.PathError{Op: "readlink", Path: Path("42/exe"), Err: syscall.ENOENT}
+	if Degrade(FeatureMetadata, nil) || Degrade(FeatureMetadata, gone) || !Has(FeatureMetadata) {
+		t.Errorf("degraded %q for a process that exited", FeatureMetadata)
+	}
+
+	denied := fmt.Errorf("open dir: %w", syscall.EACCES)
+	if !Degrade(FeatureFDs, denied) || Has(FeatureFDs) {
+		t.Errorf("didn't degrade %q after %v", FeatureFDs, denied)
+	}
+	if !Degrade(FeatureFDs, denied) || Has(FeatureFDs) {
+		t.Errorf("%q isn't degraded after being denied twice", FeatureFDs)
+	}
+	if !Has(FeatureMetadata) || !Has(FeatureThreads) {
+		t.Errorf("degraded other features than %q", FeatureFDs)
+	}
+
+	if degraded := Init(); len(degraded) != 0 || !Has(FeatureFDs) {
+		t.Errorf("Init() didn't start over: degraded %s", Describe(degraded))
+	}
+}
+
+func TestPath(t *testing.T) {
+	orig := Root
+	defer func() { Root = orig }()
+
+	Root = "/fake/proc"
+	if got, want := Path("%d/status", 42), "/fake/proc/42/status"; got != want {
+		t.Errorf("Path() = %q, want %q", got, want)
+	}
+}
+
+func TestParseContainerID(t *testing.T) {
+	const id = "3f4e1b2a9c8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f"
+	for _, tt := range []struct {
+		cgroup string
+		want   string
+	}{
+		{"0::/docker/" + id + "\n", id},
+		{"0::/system.slice/docker-" + id + ".scope\n", id},
+		{"12:memory:/kubepods/burstable/pod1234/" + id + "\n1:name=systemd:/\n", id},
+		{"0::/kubepods.slice/kubepods-pod1.slice/cri-containerd-" + id + ".scope\n", id},
+		{"0::/user.slice/user-1000.slice/session-2.scope\n", ""},
+		{"", ""},
+	} {
+		if got := parseContainerID(tt.cgroup); got != tt.want {
+			t.Errorf("parseContainerID(%q) = %q, want %q", tt.cgroup, got, tt.want)
+		}
+	}
+}
+
+func TestParseNetAddr(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{"0100007F:1F90", "127.0.0.1:8080"},
+		{"00000000:3A99", "0.0.0.0:15001"},
+		{"00000000000000000000000001000000:0050", "[::1]:80"},
+		{"0000000000000000FFFF00000100007F:0035", "127.0.0.1:53"},
+		{"B80D0120000000000000000001000000:01BB", "[2001:db8::1]:443"},
+	} {
+		got, err := ParseNetAddr(tt.in)
+		if err != nil || got.String() != tt.want {
+			t.Errorf("ParseNetAddr(%q) = %v, %v, want %s", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "0100007F", "0100007:0050", "0100007F:FFFFF", "zz00007F:0050"} {
+		if got, err := ParseNetAddr(in); err == nil {
+			t.Errorf("ParseNetAddr(%q) = %v, want an error", in, got)
+		}
+	}
+}
@@ -10,6 +10,10 @@ func getEndpoint() string {
 	if endpoint == "" {
 		return "https://subtrace.dev"
 	}
+	return normalizeEndpoint(endpoint)
+}
+
+func normalizeEndpoint(endpoint string) string {
 	endpoint = strings.TrimSuffix(endpoint, "/")
 	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
 		endpoint = "https://" + endpoint
@@ -11,7 +11,9 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"subtrace.dev/cmd/version"
@@ -24,12 +26,35 @@ type Option func(*http.Request)
 
 func WithToken() Option {
 	return func(r *http.Request) {
-		if val := os.Getenv("SUBTRACE_TOKEN"); val != "" {
+		if val := Token(); val != "" {
 			r.Header.Set("authorization", fmt.Sprintf("Bearer %s", val))
 		}
 	}
 }
 
+// WithBearer authenticates the request with the given token instead of the
+// one returned by Token.
+func WithBearer(val string) Option {
+	return func(r *http.Request) {
+		r.Header.Set("authorization", fmt.Sprintf("Bearer %s", val))
+	}
+}
+
+// WithEndpoint sends the request to the given endpoint instead of the one set
+// by SUBTRACE_ENDPOINT. It has no effect on GetHeader.
+func WithEndpoint(endpoint string) Option {
+	return func(r *http.Request) {
+		if r.URL == nil {
+			return
+		}
+		u, err := url.Parse(normalizeEndpoint(endpoint))
+		if err != nil {
+			return
+		}
+		r.URL.Scheme, r.URL.Host, r.Host = u.Scheme, u.Host, u.Host
+	}
+}
+
 func WithoutToken() Option {
 	return func(r *http.Request) {
 		r.Header.Del("authorization")
@@ -95,8 +120,12 @@ func Call[R any, PR ptr[R]](ctx context.Context, w proto.Message, path string, r
 		))
 	}()
 
-	if resp.StatusCode >= 500 {
-		return resp.StatusCode, fmt.Errorf("%s", resp.Status)
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return resp.StatusCode, &StatusError{
+			Code:       resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: RetryAfter(resp.Header, time.Now()),
+		}
 	}
 
 	b, err = io.ReadAll(io.LimitReader(resp.Body, 64<<20)) // 64 MB limit
@@ -118,6 +147,40 @@ func Call[R any, PR ptr[R]](ctx context.Context, w proto.Message, path string, r
 	return resp.StatusCode, nil
 }
 
+// StatusError is returned for responses that mean the request should be
+// retried later (429 and 5xx).
+type StatusError struct {
+	Code       int
+	Status     string
+	RetryAfter time.Duration // zero if the server didn't say
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
+// RetryAfter parses the Retry-After header. An HTTP date is interpreted
+// relative to the response's Date header rather than the local clock so that
+// clock skew between us and the server doesn't stretch or skip the wait.
+func RetryAfter(h http.Header, now time.Time) time.Duration {
+	val := strings.TrimSpace(h.Get("retry-after"))
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(val); err == nil {
+		return max(0, time.Duration(secs)*time.Second)
+	}
+
+	at, err := http.ParseTime(val)
+	if err != nil {
+		return 0
+	}
+	if date, err := http.ParseTime(h.Get("date")); err == nil {
+		now = date
+	}
+	return max(0, at.Sub(now))
+}
+
 type ptr[T any] interface {
 	*T
 	proto.Message
@@ -0,0 +1,58 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package rpc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var token struct {
+	mu     sync.RWMutex
+	val    string
+	loaded bool
+}
+
+// Token returns the API token. If SUBTRACE_TOKEN_FILE is set, the token is
+// read from that file so that it can be rotated without restarting subtrace
+// (see RefreshToken). Otherwise, it's the value of SUBTRACE_TOKEN.
+func Token() string {
+	token.mu.RLock()
+	val, loaded := token.val, token.loaded
+	token.mu.RUnlock()
+	if loaded {
+		return val
+	}
+
+	RefreshToken()
+
+	token.mu.RLock()
+	defer token.mu.RUnlock()
+	return token.val
+}
+
+// RefreshToken re-reads the token and reports whether it changed. It's meant
+// to be called when the server rejects the current token.
+func RefreshToken() (changed bool, err error) {
+	val := os.Getenv("SUBTRACE_TOKEN")
+	if path := os.Getenv("SUBTRACE_TOKEN_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			err = fmt.Errorf("read token file: %w", err)
+			token.mu.Lock()
+			token.loaded = true
+			token.mu.Unlock()
+			return false, err
+		}
+		val = strings.TrimSpace(string(b))
+	}
+
+	token.mu.Lock()
+	defer token.mu.Unlock()
+	changed = token.loaded && token.val != val
+	token.val, token.loaded = val, true
+	return changed, nil
+}
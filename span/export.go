@@ -0,0 +1,192 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package span
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"subtrace.dev/rpc"
+)
+
+// Exporter sends spans to a tracing backend. Export must not block.
+type Exporter interface {
+	Export(*Span)
+
+	// Name identifies the exporter in logs and metrics.
+	Name() string
+
+	// Metrics returns the number of spans sent and the number dropped because
+	// the queue was full or the backend kept failing.
+	Metrics() map[string]uint64
+}
+
+var (
+	batchSize     = 100
+	batchInterval = time.Second
+	maxAttempts   = 5
+	retryBase     = 500 * time.Millisecond
+	maxRetryAfter = time.Minute
+)
+
+// permanentError is returned by a batch sender when retrying the same batch
+// can't succeed (e.g. the collector rejected it as malformed).
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// batcher queues spans and sends them in batches, retrying failed batches
+// with exponential backoff. Exporters only implement sending a single batch.
+type batcher struct {
+	name string
+	send func(ctx context.Context, batch []*Span) error
+
+	ch      chan *Span
+	flush   chan struct{}
+	pending sync.WaitGroup
+	dropped atomic.Uint64 // queue full
+	failed  atomic.Uint64 // given up on after retries or a permanent error
+	sent    atomic.Uint64
+}
+
+func newBatcher(name string, send func(context.Context, []*Span) error) *batcher {
+	return &batcher{
+		name:  name,
+		send:  send,
+		ch:    make(chan *Span, 4096),
+		flush: make(chan struct{}, 1),
+	}
+}
+
+func (b *batcher) Export(s *Span) {
+	b.pending.Add(1)
+	select {
+	case b.ch <- s:
+	default:
+		b.pending.Done()
+		if b.dropped.Add(1) == 1 {
+			slog.Warn("span export queue full, dropping spans", "exporter", b.name)
+		}
+	}
+}
+
+// Loop sends queued spans until ctx is done.
+func (b *batcher) Loop(ctx context.Context) {
+	var batch []*Span
+	timer := time.NewTimer(batchInterval)
+	timer.Stop()
+
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		b.sendWithRetry(ctx, batch)
+		for range batch {
+			b.pending.Done()
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-b.ch:
+			if len(batch) == 0 {
+				timer.Reset(batchInterval)
+			}
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				timer.Stop()
+				send()
+			}
+		case <-timer.C:
+			send()
+		case <-b.flush:
+			// Pick up whatever was queued before the flush was requested.
+			for drained := false; !drained; {
+				select {
+				case s := <-b.ch:
+					batch = append(batch, s)
+				default:
+					drained = true
+				}
+			}
+			timer.Stop()
+			send()
+		}
+	}
+}
+
+func (b *batcher) sendWithRetry(ctx context.Context, batch []*Span) {
+	for attempt := 1; ; attempt++ {
+		err := b.send(ctx, batch)
+		if err == nil {
+			b.sent.Add(uint64(len(batch)))
+			return
+		}
+
+		var perr *permanentError
+		if errors.As(err, &perr) || attempt >= maxAttempts {
+			b.failed.Add(uint64(len(batch)))
+			slog.Error("failed to export spans", "exporter", b.name, "spans", len(batch), "attempts", attempt, "err", err)
+			return
+		}
+
+		wait := retryBase << (attempt - 1)
+		var se *rpc.StatusError
+		if errors.As(err, &se) && se.RetryAfter > 0 {
+			wait = min(max(wait, se.RetryAfter), maxRetryAfter)
+		}
+		slog.Debug("failed to export spans, retrying", "exporter", b.name, "spans", len(batch), "attempt", attempt, "wait", wait, "err", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (b *batcher) Name() string {
+	return b.name
+}
+
+func (b *batcher) Metrics() map[string]uint64 {
+	return map[string]uint64{
+		"sent":    b.sent.Load(),
+		"dropped": b.dropped.Load(),
+		"failed":  b.failed.Load(),
+	}
+}
+
+// Flush sends every queued span and waits up to timeout for it to finish.
+func (b *batcher) Flush(timeout time.Duration) (flushed bool) {
+	select {
+	case b.flush <- struct{}{}:
+	default:
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.pending.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package span
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"subtrace.dev/cmd/version"
+	"subtrace.dev/rpc"
+)
+
+// OTLP protocols as named by OTEL_EXPORTER_OTLP_PROTOCOL.
+const (
+	OTLPProtocolHTTP = "http/protobuf"
+	OTLPProtocolGRPC = "grpc"
+)
+
+const otlpGRPCMethod = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+
+// OTLPExporter sends spans to an OpenTelemetry collector (or any backend that
+// accepts OTLP) over OTLP/HTTP with protobuf payloads or OTLP/gRPC.
+type OTLPExporter struct {
+	*batcher
+	url     string
+	grpc    bool
+	headers http.Header
+	client  *http.Client
+}
+
+// NewOTLPExporter returns an exporter that sends spans to endpoint with the
+// given protocol. endpoint is the base URL of the collector as in
+// OTEL_EXPORTER_OTLP_ENDPOINT, e.g. http://localhost:4318 for OTLP/HTTP or
+// http://localhost:4317 for gRPC; /v1/traces is added for OTLP/HTTP unless
+// it's already there. headers are sent with every request. Loop must be
+// running for spans to be sent.
+func NewOTLPExporter(endpoint string, protocol string, headers http.Header) (*OTLPExporter, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint %q: unsupported scheme %q", endpoint, u.Scheme)
+	}
+
+	e := &OTLPExporter{headers: headers}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch protocol {
+	case "", OTLPProtocolHTTP:
+		if !strings.HasSuffix(u.Path, "/v1/traces") {
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/traces"
+		}
+	case OTLPProtocolGRPC:
+		// gRPC needs HTTP/2, which plain http:// endpoints speak with prior
+		// knowledge like every gRPC client does.
+		e.grpc = true
+		u.Path = strings.TrimSuffix(u.Path, "/") + otlpGRPCMethod
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q (want %s or %s)", protocol, OTLPProtocolHTTP, OTLPProtocolGRPC)
+	}
+	e.url = u.String()
+	e.client = &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	e.batcher = newBatcher("otlp", e.send)
+	return e, nil
+}
+
+// ParseOTLPHeaders parses headers in the format of OTEL_EXPORTER_OTLP_HEADERS:
+// comma-separated key=value pairs with URL-encoded values.
+func ParseOTLPHeaders(val string) (http.Header, error) {
+	ret := make(http.Header)
+	for _, pair := range strings.Split(val, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("header %q: missing key=value", pair)
+		}
+		v, err := url.PathUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("header %q: %w", k, err)
+		}
+		ret.Add(strings.TrimSpace(k), v)
+	}
+	return ret, nil
+}
+
+// OTLP protobuf field numbers, from opentelemetry/proto/{collector/trace,
+// trace,common,resource}/v1.
+const (
+	otlpRequestResourceSpans = 1
+
+	otlpResourceSpansResource   = 1
+	otlpResourceSpansScopeSpans = 2
+
+	otlpResourceAttributes = 1
+
+	otlpScopeSpansScope = 1
+	otlpScopeSpansSpans = 2
+
+	otlpScopeName    = 1
+	otlpScopeVersion = 2
+
+	otlpSpanTraceID    = 1
+	otlpSpanID         = 2
+	otlpSpanParentID   = 4
+	otlpSpanName       = 5
+	otlpSpanKind       = 6
+	otlpSpanStartTime  = 7
+	otlpSpanEndTime    = 8
+	otlpSpanAttributes = 9
+	otlpSpanStatus     = 15
+
+	otlpStatusCode = 3
+
+	otlpKeyValueKey   = 1
+	otlpKeyValueValue = 2
+
+	otlpAnyValueString = 1
+	otlpAnyValueInt    = 3
+)
+
+// OTLP enum values.
+const (
+	otlpSpanKindServer = 2
+	otlpSpanKindClient = 3
+
+	otlpStatusCodeUnset = 0
+	otlpStatusCodeError = 2
+)
+
+// otlpUnknownService is the service name of spans from an unknown executable,
+// as the resource semantic conventions require.
+const otlpUnknownService = "unknown_service"
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendStringAttr(b []byte, num protowire.Number, key, val string) []byte {
+	var value []byte
+	value = protowire.AppendTag(value, otlpAnyValueString, protowire.BytesType)
+	value = protowire.AppendString(value, val)
+	return appendMessage(b, num, appendMessage(appendString(nil, otlpKeyValueKey, key), otlpKeyValueValue, value))
+}
+
+func appendIntAttr(b []byte, num protowire.Number, key string, val int64) []byte {
+	var value []byte
+	value = protowire.AppendTag(value, otlpAnyValueInt, protowire.VarintType)
+	value = protowire.AppendVarint(value, uint64(val))
+	return appendMessage(b, num, appendMessage(appendString(nil, otlpKeyValueKey, key), otlpKeyValueValue, value))
+}
+
+// peerAddr is the address of the other end of the span's connection: the
+// address dialed for outgoing requests, or the remote endpoint's.
+func peerAddr(s *Span) string {
+	if addr := s.Tags["dest_addr"]; addr != "" {
+		return addr
+	}
+	if s.Remote.Addr.IsValid() {
+		return s.Remote.Addr.String()
+	}
+	return ""
+}
+
+func toOTLPSpan(s *Span) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, otlpSpanTraceID, protowire.BytesType)
+	b = protowire.AppendBytes(b, s.TraceID[:])
+	b = protowire.AppendTag(b, otlpSpanID, protowire.BytesType)
+	b = protowire.AppendBytes(b, s.ID[:])
+	if !s.ParentID.IsZero() {
+		b = protowire.AppendTag(b, otlpSpanParentID, protowire.BytesType)
+		b = protowire.AppendBytes(b, s.ParentID[:])
+	}
+	b = appendString(b, otlpSpanName, s.Name)
+	kind := otlpSpanKindServer
+	if s.Kind == KindClient {
+		kind = otlpSpanKindClient
+	}
+	b = protowire.AppendTag(b, otlpSpanKind, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(kind))
+	b = protowire.AppendTag(b, otlpSpanStartTime, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(s.Start.UnixNano()))
+	b = protowire.AppendTag(b, otlpSpanEndTime, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(s.Start.Add(s.Duration).UnixNano()))
+
+	if s.Method != "" {
+		b = appendStringAttr(b, otlpSpanAttributes, "http.method", s.Method)
+	}
+	if s.StatusCode != 0 {
+		b = appendIntAttr(b, otlpSpanAttributes, "http.status_code", int64(s.StatusCode))
+	}
+	if s.URL != "" {
+		b = appendStringAttr(b, otlpSpanAttributes, "url.full", s.URL)
+	}
+	if addr := peerAddr(s); addr != "" {
+		b = appendStringAttr(b, otlpSpanAttributes, "net.peer.addr", addr)
+	}
+	for _, k := range slices.Sorted(maps.Keys(s.Tags)) {
+		b = appendStringAttr(b, otlpSpanAttributes, k, s.Tags[k])
+	}
+
+	code := otlpStatusCodeUnset
+	if s.Error() {
+		code = otlpStatusCodeError
+	}
+	var status []byte
+	if code != otlpStatusCodeUnset {
+		status = protowire.AppendTag(status, otlpStatusCode, protowire.VarintType)
+		status = protowire.AppendVarint(status, uint64(code))
+	}
+	return appendMessage(b, otlpSpanStatus, status)
+}
+
+// toOTLP encodes an ExportTraceServiceRequest with one resource per traced
+// executable so that backends show them as separate services.
+func toOTLP(batch []*Span) []byte {
+	var services []string
+	spans := make(map[string][]byte)
+	for _, s := range batch {
+		name := s.Local.ServiceName
+		if name == "" {
+			name = otlpUnknownService
+		}
+		if _, ok := spans[name]; !ok {
+			services = append(services, name)
+		}
+		spans[name] = appendMessage(spans[name], otlpScopeSpansSpans, toOTLPSpan(s))
+	}
+
+	var scope []byte
+	scope = appendString(scope, otlpScopeName, "subtrace")
+	scope = appendString(scope, otlpScopeVersion, version.Release)
+
+	var req []byte
+	for _, name := range services {
+		resource := appendStringAttr(nil, otlpResourceAttributes, "service.name", name)
+		scopeSpans := append(appendMessage(nil, otlpScopeSpansScope, scope), spans[name]...)
+
+		var rs []byte
+		rs = appendMessage(rs, otlpResourceSpansResource, resource)
+		rs = appendMessage(rs, otlpResourceSpansScopeSpans, scopeSpans)
+		req = appendMessage(req, otlpRequestResourceSpans, rs)
+	}
+	return req
+}
+
+func (e *OTLPExporter) send(ctx context.Context, batch []*Span) error {
+	body := toOTLP(batch)
+	contentType := "application/x-protobuf"
+	if e.grpc {
+		// Length-prefixed message, uncompressed.
+		framed := make([]byte, 5, 5+len(body))
+		binary.BigEndian.PutUint32(framed[1:], uint32(len(body)))
+		body, contentType = append(framed, body...), "application/grpc"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{fmt.Errorf("new request: %w", err)}
+	}
+	for k, v := range e.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("content-type", contentType)
+	if e.grpc {
+		req.Header.Set("te", "trailers")
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		if e.grpc {
+			return grpcStatus(resp)
+		}
+		return nil
+	case code == http.StatusTooManyRequests || code >= 500:
+		return &rpc.StatusError{Code: code, Status: resp.Status, RetryAfter: rpc.RetryAfter(resp.Header, time.Now())}
+	default:
+		return &permanentError{fmt.Errorf("collector returned %s", resp.Status)}
+	}
+}
+
+// grpcStatus returns the error of a gRPC response whose body has been read.
+// The status is in the trailers, or in the headers if there's no body.
+func grpcStatus(resp *http.Response) error {
+	val := resp.Trailer.Get("grpc-status")
+	msg := resp.Trailer.Get("grpc-message")
+	if val == "" {
+		val, msg = resp.Header.Get("grpc-status"), resp.Header.Get("grpc-message")
+	}
+	code, err := strconv.Atoi(val)
+	if err != nil {
+		return fmt.Errorf("collector returned no grpc-status")
+	}
+	if m, err := url.PathUnescape(msg); err == nil {
+		msg = m
+	}
+
+	switch code {
+	case 0: // OK
+		return nil
+	case 1, 4, 8, 10, 11, 14, 15:
+		// CANCELLED, DEADLINE_EXCEEDED, RESOURCE_EXHAUSTED, ABORTED,
+		// OUT_OF_RANGE, UNAVAILABLE and DATA_LOSS are retryable per the OTLP
+		// spec.
+		return fmt.Errorf("collector returned grpc-status %d: %s", code, msg)
+	default:
+		return &permanentError{fmt.Errorf("collector returned grpc-status %d: %s", code, msg)}
+	}
+}
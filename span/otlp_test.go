@@ -0,0 +1,301 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package span
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// message is a decoded protobuf message: the values of each field in order.
+// Length-delimited values are kept as bytes and decoded on demand.
+type message map[protowire.Number][]any
+
+func decode(t *testing.T, b []byte) message {
+	t.Helper()
+	m := make(message)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("bad tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		var val any
+		switch typ {
+		case protowire.VarintType:
+			val, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			val, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			val, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("field %d: unexpected wire type %d", num, typ)
+		}
+		if n < 0 {
+			t.Fatalf("field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		m[num] = append(m[num], val)
+	}
+	return m
+}
+
+func (m message) msgs(t *testing.T, num protowire.Number) []message {
+	t.Helper()
+	var ret []message
+	for _, v := range m[num] {
+		ret = append(ret, decode(t, v.([]byte)))
+	}
+	return ret
+}
+
+func (m message) str(num protowire.Number) string {
+	if len(m[num]) == 0 {
+		return ""
+	}
+	return string(m[num][0].([]byte))
+}
+
+func (m message) uint(num protowire.Number) uint64 {
+	if len(m[num]) == 0 {
+		return 0
+	}
+	return m[num][0].(uint64)
+}
+
+// attrs returns the attributes in field num of m as strings or int64s.
+func (m message) attrs(t *testing.T, num protowire.Number) map[string]any {
+	t.Helper()
+	ret := make(map[string]any)
+	for _, kv := range m.msgs(t, num) {
+		val := kv.msgs(t, otlpKeyValueValue)[0]
+		switch {
+		case len(val[otlpAnyValueString]) > 0:
+			ret[kv.str(otlpKeyValueKey)] = val.str(otlpAnyValueString)
+		case len(val[otlpAnyValueInt]) > 0:
+			ret[kv.str(otlpKeyValueKey)] = int64(val.uint(otlpAnyValueInt))
+		}
+	}
+	return ret
+}
+
+// decodeOTLP returns the spans of an ExportTraceServiceRequest by service name.
+func decodeOTLP(t *testing.T, b []byte) map[string][]message {
+	t.Helper()
+	ret := make(map[string][]message)
+	for _, rs := range decode(t, b).msgs(t, otlpRequestResourceSpans) {
+		service, _ := rs.msgs(t, otlpResourceSpansResource)[0].attrs(t, otlpResourceAttributes)["service.name"].(string)
+		for _, ss := range rs.msgs(t, otlpResourceSpansScopeSpans) {
+			if name := ss.msgs(t, otlpScopeSpansScope)[0].str(otlpScopeName); name != "subtrace" {
+				t.Errorf("got scope %q", name)
+			}
+			ret[service] = append(ret[service], ss.msgs(t, otlpScopeSpansSpans)...)
+		}
+	}
+	return ret
+}
+
+func testOTLPSpan() *Span {
+	s := testSpan()
+	s.Method, s.URL = "GET", "https://api.example.com:8443/v1/users"
+	s.Tags = map[string]string{"process_executable_name": "curl", "dest_addr": "93.184.216.34:8443"}
+	return s
+}
+
+func TestOTLPEncoding(t *testing.T) {
+	client := testOTLPSpan()
+	server := testSpan()
+	server.Kind = KindServer
+	server.ParentID = ID{}
+	server.StatusCode = 200
+	server.Local = Endpoint{}
+	server.Remote = Endpoint{Addr: netip.MustParseAddr("10.0.0.1"), Port: 51234}
+
+	services := decodeOTLP(t, toOTLP([]*Span{client, server, client}))
+	if len(services) != 2 || len(services["curl"]) != 2 || len(services[otlpUnknownService]) != 1 {
+		t.Fatalf("got services %v", services)
+	}
+
+	got := services["curl"][0]
+	if id := got.str(otlpSpanTraceID); id != string(client.TraceID[:]) {
+		t.Errorf("trace ID = %x", id)
+	}
+	if id := got.str(otlpSpanID); id != string(client.ID[:]) {
+		t.Errorf("span ID = %x", id)
+	}
+	if id := got.str(otlpSpanParentID); id != string(client.ParentID[:]) {
+		t.Errorf("parent ID = %x", id)
+	}
+	if got.str(otlpSpanName) != "GET /v1/users" || got.uint(otlpSpanKind) != otlpSpanKindClient {
+		t.Errorf("got name %q kind %d", got.str(otlpSpanName), got.uint(otlpSpanKind))
+	}
+	start, end := got.uint(otlpSpanStartTime), got.uint(otlpSpanEndTime)
+	if start != uint64(client.Start.UnixNano()) || time.Duration(end-start) != client.Duration {
+		t.Errorf("got start %d end %d", start, end)
+	}
+	attrs := got.attrs(t, otlpSpanAttributes)
+	for k, want := range map[string]any{
+		"http.method":             "GET",
+		"http.status_code":        int64(503),
+		"url.full":                "https://api.example.com:8443/v1/users",
+		"net.peer.addr":           "93.184.216.34:8443",
+		"process_executable_name": "curl",
+	} {
+		if attrs[k] != want {
+			t.Errorf("attribute %s = %v, want %v", k, attrs[k], want)
+		}
+	}
+	if code := got.msgs(t, otlpSpanStatus)[0].uint(otlpStatusCode); code != otlpStatusCodeError {
+		t.Errorf("got status code %d for a 503", code)
+	}
+
+	got = services[otlpUnknownService][0]
+	if got.uint(otlpSpanKind) != otlpSpanKindServer || len(got[otlpSpanParentID]) != 0 {
+		t.Errorf("got kind %d parent %v", got.uint(otlpSpanKind), got[otlpSpanParentID])
+	}
+	if addr := got.attrs(t, otlpSpanAttributes)["net.peer.addr"]; addr != "10.0.0.1" {
+		t.Errorf("net.peer.addr = %v", addr)
+	}
+	if code := got.msgs(t, otlpSpanStatus)[0].uint(otlpStatusCode); code != otlpStatusCodeUnset {
+		t.Errorf("got status code %d for a 200", code)
+	}
+}
+
+func TestOTLPExporterHTTP(t *testing.T) {
+	fastRetries(t)
+
+	var mu sync.Mutex
+	var calls, received int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if r.URL.Path != "/v1/traces" || r.Header.Get("content-type") != "application/x-protobuf" || r.Header.Get("api-key") != "secret value" {
+			t.Errorf("got %s with content-type %q api-key %q", r.URL.Path, r.Header.Get("content-type"), r.Header.Get("api-key"))
+		}
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		received += len(decodeOTLP(t, b)["curl"])
+	}))
+	defer srv.Close()
+
+	headers, err := ParseOTLPHeaders("api-key=secret%20value, ,")
+	if err != nil {
+		t.Fatalf("parse headers: %v", err)
+	}
+	e, err := NewOTLPExporter(srv.URL+"/", OTLPProtocolHTTP, headers)
+	if err != nil {
+		t.Fatalf("new exporter: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Loop(ctx)
+
+	for range 3 {
+		e.Export(testOTLPSpan())
+	}
+	if !e.Flush(5 * time.Second) {
+		t.Fatalf("flush timed out")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 || received != 3 {
+		t.Fatalf("got %d calls and %d spans, want 2 calls and 3 spans", calls, received)
+	}
+	if m := e.Metrics(); m["sent"] != 3 || m["failed"] != 0 {
+		t.Errorf("got metrics %v", m)
+	}
+}
+
+func TestOTLPExporterGRPC(t *testing.T) {
+	fastRetries(t)
+
+	var mu sync.Mutex
+	var statuses []string
+	var received int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.ProtoMajor != 2 || r.URL.Path != otlpGRPCMethod || r.Header.Get("content-type") != "application/grpc" {
+			t.Errorf("got %s %s with content-type %q", r.Proto, r.URL.Path, r.Header.Get("content-type"))
+		}
+		b, _ := io.ReadAll(r.Body)
+		if len(b) < 5 || b[0] != 0 || int(binary.BigEndian.Uint32(b[1:])) != len(b)-5 {
+			t.Errorf("got a badly framed message of %d bytes", len(b))
+			return
+		}
+
+		status := statuses[0]
+		statuses = statuses[1:]
+		if status == "0" {
+			received += len(decodeOTLP(t, b[5:])["curl"])
+		}
+		w.Header().Set("content-type", "application/grpc")
+		w.Header().Set(http.TrailerPrefix+"grpc-status", status)
+		w.Header().Set(http.TrailerPrefix+"grpc-message", "try%20again")
+		w.Write([]byte{0, 0, 0, 0, 0}) // empty ExportTraceServiceResponse
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	e, err := NewOTLPExporter(strings.TrimPrefix(srv.URL, "http://"), OTLPProtocolGRPC, nil)
+	if err != nil {
+		t.Fatalf("new exporter: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Loop(ctx)
+
+	// UNAVAILABLE is retried, INVALID_ARGUMENT isn't.
+	statuses = []string{"14", "0", "3"}
+	e.Export(testOTLPSpan())
+	if !e.Flush(5 * time.Second) {
+		t.Fatalf("flush timed out")
+	}
+	e.Export(testOTLPSpan())
+	if !e.Flush(5 * time.Second) {
+		t.Fatalf("flush timed out")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(statuses) != 0 || received != 1 {
+		t.Fatalf("got %d unused statuses and %d spans, want 0 and 1", len(statuses), received)
+	}
+	if m := e.Metrics(); m["sent"] != 1 || m["failed"] != 1 {
+		t.Errorf("got metrics %v", m)
+	}
+}
+
+func TestNewOTLPExporterErrors(t *testing.T) {
+	for _, tt := range []struct {
+		endpoint, protocol string
+	}{
+		{"ftp://localhost:4318", OTLPProtocolHTTP},
+		{"http://localhost:4318", "http/json"},
+	} {
+		if _, err := NewOTLPExporter(tt.endpoint, tt.protocol, nil); err == nil {
+			t.Errorf("%s %s: got no error", tt.endpoint, tt.protocol)
+		}
+	}
+	if _, err := ParseOTLPHeaders("novalue"); err == nil {
+		t.Errorf("got no error for a header without a value")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package span converts trace events into a common span model that tracing
+// backends (e.g. Zipkin) are exported to.
+package span
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"github.com/google/uuid"
+)
+
+type Kind int
+
+const (
+	// KindClient is a request made by the traced process.
+	KindClient Kind = iota
+	// KindServer is a request received by the traced process.
+	KindServer
+)
+
+type (
+	TraceID [16]byte
+	ID      [8]byte
+)
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id ID) String() string      { return hex.EncodeToString(id[:]) }
+func (id TraceID) IsZero() bool   { return id == TraceID{} }
+func (id ID) IsZero() bool        { return id == ID{} }
+
+// Endpoint is one side of a span. Any field may be unset.
+type Endpoint struct {
+	ServiceName string
+	Addr        netip.Addr
+	Port        uint16
+}
+
+// Span is a single HTTP exchange. Exporters translate it into their wire
+// format; they shouldn't need to look at the original event.
+type Span struct {
+	TraceID  TraceID
+	ID       ID
+	ParentID ID // zero for root spans
+
+	Kind     Kind
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+
+	// Local is the traced process and Remote is the host on the other end of
+	// the request, regardless of Kind.
+	Local  Endpoint
+	Remote Endpoint
+
+	Method     string
+	URL        string
+	StatusCode int
+	Tags       map[string]string
+}
+
+// Error reports whether the exchange failed.
+func (s *Span) Error() bool {
+	return s.StatusCode == 0 || s.StatusCode >= 500
+}
+
+// New returns the span for an event. tags are the event's tags and entry its
+// HAR entry. If the request carries a W3C traceparent or B3 trace context,
+// the span joins that trace as a child of the span that sent it. Otherwise,
+// it starts a new trace whose ID is derived from the event ID.
+func New(tags map[string]string, entry *har.Entry, outgoing bool) *Span {
+	s := &Span{
+		Kind:  KindServer,
+		Start: entry.StartedDateTime,
+		Tags:  tags,
+	}
+	if outgoing {
+		s.Kind = KindClient
+	}
+	s.Duration = time.Duration(entry.Time) * time.Millisecond
+	rand.Read(s.ID[:])
+
+	if entry.Response != nil {
+		s.StatusCode = entry.Response.Status
+	}
+
+	var headers []har.Header
+	if req := entry.Request; req != nil {
+		s.Method, s.URL = strings.ToUpper(req.Method), req.URL
+		s.Name = s.Method
+		headers = req.Headers
+		if u, err := url.Parse(req.URL); err == nil {
+			if u.Path != "" {
+				s.Name += " " + u.Path
+			}
+			s.Remote = endpointFromHost(u.Host)
+		}
+	}
+	if s.Remote.ServiceName == "" {
+		s.Remote = endpointFromHost(header(headers, "host"))
+	}
+	s.Local.ServiceName = tags["process_executable_name"]
+
+	if trace, parent, ok := parseTraceparent(header(headers, "traceparent")); ok {
+		s.TraceID, s.ParentID = trace, parent
+	} else if trace, parent, ok := parseB3(headers); ok {
+		s.TraceID, s.ParentID = trace, parent
+	} else if id, err := uuid.Parse(tags["event_id"]); err == nil {
+		s.TraceID = TraceID(id)
+	} else {
+		rand.Read(s.TraceID[:])
+	}
+	return s
+}
+
+func header(headers []har.Header, name string) string {
+	for _, hdr := range headers {
+		if strings.EqualFold(hdr.Name, name) {
+			return hdr.Value
+		}
+	}
+	return ""
+}
+
+func endpointFromHost(hostport string) Endpoint {
+	host, port := hostport, ""
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		host, port = h, p
+	}
+
+	var ep Endpoint
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		ep.Addr = addr.Unmap()
+	} else {
+		ep.ServiceName = strings.ToLower(host)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+		ep.Port = uint16(n)
+	}
+	return ep
+}
+
+// parseTraceparent parses a W3C traceparent header:
+//
+//	00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(val string) (TraceID, ID, bool) {
+	parts := strings.Split(strings.TrimSpace(val), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return TraceID{}, ID{}, false
+	}
+	trace, ok1 := decodeTraceID(parts[1])
+	parent, ok2 := decodeID(parts[2])
+	if !ok1 || !ok2 || trace.IsZero() || parent.IsZero() {
+		return TraceID{}, ID{}, false
+	}
+	return trace, parent, true
+}
+
+// parseB3 parses the trace context from either the single b3 header or the
+// multiple X-B3-* headers that Zipkin instrumentation sends.
+func parseB3(headers []har.Header) (TraceID, ID, bool) {
+	trace, span := header(headers, "x-b3-traceid"), header(headers, "x-b3-spanid")
+	if single := header(headers, "b3"); single != "" {
+		parts := strings.Split(single, "-")
+		if len(parts) < 2 {
+			return TraceID{}, ID{}, false
+		}
+		trace, span = parts[0], parts[1]
+	}
+	if len(trace) == 16 {
+		trace = strings.Repeat("0", 16) + trace // 64-bit trace IDs
+	}
+	t, ok1 := decodeTraceID(trace)
+	s, ok2 := decodeID(span)
+	if !ok1 || !ok2 || t.IsZero() || s.IsZero() {
+		return TraceID{}, ID{}, false
+	}
+	return t, s, true
+}
+
+func decodeTraceID(val string) (TraceID, bool) {
+	var id TraceID
+	if len(val) != 2*len(id) {
+		return id, false
+	}
+	_, err := hex.Decode(id[:], []byte(val))
+	return id, err == nil
+}
+
+func decodeID(val string) (ID, bool) {
+	var id ID
+	if len(val) != 2*len(id) {
+		return id, false
+	}
+	_, err := hex.Decode(id[:], []byte(val))
+	return id, err == nil
+}
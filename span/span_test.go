@@ -0,0 +1,97 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package span
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/har"
+)
+
+func testEntry(headers ...har.Header) *har.Entry {
+	return &har.Entry{
+		StartedDateTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Time:            42,
+		Request: &har.Request{
+			Method:  "get",
+			URL:     "https://api.example.com:8443/v1/users",
+			Headers: headers,
+		},
+		Response: &har.Response{Status: 200},
+	}
+}
+
+func TestNewTraceparent(t *testing.T) {
+	entry := testEntry(har.Header{Name: "Traceparent", Value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"})
+	s := New(map[string]string{"process_executable_name": "curl"}, entry, true)
+
+	if got := s.TraceID.String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s", got)
+	}
+	if got := s.ParentID.String(); got != "00f067aa0ba902b7" {
+		t.Errorf("parent ID = %s", got)
+	}
+	if s.ID.IsZero() || s.ID == s.ParentID {
+		t.Errorf("span ID = %s, want a new non-zero ID", s.ID)
+	}
+	if s.Kind != KindClient || s.Name != "GET /v1/users" || s.Duration != 42*time.Millisecond {
+		t.Errorf("got kind %d name %q duration %v", s.Kind, s.Name, s.Duration)
+	}
+	if s.Method != "GET" || s.URL != "https://api.example.com:8443/v1/users" {
+		t.Errorf("got method %q URL %q", s.Method, s.URL)
+	}
+	if s.Local.ServiceName != "curl" {
+		t.Errorf("local service = %q, want curl", s.Local.ServiceName)
+	}
+	if s.Remote.ServiceName != "api.example.com" || s.Remote.Port != 8443 {
+		t.Errorf("remote = %+v, want api.example.com:8443", s.Remote)
+	}
+}
+
+func TestNewB3(t *testing.T) {
+	s := New(nil, testEntry(
+		har.Header{Name: "X-B3-TraceId", Value: "463ac35c9f6413ad"},
+		har.Header{Name: "X-B3-SpanId", Value: "a2fb4a1d1a96d312"},
+	), false)
+	if got := s.TraceID.String(); got != "0000000000000000463ac35c9f6413ad" {
+		t.Errorf("trace ID = %s", got)
+	}
+	if got := s.ParentID.String(); got != "a2fb4a1d1a96d312" {
+		t.Errorf("parent ID = %s", got)
+	}
+	if s.Kind != KindServer {
+		t.Errorf("kind = %d, want server", s.Kind)
+	}
+}
+
+func TestNewRoot(t *testing.T) {
+	tags := map[string]string{"event_id": "7c9e6679-7425-40de-944b-e07fc1f90ae7"}
+	for _, val := range []string{"", "garbage", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"} {
+		s := New(tags, testEntry(har.Header{Name: "traceparent", Value: val}), true)
+		if got := s.TraceID.String(); got != "7c9e6679742540de944be07fc1f90ae7" {
+			t.Errorf("traceparent %q: trace ID = %s, want one derived from the event ID", val, got)
+		}
+		if !s.ParentID.IsZero() {
+			t.Errorf("traceparent %q: parent ID = %s, want root span", val, s.ParentID)
+		}
+	}
+}
+
+func TestEndpointFromHost(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want Endpoint
+	}{
+		{"example.com", Endpoint{ServiceName: "example.com"}},
+		{"Example.com:80", Endpoint{ServiceName: "example.com", Port: 80}},
+		{"10.0.0.1:5432", Endpoint{Addr: netip.MustParseAddr("10.0.0.1"), Port: 5432}},
+		{"[::1]:8080", Endpoint{Addr: netip.MustParseAddr("::1"), Port: 8080}},
+	} {
+		if got := endpointFromHost(tt.in); got != tt.want {
+			t.Errorf("endpointFromHost(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package span
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"subtrace.dev/rpc"
+)
+
+// ZipkinExporter sends spans to a Zipkin v2 collector (or anything that speaks
+// its JSON API, such as Jaeger with the Zipkin collector enabled).
+type ZipkinExporter struct {
+	*batcher
+	endpoint string
+	client   *http.Client
+}
+
+// NewZipkinExporter returns an exporter that POSTs spans to endpoint, which
+// is usually http://host:9411/api/v2/spans. Loop must be running for spans to
+// be sent.
+func NewZipkinExporter(endpoint string) *ZipkinExporter {
+	e := &ZipkinExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	e.batcher = newBatcher("zipkin", e.send)
+	return e
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+	Port        uint16 `json:"port,omitempty"`
+}
+
+type zipkinSpan struct {
+	TraceID        string            `json:"traceId"`
+	ID             string            `json:"id"`
+	ParentID       string            `json:"parentId,omitempty"`
+	Kind           string            `json:"kind"`
+	Name           string            `json:"name"`
+	Timestamp      int64             `json:"timestamp"`
+	Duration       int64             `json:"duration"`
+	LocalEndpoint  *zipkinEndpoint   `json:"localEndpoint,omitempty"`
+	RemoteEndpoint *zipkinEndpoint   `json:"remoteEndpoint,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+func toZipkinEndpoint(ep Endpoint) *zipkinEndpoint {
+	ret := &zipkinEndpoint{ServiceName: ep.ServiceName, Port: ep.Port}
+	switch {
+	case ep.Addr.Is4():
+		ret.IPv4 = ep.Addr.String()
+	case ep.Addr.Is6():
+		ret.IPv6 = ep.Addr.String()
+	}
+	if *ret == (zipkinEndpoint{}) {
+		return nil
+	}
+	return ret
+}
+
+func toZipkin(s *Span) zipkinSpan {
+	ret := zipkinSpan{
+		TraceID:   s.TraceID.String(),
+		ID:        s.ID.String(),
+		Kind:      "SERVER",
+		Name:      s.Name,
+		Timestamp: s.Start.UnixMicro(),
+		// Zipkin treats a zero duration as unset.
+		Duration:       max(1, s.Duration.Microseconds()),
+		LocalEndpoint:  toZipkinEndpoint(s.Local),
+		RemoteEndpoint: toZipkinEndpoint(s.Remote),
+		Tags:           make(map[string]string, len(s.Tags)+2),
+	}
+	if s.Kind == KindClient {
+		ret.Kind = "CLIENT"
+	}
+	if !s.ParentID.IsZero() {
+		ret.ParentID = s.ParentID.String()
+	}
+
+	for k, v := range s.Tags {
+		ret.Tags[k] = v
+	}
+	if s.StatusCode != 0 {
+		ret.Tags["http.status_code"] = strconv.Itoa(s.StatusCode)
+	}
+	if s.Error() {
+		ret.Tags["error"] = "true"
+	}
+	return ret
+}
+
+func (e *ZipkinExporter) send(ctx context.Context, batch []*Span) error {
+	spans := make([]zipkinSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = toZipkin(s)
+	}
+	b, err := json.Marshal(spans)
+	if err != nil {
+		return &permanentError{fmt.Errorf("marshal: %w", err)}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return &permanentError{fmt.Errorf("new request: %w", err)}
+	}
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return nil
+	case code == http.StatusTooManyRequests || code >= 500:
+		return &rpc.StatusError{Code: code, Status: resp.Status, RetryAfter: rpc.RetryAfter(resp.Header, time.Now())}
+	default:
+		return &permanentError{fmt.Errorf("collector returned %s", resp.Status)}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package span
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func testSpan() *Span {
+	s := &Span{
+		Kind:       KindClient,
+		Name:       "GET /v1/users",
+		Start:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:   42 * time.Millisecond,
+		Local:      Endpoint{ServiceName: "curl"},
+		Remote:     Endpoint{ServiceName: "api.example.com", Port: 8443},
+		StatusCode: 503,
+		Tags:       map[string]string{"process_executable_name": "curl", "hostname": "box"},
+	}
+	s.TraceID, _ = decodeTraceID("4bf92f3577b34da6a3ce929d0e0e4736")
+	s.ParentID, _ = decodeID("00f067aa0ba902b7")
+	s.ID, _ = decodeID("b7ad6b7169203331")
+	return s
+}
+
+func TestZipkinGolden(t *testing.T) {
+	server := testSpan()
+	server.Kind = KindServer
+	server.ParentID = ID{}
+	server.StatusCode = 200
+	server.Duration = 0
+	server.Remote = Endpoint{Addr: netip.MustParseAddr("10.0.0.1"), Port: 51234}
+
+	got, err := json.MarshalIndent([]zipkinSpan{toZipkin(testSpan()), toZipkin(server)}, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	path := filepath.Join("testdata", "zipkin.json")
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("zipkin JSON doesn't match %s (run with -update to regenerate):\n%s", path, got)
+	}
+}
+
+func fastRetries(t *testing.T) {
+	base, interval := retryBase, batchInterval
+	retryBase, batchInterval = time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { retryBase, batchInterval = base, interval })
+}
+
+func TestZipkinExporterRetry(t *testing.T) {
+	fastRetries(t)
+
+	var mu sync.Mutex
+	var calls int
+	var received []zipkinSpan
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []zipkinSpan
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		received = append(received, batch...)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	e := NewZipkinExporter(srv.URL + "/api/v2/spans")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Loop(ctx)
+
+	for range 3 {
+		e.Export(testSpan())
+	}
+	if !e.Flush(5 * time.Second) {
+		t.Fatalf("flush timed out")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 || len(received) != 3 {
+		t.Fatalf("got %d calls and %d spans, want 2 calls and 3 spans", calls, len(received))
+	}
+}
+
+func TestZipkinExporterPermanentError(t *testing.T) {
+	fastRetries(t)
+
+	var mu sync.Mutex
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	e := NewZipkinExporter(srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Loop(ctx)
+
+	e.Export(testSpan())
+	if !e.Flush(5 * time.Second) {
+		t.Fatalf("flush timed out")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Fatalf("got %d calls, want no retries after 400", calls)
+	}
+}
+
+// TestZipkinCollector sends a span to a real Zipkin collector and reads it
+// back. Set SUBTRACE_TEST_ZIPKIN to its base URL to run it, e.g.:
+//
+//	docker run -d -p 9411:9411 openzipkin/zipkin
+//	SUBTRACE_TEST_ZIPKIN=http://localhost:9411 go test ./span -run Collector
+func TestZipkinCollector(t *testing.T) {
+	base := os.Getenv("SUBTRACE_TEST_ZIPKIN")
+	if base == "" {
+		t.Skip("SUBTRACE_TEST_ZIPKIN not set")
+	}
+
+	s := testSpan()
+	s.Start = time.Now().Add(-time.Second)
+	e := NewZipkinExporter(base + "/api/v2/spans")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Loop(ctx)
+	e.Export(s)
+	if !e.Flush(10 * time.Second) {
+		t.Fatalf("flush timed out")
+	}
+
+	// Zipkin stores spans asynchronously.
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(200 * time.Millisecond) {
+		resp, err := http.Get(fmt.Sprintf("%s/api/v2/trace/%s", base, s.TraceID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		var got []zipkinSpan
+		if resp.StatusCode == http.StatusOK && json.Unmarshal(b, &got) == nil && len(got) == 1 {
+			if got[0].ID != s.ID.String() || got[0].RemoteEndpoint == nil || got[0].RemoteEndpoint.ServiceName != "api.example.com" {
+				t.Fatalf("got span %+v", got[0])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("span not found in zipkin: %d %s", resp.StatusCode, b)
+		}
+	}
+}
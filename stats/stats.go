@@ -9,6 +9,14 @@ import (
 func Loop(ctx context.Context) {
 }
 
+func EphemeralPortRange() (lo int, hi int, ok bool) {
+	return 0, 0, false
+}
+
+func EphemeralPortsInUse() (inUse int, size int, ok bool) {
+	return 0, 0, false
+}
+
 func Load() map[string]string {
 	return map[string]string{}
 }
@@ -5,14 +5,27 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"subtrace.dev/procfs"
 )
 
+// maxAge is how stale the stats returned by Load may be. They're refreshed
+// lazily when an event asks for them so that an idle tracer never wakes up
+// just to read /proc.
+const maxAge = time.Second
+
 var mu sync.RWMutex
 var data = make(map[string]string)
+var updated time.Time
+var refreshing atomic.Bool
 
+// Loop primes the stats so that the first event doesn't pay for reading
+// /proc. Later refreshes happen in Load.
 func Loop(ctx context.Context) {
 	select {
 	case <-ctx.Done():
@@ -20,18 +33,6 @@ func Loop(ctx context.Context) {
 	default:
 		tick()
 	}
-
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			tick()
-		}
-	}
 }
 
 func tick() {
@@ -39,13 +40,33 @@ func tick() {
 
 	m["subtrace_linux_cpu_count"] = fmt.Sprintf("%d", runtime.NumCPU())
 
-	if b, err := os.ReadFile("/proc/loadavg"); err == nil {
+	if !procfs.Has(procfs.FeatureStats) {
+		m["subtrace_linux_cpu_load"] = procfs.Unavailable
+		m["subtrace_linux_mem_total"] = procfs.Unavailable
+		m["subtrace_linux_mem_available"] = procfs.Unavailable
+	} else {
+		readProcStats(m)
+	}
+	if inUse, size, ok := EphemeralPortsInUse(); ok {
+		m["subtrace_linux_ephemeral_ports_in_use"] = fmt.Sprintf("%d/%d", inUse, size)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for k, v := range m {
+		data[k] = v
+	}
+	updated = time.Now()
+}
+
+func readProcStats(m map[string]string) {
+	if b, err := os.ReadFile(procfs.Path("loadavg")); err == nil {
 		if fields := strings.Split(string(b), " "); len(fields) >= 3 {
 			m["subtrace_linux_cpu_load"] = strings.Join(fields[0:3], " ")
 		}
 	}
 
-	if b, err := os.ReadFile("/proc/meminfo"); err == nil {
+	if b, err := os.ReadFile(procfs.Path("meminfo")); err == nil {
 		for _, line := range strings.Split(string(b), "\n") {
 			if fields := strings.Fields(line); len(fields) >= 2 {
 				val := strings.Join(fields[1:], " ")
@@ -58,15 +79,79 @@ func tick() {
 			}
 		}
 	}
+}
 
-	mu.Lock()
-	defer mu.Unlock()
-	for k, v := range m {
-		data[k] = v
+// EphemeralPortRange returns the range of local ports that the kernel picks
+// from for sockets that aren't bound to one (net.ipv4.ip_local_port_range).
+func EphemeralPortRange() (lo int, hi int, ok bool) {
+	if !procfs.Has(procfs.FeatureSysctls) {
+		return 0, 0, false
+	}
+	b, err := os.ReadFile(procfs.Path("sys/net/ipv4/ip_local_port_range"))
+	if err != nil {
+		return 0, 0, false
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return 0, 0, false
 	}
+	lo, err1 := strconv.Atoi(fields[0])
+	hi, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || lo > hi {
+		return 0, 0, false
+	}
+	return lo, hi, true
+}
+
+// EphemeralPortsInUse estimates how many ephemeral ports are taken by counting
+// the TCP sockets (including ones in TIME_WAIT) whose local port is in the
+// ephemeral range. The kernel can reuse a port for connections to different
+// destinations, so this is an upper bound on the pressure for any single
+// destination. size is the number of ports in the range.
+func EphemeralPortsInUse() (inUse int, size int, ok bool) {
+	lo, hi, ok := EphemeralPortRange()
+	if !ok {
+		return 0, 0, false
+	}
+
+	ports := make(map[int]struct{})
+	read := false
+	for _, name := range []string{"tcp", "tcp6"} {
+		b, err := os.ReadFile(procfs.Path("net/%s", name))
+		if err != nil {
+			continue
+		}
+		read = true
+		for i, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if i == 0 || len(fields) < 4 || fields[3] == "0A" { // header or TCP_LISTEN
+				continue
+			}
+			_, hexPort, found := strings.Cut(fields[1], ":")
+			if !found {
+				continue
+			}
+			port, err := strconv.ParseInt(hexPort, 16, 32)
+			if err == nil && int(port) >= lo && int(port) <= hi {
+				ports[int(port)] = struct{}{}
+			}
+		}
+	}
+	if !read {
+		return 0, 0, false
+	}
+	return len(ports), hi - lo + 1, true
 }
 
 func Load() map[string]string {
+	mu.RLock()
+	stale := time.Since(updated) > maxAge
+	mu.RUnlock()
+	if stale && refreshing.CompareAndSwap(false, true) {
+		tick()
+		refreshing.Store(false)
+	}
+
 	mu.RLock()
 	defer mu.RUnlock()
 
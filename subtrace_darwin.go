@@ -5,6 +5,7 @@ package main
 
 import (
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"subtrace.dev/cmd/config"
 	"subtrace.dev/cmd/proxy"
 	"subtrace.dev/cmd/tail"
 	"subtrace.dev/cmd/version"
@@ -14,6 +15,7 @@ import (
 var subcommands = []*ffcli.Command{
 	proxy.NewCommand(),
 	tail.NewCommand(),
+	config.NewCommand(),
 	worker.NewCommand(),
 	version.NewCommand(),
 }
@@ -5,16 +5,25 @@ package main
 
 import (
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"subtrace.dev/cmd/config"
+	"subtrace.dev/cmd/doctor"
 	"subtrace.dev/cmd/proxy"
 	"subtrace.dev/cmd/run"
+	"subtrace.dev/cmd/spool"
 	"subtrace.dev/cmd/tail"
+	"subtrace.dev/cmd/test"
 	"subtrace.dev/cmd/version"
 	"subtrace.dev/cmd/worker"
 )
 
 var subcommands = []*ffcli.Command{run.NewCommand(),
+	run.NewAttachCommand(),
 	proxy.NewCommand(),
+	test.NewCommand(),
 	tail.NewCommand(),
+	spool.NewFlushCommand(),
+	config.NewCommand(),
+	doctor.NewCommand(),
 	worker.NewCommand(),
 	version.NewCommand(),
 }
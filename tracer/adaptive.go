@@ -0,0 +1,285 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"fmt"
+	"net/url"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"subtrace.dev/event"
+)
+
+// PayloadMode decides which exchanges keep their request and response bodies:
+// "always", "never", or "adaptive" to buffer them until the exchange finishes
+// and keep them only if it turns out to be anomalous (see anomaly). Adaptive is
+// the recommended mode in production.
+var PayloadMode = "always"
+
+// PayloadBudgetBytes bounds the memory held by bodies buffered in adaptive mode
+// until their exchange finishes. Exchanges that start while the budget is
+// exhausted are captured without bodies.
+var PayloadBudgetBytes int64 = 64 << 20
+
+// ValidPayloadMode reports whether mode is a valid PayloadMode.
+func ValidPayloadMode(mode string) bool {
+	switch mode {
+	case "always", "never", "adaptive":
+		return true
+	}
+	return false
+}
+
+// Why an exchange kept its payloads in adaptive mode, as set in the
+// payload_kept_reason tag.
+const (
+	KeptStatus     = "status"     // the response wasn't 2xx
+	KeptLatency    = "latency"    // much slower than usual for the route
+	KeptIncomplete = "incomplete" // a body was cut short or there was no response
+	KeptRule       = "rule"       // matched a payloads.keep rule in the config
+)
+
+// payloadBudget is the part of PayloadBudgetBytes held by body buffers.
+var payloadBudget atomic.Int64
+
+// payloadReservation is memory reserved against PayloadBudgetBytes for one
+// body buffer.
+type payloadReservation struct {
+	n        int64
+	released atomic.Bool
+}
+
+// reservePayload reserves n bytes of the budget, or returns nil if they aren't
+// available.
+func reservePayload(n int64) *payloadReservation {
+	for {
+		held := payloadBudget.Load()
+		if held+n > PayloadBudgetBytes {
+			return nil
+		}
+		if payloadBudget.CompareAndSwap(held, held+n) {
+			return &payloadReservation{n: n}
+		}
+	}
+}
+
+// release returns the reservation to the budget. It's safe to call more than
+// once.
+func (r *payloadReservation) release() {
+	if r.released.CompareAndSwap(false, true) {
+		payloadBudget.Add(-r.n)
+	}
+}
+
+const (
+	baselineWindow     = 128  // latencies kept per route
+	baselineMinSamples = 20   // latencies needed before a route has a baseline
+	baselineFactor     = 3    // how many times the p95 counts as anomalous
+	maxBaselineRoutes  = 4096 // routes tracked; later ones never have a baseline
+)
+
+// routeLatencies is a ring of the most recent latencies of a route.
+type routeLatencies struct {
+	mu      sync.Mutex
+	samples [baselineWindow]int64
+	n       int
+	next    int
+}
+
+var baselines struct {
+	mu     sync.Mutex
+	routes map[string]*routeLatencies
+}
+
+// observeLatency records the latency of an exchange on a route and reports
+// whether it was more than baselineFactor times the route's p95 latency before
+// it, along with that p95.
+func observeLatency(route string, ms int64) (bool, int64) {
+	baselines.mu.Lock()
+	if baselines.routes == nil {
+		baselines.routes = make(map[string]*routeLatencies)
+	}
+	r, ok := baselines.routes[route]
+	if !ok && len(baselines.routes) < maxBaselineRoutes {
+		r = new(routeLatencies)
+		baselines.routes[route] = r
+	}
+	baselines.mu.Unlock()
+	if r == nil {
+		return false, 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var p95 int64
+	if r.n >= baselineMinSamples {
+		sorted := slices.Clone(r.samples[:r.n])
+		slices.Sort(sorted)
+		p95 = sorted[(len(sorted)*95)/100]
+	}
+
+	r.samples[r.next] = ms
+	r.next = (r.next + 1) % baselineWindow
+	r.n = min(r.n+1, baselineWindow)
+
+	return p95 > 0 && ms > baselineFactor*p95, p95
+}
+
+// routeOf returns the route of a request for latency baselines: the method,
+// host and path with segments that look like IDs replaced, so that
+// /users/42 and /users/43 share a baseline.
+func routeOf(method string, host string, rawURL string) string {
+	path := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		path = u.Path
+		if u.Host != "" {
+			host = u.Host
+		}
+	}
+
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if isIDSegment(s) {
+			segments[i] = ":id"
+		}
+	}
+	return method + " " + host + strings.Join(segments, "/")
+}
+
+func isIDSegment(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits, hex := true, true
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+		case (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') || c == '-':
+			digits = false
+		default:
+			return false
+		}
+	}
+	return digits || (hex && len(s) >= 16)
+}
+
+// anomaly returns why an exchange should keep its payloads in adaptive mode,
+// or "" if it looks normal. It records the exchange's latency on its route
+// either way.
+func (p *Parser) anomaly(entry *extendedHarEntry, host string) string {
+	var reason string
+	switch {
+	case p.response == nil || p.requestBody.truncated || p.responseBody.truncated:
+		reason = KeptIncomplete
+	case p.response.Status < 200 || p.response.Status >= 300:
+		reason = KeptStatus
+	}
+
+	if p.request != nil && p.response != nil {
+		slow, p95 := observeLatency(routeOf(p.request.Method, host, p.request.URL), entry.Time)
+		if slow && reason == "" {
+			reason = KeptLatency
+			p.event.Set("payload_latency_baseline_ms", fmt.Sprintf("%d", p95))
+		}
+	}
+
+	if reason == "" {
+		tags := p.global.Config.GetEventTemplate()
+		tags.CopyFrom(p.event)
+		if p.global.Config.KeepsPayload(tags.View(), entry.Entry) {
+			reason = KeptRule
+		}
+		event.Release(tags)
+	}
+	return reason
+}
+
+// payloadLimit returns how many bytes of a body to buffer. In adaptive mode,
+// the buffer is reserved against PayloadBudgetBytes until the parser is done
+// with it, and nothing is buffered if the budget is exhausted. In never mode,
+// nothing is buffered.
+func (p *Parser) payloadLimit() int64 {
+	switch {
+	case PayloadMode == "never":
+		return 0
+	case PayloadMode != "adaptive" || PayloadLimitBytes <= 0:
+		return PayloadLimitBytes
+	}
+
+	r := reservePayload(PayloadLimitBytes)
+	if r == nil {
+		p.budgetExhausted.Store(true)
+		return 0
+	}
+
+	// Finish releases the reservation, but it's not called if the exchange
+	// fails halfway, so the cleanup makes sure the budget doesn't leak.
+	runtime.AddCleanup(p, (*payloadReservation).release, r)
+
+	p.reservedMu.Lock()
+	p.reserved = append(p.reserved, r)
+	p.reservedMu.Unlock()
+	return PayloadLimitBytes
+}
+
+// releasePayloads returns the body buffers reserved by payloadLimit to the
+// budget.
+func (p *Parser) releasePayloads() {
+	p.reservedMu.Lock()
+	defer p.reservedMu.Unlock()
+	for _, r := range p.reserved {
+		r.release()
+	}
+	p.reserved = nil
+}
+
+// applyPayloadMode drops the bodies of the exchange unless PayloadMode keeps
+// them and records why. It reports whether the bodies were dropped.
+func (p *Parser) applyPayloadMode(entry *extendedHarEntry, host string) bool {
+	hasPayload := p.requestBody.actual > 0 || p.responseBody.actual > 0 || len(p.websocketMessages) > 0
+	if p.budgetExhausted.Load() && hasPayload {
+		AddDecision(p.event, Decision{Layer: "payload", Verdict: "dropped", Reason: ReasonPayloadBudget, Detail: fmt.Sprintf("budget is %d bytes", PayloadBudgetBytes)}, CaptureMetadata)
+	}
+
+	switch PayloadMode {
+	case "never":
+		if hasPayload {
+			AddDecision(p.event, Decision{Layer: "payload", Verdict: "dropped", Reason: ReasonPayloadNever}, CaptureMetadata)
+		}
+		p.dropPayloads()
+		return true
+
+	case "adaptive":
+		if reason := p.anomaly(entry, host); reason != "" {
+			p.event.Set("payload_kept_reason", reason)
+			return false
+		}
+		if hasPayload {
+			AddDecision(p.event, Decision{Layer: "payload", Verdict: "dropped", Reason: ReasonPayloadAdaptive, Detail: "the exchange looked normal"}, CaptureMetadata)
+		}
+		p.dropPayloads()
+		return true
+	}
+	return false
+}
+
+// dropPayloads removes every request, response and websocket message body.
+// Their sizes are still in the body tags and the HAR sizes.
+func (p *Parser) dropPayloads() {
+	if p.request != nil && p.request.PostData != nil {
+		p.request.PostData.Text = ""
+		p.request.PostData.Params = nil
+	}
+	if p.response != nil && p.response.Content != nil {
+		p.response.Content.Text = nil
+	}
+	for _, msg := range p.websocketMessages {
+		msg.Data = ""
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"testing"
+)
+
+func TestRouteOf(t *testing.T) {
+	for url, want := range map[string]string{
+		"http://api/users/42/orders":                            "GET api/users/:id/orders",
+		"/users/43/orders?page=2":                               "GET example.com/users/:id/orders",
+		"http://api/items/3f2b8c1e-5a4d-4e7b-9c0a-1b2c3d4e5f60": "GET api/items/:id",
+		"http://api/v2/deadbeef":                                "GET api/v2/deadbeef",
+	} {
+		if got := routeOf("GET", "example.com", url); got != want {
+			t.Errorf("%s: got route %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestObserveLatency(t *testing.T) {
+	const route = "GET test/observe"
+	for i := range baselineMinSamples {
+		if slow, _ := observeLatency(route, int64(10+i%3)); slow {
+			t.Fatalf("sample %d: got slow before the route has a baseline", i)
+		}
+	}
+	if slow, p95 := observeLatency(route, 30); slow || p95 != 12 {
+		t.Errorf("got slow=%v p95=%d for 30ms, want slow=false p95=12", slow, p95)
+	}
+	if slow, _ := observeLatency(route, 100); !slow {
+		t.Errorf("got slow=false for 100ms, want slow=true")
+	}
+}
+
+func TestReservePayload(t *testing.T) {
+	defer func(prev int64) { PayloadBudgetBytes = prev }(PayloadBudgetBytes)
+	PayloadBudgetBytes = payloadBudget.Load() + 100
+
+	a := reservePayload(60)
+	if a == nil {
+		t.Fatalf("got no reservation within the budget")
+	}
+	if b := reservePayload(60); b != nil {
+		t.Fatalf("got a reservation beyond the budget")
+	}
+	a.release()
+	a.release()
+	b := reservePayload(100)
+	if b == nil {
+		t.Fatalf("got no reservation after releasing, want the budget back exactly once")
+	}
+	b.release()
+}
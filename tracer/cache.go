@@ -0,0 +1,359 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/event"
+	"subtrace.dev/internal/units"
+)
+
+// How an exchange used the HTTP cache, as set in the http_cache_status tag.
+const (
+	// cacheFresh is a full response that may be cached.
+	cacheFresh = "fresh"
+	// cacheRevalidated is a 304 Not Modified response to a conditional request.
+	cacheRevalidated = "revalidated"
+	// cacheRevalidationMissed is a full response carrying the same validator
+	// as a response already seen for the URL (or as the one the request sent),
+	// so a conditional request answered with 304 would have sufficed.
+	cacheRevalidationMissed = "revalidation_missed"
+	// cacheUncacheable is a response that can't be stored or revalidated.
+	cacheUncacheable = "uncacheable"
+)
+
+const (
+	// maxCacheHosts bounds the number of hosts tracked individually, like
+	// maxBandwidthHosts in the socket package.
+	maxCacheHosts = 1024
+
+	// maxCacheValidators bounds the number of URLs whose last validator is
+	// remembered to detect missed revalidations.
+	maxCacheValidators = 4096
+
+	// cacheOtherHost is the host that exchanges are attributed to when a host
+	// isn't tracked individually.
+	cacheOtherHost = "other"
+)
+
+// cacheTags maps the request and response headers relevant to caching to the
+// tags they're recorded as.
+var cacheTags = struct{ request, response map[string]string }{
+	request: map[string]string{
+		"cache-control":     "http_req_cache_control",
+		"if-none-match":     "http_req_if_none_match",
+		"if-modified-since": "http_req_if_modified_since",
+	},
+	response: map[string]string{
+		"cache-control": "http_resp_cache_control",
+		"etag":          "http_resp_etag",
+		"last-modified": "http_resp_last_modified",
+		"age":           "http_resp_age",
+	},
+}
+
+// HostCache is how effectively requests to a host used the HTTP cache.
+// MissedBytes is the number of response body bytes that were transferred in
+// revalidation_missed exchanges, i.e. what correct revalidation would have
+// saved.
+type HostCache struct {
+	Host               string `json:"host"`
+	Fresh              uint64 `json:"fresh"`
+	Revalidated        uint64 `json:"revalidated"`
+	RevalidationMissed uint64 `json:"revalidationMissed"`
+	Uncacheable        uint64 `json:"uncacheable"`
+	MissedBytes        uint64 `json:"missedBytes"`
+}
+
+func (c *HostCache) add(o HostCache) {
+	c.Fresh += o.Fresh
+	c.Revalidated += o.Revalidated
+	c.RevalidationMissed += o.RevalidationMissed
+	c.Uncacheable += o.Uncacheable
+	c.MissedBytes += o.MissedBytes
+}
+
+// Exchanges returns the number of exchanges with the host.
+func (c HostCache) Exchanges() uint64 {
+	return c.Fresh + c.Revalidated + c.RevalidationMissed + c.Uncacheable
+}
+
+// cacheValidator is the validator a response was sent with.
+type cacheValidator struct {
+	etag         string
+	lastModified string
+}
+
+func (v cacheValidator) isZero() bool {
+	return v == cacheValidator{}
+}
+
+var cache = struct {
+	mu         sync.Mutex
+	hosts      map[string]*HostCache
+	validators map[string]cacheValidator
+}{
+	hosts:      make(map[string]*HostCache),
+	validators: make(map[string]cacheValidator),
+}
+
+func header(headers []har.Header, name string) string {
+	for _, hdr := range headers {
+		if strings.EqualFold(hdr.Name, name) {
+			return hdr.Value
+		}
+	}
+	return ""
+}
+
+// hasDirective reports whether a Cache-Control header value contains the given
+// directive, with or without an argument.
+func hasDirective(cacheControl string, directive string) bool {
+	for _, d := range strings.Split(cacheControl, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if strings.EqualFold(name, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// heuristicallyCacheable reports whether responses with the status code may be
+// cached without explicit freshness information (RFC 9110, section 15.1).
+func heuristicallyCacheable(status int) bool {
+	switch status {
+	case 200, 203, 204, 206, 300, 301, 308, 404, 405, 410, 414, 501:
+		return true
+	}
+	return false
+}
+
+// etagMatches reports whether an If-None-Match header value lists the ETag,
+// using the weak comparison that If-None-Match requires.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyCache returns how the exchange used the HTTP cache. prev is the
+// validator last seen for the same URL, if any.
+func classifyCache(req *har.Request, resp *har.Response, prev cacheValidator) string {
+	if method := strings.ToUpper(req.Method); method != "GET" && method != "HEAD" {
+		return cacheUncacheable
+	}
+	if resp.Status == http.StatusNotModified {
+		return cacheRevalidated
+	}
+
+	cc := header(resp.Headers, "cache-control")
+	if hasDirective(cc, "no-store") || !heuristicallyCacheable(resp.Status) {
+		return cacheUncacheable
+	}
+
+	cur := cacheValidator{etag: header(resp.Headers, "etag"), lastModified: header(resp.Headers, "last-modified")}
+	if cur.isZero() {
+		if hasDirective(cc, "max-age") || hasDirective(cc, "s-maxage") || header(resp.Headers, "expires") != "" {
+			return cacheFresh
+		}
+		return cacheUncacheable
+	}
+
+	// The server sent the whole body even though the request could have been
+	// (or was) answered with 304 Not Modified.
+	if etagMatches(header(req.Headers, "if-none-match"), cur.etag) {
+		return cacheRevalidationMissed
+	}
+	if cur.lastModified != "" && header(req.Headers, "if-modified-since") == cur.lastModified {
+		return cacheRevalidationMissed
+	}
+	if !prev.isZero() && resp.Status == http.StatusOK {
+		if (cur.etag != "" && cur.etag == prev.etag) || (cur.etag == "" && cur.lastModified == prev.lastModified) {
+			return cacheRevalidationMissed
+		}
+	}
+	return cacheFresh
+}
+
+// setCacheTags records the caching headers of the exchange as tags, classifies
+// how it used the HTTP cache and adds it to the per-host summary.
+func (p *Parser) setCacheTags(tags *event.Event, host string) {
+	if p.request == nil || p.response == nil {
+		return
+	}
+
+	for _, hdr := range p.request.Headers {
+		if tag, ok := cacheTags.request[strings.ToLower(hdr.Name)]; ok && hdr.Value != "" {
+			tags.Set(tag, hdr.Value)
+		}
+	}
+	for _, hdr := range p.response.Headers {
+		if tag, ok := cacheTags.response[strings.ToLower(hdr.Name)]; ok && hdr.Value != "" {
+			tags.Set(tag, hdr.Value)
+		}
+	}
+
+	key := host + " " + p.request.URL
+	cur := cacheValidator{etag: header(p.response.Headers, "etag"), lastModified: header(p.response.Headers, "last-modified")}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	class := classifyCache(p.request, p.response, cache.validators[key])
+	tags.Set("http_cache_status", class)
+
+	if !cur.isZero() && class != cacheUncacheable {
+		if _, ok := cache.validators[key]; !ok && len(cache.validators) >= maxCacheValidators {
+			for k := range cache.validators {
+				delete(cache.validators, k)
+				break
+			}
+		}
+		cache.validators[key] = cur
+	}
+
+	var c HostCache
+	switch class {
+	case cacheFresh:
+		c.Fresh = 1
+	case cacheRevalidated:
+		c.Revalidated = 1
+	case cacheRevalidationMissed:
+		c.RevalidationMissed = 1
+		c.MissedBytes = uint64(max(0, p.responseBody.actual))
+	case cacheUncacheable:
+		c.Uncacheable = 1
+	}
+	accountCache(host, c)
+}
+
+// accountCache adds an exchange to the host's totals. It must be called with
+// cache.mu held.
+func accountCache(host string, c HostCache) {
+	if host == "" {
+		host = cacheOtherHost
+	}
+	h, ok := cache.hosts[host]
+	if !ok {
+		if len(cache.hosts) >= maxCacheHosts {
+			host = cacheOtherHost
+		}
+		if h, ok = cache.hosts[host]; !ok {
+			h = &HostCache{Host: host}
+			cache.hosts[host] = h
+		}
+	}
+	h.add(c)
+}
+
+// CacheEffectiveness returns how effectively requests to each host used the
+// HTTP cache over the run so far, ordered by the bytes that correct
+// revalidation would have saved. Only the first k hosts are returned
+// individually; the rest are summed up in a final "other" entry. A k of zero
+// or less returns every host.
+func CacheEffectiveness(k int) []HostCache {
+	var other *HostCache
+	cache.mu.Lock()
+	ret := make([]HostCache, 0, len(cache.hosts))
+	for _, c := range cache.hosts {
+		if c.Host == cacheOtherHost {
+			cp := *c
+			other = &cp
+			continue
+		}
+		ret = append(ret, *c)
+	}
+	cache.mu.Unlock()
+
+	slices.SortFunc(ret, func(a, b HostCache) int {
+		switch {
+		case a.MissedBytes != b.MissedBytes:
+			if a.MissedBytes > b.MissedBytes {
+				return -1
+			}
+			return 1
+		case a.RevalidationMissed != b.RevalidationMissed:
+			if a.RevalidationMissed > b.RevalidationMissed {
+				return -1
+			}
+			return 1
+		case a.Exchanges() != b.Exchanges():
+			if a.Exchanges() > b.Exchanges() {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Host, b.Host)
+	})
+
+	if k > 0 && len(ret) > k {
+		if other == nil {
+			other = &HostCache{Host: cacheOtherHost}
+		}
+		for _, c := range ret[k:] {
+			other.add(c)
+		}
+		ret = ret[:k]
+	}
+	if other != nil {
+		ret = append(ret, *other)
+	}
+	return ret
+}
+
+// WriteCacheSummary writes a table of the k hosts where correct revalidation
+// would have saved the most bytes to w. Nothing is written if there were no
+// HTTP exchanges.
+func WriteCacheSummary(w io.Writer, k int) error {
+	hosts := CacheEffectiveness(k)
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "HOST\tEXCHANGES\tFRESH\tREVALIDATED\tMISSED\tUNCACHEABLE\tSAVABLE\t\n")
+	for _, c := range hosts {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%s\t\n", c.Host, c.Exchanges(), c.Fresh, c.Revalidated, c.RevalidationMissed, c.Uncacheable, units.Bytes(c.MissedBytes))
+	}
+	return tw.Flush()
+}
+
+// ServeDebugCache serves the cache effectiveness of each host as JSON. The k
+// query parameter limits the number of hosts returned individually.
+func ServeDebugCache(w http.ResponseWriter, r *http.Request) {
+	k := 0
+	if val := r.URL.Query().Get("k"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid k: %v", err), http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(CacheEffectiveness(k)); err != nil {
+		slog.Debug("failed to write debug cache response", "err", err) // not fatal
+	}
+}
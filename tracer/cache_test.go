@@ -0,0 +1,131 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/event"
+)
+
+func resetCache(t *testing.T) {
+	reset := func() {
+		cache.mu.Lock()
+		cache.hosts = make(map[string]*HostCache)
+		cache.validators = make(map[string]cacheValidator)
+		cache.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func headers(kv ...string) []har.Header {
+	var ret []har.Header
+	for i := 0; i < len(kv); i += 2 {
+		ret = append(ret, har.Header{Name: kv[i], Value: kv[i+1]})
+	}
+	return ret
+}
+
+func TestClassifyCache(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		req    []har.Header
+		status int
+		resp   []har.Header
+		prev   cacheValidator
+		want   string
+	}{
+		{name: "post", method: "POST", status: 200, resp: headers("ETag", `"a"`), want: cacheUncacheable},
+		{name: "not modified", method: "GET", req: headers("If-None-Match", `"a"`), status: 304, want: cacheRevalidated},
+		{name: "no store", method: "GET", status: 200, resp: headers("Cache-Control", "private, no-store", "ETag", `"a"`), want: cacheUncacheable},
+		{name: "no validator or freshness", method: "GET", status: 200, want: cacheUncacheable},
+		{name: "max age", method: "GET", status: 200, resp: headers("Cache-Control", "max-age=60"), want: cacheFresh},
+		{name: "first fetch", method: "GET", status: 200, resp: headers("ETag", `"a"`), want: cacheFresh},
+		{name: "changed", method: "GET", status: 200, resp: headers("ETag", `"b"`), prev: cacheValidator{etag: `"a"`}, want: cacheFresh},
+		{name: "refetched unchanged", method: "GET", status: 200, resp: headers("ETag", `"a"`), prev: cacheValidator{etag: `"a"`}, want: cacheRevalidationMissed},
+		{name: "refetched unchanged last modified", method: "GET", status: 200, resp: headers("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT"), prev: cacheValidator{lastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}, want: cacheRevalidationMissed},
+		{name: "server ignored if-none-match", method: "GET", req: headers("If-None-Match", `W/"a", "c"`), status: 200, resp: headers("ETag", `"a"`), want: cacheRevalidationMissed},
+		{name: "server ignored if-modified-since", method: "GET", req: headers("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT"), status: 200, resp: headers("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT"), want: cacheRevalidationMissed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &har.Request{Method: tt.method, Headers: tt.req}
+			resp := &har.Response{Status: tt.status, Headers: tt.resp}
+			if got := classifyCache(req, resp, tt.prev); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheEffectiveness(t *testing.T) {
+	resetCache(t)
+
+	exchange := func(host string, req []har.Header, status int, resp []har.Header, size int64) *event.Event {
+		p := &Parser{
+			request:      &har.Request{Method: "GET", URL: "http://" + host + "/logo.png", Headers: req},
+			response:     &har.Response{Status: status, Headers: resp},
+			responseBody: bodyStats{actual: size},
+		}
+		tags := event.New()
+		p.setCacheTags(tags, host)
+		return tags
+	}
+
+	etag := headers("ETag", `"v1"`, "Cache-Control", "no-cache")
+	tags := exchange("a.example", nil, 200, etag, 1000)
+	if got := tags.Get("http_cache_status"); got != cacheFresh {
+		t.Errorf("got first fetch %q, want %q", got, cacheFresh)
+	}
+	if got := tags.Get("http_resp_etag"); got != `"v1"` {
+		t.Errorf("got http_resp_etag %q, want %q", got, `"v1"`)
+	}
+	if got := tags.Get("http_resp_cache_control"); got != "no-cache" {
+		t.Errorf("got http_resp_cache_control %q, want %q", got, "no-cache")
+	}
+
+	for range 2 {
+		exchange("a.example", nil, 200, etag, 1000)
+	}
+	tags = exchange("a.example", headers("If-None-Match", `"v1"`), 304, etag, 0)
+	if got := tags.Get("http_req_if_none_match"); got != `"v1"` {
+		t.Errorf("got http_req_if_none_match %q, want %q", got, `"v1"`)
+	}
+	exchange("b.example", nil, 200, etag, 50)
+	exchange("b.example", nil, 200, etag, 50)
+	exchange("c.example", nil, 200, nil, 10)
+
+	got := CacheEffectiveness(1)
+	if len(got) != 2 {
+		t.Fatalf("got %d hosts, want 1 and other: %+v", len(got), got)
+	}
+	if want := (HostCache{Host: "a.example", Fresh: 1, Revalidated: 1, RevalidationMissed: 2, MissedBytes: 2000}); got[0] != want {
+		t.Errorf("got top host %+v, want %+v", got[0], want)
+	}
+	if want := (HostCache{Host: cacheOtherHost, Fresh: 1, RevalidationMissed: 1, Uncacheable: 1, MissedBytes: 50}); got[1] != want {
+		t.Errorf("got other %+v, want %+v", got[1], want)
+	}
+}
+
+func TestCacheCardinality(t *testing.T) {
+	resetCache(t)
+
+	cache.mu.Lock()
+	for i := range maxCacheHosts + 10 {
+		accountCache(fmt.Sprintf("host%d", i), HostCache{Fresh: 1})
+	}
+	cache.mu.Unlock()
+
+	got := CacheEffectiveness(0)
+	if len(got) != maxCacheHosts+1 {
+		t.Fatalf("got %d hosts, want %d", len(got), maxCacheHosts+1)
+	}
+	if other := got[len(got)-1]; other.Host != cacheOtherHost || other.Fresh != 10 {
+		t.Errorf("got last entry %+v, want other with 10 exchanges", other)
+	}
+}
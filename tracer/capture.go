@@ -0,0 +1,89 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"subtrace.dev/event"
+)
+
+// How much of a connection or exchange was captured, as set in the
+// capture_level tag.
+const (
+	// CaptureFull is requests and responses including their payloads.
+	CaptureFull = "full"
+	// CaptureMetadata is requests and responses without (all of) their
+	// payloads.
+	CaptureMetadata = "metadata"
+	// CaptureNone is only the connection's addresses and byte counts.
+	CaptureNone = "none"
+)
+
+// Why less than everything was captured, as set in the capture_reason tag.
+const (
+	ReasonTLSDisabled      = "tls_disabled"         // TLS interception is off (-tls=false)
+	ReasonTLSDryRun        = "tls_dry_run"          // only forecasting interception (-tls=dry-run)
+	ReasonTLSIncoming      = "tls_incoming"         // incoming TLS can't be intercepted
+	ReasonTLSNested        = "tls_nested"           // TLS inside an intercepted TLS connection
+	ReasonTLSHandshake     = "tls_handshake_failed" // the client rejected the certificate, e.g. pinning or mTLS
+	ReasonUnknownProtocol  = "unsupported_protocol" // neither HTTP nor TLS
+	ReasonServerFirst      = "server_spoke_first"   // the server sent data first, so it's not HTTP or TLS
+	ReasonNotProxied       = "not_proxied"          // a socket type that's only observed, e.g. AF_VSOCK
+	ReasonNetns            = "netns_passthrough"    // created after the process switched network namespaces
+	ReasonSampled          = "sampled_out"          // left out by -sample
+	ReasonPayloadPolicy    = "payload_policy"       // payloads redacted by the config's payloads section
+	ReasonPayloadLimit     = "payload_limit"        // a body was larger than -payload-limit
+	ReasonPayloadLimitZero = "payload_limit_zero"   // -payload-limit is 0, so no body is captured
+	ReasonPayloadNever     = "payload_never"        // -payloads=never
+	ReasonPayloadAdaptive  = "payload_adaptive"     // -payloads=adaptive and the exchange looked normal
+	ReasonPayloadBudget    = "payload_budget"       // -payload-budget was exhausted when the exchange started
+	ReasonParserShed       = "parser_shed"          // parsing cost too much work per byte, so the rest is only counted
+)
+
+// Decision is one step in how subtrace decided what to capture of a
+// connection or exchange.
+type Decision struct {
+	Layer   string `json:"layer"` // socket, protocol, tls or payload
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// AddDecision appends d to the capture_decisions tag of ev, which holds a JSON
+// array of the decisions made so far, and updates capture_level and
+// capture_reason if d captures less than them.
+func AddDecision(ev *event.Event, d Decision, level string) {
+	var list []Decision
+	if prev := ev.Get("capture_decisions"); prev != "" {
+		if err := json.Unmarshal([]byte(prev), &list); err != nil {
+			slog.Debug("failed to decode capture_decisions tag", "err", err) // not fatal: start over
+			list = nil
+		}
+	}
+	list = append(list, d)
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		panic(err)
+	}
+	ev.Set("capture_decisions", string(b))
+
+	if captureRank(level) < captureRank(ev.Get("capture_level")) {
+		ev.Set("capture_level", level)
+		ev.Set("capture_reason", d.Reason)
+	}
+}
+
+func captureRank(level string) int {
+	switch level {
+	case CaptureNone:
+		return 0
+	case CaptureMetadata:
+		return 1
+	default:
+		return 2
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"encoding/json"
+	"testing"
+
+	"subtrace.dev/event"
+)
+
+func TestAddDecision(t *testing.T) {
+	ev := event.New()
+	AddDecision(ev, Decision{Layer: "protocol", Verdict: "tls"}, CaptureFull)
+	AddDecision(ev, Decision{Layer: "tls", Verdict: "intercepted", Detail: "api.example.com"}, CaptureFull)
+	if level := ev.Get("capture_level"); level != "" {
+		t.Errorf("got capture_level %q after full captures only, want it unset until the exchange finishes", level)
+	}
+
+	AddDecision(ev, Decision{Layer: "payload", Verdict: "truncated", Reason: ReasonPayloadLimit}, CaptureMetadata)
+	AddDecision(ev, Decision{Layer: "payload", Verdict: "redacted", Reason: ReasonPayloadPolicy}, CaptureMetadata)
+	if level, reason := ev.Get("capture_level"), ev.Get("capture_reason"); level != CaptureMetadata || reason != ReasonPayloadLimit {
+		t.Errorf("got capture_level=%q capture_reason=%q, want the first decision that captured less", level, reason)
+	}
+
+	AddDecision(ev, Decision{Layer: "socket", Verdict: "observed", Reason: ReasonNotProxied}, CaptureNone)
+	if level, reason := ev.Get("capture_level"), ev.Get("capture_reason"); level != CaptureNone || reason != ReasonNotProxied {
+		t.Errorf("got capture_level=%q capture_reason=%q, want none because %s", level, reason, ReasonNotProxied)
+	}
+
+	var got []Decision
+	if err := json.Unmarshal([]byte(ev.Get("capture_decisions")), &got); err != nil {
+		t.Fatalf("decode capture_decisions: %v", err)
+	}
+	if len(got) != 5 || got[1].Detail != "api.example.com" || got[4].Layer != "socket" {
+		t.Errorf("got decisions %+v, want all 5 in order", got)
+	}
+}
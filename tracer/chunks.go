@@ -0,0 +1,222 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"subtrace.dev/event"
+)
+
+const (
+	chunkHead      = 16 // first chunks of a body that are always kept
+	chunkReservoir = 32 // later chunks kept by reservoir sampling
+
+	// chunkMergeWindow is how close reads must be to count as one chunk. Reads
+	// of bytes that arrived together are usually split by buffer sizes.
+	chunkMergeWindow = time.Millisecond
+)
+
+// chunk is one burst of body bytes that arrived together.
+type chunk struct {
+	index uint32
+	size  uint32
+	at    time.Duration // since the exchange began
+	gap   time.Duration // since the previous chunk's last byte arrived
+}
+
+// chunkTimings records when the bytes of a streamed body arrived: the first
+// chunkHead chunks and a uniform sample of chunkReservoir later ones, plus
+// exact counts and the longest gap. Its arrays are part of the Parser so that
+// recording is allocation-free.
+type chunkTimings struct {
+	begin time.Time // with a monotonic reading; zero if not recording
+
+	cur  chunk         // the chunk still being read, if cur.size > 0
+	last time.Duration // when the last byte of the body arrived so far
+
+	head      [chunkHead]chunk
+	reservoir [chunkReservoir]chunk
+	count     uint32 // chunks seen, including cur
+	bytes     int64
+
+	maxGap      time.Duration
+	maxGapAfter uint32 // index of the chunk before the longest gap
+}
+
+// isStreamed reports whether a body is worth recording chunk timings for:
+// chunked, delimited by the end of the connection, or a known streaming
+// content type.
+func isStreamed(header http.Header, contentLength int64, transferEncoding []string) bool {
+	for _, te := range transferEncoding {
+		if strings.EqualFold(te, "chunked") {
+			return true
+		}
+	}
+	if contentLength < 0 {
+		return true
+	}
+	mt, _, _ := mime.ParseMediaType(header.Get("content-type"))
+	switch mt {
+	case "text/event-stream", "application/x-ndjson", "application/jsonl":
+		return true
+	}
+	return isGRPC(mt)
+}
+
+// start begins recording relative to begin.
+func (c *chunkTimings) start(begin time.Time) {
+	c.begin = begin
+}
+
+// add records n bytes that arrived now.
+func (c *chunkTimings) add(n int) {
+	if c.begin.IsZero() || n <= 0 {
+		return
+	}
+	c.record(time.Since(c.begin), n)
+}
+
+// record records n bytes that arrived at now since begin.
+func (c *chunkTimings) record(now time.Duration, n int) {
+	c.bytes += int64(n)
+	if c.cur.size > 0 && now-c.last < chunkMergeWindow {
+		c.cur.size += uint32(n)
+		c.last = now
+		return
+	}
+
+	gap := time.Duration(0)
+	if c.cur.size > 0 {
+		gap = now - c.last
+		if gap > c.maxGap {
+			c.maxGap, c.maxGapAfter = gap, c.cur.index
+		}
+		c.keep(c.cur)
+	}
+	c.cur = chunk{index: c.count, size: uint32(n), at: now, gap: gap}
+	c.count++
+	c.last = now
+}
+
+// keep stores a finished chunk in the head or, by reservoir sampling, in the
+// reservoir.
+func (c *chunkTimings) keep(ch chunk) {
+	switch i := ch.index; {
+	case i < chunkHead:
+		c.head[i] = ch
+	case i < chunkHead+chunkReservoir:
+		c.reservoir[i-chunkHead] = ch
+	default:
+		if j := rand.Uint32N(i - chunkHead + 1); j < chunkReservoir {
+			c.reservoir[j] = ch
+		}
+	}
+}
+
+// ChunkTimings is the summary of chunkTimings in the HAR entry. Devtools draws
+// the samples as a sparkline of bytes over time.
+type ChunkTimings struct {
+	Count       uint32        `json:"count"`
+	Bytes       int64         `json:"bytes"`
+	MaxGapMs    float64       `json:"maxGapMs"`
+	MaxGapAfter uint32        `json:"maxGapAfter"` // index of the chunk before the longest gap
+	P95GapMs    float64       `json:"p95GapMs"`
+	Samples     []ChunkSample `json:"samples"` // ordered by index
+}
+
+type ChunkSample struct {
+	Index uint32  `json:"index"`
+	Size  uint32  `json:"size"`
+	AtMs  float64 `json:"atMs"` // since the exchange began
+	GapMs float64 `json:"gapMs"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// summary returns the summary of the recorded chunks, or nil if the body
+// wasn't recorded or came in one chunk.
+func (c *chunkTimings) summary() *ChunkTimings {
+	if c.begin.IsZero() || c.count < 2 {
+		return nil
+	}
+	c.keep(c.cur)
+	c.cur = chunk{}
+
+	kept := c.head[:min(c.count, chunkHead)]
+	var sampled []chunk
+	if c.count > chunkHead {
+		sampled = c.reservoir[:min(c.count-chunkHead, chunkReservoir)]
+	}
+
+	s := &ChunkTimings{
+		Count:       c.count,
+		Bytes:       c.bytes,
+		MaxGapMs:    millis(c.maxGap),
+		MaxGapAfter: c.maxGapAfter,
+		P95GapMs:    millis(p95Gap(kept[1:], sampled, c.count-min(c.count, chunkHead))),
+		Samples:     make([]ChunkSample, 0, len(kept)+len(sampled)),
+	}
+	for _, ch := range kept {
+		s.Samples = append(s.Samples, ChunkSample{Index: ch.index, Size: ch.size, AtMs: millis(ch.at), GapMs: millis(ch.gap)})
+	}
+	for _, ch := range sampled {
+		s.Samples = append(s.Samples, ChunkSample{Index: ch.index, Size: ch.size, AtMs: millis(ch.at), GapMs: millis(ch.gap)})
+	}
+	slices.SortFunc(s.Samples[len(kept):], func(a, b ChunkSample) int { return cmp.Compare(a.Index, b.Index) })
+	return s
+}
+
+// p95Gap estimates the 95th percentile of the gaps before every chunk but the
+// first. The head chunks are all there, and each sampled chunk stands for
+// total/len(sampled) of the later ones.
+func p95Gap(head, sampled []chunk, total uint32) time.Duration {
+	type weighted struct {
+		gap    time.Duration
+		weight float64
+	}
+	var gaps [chunkHead + chunkReservoir]weighted
+	n, sum := 0, 0.0
+	for _, ch := range head {
+		gaps[n] = weighted{ch.gap, 1}
+		n, sum = n+1, sum+1
+	}
+	for _, ch := range sampled {
+		w := float64(total) / float64(len(sampled))
+		gaps[n] = weighted{ch.gap, w}
+		n, sum = n+1, sum+w
+	}
+	if n == 0 {
+		return 0
+	}
+	slices.SortFunc(gaps[:n], func(a, b weighted) int { return cmp.Compare(a.gap, b.gap) })
+	acc := 0.0
+	for _, g := range gaps[:n] {
+		if acc += g.weight; acc >= 0.95*sum {
+			return g.gap
+		}
+	}
+	return gaps[n-1].gap
+}
+
+// setChunkTags tags the event with the chunk counts and gaps of a streamed
+// body so that stalls can be found without looking at the HAR entry.
+func setChunkTags(tags *event.Event, prefix string, s *ChunkTimings) {
+	if s == nil {
+		return
+	}
+	tags.Set(prefix+"_chunks", fmt.Sprintf("%d", s.Count))
+	tags.Set(prefix+"_chunk_max_gap_ms", fmt.Sprintf("%.0f", s.MaxGapMs))
+	tags.Set(prefix+"_chunk_max_gap_after", fmt.Sprintf("%d", s.MaxGapAfter))
+	tags.Set(prefix+"_chunk_p95_gap_ms", fmt.Sprintf("%.0f", s.P95GapMs))
+}
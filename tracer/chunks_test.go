@@ -0,0 +1,111 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChunkTimings(t *testing.T) {
+	var c chunkTimings
+	c.start(time.Now())
+
+	// Three chunks, the third one split across two reads, then a stall and a
+	// long steady stream.
+	at := time.Duration(0)
+	c.record(at, 10)
+	at += 10 * time.Millisecond
+	c.record(at, 10)
+	at += 10 * time.Millisecond
+	c.record(at, 5)
+	c.record(at+100*time.Microsecond, 5)
+	at += 9 * time.Second
+	for range 1000 {
+		c.record(at, 1)
+		at += 10 * time.Millisecond
+	}
+
+	s := c.summary()
+	if s == nil {
+		t.Fatalf("got no summary")
+	}
+	if s.Count != 1003 || s.Bytes != 1030 {
+		t.Errorf("got %d chunks of %d bytes, want 1003 of 1030", s.Count, s.Bytes)
+	}
+	if s.MaxGapMs < 8999 || s.MaxGapMs > 9001 || s.MaxGapAfter != 2 {
+		t.Errorf("got max gap %.1fms after chunk %d, want 9s after chunk 2", s.MaxGapMs, s.MaxGapAfter)
+	}
+	if s.P95GapMs != 10 {
+		t.Errorf("got p95 gap %.1fms, want 10ms", s.P95GapMs)
+	}
+	if len(s.Samples) != chunkHead+chunkReservoir {
+		t.Fatalf("got %d samples, want %d", len(s.Samples), chunkHead+chunkReservoir)
+	}
+	if s.Samples[2].Size != 10 || s.Samples[3].GapMs < 8999 {
+		t.Errorf("got samples %+v, want the split chunk merged and the stall before chunk 3", s.Samples[:4])
+	}
+	for i := 1; i < len(s.Samples); i++ {
+		if s.Samples[i].Index <= s.Samples[i-1].Index {
+			t.Fatalf("samples aren't ordered by index: %+v", s.Samples)
+		}
+	}
+
+	if allocs := testing.AllocsPerRun(1000, func() { c.record(at, 1); at += time.Millisecond }); allocs != 0 {
+		t.Errorf("got %.1f allocations per chunk, want 0", allocs)
+	}
+
+	var one chunkTimings
+	one.start(time.Now())
+	one.record(0, 100)
+	if s := one.summary(); s != nil {
+		t.Errorf("got summary %+v of a single chunk", s)
+	}
+}
+
+func TestChunkTimingsStreamed(t *testing.T) {
+	for _, tt := range []struct {
+		head string
+		want bool
+	}{
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", true},
+		{"HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nContent-Length: 10\r\n\r\n", true},
+		{"HTTP/1.0 200 OK\r\n\r\n", true},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n", false},
+	} {
+		resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(tt.head)), nil)
+		if err != nil {
+			t.Fatalf("read response %q: %v", tt.head, err)
+		}
+		if got := isStreamed(resp.Header, resp.ContentLength, resp.TransferEncoding); got != tt.want {
+			t.Errorf("isStreamed(%q) = %v, want %v", tt.head, got, tt.want)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n")
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(pw, "5\r\nworld\r\n0\r\n\r\n")
+		pw.Close()
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(pr), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	var c chunkTimings
+	c.start(time.Now())
+	s := newSampler(resp.Body, PayloadLimitBytes)
+	s.chunks = &c
+	io.Copy(io.Discard, s)
+	s.Close()
+	sum := c.summary()
+	if sum == nil || sum.Count != 2 || sum.Bytes != 10 || sum.MaxGapMs < 40 {
+		t.Errorf("got summary %+v, want two chunks 50ms apart", sum)
+	}
+}
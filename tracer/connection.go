@@ -0,0 +1,111 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"github.com/google/uuid"
+	"subtrace.dev/event"
+	"subtrace.dev/global"
+)
+
+// PublishConnection publishes an event that only carries connection metadata
+// in its tags, for connections that aren't proxied and therefore have no
+// request or response to parse (e.g. AF_VSOCK sockets). summary is what's
+// printed for the event with -log. The event keeps the ID of ev so that other
+// events can refer to it before it's published.
+func PublishConnection(global *global.Global, ev *event.Event, summary string) {
+	begin := time.Now()
+
+	tags := global.Config.GetEventTemplate()
+	defer event.Release(tags)
+	tags.CopyFrom(ev)
+	id := ev.Get("event_id")
+	if id == "" {
+		id = uuid.New().String()
+	}
+	tags.Set("event_id", id)
+	tags.Set("time", begin.UTC().Format(time.RFC3339Nano))
+
+	// Filters are written against HTTP requests, so give them an empty one to
+	// look at rather than nothing.
+	entry := &har.Entry{
+		ID:              tags.Get("event_id"),
+		StartedDateTime: begin.UTC(),
+		Request:         &har.Request{},
+		Response:        &har.Response{},
+	}
+	view := tags.View()
+	rule, err := global.Config.GetMatchingRule(view, entry)
+	if err == nil && rule != nil && !rule.Keep() {
+		return
+	}
+
+	recent.add(view)
+	if DefaultManager.log.Load() {
+		fmt.Fprintf(os.Stderr, "%s  |  %s\n", begin.UTC().Format("2006-01-02 15:04:05.999 UTC"), summary)
+	}
+
+	if sinks := routeSinks(view, entry); len(sinks) > 0 {
+		for _, s := range sinks {
+			if err := s.deliver(&sinkEvent{tags: view}, 0, nil); err != nil {
+				slog.Error("failed to publish connection event to sink", "eventID", tags.Get("event_id"), "err", err)
+			}
+		}
+		return
+	}
+
+	if sendReflector {
+		DefaultPublisher.inflight.Add(1)
+		defer DefaultPublisher.inflight.Done()
+
+		err := sendReflectorEvent(DefaultPublisher, view, nil, 0, nil)
+		slog.Debug("sent connection event to reflector", "eventID", tags.Get("event_id"), "err", err)
+		if err != nil {
+			slog.Error("failed to publish connection event to reflector", "eventID", tags.Get("event_id"), "err", err)
+		}
+	}
+	if sendTunneler {
+		DefaultManager.Insert(tags.String())
+	}
+}
+
+// recentConnectionEvents is how many connection events RecentConnections
+// returns at most.
+const recentConnectionEvents = 100
+
+// connectionRing keeps the tags of the most recent connection events.
+type connectionRing struct {
+	mu   sync.Mutex
+	tags []map[string]string
+	next int // oldest entry once the ring is full
+}
+
+var recent connectionRing
+
+func (r *connectionRing) add(tags map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.tags) < recentConnectionEvents {
+		r.tags = append(r.tags, tags)
+		return
+	}
+	r.tags[r.next] = tags
+	r.next = (r.next + 1) % recentConnectionEvents
+}
+
+// RecentConnections returns the tags of the most recent connection events,
+// oldest first, for state dumps.
+func RecentConnections() []map[string]string {
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+	return append(slices.Clone(recent.tags[recent.next:]), recent.tags[:recent.next]...)
+}
@@ -0,0 +1,65 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// DefaultEventLog is the file every event that isn't excluded by a filter is
+// appended to, if any. It must be set before any events are produced.
+var DefaultEventLog *EventLog
+
+// EventLogLine is one line of an event log.
+type EventLogLine struct {
+	Tags  map[string]string `json:"tags"`
+	Entry json.RawMessage   `json:"entry"` // the HAR entry with subtrace's extensions
+}
+
+// EventLog appends events to a file as JSON lines so that other tools, such as
+// `subtrace test`, can read what was captured after the fact.
+type EventLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func OpenEventLog(path string) (*EventLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open event log: %w", err)
+	}
+	return &EventLog{f: f}, nil
+}
+
+// Write appends an event. Failures are logged and otherwise ignored so that
+// the log can never fail the event pipeline.
+func (l *EventLog) Write(tags map[string]string, entry []byte) {
+	b, err := marshalEventLogLine(tags, entry)
+	if err != nil {
+		slog.Error("failed to encode event log line", "eventID", tags["event_id"], "err", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		slog.Error("failed to write event log", "path", l.f.Name(), "eventID", tags["event_id"], "err", err)
+	}
+}
+
+// marshalEventLogLine encodes an event as a line of an event log, without the
+// newline.
+func marshalEventLogLine(tags map[string]string, entry []byte) ([]byte, error) {
+	return json.Marshal(EventLogLine{Tags: tags, Entry: entry})
+}
+
+func (l *EventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,357 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"subtrace.dev/cmd/version"
+)
+
+// SinkSchemaVersion is the version of the frames written to -sink-exec
+// subprocesses. It changes whenever a sink written for the previous version
+// could misread them.
+const SinkSchemaVersion = 1
+
+// SinkRefusedExitCode is the exit status with which a -sink-exec subprocess
+// refuses a tracer whose schema version it doesn't support (EX_CONFIG). It
+// isn't restarted after that.
+const SinkRefusedExitCode = 78
+
+// MaxSinkFrameBytes bounds the frames ReadSinkFrame accepts.
+const MaxSinkFrameBytes = 64 << 20
+
+var (
+	// execSinkQueue is how many events wait for a slow subprocess before new
+	// ones are dropped.
+	execSinkQueue = 4096
+
+	execSinkBackoffBase = 100 * time.Millisecond
+	execSinkBackoffMax  = 30 * time.Second
+
+	// execSinkStable is how long a subprocess must run for its next crash to
+	// restart it without waiting.
+	execSinkStable = 10 * time.Second
+
+	// execSinkExitWait is how long a subprocess gets to exit after its stdin
+	// fails or is closed before it's killed.
+	execSinkExitWait = 5 * time.Second
+)
+
+// SinkHello is the first frame written to every -sink-exec subprocess.
+type SinkHello struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	TracerVersion string `json:"tracerVersion"`
+}
+
+// DefaultExecSink is the -sink-exec subprocess, if any. It must be set before
+// any events are produced.
+var DefaultExecSink *ExecSink
+
+// ExecSink feeds every event to a long-lived subprocess, for pipelines that
+// subtrace has no sink for. The subprocess reads frames from stdin: a 4-byte
+// big-endian length followed by that many bytes. The first frame is a
+// SinkHello and every other frame is an event, the same JSON as an event log
+// line. Events wait in a bounded queue while the subprocess reads; once the
+// queue is full they're dropped, like the publisher's. A subprocess that exits
+// is restarted with backoff, and at shutdown its stdin is closed once the
+// queue is written.
+type ExecSink struct {
+	command string
+
+	mu     sync.RWMutex
+	closed bool
+	ch     chan []byte
+
+	done  chan struct{} // closed when the loop returns
+	abort chan struct{} // closed when Close gives up on flushing
+
+	proc     atomic.Pointer[execSinkProcess]
+	refused  atomic.Bool
+	pending  atomic.Int64
+	written  atomic.Uint64
+	dropped  atomic.Uint64
+	restarts atomic.Uint64
+}
+
+// StartExecSink starts the subprocess, which runs command with /bin/sh.
+func StartExecSink(command string) *ExecSink {
+	s := &ExecSink{
+		command: command,
+		ch:      make(chan []byte, execSinkQueue),
+		done:    make(chan struct{}),
+		abort:   make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+// Handle queues an event for the subprocess. It never blocks.
+func (s *ExecSink) Handle(tags map[string]string, json []byte) {
+	b, err := marshalEventLogLine(tags, json)
+	if err != nil {
+		slog.Error("failed to encode -sink-exec event", "eventID", tags["event_id"], "err", err)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed || s.refused.Load() {
+		s.dropped.Add(1)
+		return
+	}
+	s.pending.Add(1)
+	select {
+	case s.ch <- b:
+	default:
+		s.pending.Add(-1)
+		n := s.dropped.Add(1)
+		slog.Debug("dropped -sink-exec event", "eventID", tags["event_id"], "reason", "queue full", "dropped", n)
+	}
+}
+
+// Close writes the queued events, closes the subprocess's stdin and waits for
+// it to exit, all within timeout. After that, the subprocess is killed and
+// Close reports false.
+func (s *ExecSink) Close(timeout time.Duration) (flushed bool) {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+	s.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.done:
+		return s.pending.Load() == 0
+	case <-timer.C:
+	}
+	close(s.abort)
+	if proc := s.proc.Load(); proc != nil {
+		proc.kill()
+	}
+	<-s.done
+	return false
+}
+
+// Metrics returns the number of events written to the subprocess, dropped
+// and still queued, and the number of restarts.
+func (s *ExecSink) Metrics() map[string]uint64 {
+	refused := uint64(0)
+	if s.refused.Load() {
+		refused = 1
+	}
+	return map[string]uint64{
+		"written":  s.written.Load(),
+		"dropped":  s.dropped.Load(),
+		"pending":  uint64(max(s.pending.Load(), 0)),
+		"restarts": s.restarts.Load(),
+		"refused":  refused,
+	}
+}
+
+func (s *ExecSink) loop() {
+	defer close(s.done)
+
+	hello, _ := json.Marshal(SinkHello{SchemaVersion: SinkSchemaVersion, TracerVersion: version.GetCanonicalString()})
+	var next []byte // an event that wasn't written to the last subprocess
+	failures := 0
+	for {
+		proc, err := s.start()
+		if err == nil {
+			s.proc.Store(proc)
+			if err = proc.write(hello); err == nil {
+				if next, err = s.feed(proc, next); err == nil {
+					proc.finish()
+					s.proc.Store(nil)
+					return
+				}
+			}
+			err = proc.stop(err)
+			s.proc.Store(nil)
+			if time.Since(proc.started) >= execSinkStable {
+				failures = 0
+			}
+		}
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == SinkRefusedExitCode {
+			slog.Error("-sink-exec refused the tracer's schema version, dropping events", "command", s.command, "schemaVersion", SinkSchemaVersion)
+			s.refused.Store(true)
+			s.drain(next)
+			return
+		}
+
+		failures++
+		wait := execSinkBackoff(failures)
+		slog.Warn("-sink-exec subprocess failed, restarting", "command", s.command, "err", err, "wait", wait)
+		select {
+		case <-s.abort:
+			s.drain(next)
+			return
+		case <-time.After(wait):
+		}
+		s.restarts.Add(1)
+	}
+}
+
+// execSinkBackoff returns the wait before restarting the subprocess after the
+// given number of consecutive failures, like dialBackoff.
+func execSinkBackoff(failures int) time.Duration {
+	d := execSinkBackoffMax
+	if failures < 32 {
+		d = min(execSinkBackoffBase<<max(0, failures-1), execSinkBackoffMax)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// feed writes events to the subprocess, starting with next if it's set, until
+// the queue is closed and empty. It returns the event it failed to write, if
+// any, along with the error.
+func (s *ExecSink) feed(proc *execSinkProcess, next []byte) ([]byte, error) {
+	for {
+		if next == nil {
+			select {
+			case b, ok := <-s.ch:
+				if !ok {
+					return nil, nil
+				}
+				next = b
+			case <-proc.exited:
+				return nil, fmt.Errorf("exited while idle")
+			}
+		}
+		if err := proc.write(next); err != nil {
+			return next, err
+		}
+		s.pending.Add(-1)
+		s.written.Add(1)
+		next = nil
+	}
+}
+
+// drain drops the events that can't be written anymore, until the queue is
+// closed.
+func (s *ExecSink) drain(next []byte) {
+	if next != nil {
+		s.pending.Add(-1)
+		s.dropped.Add(1)
+	}
+	for range s.ch {
+		s.pending.Add(-1)
+		s.dropped.Add(1)
+	}
+}
+
+// execSinkProcess is a running -sink-exec subprocess.
+type execSinkProcess struct {
+	cmd     *exec.Cmd
+	stdin   *os.File
+	started time.Time
+	exited  chan struct{}
+	err     error // set once exited is closed
+}
+
+func (s *ExecSink) start() (*execSinkProcess, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("pipe: %w", err)
+	}
+	defer r.Close()
+
+	// The tracer isn't seccomp-filtered, so the subprocess is never traced
+	// itself. It gets its own process group so that killing it kills whatever
+	// the shell started too.
+	cmd := exec.Command("/bin/sh", "-c", s.command)
+	cmd.Stdin = r
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = subprocessEnviron()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("start: %w", err)
+	}
+
+	proc := &execSinkProcess{cmd: cmd, stdin: w, started: time.Now(), exited: make(chan struct{})}
+	go func() {
+		proc.err = cmd.Wait()
+		close(proc.exited)
+	}()
+	return proc, nil
+}
+
+func (p *execSinkProcess) write(b []byte) error {
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+	_, err := p.stdin.Write(frame)
+	return err
+}
+
+func (p *execSinkProcess) kill() {
+	syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// wait waits for the subprocess to exit, killing it if it takes longer than
+// execSinkExitWait.
+func (p *execSinkProcess) wait() error {
+	select {
+	case <-p.exited:
+	case <-time.After(execSinkExitWait):
+		p.kill()
+		<-p.exited
+	}
+	return p.err
+}
+
+// finish closes the subprocess's stdin and waits for it to exit.
+func (p *execSinkProcess) finish() {
+	p.stdin.Close()
+	if err := p.wait(); err != nil {
+		slog.Warn("-sink-exec subprocess failed at exit", "err", err)
+	}
+}
+
+// stop stops a subprocess that failed with err and returns why it failed,
+// which is its exit status if it exited.
+func (p *execSinkProcess) stop(err error) error {
+	p.stdin.Close()
+	if exitErr := p.wait(); exitErr != nil {
+		return exitErr
+	}
+	return err
+}
+
+// ReadSinkFrame reads a frame written to a -sink-exec subprocess.
+func ReadSinkFrame(r *bufio.Reader) ([]byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(n[:])
+	if size > MaxSinkFrameBytes {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the %d byte limit", size, MaxSinkFrameBytes)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("read frame: %w", io.ErrUnexpectedEOF)
+	}
+	return b, nil
+}
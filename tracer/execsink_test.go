@@ -0,0 +1,222 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"subtrace.dev/internal/testutil"
+)
+
+// TestMain runs the test binary as a -sink-exec subprocess if it's asked to.
+func TestMain(m *testing.M) {
+	if mode := os.Getenv("SUBTRACE_TEST_SINK"); mode != "" {
+		os.Exit(testSink(mode, os.Getenv("SUBTRACE_TEST_SINK_DIR")))
+	}
+	os.Exit(m.Run())
+}
+
+// testSink is a sink that appends the ID of every event to dir/events and
+// "EOF" once stdin is closed. The mode changes how it behaves:
+//
+//   - "record" reads every event right away;
+//   - "slow" sleeps before reading each event;
+//   - "stalled" doesn't read any until dir/go exists;
+//   - "crash" exits with an error after the first event it reads, the first
+//     time it runs;
+//   - "v2" refuses every tracer but one with schema version 2.
+func testSink(mode, dir string) int {
+	r := bufio.NewReader(os.Stdin)
+	b, err := ReadSinkFrame(r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read hello: %v\n", err)
+		return 1
+	}
+	var hello SinkHello
+	if err := json.Unmarshal(b, &hello); err != nil {
+		fmt.Fprintf(os.Stderr, "decode hello: %v\n", err)
+		return 1
+	}
+	want := SinkSchemaVersion
+	if mode == "v2" {
+		want = 2
+	}
+	if hello.SchemaVersion != want {
+		return SinkRefusedExitCode
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "events"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "open: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	crash := false
+	if mode == "crash" {
+		if _, err := os.Stat(filepath.Join(dir, "crashed")); errors.Is(err, os.ErrNotExist) {
+			os.WriteFile(filepath.Join(dir, "crashed"), nil, 0o644)
+			crash = true
+		}
+	}
+	if mode == "stalled" {
+		for {
+			if _, err := os.Stat(filepath.Join(dir, "go")); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for {
+		if mode == "slow" {
+			time.Sleep(2 * time.Millisecond)
+		}
+		b, err := ReadSinkFrame(r)
+		if errors.Is(err, io.EOF) {
+			fmt.Fprintln(f, "EOF")
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read event: %v\n", err)
+			return 1
+		}
+		if crash {
+			return 1
+		}
+		var line EventLogLine
+		if err := json.Unmarshal(b, &line); err != nil {
+			fmt.Fprintf(os.Stderr, "decode event: %v\n", err)
+			return 1
+		}
+		fmt.Fprintln(f, line.Tags["event_id"])
+	}
+}
+
+// startTestSink starts the test binary as a -sink-exec subprocess in the given
+// mode and returns the directory it records events in.
+func startTestSink(t *testing.T, mode string) (*ExecSink, string) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("executable: %v", err)
+	}
+	dir := t.TempDir()
+	s := StartExecSink(fmt.Sprintf("SUBTRACE_TEST_SINK=%s SUBTRACE_TEST_SINK_DIR='%s' exec '%s'", mode, dir, exe))
+	t.Cleanup(func() { s.Close(time.Second) })
+	return s, dir
+}
+
+func sinkEvents(t *testing.T, dir string) []string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, "events"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("read events: %v", err)
+	}
+	return strings.Fields(string(b))
+}
+
+func sendSinkEvents(s *ExecSink, ids []string, payload string) {
+	for _, id := range ids {
+		entry, _ := json.Marshal(map[string]string{"payload": payload})
+		s.Handle(map[string]string{"event_id": id}, entry)
+	}
+}
+
+func eventIDs(n int) []string {
+	var ret []string
+	for i := range n {
+		ret = append(ret, strconv.Itoa(i))
+	}
+	return ret
+}
+
+// TestExecSinkFlush checks that every event queued for a slow sink is written
+// at shutdown before its stdin is closed.
+func TestExecSinkFlush(t *testing.T) {
+	s, dir := startTestSink(t, "slow")
+	ids := eventIDs(50)
+	sendSinkEvents(s, ids, "")
+	if !s.Close(10 * time.Second) {
+		t.Fatalf("not flushed: %v", s.Metrics())
+	}
+	want := append(ids, "EOF")
+	if got := sinkEvents(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("sink got %v, want %v", got, want)
+	}
+	if m := s.Metrics(); m["written"] != 50 || m["dropped"] != 0 || m["pending"] != 0 {
+		t.Errorf("got metrics %v", m)
+	}
+}
+
+// TestExecSinkSlowReader checks that a sink that doesn't read never blocks the
+// events and that the ones that don't fit the queue are dropped.
+func TestExecSinkSlowReader(t *testing.T) {
+	prev := execSinkQueue
+	execSinkQueue = 4
+	t.Cleanup(func() { execSinkQueue = prev })
+
+	s, dir := startTestSink(t, "stalled")
+	begin := time.Now()
+	sendSinkEvents(s, eventIDs(200), strings.Repeat("x", 32<<10))
+	if d := time.Since(begin); d > 2*time.Second {
+		t.Errorf("handling events took %v", d)
+	}
+	if m := s.Metrics(); m["dropped"] == 0 {
+		t.Errorf("got metrics %v, want events dropped", m)
+	}
+
+	os.WriteFile(filepath.Join(dir, "go"), nil, 0o644)
+	if !s.Close(10 * time.Second) {
+		t.Fatalf("not flushed: %v", s.Metrics())
+	}
+	got := sinkEvents(t, dir)
+	m := s.Metrics()
+	if len(got) == 0 || got[len(got)-1] != "EOF" || uint64(len(got)-1) != m["written"] || m["written"]+m["dropped"] != 200 {
+		t.Errorf("sink got %d events, metrics %v", len(got), m)
+	}
+}
+
+// TestExecSinkRestart checks that a sink that crashes is restarted and gets
+// the events after the one it crashed on.
+func TestExecSinkRestart(t *testing.T) {
+	prev := execSinkBackoffBase
+	execSinkBackoffBase = 10 * time.Millisecond
+	t.Cleanup(func() { execSinkBackoffBase = prev })
+
+	s, dir := startTestSink(t, "crash")
+	sendSinkEvents(s, []string{"lost"}, "")
+	testutil.WaitFor(t, "the restart", func() bool { return s.Metrics()["restarts"] > 0 })
+	sendSinkEvents(s, []string{"a", "b"}, "")
+	if !s.Close(10 * time.Second) {
+		t.Fatalf("not flushed: %v", s.Metrics())
+	}
+	if got := sinkEvents(t, dir); strings.Join(got, " ") != "a b EOF" {
+		t.Errorf("sink got %v, want the events after the restart", got)
+	}
+}
+
+// TestExecSinkRefused checks that a sink that refuses the schema version isn't
+// restarted and that events are dropped from then on.
+func TestExecSinkRefused(t *testing.T) {
+	s, dir := startTestSink(t, "v2")
+	testutil.WaitFor(t, "the refusal", func() bool { return s.Metrics()["refused"] == 1 })
+	sendSinkEvents(s, eventIDs(3), "")
+	s.Close(10 * time.Second)
+	if m := s.Metrics(); m["restarts"] != 0 || m["dropped"] != 3 || m["written"] != 0 {
+		t.Errorf("got metrics %v", m)
+	}
+	if got := sinkEvents(t, dir); len(got) != 0 {
+		t.Errorf("sink got %v", got)
+	}
+}
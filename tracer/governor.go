@@ -0,0 +1,314 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"encoding/json"
+	"log/slog"
+	"unicode/utf8"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/cmd/run/capability"
+	"subtrace.dev/cmd/run/journal"
+	"subtrace.dev/event"
+)
+
+// MaxEventBytes bounds the size of a finished event: its HAR entry as JSON,
+// its tags and its correlated log lines. The payload and header limits bound
+// most of an event, but a huge URL, a long log correlation or large previews
+// can still add up to an event the backend rejects, so larger events are cut
+// down field by field in governedFields order. 0 means no limit.
+var MaxEventBytes = 1 << 20
+
+func init() {
+	capability.RegisterLimit("max_event_bytes", func() int64 { return int64(MaxEventBytes) })
+}
+
+// Truncation records that a field of an event was cut down to fit under
+// MaxEventBytes. Events list them in the _truncations field of the HAR entry
+// and, as a JSON array, in the truncations tag.
+type Truncation struct {
+	Field string `json:"field"` // e.g. response.content.text
+	From  int    `json:"from"`  // bytes before
+	To    int    `json:"to"`    // bytes after
+}
+
+// governedField is a part of an event that can be cut down. size is in bytes
+// of content, not of its JSON encoding, and cut leaves at most n of them.
+type governedField struct {
+	name string
+	size func() int
+	cut  func(n int)
+}
+
+// governEvent cuts entry, tags and loglines down to MaxEventBytes if they're
+// larger and returns what's left of loglines. Fields are cut in the order of
+// governedFields, each only as far as needed, so the same event always comes
+// out the same. An event that's still too large once every field is cut is
+// published as it is.
+func governEvent(entry *extendedHarEntry, tags *event.Event, loglines []string) []string {
+	if MaxEventBytes <= 0 || eventSize(entry, tags, loglines) <= MaxEventBytes {
+		return loglines
+	}
+
+	var list []Truncation
+	for _, f := range governedFields(entry, tags, &loglines) {
+		from := f.size()
+		if from == 0 {
+			continue
+		}
+
+		// Account for the field's record while cutting it. To can only go
+		// down from From, so the record doesn't grow when it's filled in.
+		list = append(list, Truncation{Field: f.name, From: from, To: from})
+		setTruncations(entry, tags, list)
+		for {
+			excess := eventSize(entry, tags, loglines) - MaxEventBytes
+			n := f.size()
+			if excess <= 0 || n == 0 {
+				break
+			}
+			f.cut(max(0, n-excess))
+		}
+
+		if to := f.size(); to < from {
+			list[len(list)-1].To = to
+		} else {
+			list = list[:len(list)-1]
+		}
+		setTruncations(entry, tags, list)
+		if eventSize(entry, tags, loglines) <= MaxEventBytes {
+			return loglines
+		}
+	}
+	slog.Debug("event is over the size limit after truncation", "eventID", tags.Get("event_id"), "size", eventSize(entry, tags, loglines), "limit", MaxEventBytes)
+	return loglines
+}
+
+func setTruncations(entry *extendedHarEntry, tags *event.Event, list []Truncation) {
+	if len(list) == 0 {
+		entry.Truncations = nil
+		tags.Set("truncations", "")
+		return
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		panic(err)
+	}
+	entry.Truncations = list
+	tags.Set("truncations", string(b))
+}
+
+// eventSize returns the size of an event as it's published.
+func eventSize(entry *extendedHarEntry, tags *event.Event, loglines []string) int {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return 0 // fails again when the event is encoded
+	}
+	t, _ := json.Marshal(tags.View())
+	n := len(b) + len(t)
+	for _, line := range loglines {
+		n += len(line) + 1
+	}
+	return n
+}
+
+// governedFields returns the fields of an event in the order they're cut:
+// bodies first, then correlated log lines, then body previews, then headers
+// and, as a last resort, the URL.
+func governedFields(entry *extendedHarEntry, tags *event.Event, loglines *[]string) []governedField {
+	var ret []governedField
+	req, resp := entry.Request, entry.Response
+
+	// Bodies.
+	if resp != nil && resp.Content != nil {
+		c := resp.Content
+		ret = append(ret, governedField{"response.content.text", func() int { return len(c.Text) }, func(n int) {
+			if c.Encoding == "" {
+				c.Text = []byte(utf8Prefix(string(c.Text), n))
+			} else {
+				c.Text = c.Text[:n]
+			}
+		}})
+	}
+	if req != nil && req.PostData != nil {
+		pd := req.PostData
+		ret = append(ret, governedField{"request.postData.text", func() int { return len(pd.Text) }, func(n int) { pd.Text = utf8Prefix(pd.Text, n) }})
+		ret = append(ret, governedField{"request.postData.params", func() int { return paramsSize(pd.Params) }, func(n int) {
+			for paramsSize(pd.Params) > n {
+				pd.Params = pd.Params[:len(pd.Params)-1]
+			}
+		}})
+	}
+	if len(entry.WebSocketMessages) > 0 {
+		msgs := entry.WebSocketMessages
+		size := func() int {
+			var n int
+			for _, m := range msgs {
+				n += len(m.Data)
+			}
+			return n
+		}
+		ret = append(ret, governedField{"_webSocketMessages.data", size, func(n int) {
+			// Earlier messages keep their data, later ones lose it first.
+			for _, m := range msgs {
+				if len(m.Data) > n {
+					m.Data, m.Truncated = wsDataPrefix(m, n), true
+				}
+				n -= len(m.Data)
+			}
+		}})
+	}
+
+	// Correlated log lines, of which the earliest are kept.
+	ret = append(ret, governedField{"log.lines", func() int { return linesSize(*loglines) }, func(n int) {
+		for linesSize(*loglines) > n {
+			*loglines = (*loglines)[:len(*loglines)-1]
+		}
+	}})
+	ret = append(ret, governedField{"_logs", func() int { return logsSize(entry.Logs) }, func(n int) {
+		for logsSize(entry.Logs) > n {
+			entry.Logs = entry.Logs[:len(entry.Logs)-1]
+		}
+	}})
+
+	// Previews, which are either kept whole or dropped so that they stay
+	// valid JSON.
+	previews := []struct {
+		prefix  string
+		preview *json.RawMessage
+	}{
+		{"request", &entry.RequestBodyPreview},
+		{"response", &entry.ResponseBodyPreview},
+	}
+	for _, p := range previews {
+		size := func() int { return len(*p.preview) + len(tags.Get(p.prefix+"_body_preview")) }
+		ret = append(ret, governedField{"_" + p.prefix + "BodyPreview", size, func(n int) {
+			if size() > n {
+				*p.preview = nil
+				tags.Set(p.prefix+"_body_preview", "")
+				tags.Set(p.prefix+"_body_preview_status", "")
+			}
+		}})
+	}
+
+	// Headers, of which the first are kept. Cookies repeat the Cookie and
+	// Set-Cookie headers, so they go first.
+	if resp != nil {
+		ret = append(ret, governedField{"response.cookies", cookiesSize(&resp.Cookies), cutCookies(&resp.Cookies)})
+		ret = append(ret, governedField{"response.headers", headersSize(&resp.Headers), cutHeaders(&resp.Headers)})
+	}
+	if req != nil {
+		ret = append(ret, governedField{"request.cookies", cookiesSize(&req.Cookies), cutCookies(&req.Cookies)})
+		ret = append(ret, governedField{"request.headers", headersSize(&req.Headers), cutHeaders(&req.Headers)})
+	}
+
+	// The URL, whose query string is also split into queryString.
+	if req != nil {
+		ret = append(ret, governedField{"request.queryString", func() int { return queryStringSize(req.QueryString) }, func(n int) {
+			for queryStringSize(req.QueryString) > n {
+				req.QueryString = req.QueryString[:len(req.QueryString)-1]
+			}
+		}})
+		ret = append(ret, governedField{"request.url", func() int { return len(req.URL) }, func(n int) { req.URL = utf8Prefix(req.URL, n) }})
+	}
+	if resp != nil {
+		ret = append(ret, governedField{"response.redirectURL", func() int { return len(resp.RedirectURL) }, func(n int) { resp.RedirectURL = utf8Prefix(resp.RedirectURL, n) }})
+	}
+	return ret
+}
+
+// utf8Prefix returns the longest prefix of s of at most n bytes that doesn't
+// end in the middle of a UTF-8 sequence.
+func utf8Prefix(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// wsDataPrefix returns at most n bytes of a websocket message's data that are
+// still base64 or UTF-8, as the message's data was.
+func wsDataPrefix(m *WebsocketMessage, n int) string {
+	if m.Opcode == 0x1 && !m.Compressed {
+		return utf8Prefix(m.Data, n)
+	}
+	return m.Data[:n-n%4]
+}
+
+func linesSize(lines []string) int {
+	var n int
+	for _, line := range lines {
+		n += len(line)
+	}
+	return n
+}
+
+func logsSize(logs []journal.Line) int {
+	var n int
+	for _, line := range logs {
+		n += len(line.Text)
+		for k, v := range line.Fields {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+func paramsSize(params []har.Param) int {
+	var n int
+	for _, p := range params {
+		n += len(p.Name) + len(p.Value) + len(p.Filename) + len(p.ContentType)
+	}
+	return n
+}
+
+func queryStringSize(qs []har.QueryString) int {
+	var n int
+	for _, q := range qs {
+		n += len(q.Name) + len(q.Value)
+	}
+	return n
+}
+
+func headersSize(h *[]har.Header) func() int {
+	return func() int {
+		var n int
+		for _, hdr := range *h {
+			n += len(hdr.Name) + len(hdr.Value)
+		}
+		return n
+	}
+}
+
+func cutHeaders(h *[]har.Header) func(n int) {
+	size := headersSize(h)
+	return func(n int) {
+		for size() > n {
+			*h = (*h)[:len(*h)-1]
+		}
+	}
+}
+
+func cookiesSize(c *[]har.Cookie) func() int {
+	return func() int {
+		var n int
+		for _, cookie := range *c {
+			n += len(cookie.Name) + len(cookie.Value) + len(cookie.Path) + len(cookie.Domain)
+		}
+		return n
+	}
+}
+
+func cutCookies(c *[]har.Cookie) func(n int) {
+	size := cookiesSize(c)
+	return func(n int) {
+		for size() > n {
+			*c = (*c)[:len(*c)-1]
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/cmd/run/journal"
+	"subtrace.dev/event"
+)
+
+// pathologicalEvent returns an event with every kind of field the governor
+// cuts made large.
+func pathologicalEvent(huge int) (*extendedHarEntry, *event.Event, []string) {
+	query := strings.Repeat("q", huge)
+	req := &har.Request{
+		Method:      "POST",
+		URL:         "https://api.example.com/graphql?query=" + query,
+		HTTPVersion: "HTTP/1.1",
+		QueryString: []har.QueryString{{Name: "query", Value: query}},
+		PostData:    &har.PostData{MimeType: "application/json", Text: `{"query":"` + strings.Repeat("é", huge/2) + `"}`},
+	}
+	resp := &har.Response{
+		Status:      200,
+		HTTPVersion: "HTTP/1.1",
+		Content:     &har.Content{MimeType: "application/octet-stream", Encoding: "base64", Text: []byte(strings.Repeat("\x00", huge))},
+		RedirectURL: "https://example.com/" + strings.Repeat("r", huge),
+	}
+	for i := range 200 {
+		req.Headers = append(req.Headers, har.Header{Name: fmt.Sprintf("X-Req-%03d", i), Value: strings.Repeat("h", huge/100)})
+		resp.Headers = append(resp.Headers, har.Header{Name: fmt.Sprintf("X-Resp-%03d", i), Value: strings.Repeat("h", huge/100)})
+		req.Cookies = append(req.Cookies, har.Cookie{Name: fmt.Sprintf("c%03d", i), Value: strings.Repeat("c", huge/200)})
+	}
+	preview := json.RawMessage(`{"data":"` + strings.Repeat("p", huge) + `"}`)
+	entry := &extendedHarEntry{
+		Entry:               &har.Entry{ID: "e1", Request: req, Response: resp, Timings: &har.Timings{}},
+		RequestBodyPreview:  preview,
+		ResponseBodyPreview: preview,
+		WebSocketMessages: []*WebsocketMessage{
+			{Type: "send", Opcode: 0x1, Data: strings.Repeat("ü", huge/4)},
+			{Type: "receive", Opcode: 0x2, Data: strings.Repeat("QUJD", huge/8)},
+		},
+	}
+
+	tags := event.New()
+	tags.Set("event_id", "e1")
+	tags.Set("time", "2026-01-02T03:04:05Z")
+	tags.Set("request_body_preview", string(preview))
+	tags.Set("request_body_preview_status", previewComplete)
+	tags.Set("response_body_preview", string(preview))
+	tags.Set("response_body_preview_status", previewComplete)
+
+	var loglines []string
+	for i := range 1000 {
+		loglines = append(loglines, fmt.Sprintf("%04d %s", i, strings.Repeat("l", huge/500)))
+		entry.Logs = append(entry.Logs, journal.Line{Time: time.Unix(int64(i), 0).UTC(), Stream: "stdout", Text: loglines[i]})
+	}
+	return entry, tags, loglines
+}
+
+func governed(t *testing.T, limit int, entry *extendedHarEntry, tags *event.Event, loglines []string) ([]byte, map[string]string, []string, []Truncation) {
+	prev := MaxEventBytes
+	MaxEventBytes = limit
+	t.Cleanup(func() { MaxEventBytes = prev })
+
+	loglines = governEvent(entry, tags, loglines)
+	if size := eventSize(entry, tags, loglines); size > limit {
+		t.Errorf("limit %d: got a %d byte event", limit, size)
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("limit %d: encode: %v", limit, err)
+	}
+	if !json.Valid(b) {
+		t.Fatalf("limit %d: got invalid JSON", limit)
+	}
+	return b, tags.Map(), loglines, entry.Truncations
+}
+
+func TestGovernEvent(t *testing.T) {
+	const huge = 256 << 10
+	order := []string{
+		"response.content.text", "request.postData.text", "_webSocketMessages.data",
+		"log.lines", "_logs", "_requestBodyPreview", "_responseBodyPreview",
+		"response.headers", "request.cookies", "request.headers",
+		"request.queryString", "request.url", "response.redirectURL",
+	}
+	for _, limit := range []int{16 << 20, 2 << 20, 512 << 10, 64 << 10, 8 << 10} {
+		t.Run(fmt.Sprintf("%d", limit), func(t *testing.T) {
+			run := func() ([]byte, map[string]string, []string, []Truncation) {
+				entry, tags, loglines := pathologicalEvent(huge)
+				return governed(t, limit, entry, tags, loglines)
+			}
+			b, tags, loglines, list := run()
+			if again, _, _, _ := run(); string(again) != string(b) {
+				t.Errorf("got different entries for the same event")
+			}
+
+			// Fields are cut in priority order, all but the last in full.
+			var fields []string
+			for i, tr := range list {
+				fields = append(fields, tr.Field)
+				if tr.To >= tr.From {
+					t.Errorf("%s: got a truncation from %d to %d bytes", tr.Field, tr.From, tr.To)
+				}
+				if i < len(list)-1 && tr.To != 0 {
+					t.Errorf("%s: cut to %d bytes before a later field was cut", tr.Field, tr.To)
+				}
+			}
+			if !slices.IsSortedFunc(fields, func(a, b string) int { return slices.Index(order, a) - slices.Index(order, b) }) {
+				t.Errorf("got fields cut in order %v", fields)
+			}
+
+			if limit >= 16<<20 {
+				if len(list) != 0 || tags["truncations"] != "" || len(loglines) != 1000 {
+					t.Errorf("got %v for an event under the limit", list)
+				}
+				return
+			}
+			var tagged []Truncation
+			if err := json.Unmarshal([]byte(tags["truncations"]), &tagged); err != nil || !slices.Equal(tagged, list) {
+				t.Errorf("got truncations tag %q, want %v", tags["truncations"], list)
+			}
+
+			var entry struct {
+				Request struct {
+					PostData struct {
+						Text string `json:"text"`
+					} `json:"postData"`
+				} `json:"request"`
+				RequestBodyPreview json.RawMessage `json:"_requestBodyPreview"`
+				WebSocketMessages  []struct {
+					Data string `json:"data"`
+				} `json:"_webSocketMessages"`
+			}
+			if err := json.Unmarshal(b, &entry); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if strings.ContainsRune(entry.Request.PostData.Text, '�') {
+				t.Errorf("body cut in the middle of a UTF-8 sequence")
+			}
+			if len(entry.WebSocketMessages) == 2 && len(entry.WebSocketMessages[1].Data)%4 != 0 {
+				t.Errorf("base64 websocket data cut to %d bytes", len(entry.WebSocketMessages[1].Data))
+			}
+			if p := tags["request_body_preview"]; p != "" && !json.Valid([]byte(p)) {
+				t.Errorf("got invalid preview tag")
+			}
+		})
+	}
+}
+
+// TestGovernEventBodiesFirst checks that an event whose bodies alone put it
+// over the limit keeps everything else.
+func TestGovernEventBodiesFirst(t *testing.T) {
+	entry, tags, loglines := pathologicalEvent(1 << 10)
+	entry.Response.Content.Text = []byte(strings.Repeat("x", 1<<20))
+	entry.Request.PostData.Text = strings.Repeat("y", 1<<20)
+	_, kept, loglines, list := governed(t, 256<<10, entry, tags, loglines)
+	for _, tr := range list {
+		if tr.Field != "response.content.text" && tr.Field != "request.postData.text" {
+			t.Errorf("got %s cut", tr.Field)
+		}
+	}
+	if len(list) != 2 || len(loglines) != 1000 || kept["request_body_preview"] == "" {
+		t.Errorf("got %v cut and %d log lines", list, len(loglines))
+	}
+}
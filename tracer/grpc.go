@@ -0,0 +1,190 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/event"
+)
+
+// isGRPC reports whether contentType is one of gRPC's: application/grpc,
+// optionally followed by +proto, +json or another message codec.
+func isGRPC(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/grpc" || strings.HasPrefix(mt, "application/grpc+")
+}
+
+// isGRPCProto reports whether the messages of a gRPC body are protobufs.
+func isGRPCProto(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return mt == "application/grpc" || mt == "application/grpc+proto"
+}
+
+// grpcCodes are the names of the gRPC status codes.
+var grpcCodes = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED",
+	"NOT_FOUND", "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+// grpcFrames counts the length-prefixed messages of a gRPC body as it's read.
+// A message counts once all of it has been read.
+type grpcFrames struct {
+	count  int
+	header [5]byte
+	filled int   // bytes of header read so far
+	left   int64 // bytes of the current message's payload yet to be read
+}
+
+func (f *grpcFrames) Write(b []byte) {
+	for len(b) > 0 {
+		if f.filled < len(f.header) {
+			n := copy(f.header[f.filled:], b)
+			f.filled += n
+			b = b[n:]
+			if f.filled < len(f.header) {
+				return
+			}
+			f.left = int64(binary.BigEndian.Uint32(f.header[1:]))
+		} else {
+			n := min(int64(len(b)), f.left)
+			f.left -= n
+			b = b[n:]
+		}
+		if f.left == 0 {
+			f.count++
+			f.filled = 0
+		}
+	}
+}
+
+// GRPCCall is what a gRPC exchange was about, recorded in the HAR entry since
+// the request line and status of every call are the same.
+type GRPCCall struct {
+	Service          string `json:"service"`
+	Method           string `json:"method"` // full method name: /package.Service/Method
+	Code             *int   `json:"code,omitempty"`
+	Status           string `json:"status,omitempty"` // name of Code
+	Message          string `json:"message,omitempty"`
+	RequestMessages  int    `json:"requestMessages"`
+	ResponseMessages int    `json:"responseMessages"`
+}
+
+// Summary returns the call as shown in logs: "grpc OK /users.UserService/GetUser".
+func (c *GRPCCall) Summary() string {
+	status := c.Status
+	if status == "" {
+		status = "-" // the call didn't finish
+	}
+	return fmt.Sprintf("grpc %s %s", status, c.Method)
+}
+
+// grpcCall returns the gRPC call of the exchange, or nil if it isn't one.
+func (p *Parser) grpcCall() *GRPCCall {
+	if p.request == nil || (p.requestGRPC == nil && p.responseGRPC == nil) {
+		return nil
+	}
+
+	c := &GRPCCall{Method: "/"}
+	if u, err := url.Parse(p.request.URL); err == nil {
+		c.Method = u.Path
+	}
+	if service, _, ok := strings.Cut(strings.TrimPrefix(c.Method, "/"), "/"); ok {
+		c.Service = service
+	}
+	if p.requestGRPC != nil {
+		c.RequestMessages = p.requestGRPC.count
+	}
+	if p.responseGRPC != nil {
+		c.ResponseMessages = p.responseGRPC.count
+	}
+
+	// The status is in the trailers, or in the headers of a response that has
+	// nothing but headers.
+	status, message := p.responseTrailer.Get("grpc-status"), p.responseTrailer.Get("grpc-message")
+	if status == "" && p.response != nil {
+		status, message = harHeader(p.response.Headers, "grpc-status"), harHeader(p.response.Headers, "grpc-message")
+	}
+	if code, err := strconv.Atoi(status); err == nil && code >= 0 {
+		c.Code = &code
+		c.Status = fmt.Sprintf("CODE_%d", code)
+		if code < len(grpcCodes) {
+			c.Status = grpcCodes[code]
+		}
+	}
+	if m, err := url.PathUnescape(message); err == nil {
+		message = m
+	}
+	c.Message = message
+	return c
+}
+
+func harHeader(headers []har.Header, name string) string {
+	for _, hdr := range headers {
+		if strings.EqualFold(hdr.Name, name) {
+			return hdr.Value
+		}
+	}
+	return ""
+}
+
+// setGRPCTags tags the event with the gRPC method, status and message counts
+// so that calls can be filtered without looking at the HAR entry.
+func setGRPCTags(tags *event.Event, c *GRPCCall) {
+	if c == nil {
+		return
+	}
+	tags.Set("grpc_service", c.Service)
+	tags.Set("grpc_method", c.Method)
+	if c.Code != nil {
+		tags.Set("grpc_status", c.Status)
+		tags.Set("grpc_status_code", fmt.Sprintf("%d", *c.Code))
+	}
+	if c.Message != "" {
+		tags.Set("grpc_message", c.Message)
+	}
+	tags.Set("grpc_request_messages", fmt.Sprintf("%d", c.RequestMessages))
+	tags.Set("grpc_response_messages", fmt.Sprintf("%d", c.ResponseMessages))
+}
+
+// newGRPCFrames returns a message counter for the body if header says it's a
+// gRPC one.
+func newGRPCFrames(header http.Header) *grpcFrames {
+	if !isGRPC(header.Get("content-type")) {
+		return nil
+	}
+	return new(grpcFrames)
+}
+
+// decompressGRPC decompresses a message compressed with encoding, as long as
+// it's no larger than PayloadLimitBytes once decompressed.
+func decompressGRPC(encoding string, msg []byte) ([]byte, bool) {
+	if encoding != "gzip" {
+		return nil, false
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, false
+	}
+	raw, err := io.ReadAll(io.LimitReader(gr, PayloadLimitBytes+1))
+	if err != nil || int64(len(raw)) > PayloadLimitBytes {
+		return nil, false
+	}
+	return raw, true
+}
@@ -0,0 +1,146 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/martian/v3/har"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// grpcMessage frames msg as a length-prefixed gRPC message.
+func grpcMessage(compressed bool, msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	if compressed {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+func TestGRPCFrames(t *testing.T) {
+	var body []byte
+	for _, msg := range []string{"hello", "", strings.Repeat("x", 300)} {
+		body = append(body, grpcMessage(false, []byte(msg))...)
+	}
+
+	for _, chunk := range []int{1, 3, 7, len(body)} {
+		var f grpcFrames
+		for b := body; len(b) > 0; {
+			n := min(chunk, len(b))
+			f.Write(b[:n])
+			b = b[n:]
+		}
+		if f.count != 3 {
+			t.Errorf("chunk %d: got %d messages, want 3", chunk, f.count)
+		}
+	}
+
+	// A message cut short doesn't count.
+	var f grpcFrames
+	f.Write(body[:len(body)-1])
+	if f.count != 2 {
+		t.Errorf("got %d messages for a truncated body, want 2", f.count)
+	}
+}
+
+func TestIsGRPC(t *testing.T) {
+	for ct, want := range map[string]bool{
+		"application/grpc":                true,
+		"application/grpc+proto":          true,
+		"application/grpc+json":           true,
+		"application/grpc; charset=utf-8": true,
+		"application/grpc-web":            false,
+		"application/json":                false,
+		"":                                false,
+	} {
+		if got := isGRPC(ct); got != want {
+			t.Errorf("isGRPC(%q) = %v, want %v", ct, got, want)
+		}
+	}
+}
+
+func TestGRPCCall(t *testing.T) {
+	p := &Parser{
+		request:      &har.Request{Method: "POST", URL: "http://localhost:50051/users.UserService/ListUsers"},
+		response:     &har.Response{Status: 200},
+		requestGRPC:  &grpcFrames{count: 1},
+		responseGRPC: &grpcFrames{count: 3},
+	}
+	p.SetResponseTrailer(http.Header{"Grpc-Status": {"5"}, "Grpc-Message": {"user%20not%20found"}})
+
+	c := p.grpcCall()
+	if c == nil {
+		t.Fatalf("got no call")
+	}
+	if c.Service != "users.UserService" || c.Method != "/users.UserService/ListUsers" {
+		t.Errorf("got service %q method %q", c.Service, c.Method)
+	}
+	if c.Code == nil || *c.Code != 5 || c.Status != "NOT_FOUND" || c.Message != "user not found" {
+		t.Errorf("got code %v status %q message %q", c.Code, c.Status, c.Message)
+	}
+	if c.RequestMessages != 1 || c.ResponseMessages != 3 {
+		t.Errorf("got %d request and %d response messages", c.RequestMessages, c.ResponseMessages)
+	}
+	if got := c.Summary(); got != "grpc NOT_FOUND /users.UserService/ListUsers" {
+		t.Errorf("got summary %q", got)
+	}
+
+	// A trailers-only response has its status in the headers.
+	p.responseTrailer = nil
+	p.response.Headers = []har.Header{{Name: "grpc-status", Value: "0"}}
+	if c := p.grpcCall(); c.Status != "OK" || c.Summary() != "grpc OK /users.UserService/ListUsers" {
+		t.Errorf("got status %q for a trailers-only response", c.Status)
+	}
+
+	p.response.Headers = nil
+	if c := p.grpcCall(); c.Code != nil || c.Summary() != "grpc - /users.UserService/ListUsers" {
+		t.Errorf("got code %v summary %q for an unfinished call", c.Code, c.Summary())
+	}
+
+	if c := (&Parser{request: p.request}).grpcCall(); c != nil {
+		t.Errorf("got call %+v for a plain HTTP exchange", c)
+	}
+}
+
+func TestJSONifyGRPCGzip(t *testing.T) {
+	t.Setenv("SUBTRACE_GRPC", "1")
+
+	msg := protowire.AppendTag(nil, 1, protowire.BytesType)
+	msg = protowire.AppendString(msg, "alice")
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(msg)
+	gw.Close()
+
+	large := protowire.AppendTag(nil, 1, protowire.BytesType)
+	large = protowire.AppendString(large, strings.Repeat("x", int(PayloadLimitBytes)))
+	var lbuf bytes.Buffer
+	gw = gzip.NewWriter(&lbuf)
+	gw.Write(large)
+	gw.Close()
+
+	body := append(grpcMessage(true, buf.Bytes()), grpcMessage(true, lbuf.Bytes())...)
+	b, ok := jsonify("application/grpc+proto", "gzip", body)
+	if !ok {
+		t.Fatalf("jsonify failed")
+	}
+	var got []map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("decode %s: %v", b, err)
+	}
+	if len(got) != 2 || got[0]["1"] != "alice" {
+		t.Fatalf("got %s, want the first message decoded", b)
+	}
+	if _, ok := got[1]["_comp"]; !ok {
+		t.Errorf("got %v, want the message larger than the payload limit left compressed", got[1])
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/cmd/version"
+)
+
+// DefaultHARFile is the HAR file every event that isn't excluded by a filter is
+// written to, if any. It must be set before any events are produced.
+var DefaultHARFile *HARFile
+
+// HARFile writes events as the entries of a HAR 1.2 log that browsers and
+// tools like Fiddler can import. The file ends with the closing brackets of
+// the log after every entry so that it's valid JSON even if subtrace is killed
+// before it's closed.
+type HARFile struct {
+	mu  sync.Mutex
+	f   *os.File
+	end int64 // offset of the trailer
+	n   int
+}
+
+const harFileTrailer = "\n]}}\n"
+
+func CreateHARFile(path string) (*HARFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("create HAR file: %w", err)
+	}
+	creator, err := json.Marshal(har.Creator{Name: "subtrace", Version: version.Release})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("encode HAR creator: %w", err)
+	}
+	header := `{"log":{"version":"1.2","creator":` + string(creator) + `,"pages":[],"entries":[`
+	if _, err := f.WriteString(header + harFileTrailer); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("write HAR file: %w", err)
+	}
+	return &HARFile{f: f, end: int64(len(header))}, nil
+}
+
+// harFileTimings adds the optional HAR timings to the ones that are always
+// recorded. -1 means that a phase doesn't apply to the entry.
+type harFileTimings struct {
+	Blocked int64 `json:"blocked"`
+	DNS     int64 `json:"dns"`
+	Connect int64 `json:"connect"`
+	SSL     int64 `json:"ssl"`
+	*har.Timings
+}
+
+// harFileEntry overrides the fields of an entry that must be set in a HAR
+// file but aren't in events.
+type harFileEntry struct {
+	*extendedHarEntry
+	Cache   *har.Cache     `json:"cache"`
+	Timings harFileTimings `json:"timings"`
+}
+
+// Write appends an entry. connect is how long it took to connect to the
+// server, or -1 if the entry reused a connection, and dns is how long looking
+// up its address took, or -1 if no lookup is attributed to the entry. Failures are logged and
+// otherwise ignored so that the file can never fail the event pipeline.
+func (h *HARFile) Write(entry *extendedHarEntry, connect int64, dns int64) {
+	timings := entry.Timings
+	if timings == nil {
+		timings = new(har.Timings)
+	}
+	b, err := json.Marshal(harFileEntry{
+		extendedHarEntry: entry,
+		Cache:            new(har.Cache),
+		Timings:          harFileTimings{Blocked: -1, DNS: dns, Connect: connect, SSL: -1, Timings: timings},
+	})
+	if err != nil {
+		slog.Error("failed to encode HAR file entry", "eventID", entry.ID, "err", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep := "\n"
+	if h.n > 0 {
+		sep = ",\n"
+	}
+	buf := make([]byte, 0, len(sep)+len(b)+len(harFileTrailer))
+	buf = append(append(append(buf, sep...), b...), harFileTrailer...)
+	if _, err := h.f.WriteAt(buf, h.end); err != nil {
+		slog.Error("failed to write HAR file", "path", h.f.Name(), "eventID", entry.ID, "err", err)
+		return
+	}
+	h.end += int64(len(sep) + len(b))
+	h.n++
+}
+
+func (h *HARFile) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.f.Close()
+}
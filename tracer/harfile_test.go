@@ -0,0 +1,92 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/har"
+)
+
+func TestHARFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.har")
+	h, err := CreateHARFile(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer h.Close()
+
+	type harLog struct {
+		Log struct {
+			Version string      `json:"version"`
+			Creator har.Creator `json:"creator"`
+			Entries []struct {
+				ID       string           `json:"_id"`
+				Request  har.Request      `json:"request"`
+				Cache    json.RawMessage  `json:"cache"`
+				Timings  map[string]int64 `json:"timings"`
+				Chunks   json.RawMessage  `json:"_responseChunks"`
+				Response har.Response     `json:"response"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	read := func() harLog {
+		t.Helper()
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var l harLog
+		if err := json.Unmarshal(b, &l); err != nil {
+			t.Fatalf("the file isn't valid JSON: %v\n%s", err, b)
+		}
+		return l
+	}
+
+	if l := read(); l.Log.Version != "1.2" || l.Log.Creator.Name != "subtrace" || len(l.Log.Entries) != 0 {
+		t.Fatalf("got empty log %+v", l)
+	}
+
+	for i, id := range []string{"first", "second"} {
+		entry := &extendedHarEntry{
+			Entry: &har.Entry{
+				ID:              id,
+				StartedDateTime: time.Now(),
+				Request:         &har.Request{Method: "GET", URL: "http://example.com/" + id},
+				Response:        &har.Response{Status: 200},
+				Timings:         &har.Timings{Send: 1, Wait: 2, Receive: 3},
+			},
+			ResponseChunks: &ChunkTimings{Count: 2},
+		}
+		connect, dns := int64(-1), int64(-1)
+		if i == 0 {
+			connect, dns = 5, 7
+		}
+		h.Write(entry, connect, dns)
+
+		// The file must be complete after every entry in case subtrace is killed.
+		l := read()
+		if len(l.Log.Entries) != i+1 {
+			t.Fatalf("got %d entries, want %d", len(l.Log.Entries), i+1)
+		}
+		e := l.Log.Entries[i]
+		if e.ID != id || e.Request.URL != "http://example.com/"+id || e.Response.Status != 200 {
+			t.Errorf("got entry %+v", e)
+		}
+		if string(e.Cache) != "{}" || e.Chunks == nil {
+			t.Errorf("got cache %s and chunks %s, want an empty cache and the extensions kept", e.Cache, e.Chunks)
+		}
+		want := map[string]int64{"blocked": -1, "dns": dns, "connect": connect, "ssl": -1, "send": 1, "wait": 2, "receive": 3}
+		for k, v := range want {
+			if e.Timings[k] != v {
+				t.Errorf("got timings %v, want %v", e.Timings, want)
+				break
+			}
+		}
+	}
+}
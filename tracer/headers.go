@@ -0,0 +1,135 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+
+	"subtrace.dev/cmd/run/capability"
+	"subtrace.dev/event"
+)
+
+// Header limits bound what's captured of a header section (the headers or
+// trailers of a request or response) so that a peer sending thousands of
+// headers or megabyte-sized values can't blow up the tracer's memory or every
+// event it publishes. Headers past the limits are left out of the capture and
+// oversized values are cut short. The forwarded traffic is never changed.
+var (
+	MaxHeaderCount      = 256      // headers per section
+	MaxHeaderBytes      = 16 << 10 // name and value of a single header
+	MaxHeaderTotalBytes = 64 << 10 // names and values of a section
+)
+
+func init() {
+	capability.RegisterLimit("max_header_count", func() int64 { return int64(MaxHeaderCount) })
+	capability.RegisterLimit("max_header_bytes", func() int64 { return int64(MaxHeaderBytes) })
+	capability.RegisterLimit("max_header_total_bytes", func() int64 { return int64(MaxHeaderTotalBytes) })
+}
+
+// HeaderBudget applies the header limits to the headers of one section in the
+// order they're read.
+type HeaderBudget struct {
+	count int
+	total int
+
+	Dropped   int // headers left out entirely
+	Truncated int // headers whose value was cut short
+}
+
+// Admit returns the value to capture for a header and false if the header
+// must be left out.
+func (b *HeaderBudget) Admit(name, value string) (string, bool) {
+	if b.count >= MaxHeaderCount || len(name) >= MaxHeaderBytes || b.total+len(name) >= MaxHeaderTotalBytes {
+		b.Dropped++
+		return "", false
+	}
+	limit := min(MaxHeaderBytes, MaxHeaderTotalBytes-b.total) - len(name)
+	if len(value) > limit {
+		value = value[:limit]
+		b.Truncated++
+	}
+	b.count++
+	b.total += len(name) + len(value)
+	return value, true
+}
+
+// Add records what another budget left out.
+func (b *HeaderBudget) Add(o HeaderBudget) {
+	b.Dropped += o.Dropped
+	b.Truncated += o.Truncated
+}
+
+// limitHeader returns h if it fits the header limits and otherwise a copy
+// without the headers past them. Since http.Header doesn't keep the order the
+// headers were sent in, they're admitted in order of name.
+func limitHeader(h http.Header) (http.Header, HeaderBudget) {
+	var b HeaderBudget
+	n, size := 0, 0
+	for name, values := range h {
+		n += len(values)
+		for _, v := range values {
+			size += len(name) + len(v)
+		}
+	}
+	if n <= MaxHeaderCount && size <= MaxHeaderTotalBytes && !hasLargeHeader(h) {
+		return h, b
+	}
+
+	ret := make(http.Header)
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		for _, v := range h[name] {
+			if v, ok := b.Admit(name, v); ok {
+				ret[name] = append(ret[name], v)
+			}
+		}
+	}
+	return ret, b
+}
+
+func hasLargeHeader(h http.Header) bool {
+	for name, values := range h {
+		for _, v := range values {
+			if len(name)+len(v) > MaxHeaderBytes {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TrimmedHeaders records the headers of a section that were left out or cut
+// short while they were being read, before the parser got them.
+func (p *Parser) TrimmedHeaders(isRequest, isTrailer bool, b HeaderBudget) {
+	p.headerTrims(isRequest, isTrailer).Add(b)
+}
+
+func (p *Parser) headerTrims(isRequest, isTrailer bool) *HeaderBudget {
+	switch {
+	case isRequest && !isTrailer:
+		return &p.requestHeaders
+	case isRequest:
+		return &p.requestTrailers
+	case !isTrailer:
+		return &p.responseHeaders
+	default:
+		return &p.responseTrailers
+	}
+}
+
+// setHeaderTags flags the event if a section lost headers to the limits.
+func setHeaderTags(tags *event.Event, prefix string, b HeaderBudget) {
+	if b.Dropped == 0 && b.Truncated == 0 {
+		return
+	}
+	tags.Set(prefix+"_truncated", "true")
+	if b.Dropped > 0 {
+		tags.Set(prefix+"_dropped", fmt.Sprintf("%d", b.Dropped))
+	}
+	if b.Truncated > 0 {
+		tags.Set(prefix+"_values_truncated", fmt.Sprintf("%d", b.Truncated))
+	}
+}
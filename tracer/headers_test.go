@@ -0,0 +1,57 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLimitHeader(t *testing.T) {
+	many := make(http.Header)
+	for i := range 1000 {
+		many.Set(fmt.Sprintf("X-Header-%04d", i), "v")
+	}
+	large := make(http.Header)
+	for i := range 8 {
+		large.Set(fmt.Sprintf("X-Large-%d", i), strings.Repeat("x", 12<<10))
+	}
+
+	for _, tt := range []struct {
+		name      string
+		h         http.Header
+		count     int
+		dropped   int
+		truncated int
+	}{
+		{name: "small", h: http.Header{"Host": {"example.com"}, "Accept": {"*/*"}}, count: 2},
+		{name: "count", h: many, count: MaxHeaderCount, dropped: 1000 - MaxHeaderCount},
+		{name: "value", h: http.Header{"Cookie": {strings.Repeat("c", 1<<20)}}, count: 1, truncated: 1},
+		// Five 12 KiB values fit in 64 KiB, the sixth is cut short and there's
+		// no room for the rest.
+		{name: "total", h: large, count: 6, dropped: 2, truncated: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, b := limitHeader(tt.h)
+			n, size := 0, 0
+			for name, values := range got {
+				n += len(values)
+				for _, v := range values {
+					if len(name)+len(v) > MaxHeaderBytes {
+						t.Errorf("got a %d byte %s header", len(name)+len(v), name)
+					}
+					size += len(name) + len(v)
+				}
+			}
+			if n != tt.count || b.Dropped != tt.dropped || b.Truncated != tt.truncated {
+				t.Errorf("got %d headers, %d dropped and %d truncated, want %d, %d and %d", n, b.Dropped, b.Truncated, tt.count, tt.dropped, tt.truncated)
+			}
+			if size > MaxHeaderTotalBytes {
+				t.Errorf("got %d header bytes, want at most %d", size, MaxHeaderTotalBytes)
+			}
+		})
+	}
+}
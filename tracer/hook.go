@@ -0,0 +1,143 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"golang.org/x/time/rate"
+	"subtrace.dev/filter"
+)
+
+const (
+	hookConcurrency = 4
+	hookRate        = 10 // executions per second
+	hookTimeout     = 30 * time.Second
+)
+
+// DefaultHook is the exec hook run for matching events, if any. It must be set
+// before any events are produced.
+var DefaultHook *ExecHook
+
+// ExecHook runs a shell command for every event that matches a filter with the
+// event's HAR entry JSON on stdin. Executions are rate-limited and bounded in
+// concurrency; events that arrive while the hook is saturated are dropped so
+// that the hook can never block the event pipeline.
+type ExecHook struct {
+	command string
+	filter  *filter.Filter
+	dryRun  bool
+
+	sem     chan struct{}
+	limiter *rate.Limiter
+	dropped atomic.Uint64
+}
+
+func NewExecHook(command string, expr string, dryRun bool) (*ExecHook, error) {
+	if expr == "" {
+		expr = "true"
+	}
+	f, err := filter.NewFilter(expr, filter.ActionInclude)
+	if err != nil {
+		return nil, fmt.Errorf("parse filter: %w", err)
+	}
+
+	return &ExecHook{
+		command: command,
+		filter:  f,
+		dryRun:  dryRun,
+
+		sem:     make(chan struct{}, hookConcurrency),
+		limiter: rate.NewLimiter(hookRate, hookRate),
+	}, nil
+}
+
+// Handle runs the hook for the event if it matches. It never blocks on the
+// spawned command.
+func (h *ExecHook) Handle(tags map[string]string, entry *har.Entry, json []byte) {
+	match, err := h.filter.Eval(tags, entry)
+	if err != nil {
+		slog.Debug("failed to evaluate exec hook filter", "eventID", tags["event_id"], "err", err)
+		return
+	}
+	if !match {
+		return
+	}
+
+	if !h.limiter.Allow() {
+		h.drop(tags["event_id"], "rate limited")
+		return
+	}
+
+	select {
+	case h.sem <- struct{}{}:
+	default:
+		h.drop(tags["event_id"], "too many running")
+		return
+	}
+
+	go func() {
+		defer func() { <-h.sem }()
+		h.run(tags["event_id"], json)
+	}()
+}
+
+func (h *ExecHook) drop(eventID string, reason string) {
+	n := h.dropped.Add(1)
+	slog.Debug("dropped exec hook event", "eventID", eventID, "reason", reason, "dropped", n)
+}
+
+func (h *ExecHook) run(eventID string, json []byte) {
+	if h.dryRun {
+		fmt.Fprintf(os.Stderr, "subtrace: on-event: would run %q with event %s (%d bytes) on stdin\n", h.command, eventID, len(json))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	// The tracer isn't seccomp-filtered, so commands spawned from here are
+	// never traced themselves.
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.command)
+	cmd.Stdin = bytes.NewReader(json)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = hookEnviron(eventID)
+
+	start := time.Now()
+	err := cmd.Run()
+	slog.Debug("ran exec hook", "eventID", eventID, "err", err, "took", time.Since(start).Round(time.Microsecond))
+	if err != nil {
+		slog.Error("exec hook failed", "eventID", eventID, "err", err)
+	}
+}
+
+// hookEnviron returns the environment of the hook run for an event.
+func hookEnviron(eventID string) []string {
+	return append(subprocessEnviron(), "SUBTRACE_EVENT_ID="+eventID)
+}
+
+// subprocessEnviron returns the tracer's environment without subtrace's
+// internal variables and credentials.
+func subprocessEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch k, _, _ := strings.Cut(kv, "="); {
+		case strings.HasPrefix(k, "_SUBTRACE_"):
+		case k == "SUBTRACE_TOKEN", k == "SUBTRACE_ORIG_GODEBUG":
+		default:
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,39 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"subtrace.dev/event"
+)
+
+// Intervention records a change that subtrace made to a connection's traffic
+// or behavior instead of only observing it (e.g. a rewritten request header).
+type Intervention struct {
+	Feature string `json:"feature"`
+	Rule    string `json:"rule,omitempty"`
+	Summary string `json:"summary"`
+}
+
+// AddIntervention appends iv to the interventions tag of ev, which holds a
+// JSON array of every intervention on the connection or exchange. Events
+// without the tag were only observed.
+func AddIntervention(ev *event.Event, iv Intervention) {
+	var list []Intervention
+	if prev := ev.Get("interventions"); prev != "" {
+		if err := json.Unmarshal([]byte(prev), &list); err != nil {
+			slog.Debug("failed to decode interventions tag", "err", err) // not fatal: start over
+			list = nil
+		}
+	}
+	list = append(list, iv)
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		panic(err)
+	}
+	ev.Set("interventions", string(b))
+}
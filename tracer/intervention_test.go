@@ -0,0 +1,47 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/event"
+)
+
+func TestAddIntervention(t *testing.T) {
+	conn := event.New()
+	if conn.Get("interventions") != "" {
+		t.Fatalf("new event has interventions")
+	}
+	AddIntervention(conn, Intervention{Feature: "dial_retry", Summary: "connect retried 2 times after transient errors"})
+
+	// Exchange events start from the connection's template and add their own.
+	exchange := conn.Copy()
+	AddIntervention(exchange, Intervention{Feature: "request_rewrite", Rule: "staging", Summary: "set-header X-Env"})
+
+	var got []Intervention
+	if err := json.Unmarshal([]byte(exchange.Get("interventions")), &got); err != nil {
+		t.Fatalf("decode interventions: %v", err)
+	}
+	if len(got) != 2 || got[0].Feature != "dial_retry" || got[1].Feature != "request_rewrite" || got[1].Rule != "staging" {
+		t.Errorf("got %+v, want dial_retry then request_rewrite", got)
+	}
+	if n := len(conn.Get("interventions")); n == len(exchange.Get("interventions")) {
+		t.Errorf("exchange intervention leaked into the connection template")
+	}
+
+	entry := &extendedHarEntry{Entry: &har.Entry{}, Interventions: json.RawMessage(exchange.Get("interventions"))}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("encode entry: %v", err)
+	}
+	var decoded struct {
+		Interventions []Intervention `json:"_interventions"`
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil || len(decoded.Interventions) != 2 {
+		t.Errorf("got HAR entry %s, want _interventions with 2 entries", b)
+	}
+}
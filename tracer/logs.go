@@ -0,0 +1,63 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"net/http"
+	"time"
+
+	"subtrace.dev/cmd/run/journal"
+)
+
+// RequestIDHeader is the header whose value, in a request or its response,
+// ties the -tracelogs lines that contain it to the request's event and keeps
+// them out of the events of concurrent requests. Empty to turn it off.
+var RequestIDHeader = "X-Request-Id"
+
+// minRequestIDLen is the length below which a request ID would match too many
+// unrelated lines to be tracked.
+const minRequestIDLen = 6
+
+func (p *Parser) journal() *journal.Journal {
+	if !journal.Enabled {
+		return nil
+	}
+	return p.global.Journal
+}
+
+// trackRequestID starts tracking the request ID in h, if it has one and the
+// exchange doesn't have one yet.
+func (p *Parser) trackRequestID(h http.Header) {
+	j := p.journal()
+	if j == nil || RequestIDHeader == "" {
+		return
+	}
+	id := h.Get(RequestIDHeader)
+	if len(id) < minRequestIDLen {
+		return
+	}
+
+	p.requestIDMu.Lock()
+	defer p.requestIDMu.Unlock()
+	if p.requestID == "" {
+		p.requestID, p.untrack = id, j.Track(id)
+	}
+}
+
+// correlateLogs returns the lines the traced command wrote while the exchange
+// was in flight, as attached to its event, and the exchange's request ID. It
+// stops tracking the request ID.
+func (p *Parser) correlateLogs() ([]journal.Line, string) {
+	j := p.journal()
+	if j == nil {
+		return nil, ""
+	}
+
+	p.requestIDMu.Lock()
+	defer p.requestIDMu.Unlock()
+	if p.untrack != nil {
+		defer p.untrack()
+	}
+	return j.Between(p.begin, time.Now(), p.requestID), p.requestID
+}
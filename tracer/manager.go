@@ -8,7 +8,6 @@ import (
 	"log/slog"
 	"math/rand"
 	"net/http"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -182,7 +181,7 @@ func (b *block) flushOnce(ctx context.Context) error {
 }
 
 func (b *block) flush(ctx context.Context) error {
-	if os.Getenv("SUBTRACE_TOKEN") == "" {
+	if rpc.Token() == "" {
 		return nil
 	}
 
@@ -207,10 +206,17 @@ type Manager struct {
 	pool sync.Pool
 	cur  atomic.Pointer[block]
 	log  atomic.Bool
+
+	// dirty is signalled on insert so that the background flush loop can sleep
+	// without a ticker while there are no events.
+	dirty chan struct{}
 }
 
 func newManager() *Manager {
-	m := &Manager{pool: sync.Pool{New: func() any { return new(block) }}}
+	m := &Manager{
+		pool:  sync.Pool{New: func() any { return new(block) }},
+		dirty: make(chan struct{}, 1),
+	}
 	m.cur.Store(m.pool.Get().(*block))
 	return m
 }
@@ -236,6 +242,10 @@ func (m *Manager) Insert(event string) {
 			if next != nil {
 				m.put(next)
 			}
+			select {
+			case m.dirty <- struct{}{}:
+			default:
+			}
 			return
 		}
 
@@ -260,21 +270,37 @@ func (m *Manager) Flush() error {
 	}
 }
 
+// Pending returns the approximate number of events inserted into the current
+// block that haven't been flushed yet.
+func (m *Manager) Pending() int {
+	return int(m.cur.Load().count.Load())
+}
+
 func (m *Manager) SetLog(log bool) {
 	m.log.Store(log)
 }
 
 func (m *Manager) StartBackgroundFlush(ctx context.Context) {
 	period := 5 * time.Second
-	ticker := time.NewTicker(period)
-	defer ticker.Stop()
+	timer := time.NewTimer(period)
+	defer timer.Stop()
 
 	var backoff time.Duration
 	for {
+		if m.Pending() == 0 && backoff == 0 {
+			// Nothing to flush, so don't wake up until there is.
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.dirty:
+			}
+		}
+
+		timer.Reset(period)
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-timer.C:
 		}
 
 		if backoff >= period {
@@ -0,0 +1,19 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import "testing"
+
+func TestManagerPending(t *testing.T) {
+	m := newManager()
+	if n := m.Pending(); n != 0 {
+		t.Fatalf("new manager: got %d pending, want 0", n)
+	}
+
+	m.Insert("a")
+	m.Insert("b")
+	if n := m.Pending(); n != 2 {
+		t.Fatalf("after insert: got %d pending, want 2", n)
+	}
+}
@@ -14,9 +14,11 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -24,9 +26,10 @@ import (
 	"github.com/google/martian/v3/har"
 	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
+	"subtrace.dev/clock"
+	"subtrace.dev/cmd/run/capability"
 	"subtrace.dev/cmd/run/journal"
 	"subtrace.dev/event"
-	"subtrace.dev/filter"
 	"subtrace.dev/global"
 	"subtrace.dev/pubsub"
 	"subtrace.dev/stats"
@@ -47,18 +50,69 @@ func init() {
 	default:
 		sendReflector, sendTunneler = true, false
 	}
+
+	capability.RegisterSink("reflector", func() bool { return sendReflector })
+	capability.RegisterSink("tunneler", func() bool { return sendTunneler })
+	capability.RegisterLimit("payload_limit_bytes", func() int64 { return PayloadLimitBytes })
+	capability.RegisterLimit("payload_budget_bytes", func() int64 { return PayloadBudgetBytes })
+	capability.RegisterLimit("hook_executions_per_second", func() int64 { return hookRate })
+	capability.RegisterLimit("hook_concurrency", func() int64 { return hookConcurrency })
 }
 
+// WebsocketMessage is a message of a websocket, control messages included.
+// Fragmented messages are reassembled.
 type WebsocketMessage struct {
-	Type   string  `json:"type"`
+	Type   string  `json:"type"` // "send" or "receive"
 	Time   float64 `json:"time"`
 	Opcode int     `json:"opcode"`
-	Data   string  `json:"data"`
+	Data   string  `json:"data"` // base64 unless it's an uncompressed text message
+
+	Bytes       int64  `json:"bytes"`                 // of the payload as it was sent
+	Truncated   bool   `json:"truncated,omitempty"`   // to PayloadLimitBytes
+	Compressed  bool   `json:"compressed,omitempty"`  // still deflated, see permessage-deflate
+	CloseCode   int    `json:"closeCode,omitempty"`   // close messages only
+	CloseReason string `json:"closeReason,omitempty"` // close messages only
+}
+
+// OpcodeName returns the name of the message's opcode.
+func (m *WebsocketMessage) OpcodeName() string {
+	switch m.Opcode {
+	case 0x0:
+		return "continuation"
+	case 0x1:
+		return "text"
+	case 0x2:
+		return "binary"
+	case 0x8:
+		return "close"
+	case 0x9:
+		return "ping"
+	case 0xA:
+		return "pong"
+	default:
+		return fmt.Sprintf("0x%x", m.Opcode)
+	}
 }
 
 type extendedHarEntry struct {
 	*har.Entry
-	WebSocketMessages []*WebsocketMessage `json:"_webSocketMessages"`
+	WebSocketMessages  []*WebsocketMessage `json:"_webSocketMessages"`
+	WebSocketHandshake string              `json:"_webSocketHandshake,omitempty"` // event ID, see SetWebsocketHandshake
+	Interventions      json.RawMessage     `json:"_interventions,omitempty"`      // see AddIntervention
+	CaptureLevel       string              `json:"_captureLevel,omitempty"`
+	CaptureReason      string              `json:"_captureReason,omitempty"`
+
+	RequestBodyPreview  json.RawMessage `json:"_requestBodyPreview,omitempty"` // see BodyPreview
+	ResponseBodyPreview json.RawMessage `json:"_responseBodyPreview,omitempty"`
+
+	RequestChunks  *ChunkTimings `json:"_requestChunks,omitempty"` // streamed bodies only
+	ResponseChunks *ChunkTimings `json:"_responseChunks,omitempty"`
+
+	GRPC *GRPCCall `json:"_grpc,omitempty"`
+
+	Logs []journal.Line `json:"_logs,omitempty"` // see correlateLogs
+
+	Truncations []Truncation `json:"_truncations,omitempty"` // see MaxEventBytes
 }
 
 type Parser struct {
@@ -67,17 +121,74 @@ type Parser struct {
 
 	wg       sync.WaitGroup
 	errs     chan error
-	begin    time.Time
+	begin    time.Time // with a monotonic reading, displayed in UTC
+	jumps    int       // clock jumps noticed before begin
 	timings  har.Timings
+	connect  int64 // milliseconds, or -1 if the exchange reused a connection
+	dns      int64 // milliseconds, or -1 if no lookup is attributed to the exchange
 	request  *har.Request
 	response *har.Response
 
 	requestTrailer  http.Header
 	responseTrailer http.Header
 
-	websocketMessages []*WebsocketMessage
+	// The header sections that lost headers to the header limits, including
+	// while they were read (see TrimmedHeaders).
+	requestHeaders   HeaderBudget
+	responseHeaders  HeaderBudget
+	requestTrailers  HeaderBudget
+	responseTrailers HeaderBudget
+	trailerCounts    [2]int // of the request and response as they were sent
+
+	requestBody  bodyStats
+	responseBody bodyStats
+	direction    string
+
+	requestPreview  *jsonPreview
+	responsePreview *jsonPreview
+
+	requestChunks  chunkTimings
+	responseChunks chunkTimings
+
+	requestGRPC  *grpcFrames // gRPC bodies only
+	responseGRPC *grpcFrames
+
+	websocketMessages  []*WebsocketMessage
+	websocketHandshake string
+
+	// reserved is the part of PayloadBudgetBytes held by the body buffers in
+	// adaptive mode (see payloadLimit).
+	reservedMu      sync.Mutex
+	reserved        []*payloadReservation
+	budgetExhausted atomic.Bool
 
 	journalIdx uint64
+
+	// requestID is the value of RequestIDHeader in the request or response,
+	// tracked in the journal until untrack is called.
+	requestIDMu sync.Mutex
+	requestID   string
+	untrack     func()
+}
+
+// bodyStats records how many body bytes were declared by the sender and how
+// many actually arrived.
+type bodyStats struct {
+	declared  int64 // Content-Length, or -1 if unknown
+	chunked   bool
+	actual    int64
+	truncated bool // the stream ended before the declared length or terminal chunk
+	capped    bool // the body was larger than the payload limit
+}
+
+func newBodyStats(contentLength int64, transferEncoding []string, s *sampler) bodyStats {
+	b := bodyStats{declared: contentLength, actual: s.total, truncated: s.truncated, capped: s.over}
+	for _, te := range transferEncoding {
+		if strings.EqualFold(te, "chunked") {
+			b.chunked = true
+		}
+	}
+	return b
 }
 
 func NewParser(global *global.Global, event *event.Event) *Parser {
@@ -90,8 +201,11 @@ func NewParser(global *global.Global, event *event.Event) *Parser {
 		global: global,
 		event:  event,
 
-		errs:  make(chan error, 2),
-		begin: time.Now().UTC(),
+		errs:    make(chan error, 2),
+		begin:   time.Now(),
+		jumps:   clock.Default.Count(),
+		connect: -1,
+		dns:     -1,
 
 		journalIdx: journalIdx,
 	}
@@ -151,9 +265,12 @@ func decodeRawProto(depth int, enc map[string]any, buf []byte) error {
 	return nil
 }
 
-func jsonify(mime string, buf []byte) ([]byte, bool) {
-	switch mime {
-	case "application/grpc":
+// jsonify decodes the messages of a gRPC body into JSON if SUBTRACE_GRPC is
+// set. Messages compressed with encoding are decompressed if they fit in the
+// payload limit and left as they are otherwise.
+func jsonify(mime string, encoding string, buf []byte) ([]byte, bool) {
+	switch {
+	case isGRPCProto(mime):
 		switch strings.ToLower(os.Getenv("SUBTRACE_GRPC")) {
 		case "1", "y", "yes", "t", "true":
 			var arr []map[string]any
@@ -176,8 +293,12 @@ func jsonify(mime string, buf []byte) ([]byte, bool) {
 				buf = buf[size:]
 
 				if comp != 0 {
-					arr = append(arr, map[string]any{"_comp": base64.RawStdEncoding.EncodeToString(slice)})
-					continue
+					raw, ok := decompressGRPC(encoding, slice)
+					if !ok {
+						arr = append(arr, map[string]any{"_comp": base64.RawStdEncoding.EncodeToString(slice)})
+						continue
+					}
+					slice = raw
 				}
 
 				enc := make(map[string]any)
@@ -197,29 +318,35 @@ func jsonify(mime string, buf []byte) ([]byte, bool) {
 }
 
 func (p *Parser) UseRequest(req *http.Request) {
-	sampler := newSampler(req.Body)
+	sampler := newSampler(req.Body, p.payloadLimit())
+	sampler.declared = req.ContentLength
+	sampler.preview = newBodyPreview(req.Header)
+	p.requestPreview = sampler.preview
+	if isStreamed(req.Header, req.ContentLength, req.TransferEncoding) {
+		p.requestChunks.start(p.begin)
+		sampler.chunks = &p.requestChunks
+	}
+	sampler.grpc = newGRPCFrames(req.Header)
+	p.requestGRPC = sampler.grpc
 	req.Body = sampler
+	p.trackRequestID(req.Header)
+
+	limited := *req
+	var trims HeaderBudget
+	limited.Header, trims = limitHeader(req.Header)
+	p.requestHeaders.Add(trims)
 
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
 
-		h, err := har.NewRequest(req, false)
+		h, err := har.NewRequest(&limited, false)
 		if err != nil {
 			p.errs <- fmt.Errorf("parse HAR request: %w", err)
 			return
 		}
 
-		for i := range h.Headers {
-			switch strings.ToLower(h.Headers[i].Name) {
-			case "authorization", "cookie":
-				h.Headers[i].Value = p.global.Config.SantizeCredential(h.Headers[i].Value)
-			}
-		}
-
-		for i := range h.Cookies {
-			h.Cookies[i].Value = p.global.Config.SantizeCredential(h.Cookies[i].Value)
-		}
+		p.redactHeaders(h.Headers, h.Cookies, "cookie")
 
 		start := time.Now()
 		if err := <-sampler.errs; err != nil {
@@ -227,9 +354,10 @@ func (p *Parser) UseRequest(req *http.Request) {
 			return
 		}
 		p.timings.Send = time.Since(start).Milliseconds()
+		p.requestBody = newBodyStats(req.ContentLength, req.TransferEncoding, sampler)
 
-		text := sampler.data[:sampler.used]
-		if !sampler.over {
+		text := sampler.kept()
+		if !sampler.over && !sampler.truncated {
 			switch req.Header.Get("content-encoding") {
 			case "gzip":
 				gr, err := gzip.NewReader(bytes.NewBuffer(text))
@@ -261,7 +389,7 @@ func (p *Parser) UseRequest(req *http.Request) {
 		for _, hdr := range h.Headers {
 			switch strings.ToLower(hdr.Name) {
 			case "content-type":
-				json, ok := jsonify(hdr.Value, text)
+				json, ok := jsonify(hdr.Value, req.Header.Get("grpc-encoding"), text)
 				if ok {
 					h.PostData.MimeType = "application/json"
 					h.PostData.Text = string(json)
@@ -275,15 +403,30 @@ func (p *Parser) UseRequest(req *http.Request) {
 }
 
 func (p *Parser) UseResponse(resp *http.Response) {
-	sampler := newSampler(resp.Body)
+	sampler := newSampler(resp.Body, p.payloadLimit())
+	sampler.declared = resp.ContentLength
+	sampler.preview = newBodyPreview(resp.Header)
+	p.responsePreview = sampler.preview
+	if isStreamed(resp.Header, resp.ContentLength, resp.TransferEncoding) {
+		p.responseChunks.start(p.begin)
+		sampler.chunks = &p.responseChunks
+	}
+	sampler.grpc = newGRPCFrames(resp.Header)
+	p.responseGRPC = sampler.grpc
 	resp.Body = sampler
+	p.trackRequestID(resp.Header)
+
+	limited := *resp
+	var trims HeaderBudget
+	limited.Header, trims = limitHeader(resp.Header)
+	p.responseHeaders.Add(trims)
 
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
 		start := time.Now()
 
-		h, err := har.NewResponse(resp, false)
+		h, err := har.NewResponse(&limited, false)
 		if err != nil {
 			p.errs <- fmt.Errorf("parse HAR response: %w", err)
 			return
@@ -293,16 +436,7 @@ func (p *Parser) UseResponse(resp *http.Response) {
 		// sent (including body)?
 		p.timings.Wait = time.Since(start).Milliseconds()
 
-		for i := range h.Headers {
-			switch strings.ToLower(h.Headers[i].Name) {
-			case "set-cookie":
-				h.Headers[i].Value = p.global.Config.SantizeCredential(h.Headers[i].Value)
-			}
-		}
-
-		for i := range h.Cookies {
-			h.Cookies[i].Value = p.global.Config.SantizeCredential(h.Cookies[i].Value)
-		}
+		p.redactHeaders(h.Headers, h.Cookies, "set-cookie")
 
 		start = time.Now()
 		if err := <-sampler.errs; err != nil {
@@ -310,9 +444,10 @@ func (p *Parser) UseResponse(resp *http.Response) {
 			return
 		}
 		p.timings.Receive = time.Since(start).Milliseconds()
+		p.responseBody = newBodyStats(resp.ContentLength, resp.TransferEncoding, sampler)
 
-		text := sampler.data[:sampler.used]
-		if !sampler.over {
+		text := sampler.kept()
+		if !sampler.over && !sampler.truncated {
 			switch resp.Header.Get("content-encoding") {
 			case "gzip":
 				gr, err := gzip.NewReader(bytes.NewBuffer(text))
@@ -346,7 +481,7 @@ func (p *Parser) UseResponse(resp *http.Response) {
 		for _, hdr := range h.Headers {
 			switch strings.ToLower(hdr.Name) {
 			case "content-type":
-				json, ok := jsonify(hdr.Value, text)
+				json, ok := jsonify(hdr.Value, resp.Header.Get("grpc-encoding"), text)
 				if ok {
 					h.Content.MimeType = "application/json"
 					h.Content.Text = json
@@ -359,16 +494,82 @@ func (p *Parser) UseResponse(resp *http.Response) {
 	}()
 }
 
+// SetOutgoing records whether the request was sent by the traced process
+// (outgoing) or received by it (incoming). It's used to attribute truncated
+// bodies to the side that closed early.
+func (p *Parser) SetOutgoing(outgoing bool) {
+	if outgoing {
+		p.direction = "outgoing"
+	} else {
+		p.direction = "incoming"
+	}
+}
+
+// bodySender returns which side sent the request or response body.
+func (p *Parser) bodySender(isRequest bool) string {
+	switch {
+	case p.direction == "":
+		if isRequest {
+			return "client"
+		}
+		return "server"
+	case (p.direction == "outgoing") == isRequest:
+		return "process"
+	default:
+		return "external"
+	}
+}
+
+func setBodyTags(tags *event.Event, prefix string, b bodyStats, sender string) {
+	if !b.truncated {
+		return
+	}
+	tags.Set(prefix+"_body_incomplete", "true")
+	if b.chunked {
+		tags.Set(prefix+"_body_declared_bytes", "chunked")
+	} else {
+		tags.Set(prefix+"_body_declared_bytes", fmt.Sprintf("%d", b.declared))
+	}
+	tags.Set(prefix+"_body_actual_bytes", fmt.Sprintf("%d", b.actual))
+	tags.Set(prefix+"_body_incomplete_side", sender)
+}
+
+// SetConnect records how long connecting to the server took before the
+// exchange, if it's the first one on its connection.
+func (p *Parser) SetConnect(d time.Duration) {
+	p.connect = d.Milliseconds()
+}
+
+// SetDNS records how long the DNS lookup of the server's address took before
+// the exchange, if the tracee's lookup was observed and this is the first
+// exchange on the first connection to the address after it.
+func (p *Parser) SetDNS(d time.Duration) {
+	p.dns = d.Milliseconds()
+}
+
 func (p *Parser) UseWebsocketMessages(msgs []*WebsocketMessage) {
 	p.websocketMessages = msgs
 }
 
+// SetWebsocketHandshake marks the exchange as messages of the websocket that
+// the event with the given ID opened. Its request and response are the
+// handshake's.
+func (p *Parser) SetWebsocketHandshake(eventID string) {
+	p.websocketHandshake = eventID
+}
+
 func (p *Parser) SetRequestTrailer(tr http.Header) {
-	p.requestTrailer = tr
+	var trims HeaderBudget
+	p.trailerCounts[0] = len(tr)
+	p.requestTrailer, trims = limitHeader(tr)
+	p.requestTrailers.Add(trims)
 }
 
 func (p *Parser) SetResponseTrailer(tr http.Header) {
-	p.responseTrailer = tr
+	var trims HeaderBudget
+	p.trailerCounts[1] = len(tr)
+	p.responseTrailer, trims = limitHeader(tr)
+	p.responseTrailers.Add(trims)
 }
 
 func (p *Parser) Finish() error {
@@ -378,6 +579,7 @@ func (p *Parser) Finish() error {
 	}
 
 	p.wg.Wait()
+	defer p.releasePayloads()
 	if err := errors.Join(<-p.errs, <-p.errs); err != nil {
 		return err
 	}
@@ -387,6 +589,7 @@ func (p *Parser) Finish() error {
 	if journal.Enabled {
 		logidx, loglines = p.global.Journal.CopyFrom(p.journalIdx)
 	}
+	logs, requestID := p.correlateLogs()
 
 	entry := &extendedHarEntry{
 		Entry: &har.Entry{
@@ -397,7 +600,36 @@ func (p *Parser) Finish() error {
 			Response:        p.response,
 			Timings:         &p.timings,
 		},
-		WebSocketMessages: p.websocketMessages,
+		WebSocketMessages:  p.websocketMessages,
+		WebSocketHandshake: p.websocketHandshake,
+		Logs:               logs,
+	}
+
+	var host string
+	redacted := false
+	if p.request != nil {
+		if u, err := url.Parse(p.request.URL); err == nil {
+			host = u.Host
+		}
+		for _, hdr := range p.request.Headers {
+			if host == "" && strings.EqualFold(hdr.Name, "host") {
+				host = hdr.Value
+			}
+		}
+		if !p.global.Config.IsPayloadAllowed(host) {
+			redacted = true
+			p.redactPayloads()
+			_, why := p.global.Config.ExplainPayloads(host)
+			AddDecision(p.event, Decision{Layer: "payload", Verdict: "redacted", Reason: ReasonPayloadPolicy, Detail: why}, CaptureMetadata)
+		}
+	}
+	if !redacted {
+		p.scrubPayloads()
+	}
+	p.addPayloadLimitDecision()
+	dropped := p.applyPayloadMode(entry, host)
+	if p.event.Get("capture_level") == "" {
+		p.event.Set("capture_level", CaptureFull)
 	}
 
 	for k, v := range stats.Load() {
@@ -405,6 +637,7 @@ func (p *Parser) Finish() error {
 	}
 
 	tags := p.global.Config.GetEventTemplate()
+	defer event.Release(tags)
 	tags.CopyFrom(p.event)
 	tags.Set("event_id", p.event.Get("event_id"))
 	tags.Set("time", p.event.Get("time"))
@@ -412,41 +645,96 @@ func (p *Parser) Finish() error {
 	// HAR v1.2 doesn't support trailers so for now we just set the counts as a
 	// way to indicate to the user that there were trailers.
 	if p.requestTrailer != nil {
-		tags.Set("request_trailer_count", fmt.Sprintf("%d", len(p.requestTrailer)))
+		tags.Set("request_trailer_count", fmt.Sprintf("%d", p.trailerCounts[0]))
 	}
 	if p.responseTrailer != nil {
-		tags.Set("response_trailer_count", fmt.Sprintf("%d", len(p.responseTrailer)))
+		tags.Set("response_trailer_count", fmt.Sprintf("%d", p.trailerCounts[1]))
+	}
+	if requestID != "" {
+		tags.Set("request_id", requestID)
+	}
+	if len(logs) > 0 {
+		tags.Set("log_lines", fmt.Sprintf("%d", len(logs)))
 	}
+	if j, ok := clock.Default.Since(p.jumps); ok {
+		// The duration is still right, but the wall clock timestamps on
+		// either side of the request aren't comparable.
+		tags.Set("clock_jump", j.Kind())
+		tags.Set("clock_jump_ms", fmt.Sprintf("%d", j.Offset.Milliseconds()))
+	}
+	setHeaderTags(tags, "request_headers", p.requestHeaders)
+	setHeaderTags(tags, "response_headers", p.responseHeaders)
+	setHeaderTags(tags, "request_trailers", p.requestTrailers)
+	setHeaderTags(tags, "response_trailers", p.responseTrailers)
+
+	if iv := tags.Get("interventions"); iv != "" {
+		entry.Interventions = json.RawMessage(iv)
+	}
+	entry.CaptureLevel, entry.CaptureReason = tags.Get("capture_level"), tags.Get("capture_reason")
+
+	setBodyTags(tags, "request", p.requestBody, p.bodySender(true))
+	setBodyTags(tags, "response", p.responseBody, p.bodySender(false))
+	entry.RequestChunks, entry.ResponseChunks = p.requestChunks.summary(), p.responseChunks.summary()
+	setChunkTags(tags, "request", entry.RequestChunks)
+	setChunkTags(tags, "response", entry.ResponseChunks)
+	entry.GRPC = p.grpcCall()
+	setGRPCTags(tags, entry.GRPC)
+	p.setPreviews(entry, tags, redacted || dropped)
+	p.setCacheTags(tags, host)
+	view := tags.View()
 
 	{
 		begin := time.Now()
-		match, err := p.global.Config.GetMatchingFilter(tags.Map(), entry.Entry)
-		slog.Debug("evaluated filters", "eventID", p.event.Get("event_id"), "match", match, "err", err, "took", time.Since(begin).Round(time.Nanosecond))
-		switch {
-		case err != nil:
-			fallthrough // fallthrough to ActionInclude if filter eval fails
-		case match == nil:
-			break
-		case match.Action == filter.ActionInclude:
-			break
-		case match.Action == filter.ActionExclude:
+		rule, err := p.global.Config.GetMatchingRule(view, entry.Entry)
+		slog.Debug("evaluated rules", "eventID", p.event.Get("event_id"), "rule", rule, "err", err, "took", time.Since(begin).Round(time.Nanosecond))
+		// The event is kept if a rule fails to evaluate.
+		if err == nil && rule != nil && !rule.Keep() {
 			return nil
-		default:
-			panic(fmt.Errorf("unknown filter action %q", match.Action))
 		}
 	}
 
+	loglines = governEvent(entry, tags, loglines)
+	view = tags.View()
+
 	json, err := json.Marshal(entry)
 	if err != nil {
 		return fmt.Errorf("encode json: %w", err)
 	}
 
 	if DefaultManager.log.Load() {
-		method := entry.Request.Method
-		if len(method) > 3 {
-			method = method[:3]
+		now := time.Now().UTC().Format("2006-01-02 15:04:05.999 UTC")
+		switch {
+		case entry.GRPC != nil:
+			fmt.Fprintf(os.Stderr, "%s  |  %s\n", now, entry.GRPC.Summary())
+		case entry.WebSocketHandshake != "" && len(entry.WebSocketMessages) == 1:
+			msg := entry.WebSocketMessages[0]
+			fmt.Fprintf(os.Stderr, "%s  |  ws %s %s %q\n", now, msg.Type, msg.OpcodeName(), entry.Request.URL)
+		default:
+			method := entry.Request.Method
+			if len(method) > 3 {
+				method = method[:3]
+			}
+			fmt.Fprintf(os.Stderr, "%s  |  %d %3s %q\n", now, entry.Response.Status, method, entry.Request.URL)
 		}
-		fmt.Fprintf(os.Stderr, "%s  |  %d %3s %q\n", time.Now().UTC().Format("2006-01-02 15:04:05.999 UTC"), entry.Response.Status, method, entry.Request.URL)
+	}
+
+	if DefaultHook != nil {
+		DefaultHook.Handle(view, entry.Entry, json)
+	}
+	if DefaultExecSink != nil {
+		DefaultExecSink.Handle(view, json)
+	}
+	if len(SpanExporters) > 0 {
+		exportSpan(view, entry.Entry, p.direction != "incoming")
+	}
+
+	if DefaultHARFile != nil {
+		DefaultHARFile.Write(entry, p.connect, p.dns)
+	}
+
+	sinks := routeSinks(view, entry.Entry)
+	if len(sinks) == 0 && DefaultEventLog != nil {
+		DefaultEventLog.Write(view, json)
 	}
 
 	if p.global.Devtools != nil && p.global.Devtools.HijackPath != "" {
@@ -454,9 +742,22 @@ func (p *Parser) Finish() error {
 		return nil
 	}
 
+	if len(sinks) > 0 {
+		ev := &sinkEvent{tags: view, json: json, host: host}
+		if !redacted {
+			ev.redact = p.redactForSinks(entry, view)
+		}
+		for _, s := range sinks {
+			if err := s.deliver(ev, logidx, loglines); err != nil {
+				slog.Error("failed to publish event to sink", "eventID", p.event.Get("event_id"), "err", err)
+			}
+		}
+		return nil
+	}
+
 	if sendReflector {
 		begin := time.Now()
-		err := p.sendReflector(tags.Map(), json, logidx, loglines)
+		err := sendReflectorEvent(DefaultPublisher, view, json, logidx, loglines)
 		slog.Debug("sent event to reflector", "eventID", p.event.Get("event_id"), "err", err, "took", time.Since(begin).Round(time.Microsecond))
 		if err != nil {
 			slog.Error("failed to publish event to reflector", "eventID", p.event.Get("event_id"), "err", err)
@@ -473,11 +774,122 @@ func (p *Parser) Finish() error {
 		begin := time.Now()
 		DefaultManager.Insert(ev.String())
 		slog.Debug("sent event to tunneler", "eventID", ev.Get("event_id"), "err", err, "took", time.Since(begin).Round(time.Microsecond))
+		event.Release(ev)
 	}
 	return nil
 }
 
-func (p *Parser) sendReflector(tags map[string]string, json []byte, logidx uint64, loglines []string) error {
+// addPayloadLimitDecision records that bodies weren't captured in full
+// because of -payload-limit.
+func (p *Parser) addPayloadLimitDecision() {
+	switch {
+	case PayloadLimitBytes <= 0 && (p.requestBody.actual > 0 || p.responseBody.actual > 0):
+		AddDecision(p.event, Decision{Layer: "payload", Verdict: "dropped", Reason: ReasonPayloadLimitZero}, CaptureMetadata)
+	case p.requestBody.capped || p.responseBody.capped:
+		AddDecision(p.event, Decision{Layer: "payload", Verdict: "truncated", Reason: ReasonPayloadLimit, Detail: fmt.Sprintf("limit is %d bytes", PayloadLimitBytes)}, CaptureMetadata)
+	}
+}
+
+// setPreviews adds the JSON body previews to the entry and tags as configured
+// by BodyPreview. Previews of redacted bodies keep only keys and types.
+func (p *Parser) setPreviews(entry *extendedHarEntry, tags *event.Event, redacted bool) {
+	preview := func(w *jsonPreview, b bodyStats, prefix string) json.RawMessage {
+		if w == nil {
+			return nil
+		}
+		if BodyPreview == "truncated" && !b.capped && !b.truncated && !redacted {
+			return nil
+		}
+		status := w.status()
+		if status == "" {
+			return nil
+		}
+		ret := w.render(!redacted && !p.global.Config.RedactsJSONValues())
+		if ret == nil {
+			return nil
+		}
+		tags.Set(prefix+"_body_preview", string(ret))
+		tags.Set(prefix+"_body_preview_status", status)
+		return ret
+	}
+
+	entry.RequestBodyPreview = preview(p.requestPreview, p.requestBody, "request")
+	entry.ResponseBodyPreview = preview(p.responsePreview, p.responseBody, "response")
+
+	if BodyPreview == "instead" {
+		if entry.RequestBodyPreview != nil && p.request != nil && p.request.PostData != nil {
+			p.request.PostData.Text = ""
+		}
+		if entry.ResponseBodyPreview != nil && p.response != nil && p.response.Content != nil {
+			p.response.Content.Text = nil
+		}
+	}
+}
+
+// redactHeaders redacts the values of the headers that the config's redact
+// section lists. The cookies are parsed from the named header, so they're
+// redacted along with it.
+func (p *Parser) redactHeaders(headers []har.Header, cookies []har.Cookie, cookieHeader string) {
+	for i := range headers {
+		if p.global.Config.RedactsHeader(headers[i].Name) {
+			headers[i].Value = p.global.Config.SantizeCredential(headers[i].Value)
+		}
+	}
+	if p.global.Config.RedactsHeader(cookieHeader) {
+		for i := range cookies {
+			cookies[i].Value = p.global.Config.SantizeCredential(cookies[i].Value)
+		}
+	}
+}
+
+// scrubPayloads redacts what the config's redact section selects from every
+// request, response and text websocket message body. It runs before the event
+// is encoded so that the values never reach the publisher or the devtools
+// endpoint.
+func (p *Parser) scrubPayloads() {
+	cfg := p.global.Config
+	if p.request != nil && p.request.PostData != nil {
+		if b, ok := cfg.RedactBody(p.request.PostData.MimeType, []byte(p.request.PostData.Text)); ok {
+			p.request.PostData.Text = string(b)
+			p.request.PostData.Params = nil
+		}
+	}
+	if p.response != nil && p.response.Content != nil {
+		if b, ok := cfg.RedactBody(p.response.Content.MimeType, p.response.Content.Text); ok {
+			p.response.Content.Text = b
+		}
+	}
+	for _, msg := range p.websocketMessages {
+		if msg.OpcodeName() != "text" || msg.Compressed {
+			continue // binary or base64
+		}
+		mimeType := ""
+		if json.Valid([]byte(msg.Data)) {
+			mimeType = "application/json"
+		}
+		if b, ok := cfg.RedactBody(mimeType, []byte(msg.Data)); ok {
+			msg.Data = string(b)
+		}
+	}
+}
+
+// redactPayloads replaces every request, response and websocket message body
+// with its size and hash so that payloads from hosts denied by the config never
+// reach any sink. Metadata such as headers, status and timings are kept.
+func (p *Parser) redactPayloads() {
+	if p.request != nil && p.request.PostData != nil {
+		p.request.PostData.Text = p.global.Config.RedactPayload([]byte(p.request.PostData.Text))
+		p.request.PostData.Params = nil
+	}
+	if p.response != nil && p.response.Content != nil {
+		p.response.Content.Text = []byte(p.global.Config.RedactPayload(p.response.Content.Text))
+	}
+	for _, msg := range p.websocketMessages {
+		msg.Data = p.global.Config.RedactPayload([]byte(msg.Data))
+	}
+}
+
+func sendReflectorEvent(pub *publisher, tags map[string]string, json []byte, logidx uint64, loglines []string) error {
 	b, err := proto.Marshal(&pubsub.Message{
 		Concrete: &pubsub.Message_ConcreteV1{
 			ConcreteV1: &pubsub.Message_V1{
@@ -501,29 +913,68 @@ func (p *Parser) sendReflector(tags map[string]string, json []byte, logidx uint6
 	if err != nil {
 		return fmt.Errorf("marshal proto: %w", err)
 	}
-	return DefaultPublisher.queueWrite(b)
+	return pub.queueWrite(b)
 }
 
 type sampler struct {
 	orig io.ReadCloser
 	errs chan error
 	used int64
-	data []byte
+	data []byte // allocated by grow once there's something to keep
 	over bool
+
+	limit    int64 // bytes of the body to keep in data
+	declared int64 // the body's declared size, or -1 if it has none
+
+	total     int64 // all bytes read, including those beyond the payload limit
+	truncated bool  // the body ended with io.ErrUnexpectedEOF
+
+	preview *jsonPreview  // fed every byte read, or nil
+	chunks  *chunkTimings // told when every byte arrived, or nil
+	grpc    *grpcFrames   // fed every byte read, or nil
 }
 
-func newSampler(orig io.ReadCloser) *sampler {
+func newSampler(orig io.ReadCloser, limit int64) *sampler {
 	return &sampler{
-		orig: orig,
-		errs: make(chan error, 1),
-		data: make([]byte, PayloadLimitBytes),
+		orig:     orig,
+		errs:     make(chan error, 1),
+		limit:    limit,
+		declared: -1,
 	}
 }
 
+// grow makes room in data for need bytes. Bodies usually arrive in more than
+// one read, so it allocates the whole limit at once rather than growing with
+// append, or just the declared size if that's smaller.
+func (s *sampler) grow(need int64) {
+	size := s.limit
+	if s.declared >= need && s.declared < size {
+		size = s.declared
+	}
+	data := make([]byte, size)
+	copy(data, s.data[:s.used])
+	s.data = data
+}
+
+// kept returns the bytes of the body kept in data.
+func (s *sampler) kept() []byte {
+	if s.data == nil {
+		return []byte{}
+	}
+	return s.data[:s.used]
+}
+
 func (s *sampler) setError(err error) {
 	if errors.Is(err, io.EOF) {
 		err = nil
 	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// The sender closed the connection before the declared Content-Length or
+		// the terminal chunk. That's worth recording on the event rather than
+		// failing it.
+		s.truncated = true
+		err = nil
+	}
 
 	select {
 	case s.errs <- err:
@@ -533,18 +984,30 @@ func (s *sampler) setError(err error) {
 
 func (s *sampler) Read(b []byte) (int, error) {
 	n, err := s.orig.Read(b)
-	if err != nil {
-		s.setError(err)
+	s.total += int64(n)
+	if s.preview != nil && n > 0 {
+		s.preview.Write(b[:n])
 	}
-
-	if n > 0 && s.used < PayloadLimitBytes {
+	if s.chunks != nil {
+		s.chunks.add(n)
+	}
+	if s.grpc != nil && n > 0 {
+		s.grpc.Write(b[:n])
+	}
+	if n > 0 && s.used < s.limit {
 		c := int64(n)
-		if s.used+c > PayloadLimitBytes {
+		if s.used+c > s.limit {
 			s.over = true
-			c = PayloadLimitBytes - s.used
+			c = s.limit - s.used
+		}
+		if s.used+c > int64(len(s.data)) {
+			s.grow(s.used + c)
 		}
 		s.used += int64(copy(s.data[s.used:s.used+c], b[0:c]))
 	}
+	if err != nil {
+		s.setError(err)
+	}
 	return n, err
 }
 
@@ -0,0 +1,89 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func readBodyStats(t *testing.T, raw string) bodyStats {
+	t.Helper()
+
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("read request: %v", err)
+	}
+
+	s := newSampler(req.Body, PayloadLimitBytes)
+	io.Copy(io.Discard, s)
+	s.Close()
+	if err := <-s.errs; err != nil {
+		t.Fatalf("sampler error: %v", err)
+	}
+	return newBodyStats(req.ContentLength, req.TransferEncoding, s)
+}
+
+func TestBodyStats(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		raw  string
+		want bodyStats
+	}{
+		{
+			name: "complete",
+			raw:  "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello",
+			want: bodyStats{declared: 5, actual: 5},
+		},
+		{
+			name: "short content-length",
+			raw:  "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nhello",
+			want: bodyStats{declared: 10, actual: 5, truncated: true},
+		},
+		{
+			name: "complete chunked",
+			raw:  "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			want: bodyStats{declared: -1, chunked: true, actual: 5},
+		},
+		{
+			name: "chunked without terminal chunk",
+			raw:  "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n",
+			want: bodyStats{declared: -1, chunked: true, actual: 5, truncated: true},
+		},
+		{
+			name: "over payload limit",
+			raw:  "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5000\r\n\r\n" + strings.Repeat("x", 5000),
+			want: bodyStats{declared: 5000, actual: 5000, capped: true},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readBodyStats(t, tt.raw); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodySender(t *testing.T) {
+	p := new(Parser)
+	if got := p.bodySender(true); got != "client" {
+		t.Errorf("unknown direction: request sender = %q, want client", got)
+	}
+
+	p.SetOutgoing(true)
+	if got := p.bodySender(true); got != "process" {
+		t.Errorf("outgoing: request sender = %q, want process", got)
+	}
+	if got := p.bodySender(false); got != "external" {
+		t.Errorf("outgoing: response sender = %q, want external", got)
+	}
+
+	p.SetOutgoing(false)
+	if got := p.bodySender(true); got != "external" {
+		t.Errorf("incoming: request sender = %q, want external", got)
+	}
+}
@@ -0,0 +1,677 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// BodyPreview is the policy for structural previews of JSON bodies: "off",
+// "truncated" to keep a preview only when the raw body isn't kept in full
+// (larger than -payload-limit, cut short or redacted), "always" to keep one
+// alongside every JSON body, or "instead" to keep the preview and drop the raw
+// body.
+var BodyPreview = "truncated"
+
+// ValidBodyPreview reports whether policy is a valid BodyPreview.
+func ValidBodyPreview(policy string) bool {
+	switch policy {
+	case "off", "truncated", "always", "instead":
+		return true
+	}
+	return false
+}
+
+const (
+	previewMaxDepth   = 8    // containers nested deeper are elided
+	previewMaxNodes   = 128  // keys and values recorded
+	previewMaxItems   = 3    // array elements recorded
+	previewMaxKeys    = 32   // object keys recorded
+	previewMaxScalar  = 64   // bytes kept of a key or scalar value
+	previewArenaBytes = 2048 // bytes kept of all keys and scalar values
+	previewTrackDepth = 1024 // deeper nesting is treated as invalid
+)
+
+// Statuses of a preview, as set in the *_body_preview_status tags.
+const (
+	previewComplete   = "complete"   // the body was valid JSON
+	previewIncomplete = "incomplete" // the body ended before the JSON did
+	previewInvalid    = "invalid"    // the body wasn't JSON
+)
+
+const (
+	psValue       = iota // expecting a value
+	psArrayFirst         // after '[': a value or ']'
+	psObjectFirst        // after '{': a key or '}'
+	psKey                // after ',' in an object: a key
+	psColon              // after a key
+	psAfter              // after a value in a container: ',' or a closing bracket
+	psString             // inside a string
+	psEscape             // after a backslash in a string
+	psUnicode            // inside a \uXXXX escape
+	psNumber             // inside a number
+	psLiteral            // inside true, false or null
+	psDone               // after the root value
+	psInvalid
+)
+
+// Positions within a number, following the JSON grammar.
+const (
+	numSign     = iota // after '-'
+	numZero            // after a leading '0'
+	numInt             // in the integer part
+	numDot             // after '.'
+	numFrac            // in the fraction
+	numExp             // after 'e' or 'E'
+	numExpSign         // after the exponent's sign
+	numExpDigit        // in the exponent
+)
+
+// previewNode is a key and value recorded for the preview. Strings are stored
+// in the arena, still escaped.
+type previewNode struct {
+	kind       byte // '{', '[', '"', '0' (number) or the first letter of a literal
+	keyOff     int32
+	keyLen     int32
+	valOff     int32
+	valLen     int32
+	keyClipped bool
+	valClipped bool
+	elided     bool  // a container nested too deep to be walked
+	count      int   // keys or elements of a container
+	first      int32 // first child, or -1
+	last       int32 // last child, or -1
+	next       int32 // next sibling, or -1
+}
+
+// jsonPreview walks a JSON document as it streams by and records a preview of
+// its structure: every key and the type of every value up to a depth, the
+// length of arrays with their first few elements, and the first bytes of
+// scalar values. Memory is fixed when it's created, so arbitrarily
+// large or deeply nested bodies never make it allocate more. Malformed and
+// truncated input stops the walk but keeps the preview recorded so far.
+type jsonPreview struct {
+	nodes []previewNode
+	arena []byte
+	root  int32
+
+	state   int
+	depth   int
+	objects [previewTrackDepth / 64]uint64 // whether the container at each depth is an object
+	open    [previewMaxDepth + 1]int32     // the node of the container at each depth, or -1
+
+	cur   int32 // node of the scalar being read, or -1
+	isKey bool  // the string being read is a key
+
+	keyOff      int32
+	keyLen      int32
+	keyClipped  bool
+	keyRecorded bool
+
+	number  int
+	literal [5]byte
+	litLen  int
+	uhex    int
+}
+
+func newJSONPreview() *jsonPreview {
+	return &jsonPreview{
+		nodes: make([]previewNode, 0, previewMaxNodes),
+		arena: make([]byte, 0, previewArenaBytes),
+		root:  -1,
+		cur:   -1,
+	}
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// Write walks the next bytes of the document. It never fails: malformed input
+// puts the preview in the invalid state, after which input is ignored.
+func (w *jsonPreview) Write(b []byte) (int, error) {
+	for _, c := range b {
+		if w.state == psInvalid {
+			break
+		}
+		w.step(c)
+	}
+	return len(b), nil
+}
+
+func (w *jsonPreview) step(c byte) {
+	switch w.state {
+	case psValue, psArrayFirst:
+		switch {
+		case isJSONSpace(c):
+		case c == ']' && w.state == psArrayFirst:
+			w.close(c)
+		default:
+			w.beginValue(c)
+		}
+
+	case psObjectFirst, psKey:
+		switch {
+		case isJSONSpace(c):
+		case c == '}' && w.state == psObjectFirst:
+			w.close(c)
+		case c == '"':
+			w.beginKey()
+		default:
+			w.state = psInvalid
+		}
+
+	case psColon:
+		switch {
+		case isJSONSpace(c):
+		case c == ':':
+			w.state = psValue
+		default:
+			w.state = psInvalid
+		}
+
+	case psAfter:
+		switch {
+		case isJSONSpace(c):
+		case c == ',':
+			if w.inObject() {
+				w.state = psKey
+			} else {
+				w.state = psValue
+			}
+		case c == '}' || c == ']':
+			w.close(c)
+		default:
+			w.state = psInvalid
+		}
+
+	case psString:
+		switch {
+		case c == '"':
+			if w.isKey {
+				w.state = psColon
+			} else {
+				w.endValue()
+			}
+		case c == '\\':
+			w.appendByte(c)
+			w.state = psEscape
+		case c < 0x20:
+			w.state = psInvalid
+		default:
+			w.appendByte(c)
+		}
+
+	case psEscape:
+		switch c {
+		case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			w.appendByte(c)
+			w.state = psString
+		case 'u':
+			w.appendByte(c)
+			w.uhex = 4
+			w.state = psUnicode
+		default:
+			w.state = psInvalid
+		}
+
+	case psUnicode:
+		if !isHex(c) {
+			w.state = psInvalid
+			return
+		}
+		w.appendByte(c)
+		if w.uhex--; w.uhex == 0 {
+			w.state = psString
+		}
+
+	case psNumber:
+		if w.stepNumber(c) {
+			w.appendByte(c)
+			return
+		}
+		if !w.endNumber() {
+			return
+		}
+		w.step(c)
+
+	case psLiteral:
+		if c >= 'a' && c <= 'z' {
+			if w.litLen == len(w.literal) {
+				w.state = psInvalid
+				return
+			}
+			w.literal[w.litLen] = c
+			w.litLen++
+			return
+		}
+		if !w.endLiteral() {
+			return
+		}
+		w.step(c)
+
+	case psDone:
+		if !isJSONSpace(c) {
+			w.state = psInvalid
+		}
+	}
+}
+
+func (w *jsonPreview) inObject() bool {
+	d := w.depth - 1
+	return w.objects[d/64]&(1<<(d%64)) != 0
+}
+
+// parent returns the node of the innermost open container, or -1 if it isn't
+// recorded.
+func (w *jsonPreview) parent() int32 {
+	if w.depth == 0 || w.depth > len(w.open) {
+		return -1
+	}
+	return w.open[w.depth-1]
+}
+
+// hasRoom reports whether another node with a few bytes of text fits.
+func (w *jsonPreview) hasRoom() bool {
+	return len(w.nodes) < cap(w.nodes) && len(w.arena) < cap(w.arena)
+}
+
+func (w *jsonPreview) beginKey() {
+	w.isKey = true
+	w.keyOff, w.keyLen, w.keyClipped = int32(len(w.arena)), 0, false
+	w.keyRecorded = false
+	if p := w.parent(); p >= 0 {
+		n := &w.nodes[p]
+		n.count++
+		w.keyRecorded = !n.elided && n.count <= previewMaxKeys && w.hasRoom()
+	}
+	w.state = psString
+}
+
+// addNode records a value of the given kind in the innermost open container,
+// or as the root, and returns it, or -1 if it isn't recorded.
+func (w *jsonPreview) addNode(kind byte) int32 {
+	parent := w.parent()
+	switch {
+	case w.depth == 0:
+		if w.root >= 0 {
+			return -1
+		}
+	case parent < 0:
+		return -1
+	default:
+		p := &w.nodes[parent]
+		if p.kind == '[' {
+			p.count++
+			if p.count > previewMaxItems {
+				return -1
+			}
+		} else if !w.keyRecorded {
+			return -1
+		}
+		if p.elided {
+			return -1
+		}
+	}
+	if !w.hasRoom() {
+		return -1
+	}
+
+	n := previewNode{kind: kind, valOff: int32(len(w.arena)), first: -1, last: -1, next: -1}
+	if parent >= 0 && w.nodes[parent].kind == '{' {
+		n.keyOff, n.keyLen, n.keyClipped = w.keyOff, w.keyLen, w.keyClipped
+	}
+	if (kind == '{' || kind == '[') && w.depth+1 > previewMaxDepth {
+		n.elided = true
+	}
+	w.nodes = append(w.nodes, n)
+	idx := int32(len(w.nodes) - 1)
+
+	if parent < 0 {
+		w.root = idx
+		return idx
+	}
+	p := &w.nodes[parent]
+	if p.first < 0 {
+		p.first = idx
+	} else {
+		w.nodes[p.last].next = idx
+	}
+	p.last = idx
+	return idx
+}
+
+func (w *jsonPreview) beginValue(c byte) {
+	w.isKey = false
+	switch {
+	case c == '{' || c == '[':
+		if w.depth == previewTrackDepth {
+			w.state = psInvalid
+			return
+		}
+		n := w.addNode(c)
+		d := w.depth
+		if c == '{' {
+			w.objects[d/64] |= 1 << (d % 64)
+			w.state = psObjectFirst
+		} else {
+			w.objects[d/64] &^= 1 << (d % 64)
+			w.state = psArrayFirst
+		}
+		w.depth++
+		if w.depth <= len(w.open) {
+			w.open[w.depth-1] = n
+		}
+
+	case c == '"':
+		w.cur = w.addNode('"')
+		w.state = psString
+
+	case c == '-' || (c >= '0' && c <= '9'):
+		w.cur = w.addNode('0')
+		w.number = numInt
+		switch c {
+		case '-':
+			w.number = numSign
+		case '0':
+			w.number = numZero
+		}
+		w.appendByte(c)
+		w.state = psNumber
+
+	case c == 't' || c == 'f' || c == 'n':
+		w.cur = w.addNode(c)
+		w.literal[0], w.litLen = c, 1
+		w.state = psLiteral
+
+	default:
+		w.state = psInvalid
+	}
+}
+
+// appendByte records a byte of the key or scalar being read if it's recorded
+// and there's room for it.
+func (w *jsonPreview) appendByte(c byte) {
+	switch {
+	case w.isKey:
+		if !w.keyRecorded {
+			return
+		}
+		if w.keyLen >= previewMaxScalar || len(w.arena) == cap(w.arena) {
+			w.keyClipped = true
+			return
+		}
+		w.arena = append(w.arena, c)
+		w.keyLen++
+
+	case w.cur >= 0:
+		n := &w.nodes[w.cur]
+		if n.valLen >= previewMaxScalar || len(w.arena) == cap(w.arena) {
+			n.valClipped = true
+			return
+		}
+		w.arena = append(w.arena, c)
+		n.valLen++
+	}
+}
+
+// stepNumber reports whether c continues the number being read.
+func (w *jsonPreview) stepNumber(c byte) bool {
+	digit := c >= '0' && c <= '9'
+	switch w.number {
+	case numSign:
+		switch {
+		case c == '0':
+			w.number = numZero
+		case digit:
+			w.number = numInt
+		default:
+			return false
+		}
+	case numZero, numInt:
+		switch {
+		case digit && w.number == numInt:
+		case c == '.':
+			w.number = numDot
+		case c == 'e' || c == 'E':
+			w.number = numExp
+		default:
+			return false
+		}
+	case numDot:
+		if !digit {
+			return false
+		}
+		w.number = numFrac
+	case numFrac:
+		switch {
+		case digit:
+		case c == 'e' || c == 'E':
+			w.number = numExp
+		default:
+			return false
+		}
+	case numExp:
+		switch {
+		case c == '+' || c == '-':
+			w.number = numExpSign
+		case digit:
+			w.number = numExpDigit
+		default:
+			return false
+		}
+	case numExpSign:
+		if !digit {
+			return false
+		}
+		w.number = numExpDigit
+	case numExpDigit:
+		if !digit {
+			return false
+		}
+	}
+	return true
+}
+
+// endNumber ends the number being read and reports whether it was complete.
+func (w *jsonPreview) endNumber() bool {
+	switch w.number {
+	case numZero, numInt, numFrac, numExpDigit:
+		w.endValue()
+		return true
+	}
+	w.state = psInvalid
+	return false
+}
+
+// endLiteral ends the literal being read and reports whether it was valid.
+func (w *jsonPreview) endLiteral() bool {
+	switch string(w.literal[:w.litLen]) {
+	case "true", "false", "null":
+		w.endValue()
+		return true
+	}
+	w.state = psInvalid
+	return false
+}
+
+func (w *jsonPreview) endValue() {
+	w.cur = -1
+	if w.depth == 0 {
+		w.state = psDone
+	} else {
+		w.state = psAfter
+	}
+}
+
+func (w *jsonPreview) close(c byte) {
+	if w.depth == 0 || (c == '}') != w.inObject() {
+		w.state = psInvalid
+		return
+	}
+	w.depth--
+	w.endValue()
+}
+
+// status finishes the walk at the end of the body and returns how it went. It
+// returns "" if the body was empty.
+func (w *jsonPreview) status() string {
+	switch w.state {
+	case psNumber:
+		if w.depth == 0 && w.endNumber() {
+			return previewComplete
+		}
+	case psLiteral:
+		if w.depth == 0 && w.endLiteral() {
+			return previewComplete
+		}
+	case psDone:
+		return previewComplete
+	case psValue:
+		if w.depth == 0 && w.root < 0 {
+			return ""
+		}
+	}
+	if w.state == psInvalid {
+		return previewInvalid
+	}
+	return previewIncomplete
+}
+
+// render returns the preview as JSON that mirrors the shape of the document.
+// Objects keep their recorded keys, arrays their first elements followed by a
+// note with the total length, and scalars their first bytes if values is set or
+// their type otherwise. Containers nested too deep are replaced
+// with a note of their size.
+func (w *jsonPreview) render(values bool) []byte {
+	if w.root < 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	w.renderNode(&b, w.root, values)
+	return b.Bytes()
+}
+
+func (w *jsonPreview) renderNode(b *bytes.Buffer, i int32, values bool) {
+	n := &w.nodes[i]
+	switch n.kind {
+	case '{', '[':
+		open, close, unit := byte('{'), byte('}'), "keys"
+		if n.kind == '[' {
+			open, close, unit = '[', ']', "items"
+		}
+		if n.elided {
+			writePreviewString(b, fmt.Sprintf("%c… %d %s%c", open, n.count, unit, close))
+			return
+		}
+		b.WriteByte(open)
+		shown := 0
+		for c := n.first; c >= 0; c = w.nodes[c].next {
+			if shown > 0 {
+				b.WriteByte(',')
+			}
+			if n.kind == '{' {
+				child := &w.nodes[c]
+				writePreviewString(b, w.text(child.keyOff, child.keyLen, child.keyClipped))
+				b.WriteByte(':')
+			}
+			w.renderNode(b, c, values)
+			shown++
+		}
+		if more := n.count - shown; more > 0 {
+			if shown > 0 {
+				b.WriteByte(',')
+			}
+			if n.kind == '{' {
+				writePreviewString(b, "…")
+				b.WriteByte(':')
+			}
+			writePreviewString(b, fmt.Sprintf("+%d more %s, %d total", more, unit, n.count))
+		}
+		b.WriteByte(close)
+
+	case '"':
+		if !values {
+			writePreviewString(b, "<string>")
+			return
+		}
+		writePreviewString(b, w.text(n.valOff, n.valLen, n.valClipped))
+
+	case '0':
+		raw := w.arena[n.valOff : n.valOff+n.valLen]
+		switch {
+		case !values:
+			writePreviewString(b, "<number>")
+		case n.valClipped || !json.Valid(raw):
+			writePreviewString(b, string(raw)+"…")
+		default:
+			b.Write(raw)
+		}
+
+	case 't', 'f':
+		if !values {
+			writePreviewString(b, "<boolean>")
+		} else if n.kind == 't' {
+			b.WriteString("true")
+		} else {
+			b.WriteString("false")
+		}
+
+	default:
+		b.WriteString("null")
+	}
+}
+
+// text decodes an escaped key or string value from the arena. A clipped one
+// may end in the middle of an escape sequence, which is dropped.
+func (w *jsonPreview) text(off int32, n int32, clipped bool) string {
+	raw := w.arena[off : off+n]
+	for trim := 0; trim <= 6 && trim <= len(raw); trim++ {
+		var s string
+		quoted := make([]byte, 0, len(raw)+2)
+		quoted = append(append(append(quoted, '"'), raw[:len(raw)-trim]...), '"')
+		if err := json.Unmarshal(quoted, &s); err == nil {
+			if clipped {
+				s += "…"
+			}
+			return s
+		}
+	}
+	return "…"
+}
+
+func writePreviewString(b *bytes.Buffer, s string) {
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		panic(err)
+	}
+	b.Truncate(b.Len() - 1) // trailing newline
+}
+
+// newBodyPreview returns a preview for a body with the given headers, or nil if
+// the body isn't JSON or previews are off. Compressed bodies aren't previewed
+// because only the first -payload-limit bytes are ever decompressed.
+func newBodyPreview(header http.Header) *jsonPreview {
+	if BodyPreview == "off" || BodyPreview == "" {
+		return nil
+	}
+	if enc := header.Get("content-encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("content-type"))
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+	return newJSONPreview()
+}
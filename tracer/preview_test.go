@@ -0,0 +1,125 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func walkPreview(input string, chunk int) *jsonPreview {
+	w := newJSONPreview()
+	for b := []byte(input); len(b) > 0; {
+		n := min(chunk, len(b))
+		w.Write(b[:n])
+		b = b[n:]
+	}
+	return w
+}
+
+func TestJSONPreview(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	deep := strings.Repeat("[", 10) + strings.Repeat("]", 10)
+	tests := []struct {
+		name   string
+		input  string
+		values bool
+		want   string
+		status string
+	}{
+		{"object", `{"id": 7, "name": "a\"b", "ok": true, "none": null}`, true, `{"id":7,"name":"a\"b","ok":true,"none":null}`, previewComplete},
+		{"types only", `{"id": 7, "name": "x", "ok": false, "tags": ["a"]}`, false, `{"id":"<number>","name":"<string>","ok":"<boolean>","tags":["<string>"]}`, previewComplete},
+		{"long array", `[1, 2, 3, 4, 5]`, true, `[1,2,3,"+2 more items, 5 total"]`, previewComplete},
+		{"long string", `"` + long + `"`, true, `"` + long[:previewMaxScalar] + `…"`, previewComplete},
+		{"deep", deep, true, `[[[[[[[["[… 1 items]"]]]]]]]]`, previewComplete},
+		{"truncated", `{"users": [{"id": 1}, {"id": 2}, {"na`, true, `{"users":[{"id":1},{"id":2},{"…":"+1 more keys, 1 total"}]}`, previewIncomplete},
+		{"invalid", `{"a": 1,}`, true, `{"a":1}`, previewInvalid},
+		{"root scalar", `-1.5e3`, true, `-1.5e3`, previewComplete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, chunk := range []int{1, 3, len(tt.input)} {
+				w := walkPreview(tt.input, chunk)
+				if status := w.status(); status != tt.status {
+					t.Errorf("chunk %d: got status %q, want %q", chunk, status, tt.status)
+				}
+				if got := string(w.render(tt.values)); got != tt.want {
+					t.Errorf("chunk %d: got preview %s, want %s", chunk, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONPreviewManyKeys(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i < previewMaxKeys+5; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(`"k` + strings.Repeat("0", i%3) + string(rune('a'+i%26)) + `": {}`)
+	}
+	b.WriteString("}")
+
+	var got map[string]any
+	if err := json.Unmarshal(walkPreview(b.String(), 7).render(true), &got); err != nil {
+		t.Fatalf("decode preview: %v", err)
+	}
+	if more, _ := got["…"].(string); more != "+5 more keys, 37 total" {
+		t.Errorf("got more keys note %q, want +5 more keys, 37 total", more)
+	}
+}
+
+// TestJSONPreviewBounded checks that walking a large body doesn't allocate.
+func TestJSONPreviewBounded(t *testing.T) {
+	item := []byte(`{"id": 12345, "name": "` + strings.Repeat("n", 200) + `", "tags": ["a", "b", "c", "d"], "nested": {"x": [[[[[[[[[[1]]]]]]]]]]}},`)
+	body := append([]byte("["), bytes.Repeat(item, 5000)...)
+	body = append(body[:len(body)-1], ']')
+
+	allocs := testing.AllocsPerRun(1, func() {
+		w := newJSONPreview()
+		for b := body; len(b) > 0; b = b[min(len(b), 4096):] {
+			w.Write(b[:min(len(b), 4096)])
+		}
+	})
+	if allocs > 3 {
+		t.Errorf("walking a %d byte body allocated %v times, want only the walker itself", len(body), allocs)
+	}
+
+	w := walkPreview(string(body), 4096)
+	if status := w.status(); status != previewComplete {
+		t.Errorf("got status %q, want %q", status, previewComplete)
+	}
+	if n := len(w.render(true)); n > 4*previewArenaBytes {
+		t.Errorf("got a %d byte preview, want it bounded", n)
+	}
+}
+
+func FuzzJSONPreview(f *testing.F) {
+	f.Add([]byte(`{"a": [1, 2.5e-3, "xéy", true, false, null], "b": {"c": {}}}`), uint8(3))
+	f.Add([]byte(`[{"k": "😀"}, -0, 0.1, "`), uint8(1))
+	f.Add([]byte(`{"a" 1}`), uint8(2))
+	f.Add([]byte(strings.Repeat("[", 2000)), uint8(64))
+	f.Fuzz(func(t *testing.T, input []byte, chunk uint8) {
+		w := walkPreview(string(input), int(chunk)+1)
+		status := w.status()
+		for _, values := range []bool{true, false} {
+			if out := w.render(values); out != nil && !json.Valid(out) {
+				t.Fatalf("preview of %q is invalid JSON: %s", input, out)
+			}
+		}
+
+		// The walker doesn't check UTF-8 and gives up on deeper nesting than
+		// encoding/json does, so only compare plain and shallow input.
+		if bytes.ContainsFunc(input, func(r rune) bool { return r >= 0x80 }) || bytes.Count(input, []byte("["))+bytes.Count(input, []byte("{")) >= previewTrackDepth {
+			return
+		}
+		if valid := json.Valid(input); valid != (status == previewComplete) {
+			t.Fatalf("json.Valid(%q) = %v, but got status %q", input, valid, status)
+		}
+	})
+}
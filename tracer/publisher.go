@@ -3,18 +3,23 @@ package tracer
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/term"
 	"nhooyr.io/websocket"
+	"subtrace.dev/cmd/run/crash"
 	"subtrace.dev/pubsub"
 	"subtrace.dev/rpc"
 )
@@ -25,13 +30,182 @@ type publisher struct {
 	ch       chan []byte
 	inflight sync.WaitGroup
 	queued   sync.WaitGroup
+	pending  atomic.Int64
+
+	// circuitOpen is set after too many consecutive dial failures. While it's
+	// set, new events are dropped instead of queued so that a dead endpoint
+	// doesn't hold on to memory and stall the flush at exit.
+	circuitOpen atomic.Bool
+	outcomes    [numDialOutcomes]atomic.Uint64
+	dropped     atomic.Uint64
+
+	mu    sync.Mutex
+	state string
+
+	// sink is set for the publishers of configured sinks, which use their own
+	// token and endpoint instead of the run's (see sinks.go).
+	sink *sinkAuth
+
+	// spool, if set, keeps the events that would otherwise be dropped on disk
+	// until they're uploaded (see spool.go). writing is the event Loop is
+	// writing, which Spill spools too.
+	spool   *Spool
+	writing atomic.Pointer[[]byte]
+}
+
+// SetSpool makes the publisher spool events instead of dropping them. It must
+// be called before Loop.
+func (p *publisher) SetSpool(s *Spool) {
+	p.spool = s
+}
+
+// dialOutcome classifies the result of a publisher dial attempt.
+type dialOutcome int
+
+const (
+	outcomeOK dialOutcome = iota
+	outcomeUnauthorized
+	outcomeThrottled
+	outcomeServerError
+	outcomeNetworkError
+	numDialOutcomes
+)
+
+var dialOutcomeNames = [numDialOutcomes]string{
+	outcomeOK:           "ok",
+	outcomeUnauthorized: "unauthorized",
+	outcomeThrottled:    "throttled",
+	outcomeServerError:  "server_error",
+	outcomeNetworkError: "network_error",
+}
+
+const (
+	stateHealthy      = "healthy"
+	stateUnauthorized = "unauthorized"
+	stateThrottled    = "throttled"
+	stateUnavailable  = "unavailable"
+	stateCircuitOpen  = "circuit open"
+)
+
+var (
+	dialBackoffBase = time.Second
+	dialBackoffMax  = time.Minute
+	maxRetryAfter   = 10 * time.Minute
+
+	// circuitThreshold is the number of consecutive dial failures after which
+	// the publisher stops queueing events until a dial succeeds again.
+	circuitThreshold = 5
+)
+
+var errUnauthorized = fmt.Errorf("unauthorized")
+
+func classifyDialError(err error) dialOutcome {
+	var se *rpc.StatusError
+	switch {
+	case err == nil:
+		return outcomeOK
+	case errors.Is(err, errUnauthorized):
+		return outcomeUnauthorized
+	case errors.As(err, &se) && se.Code == http.StatusTooManyRequests:
+		return outcomeThrottled
+	case errors.As(err, &se):
+		return outcomeServerError
+	default:
+		return outcomeNetworkError
+	}
+}
+
+// dialBackoff returns the wait before the next attempt after the given number
+// of consecutive failures: exponential with jitter in [d/2, d].
+func dialBackoff(failures int) time.Duration {
+	d := dialBackoffMax
+	if failures < 32 {
+		d = min(dialBackoffBase<<max(0, failures-1), dialBackoffMax)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Metrics returns the number of dial attempts by outcome and the number of
+// events dropped while the circuit was open or the queue was full. With a
+// spool, its metrics are added as "spool.<metric>".
+func (p *publisher) Metrics() map[string]uint64 {
+	m := make(map[string]uint64, numDialOutcomes+1)
+	for i := range p.outcomes {
+		m["dial_"+dialOutcomeNames[i]] = p.outcomes[i].Load()
+	}
+	m["dropped"] = p.dropped.Load()
+	if p.spool != nil {
+		for key, val := range p.spool.Metrics() {
+			m["spool."+key] = val
+		}
+	}
+	return m
+}
+
+// ServeDebugPublisher serves the publisher metrics as JSON. The metrics of
+// configured sinks are added as "sink.<name>.<metric>", those of span
+// exporters as "span.<name>.<metric>" and those of -sink-exec as
+// "exec.<metric>".
+func ServeDebugPublisher(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	m := DefaultPublisher.Metrics()
+	for name, sm := range SinkMetrics() {
+		for key, val := range sm {
+			m["sink."+name+"."+key] = val
+		}
+	}
+	for name, sm := range SpanMetrics() {
+		for key, val := range sm {
+			m["span."+name+"."+key] = val
+		}
+	}
+	if DefaultExecSink != nil {
+		for key, val := range DefaultExecSink.Metrics() {
+			m["exec."+key] = val
+		}
+	}
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		slog.Debug("failed to write debug publisher response", "err", err) // not fatal
+	}
+}
+
+// setState logs state transitions once rather than on every attempt.
+func (p *publisher) setState(state string, err error) {
+	p.mu.Lock()
+	prev := p.state
+	p.state = state
+	p.mu.Unlock()
+
+	if prev == state {
+		return
+	}
+	var attrs []any
+	if p.sink != nil {
+		attrs = append(attrs, "sink", p.sink.name)
+	}
+	switch state {
+	case stateHealthy:
+		if prev != "" {
+			slog.Info("subtrace publisher recovered", append(attrs, "previous", prev)...)
+		}
+	case stateCircuitOpen:
+		if p.spool != nil {
+			slog.Warn("subtrace publisher endpoint unreachable, spooling events until it recovers", append(attrs, "dir", p.spool.Dir(), "err", err)...)
+			break
+		}
+		slog.Warn("subtrace publisher endpoint unreachable, dropping events until it recovers", append(attrs, "err", err)...)
+	default:
+		slog.Warn("subtrace publisher "+state+", retrying with backoff", append(attrs, "err", err)...)
+	}
 }
 
 func (p *publisher) dialSingle(ctx context.Context) (*websocket.Conn, string, error) {
 	req := &pubsub.JoinPublisher_Request{}
 
 	var opts []rpc.Option
-	if os.Getenv("SUBTRACE_TOKEN") == "" {
+	if p.sink != nil {
+		opts = p.sink.options()
+	} else if rpc.Token() == "" {
 		linkID := os.Getenv("SUBTRACE_LINK_ID_OVERRIDE")
 		if linkID != "" {
 			req.LinkIdOverride = &linkID
@@ -43,7 +217,9 @@ func (p *publisher) dialSingle(ctx context.Context) (*websocket.Conn, string, er
 	}
 
 	var pub pubsub.JoinPublisher_Response
-	if code, err := rpc.Call(ctx, &pub, "/api/JoinPublisher", req, opts...); err != nil {
+	if code, err := rpc.Call(ctx, &pub, "/api/JoinPublisher", req, opts...); code == http.StatusUnauthorized || code == http.StatusForbidden {
+		return nil, "", fmt.Errorf("call JoinPublisher: %w: %s", errUnauthorized, http.StatusText(code))
+	} else if err != nil {
 		return nil, "", fmt.Errorf("call JoinPublisher: %w", err)
 	} else if code != http.StatusOK || (pub.Error != nil && *pub.Error != "") {
 		err := fmt.Errorf("JoinPublisher: %s", http.StatusText(code))
@@ -61,11 +237,17 @@ func (p *publisher) dialSingle(ctx context.Context) (*websocket.Conn, string, er
 	slog.Debug("dialing publisher websocket", "namespaceID", u.Query().Get("namespaceID"), "expiry", u.Query().Get("expiry"))
 	conn, resp, err := websocket.Dial(ctx, u.String(), &websocket.DialOptions{
 		HTTPClient: http.DefaultClient,
-		HTTPHeader: rpc.GetHeader(),
+		HTTPHeader: rpc.GetHeader(opts...),
 	})
 	if err != nil {
 		err := fmt.Errorf("websocket dial: %w", err)
 		if resp != nil {
+			switch code := resp.StatusCode; {
+			case code == http.StatusUnauthorized || code == http.StatusForbidden:
+				err = fmt.Errorf("%w: %w", err, errUnauthorized)
+			case code == http.StatusTooManyRequests || code >= 500:
+				err = fmt.Errorf("%w: %w", err, &rpc.StatusError{Code: code, Status: resp.Status, RetryAfter: rpc.RetryAfter(resp.Header, time.Now())})
+			}
 			err = fmt.Errorf("%w: %s", err, http.StatusText(resp.StatusCode))
 			if resp.Body != nil {
 				if b, err2 := io.ReadAll(resp.Body); err2 != nil && len(b) > 0 {
@@ -100,25 +282,87 @@ func (p *publisher) wait(ctx context.Context, dur time.Duration) bool {
 }
 
 func (p *publisher) dial(ctx context.Context) (*websocket.Conn, string) {
-	var backoff time.Duration
-	for i := 0; ; i++ {
+	failures := 0
+	for {
 		conn, url, err := p.dialSingle(ctx)
-		if err != nil {
-			backoff += time.Second
-			if backoff > 10*time.Second {
-				backoff = 10 * time.Second
+		outcome := classifyDialError(err)
+		p.outcomes[outcome].Add(1)
+		if err == nil {
+			p.circuitOpen.Store(false)
+			p.setState(stateHealthy, nil)
+			return conn, url
+		}
+
+		failures++
+		wait := dialBackoff(failures)
+		var se *rpc.StatusError
+		if errors.As(err, &se) && se.RetryAfter > 0 {
+			wait = min(max(wait, se.RetryAfter), maxRetryAfter)
+		}
+
+		state := stateUnavailable
+		switch outcome {
+		case outcomeUnauthorized:
+			state = stateUnauthorized
+			// The token may have been rotated under us. Retry right away if the
+			// token file has a new one.
+			refresh := rpc.RefreshToken
+			if p.sink != nil {
+				refresh = p.sink.refresh
 			}
-			if ok := p.wait(ctx, backoff); !ok {
-				return nil, ""
+			if changed, err := refresh(); err != nil {
+				slog.Debug("failed to refresh token", "err", err)
+			} else if changed {
+				slog.Debug("token changed, retrying publisher dial immediately")
+				wait = 0
 			}
-			slog.Debug("failed to dial websocket", "err", err, "attempt", i)
-			continue
-		} else {
-			return conn, url
+		case outcomeThrottled:
+			state = stateThrottled
+		}
+
+		if failures >= circuitThreshold && p.circuitOpen.CompareAndSwap(false, true) {
+			p.setState(stateCircuitOpen, err)
+			p.dropQueued()
+		} else if !p.circuitOpen.Load() {
+			p.setState(state, err)
+		}
+
+		slog.Debug("failed to dial publisher websocket", "err", err, "outcome", dialOutcomeNames[outcome], "failures", failures, "wait", wait)
+		if ok := p.wait(ctx, wait); !ok {
+			return nil, ""
+		}
+	}
+}
+
+// dropQueued drops every event waiting in the queue, or spools it.
+func (p *publisher) dropQueued() {
+	for {
+		select {
+		case b := <-p.ch:
+			p.spoolOrDrop(b)
+			p.pending.Add(-1)
+			p.queued.Done()
+		default:
+			return
 		}
 	}
 }
 
+// spoolOrDrop spools an event that can't be queued, or drops it if there's no
+// spool or writing to it fails.
+func (p *publisher) spoolOrDrop(b []byte) error {
+	if p.spool == nil {
+		p.dropped.Add(1)
+		return fmt.Errorf("no spool")
+	}
+	if err := p.spool.Add(b); err != nil {
+		// The event was counted as spooled but the whole batch was lost.
+		slog.Warn("failed to spool publisher events", "dir", p.spool.Dir(), "err", err)
+		return err
+	}
+	return nil
+}
+
 func box(title string, body ...string) {
 	const (
 		HH = "─"
@@ -168,6 +412,10 @@ func (p *publisher) showURL(val string) {
 	if val == "" {
 		return
 	}
+	if p.sink != nil {
+		slog.Info("subtrace sink connected", "sink", p.sink.name, "url", val)
+		return
+	}
 
 	box(
 		"SUBTRACE",
@@ -180,17 +428,33 @@ func (p *publisher) showURL(val string) {
 }
 
 func (p *publisher) queueWrite(b []byte) error {
+	if p.spool != nil && (p.circuitOpen.Load() || p.Pending() >= spoolAfterPending) {
+		return p.spoolOrDrop(b)
+	}
+	if p.circuitOpen.Load() {
+		p.dropped.Add(1)
+		return fmt.Errorf("publisher endpoint unreachable")
+	}
+
 	p.queued.Add(1)
+	p.pending.Add(1)
 	select {
-	case DefaultPublisher.ch <- b:
+	case p.ch <- b:
 		return nil
 	default:
+		p.pending.Add(-1)
 		p.queued.Done()
+		if p.spool != nil {
+			return p.spoolOrDrop(b)
+		}
+		p.dropped.Add(1)
 		return fmt.Errorf("publisher channel buffer full")
 	}
 }
 
 func (p *publisher) Loop(ctx context.Context) {
+	defer crash.Recover("publisher")
+
 	var conn *websocket.Conn
 	defer func() {
 		if conn != nil {
@@ -205,59 +469,152 @@ func (p *publisher) Loop(ctx context.Context) {
 		} else {
 			conn = c
 			p.showURL(url)
+			conn = p.replaySpool(ctx, conn)
 		}
 	}
 
+	var replay <-chan time.Time
+	if p.spool != nil {
+		ticker := time.NewTicker(spoolReplayInterval)
+		defer ticker.Stop()
+		replay = ticker.C
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-replay:
+			if conn != nil {
+				conn = p.replaySpool(ctx, conn)
+			}
 		case b := <-p.ch:
+			p.writing.Store(&b)
 			for i := 0; ; i++ {
 				if conn == nil {
 					conn, _ = p.dial(ctx)
 					if conn == nil { // context deadline exceeded
 						return
 					}
+					conn = p.replaySpool(ctx, conn)
 				}
 
-				if err := conn.Write(ctx, websocket.MessageBinary, b); err != nil {
-					slog.Debug("failed to write to websocket", "err", err)
+				err := errSpoolReplay
+				if conn != nil {
+					err = conn.Write(ctx, websocket.MessageBinary, b)
+				}
+				if err == nil {
+					p.writing.Store(nil)
+					p.pending.Add(-1)
+					p.queued.Done()
+					break
+				}
+
+				slog.Debug("failed to write to websocket", "err", err)
+				if conn != nil {
 					conn.CloseNow()
 					conn = nil
-					if i > 0 {
-						if !p.wait(ctx, time.Second) {
-							return
-						}
+				}
+				if p.spool != nil {
+					// Spool the event rather than hold up the queue while the
+					// publisher redials.
+					if p.writing.Swap(nil) != nil {
+						p.spoolOrDrop(b)
 					}
-				} else {
+					p.pending.Add(-1)
 					p.queued.Done()
 					break
 				}
+				if i > 0 {
+					if !p.wait(ctx, time.Second) {
+						return
+					}
+				}
 			}
 		}
 	}
 }
 
-func (p *publisher) Flush(timeout time.Duration) (flushed bool) {
-	waitEmpty := func(timeout time.Duration, wg *sync.WaitGroup) bool {
-		ch := make(chan struct{})
-		go func() {
-			defer close(ch)
-			wg.Wait()
-		}()
+var errSpoolReplay = fmt.Errorf("failed to upload spooled events")
 
-		timer := time.NewTimer(timeout)
-		defer timer.Stop()
+// replaySpool uploads the spooled events over conn. If that fails, it closes
+// conn and returns nil.
+func (p *publisher) replaySpool(ctx context.Context, conn *websocket.Conn) *websocket.Conn {
+	if p.spool == nil {
+		return conn
+	}
+	if err := p.spool.Sync(); err != nil {
+		slog.Warn("failed to spool publisher events", "dir", p.spool.Dir(), "err", err)
+	}
+	n, err := p.spool.Replay(func(b []byte) error {
+		return conn.Write(ctx, websocket.MessageBinary, b)
+	})
+	if n > 0 {
+		slog.Debug("uploaded spooled events", "dir", p.spool.Dir(), "events", n)
+	}
+	if err != nil {
+		slog.Debug("failed to upload spooled events", "dir", p.spool.Dir(), "err", err)
+		conn.CloseNow()
+		return nil
+	}
+	return conn
+}
 
+// Spill moves the events that are still queued to the spool, along with the
+// one being written, and writes the spool's last batch. It's called at exit,
+// after Flush, and returns the number of events moved. The event being
+// written may be uploaded twice if its write completes in the meantime.
+func (p *publisher) Spill() (int, error) {
+	if p.spool == nil {
+		return 0, nil
+	}
+	n := 0
+	if b := p.writing.Swap(nil); b != nil {
+		p.spoolOrDrop(*b)
+		n++
+	}
+	for {
 		select {
-		case <-ch:
-			return true
-		case <-timer.C:
-			return false
+		case b := <-p.ch:
+			p.spoolOrDrop(b)
+			p.pending.Add(-1)
+			p.queued.Done()
+			n++
+			continue
+		default:
 		}
+		break
 	}
+	return n, p.spool.Sync()
+}
 
+// ReplaySpool dials the endpoint and uploads every spooled event, for
+// `subtrace flush-spool`. It returns the number of events uploaded.
+func (p *publisher) ReplaySpool(ctx context.Context, s *Spool) (int, error) {
+	conn, _ := p.dial(ctx)
+	if conn == nil {
+		return 0, fmt.Errorf("dial: %w", context.Cause(ctx))
+	}
+	defer conn.CloseNow()
+
+	n, err := s.Replay(func(b []byte) error {
+		return conn.Write(ctx, websocket.MessageBinary, b)
+	})
+	if err != nil {
+		return n, fmt.Errorf("upload: %w", err)
+	}
+	if err := conn.Close(websocket.StatusNormalClosure, ""); err != nil {
+		slog.Debug("failed to close publisher websocket", "err", err) // not fatal
+	}
+	return n, nil
+}
+
+// Pending returns the number of events queued but not yet written.
+func (p *publisher) Pending() int {
+	return int(p.pending.Load())
+}
+
+func (p *publisher) Flush(timeout time.Duration) (flushed bool) {
 	start := time.Now()
 	waitEmpty(timeout/2, &p.inflight)
 	if left := timeout - time.Since(start); left > 0 {
@@ -270,3 +627,28 @@ func (p *publisher) Flush(timeout time.Duration) (flushed bool) {
 		return false
 	}
 }
+
+// FlushQueued is Flush for the events already queued, without waiting for the
+// ones still being finished. It's the emergency flush after a crash, when
+// those may never be.
+func (p *publisher) FlushQueued(timeout time.Duration) bool {
+	return waitEmpty(timeout, &p.queued)
+}
+
+func waitEmpty(timeout time.Duration, wg *sync.WaitGroup) bool {
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		wg.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
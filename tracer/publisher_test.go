@@ -0,0 +1,272 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"nhooyr.io/websocket"
+	"subtrace.dev/internal/testutil"
+	"subtrace.dev/pubsub"
+	"subtrace.dev/rpc"
+)
+
+// fakeBackend serves JoinPublisher and the publisher websocket. join decides
+// the response to each JoinPublisher call; returning 0 accepts it.
+type fakeBackend struct {
+	*httptest.Server
+	join     func(r *http.Request, w http.ResponseWriter) int
+	joins    atomic.Int64
+	received chan []byte
+}
+
+func newFakeBackend(t *testing.T, join func(r *http.Request, w http.ResponseWriter) int) *fakeBackend {
+	b := &fakeBackend{join: join, received: make(chan []byte, 64)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/JoinPublisher", func(w http.ResponseWriter, r *http.Request) {
+		b.joins.Add(1)
+		if code := b.join(r, w); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+		resp, _ := protojson.Marshal(&pubsub.JoinPublisher_Response{WebsocketUrl: "ws://" + r.Host + "/ws"})
+		w.Write(resp)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			_, msg, err := conn.Read(r.Context())
+			if err != nil {
+				return
+			}
+			b.received <- msg
+		}
+	})
+
+	b.Server = httptest.NewServer(mux)
+	t.Cleanup(b.Close)
+	t.Setenv("SUBTRACE_ENDPOINT", b.URL)
+	return b
+}
+
+// captureLogs redirects the default logger to a buffer for the duration of
+// the test.
+func captureLogs(t *testing.T) *syncBuffer {
+	buf := new(syncBuffer)
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return buf
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func fastBackoff(t *testing.T) {
+	base, threshold := dialBackoffBase, circuitThreshold
+	dialBackoffBase = time.Millisecond
+	t.Cleanup(func() { dialBackoffBase, circuitThreshold = base, threshold })
+}
+
+func startPublisher(t *testing.T) *publisher {
+	p := &publisher{ch: make(chan []byte, 16)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Loop(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return p
+}
+
+func expectReceived(t *testing.T, b *fakeBackend, want string) {
+	t.Helper()
+	select {
+	case got := <-b.received:
+		if string(got) != want {
+			t.Fatalf("received %q, want %q", got, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+func TestPublisherTokenRefresh(t *testing.T) {
+	fastBackoff(t)
+	logs := captureLogs(t)
+
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("old\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SUBTRACE_TOKEN_FILE", path)
+	if _, err := rpc.RefreshToken(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rpc.RefreshToken() })
+
+	b := newFakeBackend(t, func(r *http.Request, w http.ResponseWriter) int {
+		if r.Header.Get("authorization") == "Bearer new" {
+			return 0
+		}
+		// Rotate the token as the first request is rejected.
+		os.WriteFile(path, []byte("new\n"), 0o600)
+		return http.StatusUnauthorized
+	})
+
+	p := startPublisher(t)
+	if err := p.queueWrite([]byte("event")); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, b, "event")
+	testutil.WaitFor(t, "queue to drain", func() bool { return p.Pending() == 0 })
+
+	m := p.Metrics()
+	if m["dial_unauthorized"] != 1 || m["dial_ok"] != 1 {
+		t.Fatalf("metrics = %v, want 1 unauthorized and 1 ok", m)
+	}
+	if n := b.joins.Load(); n != 2 {
+		t.Fatalf("got %d JoinPublisher calls, want 2", n)
+	}
+	if out := logs.String(); !strings.Contains(out, "publisher unauthorized") || !strings.Contains(out, "publisher recovered") {
+		t.Fatalf("missing state change logs:\n%s", out)
+	}
+}
+
+func TestPublisherRetryAfter(t *testing.T) {
+	fastBackoff(t)
+	logs := captureLogs(t)
+
+	var first atomic.Bool
+	first.Store(true)
+	b := newFakeBackend(t, func(r *http.Request, w http.ResponseWriter) int {
+		if first.CompareAndSwap(true, false) {
+			w.Header().Set("retry-after", "1")
+			return http.StatusTooManyRequests
+		}
+		return 0
+	})
+
+	start := time.Now()
+	p := startPublisher(t)
+	if err := p.queueWrite([]byte("event")); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, b, "event")
+	if took := time.Since(start); took < time.Second {
+		t.Fatalf("retried after %v, want at least the 1s Retry-After", took)
+	}
+
+	if m := p.Metrics(); m["dial_throttled"] != 1 || m["dial_ok"] != 1 {
+		t.Fatalf("metrics = %v, want 1 throttled and 1 ok", m)
+	}
+	if out := logs.String(); strings.Count(out, "publisher throttled") != 1 {
+		t.Fatalf("want exactly one throttled log:\n%s", out)
+	}
+}
+
+func TestPublisherCircuitBreaker(t *testing.T) {
+	fastBackoff(t)
+	circuitThreshold = 3
+	logs := captureLogs(t)
+
+	var healthy atomic.Bool
+	b := newFakeBackend(t, func(r *http.Request, w http.ResponseWriter) int {
+		if healthy.Load() {
+			return 0
+		}
+		return http.StatusServiceUnavailable
+	})
+
+	p := startPublisher(t)
+	for range 4 {
+		if err := p.queueWrite([]byte("queued")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testutil.WaitFor(t, "circuit to open", p.circuitOpen.Load)
+	if n := p.Pending(); n != 0 {
+		t.Fatalf("got %d pending after circuit opened, want 0", n)
+	}
+	if m := p.Metrics(); m["dropped"] != 4 || m["dial_server_error"] < 3 {
+		t.Fatalf("metrics = %v, want 4 dropped and at least 3 server errors", m)
+	}
+	if err := p.queueWrite([]byte("dropped")); err == nil {
+		t.Fatalf("queueWrite succeeded with circuit open")
+	}
+	if n := p.Metrics()["dropped"]; n != 5 {
+		t.Fatalf("got %d dropped, want 5", n)
+	}
+
+	healthy.Store(true)
+	testutil.WaitFor(t, "circuit to close", func() bool { return !p.circuitOpen.Load() })
+	if err := p.queueWrite([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, b, "after")
+
+	out := logs.String()
+	if strings.Count(out, "dropping events") != 1 {
+		t.Fatalf("want exactly one circuit open log:\n%s", out)
+	}
+	if strings.Count(out, "publisher unavailable") != 1 {
+		t.Fatalf("want exactly one unavailable log:\n%s", out)
+	}
+	if !strings.Contains(out, "publisher recovered") {
+		t.Fatalf("missing recovery log:\n%s", out)
+	}
+}
+
+func TestRetryAfterClockSkew(t *testing.T) {
+	server := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	h := http.Header{}
+	h.Set("date", server.Format(http.TimeFormat))
+	h.Set("retry-after", server.Add(30*time.Second).Format(http.TimeFormat))
+
+	// The local clock is an hour ahead of the server's.
+	if got := rpc.RetryAfter(h, server.Add(time.Hour)); got != 30*time.Second {
+		t.Fatalf("got %v, want 30s", got)
+	}
+
+	h.Set("retry-after", "7")
+	if got := rpc.RetryAfter(h, server); got != 7*time.Second {
+		t.Fatalf("got %v, want 7s", got)
+	}
+}
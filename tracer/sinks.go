@@ -0,0 +1,260 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/config"
+	"subtrace.dev/rpc"
+)
+
+// Sinks are the destinations configured in the config's sinks section, each
+// with its own publisher queue and event log. Events routed to none of them
+// go to the default sink: DefaultPublisher, DefaultEventLog and the tunneler.
+// Local consumers (-log, -on-event, -sink-exec, span exporters and devtools)
+// see every event regardless of routing. Sinks must be set before any events
+// are produced.
+var Sinks []*Sink
+
+type Sink struct {
+	config    *config.Sink
+	publisher *publisher // nil if the sink has no token
+	eventLog  *EventLog  // nil if the sink has no event log
+
+	routed   atomic.Uint64
+	redacted atomic.Uint64
+}
+
+// OpenSinks opens the event logs of the configured sinks. eventLog is the
+// -event-log path, which sinks without their own event log derive theirs from.
+func OpenSinks(cfgs []*config.Sink, eventLog string) ([]*Sink, error) {
+	var ret []*Sink
+	for _, cfg := range cfgs {
+		s := &Sink{config: cfg}
+		if cfg.Token != "" || cfg.TokenFile != "" {
+			s.publisher = &publisher{
+				ch:   make(chan []byte, 4096),
+				sink: &sinkAuth{name: cfg.Name, token: cfg.Token, file: cfg.TokenFile, endpoint: cfg.Endpoint},
+			}
+			if _, err := s.publisher.sink.refresh(); err != nil {
+				closeSinks(ret)
+				return nil, fmt.Errorf("sink %q: %w", cfg.Name, err)
+			}
+		}
+		if path := cfg.EventLogPath(eventLog); path != "" {
+			l, err := OpenEventLog(path)
+			if err != nil {
+				closeSinks(ret)
+				return nil, fmt.Errorf("sink %q: %w", cfg.Name, err)
+			}
+			s.eventLog = l
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+func closeSinks(sinks []*Sink) {
+	for _, s := range sinks {
+		s.Close()
+	}
+}
+
+func (s *Sink) Name() string {
+	return s.config.Name
+}
+
+// Loop runs the sink's publisher until ctx is done.
+func (s *Sink) Loop(ctx context.Context) {
+	if s.publisher != nil {
+		s.publisher.Loop(ctx)
+	}
+}
+
+// Flush waits up to timeout for the sink's queued events to be written.
+func (s *Sink) Flush(timeout time.Duration) bool {
+	if s.publisher == nil {
+		return true
+	}
+	return s.publisher.Flush(timeout)
+}
+
+// FlushQueued waits up to timeout for the events already queued to be
+// written (see publisher.FlushQueued).
+func (s *Sink) FlushQueued(timeout time.Duration) bool {
+	if s.publisher == nil {
+		return true
+	}
+	return s.publisher.FlushQueued(timeout)
+}
+
+// Pending returns the number of events queued but not yet written.
+func (s *Sink) Pending() int {
+	if s.publisher == nil {
+		return 0
+	}
+	return s.publisher.Pending()
+}
+
+// Metrics returns the number of events routed to the sink and, if it has a
+// publisher, its metrics.
+func (s *Sink) Metrics() map[string]uint64 {
+	m := make(map[string]uint64)
+	if s.publisher != nil {
+		m = s.publisher.Metrics()
+	}
+	m["routed"] = s.routed.Load()
+	m["redacted"] = s.redacted.Load()
+	return m
+}
+
+func (s *Sink) Close() error {
+	if s.eventLog == nil {
+		return nil
+	}
+	return s.eventLog.Close()
+}
+
+// routeSinks returns the sinks an event is routed to, or nil if it goes to the
+// default sink.
+func routeSinks(tags map[string]string, entry *har.Entry) []*Sink {
+	var ret []*Sink
+	for _, s := range Sinks {
+		if s.config.Matches(tags, entry) {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// sinkEvent is an event as it's delivered to sinks. The payload-redacted form
+// is only built if a sink's own policy needs it.
+type sinkEvent struct {
+	tags map[string]string
+	json []byte
+	host string
+
+	redact   func() (map[string]string, []byte, error)
+	redacted struct {
+		once sync.Once
+		tags map[string]string
+		json []byte
+		err  error
+	}
+}
+
+func (ev *sinkEvent) forSink(s *Sink) (map[string]string, []byte, error) {
+	if ev.redact == nil || ev.host == "" || !s.config.DeniesPayload(ev.host) {
+		return ev.tags, ev.json, nil
+	}
+	ev.redacted.once.Do(func() {
+		ev.redacted.tags, ev.redacted.json, ev.redacted.err = ev.redact()
+	})
+	s.redacted.Add(1)
+	return ev.redacted.tags, ev.redacted.json, ev.redacted.err
+}
+
+// deliver sends an event to the sink's publisher and event log. Failures are
+// logged like the default sink's.
+func (s *Sink) deliver(ev *sinkEvent, logidx uint64, loglines []string) error {
+	s.routed.Add(1)
+	tags, json, err := ev.forSink(s)
+	if err != nil {
+		return fmt.Errorf("sink %q: redact: %w", s.Name(), err)
+	}
+	if s.eventLog != nil && json != nil {
+		s.eventLog.Write(tags, json)
+	}
+	if s.publisher != nil {
+		if err := sendReflectorEvent(s.publisher, tags, json, logidx, loglines); err != nil {
+			return fmt.Errorf("sink %q: %w", s.Name(), err)
+		}
+	}
+	return nil
+}
+
+// redactForSinks returns the function that builds the payload-redacted form
+// of an event for sinks whose policy denies its host. It must only be called
+// once the event has been delivered everywhere else.
+func (p *Parser) redactForSinks(entry *extendedHarEntry, tags map[string]string) func() (map[string]string, []byte, error) {
+	return func() (map[string]string, []byte, error) {
+		p.redactPayloads()
+		entry.RequestBodyPreview, entry.ResponseBodyPreview = nil, nil
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("encode json: %w", err)
+		}
+		return withoutPreviews(tags), b, nil
+	}
+}
+
+// withoutPreviews returns a copy of tags without body previews, for events
+// whose payloads a sink's policy redacts.
+func withoutPreviews(tags map[string]string) map[string]string {
+	ret := maps.Clone(tags)
+	for key := range ret {
+		if strings.HasSuffix(key, "_body_preview") || strings.HasSuffix(key, "_body_preview_status") {
+			delete(ret, key)
+		}
+	}
+	if ret["capture_level"] == CaptureFull {
+		ret["capture_level"] = CaptureMetadata
+	}
+	return ret
+}
+
+// SinkMetrics returns the metrics of every sink by name.
+func SinkMetrics() map[string]map[string]uint64 {
+	ret := make(map[string]map[string]uint64, len(Sinks))
+	for _, s := range Sinks {
+		ret[s.Name()] = s.Metrics()
+	}
+	return ret
+}
+
+// sinkAuth is the token and endpoint of a sink's publisher.
+type sinkAuth struct {
+	name     string
+	endpoint string
+	file     string // read on refresh so that the token can be rotated
+
+	mu    sync.Mutex
+	token string
+}
+
+func (a *sinkAuth) options() []rpc.Option {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	opts := []rpc.Option{rpc.WithBearer(a.token)}
+	if a.endpoint != "" {
+		opts = append(opts, rpc.WithEndpoint(a.endpoint))
+	}
+	return opts
+}
+
+func (a *sinkAuth) refresh() (changed bool, err error) {
+	if a.file == "" {
+		return false, nil
+	}
+	b, err := os.ReadFile(a.file)
+	if err != nil {
+		return false, fmt.Errorf("read token file: %w", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	val := strings.TrimSpace(string(b))
+	changed = a.token != "" && a.token != val
+	a.token = val
+	return changed, nil
+}
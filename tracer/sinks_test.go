@@ -0,0 +1,191 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"google.golang.org/protobuf/proto"
+	"subtrace.dev/config"
+	"subtrace.dev/pubsub"
+)
+
+// receivedEventIDs reads n events from a fake backend and returns their IDs.
+func receivedEventIDs(t *testing.T, b *fakeBackend, n int) []string {
+	t.Helper()
+	var ret []string
+	for range n {
+		select {
+		case msg := <-b.received:
+			var m pubsub.Message
+			if err := proto.Unmarshal(msg, &m); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			ret = append(ret, m.GetConcreteV1().GetEvent().GetConcreteV1().GetTags()["event_id"])
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for event %d of %d", len(ret)+1, n)
+		}
+	}
+	select {
+	case <-b.received:
+		t.Fatalf("received more than %d events", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+func readEventLog(t *testing.T, path string) []EventLogLine {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open event log: %v", err)
+	}
+	defer f.Close()
+	var ret []EventLogLine
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var line EventLogLine
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("decode event log line: %v", err)
+		}
+		ret = append(ret, line)
+	}
+	return ret
+}
+
+func TestSinkRouting(t *testing.T) {
+	// Each backend only accepts its own tenant's token.
+	backend := func(token string) *fakeBackend {
+		return newFakeBackend(t, func(r *http.Request, w http.ResponseWriter) int {
+			if r.Header.Get("authorization") != "Bearer "+token {
+				return http.StatusUnauthorized
+			}
+			return 0
+		})
+	}
+	a, b := backend("token-a"), backend("token-b")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "subtrace.yaml")
+	yaml := fmt.Sprintf(`
+sinks:
+  - name: tenant-a
+    token: token-a
+    endpoint: %s
+    routes:
+      - header: "X-Tenant: a"
+    payloads:
+      deny: ["*.internal"]
+  - name: tenant-b
+    token: token-b
+    endpoint: %s
+    routes:
+      - header: "X-Tenant: b"
+`, a.URL, b.URL)
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.New()
+	if err := cfg.Load(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	sinks, err := OpenSinks(cfg.GetSinks(), filepath.Join(dir, "events.jsonl"))
+	if err != nil {
+		t.Fatalf("open sinks: %v", err)
+	}
+	prev := Sinks
+	Sinks = sinks
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		Sinks = prev
+		closeSinks(sinks)
+	})
+	for _, s := range sinks {
+		go s.Loop(ctx)
+	}
+
+	want := map[string][]string{}
+	for i, tenant := range []string{"a", "b", "", "a", "b", "c", "a"} {
+		id := fmt.Sprintf("event-%d", i)
+		host := "api.example.com"
+		if i == 6 {
+			host = "db.internal"
+		}
+		req := &har.Request{Method: "GET", URL: "http://" + host + "/", Headers: []har.Header{{Name: "Host", Value: host}}}
+		if tenant != "" {
+			req.Headers = append(req.Headers, har.Header{Name: "X-Tenant", Value: tenant})
+		}
+		entry := &har.Entry{Request: req, Response: &har.Response{Status: 200}}
+		tags := map[string]string{"event_id": id, "request_body_preview": `{"secret":"x"}`}
+
+		ev := &sinkEvent{tags: tags, json: []byte(`{"body":"secret"}`), host: host}
+		ev.redact = func() (map[string]string, []byte, error) {
+			return withoutPreviews(tags), []byte(`{"body":"<redacted>"}`), nil
+		}
+		routed := routeSinks(tags, entry)
+		if len(routed) == 0 {
+			want["default"] = append(want["default"], id)
+			continue
+		}
+		for _, s := range routed {
+			want[s.Name()] = append(want[s.Name()], id)
+			if err := s.deliver(ev, 0, nil); err != nil {
+				t.Fatalf("deliver %s: %v", id, err)
+			}
+		}
+	}
+
+	if got, want := receivedEventIDs(t, a, 3), []string{"event-0", "event-3", "event-6"}; !slices.Equal(got, want) {
+		t.Errorf("tenant-a backend got %v, want %v", got, want)
+	}
+	if got, want := receivedEventIDs(t, b, 2), []string{"event-1", "event-4"}; !slices.Equal(got, want) {
+		t.Errorf("tenant-b backend got %v, want %v", got, want)
+	}
+	if got := want["default"]; !slices.Equal(got, []string{"event-2", "event-5"}) {
+		t.Errorf("default sink got %v, want event-2 and event-5", got)
+	}
+
+	// The event logs are named after the sinks, and only tenant-a's policy
+	// redacts the payload of its event to db.internal.
+	lines := readEventLog(t, filepath.Join(dir, "events.tenant-a.jsonl"))
+	if len(lines) != 3 {
+		t.Fatalf("tenant-a event log has %d lines, want 3", len(lines))
+	}
+	body := func(line EventLogLine) string {
+		var v struct{ Body string }
+		if err := json.Unmarshal(line.Entry, &v); err != nil {
+			t.Fatalf("decode entry: %v", err)
+		}
+		return v.Body
+	}
+	if got := body(lines[2]); got != "<redacted>" {
+		t.Errorf("tenant-a got body %q for db.internal, want it redacted", got)
+	}
+	if _, ok := lines[2].Tags["request_body_preview"]; ok {
+		t.Errorf("tenant-a got a body preview for db.internal")
+	}
+	if got := body(lines[0]); got != "secret" {
+		t.Errorf("tenant-a got body %q for api.example.com, want it unredacted", got)
+	}
+	if n := len(readEventLog(t, filepath.Join(dir, "events.tenant-b.jsonl"))); n != 2 {
+		t.Errorf("tenant-b event log has %d lines, want 2", n)
+	}
+
+	m := SinkMetrics()
+	if m["tenant-a"]["routed"] != 3 || m["tenant-a"]["redacted"] != 1 || m["tenant-b"]["routed"] != 2 {
+		t.Errorf("got metrics %v, want 3 routed and 1 redacted for tenant-a and 2 routed for tenant-b", m)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"github.com/google/martian/v3/har"
+	"subtrace.dev/span"
+)
+
+// SpanExporters are sent a span for every event that isn't excluded by a
+// filter. They must be set before any event is produced.
+var SpanExporters []span.Exporter
+
+func exportSpan(tags map[string]string, entry *har.Entry, outgoing bool) {
+	if entry.Request == nil || entry.Response == nil {
+		return
+	}
+	s := span.New(tags, entry, outgoing)
+	for _, e := range SpanExporters {
+		e.Export(s)
+	}
+}
+
+// SpanMetrics returns the metrics of every span exporter by name.
+func SpanMetrics() map[string]map[string]uint64 {
+	ret := make(map[string]map[string]uint64, len(SpanExporters))
+	for _, e := range SpanExporters {
+		ret[e.Name()] = e.Metrics()
+	}
+	return ret
+}
@@ -0,0 +1,316 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// spoolMagic starts every spool batch file. It changes whenever the format
+// does so that batches written by another version are skipped.
+const spoolMagic = "STSPOOL1"
+
+const spoolExt = ".spool"
+
+var (
+	// spoolBatchEvents and spoolBatchBytes bound the events kept in memory
+	// before they're written to a batch file and fsynced.
+	spoolBatchEvents = 256
+	spoolBatchBytes  = 4 << 20
+
+	// spoolAfterPending is the number of events waiting in the publisher's
+	// queue after which new ones are spooled instead.
+	spoolAfterPending = 1024
+
+	// spoolReplayInterval is how often a connected publisher uploads what was
+	// spooled since it connected.
+	spoolReplayInterval = 30 * time.Second
+)
+
+// Spool keeps publisher events on disk while the endpoint is slow or
+// unreachable so that they survive outages and the tracer's exit. Events are
+// written in batches, one file per batch, each fsynced before it's renamed
+// into place. The next run or `subtrace flush-spool` uploads them, oldest
+// first. Once the files exceed the size cap, the oldest are evicted.
+type Spool struct {
+	dir      string
+	maxBytes int64 // 0 for no cap
+
+	mu    sync.Mutex
+	batch [][]byte
+	size  int
+	seq   uint64
+
+	spooled  atomic.Uint64
+	replayed atomic.Uint64
+	evicted  atomic.Uint64
+	corrupt  atomic.Uint64
+	failed   atomic.Uint64
+}
+
+// OpenSpool opens the spool in dir, creating it if needed, and removes the
+// batches a previous run didn't finish writing.
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create spool dir: %w", err)
+	}
+	tmps, err := filepath.Glob(filepath.Join(dir, "*"+spoolExt+".tmp"))
+	if err != nil {
+		return nil, fmt.Errorf("glob: %w", err)
+	}
+	for _, path := range tmps {
+		if err := os.Remove(path); err != nil {
+			slog.Debug("failed to remove partial spool batch", "path", path, "err", err)
+		}
+	}
+	return &Spool{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// Dir returns the directory the spool keeps its batches in.
+func (s *Spool) Dir() string {
+	return s.dir
+}
+
+// Add spools an event. It's written to disk with the rest of its batch.
+func (s *Spool) Add(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.spooled.Add(1)
+	s.batch = append(s.batch, b)
+	s.size += len(b)
+	if len(s.batch) < spoolBatchEvents && s.size < spoolBatchBytes {
+		return nil
+	}
+	return s.writeLocked()
+}
+
+// Sync writes the events that don't fill a batch yet.
+func (s *Spool) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked()
+}
+
+func (s *Spool) writeLocked() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	batch := s.batch
+	s.batch, s.size = nil, 0
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, spoolExt)
+	if err := writeSpoolBatch(filepath.Join(s.dir, name), batch); err != nil {
+		s.failed.Add(uint64(len(batch)))
+		return fmt.Errorf("write spool batch: %w", err)
+	}
+	s.evictLocked()
+	return nil
+}
+
+// writeSpoolBatch writes the events to path atomically: they're written to a
+// temporary file that's fsynced and then renamed.
+func writeSpoolBatch(path string, batch [][]byte) error {
+	b := new(bytes.Buffer)
+	b.WriteString(spoolMagic)
+	for _, ev := range batch {
+		var hdr [8]byte
+		binary.BigEndian.PutUint32(hdr[0:], uint32(len(ev)))
+		binary.BigEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(ev))
+		b.Write(hdr[:])
+		b.Write(ev)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("fsync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("close: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("rename: %w", err)
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// ReadSpoolBatch reads the events of a batch file. A batch that's cut short or
+// fails its checksums is returned as an error as a whole.
+func ReadSpoolBatch(path string) ([][]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(spoolMagic)) {
+		return nil, fmt.Errorf("not a spool batch")
+	}
+	b = b[len(spoolMagic):]
+
+	var ret [][]byte
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, fmt.Errorf("event %d: %w", len(ret), io.ErrUnexpectedEOF)
+		}
+		size, sum := binary.BigEndian.Uint32(b[0:]), binary.BigEndian.Uint32(b[4:])
+		b = b[8:]
+		if uint64(size) > uint64(len(b)) {
+			return nil, fmt.Errorf("event %d: %w", len(ret), io.ErrUnexpectedEOF)
+		}
+		if crc32.ChecksumIEEE(b[:size]) != sum {
+			return nil, fmt.Errorf("event %d: checksum mismatch", len(ret))
+		}
+		ret = append(ret, b[:size])
+		b = b[size:]
+	}
+	return ret, nil
+}
+
+// Batches returns the paths of the batch files from oldest to newest.
+func (s *Spool) Batches() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), spoolExt) {
+			ret = append(ret, filepath.Join(s.dir, e.Name()))
+		}
+	}
+	slices.Sort(ret)
+	return ret, nil
+}
+
+// evictLocked removes the oldest batches until the rest fit the size cap.
+func (s *Spool) evictLocked() {
+	if s.maxBytes <= 0 {
+		return
+	}
+	paths, err := s.Batches()
+	if err != nil {
+		slog.Debug("failed to list spool batches", "dir", s.dir, "err", err)
+		return
+	}
+	sizes := make([]int64, len(paths))
+	var total int64
+	for i, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			sizes[i] = fi.Size()
+			total += sizes[i]
+		}
+	}
+	for i := 0; i < len(paths) && total > s.maxBytes; i++ {
+		events, readErr := ReadSpoolBatch(paths[i])
+		if err := os.Remove(paths[i]); err != nil {
+			slog.Debug("failed to evict spool batch", "path", paths[i], "err", err)
+			continue
+		}
+		total -= sizes[i]
+		if readErr == nil {
+			s.evicted.Add(uint64(len(events)))
+		}
+		slog.Warn("spool is over its size cap, evicted the oldest batch", "path", paths[i], "events", len(events), "maxBytes", s.maxBytes)
+	}
+}
+
+// Replay sends the spooled batches from oldest to newest and removes each
+// one that's sent. It stops at the first event send fails on and keeps the
+// rest of that batch for the next replay. Corrupt batches are skipped and
+// removed. It returns the number of events sent.
+func (s *Spool) Replay(send func([]byte) error) (int, error) {
+	paths, err := s.Batches()
+	if err != nil {
+		return 0, fmt.Errorf("list batches: %w", err)
+	}
+
+	sent := 0
+	for _, path := range paths {
+		events, err := ReadSpoolBatch(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // evicted
+		}
+		if err != nil {
+			s.corrupt.Add(1)
+			slog.Warn("skipping corrupt spool batch", "path", path, "err", err)
+			s.remove(path)
+			continue
+		}
+
+		for i, ev := range events {
+			if err := send(ev); err != nil {
+				s.keep(path, events[i:])
+				return sent, err
+			}
+			sent++
+			s.replayed.Add(1)
+		}
+		s.remove(path)
+	}
+	return sent, nil
+}
+
+func (s *Spool) remove(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("failed to remove spool batch", "path", path, "err", err)
+	}
+}
+
+// keep replaces a partly sent batch with the events that are left, unless it
+// was evicted in the meantime.
+func (s *Spool) keep(path string, left [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if err := writeSpoolBatch(path, left); err != nil {
+		slog.Warn("failed to rewrite partly sent spool batch, it'll be sent again in full", "path", path, "err", err)
+	}
+}
+
+// Metrics returns the number of events spooled, replayed, evicted to stay
+// under the size cap and lost to write failures, and the number of corrupt
+// batches skipped.
+func (s *Spool) Metrics() map[string]uint64 {
+	return map[string]uint64{
+		"spooled":  s.spooled.Load(),
+		"replayed": s.replayed.Load(),
+		"evicted":  s.evicted.Load(),
+		"failed":   s.failed.Load(),
+		"corrupt":  s.corrupt.Load(),
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) Subtrace, Inc.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func smallSpoolBatches(t *testing.T, n int) {
+	prev := spoolBatchEvents
+	spoolBatchEvents = n
+	t.Cleanup(func() { spoolBatchEvents = prev })
+}
+
+func replayAll(t *testing.T, s *Spool) []string {
+	t.Helper()
+	var got []string
+	if _, err := s.Replay(func(b []byte) error {
+		got = append(got, string(b))
+		return nil
+	}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	return got
+}
+
+// TestSpoolCorruptBatch checks that a batch that's cut short or garbled is
+// skipped without keeping the others from being replayed.
+func TestSpoolCorruptBatch(t *testing.T) {
+	smallSpoolBatches(t, 2)
+	s, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := range 8 {
+		if err := s.Add([]byte(fmt.Sprintf("event %d", i))); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	paths, err := s.Batches()
+	if err != nil || len(paths) != 4 {
+		t.Fatalf("got batches %v, err=%v, want 4", paths, err)
+	}
+
+	b, _ := os.ReadFile(paths[1])
+	os.WriteFile(paths[1], b[:len(b)-3], 0o600)
+	b, _ = os.ReadFile(paths[2])
+	b[len(b)-1] ^= 0xff
+	os.WriteFile(paths[2], b, 0o600)
+
+	want := "event 0,event 1,event 6,event 7"
+	if got := replayAll(t, s); strings.Join(got, ",") != want {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+	if m := s.Metrics(); m["corrupt"] != 2 || m["replayed"] != 4 {
+		t.Errorf("got metrics %v", m)
+	}
+	if paths, _ := s.Batches(); len(paths) != 0 {
+		t.Errorf("batches left after replay: %v", paths)
+	}
+}
+
+// TestSpoolEviction checks that the oldest batches are evicted once the spool
+// is over its size cap.
+func TestSpoolEviction(t *testing.T) {
+	smallSpoolBatches(t, 1)
+	event := strings.Repeat("x", 100)
+	s, err := OpenSpool(t.TempDir(), 1000)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := range 20 {
+		if err := s.Add([]byte(fmt.Sprintf("%02d%s", i, event))); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	paths, _ := s.Batches()
+	var total int64
+	for _, path := range paths {
+		fi, _ := os.Stat(path)
+		total += fi.Size()
+	}
+	if total > 1000 {
+		t.Errorf("spool takes %d bytes, want at most 1000", total)
+	}
+	got := replayAll(t, s)
+	if len(got) == 0 || !strings.HasPrefix(got[len(got)-1], "19") || !strings.HasPrefix(got[0], fmt.Sprintf("%02d", 20-len(got))) {
+		t.Errorf("replayed %d events, want the newest ones", len(got))
+	}
+	if m := s.Metrics(); m["evicted"]+uint64(len(got)) != 20 {
+		t.Errorf("got metrics %v with %d replayed", m, len(got))
+	}
+}
+
+// TestSpoolPartialReplay checks that a replay that fails midway keeps only
+// the events that weren't sent.
+func TestSpoolPartialReplay(t *testing.T) {
+	smallSpoolBatches(t, 4)
+	s, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := range 6 {
+		s.Add([]byte(fmt.Sprintf("%d", i)))
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	n, err := s.Replay(func(b []byte) error {
+		if string(b) == "2" {
+			return fmt.Errorf("connection reset")
+		}
+		return nil
+	})
+	if n != 2 || err == nil {
+		t.Fatalf("replay sent %d, err=%v, want 2 and an error", n, err)
+	}
+	if got := replayAll(t, s); strings.Join(got, "") != "2345" {
+		t.Errorf("replayed %q after the failure, want 2345", got)
+	}
+}
+
+// TestPublisherSpool checks that events the publisher couldn't upload before
+// exiting are spooled and uploaded by the next publisher.
+func TestPublisherSpool(t *testing.T) {
+	fastBackoff(t)
+	circuitThreshold = 1 << 20 // keep the events queued until exit
+	dir := t.TempDir()
+
+	var healthy atomic.Bool
+	b := newFakeBackend(t, func(r *http.Request, w http.ResponseWriter) int {
+		if healthy.Load() {
+			return 0
+		}
+		return http.StatusServiceUnavailable
+	})
+
+	s, err := OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	p := &publisher{ch: make(chan []byte, 16)}
+	p.SetSpool(s)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Loop(ctx)
+	}()
+	for i := range 3 {
+		if err := p.queueWrite([]byte(fmt.Sprintf("event %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.Flush(50 * time.Millisecond) {
+		t.Fatalf("flushed to an unavailable endpoint")
+	}
+	if n, err := p.Spill(); n != 3 || err != nil {
+		t.Fatalf("spilled %d, err=%v, want 3", n, err)
+	}
+	cancel()
+	<-done
+	if m := p.Metrics(); m["dropped"] != 0 || m["spool.spooled"] != 3 {
+		t.Fatalf("got metrics %v", m)
+	}
+
+	healthy.Store(true)
+	s, err = OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	p = &publisher{ch: make(chan []byte, 16)}
+	p.SetSpool(s)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if n, err := p.ReplaySpool(ctx, s); n != 3 || err != nil {
+		t.Fatalf("replayed %d, err=%v, want 3", n, err)
+	}
+	for i := range 3 {
+		expectReceived(t, b, fmt.Sprintf("event %d", i))
+	}
+	if paths, _ := s.Batches(); len(paths) != 0 {
+		t.Errorf("batches left after replay: %v", paths)
+	}
+}